@@ -0,0 +1,417 @@
+// Package admin implements an HTTP control plane for a
+// netdicom.ServiceProvider. It is a thin layer over the provider's public API:
+//
+//	GET  /health                     ServiceProvider.Health, as JSON
+//	GET  /associations               ServiceProvider.Associations, as JSON
+//	GET  /capabilities               ServiceProvider.Capabilities, as JSON
+//	GET  /conformance                Capabilities.Summary, as text
+//	POST /associations/<id>/abort    ServiceProvider.Abort
+//	POST /drain                      ServiceProvider.Drain
+//	POST /resume                     ServiceProvider.CancelDrain
+//	POST /reload                     Handler.Reload
+//	POST /loglevel?level=<n>         dicomlog.SetLevel
+//	GET  /metrics                    Prometheus text exposition
+//	GET  /peers                      Handler.Monitor's PeerMonitor.Status, as JSON
+//
+// The handler performs no authentication; serve it on a loopback or otherwise
+// trusted address, or wrap it.
+//
+//	h := &admin.Handler{Provider: sp}
+//	go http.ListenAndServe("localhost:8081", h)
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/antibios/go-dicom/dicomlog"
+	"github.com/antibios/go-netdicom"
+)
+
+// Handler serves the admin endpoints for a provider.
+type Handler struct {
+	Provider *netdicom.ServiceProvider
+
+	// Reload, if non-nil, is called by POST /reload, e.g., to re-read the
+	// configuration file.
+	Reload func() error
+
+	// Monitor, if non-nil, is reported by GET /peers and /metrics.
+	Monitor *netdicom.PeerMonitor
+}
+
+// Association is the JSON form of netdicom.AssociationInfo.
+type Association struct {
+	ID             string    `json:"id"`
+	RemoteAddr     string    `json:"remoteAddr"`
+	CallingAETitle string    `json:"callingAETitle"`
+	StartTime      time.Time `json:"startTime"`
+	Goroutines     int       `json:"goroutines"`
+	ActiveCommands int       `json:"activeCommands"`
+	BufferedBytes  int64     `json:"bufferedBytes"`
+	HandlerBytes   int64     `json:"handlerBytes"`
+
+	UnexpectedMessages int64 `json:"unexpectedMessages"`
+
+	Peer Peer `json:"peer"`
+}
+
+// Peer is the JSON form of netdicom.Peer.
+type Peer struct {
+	IP                        string `json:"ip"`
+	Port                      int    `json:"port"`
+	CallingAETitle            string `json:"callingAETitle"`
+	CalledAETitle             string `json:"calledAETitle"`
+	TLSCommonName             string `json:"tlsCommonName"`
+	ImplementationClassUID    string `json:"implementationClassUID"`
+	ImplementationVersionName string `json:"implementationVersionName"`
+	MaxPDUSize                int    `json:"maxPDUSize"`
+	MaxOpsInvoked             int    `json:"maxOpsInvoked"`
+	MaxOpsPerformed           int    `json:"maxOpsPerformed"`
+}
+
+// Health is the JSON form of netdicom.ProviderHealth.
+type Health struct {
+	ListenAddr      string `json:"listenAddr"`
+	NumAssociations int    `json:"numAssociations"`
+	Draining        bool   `json:"draining"`
+	Drained         bool   `json:"drained"`
+
+	UnexpectedMessages int64 `json:"unexpectedMessages"`
+
+	// DroppedConnections is keyed by netdicom.DropCause.String().
+	DroppedConnections map[string]int64 `json:"droppedConnections"`
+}
+
+// PeerStatus is the JSON form of netdicom.PeerStatus.
+type PeerStatus struct {
+	AETitle              string    `json:"aeTitle"`
+	Address              string    `json:"address"`
+	State                string    `json:"state"`
+	Since                time.Time `json:"since"`
+	LastCheck            time.Time `json:"lastCheck"`
+	LastError            string    `json:"lastError,omitempty"`
+	LastLatencyMillis    float64   `json:"lastLatencyMillis"`
+	ConsecutiveFailures  int       `json:"consecutiveFailures"`
+	ConsecutiveSuccesses int       `json:"consecutiveSuccesses"`
+	Transitions          int       `json:"transitions"`
+}
+
+// Capabilities is the JSON form of netdicom.Capabilities.
+type Capabilities struct {
+	AETitle                   string               `json:"aeTitle"`
+	ImplementationClassUID    string               `json:"implementationClassUID"`
+	ImplementationVersionName string               `json:"implementationVersionName"`
+	MaxPDUSize                int                  `json:"maxPDUSize"`
+	TLS                       bool                 `json:"tls"`
+	AllowedCallingAETitles    []string             `json:"allowedCallingAETitles"`
+	AnySOPClass               bool                 `json:"anySOPClass"`
+	SOPClasses                []SOPClassCapability `json:"sopClasses"`
+	TransferSyntaxes          []string             `json:"transferSyntaxes"`
+	MaxOpsPerformed           int                  `json:"maxOpsPerformed"`
+	MaxOpsInvoked             int                  `json:"maxOpsInvoked"`
+}
+
+// SOPClassCapability is the JSON form of netdicom.SOPClassCapability.
+type SOPClassCapability struct {
+	UID         string `json:"uid"`
+	Service     string `json:"service"`
+	Role        string `json:"role"`
+	Implemented bool   `json:"implemented"`
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.Path, "/")
+	switch {
+	case path == "health":
+		h.get(w, r, h.health)
+	case path == "associations":
+		h.get(w, r, h.associations)
+	case path == "capabilities":
+		h.get(w, r, h.capabilities)
+	case path == "conformance":
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, h.Provider.Capabilities().Summary())
+	case strings.HasPrefix(path, "associations/") && strings.HasSuffix(path, "/abort"):
+		id := strings.TrimSuffix(strings.TrimPrefix(path, "associations/"), "/abort")
+		h.post(w, r, func() error { return h.Provider.Abort(id) })
+	case path == "drain":
+		h.post(w, r, func() error {
+			h.Provider.Drain()
+			return nil
+		})
+	case path == "resume":
+		h.post(w, r, func() error {
+			h.Provider.CancelDrain()
+			return nil
+		})
+	case path == "reload":
+		if h.Reload == nil {
+			http.Error(w, "reload is not configured", http.StatusNotImplemented)
+			return
+		}
+		h.post(w, r, h.Reload)
+	case path == "loglevel":
+		h.post(w, r, func() error {
+			level, err := strconv.Atoi(r.URL.Query().Get("level"))
+			if err != nil {
+				return fmt.Errorf("bad level: %v", err)
+			}
+			dicomlog.SetLevel(level)
+			return nil
+		})
+	case path == "peers":
+		if h.Monitor == nil {
+			http.Error(w, "peer monitoring is not configured", http.StatusNotImplemented)
+			return
+		}
+		h.get(w, r, h.peers)
+	case path == "metrics":
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h.metrics(w)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Serve a GET request with the JSON encoding of fn().
+func (h *Handler) get(w http.ResponseWriter, r *http.Request, fn func() interface{}) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fn())
+}
+
+// Serve a POST request by running fn. An error is reported as 400.
+func (h *Handler) post(w http.ResponseWriter, r *http.Request, fn func() error) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := fn(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) health() interface{} {
+	ph := h.Provider.Health()
+	out := Health{
+		ListenAddr:      ph.ListenAddr.String(),
+		NumAssociations: ph.NumAssociations,
+		Draining:        ph.Draining,
+		Drained:         ph.Drained,
+
+		UnexpectedMessages: ph.UnexpectedMessages,
+		DroppedConnections: map[string]int64{},
+	}
+	for cause, n := range ph.DroppedConnections {
+		out.DroppedConnections[cause.String()] = n
+	}
+	return out
+}
+
+func (h *Handler) associations() interface{} {
+	assocs := []Association{}
+	for _, a := range h.Provider.Associations() {
+		assocs = append(assocs, Association{
+			ID:             a.ID,
+			RemoteAddr:     a.RemoteAddr.String(),
+			CallingAETitle: a.CallingAETitle,
+			StartTime:      a.StartTime,
+			Goroutines:     a.Goroutines,
+			ActiveCommands: a.ActiveCommands,
+			BufferedBytes:  a.BufferedBytes,
+			HandlerBytes:   a.HandlerBytes,
+
+			UnexpectedMessages: a.UnexpectedMessages,
+
+			Peer: Peer{
+				IP:                        a.Peer.IP,
+				Port:                      a.Peer.Port,
+				CallingAETitle:            a.Peer.CallingAETitle,
+				CalledAETitle:             a.Peer.CalledAETitle,
+				TLSCommonName:             a.Peer.TLSCommonName,
+				ImplementationClassUID:    a.Peer.ImplementationClassUID,
+				ImplementationVersionName: a.Peer.ImplementationVersionName,
+				MaxPDUSize:                a.Peer.MaxPDUSize,
+				MaxOpsInvoked:             a.Peer.MaxOpsInvoked,
+				MaxOpsPerformed:           a.Peer.MaxOpsPerformed,
+			},
+		})
+	}
+	return assocs
+}
+
+func (h *Handler) capabilities() interface{} {
+	c := h.Provider.Capabilities()
+	out := Capabilities{
+		AETitle:                   c.AETitle,
+		ImplementationClassUID:    c.ImplementationClassUID,
+		ImplementationVersionName: c.ImplementationVersionName,
+		MaxPDUSize:                c.MaxPDUSize,
+		TLS:                       c.TLS,
+		AllowedCallingAETitles:    c.AllowedCallingAETitles,
+		AnySOPClass:               c.AnySOPClass,
+		SOPClasses:                []SOPClassCapability{},
+		TransferSyntaxes:          c.TransferSyntaxes,
+		MaxOpsPerformed:           c.MaxOpsPerformed,
+		MaxOpsInvoked:             c.MaxOpsInvoked,
+	}
+	for _, s := range c.SOPClasses {
+		out.SOPClasses = append(out.SOPClasses, SOPClassCapability{
+			UID:         s.UID,
+			Service:     s.Service,
+			Role:        s.Role,
+			Implemented: s.Implemented,
+		})
+	}
+	return out
+}
+
+func (h *Handler) peers() interface{} {
+	peers := []PeerStatus{}
+	for _, s := range h.Monitor.Status() {
+		p := PeerStatus{
+			AETitle:              s.AETitle,
+			Address:              s.Address,
+			State:                s.State.String(),
+			Since:                s.Since,
+			LastCheck:            s.LastCheck,
+			LastLatencyMillis:    float64(s.LastLatency) / float64(time.Millisecond),
+			ConsecutiveFailures:  s.ConsecutiveFailures,
+			ConsecutiveSuccesses: s.ConsecutiveSuccesses,
+			Transitions:          s.Transitions,
+		}
+		if s.LastError != nil {
+			p.LastError = s.LastError.Error()
+		}
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+func (h *Handler) metrics(w http.ResponseWriter) {
+	ph := h.Provider.Health()
+	assocs := h.Provider.Associations()
+	var goroutines, commands int
+	var buffered, handler int64
+	for _, a := range assocs {
+		goroutines += a.Goroutines
+		commands += a.ActiveCommands
+		buffered += a.BufferedBytes
+		handler += a.HandlerBytes
+	}
+	draining := 0
+	if ph.Draining {
+		draining = 1
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range []struct {
+		name, help, typ string
+		value           int64
+	}{
+		{"netdicom_associations", "Associations being served.", "gauge", int64(ph.NumAssociations)},
+		{"netdicom_association_goroutines", "Goroutines running on behalf of associations.", "gauge", int64(goroutines)},
+		{"netdicom_active_commands", "DIMSE commands being handled.", "gauge", int64(commands)},
+		{"netdicom_buffered_bytes", "Bytes of DIMSE messages being assembled.", "gauge", buffered},
+		{"netdicom_handler_bytes", "Bytes of DIMSE payloads held by handlers.", "gauge", handler},
+		{"netdicom_draining", "1 if the provider is draining.", "gauge", int64(draining)},
+		{"netdicom_unexpected_messages_total", "DIMSE messages that matched no request or handler.", "counter", ph.UnexpectedMessages},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", m.name, m.help, m.name, m.typ, m.name, m.value)
+	}
+	const dropped = "netdicom_dropped_connections_total"
+	fmt.Fprintf(w, "# HELP %s Connections closed because of a timeout or limit.\n# TYPE %s counter\n", dropped, dropped)
+	for cause := netdicom.DropCause(0); cause < netdicom.NumDropCauses; cause++ {
+		fmt.Fprintf(w, "%s{cause=\"%s\"} %d\n", dropped, escapeLabelValue(cause.String()), ph.DroppedConnections[cause])
+	}
+	const info = "netdicom_association_info"
+	fmt.Fprintf(w, "# HELP %s Associations being served, by peer.\n# TYPE %s gauge\n", info, info)
+	byPeer := map[string]int{}
+	for _, a := range assocs {
+		byPeer[peerLabels(a.Peer)]++
+	}
+	peerKeys := make([]string, 0, len(byPeer))
+	for k := range byPeer {
+		peerKeys = append(peerKeys, k)
+	}
+	sort.Strings(peerKeys)
+	for _, k := range peerKeys {
+		fmt.Fprintf(w, "%s{%s} %d\n", info, k, byPeer[k])
+	}
+	if h.Monitor != nil {
+		h.peerMetrics(w)
+	}
+}
+
+// Write the metrics of h.Monitor.
+func (h *Handler) peerMetrics(w http.ResponseWriter) {
+	const (
+		up          = "netdicom_peer_up"
+		latency     = "netdicom_peer_echo_latency_seconds"
+		transitions = "netdicom_peer_transitions_total"
+	)
+	peers := h.Monitor.Status()
+	fmt.Fprintf(w, "# HELP %s 1 if the peer answers C-ECHO, 0 if it is down, -1 if unknown.\n# TYPE %s gauge\n", up, up)
+	for _, p := range peers {
+		v := -1
+		switch p.State {
+		case netdicom.PeerUp:
+			v = 1
+		case netdicom.PeerDown:
+			v = 0
+		}
+		fmt.Fprintf(w, "%s{ae_title=\"%s\"} %d\n", up, escapeLabelValue(p.AETitle), v)
+	}
+	fmt.Fprintf(w, "# HELP %s Duration of the last successful C-ECHO.\n# TYPE %s gauge\n", latency, latency)
+	for _, p := range peers {
+		fmt.Fprintf(w, "%s{ae_title=\"%s\"} %g\n", latency, escapeLabelValue(p.AETitle), p.LastLatency.Seconds())
+	}
+	fmt.Fprintf(w, "# HELP %s Changes between up and down.\n# TYPE %s counter\n", transitions, transitions)
+	for _, p := range peers {
+		fmt.Fprintf(w, "%s{ae_title=\"%s\"} %d\n", transitions, escapeLabelValue(p.AETitle), p.Transitions)
+	}
+}
+
+// Format the labels of a per-peer metric. The association ID and the
+// ephemeral port are left out, since each association would get its own
+// series.
+func peerLabels(peer netdicom.Peer) string {
+	labels := peer.Labels()
+	delete(labels, "port")
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = fmt.Sprintf("%s=\"%s\"", k, escapeLabelValue(labels[k]))
+	}
+	return strings.Join(pairs, ",")
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Escape a label value for the Prometheus text format, which escapes only
+// backslash, double quote and line feed. Other characters, including
+// non-ASCII ones, are written as is, in UTF-8.
+func escapeLabelValue(v string) string {
+	return labelValueEscaper.Replace(v)
+}
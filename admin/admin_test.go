@@ -0,0 +1,108 @@
+package admin
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/antibios/go-netdicom"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler(t *testing.T) {
+	sp, err := netdicom.NewServiceProvider(netdicom.ServiceProviderParams{}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+	reloads := 0
+	monitor := netdicom.NewPeerMonitor(netdicom.PeerMonitorParams{
+		Peers:    map[string]string{"SELF": sp.ListenAddr().String()},
+		Interval: time.Hour,
+	})
+	defer monitor.Close()
+	monitor.CheckNow()
+	server := httptest.NewServer(&Handler{Provider: sp, Monitor: monitor, Reload: func() error {
+		reloads++
+		return nil
+	}})
+	defer server.Close()
+
+	getHealth := func() Health {
+		resp, err := http.Get(server.URL + "/health")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		var h Health
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&h))
+		return h
+	}
+	post := func(path string) int {
+		resp, err := http.Post(server.URL+path, "", nil)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	require.False(t, getHealth().Draining)
+	require.Contains(t, getHealth().DroppedConnections, "idle_timeout")
+	require.Equal(t, http.StatusNoContent, post("/drain"))
+	require.True(t, getHealth().Draining)
+	require.Equal(t, http.StatusNoContent, post("/resume"))
+	require.False(t, getHealth().Draining)
+
+	require.Equal(t, http.StatusNoContent, post("/reload"))
+	require.Equal(t, 1, reloads)
+	require.Equal(t, http.StatusBadRequest, post("/associations/nonexistent/abort"))
+	require.Equal(t, http.StatusBadRequest, post("/loglevel?level=x"))
+
+	resp, err := http.Get(server.URL + "/associations")
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.JSONEq(t, "[]", string(body))
+
+	resp, err = http.Get(server.URL + "/metrics")
+	require.NoError(t, err)
+	body, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.Contains(t, string(body), "netdicom_associations 0\n")
+	require.Contains(t, string(body), `netdicom_dropped_connections_total{cause="slow_transfer"} 0`+"\n")
+	// The provider has no C-ECHO handler.
+	require.Contains(t, string(body), `netdicom_peer_up{ae_title="SELF"} 0`+"\n")
+
+	resp, err = http.Get(server.URL + "/peers")
+	require.NoError(t, err)
+	var peers []PeerStatus
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&peers))
+	resp.Body.Close()
+	require.Len(t, peers, 1)
+	require.Equal(t, "down", peers[0].State)
+
+	resp, err = http.Get(server.URL + "/capabilities")
+	require.NoError(t, err)
+	var c Capabilities
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&c))
+	resp.Body.Close()
+	require.Equal(t, netdicom.DefaultMaxPDUSize, c.MaxPDUSize)
+	require.NotEmpty(t, c.SOPClasses)
+
+	resp, err = http.Get(server.URL + "/conformance")
+	require.NoError(t, err)
+	body, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.Contains(t, string(body), "SOP classes:")
+}
+
+func TestLabels(t *testing.T) {
+	require.Equal(t, `a\\b\"c\nd ÄE`+"\t", escapeLabelValue("a\\b\"c\nd ÄE\t"))
+
+	// Associations from the same peer share a series.
+	peer := netdicom.Peer{IP: "10.0.0.1", Port: 50123, CallingAETitle: "CT\"1"}
+	require.Equal(t, `calling_ae="CT\"1",ip="10.0.0.1"`, peerLabels(peer))
+	peer.Port = 50124
+	require.Equal(t, `calling_ae="CT\"1",ip="10.0.0.1"`, peerLabels(peer))
+}
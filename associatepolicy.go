@@ -0,0 +1,85 @@
+package netdicom
+
+// This file implements ServiceProviderParams.OnAssociateRequest: letting the
+// application accept or reject each association request, e.g., against its
+// own list of peers and their addresses.
+
+import (
+	"errors"
+	"net"
+
+	"github.com/antibios/go-netdicom/pdu"
+)
+
+// ProposedContext is a presentation context of an A-ASSOCIATE-RQ.
+type ProposedContext struct {
+	ContextID          byte
+	AbstractSyntaxUID  string
+	TransferSyntaxUIDs []string
+}
+
+// AssociateRequest describes an A-ASSOCIATE-RQ received by a ServiceProvider.
+type AssociateRequest struct {
+	// AE titles of the request, without padding.
+	CallingAETitle string
+	CalledAETitle  string
+	// RemoteAddr is the address of the peer.
+	RemoteAddr net.Addr
+	// PresentationContexts are the contexts proposed, in order.
+	PresentationContexts []ProposedContext
+	// UserInformation is the sub-items of the user information item, as
+	// decoded. Those this package doesn't know, e.g., private ones, are
+	// *pdu.SubItemUnsupported.
+	UserInformation []pdu.SubItem
+}
+
+// AssociateRequestCallback decides whether to accept an association request.
+// It returns nil to accept it, as far as the other checks of the provider
+// allow. To reject it, it returns an *AssociationRejectedError, whose Result,
+// Source and Reason are sent to the peer in A-ASSOCIATE-RJ, or another error,
+// which is sent as a permanent rejection by the service user with no reason
+// given.
+type AssociateRequestCallback func(rq AssociateRequest) error
+
+// Build the AssociateRequest of "v", received on "conn".
+func newAssociateRequest(v *pdu.AAssociate, conn net.Conn) AssociateRequest {
+	rq := AssociateRequest{
+		CallingAETitle: pdu.NormalizeAETitle(v.CallingAETitle),
+		CalledAETitle:  pdu.NormalizeAETitle(v.CalledAETitle),
+	}
+	if conn != nil {
+		rq.RemoteAddr = conn.RemoteAddr()
+	}
+	for _, item := range v.Items {
+		if ui, ok := item.(*pdu.UserInformationItem); ok {
+			rq.UserInformation = append(rq.UserInformation, ui.Items...)
+		}
+	}
+	for _, item := range extractPresentationContextItems(v.Items) {
+		pc := ProposedContext{ContextID: item.ContextID}
+		for _, subItem := range item.Items {
+			switch c := subItem.(type) {
+			case *pdu.AbstractSyntaxSubItem:
+				pc.AbstractSyntaxUID = c.Name
+			case *pdu.TransferSyntaxSubItem:
+				pc.TransferSyntaxUIDs = append(pc.TransferSyntaxUIDs, c.Name)
+			}
+		}
+		rq.PresentationContexts = append(rq.PresentationContexts, pc)
+	}
+	return rq
+}
+
+// Returns the A-ASSOCIATE-RJ for "err", returned by an
+// AssociateRequestCallback.
+func associateRejection(err error) *pdu.AAssociateRj {
+	var rj *AssociationRejectedError
+	if errors.As(err, &rj) {
+		return &pdu.AAssociateRj{Result: rj.Result, Source: rj.Source, Reason: rj.Reason}
+	}
+	return &pdu.AAssociateRj{
+		Result: pdu.ResultRejectedPermanent,
+		Source: pdu.SourceULServiceUser,
+		Reason: pdu.RejectReasonNone,
+	}
+}
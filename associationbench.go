@@ -0,0 +1,209 @@
+package netdicom
+
+// This file implements BenchmarkAssociations: setting up and releasing
+// associations with a peer in a loop, without any DIMSE message, and
+// reporting the latency of each phase. When "PACS is slow", it tells a slow
+// network, which shows in the TCP connection, from a slow peer, which shows in
+// the association handshake.
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/antibios/go-netdicom/sopclass"
+)
+
+// DefaultAssociationBenchCount is the default value of
+// AssociationBenchParams.Count.
+const DefaultAssociationBenchCount = 10
+
+// AssociationBenchParams configures BenchmarkAssociations.
+type AssociationBenchParams struct {
+	// Address of the peer, "host:port".
+	Address string
+
+	// Count is the number of associations to set up, one after the other.
+	// If zero, DefaultAssociationBenchCount is used.
+	Count int
+
+	// Interval is the pause between associations.
+	Interval time.Duration
+
+	// Timeout bounds each association, from the connection to the release.
+	// If zero, DefaultPeerEchoTimeout is used.
+	Timeout time.Duration
+
+	// ServiceUser configures the associations, e.g., the AE titles. If
+	// SOPClasses is empty, the verification class is proposed.
+	ServiceUser ServiceUserParams
+}
+
+// AssociationTiming is the latency of the phases of one association.
+type AssociationTiming struct {
+	// Connect is the time to set up the TCP connection, and the TLS
+	// handshake if any.
+	Connect time.Duration
+	// Associate is the time from the connection to A-ASSOCIATE-AC.
+	Associate time.Duration
+	// Release is the time from A-RELEASE-RQ to A-RELEASE-RP.
+	Release time.Duration
+	// Total is the sum of the above.
+	Total time.Duration
+}
+
+// LatencyStats summarizes a set of latencies.
+type LatencyStats struct {
+	Min, P50, P90, P99, Max time.Duration
+}
+
+// Returns the stats of "samples", which is sorted in place.
+func newLatencyStats(samples []time.Duration) LatencyStats {
+	if len(samples) == 0 {
+		return LatencyStats{}
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	// Nearest rank.
+	percentile := func(p int) time.Duration {
+		i := (p*len(samples) + 99) / 100
+		if i < 1 {
+			i = 1
+		}
+		return samples[i-1]
+	}
+	return LatencyStats{
+		Min: samples[0],
+		P50: percentile(50),
+		P90: percentile(90),
+		P99: percentile(99),
+		Max: samples[len(samples)-1],
+	}
+}
+
+func (s LatencyStats) String() string {
+	return fmt.Sprintf("min %v p50 %v p90 %v p99 %v max %v", s.Min, s.P50, s.P90, s.P99, s.Max)
+}
+
+// AssociationBenchReport is the outcome of BenchmarkAssociations.
+type AssociationBenchReport struct {
+	// Timings of the associations that succeeded, in order.
+	Timings []AssociationTiming
+	// Errors of the associations that failed, in order.
+	Errors []error
+
+	// Stats of the associations that succeeded, per phase.
+	Connect, Associate, Release, Total LatencyStats
+}
+
+// String formats the report, one line per phase.
+func (r *AssociationBenchReport) String() string {
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "%d associations, %d failed\n", len(r.Timings)+len(r.Errors), len(r.Errors))
+	if len(r.Timings) > 0 {
+		fmt.Fprintf(&b, "connect:   %v\n", r.Connect)
+		fmt.Fprintf(&b, "associate: %v\n", r.Associate)
+		fmt.Fprintf(&b, "release:   %v\n", r.Release)
+		fmt.Fprintf(&b, "total:     %v\n", r.Total)
+	}
+	return b.String()
+}
+
+// BenchmarkAssociations sets up associations with the peer at params.Address,
+// one after the other, and releases each right away, with no DIMSE message in
+// between. The associations that fail are counted in the report, and don't
+// stop the run. Returns early, with the associations made so far, if "ctx" is
+// done.
+func BenchmarkAssociations(ctx context.Context, params AssociationBenchParams) (*AssociationBenchReport, error) {
+	if params.Address == "" {
+		return nil, fmt.Errorf("dicom.BenchmarkAssociations: empty Address")
+	}
+	if params.Count <= 0 {
+		params.Count = DefaultAssociationBenchCount
+	}
+	if params.Timeout <= 0 {
+		params.Timeout = DefaultPeerEchoTimeout
+	}
+	if len(params.ServiceUser.SOPClasses) == 0 {
+		params.ServiceUser.SOPClasses = sopclass.VerificationClasses
+	}
+	if err := validateServiceUserParams(&params.ServiceUser); err != nil {
+		return nil, err
+	}
+	r := &AssociationBenchReport{}
+	for i := 0; i < params.Count && ctx.Err() == nil; i++ {
+		if i > 0 && params.Interval > 0 {
+			select {
+			case <-time.After(params.Interval):
+			case <-ctx.Done():
+			}
+		}
+		timing, err := benchmarkAssociation(ctx, params)
+		if err != nil {
+			r.Errors = append(r.Errors, err)
+			continue
+		}
+		r.Timings = append(r.Timings, timing)
+	}
+	var connect, associate, release, total []time.Duration
+	for _, t := range r.Timings {
+		connect = append(connect, t.Connect)
+		associate = append(associate, t.Associate)
+		release = append(release, t.Release)
+		total = append(total, t.Total)
+	}
+	r.Connect = newLatencyStats(connect)
+	r.Associate = newLatencyStats(associate)
+	r.Release = newLatencyStats(release)
+	r.Total = newLatencyStats(total)
+	return r, nil
+}
+
+// Set up and release one association.
+func benchmarkAssociation(ctx context.Context, params AssociationBenchParams) (AssociationTiming, error) {
+	var t AssociationTiming
+	ctx, cancel := context.WithTimeout(ctx, params.Timeout)
+	defer cancel()
+	start := time.Now()
+	conn, err := dialTCP(ctx, params.Address, params.ServiceUser.Dial)
+	if err == nil && params.ServiceUser.TLSConfig != nil {
+		conn, err = tlsClientHandshake(ctx, conn, params.Address, params.ServiceUser.TLSConfig, params.ServiceUser.Dial)
+	}
+	if err != nil {
+		return t, err
+	}
+	t.Connect = time.Since(start)
+
+	su, err := NewServiceUser(params.ServiceUser)
+	if err != nil {
+		conn.Close()
+		return t, err
+	}
+	start = time.Now()
+	su.SetConn(conn)
+	// Abort the association when the context ends, which unblocks the
+	// waits below.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			su.Association().Abort(fmt.Errorf("dicom.BenchmarkAssociations: no answer from %s within %v", params.Address, params.Timeout)) // nolint: errcheck
+		case <-done:
+		}
+	}()
+	if err := su.waitUntilReady(); err != nil {
+		su.Release()
+		return t, err
+	}
+	t.Associate = time.Since(start)
+
+	start = time.Now()
+	if err := su.Release(); err != nil {
+		return t, err
+	}
+	t.Release = time.Since(start)
+	t.Total = t.Connect + t.Associate + t.Release
+	return t, nil
+}
@@ -0,0 +1,52 @@
+package netdicom
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBenchmarkAssociations(t *testing.T) {
+	r, err := BenchmarkAssociations(context.Background(), AssociationBenchParams{
+		Address: provider.ListenAddr().String(),
+		Count:   5,
+	})
+	require.NoError(t, err)
+	require.Empty(t, r.Errors)
+	require.Len(t, r.Timings, 5)
+	for _, timing := range r.Timings {
+		require.Equal(t, timing.Connect+timing.Associate+timing.Release, timing.Total)
+	}
+	require.LessOrEqual(t, r.Total.Min, r.Total.P50)
+	require.LessOrEqual(t, r.Total.P99, r.Total.Max)
+	require.Contains(t, r.String(), "5 associations, 0 failed")
+
+	// A peer that doesn't listen fails each association, in the
+	// connection.
+	listener, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	addr := listener.Addr().String()
+	listener.Close()
+	r, err = BenchmarkAssociations(context.Background(), AssociationBenchParams{Address: addr, Count: 2})
+	require.NoError(t, err)
+	require.Len(t, r.Errors, 2)
+	require.Empty(t, r.Timings)
+}
+
+func TestLatencyStats(t *testing.T) {
+	var samples []time.Duration
+	for i := 100; i >= 1; i-- {
+		samples = append(samples, time.Duration(i)*time.Millisecond)
+	}
+	require.Equal(t, LatencyStats{
+		Min: time.Millisecond,
+		P50: 50 * time.Millisecond,
+		P90: 90 * time.Millisecond,
+		P99: 99 * time.Millisecond,
+		Max: 100 * time.Millisecond,
+	}, newLatencyStats(samples))
+	require.Equal(t, LatencyStats{}, newLatencyStats(nil))
+}
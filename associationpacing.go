@@ -0,0 +1,157 @@
+package netdicom
+
+// This file implements PeerProfile: spacing out the associations a process
+// opens to a peer, for legacy SCPs that misbehave when a new association
+// arrives right after one is released.
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// PeerProfile describes how associations to a peer must be paced. It is set in
+// ServiceUserParams.PeerProfile, or, for the sub-operations of C-MOVE, in
+// ServiceProviderParams.CMoveUser and CMovePeerProfiles. It applies to all the
+// associations of the process to the same "host:port" with a profile, e.g.,
+// those of an OutboundQueue and of the C-MOVEs served to the same peer.
+type PeerProfile struct {
+	// AssociationDelay is the minimum time between the end of an
+	// association to the peer and the start of the next one.
+	AssociationDelay time.Duration
+
+	// MaxAssociationsPerSecond, if positive, caps the rate at which
+	// associations to the peer are started.
+	MaxAssociationsPerSecond float64
+}
+
+func (p *PeerProfile) validate() error {
+	if p == nil {
+		return nil
+	}
+	if p.AssociationDelay < 0 {
+		return fmt.Errorf("PeerProfile.AssociationDelay: negative value %v", p.AssociationDelay)
+	}
+	if p.MaxAssociationsPerSecond < 0 {
+		return fmt.Errorf("PeerProfile.MaxAssociationsPerSecond: negative value %v", p.MaxAssociationsPerSecond)
+	}
+	return nil
+}
+
+// peerPacer tracks the associations to one peer.
+type peerPacer struct {
+	mu sync.Mutex
+	// Number of ServiceUsers that got the pacer and haven't ended their
+	// association yet.
+	users     int
+	lastStart time.Time
+	lastEnd   time.Time
+	// When the profiles applied so far stop delaying the next
+	// association. From then on, an idle pacer is no different from a new
+	// one.
+	idleAt time.Time
+}
+
+var (
+	peerPacersMu sync.Mutex
+	peerPacers   = map[string]*peerPacer{} // keyed by "host:port"
+	// Size of peerPacers at which it is next pruned.
+	peerPacersPruneAt = minPeerPacersPruneAt
+)
+
+// Size of peerPacers below which it isn't pruned.
+const minPeerPacersPruneAt = 64
+
+// Returns the pacer of the peer at "addr". The caller must call end, or
+// release if it doesn't start an association.
+func getPeerPacer(addr string, clock Clock) *peerPacer {
+	peerPacersMu.Lock()
+	defer peerPacersMu.Unlock()
+	p, ok := peerPacers[addr]
+	if !ok {
+		if len(peerPacers) >= peerPacersPruneAt {
+			prunePeerPacersLocked(clock.Now())
+		}
+		p = &peerPacer{}
+		peerPacers[addr] = p
+	}
+	p.mu.Lock()
+	p.users++
+	p.mu.Unlock()
+	return p
+}
+
+// Drop the pacers that no ServiceUser holds and that no longer delay the next
+// association, so that peerPacers doesn't grow with every address ever
+// connected to. Pruning is amortized: the map is pruned again once it has
+// doubled. REQUIRES: peerPacersMu is held.
+func prunePeerPacersLocked(now time.Time) {
+	for addr, p := range peerPacers {
+		p.mu.Lock()
+		if p.users == 0 && !now.Before(p.idleAt) {
+			delete(peerPacers, addr)
+		}
+		p.mu.Unlock()
+	}
+	peerPacersPruneAt = 2 * len(peerPacers)
+	if peerPacersPruneAt < minPeerPacersPruneAt {
+		peerPacersPruneAt = minPeerPacersPruneAt
+	}
+}
+
+// Wait until "profile" allows an association to start, and record its start.
+// Returns early, with an error, if "ctx" is done first.
+func (p *peerPacer) start(ctx context.Context, clock Clock, profile *PeerProfile) error {
+	for {
+		p.mu.Lock()
+		now := clock.Now()
+		earliest := p.lastEnd.Add(profile.AssociationDelay)
+		var interval time.Duration
+		if profile.MaxAssociationsPerSecond > 0 {
+			interval = time.Duration(float64(time.Second) / profile.MaxAssociationsPerSecond)
+			if t := p.lastStart.Add(interval); t.After(earliest) {
+				earliest = t
+			}
+		}
+		if !now.Before(earliest) {
+			p.lastStart = now
+			if t := now.Add(interval); t.After(p.idleAt) {
+				p.idleAt = t
+			}
+			p.mu.Unlock()
+			return nil
+		}
+		p.mu.Unlock()
+		// Other ServiceUsers may be waiting too, so check again after
+		// the wait.
+		ready := make(chan struct{})
+		timer := clock.AfterFunc(earliest.Sub(now), func() { close(ready) })
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// Record the end of an association started under "profile".
+func (p *peerPacer) end(clock Clock, profile *PeerProfile) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.users--
+	if now := clock.Now(); now.After(p.lastEnd) {
+		p.lastEnd = now
+	}
+	if t := p.lastEnd.Add(profile.AssociationDelay); t.After(p.idleAt) {
+		p.idleAt = t
+	}
+}
+
+// Give up the pacer without starting an association.
+func (p *peerPacer) release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.users--
+}
@@ -0,0 +1,142 @@
+package netdicom
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/antibios/dicom"
+	"github.com/antibios/dicom/pkg/tag"
+	"github.com/antibios/go-netdicom/dimse"
+	"github.com/antibios/go-netdicom/sopclass"
+	"github.com/stretchr/testify/require"
+)
+
+// Connect waits for the AssociationDelay after the release of the previous
+// association to the same peer, and for the rate cap.
+func TestPeerProfile(t *testing.T) {
+	sp, err := NewServiceProvider(ServiceProviderParams{}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+	defer sp.Shutdown() // nolint: errcheck
+	addr := sp.ListenAddr().String()
+
+	associate := func(profile *PeerProfile) time.Time {
+		su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.VerificationClasses, PeerProfile: profile})
+		require.NoError(t, err)
+		require.NoError(t, su.ConnectContext(context.Background(), addr))
+		start := time.Now()
+		require.NoError(t, su.CEcho())
+		require.NoError(t, su.Release())
+		<-su.done
+		return start
+	}
+	const delay = 200 * time.Millisecond
+	associate(&PeerProfile{AssociationDelay: delay})
+	released := time.Now()
+	require.GreaterOrEqual(t, associate(&PeerProfile{AssociationDelay: delay}).Sub(released), delay)
+	// Without a profile, nothing waits.
+	released = time.Now()
+	require.Less(t, associate(nil).Sub(released), delay)
+
+	// Two associations per second: the second starts half a second after
+	// the first.
+	first := associate(&PeerProfile{MaxAssociationsPerSecond: 2})
+	require.GreaterOrEqual(t, associate(&PeerProfile{MaxAssociationsPerSecond: 2}).Sub(first), 450*time.Millisecond)
+
+	// A context done while waiting fails the connection.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.VerificationClasses, PeerProfile: &PeerProfile{AssociationDelay: time.Hour}})
+	require.NoError(t, err)
+	defer su.Release() // nolint: errcheck
+	require.ErrorIs(t, su.ConnectContext(ctx, addr), context.DeadlineExceeded)
+}
+
+// The sub-associations of C-MOVE are paced by CMovePeerProfiles.
+func TestCMovePeerProfile(t *testing.T) {
+	stored := make(chan time.Time, 10)
+	dest, err := NewServiceProvider(ServiceProviderParams{
+		CStore: func(conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID, calledAE, callingAE string, data []byte) dimse.Status {
+			stored <- time.Now()
+			return dimse.Success
+		},
+	}, "localhost:0")
+	require.NoError(t, err)
+	go dest.Run()
+	defer dest.Shutdown() // nolint: errcheck
+	const delay = 300 * time.Millisecond
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		AETitle:           "ARCHIVE",
+		RemoteAEs:         map[string]string{"WORKSTATION": dest.ListenAddr().String()},
+		CMoveUser:         &ServiceUserParams{MaxPDUSize: 4096},
+		CMovePeerProfiles: map[string]*PeerProfile{"WORKSTATION": {AssociationDelay: delay}},
+		CMove: func(conn ConnectionState, transferSyntaxUID, sopClassUID string, filters []*dicom.Element, ch chan CMoveResult) {
+			path := "testdata/reportsi.dcm"
+			ch <- CMoveResult{Remaining: 0, Path: path, DataSet: mustReadDICOMFile(path)}
+			close(ch)
+		},
+	}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+	defer sp.Shutdown() // nolint: errcheck
+
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.QRMoveClasses})
+	require.NoError(t, err)
+	defer su.Release() // nolint: errcheck
+	su.Connect(sp.ListenAddr().String())
+	filter := []*dicom.Element{dicom.MustNewElement(tag.PatientName, "foohah")}
+	for i := 0; i < 2; i++ {
+		result, err := su.CMove("WORKSTATION", QRLevelPatient, filter, nil)
+		require.NoError(t, err)
+		require.Equal(t, 1, result.Completed)
+	}
+	first, second := <-stored, <-stored
+	require.GreaterOrEqual(t, second.Sub(first), delay)
+
+	_, err = NewServiceProvider(ServiceProviderParams{
+		CMovePeerProfiles: map[string]*PeerProfile{"WORKSTATION": {AssociationDelay: -delay}},
+	}, "localhost:0")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "CMovePeerProfiles[WORKSTATION]")
+}
+
+// Pacers that are idle and no longer delay anything are dropped once the map
+// has grown.
+func TestPrunePeerPacers(t *testing.T) {
+	peerPacersMu.Lock()
+	saved, savedPruneAt := peerPacers, peerPacersPruneAt
+	peerPacers, peerPacersPruneAt = map[string]*peerPacer{}, minPeerPacersPruneAt
+	peerPacersMu.Unlock()
+	defer func() {
+		peerPacersMu.Lock()
+		peerPacers, peerPacersPruneAt = saved, savedPruneAt
+		peerPacersMu.Unlock()
+	}()
+
+	clock := NewVirtualClock(time.Unix(1000, 0))
+	profile := &PeerProfile{AssociationDelay: time.Minute}
+	for i := 0; i < minPeerPacersPruneAt; i++ {
+		p := getPeerPacer(fmt.Sprintf("host%d:104", i), clock)
+		require.NoError(t, p.start(context.Background(), clock, profile))
+		if i == 0 {
+			// Still in use.
+			continue
+		}
+		p.end(clock, profile)
+	}
+	// The delay hasn't passed: nothing is dropped.
+	getPeerPacer("new:104", clock).release()
+	require.Len(t, peerPacers, minPeerPacersPruneAt+1)
+	require.Equal(t, 2*minPeerPacersPruneAt, peerPacersPruneAt)
+
+	clock.Advance(time.Minute)
+	peerPacersMu.Lock()
+	prunePeerPacersLocked(clock.Now())
+	peerPacersMu.Unlock()
+	// Only the pacer in use is left.
+	require.Len(t, peerPacers, 1)
+	require.Contains(t, peerPacers, "host0:104")
+	require.Equal(t, minPeerPacersPruneAt, peerPacersPruneAt)
+}
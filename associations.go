@@ -0,0 +1,220 @@
+package netdicom
+
+// This file tracks the associations served by a ServiceProvider, and the
+// resources they consume.
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AssociationInfo is a snapshot of an association served by a
+// ServiceProvider.
+type AssociationInfo struct {
+	// ID identifies the association in log messages and in Abort.
+	ID         string
+	RemoteAddr net.Addr
+	// AE title of the peer. Empty until the association is accepted.
+	CallingAETitle string
+	StartTime      time.Time
+	// The remote end. Only the transport fields are set until the
+	// association is accepted.
+	Peer Peer
+
+	// Number of goroutines running on behalf of the association, including
+	// the ones running callbacks.
+	Goroutines int
+	// Number of DIMSE commands being handled.
+	ActiveCommands int
+	// Bytes of DIMSE messages received but not yet fully assembled.
+	BufferedBytes int64
+	// Bytes of DIMSE payloads held by running handlers, e.g., the data
+	// passed to CStore.
+	HandlerBytes int64
+	// Number of DIMSE messages received that matched no outstanding
+	// request and no handler.
+	UnexpectedMessages int64
+}
+
+// Counters for one association. The fields are updated atomically by the
+// association's goroutines. A nil *associationStats ignores updates, so that
+// client-side code needn't check.
+type associationStats struct {
+	goroutines         int64
+	bufferedBytes      int64
+	handlerBytes       int64
+	unexpectedMessages int64
+	// If non-nil, unexpected messages are also counted here, so that the
+	// count outlives the association.
+	totalUnexpectedMessages *int64
+	// If non-nil, connections dropped by a limit are counted here.
+	totalDropped *dropCounters
+
+	mu             sync.Mutex
+	callingAETitle string // guarded by mu
+	peer           Peer   // guarded by mu
+}
+
+func (s *associationStats) goroutineStarted() {
+	if s != nil {
+		atomic.AddInt64(&s.goroutines, 1)
+	}
+}
+
+func (s *associationStats) goroutineDone() {
+	if s != nil {
+		atomic.AddInt64(&s.goroutines, -1)
+	}
+}
+
+func (s *associationStats) setBufferedBytes(n int64) {
+	if s != nil {
+		atomic.StoreInt64(&s.bufferedBytes, n)
+	}
+}
+
+func (s *associationStats) addHandlerBytes(n int) {
+	if s != nil {
+		atomic.AddInt64(&s.handlerBytes, int64(n))
+	}
+}
+
+func (s *associationStats) setPeer(peer Peer) {
+	if s != nil {
+		s.mu.Lock()
+		s.peer = peer
+		s.mu.Unlock()
+	}
+}
+
+func (s *associationStats) addDroppedConnection(cause DropCause) {
+	if s != nil && s.totalDropped != nil {
+		atomic.AddInt64(&s.totalDropped[cause], 1)
+	}
+}
+
+func (s *associationStats) addUnexpectedMessage() {
+	if s != nil {
+		atomic.AddInt64(&s.unexpectedMessages, 1)
+		if s.totalUnexpectedMessages != nil {
+			atomic.AddInt64(s.totalUnexpectedMessages, 1)
+		}
+	}
+}
+
+func (s *associationStats) setCallingAETitle(aeTitle string) {
+	if s != nil {
+		s.mu.Lock()
+		s.callingAETitle = aeTitle
+		s.mu.Unlock()
+	}
+}
+
+// Run fn in a new goroutine that is counted in s.
+func (s *associationStats) goFunc(fn func()) {
+	s.goroutineStarted()
+	go func() {
+		defer s.goroutineDone()
+		fn()
+	}()
+}
+
+// An association being served by ServiceProvider.Run.
+type providerAssociation struct {
+	sp        *ServiceProvider
+	label     string
+	conn      net.Conn
+	startTime time.Time
+	stats     associationStats
+
+	mu   sync.Mutex
+	disp *serviceDispatcher // set once serving starts; guarded by mu
+}
+
+func (a *providerAssociation) info() AssociationInfo {
+	a.stats.mu.Lock()
+	callingAETitle := a.stats.callingAETitle
+	peer := a.stats.peer
+	a.stats.mu.Unlock()
+	if peer.IP == "" {
+		peer = newPeer(a.conn, nil)
+	}
+	info := AssociationInfo{
+		ID:             a.label,
+		RemoteAddr:     a.conn.RemoteAddr(),
+		CallingAETitle: callingAETitle,
+		StartTime:      a.startTime,
+		Peer:           peer,
+		Goroutines:     int(atomic.LoadInt64(&a.stats.goroutines)),
+		BufferedBytes:  atomic.LoadInt64(&a.stats.bufferedBytes),
+		HandlerBytes:   atomic.LoadInt64(&a.stats.handlerBytes),
+
+		UnexpectedMessages: atomic.LoadInt64(&a.stats.unexpectedMessages),
+	}
+	a.mu.Lock()
+	disp := a.disp
+	a.mu.Unlock()
+	if disp != nil {
+		disp.mu.Lock()
+		info.ActiveCommands = len(disp.activeCommands)
+		disp.mu.Unlock()
+	}
+	return info
+}
+
+// Associations returns a snapshot of the connections being served, including
+// the ones whose association hasn't been accepted yet.
+func (sp *ServiceProvider) Associations() []AssociationInfo {
+	sp.mu.Lock()
+	assocs := make([]*providerAssociation, 0, len(sp.assocs))
+	for _, a := range sp.assocs {
+		assocs = append(assocs, a)
+	}
+	sp.mu.Unlock()
+	infos := make([]AssociationInfo, len(assocs))
+	for i, a := range assocs {
+		infos[i] = a.info()
+	}
+	return infos
+}
+
+// Abort sends A-ABORT to the peer of the association with the given ID (see
+// AssociationInfo) and closes the connection.
+func (sp *ServiceProvider) Abort(id string) error {
+	sp.mu.Lock()
+	a, ok := sp.assocs[id]
+	sp.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("dicom.serviceProvider(%s): association %s not found", sp.label, id)
+	}
+	a.mu.Lock()
+	disp := a.disp
+	a.mu.Unlock()
+	if disp == nil {
+		return a.conn.Close()
+	}
+	select {
+	case disp.downcallCh <- stateEvent{event: evt15}:
+		return nil
+	default:
+		// The statemachine is backed up; don't wait for it.
+		return a.conn.Close()
+	}
+}
+
+// Close the connections of all the associations being served, without
+// waiting for their statemachines.
+func (sp *ServiceProvider) closeConnections() {
+	sp.mu.Lock()
+	conns := make([]net.Conn, 0, len(sp.assocs))
+	for _, a := range sp.assocs {
+		conns = append(conns, a.conn)
+	}
+	sp.mu.Unlock()
+	for _, conn := range conns {
+		conn.Close() // nolint: errcheck
+	}
+}
@@ -0,0 +1,303 @@
+package netdicom
+
+// This file implements CFindCache, which serves repeated C-FIND requests from
+// memory.
+
+import (
+	"container/list"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	dicom "github.com/antibios/dicom"
+	dicomtag "github.com/antibios/dicom/pkg/tag"
+)
+
+const (
+	// DefaultCFindCacheEntries is the default value of
+	// CFindCacheParams.MaxEntries.
+	DefaultCFindCacheEntries = 1024
+
+	// DefaultCFindCacheTTL is the default value of CFindCacheParams.TTL.
+	DefaultCFindCacheTTL = 10 * time.Second
+
+	// DefaultCFindCacheEntryResults is the default value of
+	// CFindCacheParams.MaxEntryResults.
+	DefaultCFindCacheEntryResults = 1000
+)
+
+// CFindCacheParams configures a CFindCache.
+type CFindCacheParams struct {
+	// MaxEntries bounds the number of queries whose results are cached. The
+	// least recently used is evicted first. If zero,
+	// DefaultCFindCacheEntries is used.
+	MaxEntries int
+
+	// TTL is how long the results of a query are served from the cache. If
+	// zero, DefaultCFindCacheTTL is used.
+	TTL time.Duration
+
+	// MaxEntryResults bounds the number of results of a query that is
+	// cached. Queries with more results are passed to the backend every
+	// time. If zero, DefaultCFindCacheEntryResults is used.
+	MaxEntryResults int
+
+	// Clock, if non-nil, is used to expire entries. Tests set it to a
+	// VirtualClock. If nil, the real clock is used.
+	Clock Clock
+}
+
+// CFindCache wraps a CFindCallback, and answers requests whose identifier
+// matches that of a recent request from the cached results, e.g., for
+// worklist and browser clients that repeat the same query every few seconds.
+// Identifiers are compared after sorting their elements by tag and trimming
+// the padding of their values. Failed requests aren't cached.
+//
+// Results are cached per caller: a request is answered from the cache only if
+// it comes with the same calling and called AE titles, TLS certificate name
+// and Principal as the one that filled the entry, so that a backend that
+// filters by caller doesn't leak results to another.
+//
+// Results become stale when instances arrive. Pass the events of the
+// provider to Run, or call Add or InvalidateAll, to drop them early. Results
+// still being computed when they are called aren't cached. It is thread safe.
+type CFindCache struct {
+	backend CFindCallback
+	params  CFindCacheParams
+	clock   Clock
+
+	mu      sync.Mutex
+	lru     *list.List // of *cfindCacheEntry, most recently used first
+	entries map[string]*list.Element
+	// Incremented by Add and InvalidateAll. Results computed while it
+	// changed may be stale, and aren't stored.
+	generation uint64
+}
+
+type cfindCacheEntry struct {
+	key     string
+	expires time.Time
+	results []CFindResult
+	// Values of the unique keys the query filtered on, e.g., PatientID.
+	// An instance that differs in any of them can't match the query.
+	uniqueKeys map[dicomtag.Tag]string
+}
+
+// Attributes that, when a query filters on a single value of them, restrict
+// the instances that can change its results.
+var cfindCacheUniqueKeys = []dicomtag.Tag{
+	dicomtag.PatientID,
+	dicomtag.StudyInstanceUID,
+	dicomtag.SeriesInstanceUID,
+}
+
+// NewCFindCache creates a cache in front of "backend". Set its CFind method as
+// ServiceProviderParams.CFind.
+func NewCFindCache(backend CFindCallback, params CFindCacheParams) *CFindCache {
+	if params.MaxEntries <= 0 {
+		params.MaxEntries = DefaultCFindCacheEntries
+	}
+	if params.TTL <= 0 {
+		params.TTL = DefaultCFindCacheTTL
+	}
+	if params.MaxEntryResults <= 0 {
+		params.MaxEntryResults = DefaultCFindCacheEntryResults
+	}
+	return &CFindCache{
+		backend: backend,
+		params:  params,
+		clock:   clockOrDefault(params.Clock),
+		lru:     list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+// CFind implements CFindCallback. On a miss, the results of the backend are
+// passed through as they are produced, and cached once it closes the channel.
+func (c *CFindCache) CFind(
+	conn ConnectionState,
+	transferSyntaxUID string,
+	sopClassUID string,
+	filters []*dicom.Element,
+	ch chan CFindResult) {
+	defer close(ch)
+	key := cfindCacheKey(conn, sopClassUID, filters)
+	results, generation, ok := c.lookup(key)
+	if ok {
+		for _, r := range results {
+			ch <- r
+		}
+		return
+	}
+	backendCh := make(chan CFindResult, cap(ch))
+	go c.backend(conn, transferSyntaxUID, sopClassUID, filters, backendCh)
+	cacheable := true
+	for r := range backendCh {
+		if r.Err != nil || len(results) >= c.params.MaxEntryResults {
+			cacheable = false
+			results = nil
+		}
+		if cacheable {
+			results = append(results, r)
+		}
+		ch <- r
+	}
+	if cacheable {
+		c.store(key, generation, results, filters)
+	}
+}
+
+// Run consumes "events" until the channel is closed, passing each to Add. It
+// is typically given the result of EventBus.Subscribe.
+func (c *CFindCache) Run(events <-chan Event) {
+	for e := range events {
+		c.Add(e)
+	}
+}
+
+// Add drops the cached results that the instance in an EventInstanceReceived
+// event could change. Other events are ignored.
+func (c *CFindCache) Add(e Event) {
+	if e.Type != EventInstanceReceived {
+		return
+	}
+	values := map[dicomtag.Tag]string{
+		dicomtag.PatientID:         e.PatientID,
+		dicomtag.StudyInstanceUID:  e.StudyInstanceUID,
+		dicomtag.SeriesInstanceUID: e.SeriesInstanceUID,
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	for key, elem := range c.entries {
+		entry := elem.Value.(*cfindCacheEntry)
+		unrelated := false
+		for tag, v := range entry.uniqueKeys {
+			if values[tag] != "" && values[tag] != v {
+				unrelated = true
+				break
+			}
+		}
+		if !unrelated {
+			c.lru.Remove(elem)
+			delete(c.entries, key)
+		}
+	}
+}
+
+// InvalidateAll drops every cached result, e.g., after the backend's data
+// changed other than by the arrival of instances.
+func (c *CFindCache) InvalidateAll() {
+	c.mu.Lock()
+	c.generation++
+	c.lru.Init()
+	c.entries = map[string]*list.Element{}
+	c.mu.Unlock()
+}
+
+// Len returns the number of queries whose results are cached.
+func (c *CFindCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// Returns the cached results for "key", if any. On a miss, also returns the
+// generation to pass to store.
+func (c *CFindCache) lookup(key string) ([]CFindResult, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, c.generation, false
+	}
+	entry := elem.Value.(*cfindCacheEntry)
+	if !c.clock.Now().Before(entry.expires) {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		return nil, c.generation, false
+	}
+	c.lru.MoveToFront(elem)
+	return entry.results, 0, true
+}
+
+// Cache the results for "key", computed since lookup returned "generation".
+// They are dropped if Add or InvalidateAll was called in the meantime.
+func (c *CFindCache) store(key string, generation uint64, results []CFindResult, filters []*dicom.Element) {
+	entry := &cfindCacheEntry{
+		key:        key,
+		expires:    c.clock.Now().Add(c.params.TTL),
+		results:    results,
+		uniqueKeys: map[dicomtag.Tag]string{},
+	}
+	for _, filter := range filters {
+		for _, tag := range cfindCacheUniqueKeys {
+			if filter.Tag != tag {
+				continue
+			}
+			if v, ok := filter.Value.GetValue().([]string); ok && len(v) == 1 {
+				if s := strings.TrimSpace(v[0]); s != "" && !strings.ContainsAny(s, "*?") {
+					entry.uniqueKeys[tag] = s
+				}
+			}
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.generation != generation {
+		return
+	}
+	if elem, ok := c.entries[key]; ok {
+		c.lru.Remove(elem)
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.params.MaxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cfindCacheEntry).key)
+	}
+}
+
+// Returns the normalized form of a C-FIND identifier, qualified by the caller.
+func cfindCacheKey(conn ConnectionState, sopClassUID string, filters []*dicom.Element) string {
+	principal := ""
+	if p := conn.Principal; p != nil {
+		principal = fmt.Sprintf("%v:%s", p.IdentityType, p.Name)
+	}
+	caller := fmt.Sprintf("%q|%q|%q|%q", conn.Peer.CallingAETitle, conn.Peer.CalledAETitle,
+		conn.Peer.TLSCommonName, principal)
+	return caller + "|" + sopClassUID + "|" + normalizedElements(filters)
+}
+
+func normalizedElements(elems []*dicom.Element) string {
+	sorted := append([]*dicom.Element(nil), elems...)
+	sort.SliceStable(sorted, func(i, j int) bool { return tagLess(sorted[i].Tag, sorted[j].Tag) })
+	var parts []string
+	for _, elem := range sorted {
+		parts = append(parts, fmt.Sprintf("%04x%04x=%s", elem.Tag.Group, elem.Tag.Element, normalizedValue(elem.Value.GetValue())))
+	}
+	return strings.Join(parts, ";")
+}
+
+func normalizedValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return strings.Trim(v, " \x00")
+	case []string:
+		values := make([]string, len(v))
+		for i, s := range v {
+			values[i] = strings.Trim(s, " \x00")
+		}
+		return strings.Join(values, "\\")
+	case []*dicom.SequenceItemValue:
+		var items []string
+		for _, item := range v {
+			elems, _ := item.GetValue().([]*dicom.Element)
+			items = append(items, "("+normalizedElements(elems)+")")
+		}
+		return strings.Join(items, "")
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,111 @@
+package netdicom
+
+import (
+	"testing"
+	"time"
+
+	dicom "github.com/antibios/dicom"
+	dicomtag "github.com/antibios/dicom/pkg/tag"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCFindCache(t *testing.T) {
+	const sopClassUID = "1.2.840.10008.5.1.4.1.2.2.1" // Study root C-FIND
+	calls := 0
+	backend := func(conn ConnectionState, transferSyntaxUID, sopClassUID string, filters []*dicom.Element, ch chan CFindResult) {
+		calls++
+		ch <- CFindResult{Elements: []*dicom.Element{dicom.MustNewElement(dicomtag.PatientName, "johndoe")}}
+		close(ch)
+	}
+	clock := NewVirtualClock(time.Time{})
+	cache := NewCFindCache(backend, CFindCacheParams{MaxEntries: 2, TTL: time.Minute, Clock: clock})
+	find := func(filters ...*dicom.Element) []CFindResult {
+		ch := make(chan CFindResult, 16)
+		cache.CFind(ConnectionState{}, "", sopClassUID, filters, ch)
+		var results []CFindResult
+		for r := range ch {
+			results = append(results, r)
+		}
+		return results
+	}
+	patient := dicom.MustNewElement(dicomtag.PatientID, "P1")
+	name := dicom.MustNewElement(dicomtag.PatientName, "")
+
+	require.Len(t, find(patient, name), 1)
+	require.Equal(t, 1, calls)
+	// The same identifier, in another order and with padding.
+	require.Len(t, find(name, dicom.MustNewElement(dicomtag.PatientID, "P1 ")), 1)
+	require.Equal(t, 1, calls)
+
+	// An instance of another patient doesn't invalidate the query.
+	cache.Add(Event{Type: EventInstanceReceived, PatientID: "P2", StudyInstanceUID: "1.2"})
+	find(patient, name)
+	require.Equal(t, 1, calls)
+	cache.Add(Event{Type: EventInstanceReceived, PatientID: "P1", StudyInstanceUID: "1.2"})
+	find(patient, name)
+	require.Equal(t, 2, calls)
+
+	clock.Advance(time.Minute)
+	find(patient, name)
+	require.Equal(t, 3, calls)
+
+	// The least recently used entry is evicted.
+	find(dicom.MustNewElement(dicomtag.PatientID, "P2"))
+	find(dicom.MustNewElement(dicomtag.PatientID, "P3"))
+	require.Equal(t, 2, cache.Len())
+	find(patient, name)
+	require.Equal(t, 6, calls)
+
+	cache.InvalidateAll()
+	require.Equal(t, 0, cache.Len())
+
+	// Another caller doesn't get the results cached for the first.
+	find(patient)
+	ch := make(chan CFindResult, 16)
+	cache.CFind(ConnectionState{Peer: Peer{CallingAETitle: "OTHER"}}, "", sopClassUID, []*dicom.Element{patient}, ch)
+	for range ch {
+	}
+	require.Equal(t, 8, calls)
+}
+
+// Results computed before an invalidation aren't stored after it.
+func TestCFindCacheStaleStore(t *testing.T) {
+	const sopClassUID = "1.2.840.10008.5.1.4.1.2.2.1" // Study root C-FIND
+	calls := 0
+	var cache *CFindCache
+	backend := func(conn ConnectionState, transferSyntaxUID, sopClassUID string, filters []*dicom.Element, ch chan CFindResult) {
+		calls++
+		ch <- CFindResult{Elements: []*dicom.Element{dicom.MustNewElement(dicomtag.PatientName, "johndoe")}}
+		// An instance arrives while the query runs.
+		cache.Add(Event{Type: EventInstanceReceived, PatientID: "P1"})
+		close(ch)
+	}
+	cache = NewCFindCache(backend, CFindCacheParams{})
+	ch := make(chan CFindResult, 16)
+	cache.CFind(ConnectionState{}, "", sopClassUID, []*dicom.Element{dicom.MustNewElement(dicomtag.PatientID, "P1")}, ch)
+	for range ch {
+	}
+	require.Equal(t, 1, calls)
+	require.Equal(t, 0, cache.Len())
+}
+
+// Queries with more than MaxEntryResults results aren't cached, but are
+// answered in full.
+func TestCFindCacheMaxEntryResults(t *testing.T) {
+	const sopClassUID = "1.2.840.10008.5.1.4.1.2.2.1" // Study root C-FIND
+	backend := func(conn ConnectionState, transferSyntaxUID, sopClassUID string, filters []*dicom.Element, ch chan CFindResult) {
+		for i := 0; i < 3; i++ {
+			ch <- CFindResult{Elements: []*dicom.Element{dicom.MustNewElement(dicomtag.PatientName, "johndoe")}}
+		}
+		close(ch)
+	}
+	cache := NewCFindCache(backend, CFindCacheParams{MaxEntryResults: 2})
+	ch := make(chan CFindResult, 16)
+	cache.CFind(ConnectionState{}, "", sopClassUID, nil, ch)
+	n := 0
+	for range ch {
+		n++
+	}
+	require.Equal(t, 3, n)
+	require.Equal(t, 0, cache.Len())
+}
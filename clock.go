@@ -0,0 +1,147 @@
+package netdicom
+
+// This file abstracts the passage of time for the statemachine, so that tests
+// can exercise the ARTIM timer and the read deadlines without sleeping.
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is the source of time for the protocol timers: the ARTIM timer, and
+// ServiceProviderParams.AssociationRequestTimeout and IdleTimeout.
+// WriteTimeout always uses the real clock, since it bounds a blocked socket.
+type Clock interface {
+	Now() time.Time
+	// AfterFunc calls f in its own goroutine once d has elapsed, like
+	// time.AfterFunc.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is returned by Clock.AfterFunc.
+type Timer interface {
+	// Stop prevents the timer from firing. It returns false if the timer
+	// has already fired or been stopped.
+	Stop() bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer { return time.AfterFunc(d, f) }
+
+// Returns c, or the real clock if c is nil.
+func clockOrDefault(c Clock) Clock {
+	if c == nil {
+		return realClock{}
+	}
+	return c
+}
+
+// VirtualClock is a Clock that moves only when Advance is called. Timers fire
+// synchronously inside Advance, in order of expiry, so a test observes their
+// effects deterministically.
+//
+//	clock := netdicom.NewVirtualClock(time.Time{})
+//	sp, _ := netdicom.NewServiceProvider(netdicom.ServiceProviderParams{Clock: clock, ...}, ":0")
+//	...
+//	clock.BlockUntil(1)         // wait for the statemachine to arm its timer
+//	clock.Advance(time.Minute)  // fire it
+type VirtualClock struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	now    time.Time
+	timers []*virtualTimer // pending timers; guarded by mu
+}
+
+type virtualTimer struct {
+	clock *VirtualClock
+	when  time.Time
+	f     func()
+}
+
+// NewVirtualClock creates a clock whose time starts at "start".
+func NewVirtualClock(start time.Time) *VirtualClock {
+	c := &VirtualClock{now: start}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// Now returns the current virtual time.
+func (c *VirtualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// AfterFunc arranges for f to be called when the clock has been advanced by
+// d.
+func (c *VirtualClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &virtualTimer{clock: c, when: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	c.cond.Broadcast()
+	return t
+}
+
+// Stop implements Timer.
+func (t *virtualTimer) Stop() bool {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.removeLocked(t)
+}
+
+func (c *VirtualClock) removeLocked(t *virtualTimer) bool {
+	for i, pt := range c.timers {
+		if pt == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			c.cond.Broadcast()
+			return true
+		}
+	}
+	return false
+}
+
+// Advance moves the clock forward by d, firing every timer that expires on
+// the way. Timers armed by the callbacks fire too if they expire within d.
+func (c *VirtualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	for {
+		sort.SliceStable(c.timers, func(i, j int) bool { return c.timers[i].when.Before(c.timers[j].when) })
+		if len(c.timers) == 0 || c.timers[0].when.After(end) {
+			break
+		}
+		t := c.timers[0]
+		c.removeLocked(t)
+		c.now = t.when
+		c.mu.Unlock()
+		t.f()
+		c.mu.Lock()
+	}
+	c.now = end
+	c.mu.Unlock()
+}
+
+// PendingTimers returns the number of timers that haven't fired or been
+// stopped.
+func (c *VirtualClock) PendingTimers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// BlockUntil waits until at least n timers are pending. Use it to wait for
+// the statemachine, which runs in its own goroutine, to arm its timers before
+// calling Advance.
+func (c *VirtualClock) BlockUntil(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.timers) < n {
+		c.cond.Wait()
+	}
+}
@@ -0,0 +1,127 @@
+package netdicom
+
+// This file implements ServiceProviderParams.CMoveReplicas: sending copies of
+// the datasets of a C-MOVE to AEs other than the move destination.
+
+import (
+	"fmt"
+	"sync"
+
+	dicom "github.com/antibios/dicom"
+)
+
+// CMoveReplicasCallback is called for each dataset sent by C-MOVE. It returns
+// the AE titles, in addition to moveDestination, that should receive a copy
+// of "ds", e.g., a disaster-recovery archive. Each must be listed in
+// ServiceProviderParams.RemoteAEs, or known to ResolveAE. It may return nil.
+type CMoveReplicasCallback func(
+	conn ConnectionState,
+	moveDestination string,
+	ds *dicom.Dataset) []string
+
+// CMoveReplicaCounts reports the copies sent to one replica AE during a
+// C-MOVE.
+type CMoveReplicaCounts struct {
+	Completed int
+	Failed    int
+	// Dropped counts the copies not sent because the replica had fallen
+	// maxReplicaBacklog datasets behind.
+	Dropped int
+	// Err is the last error, if Failed > 0.
+	Err error
+}
+
+// CMoveReplicasDoneCallback is called once every copy made during a C-MOVE
+// has been sent. "counts" is keyed by AE title. It is called after the final
+// C-MOVE response, whose status doesn't reflect the replicas.
+type CMoveReplicasDoneCallback func(
+	conn ConnectionState,
+	moveDestination string,
+	counts map[string]CMoveReplicaCounts)
+
+// cmoveReplicator sends copies for one C-MOVE. Each replica AE has its own
+// queue, goroutine and associations, so that a slow or failing replica delays
+// neither the move destination nor the other replicas: the copies for a
+// replica that has fallen too far behind are dropped.
+type cmoveReplicator struct {
+	params ServiceProviderParams
+	wg     sync.WaitGroup
+
+	mu     sync.Mutex
+	queues map[string]chan *dicom.Dataset
+	counts map[string]*CMoveReplicaCounts
+}
+
+func newCMoveReplicator(params ServiceProviderParams) *cmoveReplicator {
+	if params.CMoveReplicas == nil {
+		return nil
+	}
+	return &cmoveReplicator{
+		params: params,
+		queues: map[string]chan *dicom.Dataset{},
+		counts: map[string]*CMoveReplicaCounts{},
+	}
+}
+
+// Number of datasets a replica may fall behind before its copies are dropped.
+const maxReplicaBacklog = 1024
+
+// Queue "ds" for each of "aeTitles".
+func (r *cmoveReplicator) send(aeTitles []string, ds *dicom.Dataset) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, aeTitle := range aeTitles {
+		q, ok := r.queues[aeTitle]
+		if !ok {
+			q = make(chan *dicom.Dataset, maxReplicaBacklog)
+			r.queues[aeTitle] = q
+			r.counts[aeTitle] = &CMoveReplicaCounts{}
+			r.wg.Add(1)
+			go r.run(aeTitle, q)
+		}
+		select {
+		case q <- ds:
+		default:
+			r.counts[aeTitle].Dropped++
+		}
+	}
+}
+
+func (r *cmoveReplicator) run(aeTitle string, q chan *dicom.Dataset) {
+	defer r.wg.Done()
+	remoteHostPort, resolveErr := resolveAE(r.params, aeTitle)
+	assocs := newCMoveSubAssociations(r.params, aeTitle, remoteHostPort)
+	defer assocs.close()
+	for ds := range q {
+		var err error
+		if resolveErr != nil {
+			err = fmt.Errorf("C-MOVE replica: %v", resolveErr)
+		} else {
+			err = assocs.cstore(ds)
+		}
+		r.mu.Lock()
+		if err != nil {
+			loggerOrDefault(r.params.Logger)(0, "dicom.serviceProvider: C-MOVE: replica to %v(%v) failed: %v", aeTitle, remoteHostPort, err)
+			r.counts[aeTitle].Failed++
+			r.counts[aeTitle].Err = err
+		} else {
+			r.counts[aeTitle].Completed++
+		}
+		r.mu.Unlock()
+	}
+}
+
+// Wait for the queued copies to be sent, and return the counts.
+func (r *cmoveReplicator) finish() map[string]CMoveReplicaCounts {
+	r.mu.Lock()
+	for _, q := range r.queues {
+		close(q)
+	}
+	r.mu.Unlock()
+	r.wg.Wait()
+	counts := map[string]CMoveReplicaCounts{}
+	for aeTitle, c := range r.counts {
+		counts[aeTitle] = *c
+	}
+	return counts
+}
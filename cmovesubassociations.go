@@ -0,0 +1,148 @@
+package netdicom
+
+// This file implements the outbound side of C-MOVE: resolving the move
+// destination to an address, and the associations that carry the C-STORE
+// sub-operations to it. The sub-operations of one C-MOVE share associations
+// instead of each opening its own.
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	dicom "github.com/antibios/dicom"
+	"github.com/antibios/go-netdicom/sopclass"
+)
+
+// AEResolver returns the "host:port" of the AE "aeTitle", e.g., by looking it
+// up in a directory. It returns an error if the AE is unknown.
+type AEResolver func(aeTitle string) (hostPort string, err error)
+
+// Returns the "host:port" of "aeTitle", from params.ResolveAE or, if it is
+// nil, params.RemoteAEs.
+func resolveAE(params ServiceProviderParams, aeTitle string) (string, error) {
+	if params.ResolveAE != nil {
+		return params.ResolveAE(aeTitle)
+	}
+	hostPort, ok := params.RemoteAEs[aeTitle]
+	if !ok {
+		return "", fmt.Errorf("AE '%v' not registered in the server", aeTitle)
+	}
+	return hostPort, nil
+}
+
+// Returns the parameters of an association from the provider to
+// "remoteAETitle" that sends datasets encoded in transferSyntaxUID, made from
+// params.CMoveUser. If params.PreserveTransferSyntax is false, or
+// transferSyntaxUID is empty, the standard transfer syntaxes are proposed.
+func newCStoreServiceUserParams(params ServiceProviderParams, remoteAETitle, transferSyntaxUID string) ServiceUserParams {
+	var suParams ServiceUserParams
+	if params.CMoveUser != nil {
+		suParams = *params.CMoveUser
+	}
+	suParams.CalledAETitle = remoteAETitle
+	suParams.CallingAETitle = params.AETitle
+	suParams.SOPClasses = sopclass.StorageClasses
+	suParams.TransferSyntaxes = nil
+	suParams.PreserveTransferSyntax = params.PreserveTransferSyntax
+	if params.PreserveTransferSyntax && transferSyntaxUID != "" {
+		suParams.TransferSyntaxes = []string{transferSyntaxUID}
+	}
+	if profile, ok := params.CMovePeerProfiles[remoteAETitle]; ok {
+		suParams.PeerProfile = profile
+	}
+	if suParams.Clock == nil {
+		suParams.Clock = params.Clock
+	}
+	if suParams.MaxPDUSize == 0 {
+		suParams.MaxPDUSize = params.MaxPDUSize
+	}
+	if suParams.Logger == nil {
+		suParams.Logger = params.Logger
+	}
+	return suParams
+}
+
+// Opens an association to "remoteAETitle" at "hostPort" to send datasets
+// encoded in transferSyntaxUID. See newCStoreServiceUserParams.
+func connectCStoreServiceUser(params ServiceProviderParams, remoteAETitle, hostPort, transferSyntaxUID string) (*ServiceUser, error) {
+	su, err := NewServiceUser(newCStoreServiceUserParams(params, remoteAETitle, transferSyntaxUID))
+	if err != nil {
+		return nil, err
+	}
+	if err := su.ConnectContext(context.Background(), hostPort); err != nil {
+		su.Release() // nolint: errcheck
+		return nil, err
+	}
+	return su, nil
+}
+
+// cmoveSubAssociations holds the associations to the destination of one
+// C-MOVE. A sub-operation takes an idle association, or opens one, and gives
+// it back when done, so that at most as many are open as sub-operations run
+// at once. An association on which a C-STORE fails is released rather than
+// reused, in case the failure broke it.
+type cmoveSubAssociations struct {
+	params      ServiceProviderParams
+	destination string
+	hostPort    string
+
+	mu sync.Mutex
+	// Idle associations, keyed by the transfer syntax they propose, or ""
+	// for the standard ones.
+	idle map[string][]*ServiceUser
+}
+
+func newCMoveSubAssociations(params ServiceProviderParams, destination, hostPort string) *cmoveSubAssociations {
+	return &cmoveSubAssociations{
+		params:      params,
+		destination: destination,
+		hostPort:    hostPort,
+		idle:        map[string][]*ServiceUser{},
+	}
+}
+
+// Send "ds" to the destination with C-STORE.
+func (a *cmoveSubAssociations) cstore(ds *dicom.Dataset) error {
+	key := ""
+	if a.params.PreserveTransferSyntax {
+		key = datasetTransferSyntaxUID(ds)
+	}
+	a.mu.Lock()
+	var su *ServiceUser
+	if n := len(a.idle[key]); n > 0 {
+		su = a.idle[key][n-1]
+		a.idle[key] = a.idle[key][:n-1]
+	}
+	a.mu.Unlock()
+	if su == nil {
+		var err error
+		if su, err = connectCStoreServiceUser(a.params, a.destination, a.hostPort, key); err != nil {
+			return err
+		}
+	}
+	err := su.CStore(ds)
+	loggerOrDefault(a.params.Logger)(1, "dicom.serviceProvider: C-STORE subop done: %v", err)
+	if err != nil {
+		su.Release()
+		return err
+	}
+	a.mu.Lock()
+	a.idle[key] = append(a.idle[key], su)
+	a.mu.Unlock()
+	return nil
+}
+
+// Release the associations. Called once the sub-operations are done.
+func (a *cmoveSubAssociations) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for key, sus := range a.idle {
+		for _, su := range sus {
+			if err := su.Release(); err != nil {
+				loggerOrDefault(a.params.Logger)(0, "dicom.serviceProvider: C-MOVE: release of the association to %v(%v) failed: %v", a.destination, a.hostPort, err)
+			}
+		}
+		delete(a.idle, key)
+	}
+}
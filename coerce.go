@@ -0,0 +1,376 @@
+package netdicom
+
+// This file implements ServiceProviderParams.CStoreCoerce: correcting
+// attributes of inbound C-STORE datasets, e.g., a PatientID entered wrongly at
+// a modality, before they are stored or forwarded.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	dicom "github.com/antibios/dicom"
+	dicomtag "github.com/antibios/dicom/pkg/tag"
+	dicomuid "github.com/antibios/dicom/pkg/uid"
+	"github.com/antibios/go-dicom/dicomlog"
+	"github.com/antibios/go-netdicom/dimse"
+)
+
+// CStoreCoerceCallback is called with the top-level elements of an inbound
+// C-STORE dataset whose VR is a string type (e.g., LO, PN, SH, UI), before the
+// C-STORE handler. It returns the new values of the attributes to coerce,
+// keyed by tag; a nil value removes the attribute. Only attributes with a
+// string VR can be coerced, and the SOP Class and SOP Instance UIDs can't be.
+//
+// The handler receives the coerced dataset. The other elements are passed
+// byte for byte as received. If any attribute changed and the handler returns
+// dimse.Success, the C-STORE response carries
+// dimse.CStoreCoercionOfDataElements instead.
+//
+// If the callback returns an error, the handler is not called, and the
+// C-STORE fails with dimse.CStoreCannotUnderstand.
+type CStoreCoerceCallback func(
+	conn ConnectionState,
+	sopClassUID string,
+	sopInstanceUID string,
+	elems []*dicom.Element) (map[dicomtag.Tag][]string, error)
+
+// CStoreCoercedCallback is called with the changes CStoreCoerce made to a
+// dataset, once the C-STORE handler has accepted it, e.g., to keep an audit
+// trail.
+type CStoreCoercedCallback func(
+	conn ConnectionState,
+	sopClassUID string,
+	sopInstanceUID string,
+	coercions []Coercion)
+
+// Coercion is a change made to an attribute of an inbound dataset.
+type Coercion struct {
+	Tag      dicomtag.Tag
+	OldValue []string // nil if the attribute was absent
+	NewValue []string // nil if the attribute was removed
+}
+
+func (c Coercion) String() string {
+	return fmt.Sprintf("%s: %q -> %q", c.Tag.String(), c.OldValue, c.NewValue)
+}
+
+// Maximum nesting of sequences and items the scan of a dataset accepts.
+const maxRawElementDepth = 64
+
+// rawElement locates an element in an encoded dataset.
+type rawElement struct {
+	tag        dicomtag.Tag
+	vr         string
+	start      int // offset of the tag
+	valueStart int // offset of the value
+	end        int // offset past the value, or past the delimiter if the length is undefined
+}
+
+var (
+	itemTag                  = dicomtag.Tag{Group: 0xfffe, Element: 0xe000}
+	itemDelimitationTag      = dicomtag.Tag{Group: 0xfffe, Element: 0xe00d}
+	sequenceDelimitationTag  = dicomtag.Tag{Group: 0xfffe, Element: 0xe0dd}
+	errTruncatedRawElement   = errors.New("dicom.coerce: truncated element")
+	errRawElementsTooDeep    = errors.New("dicom.coerce: sequences nested too deeply")
+	uncoercibleAttributeTags = map[dicomtag.Tag]bool{
+		dicomtag.SOPClassUID:    true,
+		dicomtag.SOPInstanceUID: true,
+	}
+)
+
+// Returns the top-level elements of "data".
+func scanRawElements(data []byte, bo binary.ByteOrder, implicit bool) ([]rawElement, error) {
+	var elems []rawElement
+	for off := 0; off < len(data); {
+		e, err := scanRawElement(data, off, bo, implicit, 0)
+		if err != nil {
+			return nil, err
+		}
+		elems = append(elems, e)
+		off = e.end
+	}
+	return elems, nil
+}
+
+// Locate the element that starts at data[off:]. Elements of undefined length,
+// i.e., sequences, items and encapsulated pixel data, are scanned to their
+// delimiter.
+func scanRawElement(data []byte, off int, bo binary.ByteOrder, implicit bool, depth int) (rawElement, error) {
+	if depth > maxRawElementDepth {
+		return rawElement{}, errRawElementsTooDeep
+	}
+	if len(data)-off < 8 {
+		return rawElement{}, errTruncatedRawElement
+	}
+	e := rawElement{
+		tag:   dicomtag.Tag{Group: bo.Uint16(data[off:]), Element: bo.Uint16(data[off+2:])},
+		start: off,
+	}
+	var length uint32
+	if implicit || e.tag.Group == 0xfffe {
+		// Items and delimiters have no VR, whatever the transfer syntax.
+		if info, err := dicomtag.Find(e.tag); err == nil {
+			e.vr = info.VR
+		}
+		length = bo.Uint32(data[off+4:])
+		e.valueStart = off + 8
+	} else {
+		e.vr = string(data[off+4 : off+6])
+		if longExplicitVRs[e.vr] {
+			if len(data)-off < 12 {
+				return rawElement{}, errTruncatedRawElement
+			}
+			length = bo.Uint32(data[off+8:])
+			e.valueStart = off + 12
+		} else {
+			length = uint32(bo.Uint16(data[off+6:]))
+			e.valueStart = off + 8
+		}
+	}
+	if length != 0xffffffff {
+		if uint64(len(data)-e.valueStart) < uint64(length) {
+			return rawElement{}, errTruncatedRawElement
+		}
+		e.end = e.valueStart + int(length)
+		return e, nil
+	}
+	delimiter := sequenceDelimitationTag
+	if e.tag == itemTag {
+		delimiter = itemDelimitationTag
+	}
+	for off := e.valueStart; ; {
+		child, err := scanRawElement(data, off, bo, implicit, depth+1)
+		if err != nil {
+			return rawElement{}, err
+		}
+		off = child.end
+		if child.tag == delimiter {
+			e.end = off
+			return e, nil
+		}
+	}
+}
+
+// Encode a top-level element with a string VR.
+func encodeRawStringElement(tag dicomtag.Tag, vr string, values []string, bo binary.ByteOrder, implicit bool) ([]byte, error) {
+	value := []byte(strings.Join(values, "\\"))
+	if len(value)%2 == 1 {
+		if vr == "UI" {
+			value = append(value, 0)
+		} else {
+			value = append(value, ' ')
+		}
+	}
+	var b bytes.Buffer
+	binary.Write(&b, bo, tag.Group)
+	binary.Write(&b, bo, tag.Element)
+	switch {
+	case implicit:
+		binary.Write(&b, bo, uint32(len(value)))
+	case longExplicitVRs[vr]:
+		b.WriteString(vr)
+		b.Write([]byte{0, 0})
+		binary.Write(&b, bo, uint32(len(value)))
+	default:
+		if len(value) > 0xffff {
+			return nil, fmt.Errorf("dicom.coerce: value of %s too long for VR %s", tag.String(), vr)
+		}
+		b.WriteString(vr)
+		binary.Write(&b, bo, uint16(len(value)))
+	}
+	b.Write(value)
+	return b.Bytes(), nil
+}
+
+// Bytes at the head of a streamed dataset that are buffered for CStoreCoerce,
+// beyond which its elements are passed through unseen.
+const maxCoerceStreamHeadBytes = 1 << 20
+
+// Run params.CStoreCoerce on "data", encoded in transferSyntaxUID. Returns the
+// coerced dataset and the changes made; "data" itself is not modified.
+func coerceCStoreData(params ServiceProviderParams, conn ConnectionState,
+	transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) ([]byte, []Coercion, error) {
+	return coerceRawElements(params, conn, transferSyntaxUID, sopClassUID, sopInstanceUID, data, nil)
+}
+
+// Like coerceCStoreData, but for a dataset streamed through "r". Only the
+// top-level elements that precede PixelData, and fit in the first
+// maxCoerceStreamHeadBytes, are read ahead, shown to the callback and coerced.
+// Returns the reader of the coerced dataset; the bytes past its head are
+// passed through as they arrive.
+func coerceCStoreStream(params ServiceProviderParams, conn ConnectionState,
+	transferSyntaxUID, sopClassUID, sopInstanceUID string, r io.Reader) (io.Reader, []Coercion, error) {
+	if transferSyntaxUID == dicomuid.DeflatedExplicitVRLittleEndian || isOpaqueTransferSyntax(transferSyntaxUID) {
+		dicomlog.Vprintf(0, "dicom.coerce: not coercing %s, encoded in %s", sopInstanceUID, dicomuid.UIDString(transferSyntaxUID))
+		return r, nil, nil
+	}
+	bo, implicitVR, err := ParseTransferSyntaxUID(transferSyntaxUID)
+	if err != nil {
+		return nil, nil, err
+	}
+	implicit := implicitVR == ImplicitVR
+	var head []byte
+	end := 0 // offset past the elements of "head" scanned so far
+	buf := make([]byte, 32<<10)
+	for {
+		// The tag that follows the scanned elements, if known.
+		var next *dicomtag.Tag
+		for next == nil && len(head)-end >= 4 {
+			tag := dicomtag.Tag{Group: bo.Uint16(head[end:]), Element: bo.Uint16(head[end+2:])}
+			if !tagLess(tag, dicomtag.PixelData) {
+				next = &tag
+				break
+			}
+			e, err := scanRawElement(head, end, bo, implicit, 0)
+			if err == errTruncatedRawElement {
+				next = &tag
+				break
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+			end = e.end
+		}
+		if next != nil && (!tagLess(*next, dicomtag.PixelData) || len(head) >= maxCoerceStreamHeadBytes) {
+			// Tags from "next" on are past the head.
+			coerced, coercions, err := coerceRawElements(params, conn, transferSyntaxUID, sopClassUID, sopInstanceUID, head[:end], next)
+			if err != nil {
+				return nil, nil, err
+			}
+			return io.MultiReader(bytes.NewReader(coerced), bytes.NewReader(head[end:]), r), coercions, nil
+		}
+		n, err := r.Read(buf)
+		head = append(head, buf[:n]...)
+		if err == io.EOF {
+			// The whole dataset fits in the head.
+			coerced, coercions, err := coerceRawElements(params, conn, transferSyntaxUID, sopClassUID, sopInstanceUID, head, nil)
+			if err != nil {
+				return nil, nil, err
+			}
+			return bytes.NewReader(coerced), coercions, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+// Run params.CStoreCoerce on "data". If "limit" is non-nil, "data" is the head
+// of a dataset, and the attributes at or past *limit can't be coerced.
+func coerceRawElements(params ServiceProviderParams, conn ConnectionState,
+	transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte, limit *dicomtag.Tag) ([]byte, []Coercion, error) {
+	if transferSyntaxUID == dicomuid.DeflatedExplicitVRLittleEndian || isOpaqueTransferSyntax(transferSyntaxUID) {
+		// Can't be rewritten without inflating the whole dataset, or
+		// knowing its encoding.
+		dicomlog.Vprintf(0, "dicom.coerce: not coercing %s, encoded in %s", sopInstanceUID, dicomuid.UIDString(transferSyntaxUID))
+		return data, nil, nil
+	}
+	bo, implicitVR, err := ParseTransferSyntaxUID(transferSyntaxUID)
+	if err != nil {
+		return nil, nil, err
+	}
+	implicit := implicitVR == ImplicitVR
+	raw, err := scanRawElements(data, bo, implicit)
+	if err != nil {
+		return nil, nil, err
+	}
+	var elems []*dicom.Element
+	for _, e := range raw {
+		if !stringVRs[e.vr] {
+			continue
+		}
+		value := data[e.valueStart:e.end]
+		if elem, err := dicom.NewElement(e.tag, shallowElementValue(e.vr, bo, value)); err == nil {
+			elem.RawValueRepresentation = e.vr
+			elem.ValueLength = uint32(len(value))
+			elems = append(elems, elem)
+		}
+	}
+	values, err := params.CStoreCoerce(conn, sopClassUID, sopInstanceUID, elems)
+	if err != nil || len(values) == 0 {
+		return data, nil, err
+	}
+
+	// Apply the changes in tag order, so that inserted elements keep the
+	// dataset sorted.
+	tags := make([]dicomtag.Tag, 0, len(values))
+	for tag := range values {
+		tags = append(tags, tag)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tagLess(tags[i], tags[j]) })
+	var out bytes.Buffer
+	var coercions []Coercion
+	next := 0 // offset in "data" of the bytes not copied yet
+	for _, tag := range tags {
+		if uncoercibleAttributeTags[tag] || tag.Group == 0x0002 {
+			return nil, nil, fmt.Errorf("dicom.coerce: %s can't be coerced", tag.String())
+		}
+		if limit != nil && !tagLess(tag, *limit) {
+			return nil, nil, fmt.Errorf("dicom.coerce: %s follows the head of the streamed dataset, and can't be coerced", tag.String())
+		}
+		newValue := values[tag]
+		i := sort.Search(len(raw), func(i int) bool { return !tagLess(raw[i].tag, tag) })
+		found := i < len(raw) && raw[i].tag == tag
+		c := Coercion{Tag: tag, NewValue: newValue}
+		vr := ""
+		if found {
+			vr = raw[i].vr
+		} else if info, err := dicomtag.Find(tag); err == nil {
+			vr = info.VR
+		}
+		if !stringVRs[vr] {
+			return nil, nil, fmt.Errorf("dicom.coerce: %s has VR %q, not a string", tag.String(), vr)
+		}
+		if found {
+			c.OldValue = shallowElementValue(vr, bo, data[raw[i].valueStart:raw[i].end]).([]string)
+		}
+		if (!found && newValue == nil) || (found && newValue != nil && strings.Join(c.OldValue, "\\") == strings.Join(newValue, "\\")) {
+			continue
+		}
+		start := len(data)
+		if i < len(raw) {
+			start = raw[i].start
+		}
+		out.Write(data[next:start])
+		next = start
+		if found {
+			next = raw[i].end
+		}
+		if newValue != nil {
+			b, err := encodeRawStringElement(tag, vr, newValue, bo, implicit)
+			if err != nil {
+				return nil, nil, err
+			}
+			out.Write(b)
+		}
+		coercions = append(coercions, c)
+	}
+	if len(coercions) == 0 {
+		return data, nil, nil
+	}
+	out.Write(data[next:])
+	return out.Bytes(), coercions, nil
+}
+
+// The status of a C-STORE whose dataset was coerced, given the status the
+// handler returned.
+func coercedCStoreStatus(status dimse.Status, coercions []Coercion) dimse.Status {
+	if len(coercions) == 0 || status.Status != dimse.StatusSuccess {
+		return status
+	}
+	var tags []string
+	for _, c := range coercions {
+		tags = append(tags, c.Tag.String())
+	}
+	comment := "coerced " + strings.Join(tags, ", ")
+	if len(comment) > maxErrorCommentLength {
+		// Error Comment is an LO.
+		comment = fmt.Sprintf("coerced %d attributes", len(coercions))
+	}
+	return dimse.Status{Status: dimse.CStoreCoercionOfDataElements, ErrorComment: comment}
+}
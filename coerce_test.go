@@ -0,0 +1,123 @@
+package netdicom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	dicom "github.com/antibios/dicom"
+	dicomtag "github.com/antibios/dicom/pkg/tag"
+	dicomuid "github.com/antibios/dicom/pkg/uid"
+	"github.com/antibios/go-netdicom/dimse"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCoerceCStoreData(t *testing.T) {
+	bo := binary.LittleEndian
+	element := func(tag dicomtag.Tag, vr string, values ...string) []byte {
+		b, err := encodeRawStringElement(tag, vr, values, bo, false)
+		require.NoError(t, err)
+		return b
+	}
+	// ReferencedStudySequence, of undefined length, holding one item of
+	// undefined length.
+	var sq bytes.Buffer
+	sq.Write([]byte{0x08, 0x00, 0x10, 0x11, 'S', 'Q', 0, 0, 0xff, 0xff, 0xff, 0xff})
+	sq.Write([]byte{0xfe, 0xff, 0x00, 0xe0, 0xff, 0xff, 0xff, 0xff})
+	sq.Write(element(dicomtag.ReferencedSOPInstanceUID, "UI", "1.2.3"))
+	sq.Write([]byte{0xfe, 0xff, 0x0d, 0xe0, 0, 0, 0, 0})
+	sq.Write([]byte{0xfe, 0xff, 0xdd, 0xe0, 0, 0, 0, 0})
+
+	in := bytes.Join([][]byte{
+		element(dicomtag.AccessionNumber, "SH", "ACC1"),
+		sq.Bytes(),
+		element(dicomtag.PatientID, "LO", "WRONG"),
+		element(dicomtag.StudyInstanceUID, "UI", "1.2.4"),
+	}, nil)
+	params := ServiceProviderParams{
+		CStoreCoerce: func(conn ConnectionState, sopClassUID, sopInstanceUID string, elems []*dicom.Element) (map[dicomtag.Tag][]string, error) {
+			var tags []dicomtag.Tag
+			for _, elem := range elems {
+				tags = append(tags, elem.Tag)
+			}
+			require.Equal(t, []dicomtag.Tag{dicomtag.AccessionNumber, dicomtag.PatientID, dicomtag.StudyInstanceUID}, tags)
+			return map[dicomtag.Tag][]string{
+				dicomtag.AccessionNumber:  nil,
+				dicomtag.PatientName:      {"DOE^JOHN"},
+				dicomtag.PatientID:        {"RIGHT"},
+				dicomtag.StudyInstanceUID: {"1.2.4"},
+			}, nil
+		},
+	}
+	out, coercions, err := coerceCStoreData(params, ConnectionState{}, dicomuid.ExplicitVRLittleEndian, "1.2.840.10008.5.1.4.1.1.7", "1.2.5", in)
+	require.NoError(t, err)
+	require.Equal(t, bytes.Join([][]byte{
+		sq.Bytes(),
+		element(dicomtag.PatientName, "PN", "DOE^JOHN"),
+		element(dicomtag.PatientID, "LO", "RIGHT"),
+		element(dicomtag.StudyInstanceUID, "UI", "1.2.4"),
+	}, nil), out)
+	require.Equal(t, []Coercion{
+		{Tag: dicomtag.AccessionNumber, OldValue: []string{"ACC1"}},
+		{Tag: dicomtag.PatientName, NewValue: []string{"DOE^JOHN"}},
+		{Tag: dicomtag.PatientID, OldValue: []string{"WRONG"}, NewValue: []string{"RIGHT"}},
+	}, coercions)
+	require.Equal(t, dimse.CStoreCoercionOfDataElements, coercedCStoreStatus(dimse.Success, coercions).Status)
+
+	params.CStoreCoerce = func(ConnectionState, string, string, []*dicom.Element) (map[dicomtag.Tag][]string, error) {
+		return map[dicomtag.Tag][]string{dicomtag.SOPInstanceUID: {"1.2.6"}}, nil
+	}
+	_, _, err = coerceCStoreData(params, ConnectionState{}, dicomuid.ExplicitVRLittleEndian, "1.2.840.10008.5.1.4.1.1.7", "1.2.5", in)
+	require.Error(t, err)
+}
+
+func TestCoerceCStoreStream(t *testing.T) {
+	bo := binary.LittleEndian
+	element := func(tag dicomtag.Tag, vr string, values ...string) []byte {
+		b, err := encodeRawStringElement(tag, vr, values, bo, false)
+		require.NoError(t, err)
+		return b
+	}
+	pixels := []byte{0xe0, 0x7f, 0x10, 0x00, 'O', 'B', 0, 0, 4, 0, 0, 0, 1, 2, 3, 4}
+	in := bytes.Join([][]byte{
+		element(dicomtag.PatientID, "LO", "WRONG"),
+		element(dicomtag.StudyInstanceUID, "UI", "1.2.4"),
+		pixels,
+	}, nil)
+	params := ServiceProviderParams{
+		CStoreCoerce: func(conn ConnectionState, sopClassUID, sopInstanceUID string, elems []*dicom.Element) (map[dicomtag.Tag][]string, error) {
+			return map[dicomtag.Tag][]string{dicomtag.PatientID: {"RIGHT"}}, nil
+		},
+	}
+	// The head arrives a byte at a time.
+	r, coercions, err := coerceCStoreStream(params, ConnectionState{}, dicomuid.ExplicitVRLittleEndian, "1.2.840.10008.5.1.4.1.1.7", "1.2.5", iotest.OneByteReader(bytes.NewReader(in)))
+	require.NoError(t, err)
+	out, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, bytes.Join([][]byte{
+		element(dicomtag.PatientID, "LO", "RIGHT"),
+		element(dicomtag.StudyInstanceUID, "UI", "1.2.4"),
+		pixels,
+	}, nil), out)
+	require.Equal(t, []Coercion{{Tag: dicomtag.PatientID, OldValue: []string{"WRONG"}, NewValue: []string{"RIGHT"}}}, coercions)
+
+	// Without PixelData, the whole dataset is read ahead.
+	r, _, err = coerceCStoreStream(params, ConnectionState{}, dicomuid.ExplicitVRLittleEndian, "1.2.840.10008.5.1.4.1.1.7", "1.2.5", bytes.NewReader(in[:len(in)-len(pixels)]))
+	require.NoError(t, err)
+	out, err = io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, bytes.Join([][]byte{
+		element(dicomtag.PatientID, "LO", "RIGHT"),
+		element(dicomtag.StudyInstanceUID, "UI", "1.2.4"),
+	}, nil), out)
+}
+
+func TestErrorComment(t *testing.T) {
+	require.Equal(t, "short", errorComment("short"))
+	long := strings.Repeat("x", 63) + "é"
+	require.Equal(t, strings.Repeat("x", 63), errorComment(long))
+	require.Len(t, errorComment(strings.Repeat("y", 100)), maxErrorCommentLength)
+}
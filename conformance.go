@@ -0,0 +1,211 @@
+package netdicom
+
+// This file describes what a ServiceProvider negotiates, as a capability
+// description and a conformance summary.
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	dicomuid "github.com/antibios/dicom/pkg/uid"
+	"github.com/antibios/go-netdicom/sopclass"
+)
+
+// Capabilities describes what a ServiceProvider accepts during association
+// negotiation, derived from its current ServiceProviderParams.
+type Capabilities struct {
+	AETitle                   string
+	ImplementationClassUID    string
+	ImplementationVersionName string
+
+	// MaxPDUSize is the maximum PDU length the provider advertises.
+	MaxPDUSize int
+
+	// TLS is set if connections must use TLS.
+	TLS bool
+
+	// AllowedCallingAETitles is ServiceProviderParams.AllowedCallingAETitles.
+	// Empty if every peer may associate.
+	AllowedCallingAETitles []string
+
+	// CalledAETitles is ServiceProviderParams.CalledAETitles. Empty if the
+	// called AE title isn't checked.
+	CalledAETitles []string
+
+	// UserIdentity is "required" or "optional" if the provider
+	// authenticates peers with ServiceProviderParams.Authenticator, and
+	// "ignored" otherwise.
+	UserIdentity string
+
+	// AnySOPClass is set if every proposed abstract syntax is accepted, as
+	// by default; see ServiceProviderParams.RejectUnknownSOPClasses.
+	// SOPClasses then lists only the classes known to the sopclass package.
+	AnySOPClass bool
+
+	// SOPClasses lists the SOP classes accepted, sorted by service and
+	// UID.
+	SOPClasses []SOPClassCapability
+
+	// TransferSyntaxes lists the well-known transfer syntaxes the provider
+	// accepts. It accepts the first transfer syntax proposed for each
+	// context, except that explicit VR big endian is picked only if it's
+	// the sole one proposed, and is refused if retired. See
+	// ServiceProviderParams.BigEndian.
+	TransferSyntaxes []string
+
+	// The Asynchronous Operations Window, as in ServiceProviderParams. 0
+	// means unlimited.
+	MaxOpsPerformed int
+	MaxOpsInvoked   int
+}
+
+// SOPClassCapability describes the support for one SOP class.
+type SOPClassCapability struct {
+	UID string
+
+	// Service is the DIMSE service the class is used with: "C-ECHO",
+	// "C-STORE", "C-FIND", "C-MOVE", "C-GET" or, for MPPS,
+	// "N-CREATE/N-SET".
+	Service string
+
+	// Role is "SCP" for all the classes accepted by a provider.
+	Role string
+
+	// Implemented is set if a handler is configured for the service.
+	// Otherwise the class is still negotiated, but its requests fail with
+	// "unrecognized operation".
+	Implemented bool
+}
+
+// Capabilities returns the capability description of the provider, based on
+// its current parameters.
+func (sp *ServiceProvider) Capabilities() Capabilities {
+	sp.mu.Lock()
+	params := sp.params
+	sp.mu.Unlock()
+	return capabilitiesForParams(params)
+}
+
+func capabilitiesForParams(params ServiceProviderParams) Capabilities {
+	c := Capabilities{
+		AETitle:                   params.AETitle,
+		ImplementationClassUID:    GoDICOMImplementationClassUID,
+		ImplementationVersionName: GoDICOMImplementationVersionName,
+		MaxPDUSize:                maxPDUSizeOrDefault(params.MaxPDUSize),
+		TLS:                       params.TLSConfig != nil,
+		AllowedCallingAETitles:    params.AllowedCallingAETitles,
+		CalledAETitles:            params.CalledAETitles,
+		MaxOpsPerformed:           params.MaxOpsPerformed,
+		MaxOpsInvoked:             params.MaxOpsInvoked,
+	}
+	switch {
+	case params.Authenticator == nil:
+		c.UserIdentity = "ignored"
+	case params.AllowAnonymous:
+		c.UserIdentity = "optional"
+	default:
+		c.UserIdentity = "required"
+	}
+	accept := abstractSyntaxFilter(params)
+	c.AnySOPClass = accept == nil
+	hasCStore := hasCStoreHandler(params)
+	seen := map[string]bool{}
+	for _, s := range []struct {
+		service     string
+		uids        []string
+		implemented bool
+	}{
+		{"C-ECHO", sopclass.VerificationClasses, params.CEcho != nil},
+		{"C-FIND", sopclass.QRFindClasses, params.CFind != nil},
+		{"C-MOVE", sopclass.QRMoveClasses, params.CMove != nil},
+		{"C-GET", sopclass.QRGetClasses, params.CGet != nil},
+		{"C-STORE", sopclass.StorageClasses, hasCStore},
+		{"N-CREATE/N-SET", sopclass.MPPSClasses, params.MPPS != nil || params.NService != nil},
+	} {
+		for _, uid := range s.uids {
+			// QRGetClasses also lists the storage classes.
+			if seen[uid] || !nonStorageAbstractSyntaxes[uid] && s.service != "C-STORE" {
+				continue
+			}
+			if accept != nil && !accept(uid) {
+				continue
+			}
+			seen[uid] = true
+			c.SOPClasses = append(c.SOPClasses, SOPClassCapability{
+				UID:         uid,
+				Service:     s.service,
+				Role:        "SCP",
+				Implemented: s.implemented,
+			})
+		}
+	}
+	sort.SliceStable(c.SOPClasses, func(i, j int) bool {
+		a, b := c.SOPClasses[i], c.SOPClasses[j]
+		if a.Service != b.Service {
+			return a.Service < b.Service
+		}
+		return a.UID < b.UID
+	})
+	for _, uid := range append(append([]string{}, StandardTransferSyntaxes...), sortedRecentTransferSyntaxes()...) {
+		if uid == dicomuid.ExplicitVRBigEndian && params.BigEndian == RetireExplicitVRBigEndian {
+			continue
+		}
+		c.TransferSyntaxes = append(c.TransferSyntaxes, uid)
+	}
+	return c
+}
+
+func sortedRecentTransferSyntaxes() []string {
+	var uids []string
+	for uid := range recentTransferSyntaxes {
+		uids = append(uids, uid)
+	}
+	sort.Strings(uids)
+	return uids
+}
+
+// Summary renders the capabilities as a plain-text conformance summary.
+func (c Capabilities) Summary() string {
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "AE title: %s\n", c.AETitle)
+	fmt.Fprintf(&b, "Implementation: %s (%s)\n", c.ImplementationClassUID, c.ImplementationVersionName)
+	fmt.Fprintf(&b, "Max PDU size: %d\n", c.MaxPDUSize)
+	fmt.Fprintf(&b, "TLS: %v\n", c.TLS)
+	if len(c.AllowedCallingAETitles) > 0 {
+		fmt.Fprintf(&b, "Allowed calling AE titles: %s\n", strings.Join(c.AllowedCallingAETitles, ", "))
+	} else {
+		fmt.Fprintf(&b, "Allowed calling AE titles: any\n")
+	}
+	if len(c.CalledAETitles) > 0 {
+		fmt.Fprintf(&b, "Accepted called AE titles: %s\n", strings.Join(c.CalledAETitles, ", "))
+	} else {
+		fmt.Fprintf(&b, "Accepted called AE titles: any\n")
+	}
+	fmt.Fprintf(&b, "User identity: %s\n", c.UserIdentity)
+	fmt.Fprintf(&b, "Asynchronous operations window: performed %s, invoked %s\n",
+		opsString(c.MaxOpsPerformed), opsString(c.MaxOpsInvoked))
+	if c.AnySOPClass {
+		fmt.Fprintf(&b, "Any SOP class is accepted.\n")
+	}
+	fmt.Fprintf(&b, "SOP classes:\n")
+	for _, s := range c.SOPClasses {
+		note := ""
+		if !s.Implemented {
+			note = " (not implemented)"
+		}
+		fmt.Fprintf(&b, "  %s %s %s%s\n", s.Service, s.Role, dicomuid.UIDString(s.UID), note)
+	}
+	fmt.Fprintf(&b, "Transfer syntaxes:\n")
+	for _, uid := range c.TransferSyntaxes {
+		fmt.Fprintf(&b, "  %s\n", dicomuid.UIDString(uid))
+	}
+	return b.String()
+}
+
+func opsString(n int) string {
+	if n == 0 {
+		return "unlimited"
+	}
+	return fmt.Sprint(n)
+}
@@ -0,0 +1,45 @@
+package netdicom
+
+import (
+	"testing"
+
+	"github.com/antibios/dicom/pkg/uid"
+	"github.com/antibios/go-netdicom/dimse"
+	"github.com/antibios/go-netdicom/sopclass"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCapabilities(t *testing.T) {
+	router := NewCStoreRouter()
+	router.HandleCategory(sopclass.StructuredReport, func(conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID, calledAE, callingAE string, data []byte) dimse.Status {
+		return dimse.Success
+	})
+	c := capabilitiesForParams(ServiceProviderParams{
+		AETitle:        "ARCHIVE",
+		CEcho:          func(conn ConnectionState) dimse.Status { return dimse.Success },
+		CStoreHandlers: router,
+	})
+	require.Equal(t, "ARCHIVE", c.AETitle)
+	require.False(t, c.TLS)
+	services := map[string]int{}
+	for _, s := range c.SOPClasses {
+		services[s.Service]++
+		switch s.Service {
+		case "C-ECHO":
+			require.True(t, s.Implemented)
+		case "C-STORE":
+			require.True(t, sopclass.StructuredReport(s.UID), s.UID)
+			require.True(t, s.Implemented)
+		default:
+			require.False(t, s.Implemented)
+		}
+	}
+	require.Equal(t, 1, services["C-ECHO"])
+	require.Equal(t, len(sopclass.QRFindClasses), services["C-FIND"])
+	require.Equal(t, 3, services["C-GET"])
+	require.Contains(t, c.TransferSyntaxes, uid.ExplicitVRBigEndian)
+
+	c = capabilitiesForParams(ServiceProviderParams{BigEndian: RetireExplicitVRBigEndian})
+	require.NotContains(t, c.TransferSyntaxes, uid.ExplicitVRBigEndian)
+	require.Contains(t, c.Summary(), "Transfer syntaxes:")
+}
@@ -1,7 +1,11 @@
 package netdicom
 
 import (
+	"context"
 	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
 
 	dicomuid "github.com/antibios/dicom/pkg/uid"
 	"github.com/antibios/go-dicom/dicomlog"
@@ -21,6 +25,60 @@ type contextManagerEntry struct {
 	abstractSyntaxUID string
 	transferSyntaxUID string
 	result            pdu.PresentationContextResult // was this mapping accepted by the server?
+	// Messages exchanged on the context. Shared by the copies of the entry.
+	usage *contextUsage
+}
+
+// Counters of the DIMSE messages exchanged on a presentation context. Updated
+// atomically.
+type contextUsage struct {
+	received int64
+	sent     int64
+}
+
+// ContextUsage reports how an accepted presentation context was used during
+// an association, e.g., to prune SOP classes and transfer syntaxes that are
+// negotiated but never used. Some peers are slow to set up associations that
+// propose many contexts.
+type ContextUsage struct {
+	ContextID         byte
+	AbstractSyntaxUID string
+	TransferSyntaxUID string
+	// Number of DIMSE messages, commands and responses, received and sent
+	// on the context.
+	MessagesReceived int64
+	MessagesSent     int64
+}
+
+// Used reports whether any message was exchanged on the context.
+func (u ContextUsage) Used() bool {
+	return u.MessagesReceived > 0 || u.MessagesSent > 0
+}
+
+// RejectedPresentationContext describes one presentation context that the
+// peer refused during association negotiation.
+type RejectedPresentationContext struct {
+	ContextID         byte
+	AbstractSyntaxUID string
+	Result            pdu.PresentationContextResult
+}
+
+// NoAcceptedContextsError is reported to the service user when the provider
+// accepts the association but rejects every presentation context proposed in
+// A-ASSOCIATE-RQ. Such an association can't carry any DIMSE message, so it is
+// aborted immediately.
+type NoAcceptedContextsError struct {
+	Contexts []RejectedPresentationContext
+}
+
+func (e *NoAcceptedContextsError) Error() string {
+	reasons := make([]string, len(e.Contexts))
+	for i, c := range e.Contexts {
+		reasons[i] = fmt.Sprintf("context %d (%s): %s",
+			c.ContextID, dicomuid.UIDString(c.AbstractSyntaxUID), c.Result.String())
+	}
+	return fmt.Sprintf("dicom: provider rejected all %d presentation contexts: %s",
+		len(e.Contexts), strings.Join(reasons, "; "))
 }
 
 // contextManager manages mappings between a contextID and the corresponding
@@ -33,18 +91,79 @@ type contextManagerEntry struct {
 // per association.
 type contextManager struct {
 	label string // for diagnostics only.
+	logf  Logger
+
+	// The context of the association, on the provider side. See
+	// ConnectionState.Context.
+	ctx context.Context
 
-	// The two maps are inverses of each other.
+	// The two maps are inverses of each other. One abstract syntax may be
+	// accepted under multiple contexts, each with a different transfer
+	// syntax, so the latter map holds a list of entries in contextID order.
 	contextIDToAbstractSyntaxNameMap map[byte]*contextManagerEntry
-	abstractSyntaxNameToContextIDMap map[string]*contextManagerEntry
+	abstractSyntaxNameToContextIDMap map[string][]*contextManagerEntry
+
+	// The max PDU size advertised to the peer in A-ASSOCIATE-RQ or -AC.
+	maxPDUSize int
+
+	// Whether explicit VR big endian, and transfer syntaxes missing from
+	// the registry, are proposed or accepted, as in ServiceUserParams and
+	// ServiceProviderParams.
+	bigEndian               BigEndianPolicy
+	unknownTransferSyntaxes UnknownTransferSyntaxPolicy
 
 	// Info about the the other side of the communication, gleaned from
 	// A-ASSOCIATE-* pdu.
 	peerMaxPDUSize int
+	// AE titles of the association, without padding. Set by the
+	// statemachine.
+	callingAETitle string
+	calledAETitle  string
+	// The AE title fields of the A-ASSOCIATE-RQ, padding included. Only
+	// set on the provider side.
+	rawCallingAETitle string
+	rawCalledAETitle  string
 	// UID that identifies the peer type. It's supposed to be globally unique.
 	peerImplementationClassUID string
 	// Implementation version, virtually meaningless since its format isn't standardiszed.
 	peerImplementationVersionName string
+	// The Asynchronous Operations Window proposed by the peer (P3.7
+	// D.3.3.3). 0 means unlimited. Both are 1, the default, if the peer
+	// didn't propose a window.
+	peerMaxOpsInvoked   int
+	peerMaxOpsPerformed int
+	// Set if the peer proposed an Asynchronous Operations Window.
+	peerProposedOpsWindow bool
+
+	// Used only on the provider side: the window offered in reply to a
+	// proposal, as ServiceProviderParams.MaxOps{Performed,Invoked}. 0
+	// means unlimited.
+	maxOpsPerformed int
+	maxOpsInvoked   int
+
+	// Used only on the user side: the roles proposed in A-ASSOCIATE-RQ, and
+	// the ones granted in A-ASSOCIATE-AC, keyed by SOP class UID. See
+	// roleselection.go.
+	proposedRoles []RoleSelection
+	grantedRoles  map[string]RoleSelection
+
+	// Used only on the provider side: the roles the peer proposed, and
+	// were accepted, keyed by SOP class UID.
+	peerRoles map[string]RoleSelection
+
+	// Used only on the user side: the identity sent in A-ASSOCIATE-RQ, or
+	// nil. See useridentity.go.
+	proposedIdentity *UserIdentity
+	// The server response of the User Identity item in A-ASSOCIATE-AC,
+	// or nil.
+	identityResponse []byte
+	// The A-ASSOCIATE-AC, as received. See ServiceUser.AssociateAC.
+	associateAC *pdu.AAssociate
+
+	// Used only on the provider side: the identity the peer sent, or nil,
+	// and the principal the Authenticator established from it, or nil.
+	peerIdentity *pdu.UserIdentityRequestSubItem
+	principal    *Principal
 
 	// tmpRequests used only on the client (requestor) side. It holds the
 	// contextid->presentationcontext mapping generated from the
@@ -52,15 +171,25 @@ type contextManager struct {
 	// is matched against the response PDU and
 	// contextid->{abstractsyntax,transfersyntax} mappings are filled.
 	tmpRequests map[byte]*pdu.PresentationContextItem
+
+	// acceptAbstractSyntax is used only on the provider side. If non-nil,
+	// it is called for each abstract syntax proposed in A_ASSOCIATE_RQ, and
+	// contexts for which it returns false are rejected. If nil, every
+	// abstract syntax is accepted.
+	acceptAbstractSyntax func(abstractSyntaxUID string) bool
 }
 
 // Create an empty contextManager
 func newContextManager(label string) *contextManager {
 	c := &contextManager{
 		label:                            label,
+		logf:                             dicomlog.Vprintf,
 		contextIDToAbstractSyntaxNameMap: make(map[byte]*contextManagerEntry),
-		abstractSyntaxNameToContextIDMap: make(map[string]*contextManagerEntry),
+		abstractSyntaxNameToContextIDMap: make(map[string][]*contextManagerEntry),
+		maxPDUSize:                       DefaultMaxPDUSize,
 		peerMaxPDUSize:                   16384, // The default value used by Osirix & pynetdicom.
+		peerMaxOpsInvoked:                1,
+		peerMaxOpsPerformed:              1,
 		tmpRequests:                      make(map[byte]*pdu.PresentationContextItem),
 	}
 	return c
@@ -68,20 +197,26 @@ func newContextManager(label string) *contextManager {
 
 // Called by the user (client) to produce a list to be embedded in an
 // A_REQUEST_RQ.Items. The PDU is sent when running as a service user (client).
-// maxPDUSize is the maximum PDU size, in bytes, that the clients is willing to
-// receive. maxPDUSize is encoded in one of the items.
+// m.maxPDUSize is the maximum PDU size, in bytes, that the clients is willing
+// to receive. It is encoded in one of the items.
+//
+// If contextPerTransferSyntax is true, each <sopclass, transfersyntax> pair is
+// proposed in its own presentation context, so that the provider can accept
+// the same sopclass under multiple transfer syntaxes.
 func (m *contextManager) generateAssociateRequest(
-	sopClassUIDs []string, transferSyntaxUIDs []string) []pdu.SubItem {
+	sopClassUIDs []string, transferSyntaxUIDs []string,
+	contextPerTransferSyntax bool) []pdu.SubItem {
 	items := []pdu.SubItem{
 		&pdu.ApplicationContextItem{
 			Name: pdu.DICOMApplicationContextItemName,
 		}}
+	transferSyntaxUIDs = proposableTransferSyntaxes(transferSyntaxUIDs, m.bigEndian)
 	var contextID byte = 1
-	for _, sop := range sopClassUIDs {
+	addContext := func(sop string, syntaxUIDs []string) {
 		syntaxItems := []pdu.SubItem{
 			&pdu.AbstractSyntaxSubItem{Name: sop},
 		}
-		for _, syntaxUID := range transferSyntaxUIDs {
+		for _, syntaxUID := range syntaxUIDs {
 			syntaxItems = append(syntaxItems, &pdu.TransferSyntaxSubItem{Name: syntaxUID})
 		}
 		item := &pdu.PresentationContextItem{
@@ -94,17 +229,49 @@ func (m *contextManager) generateAssociateRequest(
 		m.tmpRequests[contextID] = item
 		contextID += 2 // must be odd.
 	}
+	for _, sop := range sopClassUIDs {
+		if contextPerTransferSyntax {
+			for _, syntaxUID := range transferSyntaxUIDs {
+				addContext(sop, []string{syntaxUID})
+			}
+		} else {
+			addContext(sop, transferSyntaxUIDs)
+		}
+	}
 	items = append(items,
 		&pdu.UserInformationItem{
-			Items: []pdu.SubItem{
-				&pdu.UserInformationMaximumLengthItem{MaximumLengthReceived: uint32(DefaultMaxPDUSize)},
+			Items: append([]pdu.SubItem{
+				&pdu.UserInformationMaximumLengthItem{MaximumLengthReceived: uint32(m.maxPDUSize)},
 				&pdu.ImplementationClassUIDSubItem{Name: GoDICOMImplementationClassUID},
 				&pdu.ImplementationVersionNameSubItem{Name: GoDICOMImplementationVersionName},
-			}})
+			}, append(m.roleSelectionItems(), m.userIdentityItems()...)...)})
 
 	return items
 }
 
+// Pick the transfer syntax to accept among the ones proposed in a
+// presentation context. It is the first one proposed that "unknown" allows,
+// except that explicit VR big endian comes last. Returns false if nothing
+// acceptable is proposed under the policies; the UID returned then is the
+// first proposed.
+func pickTransferSyntax(uids []string, bigEndian BigEndianPolicy, unknown UnknownTransferSyntaxPolicy) (string, bool) {
+	var acceptable []string
+	for _, uid := range uids {
+		if _, err := canonicalTransferSyntaxUID(uid, unknown); err == nil {
+			acceptable = append(acceptable, uid)
+		}
+	}
+	for _, uid := range acceptable {
+		if uid != dicomuid.ExplicitVRBigEndian {
+			return uid, true
+		}
+	}
+	if len(acceptable) > 0 && bigEndian != RetireExplicitVRBigEndian {
+		return acceptable[0], true
+	}
+	return uids[0], false
+}
+
 // Called when A_ASSOCIATE_RQ pdu arrives, on the provider side. Returns a list of items to be sent in
 // the A_ASSOCIATE_AC pdu.
 func (m *contextManager) onAssociateRequest(requestItems []pdu.SubItem) ([]pdu.SubItem, error) {
@@ -113,16 +280,17 @@ func (m *contextManager) onAssociateRequest(requestItems []pdu.SubItem) ([]pdu.S
 			Name: pdu.DICOMApplicationContextItemName,
 		},
 	}
+	var roleRequests []*pdu.RoleSelectionSubItem
 	for _, requestItem := range requestItems {
 		switch ri := requestItem.(type) {
 		case *pdu.ApplicationContextItem:
 			if ri.Name != pdu.DICOMApplicationContextItemName {
-				dicomlog.Vprintf(0, "dicom.onAssociateRequest(%s): Found illegal applicationcontextname. Expect %v, found %v",
+				m.logf(0, "dicom.onAssociateRequest(%s): Found illegal applicationcontextname. Expect %v, found %v",
 					m.label, ri.Name, pdu.DICOMApplicationContextItemName)
 			}
 		case *pdu.PresentationContextItem:
 			var sopUID string
-			var pickedTransferSyntaxUID string
+			var transferSyntaxUIDs []string
 			for _, subItem := range ri.Items {
 				switch c := subItem.(type) {
 				case *pdu.AbstractSyntaxSubItem:
@@ -132,28 +300,35 @@ func (m *contextManager) onAssociateRequest(requestItems []pdu.SubItem) ([]pdu.S
 					}
 					sopUID = c.Name
 				case *pdu.TransferSyntaxSubItem:
-					// Just pick the first syntax UID proposed by the client.
-					if pickedTransferSyntaxUID == "" {
-						pickedTransferSyntaxUID = c.Name
-					}
+					transferSyntaxUIDs = append(transferSyntaxUIDs, c.Name)
 				default:
 					return nil, fmt.Errorf("dicom.onAssociateRequest: Unknown subitem in PresentationContext: %s",
 						subItem.String())
 				}
 			}
-			if sopUID == "" || pickedTransferSyntaxUID == "" {
+			if sopUID == "" || len(transferSyntaxUIDs) == 0 {
 				return nil, fmt.Errorf("dicom.onAssociateRequest: SOP or transfersyntax not found in PresentationContext: %v",
 					ri.String())
 			}
+			pickedTransferSyntaxUID, ok := pickTransferSyntax(transferSyntaxUIDs, m.bigEndian, m.unknownTransferSyntaxes)
+			result := pdu.PresentationContextAccepted
+			if m.acceptAbstractSyntax != nil && !m.acceptAbstractSyntax(sopUID) {
+				m.logf(0, "dicom.onAssociateRequest(%s): Rejecting unsupported abstract syntax %v in context %d",
+					m.label, dicomuid.UIDString(sopUID), ri.ContextID)
+				result = pdu.PresentationContextProviderRejectionAbstractSyntaxNotSupported
+			} else if !ok {
+				m.logf(0, "dicom.onAssociateRequest(%s): Rejecting retired transfer syntax %v in context %d",
+					m.label, dicomuid.UIDString(pickedTransferSyntaxUID), ri.ContextID)
+				result = pdu.PresentationContextProviderRejectionTransferSyntaxNotSupported
+			}
 			responses = append(responses, &pdu.PresentationContextItem{
 				Type:      pdu.ItemTypePresentationContextResponse,
 				ContextID: ri.ContextID,
-				Result:    0, // accepted
+				Result:    result,
 				Items:     []pdu.SubItem{&pdu.TransferSyntaxSubItem{Name: pickedTransferSyntaxUID}}})
-			dicomlog.Vprintf(2, "dicom.onAssociateRequest(%s): Provider(%p): addmapping %v %v %v",
+			m.logf(2, "dicom.onAssociateRequest(%s): Provider(%p): addmapping %v %v %v",
 				m.label, m, sopUID, pickedTransferSyntaxUID, ri.ContextID)
-			// TODO(saito) Callback the service provider instead of accepting the sopclass blindly.
-			addContextMapping(m, sopUID, pickedTransferSyntaxUID, ri.ContextID, pdu.PresentationContextAccepted)
+			addContextMapping(m, sopUID, pickedTransferSyntaxUID, ri.ContextID, result)
 		case *pdu.UserInformationItem:
 			for _, subItem := range ri.Items {
 				switch c := subItem.(type) {
@@ -163,22 +338,45 @@ func (m *contextManager) onAssociateRequest(requestItems []pdu.SubItem) ([]pdu.S
 					m.peerImplementationClassUID = c.Name
 				case *pdu.ImplementationVersionNameSubItem:
 					m.peerImplementationVersionName = c.Name
-
+				case *pdu.AsynchronousOperationsWindowSubItem:
+					m.peerMaxOpsInvoked = int(c.MaxOpsInvoked)
+					m.peerMaxOpsPerformed = int(c.MaxOpsPerformed)
+					m.peerProposedOpsWindow = true
+				case *pdu.RoleSelectionSubItem:
+					roleRequests = append(roleRequests, c)
+				case *pdu.UserIdentityRequestSubItem:
+					m.peerIdentity = c
 				}
 			}
 		}
 	}
-	responses = append(responses,
-		&pdu.UserInformationItem{
-			Items: []pdu.SubItem{&pdu.UserInformationMaximumLengthItem{MaximumLengthReceived: uint32(DefaultMaxPDUSize)}}})
-	dicomlog.Vprintf(1, "dicom.onAssociateRequest(%s): Received associate request, #contexts:%v, maxPDU:%v, implclass:%v, version:%v",
+	userInfo := []pdu.SubItem{&pdu.UserInformationMaximumLengthItem{MaximumLengthReceived: uint32(m.maxPDUSize)}}
+	if m.peerProposedOpsWindow {
+		// The window is answered only if proposed. P3.7 D.3.3.3.2.
+		userInfo = append(userInfo, &pdu.AsynchronousOperationsWindowSubItem{
+			MaxOpsInvoked:   uint16(minOps(m.peerMaxOpsInvoked, m.maxOpsPerformed)),
+			MaxOpsPerformed: uint16(minOps(m.peerMaxOpsPerformed, m.maxOpsInvoked)),
+		})
+	}
+	userInfo = append(userInfo, m.acceptRoleSelections(roleRequests)...)
+	responses = append(responses, &pdu.UserInformationItem{Items: userInfo})
+	m.logf(1, "dicom.onAssociateRequest(%s): Received associate request, #contexts:%v, maxPDU:%v, implclass:%v, version:%v",
 		m.label, len(m.contextIDToAbstractSyntaxNameMap),
 		m.peerMaxPDUSize, m.peerImplementationClassUID, m.peerImplementationVersionName)
 	return responses, nil
 }
 
+// Returns the smaller of two operation limits, where 0 means unlimited.
+func minOps(a, b int) int {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
 // Called by the user (client) to when A_ASSOCIATE_AC PDU arrives from the provider.
 func (m *contextManager) onAssociateResponse(responses []pdu.SubItem) error {
+	var roleReplies []*pdu.RoleSelectionSubItem
 	for _, responseItem := range responses {
 		switch ri := responseItem.(type) {
 		case *pdu.PresentationContextItem:
@@ -219,7 +417,7 @@ func (m *contextManager) onAssociateResponse(responses []pdu.SubItem) error {
 				return fmt.Errorf("dicom.onAssociateResponse(%s): The A-ASSOCIATE request lacks the abstract syntax item for tag %v (this shouldn't happen)", m.label, ri.ContextID)
 			}
 			if ri.Result != pdu.PresentationContextAccepted {
-				dicomlog.Vprintf(0, "dicom.onAssociateResponse(%s): Abstract syntax %v, transfer syntax %v was rejected by the server: %s", m.label, dicomuid.UIDString(sopUID), dicomuid.UIDString(pickedTransferSyntaxUID), ri.Result.String())
+				m.logf(0, "dicom.onAssociateResponse(%s): Abstract syntax %v, transfer syntax %v was rejected by the server: %s", m.label, dicomuid.UIDString(sopUID), dicomuid.UIDString(pickedTransferSyntaxUID), ri.Result.String())
 			}
 			if !found {
 				// Generally, we expect the server to pick a
@@ -229,7 +427,7 @@ func (m *contextManager) onAssociateResponse(responses []pdu.SubItem) error {
 				// the point of reporting the list in
 				// A-ASSOCIATE-RQ, but that's only one of
 				// DICOM's pointless complexities.
-				dicomlog.Vprintf(0, "dicom.onAssociateResponse(%s): The server picked TransferSyntaxUID '%s' for %s, which is not in the list proposed, %v",
+				m.logf(0, "dicom.onAssociateResponse(%s): The server picked TransferSyntaxUID '%s' for %s, which is not in the list proposed, %v",
 					m.label,
 					dicomuid.UIDString(pickedTransferSyntaxUID),
 					dicomuid.UIDString(sopUID),
@@ -245,18 +443,47 @@ func (m *contextManager) onAssociateResponse(responses []pdu.SubItem) error {
 					m.peerImplementationClassUID = c.Name
 				case *pdu.ImplementationVersionNameSubItem:
 					m.peerImplementationVersionName = c.Name
-
+				case *pdu.RoleSelectionSubItem:
+					roleReplies = append(roleReplies, c)
+				case *pdu.UserIdentityResponseSubItem:
+					m.identityResponse = c.ServerResponse
 				}
 			}
 		}
 	}
-	dicomlog.Vprintf(1, "dicom.onAssociateResponse(%s): Received associate response, #contexts:%v, maxPDU:%v, implclass:%v, version:%v",
+	m.onRoleSelectionReplies(roleReplies)
+	m.logf(1, "dicom.onAssociateResponse(%s): Received associate response, #contexts:%v, maxPDU:%v, implclass:%v, version:%v",
 		m.label,
 		len(m.contextIDToAbstractSyntaxNameMap),
 		m.peerMaxPDUSize, m.peerImplementationClassUID, m.peerImplementationVersionName)
+	if m.numAcceptedContexts() == 0 {
+		err := &NoAcceptedContextsError{}
+		for _, e := range m.contextIDToAbstractSyntaxNameMap {
+			err.Contexts = append(err.Contexts, RejectedPresentationContext{
+				ContextID:         e.contextID,
+				AbstractSyntaxUID: e.abstractSyntaxUID,
+				Result:            e.result,
+			})
+		}
+		sort.Slice(err.Contexts, func(i, j int) bool {
+			return err.Contexts[i].ContextID < err.Contexts[j].ContextID
+		})
+		return err
+	}
 	return nil
 }
 
+// Return the number of presentation contexts accepted during the handshake.
+func (m *contextManager) numAcceptedContexts() int {
+	n := 0
+	for _, e := range m.contextIDToAbstractSyntaxNameMap {
+		if e.result == pdu.PresentationContextAccepted {
+			n++
+		}
+	}
+	return n
+}
+
 // Add a mapping between a (global) UID and a (per-session) context ID.
 func addContextMapping(
 	m *contextManager,
@@ -264,7 +491,7 @@ func addContextMapping(
 	transferSyntaxUID string,
 	contextID byte,
 	result pdu.PresentationContextResult) {
-	dicomlog.Vprintf(2, "dicom.addContextMapping(%v): Map context %d -> %s, %s",
+	m.logf(2, "dicom.addContextMapping(%v): Map context %d -> %s, %s",
 		m.label, contextID, dicomuid.UIDString(abstractSyntaxUID),
 		dicomuid.UIDString(transferSyntaxUID))
 	doassert(result >= 0 && result <= 4, result)
@@ -278,9 +505,17 @@ func addContextMapping(
 		transferSyntaxUID: transferSyntaxUID,
 		contextID:         contextID,
 		result:            result,
+		usage:             &contextUsage{},
 	}
 	m.contextIDToAbstractSyntaxNameMap[contextID] = e
-	m.abstractSyntaxNameToContextIDMap[abstractSyntaxUID] = e
+	entries := m.abstractSyntaxNameToContextIDMap[abstractSyntaxUID]
+	for i, old := range entries {
+		if old.contextID == contextID {
+			entries[i] = e
+			return
+		}
+	}
+	m.abstractSyntaxNameToContextIDMap[abstractSyntaxUID] = append(entries, e)
 }
 
 func (m *contextManager) checkContextRejection(e *contextManagerEntry) error {
@@ -294,20 +529,85 @@ func (m *contextManager) checkContextRejection(e *contextManagerEntry) error {
 	return nil
 }
 
-// Convert an UID to a context ID.
+// Convert an UID to a context ID. If the abstract syntax is accepted under
+// multiple contexts, the one with the smallest context ID is returned.
 func (m *contextManager) lookupByAbstractSyntaxUID(name string) (contextManagerEntry, error) {
-	e, ok := m.abstractSyntaxNameToContextIDMap[name]
-	if !ok {
+	return m.lookupByAbstractSyntaxUIDAndTransferSyntax(name, "")
+}
+
+// Convert an UID to a context ID, preferring a context whose transfer syntax
+// is transferSyntaxUID. This avoids transcoding when the data to be sent is
+// already encoded in one of the accepted transfer syntaxes. If no such context
+// exists, or transferSyntaxUID is empty, it behaves like
+// lookupByAbstractSyntaxUID.
+func (m *contextManager) lookupByAbstractSyntaxUIDAndTransferSyntax(name, transferSyntaxUID string) (contextManagerEntry, error) {
+	entries, ok := m.abstractSyntaxNameToContextIDMap[name]
+	if !ok || len(entries) == 0 {
 		return contextManagerEntry{}, fmt.Errorf("dicom.checkContextRejection %v: Unknown syntax %s", m.label, dicomuid.UIDString(name))
 	}
-	err := m.checkContextRejection(e)
-	if err != nil {
-		return contextManagerEntry{}, err
+	var accepted *contextManagerEntry
+	for _, e := range entries {
+		if e.result != pdu.PresentationContextAccepted {
+			continue
+		}
+		if transferSyntaxUID != "" && e.transferSyntaxUID == transferSyntaxUID {
+			return *e, nil
+		}
+		if accepted == nil {
+			accepted = e
+		}
 	}
-	return *e, nil
+	if accepted == nil {
+		return contextManagerEntry{}, m.checkContextRejection(entries[0])
+	}
+	return *accepted, nil
+}
+
+// Return all the accepted contexts for the given abstract syntax, in contextID
+// order.
+func (m *contextManager) lookupAllByAbstractSyntaxUID(name string) []contextManagerEntry {
+	var entries []contextManagerEntry
+	for _, e := range m.abstractSyntaxNameToContextIDMap[name] {
+		if e.result == pdu.PresentationContextAccepted {
+			entries = append(entries, *e)
+		}
+	}
+	return entries
+}
+
+// Count a DIMSE message received or sent on "contextID". Unknown contexts
+// are ignored.
+func (m *contextManager) noteMessage(contextID byte, sent bool) {
+	e, ok := m.contextIDToAbstractSyntaxNameMap[contextID]
+	if !ok {
+		return
+	}
+	if sent {
+		atomic.AddInt64(&e.usage.sent, 1)
+	} else {
+		atomic.AddInt64(&e.usage.received, 1)
+	}
+}
+
+// Returns the usage of the accepted contexts, in order of context ID.
+func (m *contextManager) contextUsage() []ContextUsage {
+	var r []ContextUsage
+	for _, e := range m.contextIDToAbstractSyntaxNameMap {
+		if e.result != pdu.PresentationContextAccepted {
+			continue
+		}
+		r = append(r, ContextUsage{
+			ContextID:         e.contextID,
+			AbstractSyntaxUID: e.abstractSyntaxUID,
+			TransferSyntaxUID: e.transferSyntaxUID,
+			MessagesReceived:  atomic.LoadInt64(&e.usage.received),
+			MessagesSent:      atomic.LoadInt64(&e.usage.sent),
+		})
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].ContextID < r[j].ContextID })
+	return r
 }
 
-// Convert a contextID to a UID.
 func (m *contextManager) lookupByContextID(contextID byte) (contextManagerEntry, error) {
 	e, ok := m.contextIDToAbstractSyntaxNameMap[contextID]
 	if !ok {
@@ -0,0 +1,327 @@
+package netdicom
+
+import (
+	"errors"
+	"testing"
+
+	dicomuid "github.com/antibios/dicom/pkg/uid"
+	"github.com/antibios/go-netdicom/pdu"
+	"github.com/stretchr/testify/require"
+)
+
+const testSOPClassUID = "1.2.840.10008.5.1.4.1.1.1"
+
+func TestContextManagerMultipleContextsPerAbstractSyntax(t *testing.T) {
+	user := newContextManager("testuser")
+	items := user.generateAssociateRequest(
+		[]string{testSOPClassUID},
+		[]string{dicomuid.ImplicitVRLittleEndian, dicomuid.ExplicitVRLittleEndian},
+		true)
+
+	provider := newContextManager("testprovider")
+	responses, err := provider.onAssociateRequest(items)
+	require.NoError(t, err)
+	require.NoError(t, user.onAssociateResponse(responses))
+
+	for _, cm := range []*contextManager{user, provider} {
+		require.Len(t, cm.lookupAllByAbstractSyntaxUID(testSOPClassUID), 2)
+
+		e, err := cm.lookupByAbstractSyntaxUID(testSOPClassUID)
+		require.NoError(t, err)
+		require.Equal(t, byte(1), e.contextID)
+		require.Equal(t, dicomuid.ImplicitVRLittleEndian, e.transferSyntaxUID)
+
+		e, err = cm.lookupByAbstractSyntaxUIDAndTransferSyntax(testSOPClassUID, dicomuid.ExplicitVRLittleEndian)
+		require.NoError(t, err)
+		require.Equal(t, byte(3), e.contextID)
+		require.Equal(t, dicomuid.ExplicitVRLittleEndian, e.transferSyntaxUID)
+
+		// Unknown transfer syntax falls back to the first accepted context.
+		e, err = cm.lookupByAbstractSyntaxUIDAndTransferSyntax(testSOPClassUID, dicomuid.ExplicitVRBigEndian)
+		require.NoError(t, err)
+		require.Equal(t, byte(1), e.contextID)
+	}
+}
+
+func TestContextManagerSkipsRejectedContext(t *testing.T) {
+	cm := newContextManager("test")
+	addContextMapping(cm, testSOPClassUID, dicomuid.ExplicitVRLittleEndian, 1, pdu.PresentationContextProviderRejectionTransferSyntaxNotSupported)
+	addContextMapping(cm, testSOPClassUID, dicomuid.ImplicitVRLittleEndian, 3, pdu.PresentationContextAccepted)
+
+	e, err := cm.lookupByAbstractSyntaxUIDAndTransferSyntax(testSOPClassUID, dicomuid.ExplicitVRLittleEndian)
+	require.NoError(t, err)
+	require.Equal(t, byte(3), e.contextID)
+}
+
+func TestContextManagerNoAcceptedContexts(t *testing.T) {
+	user := newContextManager("testuser")
+	items := user.generateAssociateRequest(
+		[]string{testSOPClassUID, dicomuid.VerificationSOPClass},
+		[]string{dicomuid.ImplicitVRLittleEndian},
+		false)
+
+	var responses []pdu.SubItem
+	for _, item := range extractPresentationContextItems(items) {
+		responses = append(responses, &pdu.PresentationContextItem{
+			Type:      pdu.ItemTypePresentationContextResponse,
+			ContextID: item.ContextID,
+			Result:    pdu.PresentationContextProviderRejectionAbstractSyntaxNotSupported,
+			Items:     []pdu.SubItem{&pdu.TransferSyntaxSubItem{Name: dicomuid.ImplicitVRLittleEndian}},
+		})
+	}
+	err := user.onAssociateResponse(responses)
+	require.Error(t, err)
+	noContexts, ok := err.(*NoAcceptedContextsError)
+	require.True(t, ok, "unexpected error type: %v", err)
+	require.Len(t, noContexts.Contexts, 2)
+	require.Equal(t, byte(1), noContexts.Contexts[0].ContextID)
+	require.Equal(t, testSOPClassUID, noContexts.Contexts[0].AbstractSyntaxUID)
+	require.Equal(t, byte(3), noContexts.Contexts[1].ContextID)
+	require.Equal(t, pdu.PresentationContextProviderRejectionAbstractSyntaxNotSupported, noContexts.Contexts[1].Result)
+}
+
+func TestContextManagerRejectsUnknownAbstractSyntax(t *testing.T) {
+	const privateSOPClassUID = "1.2.826.0.1.3680043.9.7133.99.1"
+	for _, promiscuous := range []bool{false, true} {
+		user := newContextManager("testuser")
+		items := user.generateAssociateRequest(
+			[]string{dicomuid.VerificationSOPClass, privateSOPClassUID},
+			[]string{dicomuid.ImplicitVRLittleEndian},
+			false)
+
+		provider := newContextManager("testprovider")
+		if !promiscuous {
+			provider.acceptAbstractSyntax = isKnownAbstractSyntax
+		}
+		responses, err := provider.onAssociateRequest(items)
+		require.NoError(t, err)
+		require.NoError(t, user.onAssociateResponse(responses))
+
+		_, err = user.lookupByAbstractSyntaxUID(dicomuid.VerificationSOPClass)
+		require.NoError(t, err)
+		_, err = user.lookupByAbstractSyntaxUID(privateSOPClassUID)
+		if promiscuous {
+			require.NoError(t, err)
+		} else {
+			require.Error(t, err)
+			_, err = provider.lookupByContextID(3)
+			require.Error(t, err)
+		}
+	}
+}
+
+// Every abstract syntax is accepted unless RejectUnknownSOPClasses is set.
+func TestAbstractSyntaxFilter(t *testing.T) {
+	const privateSOPClassUID = "1.2.826.0.1.3680043.9.7133.99.1"
+	require.Nil(t, abstractSyntaxFilter(ServiceProviderParams{}))
+
+	accept := abstractSyntaxFilter(ServiceProviderParams{RejectUnknownSOPClasses: true})
+	require.True(t, accept(dicomuid.VerificationSOPClass))
+	require.False(t, accept(privateSOPClassUID))
+
+	require.Nil(t, abstractSyntaxFilter(ServiceProviderParams{RejectUnknownSOPClasses: true, Promiscuous: true}))
+
+	// A class listed in SOPClasses is accepted even if unknown.
+	accept = abstractSyntaxFilter(ServiceProviderParams{
+		SOPClasses:              []string{privateSOPClassUID},
+		RejectUnknownSOPClasses: true,
+	})
+	require.True(t, accept(privateSOPClassUID))
+	require.False(t, accept(dicomuid.VerificationSOPClass))
+}
+
+func TestContextManagerPrefersLittleEndian(t *testing.T) {
+	user := newContextManager("testuser")
+	items := user.generateAssociateRequest(
+		[]string{testSOPClassUID},
+		[]string{dicomuid.ExplicitVRBigEndian, dicomuid.ExplicitVRLittleEndian},
+		false)
+	provider := newContextManager("testprovider")
+	responses, err := provider.onAssociateRequest(items)
+	require.NoError(t, err)
+	require.NoError(t, user.onAssociateResponse(responses))
+	e, err := user.lookupByAbstractSyntaxUID(testSOPClassUID)
+	require.NoError(t, err)
+	require.Equal(t, dicomuid.ExplicitVRLittleEndian, e.transferSyntaxUID)
+}
+
+func TestContextManagerRetiredBigEndian(t *testing.T) {
+	// Not proposed.
+	user := newContextManager("testuser")
+	user.bigEndian = RetireExplicitVRBigEndian
+	items := user.generateAssociateRequest(
+		[]string{testSOPClassUID},
+		[]string{dicomuid.ExplicitVRBigEndian, dicomuid.ImplicitVRLittleEndian},
+		true)
+	require.Len(t, items, 3) // application context, one presentation context, user info
+
+	// Not accepted.
+	provider := newContextManager("testprovider")
+	provider.bigEndian = RetireExplicitVRBigEndian
+	_, err := provider.onAssociateRequest([]pdu.SubItem{
+		&pdu.PresentationContextItem{
+			Type:      pdu.ItemTypePresentationContextRequest,
+			ContextID: 1,
+			Items: []pdu.SubItem{
+				&pdu.AbstractSyntaxSubItem{Name: testSOPClassUID},
+				&pdu.TransferSyntaxSubItem{Name: dicomuid.ExplicitVRBigEndian},
+			}}})
+	require.NoError(t, err)
+	require.Empty(t, provider.lookupAllByAbstractSyntaxUID(testSOPClassUID))
+
+	_, err = NewServiceUser(ServiceUserParams{
+		SOPClasses:       []string{testSOPClassUID},
+		TransferSyntaxes: []string{dicomuid.ExplicitVRBigEndian},
+		BigEndian:        RetireExplicitVRBigEndian,
+	})
+	require.Error(t, err)
+
+	// The policy is per service: by default, big endian is still
+	// negotiated.
+	params := ServiceUserParams{
+		SOPClasses:       []string{testSOPClassUID},
+		TransferSyntaxes: []string{dicomuid.ExplicitVRBigEndian},
+	}
+	require.NoError(t, validateServiceUserParams(&params))
+	provider = newContextManager("testprovider")
+	_, err = provider.onAssociateRequest([]pdu.SubItem{
+		&pdu.PresentationContextItem{
+			Type:      pdu.ItemTypePresentationContextRequest,
+			ContextID: 1,
+			Items: []pdu.SubItem{
+				&pdu.AbstractSyntaxSubItem{Name: testSOPClassUID},
+				&pdu.TransferSyntaxSubItem{Name: dicomuid.ExplicitVRBigEndian},
+			}}})
+	require.NoError(t, err)
+	require.Len(t, provider.lookupAllByAbstractSyntaxUID(testSOPClassUID), 1)
+}
+
+func TestContextManagerAsyncOperationsWindow(t *testing.T) {
+	findWindow := func(responses []pdu.SubItem) *pdu.AsynchronousOperationsWindowSubItem {
+		for _, item := range responses {
+			if ui, ok := item.(*pdu.UserInformationItem); ok {
+				for _, sub := range ui.Items {
+					if w, ok := sub.(*pdu.AsynchronousOperationsWindowSubItem); ok {
+						return w
+					}
+				}
+			}
+		}
+		return nil
+	}
+	user := newContextManager("testuser")
+	items := user.generateAssociateRequest([]string{testSOPClassUID}, []string{dicomuid.ImplicitVRLittleEndian}, false)
+
+	// Not proposed, not answered.
+	provider := newContextManager("testprovider")
+	provider.maxOpsPerformed = 2
+	responses, err := provider.onAssociateRequest(items)
+	require.NoError(t, err)
+	require.Nil(t, findWindow(responses))
+	require.Equal(t, 1, provider.peerMaxOpsInvoked)
+	require.Equal(t, 1, provider.peerMaxOpsPerformed)
+
+	for i, item := range items {
+		if ui, ok := item.(*pdu.UserInformationItem); ok {
+			ui.Items = append(ui.Items, &pdu.AsynchronousOperationsWindowSubItem{MaxOpsInvoked: 0, MaxOpsPerformed: 3})
+			items[i] = ui
+		}
+	}
+	provider = newContextManager("testprovider")
+	provider.maxOpsPerformed = 2
+	responses, err = provider.onAssociateRequest(items)
+	require.NoError(t, err)
+	require.Equal(t, &pdu.AsynchronousOperationsWindowSubItem{MaxOpsInvoked: 2, MaxOpsPerformed: 3}, findWindow(responses))
+	require.Equal(t, 0, provider.peerMaxOpsInvoked)
+	require.Equal(t, 3, provider.peerMaxOpsPerformed)
+}
+
+func TestRoleSelection(t *testing.T) {
+	const otherSOPClassUID = "1.2.840.10008.5.1.4.1.1.4"
+	user := newContextManager("testuser")
+	user.proposedRoles = []RoleSelection{
+		{SOPClassUID: testSOPClassUID, SCU: true, SCP: true},
+		{SOPClassUID: otherSOPClassUID, SCP: true},
+	}
+	items := user.generateAssociateRequest([]string{testSOPClassUID, otherSOPClassUID},
+		[]string{dicomuid.ImplicitVRLittleEndian}, false)
+
+	// The provider accepts the roles as proposed.
+	provider := newContextManager("testprovider")
+	responses, err := provider.onAssociateRequest(items)
+	require.NoError(t, err)
+	require.NoError(t, user.onAssociateResponse(responses))
+	require.NoError(t, user.checkRole(testSOPClassUID, false))
+	require.NoError(t, user.checkRole(testSOPClassUID, true))
+	require.NoError(t, user.checkRole(otherSOPClassUID, true))
+	var roleErr *RoleNotGrantedError
+	require.True(t, errors.As(user.checkRole(otherSOPClassUID, false), &roleErr))
+	require.Equal(t, "SCU", roleErr.Role)
+	require.NoError(t, user.checkCGetRoles())
+
+	// A provider that ignores role selection grants the default roles.
+	for i, item := range responses {
+		if ui, ok := item.(*pdu.UserInformationItem); ok {
+			var kept []pdu.SubItem
+			for _, sub := range ui.Items {
+				if _, ok := sub.(*pdu.RoleSelectionSubItem); !ok {
+					kept = append(kept, sub)
+				}
+			}
+			responses[i] = &pdu.UserInformationItem{Items: kept}
+		}
+	}
+	user = newContextManager("testuser")
+	user.proposedRoles = []RoleSelection{{SOPClassUID: otherSOPClassUID, SCP: true}}
+	user.generateAssociateRequest([]string{testSOPClassUID, otherSOPClassUID},
+		[]string{dicomuid.ImplicitVRLittleEndian}, false)
+	require.NoError(t, user.onAssociateResponse(responses))
+	require.NoError(t, user.checkRole(otherSOPClassUID, false))
+	require.True(t, errors.As(user.checkRole(otherSOPClassUID, true), &roleErr))
+	require.True(t, errors.As(user.checkCGetRoles(), &roleErr))
+	// Unlisted classes aren't checked.
+	require.NoError(t, user.checkRole(testSOPClassUID, true))
+}
+
+func TestMaxPDVValueSize(t *testing.T) {
+	sm := &stateMachine{contextManager: newContextManager("test")}
+	for _, c := range []struct{ peerMaxPDUSize, want int }{
+		{16384, 16378},
+		{4096, 4090},
+		{0, maxSendPDUSize - 6},          // No limit.
+		{0xffffffff, maxSendPDUSize - 6}, // 4GB.
+		{MinMaxPDUSize, 1},
+		{4, 1},
+	} {
+		sm.contextManager.peerMaxPDUSize = c.peerMaxPDUSize
+		require.Equal(t, c.want, maxPDVValueSize(sm), "peer max PDU size %d", c.peerMaxPDUSize)
+	}
+}
+
+// Each PDU holds a PDV that fills it exactly, up to the peer's max PDU size.
+// Empty data takes one empty PDV.
+func TestSplitDataIntoPDUs(t *testing.T) {
+	sm := &stateMachine{contextManager: newContextManager("test")}
+	addContextMapping(sm.contextManager, testSOPClassUID, dicomuid.ImplicitVRLittleEndian, 1, pdu.PresentationContextAccepted)
+	sm.contextManager.peerMaxPDUSize = 4096
+	for _, c := range []struct{ size, wantPDUs int }{
+		{0, 1},
+		{1, 1},
+		{4090, 1},
+		{4091, 2},
+		{2 * 4090, 2},
+	} {
+		pdus := splitDataIntoPDUs(sm, 1, false, make([]byte, c.size))
+		require.Len(t, pdus, c.wantPDUs, "size %d", c.size)
+		for i, v := range pdus {
+			b, err := pdu.EncodePDU(&v)
+			require.NoError(t, err)
+			// The max PDU size bounds the PDU minus its 6-byte header.
+			require.LessOrEqual(t, len(b)-6, 4096)
+			if i < len(pdus)-1 {
+				require.Equal(t, 4096, len(b)-6)
+			}
+			require.Equal(t, i == len(pdus)-1, v.Items[0].Last)
+		}
+	}
+}
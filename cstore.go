@@ -2,22 +2,39 @@ package netdicom
 
 import (
 	"bytes"
-	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 
 	"github.com/antibios/dicom"
 	dicomtag "github.com/antibios/dicom/pkg/tag"
 	dicomuid "github.com/antibios/dicom/pkg/uid"
-	"github.com/antibios/go-dicom/dicomlog"
 	"github.com/antibios/go-netdicom/dimse"
 )
 
+// ErrCStoreNoResponse is wrapped by the error of a C-STORE whose request was
+// sent, but whose response never came, e.g., because the association was
+// aborted. The peer may or may not have stored the instance.
+var ErrCStoreNoResponse = errors.New("dicom: no C-STORE response")
+
+// CStoreStatusError is returned by a C-STORE that the peer answered with a
+// failure status, i.e., one that the peer processed and refused.
+type CStoreStatusError struct {
+	// Label of the association, for the error message.
+	label string
+	// The response received.
+	Response *dimse.CStoreRsp
+}
+
+func (e *CStoreStatusError) Error() string {
+	return fmt.Sprintf("dicom.cstore(%s): failed: %v", e.label, e.Response.String())
+}
+
 // Helper function used by C-{STORE,GET,MOVE} to send a dataset using C-STORE
-// over an already-established association.
-func runCStoreOnAssociation(upcallCh chan upcallEvent, downcallCh chan stateEvent,
-	cm *contextManager,
-	messageID dimse.MessageID,
-	ds *dicom.Dataset) error {
+// over an already-established association. If preserveTransferSyntax is true,
+// the dataset is sent only if the peer accepted its original transfer syntax.
+func runCStoreOnAssociation(cs *serviceCommandState, ds *dicom.Dataset, preserveTransferSyntax bool) error {
+	cm := cs.cm
 	var getElement = func(tag dicomtag.Tag) (string, error) {
 		elem, err := ds.FindElementByTag(tag)
 		if err != nil {
@@ -35,51 +52,160 @@ func runCStoreOnAssociation(upcallCh chan upcallEvent, downcallCh chan stateEven
 	if err != nil {
 		return fmt.Errorf("dicom.cstore: data lacks MediaStorageSOPClassUID: %v", err)
 	}
-	dicomlog.Vprintf(1, "dicom.cstore(%s): DICOM abstractsyntax: %s, sopinstance: %s", cm.label, dicomuid.UIDString(sopClassUID), sopInstanceUID)
-	context, err := cm.lookupByAbstractSyntaxUID(sopClassUID)
+	cm.logf(1, "dicom.cstore(%s): DICOM abstractsyntax: %s, sopinstance: %s", cm.label, dicomuid.UIDString(sopClassUID), sopInstanceUID)
+	context, err := lookupCStoreContext(cm, sopClassUID, datasetTransferSyntaxUID(ds), preserveTransferSyntax)
 	if err != nil {
-		dicomlog.Vprintf(0, "dicom.cstore(%s): sop class %v not found in context %v", cm.label, sopClassUID, err)
+		cm.logf(0, "dicom.cstore(%s): sop class %v not found in context %v", cm.label, sopClassUID, err)
 		return err
 	}
-	dicomlog.Vprintf(1, "dicom.cstore(%s): using transfersyntax %s to send sop class %s, instance %s",
+	cm.logf(1, "dicom.cstore(%s): using transfersyntax %s to send sop class %s, instance %s",
 		cm.label,
 		dicomuid.UIDString(context.transferSyntaxUID),
 		dicomuid.UIDString(sopClassUID),
 		sopInstanceUID)
 	// MK Write our own data to the DICOM file.
 	bodyEncoder := bytes.Buffer{}
+	bo, implicit, err := ParseTransferSyntaxUID(context.transferSyntaxUID)
+	if err != nil {
+		return fmt.Errorf("dicom.cstore(%s): %v", cm.label, err)
+	}
 	e := dicom.NewWriter(&bodyEncoder, dicom.SkipVRVerification())
-	e.SetTransferSyntax(binary.LittleEndian, true)
-	for _, elem := range ds.Elements {
+	e.SetTransferSyntax(bo, implicit == ImplicitVR)
+	for _, elem := range StripFileMetaElements(ds.Elements) {
 		e.WriteElement(elem)
 	}
-	downcallCh <- stateEvent{
+	return runCStoreBytesOnAssociation(cs, context, sopClassUID, sopInstanceUID, bodyEncoder.Bytes())
+}
+
+// Find the context to send an object of the given SOP class. The context whose
+// transfer syntax matches the original encoding of the object is preferred, to
+// avoid transcoding. If exact is true, no other context is acceptable.
+// Otherwise the object is transcoded to a native transfer syntax, which is
+// possible only if it isn't encapsulated.
+func lookupCStoreContext(cm *contextManager, sopClassUID, transferSyntaxUID string, exact bool) (contextManagerEntry, error) {
+	if err := cm.checkRole(sopClassUID, false); err != nil {
+		return contextManagerEntry{}, err
+	}
+	context, err := cm.lookupByAbstractSyntaxUIDAndTransferSyntax(sopClassUID, transferSyntaxUID)
+	if err != nil {
+		return contextManagerEntry{}, err
+	}
+	if context.transferSyntaxUID == transferSyntaxUID {
+		return context, nil
+	}
+	if exact {
+		return contextManagerEntry{}, fmt.Errorf("dicom.cstore(%s): peer did not accept transfer syntax %s for %s",
+			cm.label, dicomuid.UIDString(transferSyntaxUID), dicomuid.UIDString(sopClassUID))
+	}
+	if transferSyntaxUID != "" && !isNativeTransferSyntax(transferSyntaxUID) {
+		return contextManagerEntry{}, fmt.Errorf("dicom.cstore(%s): peer did not accept transfer syntax %s for %s, and encapsulated data can't be transcoded",
+			cm.label, dicomuid.UIDString(transferSyntaxUID), dicomuid.UIDString(sopClassUID))
+	}
+	for _, e := range cm.lookupAllByAbstractSyntaxUID(sopClassUID) {
+		if isNativeTransferSyntax(e.transferSyntaxUID) {
+			return e, nil
+		}
+	}
+	return contextManagerEntry{}, fmt.Errorf("dicom.cstore(%s): peer accepted no native transfer syntax for %s",
+		cm.label, dicomuid.UIDString(sopClassUID))
+}
+
+// Send "data", the body of a dataset already encoded in the context's transfer
+// syntax, using C-STORE. The bytes are sent verbatim. Blocks until the
+// response arrives.
+func runCStoreBytesOnAssociation(cs *serviceCommandState, context contextManagerEntry,
+	sopClassUID, sopInstanceUID string, data []byte) error {
+	return runCStoreRawOnAssociation(cs, context, sopClassUID, sopInstanceUID, data, nil, nil)
+}
+
+// Like runCStoreBytesOnAssociation, but streams the data from "r".
+func runCStoreReaderOnAssociation(cs *serviceCommandState, context contextManagerEntry,
+	sopClassUID, sopInstanceUID string, r io.Reader) error {
+	return runCStoreRawOnAssociation(cs, context, sopClassUID, sopInstanceUID, nil, r, nil)
+}
+
+// Reads exactly "size" bytes from "r", then reports EOF. If "r" ends earlier,
+// the error is not io.ErrUnexpectedEOF, which readDataChunks takes for
+// the end of the data, so that the transfer is aborted instead.
+type sizedReader struct {
+	r          io.Reader
+	size, left int64
+}
+
+func (s *sizedReader) Read(p []byte) (int, error) {
+	if s.left <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > s.left {
+		p = p[:s.left]
+	}
+	n, err := s.r.Read(p)
+	s.left -= int64(n)
+	if err == io.EOF && s.left > 0 {
+		err = fmt.Errorf("dicom.cstore: data ended after %d of %d bytes", s.size-s.left, s.size)
+	}
+	return n, err
+}
+
+// Like runCStoreBytesOnAssociation, but sends the body of a mapped file. The
+// state machine takes ownership of "mapped".
+func runCStoreMappedOnAssociation(cs *serviceCommandState, context contextManagerEntry,
+	sopClassUID, sopInstanceUID string, mapped *mappedData) error {
+	return runCStoreRawOnAssociation(cs, context, sopClassUID, sopInstanceUID, nil, nil, mapped)
+}
+
+// Send a C-STORE with the data in either "data", "r" or "mapped".
+func runCStoreRawOnAssociation(cs *serviceCommandState, context contextManagerEntry,
+	sopClassUID, sopInstanceUID string, data []byte, r io.Reader, mapped *mappedData) error {
+	cm := cs.cm
+	messageID := cs.messageID
+	cs.disp.sendDowncall(stateEvent{
 		event: evt09,
 		dimsePayload: &stateEventDIMSEPayload{
-			abstractSyntaxName: sopClassUID,
+			contextID: context.contextID,
 			command: &dimse.CStoreRq{
 				AffectedSOPClassUID:    sopClassUID,
 				MessageID:              messageID,
 				CommandDataSetType:     int(dimse.CommandDataSetTypeNonNull),
 				AffectedSOPInstanceUID: sopInstanceUID,
 			},
-			data: bodyEncoder.Bytes(),
+			data:       data,
+			dataReader: r,
+			mapped:     mapped,
 		},
-	}
+	})
 	for {
-		dicomlog.Vprintf(0, "dicom.cstore(%s): Start reading resp w/ messageID:%v", cm.label, messageID)
-		event, ok := <-upcallCh
+		cm.logf(0, "dicom.cstore(%s): Start reading resp w/ messageID:%v", cm.label, messageID)
+		event, ok := <-cs.upcallCh
 		if !ok {
-			return fmt.Errorf("dicom.cstore(%s): Connection closed while waiting for C-STORE response", cm.label)
+			return fmt.Errorf("%w: %w", ErrCStoreNoResponse,
+				cs.disp.closeError("dicom.cstore(%s): Connection closed while waiting for C-STORE response", cm.label))
 		}
-		dicomlog.Vprintf(1, "dicom.cstore(%s): resp event: %v", cm.label, event.command)
+		cm.logf(1, "dicom.cstore(%s): resp event: %v", cm.label, event.command)
 		doassert(event.eventType == upcallEventData)
 		doassert(event.command != nil)
 		resp, ok := event.command.(*dimse.CStoreRsp)
-		doassert(ok) // TODO(saito)
-		if resp.Status.Status != 0 {
-			return fmt.Errorf("dicom.cstore(%s): failed: %v", cm.label, resp.String())
+		if !ok {
+			return cs.abortUnexpectedCommand("C-STORE-RSP", event.command)
+		}
+		// The object is stored despite a warning, e.g., of coercion or
+		// of elements discarded.
+		if c := resp.Status.Status.Category(); c != dimse.StatusCategorySuccess && c != dimse.StatusCategoryWarning {
+			return &CStoreStatusError{label: cm.label, Response: resp}
 		}
 		return nil
 	}
 }
+
+// Returns the transfer syntax the dataset was originally encoded in, or "" if
+// the dataset lacks the TransferSyntaxUID metadata element.
+func datasetTransferSyntaxUID(ds *dicom.Dataset) string {
+	elem, err := ds.FindElementByTag(dicomtag.TransferSyntaxUID)
+	if err != nil {
+		return ""
+	}
+	if v, ok := elem.Value.GetValue().([]string); ok && len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
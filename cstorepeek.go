@@ -0,0 +1,328 @@
+package netdicom
+
+// This file implements ServiceProviderParams.CStoreAdmit and CStorePeek:
+// inspecting an inbound C-STORE request while its dataset is still being
+// received.
+
+import (
+	"encoding/binary"
+	"strings"
+
+	dicom "github.com/antibios/dicom"
+	dicomtag "github.com/antibios/dicom/pkg/tag"
+	dicomuid "github.com/antibios/dicom/pkg/uid"
+	"github.com/antibios/go-netdicom/dimse"
+)
+
+// CStorePeekCallback is called with the top-level elements of an inbound
+// C-STORE dataset that precede ServiceProviderParams.CStorePeekTag, before the
+// rest of the dataset has been received. If the dataset lacks the tag, it is
+// called once the whole dataset has arrived. The parse is shallow: sequences
+// are returned as raw bytes, and the parse stops at the first element of
+// undefined length.
+//
+// If the callback returns dimse.Success, the transfer continues and CStore is
+// called as usual. Otherwise the rest of the dataset is discarded as it
+// arrives, CStore is not called, and the returned status is sent in the
+// C-STORE response once the transfer completes.
+//
+// The callback runs on the goroutine that serves the association, so no
+// other PDU is read or sent, and no timer fires, until it returns. It must not
+// block, e.g., on network calls.
+type CStorePeekCallback func(
+	conn ConnectionState,
+	transferSyntaxUID string,
+	sopClassUID string,
+	sopInstanceUID string,
+	elems []*dicom.Element) dimse.Status
+
+// CStoreAdmitCallback is called once the command set of an inbound C-STORE
+// request has arrived, before its dataset is received. callingAETitle is the
+// AE title of the peer that requested the association.
+//
+// If the callback returns dimse.Success, the transfer proceeds. Otherwise the
+// dataset is discarded as it arrives, neither CStorePeek nor CStore is called,
+// and the returned status is sent in the C-STORE response. Typical refusals
+// are dimse.CStoreOutOfResources and dimse.CStoreRefusedSOPClassNotSupported.
+//
+// Like CStorePeekCallback, it runs on the goroutine that serves the
+// association, and must not block.
+type CStoreAdmitCallback func(
+	conn ConnectionState,
+	callingAETitle string,
+	sopClassUID string,
+	sopInstanceUID string) dimse.Status
+
+// cstorePeeker runs CStoreAdmit and CStorePeek for one association. It is
+// owned by the statemachine goroutine, and inspects P_DATA_TF payloads as they
+// are assembled.
+type cstorePeeker struct {
+	params ServiceProviderParams
+
+	// State for the commands being received, keyed by context ID. An entry
+	// is removed on completion.
+	pending map[byte]*cstorePeekState
+}
+
+type cstorePeekState struct {
+	admitted bool          // CStoreAdmit has run, or isn't set
+	called   bool          // CStorePeek has run
+	status   *dimse.Status // non-nil if a callback rejected the dataset
+
+	// Parse of the data received so far, resumed at each PDU. Nil until
+	// CStorePeek needs it.
+	parser *shallowParser
+}
+
+func newCStorePeeker(params ServiceProviderParams) *cstorePeeker {
+	if params.CStoreAdmit == nil && params.CStorePeek == nil {
+		return nil
+	}
+	return &cstorePeeker{params: params, pending: make(map[byte]*cstorePeekState)}
+}
+
+func (p *cstorePeeker) stateFor(contextID byte) *cstorePeekState {
+	s, ok := p.pending[contextID]
+	if !ok {
+		s = &cstorePeekState{}
+		p.pending[contextID] = s
+	}
+	return s
+}
+
+// Called after each P_DATA_TF PDU for every message on "contextID" whose
+// command set is complete but whose data is not. Returns true if the rest of
+// the data should be discarded.
+func (p *cstorePeeker) onPartialData(sm *stateMachine, contextID byte, command dimse.Message, data []byte) bool {
+	req, ok := command.(*dimse.CStoreRq)
+	if !ok {
+		return false
+	}
+	s := p.stateFor(contextID)
+	if s.status != nil {
+		return false
+	}
+	if !s.admitted && p.admit(sm, s, req) {
+		return true
+	}
+	if s.called || p.params.CStorePeek == nil {
+		return false
+	}
+	context, err := sm.contextManager.lookupByContextID(contextID)
+	if err != nil {
+		return false
+	}
+	if s.parser == nil {
+		s.parser = newShallowParser(context.transferSyntaxUID, p.stopTag())
+	}
+	elems, complete := s.parser.parse(data)
+	if !complete {
+		return false
+	}
+	return p.run(sm, s, context.transferSyntaxUID, req, elems)
+}
+
+// Called when the command and its data have been fully received. Returns a
+// non-nil status if the dataset was rejected and the handler must not run.
+func (p *cstorePeeker) onComplete(sm *stateMachine, contextID byte, command dimse.Message, data []byte) *dimse.Status {
+	req, ok := command.(*dimse.CStoreRq)
+	if !ok {
+		return nil
+	}
+	s := p.stateFor(contextID)
+	delete(p.pending, contextID)
+	if !s.admitted && p.admit(sm, s, req) {
+		return s.status
+	}
+	if !s.called && s.status == nil && p.params.CStorePeek != nil {
+		if context, err := sm.contextManager.lookupByContextID(contextID); err == nil {
+			if s.parser == nil {
+				s.parser = newShallowParser(context.transferSyntaxUID, p.stopTag())
+			}
+			elems, _ := s.parser.parse(data)
+			p.run(sm, s, context.transferSyntaxUID, req, elems)
+		}
+	}
+	return s.status
+}
+
+// Invoke CStoreAdmit, if set. Returns true if the dataset was rejected.
+func (p *cstorePeeker) admit(sm *stateMachine, s *cstorePeekState, req *dimse.CStoreRq) bool {
+	s.admitted = true
+	if p.params.CStoreAdmit == nil {
+		return false
+	}
+	status := p.params.CStoreAdmit(getConnState(sm.conn, sm.contextManager), sm.callingAETitle,
+		req.AffectedSOPClassUID, req.AffectedSOPInstanceUID)
+	if status.Status == dimse.StatusSuccess {
+		return false
+	}
+	sm.logf(0, "dicom.stateMachine(%s): C-STORE of %s from %s refused before receiving data: %v",
+		sm.label, req.AffectedSOPInstanceUID, sm.callingAETitle, status)
+	s.status = &status
+	return true
+}
+
+// Invoke CStorePeek. Returns true if the dataset was rejected.
+func (p *cstorePeeker) run(sm *stateMachine, s *cstorePeekState, transferSyntaxUID string, req *dimse.CStoreRq, elems []*dicom.Element) bool {
+	s.called = true
+	status := p.params.CStorePeek(getConnState(sm.conn, sm.contextManager), transferSyntaxUID,
+		req.AffectedSOPClassUID, req.AffectedSOPInstanceUID, elems)
+	if status.Status == dimse.StatusSuccess {
+		return false
+	}
+	sm.logf(0, "dicom.stateMachine(%s): C-STORE of %s rejected while receiving: %v",
+		sm.label, req.AffectedSOPInstanceUID, status)
+	s.status = &status
+	return true
+}
+
+func (p *cstorePeeker) stopTag() dicomtag.Tag {
+	if p.params.CStorePeekTag == (dicomtag.Tag{}) {
+		return dicomtag.PixelData
+	}
+	return p.params.CStorePeekTag
+}
+
+// VRs whose length field is 4 bytes long in explicit VR encoding. P3.5 7.1.2.
+var longExplicitVRs = map[string]bool{
+	"OB": true, "OD": true, "OF": true, "OL": true, "OV": true, "OW": true,
+	"SQ": true, "SV": true, "UC": true, "UN": true, "UR": true, "UT": true, "UV": true,
+}
+
+// VRs whose values are returned as strings.
+var stringVRs = map[string]bool{
+	"AE": true, "AS": true, "CS": true, "DA": true, "DS": true, "DT": true, "IS": true,
+	"LO": true, "LT": true, "PN": true, "SH": true, "ST": true, "TM": true, "UC": true,
+	"UI": true, "UR": true, "UT": true,
+}
+
+// Parse the top-level elements in "data", encoded in transferSyntaxUID, up to
+// (but excluding) stopTag. Returns true if the parse reached stopTag, or an
+// element it can't skip over; false if more data is needed. Elements that
+// don't fit in "data" are not returned.
+func shallowParseElements(transferSyntaxUID string, data []byte, stopTag dicomtag.Tag) ([]*dicom.Element, bool) {
+	return newShallowParser(transferSyntaxUID, stopTag).parse(data)
+}
+
+// shallowParser is shallowParseElements for a dataset that arrives in pieces.
+// Each call to parse resumes where the previous one stopped, so that the data
+// is parsed once however many PDUs it spans.
+type shallowParser struct {
+	bo       binary.ByteOrder
+	implicit IsImplicitVR
+	stopTag  dicomtag.Tag
+
+	offset int              // bytes of data parsed so far
+	elems  []*dicom.Element // elements parsed so far
+	done   bool             // the parse reached its end
+}
+
+func newShallowParser(transferSyntaxUID string, stopTag dicomtag.Tag) *shallowParser {
+	p := &shallowParser{stopTag: stopTag}
+	if transferSyntaxUID == dicomuid.DeflatedExplicitVRLittleEndian {
+		// Can't be parsed without inflating the whole dataset.
+		p.done = true
+		return p
+	}
+	bo, implicit, err := ParseTransferSyntaxUID(transferSyntaxUID)
+	if err != nil {
+		p.done = true
+		return p
+	}
+	p.bo, p.implicit = bo, implicit
+	return p
+}
+
+// Parse the elements in "data" past those parsed by earlier calls. "data" must
+// extend the data passed to the previous call. Returns the elements parsed so
+// far, and true if the parse has ended; see shallowParseElements.
+func (p *shallowParser) parse(data []byte) ([]*dicom.Element, bool) {
+	if !p.done {
+		p.done = p.parseElements(data)
+	}
+	return p.elems, p.done
+}
+
+func (p *shallowParser) parseElements(data []byte) bool {
+	if len(data) < p.offset {
+		// The data was discarded.
+		return true
+	}
+	bo := p.bo
+	for {
+		rest := data[p.offset:]
+		if len(rest) < 8 {
+			return false
+		}
+		tag := dicomtag.Tag{Group: bo.Uint16(rest), Element: bo.Uint16(rest[2:])}
+		if !tagLess(tag, p.stopTag) {
+			return true
+		}
+		var vr string
+		var length uint32
+		var headerSize int
+		if p.implicit == ImplicitVR {
+			if info, err := dicomtag.Find(tag); err == nil {
+				vr = info.VR
+			}
+			length = bo.Uint32(rest[4:])
+			headerSize = 8
+		} else {
+			vr = string(rest[4:6])
+			if longExplicitVRs[vr] {
+				if len(rest) < 12 {
+					return false
+				}
+				length = bo.Uint32(rest[8:])
+				headerSize = 12
+			} else {
+				length = uint32(bo.Uint16(rest[6:]))
+				headerSize = 8
+			}
+		}
+		if length == 0xffffffff {
+			// Undefined length; skipping requires a full parse.
+			return true
+		}
+		if uint64(len(rest)) < uint64(headerSize)+uint64(length) {
+			return false
+		}
+		value := rest[headerSize : headerSize+int(length)]
+		p.offset += headerSize + int(length)
+		if elem, err := dicom.NewElement(tag, shallowElementValue(vr, bo, value)); err == nil {
+			elem.RawValueRepresentation = vr
+			elem.ValueLength = length
+			p.elems = append(p.elems, elem)
+		}
+	}
+}
+
+func tagLess(a, b dicomtag.Tag) bool {
+	if a.Group != b.Group {
+		return a.Group < b.Group
+	}
+	return a.Element < b.Element
+}
+
+// Convert the raw value of an element for dicom.NewElement.
+func shallowElementValue(vr string, bo binary.ByteOrder, value []byte) interface{} {
+	switch {
+	case stringVRs[vr]:
+		s := strings.TrimRight(string(value), " \x00")
+		return strings.Split(s, "\\")
+	case vr == "US" && len(value)%2 == 0:
+		var v []int
+		for i := 0; i < len(value); i += 2 {
+			v = append(v, int(bo.Uint16(value[i:])))
+		}
+		return v
+	case vr == "UL" && len(value)%4 == 0:
+		var v []int
+		for i := 0; i < len(value); i += 4 {
+			v = append(v, int(bo.Uint32(value[i:])))
+		}
+		return v
+	}
+	return append([]byte(nil), value...)
+}
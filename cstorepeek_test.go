@@ -0,0 +1,48 @@
+package netdicom
+
+import (
+	"testing"
+
+	dicomtag "github.com/antibios/dicom/pkg/tag"
+	dicomuid "github.com/antibios/dicom/pkg/uid"
+	"github.com/stretchr/testify/require"
+)
+
+// A dataset fed in pieces parses to the same elements as one parsed whole,
+// and each piece resumes the parse rather than restarting it.
+func TestShallowParserResumes(t *testing.T) {
+	data := []byte{
+		0x10, 0x00, 0x20, 0x00, 'L', 'O', 0x04, 0x00, 'P', 'A', 'T', '1', // PatientID
+		0x20, 0x00, 0x0d, 0x00, 'U', 'I', 0x04, 0x00, '1', '.', '2', 0x00, // StudyInstanceUID
+		0xe0, 0x7f, 0x10, 0x00, 'O', 'B', 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, 0xff, 0xff, // PixelData
+	}
+	whole, done := shallowParseElements(dicomuid.ExplicitVRLittleEndian, data, dicomtag.PixelData)
+	require.True(t, done)
+	require.Len(t, whole, 2)
+
+	p := newShallowParser(dicomuid.ExplicitVRLittleEndian, dicomtag.PixelData)
+	elems, done := p.parse(data[:10])
+	require.False(t, done)
+	require.Empty(t, elems)
+	elems, done = p.parse(data[:14])
+	require.False(t, done)
+	require.Len(t, elems, 1)
+	require.Equal(t, 12, p.offset)
+	elems, done = p.parse(data[:30])
+	require.True(t, done)
+	require.Equal(t, 24, p.offset)
+	require.Len(t, elems, 2)
+	for i := range whole {
+		require.Equal(t, whole[i].Tag, elems[i].Tag)
+		require.Equal(t, whole[i].Value.GetValue(), elems[i].Value.GetValue())
+	}
+
+	// Once done, further data isn't parsed.
+	elems, done = p.parse(data)
+	require.True(t, done)
+	require.Len(t, elems, 2)
+
+	// Deflated data can't be parsed in pieces.
+	_, done = newShallowParser(dicomuid.DeflatedExplicitVRLittleEndian, dicomtag.PixelData).parse(data)
+	require.True(t, done)
+}
@@ -0,0 +1,151 @@
+package netdicom
+
+// This file implements CStoreRouter, which picks the C-STORE handler by SOP
+// class.
+
+import (
+	"sync"
+
+	"github.com/antibios/go-netdicom/dimse"
+	"github.com/antibios/go-netdicom/sopclass"
+)
+
+// CStoreRouter dispatches C-STORE requests to handlers registered by SOP
+// class. Set it in ServiceProviderParams.CStoreHandlers. A handler registered
+// for the exact SOP class UID is preferred; then the first category, in
+// registration order, that matches; then the default handler. SOP classes for
+// which no handler applies are rejected during association negotiation. It is
+// thread safe, but handlers registered after an association is negotiated
+// don't change the contexts it accepted.
+type CStoreRouter struct {
+	mu         sync.Mutex
+	exact      map[string]CStoreCallback
+	categories []categoryHandler
+	fallback   CStoreCallback
+}
+
+type categoryHandler struct {
+	category sopclass.Category
+	cb       CStoreCallback
+}
+
+// NewCStoreRouter creates a CStoreRouter with no handler.
+func NewCStoreRouter() *CStoreRouter {
+	return &CStoreRouter{exact: map[string]CStoreCallback{}}
+}
+
+// Handle registers "cb" for the given SOP classes, replacing any handler
+// registered for them before.
+func (r *CStoreRouter) Handle(cb CStoreCallback, sopClassUIDs ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, uid := range sopClassUIDs {
+		r.exact[uid] = cb
+	}
+}
+
+// HandleCategory registers "cb" for the SOP classes in the category, e.g.,
+// sopclass.StructuredReport.
+func (r *CStoreRouter) HandleCategory(category sopclass.Category, cb CStoreCallback) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.categories = append(r.categories, categoryHandler{category, cb})
+}
+
+// HandleDefault registers "cb" for the SOP classes that no other handler
+// applies to. Without a default handler, such classes are rejected.
+func (r *CStoreRouter) HandleDefault(cb CStoreCallback) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fallback = cb
+}
+
+// Returns the handler for the SOP class, or nil.
+func (r *CStoreRouter) lookup(sopClassUID string) CStoreCallback {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if cb, ok := r.exact[sopClassUID]; ok {
+		return cb
+	}
+	for _, c := range r.categories {
+		if c.category(sopClassUID) {
+			return c.cb
+		}
+	}
+	return r.fallback
+}
+
+// CStore calls the handler for sopClassUID. It has the signature of
+// CStoreCallback. A request for a class without a handler, which can't happen
+// on an association negotiated with the router, gets
+// dimse.CStoreRefusedSOPClassNotSupported.
+func (r *CStoreRouter) CStore(
+	conn ConnectionState,
+	transferSyntaxUID string,
+	sopClassUID string,
+	sopInstanceUID string,
+	calledAE string,
+	callingAE string,
+	data []byte) dimse.Status {
+	cb := r.lookup(sopClassUID)
+	if cb == nil {
+		return dimse.Status{Status: dimse.CStoreRefusedSOPClassNotSupported}
+	}
+	return cb(conn, transferSyntaxUID, sopClassUID, sopInstanceUID, calledAE, callingAE, data)
+}
+
+// Abstract syntaxes served by handlers other than CStore.
+var nonStorageAbstractSyntaxes = func() map[string]bool {
+	m := map[string]bool{}
+	for _, list := range [][]string{
+		sopclass.VerificationClasses,
+		sopclass.QRFindClasses,
+		sopclass.QRMoveClasses,
+		sopclass.QRGetClasses,
+		sopclass.NServiceClasses,
+	} {
+		for _, uid := range list {
+			m[uid] = true
+		}
+	}
+	// QRGetClasses also lists the storage classes used by C-GET.
+	for _, uid := range sopclass.StorageClasses {
+		delete(m, uid)
+	}
+	return m
+}()
+
+// Build the function that decides which abstract syntaxes the provider
+// accepts. Returns nil if every abstract syntax is accepted.
+func abstractSyntaxFilter(params ServiceProviderParams) func(string) bool {
+	router := params.CStoreHandlers
+	noStorage := rejectStorageContexts(params)
+	strict := params.RejectUnknownSOPClasses && !params.Promiscuous
+	if !strict && router == nil && !noStorage && len(params.SOPClasses) == 0 {
+		return nil
+	}
+	var only map[string]bool
+	if len(params.SOPClasses) > 0 {
+		only = map[string]bool{}
+		for _, uid := range params.SOPClasses {
+			only[uid] = true
+		}
+	}
+	return func(uid string) bool {
+		// A class listed in SOPClasses is accepted even if unknown.
+		if only != nil {
+			if !only[uid] {
+				return false
+			}
+		} else if strict && !isKnownAbstractSyntax(uid) {
+			return false
+		}
+		if noStorage && !nonStorageAbstractSyntaxes[uid] {
+			return false
+		}
+		if router != nil && !nonStorageAbstractSyntaxes[uid] {
+			return router.lookup(uid) != nil
+		}
+		return true
+	}
+}
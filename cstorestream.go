@@ -0,0 +1,411 @@
+package netdicom
+
+// This file implements ServiceProviderParams.CStoreStream: handing the dataset
+// of an inbound C-STORE to the handler while it is being received, e.g., to
+// splice it into an outbound association without holding it in memory.
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/antibios/dicom"
+	dicomtag "github.com/antibios/dicom/pkg/tag"
+	"github.com/antibios/go-netdicom/dimse"
+	"github.com/antibios/go-netdicom/pdu"
+)
+
+// CStoreStreamCallback is called for an inbound C-STORE as soon as its command
+// set has arrived. "data" yields the dataset, encoded in transferSyntaxUID, as
+// its P-DATA fragments arrive; only the command set is decoded. Read returns
+// io.EOF after the last fragment, and an error if the association ends first.
+// "priority" is the Priority field of the request (P3.7 C.4.2.1.4).
+//
+// Fragments are buffered until the handler reads them. Once the handlers of
+// an association fall maxBufferedStreamBytes behind, no more PDUs are read
+// from the connection, so a slow handler slows down the peer instead of
+// growing memory use. Reading goes on only while another handler of the
+// association waits for data, which may be queued behind; a dataset whose
+// handler then falls maxStreamBacklogBytes behind is dropped, and Read
+// returns an error. The handler may return before reading all of "data";
+// the rest is then discarded, and the status is sent once the transfer
+// completes.
+type CStoreStreamCallback func(
+	conn ConnectionState,
+	transferSyntaxUID string,
+	sopClassUID string,
+	sopInstanceUID string,
+	priority int,
+	data io.Reader) dimse.Status
+
+// DigestReader is the "data" passed to CStoreStreamCallback when
+// ServiceProviderParams.DataDigest is set. It digests the dataset as it is
+// read.
+type DigestReader interface {
+	io.Reader
+	// Digest returns the digest of the dataset once Read has returned
+	// io.EOF, and nil before.
+	Digest() []byte
+}
+
+// digestReader implements DigestReader. It is used by one goroutine at a time.
+type digestReader struct {
+	r   io.Reader
+	h   hash.Hash
+	sum []byte
+}
+
+func (d *digestReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.h.Write(p[:n])
+	if err == io.EOF && d.sum == nil {
+		d.sum = d.h.Sum(nil)
+	}
+	return n, err
+}
+
+func (d *digestReader) Digest() []byte {
+	return d.sum
+}
+
+// Returned by the reader of a streamed dataset when the association ends
+// before the dataset is complete.
+var errStreamAborted = errors.New("dicom: association ended while the dataset was being received")
+
+// Returned by the reader of a streamed dataset dropped because its handler
+// fell maxStreamBacklogBytes behind.
+var errStreamOverflow = errors.New("dicom: dataset dropped: its handler fell too far behind while another one waited for data")
+
+// Bytes the streamed datasets of an association may hold, unread by their
+// handlers, before the network reader stops reading PDUs. The PDUs already
+// queued for the statemachine are still buffered.
+const maxBufferedStreamBytes = 1 << 20
+
+// Bytes one streamed dataset may hold, unread by its handler. The network
+// reader stops before a stream exceeds it, bar the PDU that crosses
+// maxBufferedStreamBytes, unless it goes on for a handler that waits for data.
+const maxStreamBacklogBytes = maxBufferedStreamBytes + DefaultMaxPDUSize
+
+// cstoreStreamer feeds the datasets of inbound C-STOREs to CStoreStream
+// handlers for one association. It is owned by the statemachine goroutine,
+// which never waits for the handlers.
+type cstoreStreamer struct {
+	flow *cstoreStreamFlow
+	// The datasets being received, keyed by context ID.
+	pending map[byte]*cstoreStream
+}
+
+// cstoreStreamFlow paces the network reader of an association by the
+// handlers of its streamed datasets.
+type cstoreStreamFlow struct {
+	// The IdleTimeout of the provider. See cstoreStreamFlow.wait.
+	idleTimeout time.Duration
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// Bytes buffered and not yet read by the handlers. Guarded by mu.
+	buffered int
+	// Handlers blocked in Read on an empty buffer. While there are any,
+	// the reader doesn't stop: the data they wait for may be queued
+	// behind the data of other datasets. Guarded by mu.
+	starving int
+	// Set when the association ends. Guarded by mu.
+	closed bool
+}
+
+// cstoreStream is the dataset of one streamed C-STORE, as read by its
+// handler. Its fields are guarded by flow.mu.
+type cstoreStream struct {
+	flow  *cstoreStreamFlow
+	frags [][]byte
+	// Bytes in frags.
+	buffered int
+	// io.EOF once the dataset is received in full, errStreamAborted if the
+	// association ended first, errStreamOverflow if it was dropped.
+	err error
+	// Set once nobody will read the rest of the dataset. Fragments are
+	// then dropped.
+	closed bool
+}
+
+func newCStoreStreamer(params ServiceProviderParams) *cstoreStreamer {
+	if params.CStoreStream == nil {
+		return nil
+	}
+	flow := &cstoreStreamFlow{idleTimeout: params.IdleTimeout}
+	flow.cond = sync.NewCond(&flow.mu)
+	return &cstoreStreamer{flow: flow, pending: map[byte]*cstoreStream{}}
+}
+
+// Handle P_DATA_TF PDU "v", after it has been added to sm.commandAssembler,
+// which returned "messages". "streaming" is the set of contexts that were
+// being streamed before the PDU arrived. Returns the messages that are not
+// streamed, to be delivered as usual.
+func (s *cstoreStreamer) onPDU(sm *stateMachine, v *pdu.PDataTf, streaming map[byte]bool, messages []dimse.AssembledMessage) []dimse.AssembledMessage {
+	for _, item := range v.Items {
+		if !item.Command && streaming[item.ContextID] {
+			s.write(item.ContextID, item.Value)
+		}
+	}
+	var rest []dimse.AssembledMessage
+	for _, m := range messages {
+		if streaming[m.ContextID] {
+			s.finish(m.ContextID, nil)
+			continue
+		}
+		if _, ok := m.Command.(*dimse.CStoreRq); !ok {
+			rest = append(rest, m)
+			continue
+		}
+		// The whole dataset arrived in this PDU.
+		s.start(sm, m.ContextID, m.Command)
+		s.write(m.ContextID, m.Data)
+		s.finish(m.ContextID, nil)
+	}
+	for _, m := range sm.commandAssembler.PendingCommands() {
+		if _, ok := m.Command.(*dimse.CStoreRq); !ok || s.pending[m.ContextID] != nil {
+			continue
+		}
+		s.start(sm, m.ContextID, m.Command)
+		s.write(m.ContextID, m.Data)
+		sm.commandAssembler.DiscardData(m.ContextID)
+	}
+	return rest
+}
+
+// Returns the contexts being streamed.
+func (s *cstoreStreamer) streaming() map[byte]bool {
+	r := map[byte]bool{}
+	for contextID := range s.pending {
+		r[contextID] = true
+	}
+	return r
+}
+
+// Start streaming the dataset of "command", and hand it to the dispatcher.
+func (s *cstoreStreamer) start(sm *stateMachine, contextID byte, command dimse.Message) {
+	sm.logf(1, "dicom.stateMachine(%s): Streaming DIMSE request: %v", sm.label, command)
+	stream := &cstoreStream{flow: s.flow}
+	s.pending[contextID] = stream
+	sm.upcallCh <- upcallEvent{
+		eventType: upcallEventData,
+		cm:        sm.contextManager,
+		contextID: contextID,
+		command:   command,
+		stream:    stream,
+	}
+}
+
+// Buffer a fragment for the handler. "data" may be reused by the PDU reader,
+// so it is copied.
+func (s *cstoreStreamer) write(contextID byte, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	f := s.flow
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	stream := s.pending[contextID]
+	if stream.closed {
+		return
+	}
+	if stream.buffered+len(data) > maxStreamBacklogBytes {
+		// The reader went on for another handler; see wait. Drop the
+		// dataset rather than hold it all.
+		stream.drop()
+		stream.err = errStreamOverflow
+		f.cond.Broadcast()
+		return
+	}
+	stream.frags = append(stream.frags, append([]byte(nil), data...))
+	stream.buffered += len(data)
+	f.buffered += len(data)
+	f.cond.Broadcast()
+}
+
+// End the dataset on "contextID". "err" is nil if it was received in full.
+func (s *cstoreStreamer) finish(contextID byte, err error) {
+	if err == nil {
+		err = io.EOF
+	}
+	f := s.flow
+	f.mu.Lock()
+	if stream := s.pending[contextID]; stream.err == nil {
+		stream.err = err
+	}
+	f.cond.Broadcast()
+	f.mu.Unlock()
+	delete(s.pending, contextID)
+}
+
+// End the datasets still being received, when the association ends.
+func (s *cstoreStreamer) abort() {
+	if s == nil {
+		return
+	}
+	for contextID := range s.pending {
+		s.finish(contextID, errStreamAborted)
+	}
+	s.flow.mu.Lock()
+	s.flow.closed = true
+	s.flow.cond.Broadcast()
+	s.flow.mu.Unlock()
+}
+
+// Called by the network reader before it reads a PDU. Waits while the
+// handlers are too far behind, unless one of them waits for data, or the
+// association has ended. In the former case, the data it waits for may be
+// queued behind the data of the others, so stopping could deadlock handlers
+// that depend on one another, e.g., through a TransferScheduler; write drops
+// the datasets that grow past maxStreamBacklogBytes instead. A wait may outlast the read deadline set for
+// IdleTimeout, which is then pushed back: it's the handlers that were idle,
+// not the peer. Safe on a nil cstoreStreamFlow.
+func (f *cstoreStreamFlow) wait(conn net.Conn) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	waited := false
+	for !f.closed && f.buffered > maxBufferedStreamBytes && f.starving == 0 {
+		waited = true
+		f.cond.Wait()
+	}
+	closed := f.closed
+	f.mu.Unlock()
+	if waited && !closed && f.idleTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(f.idleTimeout))
+	}
+}
+
+func (s *cstoreStream) Read(p []byte) (int, error) {
+	f := s.flow
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for len(s.frags) == 0 && s.err == nil {
+		f.starving++
+		f.cond.Broadcast()
+		f.cond.Wait()
+		f.starving--
+	}
+	if len(s.frags) == 0 {
+		return 0, s.err
+	}
+	n := copy(p, s.frags[0])
+	if n == len(s.frags[0]) {
+		s.frags[0] = nil
+		s.frags = s.frags[1:]
+	} else {
+		s.frags[0] = s.frags[0][n:]
+	}
+	s.release(n)
+	return n, nil
+}
+
+// Drop the rest of the dataset. Fragments that arrive later are dropped too.
+func (s *cstoreStream) Close() error {
+	f := s.flow
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s.drop()
+	return nil
+}
+
+// Drop the fragments buffered, and those that arrive later. Requires flow.mu.
+func (s *cstoreStream) drop() {
+	s.closed = true
+	s.release(s.buffered)
+	s.frags = nil
+}
+
+// Note that "n" buffered bytes were consumed. Requires flow.mu.
+func (s *cstoreStream) release(n int) {
+	f := s.flow
+	s.buffered -= n
+	f.buffered -= n
+	if f.buffered+n > maxBufferedStreamBytes && f.buffered <= maxBufferedStreamBytes {
+		f.cond.Broadcast()
+	}
+}
+
+// NewCStoreForwarder returns a CStoreStreamCallback that relays each inbound
+// C-STORE to "su" with CStoreRawFromReader, fragment by fragment, so that a
+// proxy's memory use doesn't grow with the size of the objects. The dataset
+// is relayed verbatim, so "su" must have negotiated the transfer syntaxes of
+// the inbound associations. A failure to relay is reported to the inbound
+// peer with status dimse.CStoreOutOfResources.
+func NewCStoreForwarder(su *ServiceUser) CStoreStreamCallback {
+	return func(conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID string, priority int, data io.Reader) dimse.Status {
+		err := su.CStoreRawFromReader(sopClassUID, sopInstanceUID, transferSyntaxUID, data)
+		return forwardStatus(su.disp.logf, conn, sopInstanceUID, err)
+	}
+}
+
+// NewScheduledCStoreForwarder is like NewCStoreForwarder, but relays the
+// inbound C-STOREs through "sched", so that urgent objects overtake the ones
+// queued before them. The inbound peer waits for the response while its
+// object is queued. Meanwhile the dataset is buffered, up to
+// maxBufferedStreamBytes per inbound association, after which reading from
+// the peer pauses; the inbound association itself keeps running, and the
+// other datasets on it are still read if their handlers wait for them. The
+// StudyInstanceUID passed to the scheduler's rules is read from the head of
+// the dataset, if it is among the first maxStudyPeekBytes, before the
+// transfer is queued.
+func NewScheduledCStoreForwarder(su *ServiceUser, sched *TransferScheduler) CStoreStreamCallback {
+	return func(conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID string, priority int, data io.Reader) dimse.Status {
+		r := bufio.NewReaderSize(data, maxStudyPeekBytes)
+		t := Transfer{
+			SOPClassUID:      sopClassUID,
+			SOPInstanceUID:   sopInstanceUID,
+			StudyInstanceUID: peekStudyInstanceUID(r, transferSyntaxUID),
+			CallingAETitle:   conn.Peer.CallingAETitle,
+			DIMSEPriority:    priority,
+		}
+		err := sched.Do(t, func() error {
+			return su.CStoreRawFromReader(sopClassUID, sopInstanceUID, transferSyntaxUID, r)
+		})
+		return forwardStatus(su.disp.logf, conn, sopInstanceUID, err)
+	}
+}
+
+// Returns the C-STORE status for the outcome of forwarding an object.
+func forwardStatus(logf Logger, conn ConnectionState, sopInstanceUID string, err error) dimse.Status {
+	if err != nil {
+		logf(0, "dicom.serviceProvider: Failed to forward %s from %v: %v", sopInstanceUID, conn.Peer, err)
+		return dimse.Status{
+			Status:       dimse.CStoreOutOfResources,
+			ErrorComment: errorComment(fmt.Sprintf("forwarding failed: %v", err)),
+		}
+	}
+	return dimse.Success
+}
+
+// Bytes at the head of a forwarded dataset searched for its StudyInstanceUID.
+const maxStudyPeekBytes = 64 << 10
+
+// Returns the StudyInstanceUID of the dataset read through "r", or "" if it
+// isn't among the bytes "r" can buffer. The bytes peeked are still returned
+// by r.Read.
+func peekStudyInstanceUID(r *bufio.Reader, transferSyntaxUID string) string {
+	return elementString(peekElements(r, transferSyntaxUID, dicomtag.SeriesInstanceUID), dicomtag.StudyInstanceUID)
+}
+
+// Returns the top-level elements before stopTag of the dataset read through
+// "r", as far as "r" can buffer them; see shallowParseElements. The bytes
+// peeked are still returned by r.Read.
+func peekElements(r *bufio.Reader, transferSyntaxUID string, stopTag dicomtag.Tag) []*dicom.Element {
+	for n := 4096; ; n *= 2 {
+		if n > r.Size() {
+			n = r.Size()
+		}
+		head, err := r.Peek(n)
+		elems, done := shallowParseElements(transferSyntaxUID, head, stopTag)
+		if done || err != nil || n == r.Size() {
+			return elems
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package netdicom
+
+// This file implements DatasetSource: the dataset of a C-STORE, independent of
+// the library that parsed it, so that an application whose datasets come from
+// another DICOM parser can send and receive them without converting them to
+// dicom.Dataset.
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/antibios/dicom"
+	dicomtag "github.com/antibios/dicom/pkg/tag"
+	dicomuid "github.com/antibios/dicom/pkg/uid"
+	"github.com/antibios/go-netdicom/dimse"
+)
+
+// DatasetSource is a dataset sent or received with C-STORE. NewRawDataset
+// wraps encoded bytes, and NewDicomDatasetSource a dicom.Dataset; other
+// parsers can implement it directly.
+type DatasetSource interface {
+	// SOPClassUID and SOPInstanceUID identify the object.
+	SOPClassUID() string
+	SOPInstanceUID() string
+
+	// TransferSyntaxUID is the encoding of the bytes written by WriteTo.
+	TransferSyntaxUID() string
+
+	// WriteTo writes the body of the dataset, i.e., without the group 0002
+	// metadata elements, encoded in TransferSyntaxUID. It may be called
+	// more than once.
+	io.WriterTo
+}
+
+// CStoreDatasetCallback is like CStoreCallback, but receives the dataset as a
+// DatasetSource. "ds" is a *RawDataset holding the bytes as received; it must
+// not be used after the callback returns unless they are copied.
+type CStoreDatasetCallback func(conn ConnectionState, ds DatasetSource) dimse.Status
+
+// RawDataset is a DatasetSource over an encoded dataset, e.g., the data passed
+// to CStoreCallback.
+type RawDataset struct {
+	sopClassUID       string
+	sopInstanceUID    string
+	transferSyntaxUID string
+	data              []byte
+}
+
+// NewRawDataset creates a DatasetSource for "data", the body of a dataset
+// encoded in transferSyntaxUID. The bytes are not copied.
+func NewRawDataset(sopClassUID, sopInstanceUID, transferSyntaxUID string, data []byte) *RawDataset {
+	return &RawDataset{
+		sopClassUID:       sopClassUID,
+		sopInstanceUID:    sopInstanceUID,
+		transferSyntaxUID: transferSyntaxUID,
+		data:              data,
+	}
+}
+
+func (d *RawDataset) SOPClassUID() string       { return d.sopClassUID }
+func (d *RawDataset) SOPInstanceUID() string    { return d.sopInstanceUID }
+func (d *RawDataset) TransferSyntaxUID() string { return d.transferSyntaxUID }
+
+// Bytes returns the encoded dataset.
+func (d *RawDataset) Bytes() []byte { return d.data }
+
+func (d *RawDataset) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(d.data)
+	return int64(n), err
+}
+
+// dicomDatasetSource adapts a dicom.Dataset.
+type dicomDatasetSource struct {
+	ds                *dicom.Dataset
+	sopClassUID       string
+	sopInstanceUID    string
+	transferSyntaxUID string
+}
+
+// NewDicomDatasetSource adapts "ds", parsed by the github.com/antibios/dicom
+// package. The UIDs are read from its file meta elements. It is encoded in its
+// original transfer syntax, or in implicit VR little endian if ds lacks the
+// TransferSyntaxUID element.
+func NewDicomDatasetSource(ds *dicom.Dataset) (DatasetSource, error) {
+	s := &dicomDatasetSource{ds: ds, transferSyntaxUID: datasetTransferSyntaxUID(ds)}
+	if s.transferSyntaxUID == "" {
+		s.transferSyntaxUID = dicomuid.ImplicitVRLittleEndian
+	}
+	for _, u := range []struct {
+		tag   dicomtag.Tag
+		value *string
+	}{
+		{dicomtag.MediaStorageSOPClassUID, &s.sopClassUID},
+		{dicomtag.MediaStorageSOPInstanceUID, &s.sopInstanceUID},
+	} {
+		elem, err := ds.FindElementByTag(u.tag)
+		if err != nil {
+			return nil, fmt.Errorf("dicom.DatasetSource: data lacks %s: %v", u.tag.String(), err)
+		}
+		v, ok := elem.Value.GetValue().([]string)
+		if !ok || len(v) == 0 {
+			return nil, fmt.Errorf("dicom.DatasetSource: %s is empty", u.tag.String())
+		}
+		*u.value = v[0]
+	}
+	if _, _, err := ParseTransferSyntaxUID(s.transferSyntaxUID); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *dicomDatasetSource) SOPClassUID() string       { return s.sopClassUID }
+func (s *dicomDatasetSource) SOPInstanceUID() string    { return s.sopInstanceUID }
+func (s *dicomDatasetSource) TransferSyntaxUID() string { return s.transferSyntaxUID }
+
+func (s *dicomDatasetSource) WriteTo(w io.Writer) (int64, error) {
+	bo, implicit, err := ParseTransferSyntaxUID(s.transferSyntaxUID)
+	if err != nil {
+		return 0, err
+	}
+	var b bytes.Buffer
+	e := dicom.NewWriter(&b, dicom.SkipVRVerification())
+	e.SetTransferSyntax(bo, implicit == ImplicitVR)
+	for _, elem := range StripFileMetaElements(s.ds.Elements) {
+		e.WriteElement(elem)
+	}
+	return b.WriteTo(w)
+}
+
+// RawElement is a top-level element of an encoded dataset.
+type RawElement struct {
+	Tag dicomtag.Tag
+	// VR is the value representation; it is guessed from the tag if the
+	// dataset is in implicit VR.
+	VR string
+	// Value is the encoded value. For a sequence of undefined length, it
+	// runs through the sequence delimitation item.
+	Value []byte
+}
+
+// RawElements calls "fn" for each top-level element of "src", in order,
+// without decoding the values, and stops at the first error. Datasets in the
+// deflated transfer syntax can't be scanned.
+func RawElements(src DatasetSource, fn func(RawElement) error) error {
+	tsUID := src.TransferSyntaxUID()
+	if tsUID == dicomuid.DeflatedExplicitVRLittleEndian {
+		return fmt.Errorf("dicom.RawElements: can't scan a dataset encoded in %s", dicomuid.UIDString(tsUID))
+	}
+	bo, implicit, err := ParseTransferSyntaxUID(tsUID)
+	if err != nil {
+		return err
+	}
+	var data []byte
+	if raw, ok := src.(*RawDataset); ok {
+		data = raw.data
+	} else {
+		var b bytes.Buffer
+		if _, err := src.WriteTo(&b); err != nil {
+			return err
+		}
+		data = b.Bytes()
+	}
+	elems, err := scanRawElements(data, bo, implicit == ImplicitVR)
+	if err != nil {
+		return err
+	}
+	for _, e := range elems {
+		if err := fn(RawElement{Tag: e.tag, VR: e.vr, Value: data[e.valueStart:e.end]}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package netdicom
+
+// This file implements the dialing of providers whose host names resolve to
+// several addresses, racing them in the manner of Happy Eyeballs (RFC 8305),
+// so that an unreachable address, typically a broken IPv6 path, doesn't delay
+// each association by a full TCP timeout. net.Dialer's FallbackDelay races
+// the two address families, but tries the addresses of each one in turn, under
+// a shared timeout; here each address gets an attempt of its own.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+)
+
+const (
+	// DefaultDialTimeout is the default value of DialParams.Timeout.
+	DefaultDialTimeout = 30 * time.Second
+
+	// DefaultDialAttemptTimeout is the default value of
+	// DialParams.AttemptTimeout.
+	DefaultDialAttemptTimeout = 10 * time.Second
+
+	// DefaultConnectionAttemptDelay is the default value of
+	// DialParams.AttemptDelay. RFC 8305 section 5 recommends 250ms.
+	DefaultConnectionAttemptDelay = 250 * time.Millisecond
+)
+
+// DialParams configures how a ServiceUser or DialUL connects to a provider.
+type DialParams struct {
+	// Timeout bounds the whole connection attempt, over all the addresses
+	// of the host. If zero, DefaultDialTimeout is used.
+	Timeout time.Duration
+
+	// AttemptTimeout bounds the attempt to connect to one address. If
+	// zero, DefaultDialAttemptTimeout is used.
+	AttemptTimeout time.Duration
+
+	// AttemptDelay is how long an attempt runs alone before the next
+	// address is tried in parallel. Addresses alternate between IPv6 and
+	// IPv4, starting with the first one returned by the resolver. If
+	// zero, DefaultConnectionAttemptDelay is used. If negative, addresses
+	// are tried one at a time.
+	AttemptDelay time.Duration
+
+	// Resolver looks up host names. If nil, net.DefaultResolver is used.
+	Resolver *net.Resolver
+}
+
+// Connects to "address", "host:port", over TCP. Only host names are looked up;
+// an IP address, or an empty host, is dialed as is.
+func dialTCP(ctx context.Context, address string, params DialParams) (net.Conn, error) {
+	if params.Timeout <= 0 {
+		params.Timeout = DefaultDialTimeout
+	}
+	if params.AttemptTimeout <= 0 {
+		params.AttemptTimeout = DefaultDialAttemptTimeout
+	}
+	if params.AttemptDelay == 0 {
+		params.AttemptDelay = DefaultConnectionAttemptDelay
+	}
+	resolver := params.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	ctx, cancel := context.WithTimeout(ctx, params.Timeout)
+	defer cancel()
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if host == "" {
+		// As with net.Dial, an empty host is the local system; there is
+		// nothing to look up or race.
+		d := net.Dialer{Timeout: params.AttemptTimeout}
+		return d.DialContext(ctx, "tcp", address)
+	}
+	var addrs []net.IPAddr
+	if ip, err := netip.ParseAddr(host); err == nil {
+		addrs = []net.IPAddr{{IP: ip.AsSlice(), Zone: ip.Zone()}}
+	} else if addrs, err = resolver.LookupIPAddr(ctx, host); err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("dicom.dial: no address for %s", host)
+	}
+	return dialAddrs(ctx, interleaveAddrFamilies(addrs), port, params)
+}
+
+// Orders "addrs" so that the families alternate, starting with that of the
+// first, as in RFC 8305 section 4.
+func interleaveAddrFamilies(addrs []net.IPAddr) []net.IPAddr {
+	var first, second []net.IPAddr
+	firstIs4 := addrs[0].IP.To4() != nil
+	for _, a := range addrs {
+		if (a.IP.To4() != nil) == firstIs4 {
+			first = append(first, a)
+		} else {
+			second = append(second, a)
+		}
+	}
+	r := make([]net.IPAddr, 0, len(addrs))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			r = append(r, first[i])
+		}
+		if i < len(second) {
+			r = append(r, second[i])
+		}
+	}
+	return r
+}
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// Races connections to "addrs", starting one every params.AttemptDelay, or as
+// soon as the previous one fails. Returns the first to succeed; the others are
+// closed.
+func dialAddrs(ctx context.Context, addrs []net.IPAddr, port string, params DialParams) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan dialResult, len(addrs))
+	start := func(a net.IPAddr) {
+		go func() {
+			attemptCtx, cancel := context.WithTimeout(ctx, params.AttemptTimeout)
+			defer cancel()
+			var d net.Dialer
+			conn, err := d.DialContext(attemptCtx, "tcp", net.JoinHostPort(a.String(), port))
+			results <- dialResult{conn, err}
+		}()
+	}
+	next, running := 0, 0
+	var errs []error
+	for next < len(addrs) || running > 0 {
+		if running == 0 {
+			start(addrs[next])
+			next++
+			running++
+		}
+		var timer *time.Timer
+		var delay <-chan time.Time
+		if params.AttemptDelay > 0 && next < len(addrs) {
+			timer = time.NewTimer(params.AttemptDelay)
+			delay = timer.C
+		}
+		select {
+		case r := <-results:
+			running--
+			if r.err == nil {
+				go closeLateConns(results, running)
+				return r.conn, nil
+			}
+			errs = append(errs, r.err)
+		case <-delay:
+			start(addrs[next])
+			next++
+			running++
+		case <-ctx.Done():
+			go closeLateConns(results, running)
+			return nil, ctx.Err()
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+	return nil, fmt.Errorf("dicom.dial: %w", errors.Join(errs...))
+}
+
+// Close the connections of the "n" attempts still running once they finish.
+func closeLateConns(results chan dialResult, n int) {
+	for ; n > 0; n-- {
+		if r := <-results; r.conn != nil {
+			r.conn.Close()
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package netdicom
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInterleaveAddrFamilies(t *testing.T) {
+	addrs := func(ips ...string) []net.IPAddr {
+		var r []net.IPAddr
+		for _, ip := range ips {
+			r = append(r, net.IPAddr{IP: net.ParseIP(ip)})
+		}
+		return r
+	}
+	require.Equal(t,
+		addrs("::1", "10.0.0.1", "::2", "10.0.0.2", "::3"),
+		interleaveAddrFamilies(addrs("::1", "::2", "::3", "10.0.0.1", "10.0.0.2")))
+	require.Equal(t,
+		addrs("10.0.0.1", "::1", "10.0.0.2"),
+		interleaveAddrFamilies(addrs("10.0.0.1", "10.0.0.2", "::1")))
+}
+
+// An address that refuses the connection is skipped without waiting for the
+// attempt delay.
+func TestDialAddrs(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	require.NoError(t, err)
+
+	addrs := []net.IPAddr{{IP: net.ParseIP("127.0.0.2")}, {IP: net.ParseIP("127.0.0.1")}}
+	conn, err := dialAddrs(context.Background(), addrs, port, DialParams{AttemptTimeout: DefaultDialAttemptTimeout, AttemptDelay: -1})
+	require.NoError(t, err)
+	require.Equal(t, l.Addr().String(), conn.RemoteAddr().String())
+	conn.Close()
+
+	_, err = dialAddrs(context.Background(), addrs[:1], port, DialParams{AttemptTimeout: DefaultDialAttemptTimeout})
+	require.Error(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = dialTCP(ctx, l.Addr().String(), DialParams{})
+	require.Error(t, err)
+}
+
+// Empty hosts and IP addresses are dialed without a lookup.
+func TestDialTCPNoLookup(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	require.NoError(t, err)
+
+	params := DialParams{Resolver: &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return nil, errors.New("unexpected lookup")
+		},
+	}}
+	for _, address := range []string{":" + port, "127.0.0.1:" + port} {
+		conn, err := dialTCP(context.Background(), address, params)
+		require.NoError(t, err, address)
+		conn.Close()
+	}
+	_, err = dialTCP(context.Background(), "localhost.invalid:"+port, params)
+	require.Error(t, err)
+}
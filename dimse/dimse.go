@@ -1,6 +1,7 @@
 package dimse
 
 //go:generate ./generate_dimse_messages.py
+//go:generate ./generate_status_codes.py
 //go:generate stringer -type StatusCode
 
 // Implements message types defined in P3.7.
@@ -11,6 +12,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"hash"
 	"log"
 	"sort"
 
@@ -81,6 +83,16 @@ func (d *messageDecoder) findElement(tag dicomtag.Tag, optional isOptionalElemen
 	return nil
 }
 
+// Reports whether the message has an element with "tag".
+func (d *messageDecoder) hasElement(tag dicomtag.Tag) bool {
+	for _, elem := range d.elems.Elements {
+		if elem.Tag == tag {
+			return true
+		}
+	}
+	return false
+}
+
 // Return the list of elements that did not match any of the prior getXXX calls.
 func (d *messageDecoder) unparsedElements() (unparsed []*dicom.Element) {
 	return unparsed
@@ -130,6 +142,39 @@ func (d *messageDecoder) getUInt16(tag dicomtag.Tag, optional isOptionalElement)
 	return 0
 }
 
+// Find an element with "tag", and extract a list of tags from it, e.g., the
+// Attribute Identifier List of N-GET. Each tag is stored as a pair of ints,
+// its group and element. Errors are reported in d.err.
+func (d *messageDecoder) getTags(tag dicomtag.Tag, optional isOptionalElement) []dicomtag.Tag {
+	e := d.findElement(tag, optional)
+	if e == nil {
+		return nil
+	}
+	if e.Value.ValueType() != dicom.Ints {
+		d.setError(fmt.Errorf("dimse: %s is not a list of tags", dicomtag.DebugString(tag)))
+		return nil
+	}
+	v := dicom.MustGetInts(e.Value)
+	if len(v)%2 != 0 {
+		d.setError(fmt.Errorf("dimse: %s has an odd number of values, %d", dicomtag.DebugString(tag), len(v)))
+		return nil
+	}
+	tags := make([]dicomtag.Tag, 0, len(v)/2)
+	for i := 0; i < len(v); i += 2 {
+		tags = append(tags, dicomtag.Tag{Group: uint16(v[i]), Element: uint16(v[i+1])})
+	}
+	return tags
+}
+
+// The value of an element that lists "tags", in the form getTags reads.
+func tagsValue(tags []dicomtag.Tag) []int {
+	v := make([]int, 0, 2*len(tags))
+	for _, t := range tags {
+		v = append(v, int(t.Group), int(t.Element))
+	}
+	return v
+}
+
 // Encode the given elements. The elements are sorted in ascending tag order.
 func encodeElements(e *dicom.Writer, elems []*dicom.Element) {
 	sort.Slice(elems, func(i, j int) bool {
@@ -178,42 +223,141 @@ const CommandDataSetTypeNonNull uint16 = 1
 // Success is an OK status for a call.
 var Success = Status{Status: StatusSuccess}
 
-// StatusCode represents a DIMSE service response code, as defined in P3.7
+// StatusCode represents a DIMSE service response code, as defined in P3.7.
+// The constants are generated into status_codes.go.
 type StatusCode uint16
 
+// StatusCategory is the class of a status code. P3.7 C.1.
+type StatusCategory int
+
 const (
-	StatusSuccess               StatusCode = 0
-	StatusCancel                StatusCode = 0xFE00
-	StatusSOPClassNotSupported  StatusCode = 0x0112
-	StatusInvalidArgumentValue  StatusCode = 0x0115
-	StatusInvalidAttributeValue StatusCode = 0x0106
-	StatusInvalidObjectInstance StatusCode = 0x0117
-	StatusUnrecognizedOperation StatusCode = 0x0211
-	StatusNotAuthorized         StatusCode = 0x0124
-	StatusPending               StatusCode = 0xff00
-
-	// C-STORE-specific status codes. P3.4 GG4-1
-	CStoreOutOfResources              StatusCode = 0xa700
-	CStoreCannotUnderstand            StatusCode = 0xc000
-	CStoreDataSetDoesNotMatchSOPClass StatusCode = 0xa900
-
-	// C-FIND-specific status codes.
-	CFindUnableToProcess StatusCode = 0xc000
-
-	// C-MOVE/C-GET-specific status codes.
-	CMoveOutOfResourcesUnableToCalculateNumberOfMatches StatusCode = 0xa701
-	CMoveOutOfResourcesUnableToPerformSubOperations     StatusCode = 0xa702
-	CMoveMoveDestinationUnknown                         StatusCode = 0xa801
-	CMoveDataSetDoesNotMatchSOPClass                    StatusCode = 0xa900
-
-	// Warning codes.
-	StatusAttributeValueOutOfRange StatusCode = 0x0116
-	StatusAttributeListError       StatusCode = 0x0107
+	StatusCategoryFailure StatusCategory = iota
+	StatusCategorySuccess
+	StatusCategoryPending
+	StatusCategoryCancel
+	StatusCategoryWarning
 )
 
+func (c StatusCategory) String() string {
+	switch c {
+	case StatusCategoryFailure:
+		return "failure"
+	case StatusCategorySuccess:
+		return "success"
+	case StatusCategoryPending:
+		return "pending"
+	case StatusCategoryCancel:
+		return "cancel"
+	case StatusCategoryWarning:
+		return "warning"
+	}
+	return fmt.Sprintf("StatusCategory(%d)", int(c))
+}
+
+// Category returns the class of the code. Codes 0xBxxx, and the general
+// warnings of P3.7 C.5, are warnings; codes not listed in StatusCodes, e.g.,
+// 0xA7xx or 0xCxxx, are failures.
+func (c StatusCode) Category() StatusCategory {
+	switch {
+	case c == StatusSuccess:
+		return StatusCategorySuccess
+	case c == StatusPending || c == CFindPendingOptionalKeysNotSupported:
+		return StatusCategoryPending
+	case c == StatusCancel:
+		return StatusCategoryCancel
+	case c&0xf000 == 0xb000 || c == 0x0001 || c == StatusAttributeListError || c == StatusAttributeValueOutOfRange:
+		return StatusCategoryWarning
+	}
+	return StatusCategoryFailure
+}
+
+// StatusCodeInfo describes a status code. See StatusCodes.
+type StatusCodeInfo struct {
+	Code StatusCode
+	// Name of the constant for the code.
+	Name     string
+	Category StatusCategory
+	// Services that define the code with this meaning, e.g., "C-STORE".
+	// Empty if the code is general.
+	Services []string
+	// Meaning, as worded in the standard.
+	Meaning string
+}
+
+// LookupStatusCode returns the entries of StatusCodes for "code". If
+// "service", e.g., "C-FIND", is nonempty, only the entries that apply to it,
+// including the general ones, are returned.
+func LookupStatusCode(code StatusCode, service string) []StatusCodeInfo {
+	var infos []StatusCodeInfo
+	for _, info := range StatusCodes {
+		if info.Code != code {
+			continue
+		}
+		if service != "" && len(info.Services) > 0 {
+			found := false
+			for _, s := range info.Services {
+				found = found || s == service
+			}
+			if !found {
+				continue
+			}
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// NewStatus returns a Status with the given code and ErrorComment.
+func NewStatus(code StatusCode, comment string) Status {
+	return Status{Status: code, ErrorComment: comment}
+}
+
+// StatusOutOfResources returns the status for refusing a C-STORE or C-FIND
+// for lack of resources (0xA700).
+func StatusOutOfResources(comment string) Status {
+	return NewStatus(CStoreOutOfResources, comment)
+}
+
+// StatusCannotUnderstand returns the status for a C-STORE dataset that can't
+// be processed, or a C-FIND, C-GET or C-MOVE that can't be (0xC000).
+func StatusCannotUnderstand(comment string) Status {
+	return NewStatus(CStoreCannotUnderstand, comment)
+}
+
+// StatusDataSetMismatch returns the status for a dataset, or an identifier,
+// that doesn't match the SOP class of the request (0xA900).
+func StatusDataSetMismatch(comment string) Status {
+	return NewStatus(CStoreDataSetDoesNotMatchSOPClass, comment)
+}
+
+// StatusMoveDestinationUnknown returns the status for a C-MOVE whose
+// destination AE is unknown (0xA801).
+func StatusMoveDestinationUnknown(comment string) Status {
+	return NewStatus(CMoveMoveDestinationUnknown, comment)
+}
+
+// StatusSubOperationsFailed returns the warning for a C-GET or C-MOVE whose
+// sub-operations completed with one or more failures (0xB000).
+func StatusSubOperationsFailed(comment string) Status {
+	return NewStatus(CMoveSubOperationsFailed, comment)
+}
+
+// StatusRefused returns the status for a request the peer isn't authorized
+// to make (0x0124).
+func StatusRefused(comment string) Status {
+	return NewStatus(StatusNotAuthorized, comment)
+}
+
+// StatusFailure returns the status for a request that failed for a reason
+// with no specific code (0x0110).
+func StatusFailure(comment string) Status {
+	return NewStatus(StatusProcessingFailure, comment)
+}
+
 // ReadMessage constructs a typed dimse.Message object, given a set of
-// dicom.Elements,
-func ReadMessage(d dicom.Dataset) Message {
+// dicom.Elements. It returns an error if the command field is missing or
+// unknown, or if a required element is missing.
+func ReadMessage(d dicom.Dataset) (Message, error) {
 	// A DIMSE message is a sequence of Elements, encoded in implicit
 	// LE.
 	//
@@ -239,15 +383,13 @@ func ReadMessage(d dicom.Dataset) Message {
 	}
 	commandField := dd.getUInt16(dicomtag.CommandField, requiredElement)
 	if dd.err != nil {
-		log.Println(dd.err)
-		return nil
+		return nil, dd.err
 	}
 	v := decodeMessageForType(&dd, commandField)
 	if dd.err != nil {
-		log.Println(dd.err)
-		return nil
+		return nil, dd.err
 	}
-	return v
+	return v, nil
 }
 
 // EncodeMessage serializes the given message. Errors are reported through e.Error()
@@ -274,72 +416,250 @@ func EncodeMessage(e *dicom.Writer, v Message) {
 
 }
 
-// CommandAssembler is a helper that assembles a DIMSE command message and data
-// payload from a sequence of P_DATA_TF PDUs.
+// CommandAssembler is a helper that assembles DIMSE command messages and data
+// payloads from a sequence of P_DATA_TF PDUs. Fragments of messages on
+// different presentation contexts may be interleaved, within a PDU and across
+// PDUs; at most one message per context is in flight. Within a context, the
+// command set must be complete before data fragments arrive. P3.8 Annex E.
+//
+// The zero value is ready to use.
 type CommandAssembler struct {
-	contextID      byte
+	// MaxCommandBytes bounds the size of a command set. A peer that sends
+	// more fails AddPDU before the command is parsed. If zero,
+	// DefaultMaxCommandBytes is used. If negative, the size is unbounded.
+	MaxCommandBytes int
+
+	// MaxCommandElements bounds the number of elements in a command set.
+	// If zero, DefaultMaxCommandElements is used. If negative, the count
+	// is unbounded.
+	MaxCommandElements int
+
+	// DataHash, if non-nil, creates a hash that digests the data payload of
+	// each message as its fragments arrive, including the ones discarded.
+	// The result is in AssembledMessage.Digest.
+	DataHash func() hash.Hash
+
+	// Messages being assembled, keyed by context ID.
+	pending map[byte]*partialMessage
+	// Context IDs of pending, in order of their first fragment.
+	order []byte
+}
+
+type partialMessage struct {
 	commandBytes   []byte
 	command        Message
 	dataBytes      []byte
 	readAllCommand bool
+	// Bytes of data received, including the ones discarded. A dataset may
+	// exceed 4GB, and the range of int on 32-bit platforms.
+	dataLength int64
 
 	readAllData bool
+	discardData bool
+	// Digests the data, if CommandAssembler.DataHash is set.
+	dataHash hash.Hash
 }
 
-// AddDataPDU is to be called for each P_DATA_TF PDU received from the
-// network. If the fragment is marked as the last one, AddDataPDU returns
-// <SOPUID, TransferSyntaxUID, payload, nil>.  If it needs more fragments, it
-// returns <"", "", nil, nil>.  On error, it returns a non-nil error.
-func (a *CommandAssembler) AddDataPDU(pdu *pdu.PDataTf) (byte, Message, []byte, error) {
+func (m *partialMessage) complete() bool {
+	return m.readAllCommand && (!m.command.HasData() || m.readAllData)
+}
+
+// AssembledMessage is a DIMSE message assembled by CommandAssembler. Data is
+// nil if the command has no data payload, or if it was discarded. A payload
+// sent as zero-length PDVs, i.e., an empty dataset, is an empty, non-nil Data.
+type AssembledMessage struct {
+	ContextID byte
+	Command   Message
+	Data      []byte
+	// DataLength is the number of bytes of data received, including the
+	// ones discarded.
+	DataLength int64
+	// Digest is the digest of the data, if CommandAssembler.DataHash is
+	// set and the message has a data payload.
+	Digest []byte
+}
+
+// PendingCommands returns the commands whose data payload is still being
+// assembled, along with the data received so far, in order of arrival. A
+// message whose command set is incomplete is not included.
+func (a *CommandAssembler) PendingCommands() []AssembledMessage {
+	var r []AssembledMessage
+	for _, contextID := range a.order {
+		if m := a.pending[contextID]; m.command != nil && !m.readAllData {
+			r = append(r, AssembledMessage{ContextID: contextID, Command: m.command, Data: m.dataBytes, DataLength: m.dataLength})
+		}
+	}
+	return r
+}
+
+// PendingCommand returns the first of PendingCommands, or a nil Message if
+// there is none.
+func (a *CommandAssembler) PendingCommand() (byte, Message, []byte) {
+	if p := a.PendingCommands(); len(p) > 0 {
+		return p[0].ContextID, p[0].Command, p[0].Data
+	}
+	return 0, nil, nil
+}
+
+// BufferedBytes returns the number of bytes held for the messages being
+// assembled.
+func (a *CommandAssembler) BufferedBytes() int64 {
+	var n int64
+	for _, m := range a.pending {
+		n += int64(len(m.commandBytes)) + int64(len(m.dataBytes))
+	}
+	return n
+}
+
+// DiscardData causes the data payload of the pending command on "contextID"
+// to be dropped as it arrives, so that it doesn't consume memory. The message
+// is then assembled with a nil payload.
+func (a *CommandAssembler) DiscardData(contextID byte) {
+	if m, ok := a.pending[contextID]; ok {
+		m.discardData = true
+		m.dataBytes = nil
+	}
+}
+
+// AddPDU is to be called for each P_DATA_TF PDU received from the network. It
+// returns the messages completed by the PDU, in order of completion. On error,
+// the state of the assembler is undefined, and the association should be
+// aborted.
+func (a *CommandAssembler) AddPDU(pdu *pdu.PDataTf) ([]AssembledMessage, error) {
+	var done []AssembledMessage
 	for _, item := range pdu.Items {
-		if a.contextID == 0 {
-			a.contextID = item.ContextID
-		} else if a.contextID != item.ContextID {
-			return 0, nil, nil, fmt.Errorf("Mixed context: %d %d", a.contextID, item.ContextID)
+		m, ok := a.pending[item.ContextID]
+		if !ok {
+			if a.pending == nil {
+				a.pending = make(map[byte]*partialMessage)
+			}
+			m = &partialMessage{}
+			a.pending[item.ContextID] = m
+			a.order = append(a.order, item.ContextID)
 		}
 		if item.Command {
-			a.commandBytes = append(a.commandBytes, item.Value...)
+			if m.readAllCommand {
+				return nil, fmt.Errorf("P_DATA_TF: context %d: command fragment after the last one", item.ContextID)
+			}
+			m.commandBytes = append(m.commandBytes, item.Value...)
+			if max := limitOrDefault(a.MaxCommandBytes, DefaultMaxCommandBytes); max >= 0 && len(m.commandBytes) > max {
+				return nil, fmt.Errorf("P_DATA_TF: context %d: command set exceeds %d bytes", item.ContextID, max)
+			}
 			if item.Last {
-				if a.readAllCommand {
-					return 0, nil, nil, fmt.Errorf("P_DATA_TF: found >1 command chunks with the Last bit set")
+				m.readAllCommand = true
+				if len(m.commandBytes) == 0 {
+					return nil, fmt.Errorf("P_DATA_TF: context %d: empty command set", item.ContextID)
+				}
+				n, err := countCommandElements(m.commandBytes)
+				if err != nil {
+					return nil, fmt.Errorf("P_DATA_TF: context %d: %v", item.ContextID, err)
+				}
+				if max := limitOrDefault(a.MaxCommandElements, DefaultMaxCommandElements); max >= 0 && n > max {
+					return nil, fmt.Errorf("P_DATA_TF: context %d: command set has %d elements, more than %d", item.ContextID, n, max)
+				}
+				d, err := dicom.ReadDataSetInBytes(&m.commandBytes, dicom.SkipPixelData(), dicom.SkipMetadataReadOnNewParserInit())
+				if err != nil {
+					return nil, fmt.Errorf("P_DATA_TF: context %d: failed to parse the DIMSE command: %v", item.ContextID, err)
+				}
+				if m.command, err = ReadMessage(d); err != nil {
+					return nil, fmt.Errorf("P_DATA_TF: context %d: %v", item.ContextID, err)
 				}
-				a.readAllCommand = true
 			}
 		} else {
-			a.dataBytes = append(a.dataBytes, item.Value...)
-			if item.Last {
-				if a.readAllData {
-					return 0, nil, nil, fmt.Errorf("P_DATA_TF: found >1 data chunks with the Last bit set")
+			if !m.readAllCommand {
+				return nil, fmt.Errorf("P_DATA_TF: context %d: data fragment before the command is complete", item.ContextID)
+			}
+			if !m.command.HasData() {
+				return nil, fmt.Errorf("P_DATA_TF: context %d: data fragment for %v, which has no data", item.ContextID, m.command)
+			}
+			m.dataLength += int64(len(item.Value))
+			if a.DataHash != nil {
+				if m.dataHash == nil {
+					m.dataHash = a.DataHash()
+				}
+				m.dataHash.Write(item.Value)
+			}
+			if !m.discardData {
+				if m.dataBytes == nil {
+					// Even if the payload turns out empty, it's
+					// there.
+					m.dataBytes = []byte{}
 				}
-				a.readAllData = true
+				m.dataBytes = append(m.dataBytes, item.Value...)
 			}
+			m.readAllData = item.Last
+		}
+		if m.complete() {
+			msg := AssembledMessage{ContextID: item.ContextID, Command: m.command, Data: m.dataBytes, DataLength: m.dataLength}
+			if m.dataHash != nil {
+				msg.Digest = m.dataHash.Sum(nil)
+			}
+			done = append(done, msg)
+			a.remove(item.ContextID)
 		}
 	}
-	if !a.readAllCommand {
-		return 0, nil, nil, nil
+	return done, nil
+}
+
+// Defaults for CommandAssembler's limits. A command set holds a dozen short
+// elements, so they leave ample room. P3.7 E.1.
+const (
+	DefaultMaxCommandBytes    = 64 << 10
+	DefaultMaxCommandElements = 64
+)
+
+func limitOrDefault(limit, def int) int {
+	if limit == 0 {
+		return def
 	}
-	if a.command == nil {
-		d, err := dicom.ReadDataSetInBytes(&a.commandBytes, dicom.SkipPixelData(), dicom.SkipMetadataReadOnNewParserInit())
-		if err != nil {
-			log.Println("(AddDataPDU) error reading Bytes ", err)
+	return limit
+}
+
+// Count the elements of a command set, encoded in implicit VR little endian,
+// without parsing their values. Fails if an element overruns the buffer.
+func countCommandElements(b []byte) (int, error) {
+	n := 0
+	for len(b) > 0 {
+		if len(b) < 8 {
+			return 0, fmt.Errorf("truncated command element header")
 		}
-		a.command = ReadMessage(d)
-		/* d := dicomio.NewBytesDecoder(a.commandBytes, nil, dicomio.UnknownVR)
+		length := binary.LittleEndian.Uint32(b[4:])
+		if uint64(length) > uint64(len(b)-8) {
+			return 0, fmt.Errorf("command element (%04x,%04x) of %d bytes overruns the command set",
+				binary.LittleEndian.Uint16(b), binary.LittleEndian.Uint16(b[2:]), length)
+		}
+		b = b[8+int(length):]
+		n++
+	}
+	return n, nil
+}
 
-		a.command = ReadMessage(d)
-		if err := d.Finish(); err != nil {
-			return 0, nil, nil, err
-		}*/
+func (a *CommandAssembler) remove(contextID byte) {
+	delete(a.pending, contextID)
+	for i, id := range a.order {
+		if id == contextID {
+			a.order = append(a.order[:i], a.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// AddDataPDU is like AddPDU, for callers that handle one message at a time.
+// If the PDU completes a message, AddDataPDU returns <contextID, command,
+// payload, nil>. If it needs more fragments, it returns <0, nil, nil, nil>. It
+// is an error for the PDU to complete more than one message.
+func (a *CommandAssembler) AddDataPDU(pdu *pdu.PDataTf) (byte, Message, []byte, error) {
+	done, err := a.AddPDU(pdu)
+	if err != nil {
+		return 0, nil, nil, err
 	}
-	if a.command.HasData() && !a.readAllData {
+	switch len(done) {
+	case 0:
 		return 0, nil, nil, nil
+	case 1:
+		return done[0].ContextID, done[0].Command, done[0].Data, nil
 	}
-	contextID := a.contextID
-	command := a.command
-	dataBytes := a.dataBytes
-	*a = CommandAssembler{}
-	return contextID, command, dataBytes, nil
-	// TODO(saito) Verify that there's no unread items after the last command&data.
+	return 0, nil, nil, fmt.Errorf("P_DATA_TF: completed %d messages at once", len(done))
 }
 
 type MessageID = uint16
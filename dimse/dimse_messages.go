@@ -401,6 +401,10 @@ type CMoveRsp struct {
 	MessageIDBeingRespondedTo      MessageID
 	CommandDataSetType             uint16
 	NumberOfRemainingSuboperations uint16
+	// RemainingSuboperationsPresent is set if the message has
+	// NumberOfRemainingSuboperations, even zero. Set, it makes Encode send
+	// the field.
+	RemainingSuboperationsPresent  bool
 	NumberOfCompletedSuboperations uint16
 	NumberOfFailedSuboperations    uint16
 	NumberOfWarningSuboperations   uint16
@@ -414,7 +418,7 @@ func (v *CMoveRsp) Encode(e *dicom.Writer) {
 	elems = append(elems, newElement(dicomtag.AffectedSOPClassUID, v.AffectedSOPClassUID))
 	elems = append(elems, newElement(dicomtag.MessageIDBeingRespondedTo, v.MessageIDBeingRespondedTo))
 	elems = append(elems, newElement(dicomtag.CommandDataSetType, v.CommandDataSetType))
-	if v.NumberOfRemainingSuboperations != 0 {
+	if v.NumberOfRemainingSuboperations != 0 || v.RemainingSuboperationsPresent {
 		elems = append(elems, newElement(dicomtag.NumberOfRemainingSuboperations, v.NumberOfRemainingSuboperations))
 	}
 	if v.NumberOfCompletedSuboperations != 0 {
@@ -457,6 +461,7 @@ func decodeCMoveRsp(d *messageDecoder) *CMoveRsp {
 	v.MessageIDBeingRespondedTo = d.getUInt16(dicomtag.MessageIDBeingRespondedTo, requiredElement)
 	v.CommandDataSetType = d.getUInt16(dicomtag.CommandDataSetType, requiredElement)
 	v.NumberOfRemainingSuboperations = d.getUInt16(dicomtag.NumberOfRemainingSuboperations, optionalElement)
+	v.RemainingSuboperationsPresent = d.hasElement(dicomtag.NumberOfRemainingSuboperations)
 	v.NumberOfCompletedSuboperations = d.getUInt16(dicomtag.NumberOfCompletedSuboperations, optionalElement)
 	v.NumberOfFailedSuboperations = d.getUInt16(dicomtag.NumberOfFailedSuboperations, optionalElement)
 	v.NumberOfWarningSuboperations = d.getUInt16(dicomtag.NumberOfWarningSuboperations, optionalElement)
@@ -588,7 +593,6 @@ func decodeMessageForType(d *messageDecoder, commandField uint16) Message {
 	case 0x8030:
 		return decodeCEchoRsp(d)
 	default:
-		d.setError(fmt.Errorf("Unknown DIMSE command 0x%x", commandField))
-		return nil
+		return decodeNMessageForType(d, commandField)
 	}
 }
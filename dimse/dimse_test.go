@@ -2,11 +2,15 @@ package dimse_test
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
 	"testing"
 
 	dicom "github.com/antibios/dicom"
+	"github.com/antibios/dicom/pkg/tag"
 	"github.com/antibios/go-netdicom/dimse"
+	"github.com/antibios/go-netdicom/pdu"
+	"github.com/stretchr/testify/require"
 )
 
 func testDIMSE(t *testing.T, v dimse.Message) {
@@ -20,7 +24,10 @@ func testDIMSE(t *testing.T, v dimse.Message) {
 		t.Errorf("ReadDataSetInBytes %v from %v", bytes, v)
 	}
 
-	v2 := dimse.ReadMessage(d)
+	v2, err := dimse.ReadMessage(d)
+	if err != nil {
+		t.Fatalf("ReadMessage %v: %v", v, err)
+	}
 	//TODO: Check that buffer is empty
 
 	if v.String() != v2.String() {
@@ -62,6 +69,72 @@ func TestCEchoRsp(t *testing.T) {
 		nil})
 }
 
+// A zero count of remaining sub-operations is told apart from a missing one.
+func TestCMoveRspRemaining(t *testing.T) {
+	for _, present := range []bool{false, true} {
+		b := bytes.Buffer{}
+		e := dicom.NewWriter(&b, dicom.SkipVRVerification())
+		e.SetTransferSyntax(binary.LittleEndian, true)
+		dimse.EncodeMessage(e, &dimse.CMoveRsp{
+			AffectedSOPClassUID:            "1.2.3",
+			MessageIDBeingRespondedTo:      0x1234,
+			CommandDataSetType:             dimse.CommandDataSetTypeNull,
+			RemainingSuboperationsPresent:  present,
+			NumberOfCompletedSuboperations: 3,
+		})
+		data := b.Bytes()
+		d, err := dicom.ReadDataSetInBytes(&data, dicom.SkipMetadataReadOnNewParserInit())
+		require.NoError(t, err)
+		v, err := dimse.ReadMessage(d)
+		require.NoError(t, err)
+		rsp := v.(*dimse.CMoveRsp)
+		require.Equal(t, present, rsp.RemainingSuboperationsPresent)
+		require.Equal(t, uint16(0), rsp.NumberOfRemainingSuboperations)
+		require.Equal(t, uint16(3), rsp.NumberOfCompletedSuboperations)
+	}
+}
+
+func TestNMessages(t *testing.T) {
+	for _, v := range []dimse.Message{
+		&dimse.NEventReportRq{
+			AffectedSOPClassUID:    "1.2.840.10008.1.20.1",
+			MessageID:              0x1234,
+			CommandDataSetType:     dimse.CommandDataSetTypeNonNull,
+			AffectedSOPInstanceUID: "1.2.840.10008.1.20.1.1",
+			EventTypeID:            1,
+		},
+		&dimse.NEventReportRsp{
+			MessageIDBeingRespondedTo: 0x1234,
+			CommandDataSetType:        dimse.CommandDataSetTypeNull,
+			Status:                    dimse.Success,
+		},
+		&dimse.NGetRq{
+			RequestedSOPClassUID:    "1.2.3",
+			MessageID:               7,
+			CommandDataSetType:      dimse.CommandDataSetTypeNull,
+			RequestedSOPInstanceUID: "1.2.3.4",
+			AttributeIdentifierList: []tag.Tag{tag.PatientName, tag.PatientID},
+		},
+		&dimse.NGetRsp{
+			AffectedSOPClassUID:       "1.2.3",
+			MessageIDBeingRespondedTo: 7,
+			CommandDataSetType:        dimse.CommandDataSetTypeNonNull,
+			AffectedSOPInstanceUID:    "1.2.3.4",
+			Status:                    dimse.Success,
+		},
+		&dimse.NSetRq{"1.2.3", 8, dimse.CommandDataSetTypeNonNull, "1.2.3.4", nil},
+		&dimse.NSetRsp{"", 8, dimse.CommandDataSetTypeNull, "", dimse.Status{Status: dimse.StatusCode(0x0106), ErrorComment: "bad value"}, nil},
+		&dimse.NActionRq{"1.2.840.10008.1.20.1", 9, dimse.CommandDataSetTypeNonNull, "1.2.840.10008.1.20.1.1", 1, nil},
+		&dimse.NActionRsp{"1.2.840.10008.1.20.1", 9, dimse.CommandDataSetTypeNull, "1.2.840.10008.1.20.1.1", 1, dimse.Success, nil},
+		&dimse.NCreateRq{"1.2.840.10008.3.1.2.3.3", 10, dimse.CommandDataSetTypeNonNull, "", nil},
+		&dimse.NCreateRsp{"1.2.840.10008.3.1.2.3.3", 10, dimse.CommandDataSetTypeNull, "1.2.3.5", dimse.Success, nil},
+		&dimse.NDeleteRq{"1.2.3", 11, dimse.CommandDataSetTypeNull, "1.2.3.4", nil},
+		&dimse.NDeleteRsp{"", 11, dimse.CommandDataSetTypeNull, "", dimse.Success, nil},
+	} {
+		testDIMSE(t, v)
+	}
+}
+
 // This constantly fails and doesn't really test anything more that our actual tests.
 /* func FuzzCstoreRq(f *testing.F) {
 	testcases := []string{"ABC", "CAST123", "WINTE-IR-123"}
@@ -82,3 +155,263 @@ func TestCEchoRsp(t *testing.T) {
 		})
 	})
 } */
+
+func encodeCommand(v dimse.Message) []byte {
+	b := bytes.Buffer{}
+	e := dicom.NewWriter(&b, dicom.SkipVRVerification())
+	e.SetTransferSyntax(binary.LittleEndian, true)
+	dimse.EncodeMessage(e, v)
+	return b.Bytes()
+}
+
+func pdv(contextID byte, command, last bool, value []byte) pdu.PresentationDataValueItem {
+	return pdu.PresentationDataValueItem{ContextID: contextID, Command: command, Last: last, Value: value}
+}
+
+func TestCommandAssemblerInterleavedContexts(t *testing.T) {
+	store := encodeCommand(&dimse.CStoreRq{
+		AffectedSOPClassUID:    "1.2.3",
+		MessageID:              1,
+		CommandDataSetType:     int(dimse.CommandDataSetTypeNonNull),
+		AffectedSOPInstanceUID: "1.2.3.4",
+	})
+	echo := encodeCommand(&dimse.CEchoRq{MessageID: 2, CommandDataSetType: dimse.CommandDataSetTypeNull})
+
+	a := dimse.CommandAssembler{}
+	// Fragments of both messages within one PDU.
+	done, err := a.AddPDU(&pdu.PDataTf{Items: []pdu.PresentationDataValueItem{
+		pdv(1, true, false, store[:10]),
+		pdv(3, true, false, echo[:5]),
+		pdv(1, true, true, store[10:]),
+		pdv(1, false, false, []byte("ab")),
+	}})
+	require.NoError(t, err)
+	require.Empty(t, done)
+	pending := a.PendingCommands()
+	require.Len(t, pending, 1)
+	require.Equal(t, byte(1), pending[0].ContextID)
+	require.Equal(t, []byte("ab"), pending[0].Data)
+
+	// Across PDUs. The echo completes first.
+	done, err = a.AddPDU(&pdu.PDataTf{Items: []pdu.PresentationDataValueItem{
+		pdv(3, true, true, echo[5:]),
+		pdv(1, false, true, []byte("cd")),
+	}})
+	require.NoError(t, err)
+	require.Len(t, done, 2)
+	require.Equal(t, byte(3), done[0].ContextID)
+	require.Equal(t, uint16(2), done[0].Command.GetMessageID())
+	require.Nil(t, done[0].Data)
+	require.Equal(t, byte(1), done[1].ContextID)
+	require.Equal(t, uint16(1), done[1].Command.GetMessageID())
+	require.Equal(t, []byte("abcd"), done[1].Data)
+	require.Equal(t, int64(0), a.BufferedBytes())
+}
+
+// DataHash digests the data as it arrives, also when it is discarded.
+func TestCommandAssemblerDataHash(t *testing.T) {
+	store := encodeCommand(&dimse.CStoreRq{
+		AffectedSOPClassUID:    "1.2.3",
+		MessageID:              1,
+		CommandDataSetType:     int(dimse.CommandDataSetTypeNonNull),
+		AffectedSOPInstanceUID: "1.2.3.4",
+	})
+	a := dimse.CommandAssembler{DataHash: sha256.New}
+	_, err := a.AddPDU(&pdu.PDataTf{Items: []pdu.PresentationDataValueItem{
+		pdv(1, true, true, store),
+		pdv(1, false, false, []byte("ab")),
+	}})
+	require.NoError(t, err)
+	a.DiscardData(1)
+	done, err := a.AddPDU(&pdu.PDataTf{Items: []pdu.PresentationDataValueItem{
+		pdv(1, false, true, []byte("cd")),
+	}})
+	require.NoError(t, err)
+	require.Len(t, done, 1)
+	require.Nil(t, done[0].Data)
+	expected := sha256.Sum256([]byte("abcd"))
+	require.Equal(t, expected[:], done[0].Digest)
+}
+
+func TestCommandAssemblerTruncatedCommand(t *testing.T) {
+	echo := encodeCommand(&dimse.CEchoRq{MessageID: 2, CommandDataSetType: dimse.CommandDataSetTypeNull})
+	a := dimse.CommandAssembler{}
+	// Without the Last flag, the message just stays pending.
+	done, err := a.AddPDU(&pdu.PDataTf{Items: []pdu.PresentationDataValueItem{pdv(1, true, false, echo[:len(echo)-4])}})
+	require.NoError(t, err)
+	require.Empty(t, done)
+	require.Equal(t, int64(len(echo)-4), a.BufferedBytes())
+
+	// A last fragment that leaves the command short is an error.
+	a = dimse.CommandAssembler{}
+	_, err = a.AddPDU(&pdu.PDataTf{Items: []pdu.PresentationDataValueItem{pdv(1, true, true, echo[:len(echo)-4])}})
+	require.Error(t, err)
+}
+
+func TestCommandAssemblerOutOfOrderLast(t *testing.T) {
+	store := encodeCommand(&dimse.CStoreRq{
+		AffectedSOPClassUID:    "1.2.3",
+		MessageID:              1,
+		CommandDataSetType:     int(dimse.CommandDataSetTypeNonNull),
+		AffectedSOPInstanceUID: "1.2.3.4",
+	})
+	echo := encodeCommand(&dimse.CEchoRq{MessageID: 2, CommandDataSetType: dimse.CommandDataSetTypeNull})
+	for _, test := range []struct {
+		name  string
+		items []pdu.PresentationDataValueItem
+	}{
+		{"data before command", []pdu.PresentationDataValueItem{
+			pdv(1, false, true, []byte("ab")),
+		}},
+		{"data before last command fragment", []pdu.PresentationDataValueItem{
+			pdv(1, true, false, store[:10]),
+			pdv(1, false, true, []byte("ab")),
+		}},
+		{"command after last command fragment", []pdu.PresentationDataValueItem{
+			pdv(1, true, true, store),
+			pdv(1, true, true, store),
+		}},
+		{"data for command without data", []pdu.PresentationDataValueItem{
+			pdv(1, true, false, echo[:5]),
+			pdv(1, true, true, echo[5:]),
+			pdv(1, false, true, []byte("ab")),
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			a := dimse.CommandAssembler{}
+			_, err := a.AddPDU(&pdu.PDataTf{Items: test.items})
+			require.Error(t, err)
+		})
+	}
+}
+
+// Zero-length PDVs add nothing, but a dataset made only of them is an empty
+// payload, not a missing one. An empty command set is an error.
+func TestCommandAssemblerEmptyPDVs(t *testing.T) {
+	store := encodeCommand(&dimse.CStoreRq{
+		AffectedSOPClassUID:    "1.2.3",
+		MessageID:              1,
+		CommandDataSetType:     int(dimse.CommandDataSetTypeNonNull),
+		AffectedSOPInstanceUID: "1.2.3.4",
+	})
+	a := dimse.CommandAssembler{}
+	done, err := a.AddPDU(&pdu.PDataTf{Items: []pdu.PresentationDataValueItem{
+		pdv(1, true, false, store),
+		pdv(1, true, true, nil),
+		pdv(1, false, false, nil),
+		pdv(1, false, true, []byte{}),
+	}})
+	require.NoError(t, err)
+	require.Len(t, done, 1)
+	require.NotNil(t, done[0].Data)
+	require.Empty(t, done[0].Data)
+	require.Equal(t, int64(0), done[0].DataLength)
+
+	done, err = a.AddPDU(&pdu.PDataTf{Items: []pdu.PresentationDataValueItem{
+		pdv(1, true, true, store),
+		pdv(1, false, false, []byte("ab")),
+		pdv(1, false, true, nil),
+	}})
+	require.NoError(t, err)
+	require.Len(t, done, 1)
+	require.Equal(t, []byte("ab"), done[0].Data)
+
+	a = dimse.CommandAssembler{}
+	_, err = a.AddPDU(&pdu.PDataTf{Items: []pdu.PresentationDataValueItem{pdv(1, true, true, nil)}})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "empty command set")
+}
+
+// A dataset beyond 4GB, in many fragments. The data is discarded as it
+// arrives, so that the test needn't hold it.
+func TestCommandAssemblerLargeDiscardedData(t *testing.T) {
+	store := encodeCommand(&dimse.CStoreRq{
+		AffectedSOPClassUID:    "1.2.3",
+		MessageID:              1,
+		CommandDataSetType:     int(dimse.CommandDataSetTypeNonNull),
+		AffectedSOPInstanceUID: "1.2.3.4",
+	})
+	a := dimse.CommandAssembler{}
+	_, err := a.AddPDU(&pdu.PDataTf{Items: []pdu.PresentationDataValueItem{pdv(1, true, true, store)}})
+	require.NoError(t, err)
+	a.DiscardData(1)
+	fragment := make([]byte, 1<<20)
+	const numFragments = 4097 // 4GB + 1MB
+	for i := 0; i < numFragments-1; i++ {
+		done, err := a.AddPDU(&pdu.PDataTf{Items: []pdu.PresentationDataValueItem{pdv(1, false, false, fragment)}})
+		require.NoError(t, err)
+		require.Empty(t, done)
+	}
+	pending := a.PendingCommands()
+	require.Len(t, pending, 1)
+	require.Equal(t, int64(numFragments-1)<<20, pending[0].DataLength)
+	done, err := a.AddPDU(&pdu.PDataTf{Items: []pdu.PresentationDataValueItem{pdv(1, false, true, fragment)}})
+	require.NoError(t, err)
+	require.Len(t, done, 1)
+	require.Nil(t, done[0].Data)
+	require.Equal(t, int64(numFragments)<<20, done[0].DataLength)
+	require.Equal(t, int64(0), a.BufferedBytes())
+}
+
+func TestCommandAssemblerLimits(t *testing.T) {
+	echo := encodeCommand(&dimse.CEchoRq{MessageID: 2, CommandDataSetType: dimse.CommandDataSetTypeNull})
+
+	// The size is checked as fragments arrive, before the Last flag.
+	a := dimse.CommandAssembler{MaxCommandBytes: len(echo) - 1}
+	_, err := a.AddPDU(&pdu.PDataTf{Items: []pdu.PresentationDataValueItem{pdv(1, true, false, echo)}})
+	require.Error(t, err)
+
+	a = dimse.CommandAssembler{MaxCommandElements: 2}
+	_, err = a.AddPDU(&pdu.PDataTf{Items: []pdu.PresentationDataValueItem{pdv(1, true, true, echo)}})
+	require.Error(t, err)
+
+	// An element that claims to be huge.
+	huge := append([]byte{0, 0, 0, 1, 0, 0, 0, 0x20}, make([]byte, 16)...)
+	a = dimse.CommandAssembler{}
+	_, err = a.AddPDU(&pdu.PDataTf{Items: []pdu.PresentationDataValueItem{pdv(1, true, true, huge)}})
+	require.Error(t, err)
+
+	a = dimse.CommandAssembler{MaxCommandBytes: -1, MaxCommandElements: -1}
+	done, err := a.AddPDU(&pdu.PDataTf{Items: []pdu.PresentationDataValueItem{pdv(1, true, true, echo)}})
+	require.NoError(t, err)
+	require.Len(t, done, 1)
+}
+
+func TestHexDump(t *testing.T) {
+	b := encodeCommand(&dimse.CEchoRsp{MessageIDBeingRespondedTo: 0x1234, CommandDataSetType: dimse.CommandDataSetTypeNull, Status: dimse.Success})
+	dump := dimse.HexDump(b)
+	require.Contains(t, dump, "(0000,0120)")
+	require.Contains(t, dump, "value: 4660 (0x1234)")
+	require.Contains(t, dump, "value: 0x0000 (StatusSuccess)")
+	require.NotContains(t, dump, "truncated")
+
+	dump = dimse.HexDump(b[:len(b)-1])
+	require.Contains(t, dump, "truncated")
+}
+
+func TestStatusCodes(t *testing.T) {
+	require.Equal(t, dimse.StatusCategorySuccess, dimse.StatusSuccess.Category())
+	require.Equal(t, dimse.StatusCategoryPending, dimse.CFindPendingOptionalKeysNotSupported.Category())
+	require.Equal(t, dimse.StatusCategoryCancel, dimse.StatusCancel.Category())
+	require.Equal(t, dimse.StatusCategoryWarning, dimse.CStoreElementsDiscarded.Category())
+	require.Equal(t, dimse.StatusCategoryFailure, dimse.CMoveMoveDestinationUnknown.Category())
+	for _, info := range dimse.StatusCodes {
+		require.Equal(t, info.Category, info.Code.Category(), info.Name)
+	}
+
+	// A code shared by several constants prints as the first one.
+	require.Equal(t, "StatusNoSuchSOPInstance", dimse.StatusCode(0x0112).String())
+	require.Equal(t, "CStoreCoercionOfDataElements", dimse.StatusCode(0xb000).String())
+	require.Equal(t, "CFindPendingOptionalKeysNotSupported", dimse.StatusCode(0xff01).String())
+	require.Equal(t, "StatusCode(4660)", dimse.StatusCode(0x1234).String())
+
+	infos := dimse.LookupStatusCode(0xa900, "C-FIND")
+	require.Len(t, infos, 1)
+	require.Equal(t, "CFindIdentifierDoesNotMatchSOPClass", infos[0].Name)
+	require.Len(t, dimse.LookupStatusCode(0xa900, ""), 4)
+	require.Len(t, dimse.LookupStatusCode(dimse.StatusSuccess, "C-GET"), 1)
+
+	s := dimse.StatusMoveDestinationUnknown("no such AE")
+	require.Equal(t, dimse.CMoveMoveDestinationUnknown, s.Status)
+	require.Equal(t, "no such AE", s.ErrorComment)
+}
@@ -3,9 +3,15 @@
 import enum
 from typing import IO, List, NamedTuple
 
-Field = NamedTuple('Field', [('name', str),
-                             ('type', str),
-                             ('required', bool)])
+# "present", if set, names a bool field that records whether an optional
+# field was in the message, so that a zero value can be told apart from a
+# missing one. Set, it also makes Encode send the field.
+class Field(NamedTuple):
+    name: str
+    type: str
+    required: bool
+    present: str = ''
+
 class Type(enum.Enum):
     REQUEST = 1
     RESPONSE = 2
@@ -78,7 +84,7 @@ MESSAGES = [
             [Field('AffectedSOPClassUID', 'string', True),
              Field('MessageIDBeingRespondedTo', 'MessageID', True),
              Field('CommandDataSetType', 'uint16', True),
-             Field('NumberOfRemainingSuboperations', 'uint16', False),
+             Field('NumberOfRemainingSuboperations', 'uint16', False, 'RemainingSuboperationsPresent'),
              Field('NumberOfCompletedSuboperations', 'uint16', False),
              Field('NumberOfFailedSuboperations', 'uint16', False),
              Field('NumberOfWarningSuboperations', 'uint16', False),
@@ -95,30 +101,140 @@ MESSAGES = [
 	     Field('Status', 'Status', True)])
 ]
 
+# Normalized (N-) services, P3.7 10.3. Written to dimse_nmessages.go.
+N_MESSAGES = [
+    # P3.7 10.3.1
+    Message('NEventReportRq',
+            Type.REQUEST, 0x0100,
+            [Field('AffectedSOPClassUID', 'string', True),
+             Field('MessageID', 'MessageID', True),
+             Field('CommandDataSetType', 'uint16', True),
+             Field('AffectedSOPInstanceUID', 'string', True),
+             Field('EventTypeID', 'uint16', True)]),
+    Message('NEventReportRsp',
+            Type.RESPONSE, 0x8100,
+            [Field('AffectedSOPClassUID', 'string', False),
+             Field('MessageIDBeingRespondedTo', 'MessageID', True),
+             Field('CommandDataSetType', 'uint16', True),
+             Field('AffectedSOPInstanceUID', 'string', False),
+             Field('EventTypeID', 'uint16', False),
+             Field('Status', 'Status', True)]),
+    # P3.7 10.3.2
+    Message('NGetRq',
+            Type.REQUEST, 0x0110,
+            [Field('RequestedSOPClassUID', 'string', True),
+             Field('MessageID', 'MessageID', True),
+             Field('CommandDataSetType', 'uint16', True),
+             Field('RequestedSOPInstanceUID', 'string', True),
+             Field('AttributeIdentifierList', '[]dicomtag.Tag', False)]),
+    Message('NGetRsp',
+            Type.RESPONSE, 0x8110,
+            [Field('AffectedSOPClassUID', 'string', False),
+             Field('MessageIDBeingRespondedTo', 'MessageID', True),
+             Field('CommandDataSetType', 'uint16', True),
+             Field('AffectedSOPInstanceUID', 'string', False),
+             Field('Status', 'Status', True)]),
+    # P3.7 10.3.3
+    Message('NSetRq',
+            Type.REQUEST, 0x0120,
+            [Field('RequestedSOPClassUID', 'string', True),
+             Field('MessageID', 'MessageID', True),
+             Field('CommandDataSetType', 'uint16', True),
+             Field('RequestedSOPInstanceUID', 'string', True)]),
+    Message('NSetRsp',
+            Type.RESPONSE, 0x8120,
+            [Field('AffectedSOPClassUID', 'string', False),
+             Field('MessageIDBeingRespondedTo', 'MessageID', True),
+             Field('CommandDataSetType', 'uint16', True),
+             Field('AffectedSOPInstanceUID', 'string', False),
+             Field('Status', 'Status', True)]),
+    # P3.7 10.3.4
+    Message('NActionRq',
+            Type.REQUEST, 0x0130,
+            [Field('RequestedSOPClassUID', 'string', True),
+             Field('MessageID', 'MessageID', True),
+             Field('CommandDataSetType', 'uint16', True),
+             Field('RequestedSOPInstanceUID', 'string', True),
+             Field('ActionTypeID', 'uint16', True)]),
+    Message('NActionRsp',
+            Type.RESPONSE, 0x8130,
+            [Field('AffectedSOPClassUID', 'string', False),
+             Field('MessageIDBeingRespondedTo', 'MessageID', True),
+             Field('CommandDataSetType', 'uint16', True),
+             Field('AffectedSOPInstanceUID', 'string', False),
+             Field('ActionTypeID', 'uint16', False),
+             Field('Status', 'Status', True)]),
+    # P3.7 10.3.5
+    Message('NCreateRq',
+            Type.REQUEST, 0x0140,
+            [Field('AffectedSOPClassUID', 'string', True),
+             Field('MessageID', 'MessageID', True),
+             Field('CommandDataSetType', 'uint16', True),
+             Field('AffectedSOPInstanceUID', 'string', False)]),
+    Message('NCreateRsp',
+            Type.RESPONSE, 0x8140,
+            [Field('AffectedSOPClassUID', 'string', False),
+             Field('MessageIDBeingRespondedTo', 'MessageID', True),
+             Field('CommandDataSetType', 'uint16', True),
+             Field('AffectedSOPInstanceUID', 'string', False),
+             Field('Status', 'Status', True)]),
+    # P3.7 10.3.6
+    Message('NDeleteRq',
+            Type.REQUEST, 0x0150,
+            [Field('RequestedSOPClassUID', 'string', True),
+             Field('MessageID', 'MessageID', True),
+             Field('CommandDataSetType', 'uint16', True),
+             Field('RequestedSOPInstanceUID', 'string', True)]),
+    Message('NDeleteRsp',
+            Type.RESPONSE, 0x8150,
+            [Field('AffectedSOPClassUID', 'string', False),
+             Field('MessageIDBeingRespondedTo', 'MessageID', True),
+             Field('CommandDataSetType', 'uint16', True),
+             Field('AffectedSOPInstanceUID', 'string', False),
+             Field('Status', 'Status', True)]),
+]
+
+# Go expression that encodes field "f" of "v" as a dicom.Value.
+def encode_value(f: Field) -> str:
+    if f.type == 'string':
+        return f'[]string{{v.{f.name}}}'
+    if f.type == '[]dicomtag.Tag':
+        return f'tagsValue(v.{f.name})'
+    return f'[]int{{int(v.{f.name})}}'
+
 def generate_go_definition(m: Message, out: IO[str]):
     print(f'type {m.name} struct {{', file=out)
     for f in m.fields:
         print(f'	{f.name} {f.type}', file=out)
+        if f.present:
+            print(f'	// {f.present} is set if the message has', file=out)
+            print(f'	// {f.name}, even zero. Set, it makes Encode send', file=out)
+            print(f'	// the field.', file=out)
+            print(f'	{f.present} bool', file=out)
     print(f'	Extra []*dicom.Element  // Unparsed elements', file=out)
     print('}', file=out)
 
     print('', file=out)
-    print(f'func (v *{m.name}) Encode(e *dicomio.Writer) {{', file=out)
-    print('    elems := []*dicom.Element{}', file=out)
-    print(f'	elems = append(elems, newElement(dicomtag.CommandField, uint16({m.command_field})))', file=out)
+    print(f'func (v *{m.name}) Encode(e *dicom.Writer) {{', file=out)
+    print('	elems := []*dicom.Element{}', file=out)
+    print(f'	elems = append(elems, newElement(dicomtag.CommandField, []int{{{m.command_field}}}))', file=out)
     for f in m.fields:
         if not f.required:
             if f.type == 'string':
-                zero = '""'
+                cond = f'v.{f.name} != ""'
+            elif f.type.startswith('[]'):
+                cond = f'len(v.{f.name}) > 0'
             else:
-                zero = '0'
-            print(f'	if v.{f.name} != {zero} {{', file=out)
-            print(f'		elems = append(elems, newElement(dicomtag.{f.name}, v.{f.name}))', file=out)
+                cond = f'v.{f.name} != 0'
+            if f.present:
+                cond += f' || v.{f.present}'
+            print(f'	if {cond} {{', file=out)
+            print(f'		elems = append(elems, newElement(dicomtag.{f.name}, {encode_value(f)}))', file=out)
             print(f'	}}', file=out)
         elif f.type == 'Status':
             print(f'	elems = append(elems, newStatusElements(v.{f.name})...)', file=out)
         else:
-            print(f'	elems = append(elems, newElement(dicomtag.{f.name}, v.{f.name}))', file=out)
+            print(f'	elems = append(elems, newElement(dicomtag.{f.name}, {encode_value(f)}))', file=out)
     print('	elems = append(elems, v.Extra...)', file=out)
     print('	encodeElements(e, elems)', file=out)
     print('}', file=out)
@@ -180,6 +296,8 @@ def generate_go_definition(m: Message, out: IO[str]):
                 decoder = 'UInt16'
             elif f.type == 'uint32':
                 decoder = 'UInt32'
+            elif f.type == '[]dicomtag.Tag':
+                decoder = 'Tags'
             else:
                 raise Exception(f)
             if f.required:
@@ -187,12 +305,25 @@ def generate_go_definition(m: Message, out: IO[str]):
             else:
                 required = 'optionalElement'
             print(f'	v.{f.name} = d.get{decoder}(dicomtag.{f.name}, {required})', file=out)
+            if f.present:
+                print(f'	v.{f.present} = d.hasElement(dicomtag.{f.name})', file=out)
     print(f'	v.Extra = d.unparsedElements()', file=out)
     print(f'	return v', file=out)
     print('}', file=out)
 
-def main():
-    with open('dimse_messages.go', 'w') as out:
+def generate_decoder(name: str, messages: List[Message], default: str, out: IO[str]):
+    print(f'func {name}(d *messageDecoder, commandField uint16) Message {{', file=out)
+    print('	switch commandField {', file=out)
+    for m in messages:
+        print('	case 0x%x:' % (m.command_field, ), file=out)
+        print(f'		return decode{m.name}(d)', file=out)
+    print('	default:', file=out)
+    print(f'		{default}', file=out)
+    print('	}', file=out)
+    print('}', file=out)
+
+def generate_file(path: str, messages: List[Message], decoder: str, default: str):
+    with open(path, 'w') as out:
         print("""
 package dimse
 
@@ -202,26 +333,22 @@ import (
 	"fmt"
 
 	"github.com/antibios/dicom"
-	"github.com/antibios/dicom/pkg/dicomio"
 	dicomtag "github.com/antibios/dicom/pkg/tag"
 )
 
         """, file=out)
-        for m in MESSAGES:
+        for m in messages:
             generate_go_definition(m, out)
 
-        for m in MESSAGES:
+        for m in messages:
             print(f'const CommandField{m.name} = {m.command_field}', file=out)
 
-        print('func decodeMessageForType(d* messageDecoder, commandField uint16) Message {', file=out)
-        print('	switch commandField {', file=out)
-        for m in MESSAGES:
-            print('	case 0x%x:' % (m.command_field, ), file=out)
-            print(f'		return decode{m.name}(d)', file=out)
-        print('	default:', file=out)
-        print('		d.setError(fmt.Errorf("Unknown DIMSE command 0x%x", commandField))', file=out)
-        print('		return nil', file=out)
-        print('	}', file=out)
-        print('}', file=out)
+        generate_decoder(decoder, messages, default, out)
+
+def main():
+    generate_file('dimse_messages.go', MESSAGES, 'decodeMessageForType',
+                  'return decodeNMessageForType(d, commandField)')
+    generate_file('dimse_nmessages.go', N_MESSAGES, 'decodeNMessageForType',
+                  'd.setError(fmt.Errorf("Unknown DIMSE command 0x%x", commandField))\n\t\treturn nil')
 
 main()
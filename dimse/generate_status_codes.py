@@ -0,0 +1,127 @@
+#!/usr/bin/env python3
+
+# Generates status_codes.go: the StatusCode constants, and the table that
+# describes them, from the lists in P3.7 Annex C and the service definitions
+# of P3.4.
+
+import subprocess
+from typing import IO, List, NamedTuple
+
+Code = NamedTuple('Code', [('name', str),
+                           ('code', int),
+                           ('category', str),
+                           ('services', List[str]),
+                           ('meaning', str),
+                           ('comment', str)])
+
+def code(name, value, category, services, meaning, comment=''):
+    return Code(name, value, category, services, meaning, comment)
+
+SUCCESS = 'StatusCategorySuccess'
+PENDING = 'StatusCategoryPending'
+CANCEL = 'StatusCategoryCancel'
+WARNING = 'StatusCategoryWarning'
+FAILURE = 'StatusCategoryFailure'
+
+ALL = []  # Applies to every service.
+
+CODES = [
+    # P3.7 C.1 and C.5: general statuses.
+    code('StatusSuccess', 0x0000, SUCCESS, ALL, 'Success'),
+    code('StatusCancel', 0xfe00, CANCEL, ALL, 'Terminated due to a Cancel request'),
+    code('StatusPending', 0xff00, PENDING, ALL, 'Pending'),
+    code('StatusAttributeListError', 0x0107, WARNING, ALL, 'Attribute list error'),
+    code('StatusAttributeValueOutOfRange', 0x0116, WARNING, ALL, 'Attribute value out of range'),
+    code('StatusNoSuchAttribute', 0x0105, FAILURE, ALL, 'No such attribute'),
+    code('StatusInvalidAttributeValue', 0x0106, FAILURE, ALL, 'Invalid attribute value'),
+    code('StatusProcessingFailure', 0x0110, FAILURE, ALL, 'Processing failure'),
+    code('StatusDuplicateSOPInstance', 0x0111, FAILURE, ALL, 'Duplicate SOP instance'),
+    code('StatusNoSuchSOPInstance', 0x0112, FAILURE, ALL, 'No such SOP instance'),
+    code('StatusSOPClassNotSupported', 0x0112, FAILURE, ALL, 'No such SOP instance',
+         'Deprecated: 0x0112 is No such SOP instance. Use StatusNoSuchSOPInstance, or\n'
+         '// StatusRefusedSOPClassNotSupported for 0x0122.'),
+    code('StatusNoSuchEventType', 0x0113, FAILURE, ALL, 'No such event type'),
+    code('StatusNoSuchArgument', 0x0114, FAILURE, ALL, 'No such argument'),
+    code('StatusInvalidArgumentValue', 0x0115, FAILURE, ALL, 'Invalid argument value'),
+    code('StatusInvalidObjectInstance', 0x0117, FAILURE, ALL, 'Invalid object instance'),
+    code('StatusNoSuchSOPClass', 0x0118, FAILURE, ALL, 'No such SOP class'),
+    code('StatusClassInstanceConflict', 0x0119, FAILURE, ALL, 'Class-instance conflict'),
+    code('StatusMissingAttribute', 0x0120, FAILURE, ALL, 'Missing attribute'),
+    code('StatusMissingAttributeValue', 0x0121, FAILURE, ALL, 'Missing attribute value'),
+    code('StatusRefusedSOPClassNotSupported', 0x0122, FAILURE, ALL, 'Refused: SOP class not supported'),
+    code('StatusNoSuchAction', 0x0123, FAILURE, ALL, 'No such action'),
+    code('StatusNotAuthorized', 0x0124, FAILURE, ALL, 'Refused: not authorized'),
+    code('StatusDuplicateInvocation', 0x0210, FAILURE, ALL, 'Duplicate invocation'),
+    code('StatusUnrecognizedOperation', 0x0211, FAILURE, ALL, 'Unrecognized operation'),
+    code('StatusMistypedArgument', 0x0212, FAILURE, ALL, 'Mistyped argument'),
+    code('StatusResourceLimitation', 0x0213, FAILURE, ALL, 'Resource limitation'),
+
+    # P3.4 GG.4.2: C-STORE.
+    code('CStoreRefusedSOPClassNotSupported', 0x0122, FAILURE, ['C-STORE'], 'Refused: SOP class not supported'),
+    code('CStoreOutOfResources', 0xa700, FAILURE, ['C-STORE'], 'Refused: out of resources'),
+    code('CStoreDataSetDoesNotMatchSOPClass', 0xa900, FAILURE, ['C-STORE'], 'Error: data set does not match SOP class'),
+    code('CStoreCannotUnderstand', 0xc000, FAILURE, ['C-STORE'], 'Error: cannot understand'),
+    code('CStoreCoercionOfDataElements', 0xb000, WARNING, ['C-STORE'], 'Coercion of data elements'),
+    code('CStoreElementsDiscarded', 0xb006, WARNING, ['C-STORE'], 'Elements discarded'),
+    code('CStoreDataSetDoesNotMatchSOPClassWarning', 0xb007, WARNING, ['C-STORE'], 'Data set does not match SOP class'),
+
+    # P3.4 C.4.1.1.4: C-FIND.
+    code('CFindOutOfResources', 0xa700, FAILURE, ['C-FIND'], 'Refused: out of resources'),
+    code('CFindIdentifierDoesNotMatchSOPClass', 0xa900, FAILURE, ['C-FIND'], 'Identifier does not match SOP class'),
+    code('CFindUnableToProcess', 0xc000, FAILURE, ['C-FIND'], 'Unable to process'),
+    code('CFindPendingOptionalKeysNotSupported', 0xff01, PENDING, ['C-FIND'],
+         'Pending: optional keys not supported'),
+
+    # P3.4 C.4.2.1.5: C-MOVE.
+    code('CMoveOutOfResourcesUnableToCalculateNumberOfMatches', 0xa701, FAILURE, ['C-MOVE'],
+         'Refused: out of resources, unable to calculate number of matches'),
+    code('CMoveOutOfResourcesUnableToPerformSubOperations', 0xa702, FAILURE, ['C-MOVE'],
+         'Refused: out of resources, unable to perform sub-operations'),
+    code('CMoveMoveDestinationUnknown', 0xa801, FAILURE, ['C-MOVE'], 'Refused: move destination unknown'),
+    code('CMoveDataSetDoesNotMatchSOPClass', 0xa900, FAILURE, ['C-MOVE'], 'Identifier does not match SOP class'),
+    code('CMoveUnableToProcess', 0xc000, FAILURE, ['C-MOVE'], 'Unable to process'),
+    code('CMoveSubOperationsFailed', 0xb000, WARNING, ['C-MOVE'],
+         'Sub-operations complete, one or more failures'),
+
+    # P3.4 C.4.3.1.4: C-GET.
+    code('CGetOutOfResourcesUnableToCalculateNumberOfMatches', 0xa701, FAILURE, ['C-GET'],
+         'Refused: out of resources, unable to calculate number of matches'),
+    code('CGetOutOfResourcesUnableToPerformSubOperations', 0xa702, FAILURE, ['C-GET'],
+         'Refused: out of resources, unable to perform sub-operations'),
+    code('CGetIdentifierDoesNotMatchSOPClass', 0xa900, FAILURE, ['C-GET'], 'Identifier does not match SOP class'),
+    code('CGetUnableToProcess', 0xc000, FAILURE, ['C-GET'], 'Unable to process'),
+    code('CGetSubOperationsFailed', 0xb000, WARNING, ['C-GET'],
+         'Sub-operations complete, one or more failures'),
+]
+
+def generate(out: IO[str]):
+    print('package dimse', file=out)
+    print('', file=out)
+    print('// Code generated from generate_status_codes.py. DO NOT EDIT.', file=out)
+    print('', file=out)
+    print('const (', file=out)
+    for c in CODES:
+        if c.comment:
+            print(f'\t// {c.comment}', file=out)
+        print(f'\t{c.name} StatusCode = 0x{c.code:04x} // {c.meaning}', file=out)
+    print(')', file=out)
+    print('', file=out)
+    print('// StatusCodes describes the status codes of P3.7 Annex C, and those of the', file=out)
+    print('// C-STORE, C-FIND, C-MOVE and C-GET services of P3.4. A code may appear more', file=out)
+    print('// than once, with a different meaning for each service.', file=out)
+    print('var StatusCodes = []StatusCodeInfo{', file=out)
+    for c in CODES:
+        if c.comment:
+            continue
+        services = 'nil'
+        if c.services:
+            services = '[]string{' + ', '.join(f'"{s}"' for s in c.services) + '}'
+        print(f'\t{{Code: {c.name}, Name: "{c.name}", Category: {c.category}, Services: {services}, Meaning: "{c.meaning}"}},', file=out)
+    print('}', file=out)
+
+def main():
+    with open('status_codes.go', 'w') as out:
+        generate(out)
+    subprocess.check_call(['gofmt', '-w', 'status_codes.go'])
+
+main()
@@ -0,0 +1,87 @@
+package dimse
+
+// Annotated hex dumps of encoded command sets, for debugging interoperability
+// problems.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	dicomtag "github.com/antibios/dicom/pkg/tag"
+)
+
+// Number of bytes per line of a hex dump.
+const hexDumpWidth = 8
+
+// HexDump returns an annotated hex dump of a command set, encoded in implicit
+// VR little endian as by EncodeMessage. Each element is shown as its tag,
+// name and length, followed by its value, e.g.,
+//
+//	000008  00 00 00 01 02 00 00 00  (0000,0100) CommandField, length 2
+//	000010  01 00                      value: 1 (0x0001)
+//
+// The command set needn't be valid: the dump stops annotating at the first
+// element that overruns the data, and dumps the remaining bytes as is.
+func HexDump(data []byte) string {
+	var buf strings.Builder
+	emit := func(off int, b []byte, note string) {
+		for i := 0; i == 0 || i < len(b); i += hexDumpWidth {
+			end := i + hexDumpWidth
+			if end > len(b) {
+				end = len(b)
+			}
+			hex := make([]string, 0, hexDumpWidth)
+			for _, c := range b[i:end] {
+				hex = append(hex, fmt.Sprintf("%02x", c))
+			}
+			fmt.Fprintf(&buf, "%06x  %-*s  %s\n", off+i, 3*hexDumpWidth-1, strings.Join(hex, " "), note)
+			note = ""
+		}
+	}
+	off := 0
+	for off < len(data) {
+		if len(data)-off < 8 {
+			emit(off, data[off:], "truncated element header")
+			break
+		}
+		tag := dicomtag.Tag{
+			Group:   binary.LittleEndian.Uint16(data[off:]),
+			Element: binary.LittleEndian.Uint16(data[off+2:]),
+		}
+		length := binary.LittleEndian.Uint32(data[off+4:])
+		name, vr := "unknown", ""
+		if info, err := dicomtag.Find(tag); err == nil {
+			name, vr = info.Name, info.VR
+		}
+		emit(off, data[off:off+8], fmt.Sprintf("(%04x,%04x) %s, length %d", tag.Group, tag.Element, name, length))
+		off += 8
+		if uint64(length) > uint64(len(data)-off) {
+			emit(off, data[off:], fmt.Sprintf("  truncated: expected %d bytes", length))
+			break
+		}
+		value := data[off : off+int(length)]
+		emit(off, value, "  value: "+describeCommandValue(tag, vr, value))
+		off += int(length)
+	}
+	return buf.String()
+}
+
+// Describe the value of a command element.
+func describeCommandValue(tag dicomtag.Tag, vr string, b []byte) string {
+	switch {
+	case vr == "US" && len(b) == 2:
+		v := binary.LittleEndian.Uint16(b)
+		if tag == dicomtag.Status {
+			return fmt.Sprintf("0x%04x (%v)", v, StatusCode(v))
+		}
+		return fmt.Sprintf("%d (0x%04x)", v, v)
+	case vr == "UL" && len(b) == 4:
+		return fmt.Sprintf("%d", binary.LittleEndian.Uint32(b))
+	case vr == "AT" && len(b) == 4:
+		return fmt.Sprintf("(%04x,%04x)", binary.LittleEndian.Uint16(b), binary.LittleEndian.Uint16(b[2:]))
+	case vr == "" || vr == "OB" || vr == "OW" || vr == "UN" || vr == "SQ":
+		return fmt.Sprintf("%d bytes", len(b))
+	}
+	return fmt.Sprintf("%q", string(b))
+}
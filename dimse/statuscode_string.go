@@ -4,26 +4,44 @@ package dimse
 
 import "fmt"
 
-const _StatusCode_name = "StatusSuccessStatusInvalidAttributeValueStatusAttributeListErrorStatusSOPClassNotSupportedStatusInvalidArgumentValueStatusAttributeValueOutOfRangeStatusInvalidObjectInstanceStatusNotAuthorizedStatusUnrecognizedOperationCStoreOutOfResourcesCMoveOutOfResourcesUnableToCalculateNumberOfMatchesCMoveOutOfResourcesUnableToPerformSubOperationsCMoveMoveDestinationUnknownCStoreDataSetDoesNotMatchSOPClassCStoreCannotUnderstandStatusCancelStatusPending"
+const _StatusCode_name = "StatusSuccessStatusNoSuchAttributeStatusInvalidAttributeValueStatusAttributeListErrorStatusProcessingFailureStatusDuplicateSOPInstanceStatusNoSuchSOPInstanceStatusNoSuchEventTypeStatusNoSuchArgumentStatusInvalidArgumentValueStatusAttributeValueOutOfRangeStatusInvalidObjectInstanceStatusNoSuchSOPClassStatusClassInstanceConflictStatusMissingAttributeStatusMissingAttributeValueStatusRefusedSOPClassNotSupportedStatusNoSuchActionStatusNotAuthorizedStatusDuplicateInvocationStatusUnrecognizedOperationStatusMistypedArgumentStatusResourceLimitationCStoreOutOfResourcesCMoveOutOfResourcesUnableToCalculateNumberOfMatchesCMoveOutOfResourcesUnableToPerformSubOperationsCMoveMoveDestinationUnknownCStoreDataSetDoesNotMatchSOPClassCStoreCoercionOfDataElementsCStoreElementsDiscardedCStoreDataSetDoesNotMatchSOPClassWarningCStoreCannotUnderstandStatusCancelStatusPendingCFindPendingOptionalKeysNotSupported"
 
 var _StatusCode_map = map[StatusCode]string{
 	0:     _StatusCode_name[0:13],
-	262:   _StatusCode_name[13:40],
-	263:   _StatusCode_name[40:64],
-	274:   _StatusCode_name[64:90],
-	277:   _StatusCode_name[90:116],
-	278:   _StatusCode_name[116:146],
-	279:   _StatusCode_name[146:173],
-	292:   _StatusCode_name[173:192],
-	529:   _StatusCode_name[192:219],
-	42752: _StatusCode_name[219:239],
-	42753: _StatusCode_name[239:290],
-	42754: _StatusCode_name[290:337],
-	43009: _StatusCode_name[337:364],
-	43264: _StatusCode_name[364:397],
-	49152: _StatusCode_name[397:419],
-	65024: _StatusCode_name[419:431],
-	65280: _StatusCode_name[431:444],
+	261:   _StatusCode_name[13:34],
+	262:   _StatusCode_name[34:61],
+	263:   _StatusCode_name[61:85],
+	272:   _StatusCode_name[85:108],
+	273:   _StatusCode_name[108:134],
+	274:   _StatusCode_name[134:157],
+	275:   _StatusCode_name[157:178],
+	276:   _StatusCode_name[178:198],
+	277:   _StatusCode_name[198:224],
+	278:   _StatusCode_name[224:254],
+	279:   _StatusCode_name[254:281],
+	280:   _StatusCode_name[281:301],
+	281:   _StatusCode_name[301:328],
+	288:   _StatusCode_name[328:350],
+	289:   _StatusCode_name[350:377],
+	290:   _StatusCode_name[377:410],
+	291:   _StatusCode_name[410:428],
+	292:   _StatusCode_name[428:447],
+	528:   _StatusCode_name[447:472],
+	529:   _StatusCode_name[472:499],
+	530:   _StatusCode_name[499:521],
+	531:   _StatusCode_name[521:545],
+	42752: _StatusCode_name[545:565],
+	42753: _StatusCode_name[565:616],
+	42754: _StatusCode_name[616:663],
+	43009: _StatusCode_name[663:690],
+	43264: _StatusCode_name[690:723],
+	45056: _StatusCode_name[723:751],
+	45062: _StatusCode_name[751:774],
+	45063: _StatusCode_name[774:814],
+	49152: _StatusCode_name[814:836],
+	65024: _StatusCode_name[836:848],
+	65280: _StatusCode_name[848:861],
+	65281: _StatusCode_name[861:897],
 }
 
 func (i StatusCode) String() string {
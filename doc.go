@@ -2,6 +2,7 @@
 Package netdicom implements the DICOM network protocol.
 
 This package exports two main classes: ServiceUser for implementing DICOM
-clients, and ServiceProvider for implementing DICOM servers.
+clients, and ServiceProvider for implementing DICOM servers. Tools that work
+below DIMSE can exchange raw PDUs through ULConn.
 */
 package netdicom
@@ -3,11 +3,20 @@ package netdicom
 import (
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/binary"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"math/big"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -22,6 +31,7 @@ import (
 	"github.com/antibios/dicom/pkg/tag"
 	"github.com/antibios/dicom/pkg/uid"
 	"github.com/antibios/go-netdicom/dimse"
+	"github.com/antibios/go-netdicom/pdu"
 	"github.com/antibios/go-netdicom/sopclass"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -68,20 +78,6 @@ func onCStoreRequest(
 		uid.UIDString(sopClassUID),
 		uid.UIDString(sopInstanceUID))
 
-	/* e := dicomio.NewBytesEncoder(nil, dicomio.UnknownVR)
-	dicom.WriteFileHeader(e, */
-	b := bytes.Buffer{}
-	e := dicom.NewWriter(&b, dicom.SkipVRVerification())
-	e.SetTransferSyntax(binary.LittleEndian, true)
-
-	for _, elem := range []*dicom.Element{
-		dicom.MustNewElement(tag.TransferSyntaxUID, transferSyntaxUID),
-		dicom.MustNewElement(tag.MediaStorageSOPClassUID, sopClassUID),
-		dicom.MustNewElement(tag.MediaStorageSOPInstanceUID, sopInstanceUID),
-	} {
-		e.WriteElement(elem)
-	}
-	e.WriteBytes(data)
 	cstoreData = data
 	log.Printf("Received C-STORE request, %d bytes", len(cstoreData))
 	return cstoreStatus
@@ -178,18 +174,8 @@ func checkFileBodiesEqual(t *testing.T, in, out *dicom.Dataset) {
 		return s
 	} */
 
-	var removeMetaElems = func(f *dicom.Dataset) []*dicom.Element {
-		var elems []*dicom.Element
-		for _, elem := range f.Elements {
-			if elem.Tag.Group != tag.MetadataGroup {
-				elems = append(elems, elem)
-			}
-		}
-		return elems
-	}
-
-	inElems := removeMetaElems(in)
-	outElems := removeMetaElems(out)
+	inElems := StripFileMetaElements(in.Elements)
+	outElems := StripFileMetaElements(out.Elements)
 	assert.Equal(t, len(inElems), len(outElems))
 	for i := 0; i < len(inElems); i++ {
 		/* 		ins := normalize(inElems[i].String())
@@ -251,6 +237,48 @@ func TestStore(t *testing.T) {
 	checkFileBodiesEqual(t, dataset, out)
 }
 
+// A dataset sent as a DatasetSource arrives as one, and can be relayed as is.
+func TestCStoreDataset(t *testing.T) {
+	received := make(chan *RawDataset, 2)
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		CStoreDataset: func(conn ConnectionState, ds DatasetSource) dimse.Status {
+			raw := ds.(*RawDataset)
+			received <- NewRawDataset(raw.SOPClassUID(), raw.SOPInstanceUID(), raw.TransferSyntaxUID(),
+				append([]byte(nil), raw.Bytes()...))
+			return dimse.Success
+		},
+	}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+
+	src, err := NewDicomDatasetSource(mustReadDICOMFile("testdata/IM-0001-0003.dcm"))
+	require.NoError(t, err)
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.StorageClasses})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	require.NoError(t, su.CStoreDataset(src))
+	ds := <-received
+	require.Equal(t, src.SOPInstanceUID(), ds.SOPInstanceUID())
+	require.Equal(t, src.TransferSyntaxUID(), ds.TransferSyntaxUID())
+	var want bytes.Buffer
+	_, err = src.WriteTo(&want)
+	require.NoError(t, err)
+	require.Equal(t, want.Bytes(), ds.Bytes())
+
+	var sopInstanceUID string
+	require.NoError(t, RawElements(ds, func(e RawElement) error {
+		if e.Tag == tag.SOPInstanceUID {
+			sopInstanceUID = strings.TrimRight(string(e.Value), "\x00 ")
+		}
+		return nil
+	}))
+	require.Equal(t, src.SOPInstanceUID(), sopInstanceUID)
+
+	require.NoError(t, su.CStoreDataset(ds))
+	require.Equal(t, ds.Bytes(), (<-received).Bytes())
+}
+
 // Arrange so that the cstore server returns an error. The client should detect
 // that.
 func TestStoreFailure0(t *testing.T) {
@@ -378,19 +406,171 @@ func (fi *testFaultInjector) onSend(data []byte) faultInjectorAction {
 	return faultInjectorContinue
 }
 
+func (fi *testFaultInjector) afterSend(data []byte) [][]byte {
+	return nil
+}
+
 func (fi *testFaultInjector) String() string {
 	return "testFaultInjector"
 }
 
+// Injects DIMSE messages on context 1 right after the first A-ASSOCIATE-AC.
+type messageInjector struct {
+	msgs []dimse.Message
+
+	mu       sync.Mutex
+	injected bool
+}
+
+func (fi *messageInjector) onStateTransition(oldState stateType, event *stateEvent, action *stateAction, newState stateType) {
+}
+
+func (fi *messageInjector) onSend(data []byte) faultInjectorAction {
+	return faultInjectorContinue
+}
+
+func (fi *messageInjector) afterSend(data []byte) [][]byte {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	if fi.injected || pdu.Type(data[0]) != pdu.TypeAAssociateAc {
+		return nil
+	}
+	fi.injected = true
+	var pdus [][]byte
+	for _, msg := range fi.msgs {
+		b := bytes.Buffer{}
+		e := dicom.NewWriter(&b, dicom.SkipVRVerification())
+		e.SetTransferSyntax(binary.LittleEndian, true)
+		dimse.EncodeMessage(e, msg)
+		data, err := pdu.EncodePDU(&pdu.PDataTf{Items: []pdu.PresentationDataValueItem{
+			{ContextID: 1, Command: true, Last: true, Value: b.Bytes()},
+		}})
+		if err != nil {
+			panic(err)
+		}
+		pdus = append(pdus, data)
+	}
+	return pdus
+}
+
+func (fi *messageInjector) String() string {
+	return "messageInjector"
+}
+
+// A response for an unknown message ID and an unsolicited C-STORE are
+// tolerated by default.
+func TestUnexpectedMessagesTolerated(t *testing.T) {
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		CEcho: onCEchoRequest,
+		FaultInjector: &messageInjector{msgs: []dimse.Message{
+			&dimse.CEchoRsp{
+				MessageIDBeingRespondedTo: 998,
+				CommandDataSetType:        dimse.CommandDataSetTypeNull,
+				Status:                    dimse.Success,
+			},
+			&dimse.CStoreRq{
+				AffectedSOPClassUID:    uid.VerificationSOPClass,
+				MessageID:              999,
+				CommandDataSetType:     int(dimse.CommandDataSetTypeNull),
+				AffectedSOPInstanceUID: "1.2.3",
+			},
+		}},
+	}, ":0")
+	require.NoError(t, err)
+	go sp.Run()
+
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.VerificationClasses})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	require.NoError(t, su.CEcho())
+	// The user answers the C-STORE with "unrecognized operation", and the
+	// provider, which sent no such request, counts the answer.
+	require.Eventually(t, func() bool {
+		return sp.Health().UnexpectedMessages == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, su.CEcho())
+}
+
+func TestUnexpectedMessageAborts(t *testing.T) {
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		CEcho: onCEchoRequest,
+		FaultInjector: &messageInjector{msgs: []dimse.Message{
+			&dimse.CEchoRsp{
+				MessageIDBeingRespondedTo: 998,
+				CommandDataSetType:        dimse.CommandDataSetTypeNull,
+				Status:                    dimse.Success,
+			},
+		}},
+	}, ":0")
+	require.NoError(t, err)
+	go sp.Run()
+
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:               sopclass.VerificationClasses,
+		AbortOnUnexpectedMessage: true,
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	require.Error(t, su.CEcho())
+}
+
+// Collects the messages passed to a Logger.
+type testLogger struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (l *testLogger) logf(level int, format string, args ...interface{}) {
+	l.mu.Lock()
+	l.msgs = append(l.msgs, fmt.Sprintf(format, args...))
+	l.mu.Unlock()
+}
+
+func (l *testLogger) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return strings.Join(l.msgs, "\n")
+}
+
+// Each ServiceUser and ServiceProvider logs to its own Logger.
+func TestLogger(t *testing.T) {
+	var userLog, providerLog testLogger
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		CEcho:  onCEchoRequest,
+		Logger: providerLog.logf,
+	}, ":0")
+	require.NoError(t, err)
+	go sp.Run()
+
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses: sopclass.VerificationClasses,
+		Logger:     userLog.logf,
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	require.NoError(t, su.CEcho())
+
+	require.Contains(t, userLog.String(), "Received associate response")
+	require.NotContains(t, userLog.String(), "Received associate request")
+	require.Contains(t, providerLog.String(), "Received associate request")
+	require.Contains(t, providerLog.String(), "Received E-ECHO")
+	require.NotContains(t, providerLog.String(), "Received associate response")
+}
+
 // Similar to the previous test, but inject a network failure during send.
 func TestStoreFailure1(t *testing.T) {
 	dataset := mustReadDICOMFile("testdata/IM-0001-0003.dcm")
-	SetUserFaultInjector(&testFaultInjector{})
-	defer SetUserFaultInjector(nil)
-
-	su := mustNewServiceUser(t, sopclass.StorageClasses)
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:    sopclass.StorageClasses,
+		FaultInjector: &testFaultInjector{},
+	})
+	require.NoError(t, err)
+	su.Connect(provider.ListenAddr().String())
 	defer su.Release()
-	err := su.CStore(dataset)
+	err = su.CStore(dataset)
 	if err == nil || strings.Index(err.Error(), "Connection failed") < 0 {
 		log.Panic(err)
 	}
@@ -434,6 +614,44 @@ func TestFind(t *testing.T) {
 	}
 }
 
+func TestFindBatchedAndCapped(t *testing.T) {
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		CFind: func(conn ConnectionState, transferSyntaxUID, sopClassUID string, filters []*dicom.Element, ch chan CFindResult) {
+			for i := 0; i < 20; i++ {
+				ch <- CFindResult{Elements: []*dicom.Element{dicom.MustNewElement(tag.PatientName, fmt.Sprintf("patient%02d", i))}}
+			}
+			close(ch)
+		},
+		CFindBatchSize:        8,
+		CFindBatchDelay:       time.Millisecond,
+		CFindMaxResults:       15,
+		CFindMaxResultsStatus: dimse.Status{Status: dimse.CFindOutOfResources, ErrorComment: "too many matches"},
+	}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.QRFindClasses})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	var names []string
+	var errs []error
+	for result := range su.CFind(QRLevelPatient, []*dicom.Element{dicom.MustNewElement(tag.PatientName, "*")}) {
+		if result.Err != nil {
+			errs = append(errs, result.Err)
+			continue
+		}
+		for _, elem := range result.Elements {
+			names = append(names, elem.Value.GetValue().(string))
+		}
+	}
+	require.Len(t, names, 15)
+	require.Equal(t, "patient00", names[0])
+	require.Equal(t, "patient14", names[14])
+	require.Len(t, errs, 1)
+	require.Contains(t, errs[0].Error(), "too many matches")
+}
+
 func TestCGet(t *testing.T) {
 	su := mustNewServiceUser(t, sopclass.QRGetClasses)
 	defer su.Release()
@@ -447,18 +665,8 @@ func TestCGet(t *testing.T) {
 		func(transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) dimse.Status {
 			log.Printf("Got data: %v %v %v %d bytes", transferSyntaxUID, sopClassUID, sopInstanceUID, len(data))
 			require.True(t, len(cgetData) == 0, "Received multiple C-GET responses")
-			/* e := dicomio.NewBytesEncoder(nil, dicomio.UnknownVR)
-			dicom.WriteFileHeader(e, */
 			b := bytes.Buffer{}
-			e := dicom.NewWriter(&b, dicom.SkipVRVerification())
-			for _, elem := range []*dicom.Element{
-				dicom.MustNewElement(tag.TransferSyntaxUID, transferSyntaxUID),
-				dicom.MustNewElement(tag.MediaStorageSOPClassUID, sopClassUID),
-				dicom.MustNewElement(tag.MediaStorageSOPInstanceUID, sopInstanceUID),
-			} {
-				e.WriteElement(elem)
-			}
-			//e.WriteBytes(data)
+			require.NoError(t, WritePart10(&b, transferSyntaxUID, sopClassUID, sopInstanceUID, "", data))
 			cgetData = b.Bytes()
 			return dimse.Success
 		})
@@ -470,6 +678,100 @@ func TestCGet(t *testing.T) {
 	checkFileBodiesEqual(t, expected, &ds)
 }
 
+func TestCMove(t *testing.T) {
+	stored := make(chan string, 10)
+	dest, err := NewServiceProvider(ServiceProviderParams{
+		CStore: func(conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID, calledAE, callingAE string, data []byte) dimse.Status {
+			stored <- sopInstanceUID
+			return dimse.Success
+		},
+	}, "localhost:0")
+	require.NoError(t, err)
+	go dest.Run()
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		AETitle:   "ARCHIVE",
+		RemoteAEs: map[string]string{"WORKSTATION": dest.ListenAddr().String()},
+		CMove: func(conn ConnectionState, transferSyntaxUID, sopClassUID string, filters []*dicom.Element, ch chan CMoveResult) {
+			path := "testdata/reportsi.dcm"
+			for i := 2; i >= 1; i-- {
+				ch <- CMoveResult{Remaining: i, Path: path, DataSet: mustReadDICOMFile(path)}
+			}
+			close(ch)
+		},
+	}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.QRMoveClasses})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	filter := []*dicom.Element{dicom.MustNewElement(tag.PatientName, "foohah")}
+	var pending []CMoveProgress
+	result, err := su.CMove("WORKSTATION", QRLevelPatient, filter, func(p CMoveProgress) {
+		require.Equal(t, dimse.StatusPending, p.Status.Status)
+		pending = append(pending, p)
+	})
+	require.NoError(t, err)
+	require.Equal(t, CMoveProgress{Remaining: -1, Completed: 2, Status: dimse.Success}, result)
+	require.NotEmpty(t, pending)
+	require.Len(t, stored, 2)
+
+	_, err = su.CMove("NOWHERE", QRLevelPatient, filter, nil)
+	require.Error(t, err)
+	_, err = su.CMove("ABCDEFGHIJKLMNOPQ", QRLevelPatient, filter, nil)
+	require.Error(t, err)
+}
+
+// The sub-operations of a C-MOVE share one association to the destination,
+// whose address comes from ResolveAE.
+func TestCMoveResolveAE(t *testing.T) {
+	ports := make(chan int, 10)
+	dest, err := NewServiceProvider(ServiceProviderParams{
+		CStore: func(conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID, calledAE, callingAE string, data []byte) dimse.Status {
+			ports <- conn.Peer.Port
+			return dimse.Success
+		},
+	}, "localhost:0")
+	require.NoError(t, err)
+	go dest.Run()
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		AETitle: "ARCHIVE",
+		ResolveAE: func(aeTitle string) (string, error) {
+			if aeTitle != "WORKSTATION" {
+				return "", fmt.Errorf("unknown AE %s", aeTitle)
+			}
+			return dest.ListenAddr().String(), nil
+		},
+		CMove: func(conn ConnectionState, transferSyntaxUID, sopClassUID string, filters []*dicom.Element, ch chan CMoveResult) {
+			path := "testdata/reportsi.dcm"
+			for i := 2; i >= 0; i-- {
+				ch <- CMoveResult{Remaining: i, Path: path, DataSet: mustReadDICOMFile(path)}
+			}
+			close(ch)
+		},
+	}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.QRMoveClasses})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	filter := []*dicom.Element{dicom.MustNewElement(tag.PatientName, "foohah")}
+	result, err := su.CMove("WORKSTATION", QRLevelPatient, filter, nil)
+	require.NoError(t, err)
+	require.Equal(t, 3, result.Completed)
+	require.Len(t, ports, 3)
+	port := <-ports
+	require.Equal(t, port, <-ports)
+	require.Equal(t, port, <-ports)
+
+	result, err = su.CMove("NOWHERE", QRLevelPatient, filter, nil)
+	require.Error(t, err)
+	require.Equal(t, dimse.CMoveMoveDestinationUnknown, result.Status.Status)
+}
+
 func TestReleaseWithoutConnect(t *testing.T) {
 	su, err := NewServiceUser(ServiceUserParams{
 		SOPClasses: sopclass.StorageClasses})
@@ -490,3 +792,1895 @@ func TestNonexistentServer(t *testing.T) {
 }
 
 // TODO(saito) Test that the state machine shuts down properly.
+
+// Start a fake provider that accepts a single association and calls
+// "onRequest" when the first P-DATA-TF PDU arrives. It returns the listen
+// address.
+func startScriptedProvider(t *testing.T, onRequest func(conn net.Conn)) string {
+	listener, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		v, err := pdu.ReadPDU(conn, DefaultMaxPDUSize)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		rq := v.(*pdu.AAssociate)
+		responses, err := newContextManager("scripted").onAssociateRequest(rq.Items)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		mustWritePDU(t, conn, &pdu.AAssociate{
+			Type:            pdu.TypeAAssociateAc,
+			ProtocolVersion: pdu.CurrentProtocolVersion,
+			CalledAETitle:   rq.CalledAETitle,
+			CallingAETitle:  rq.CallingAETitle,
+			Items:           responses,
+		})
+		if _, err := pdu.ReadPDU(conn, DefaultMaxPDUSize); err != nil {
+			t.Error(err)
+			return
+		}
+		onRequest(conn)
+	}()
+	return listener.Addr().String()
+}
+
+func mustWritePDU(t *testing.T, conn net.Conn, v pdu.PDU) {
+	data, err := pdu.EncodePDU(v)
+	if err == nil {
+		_, err = conn.Write(data)
+	}
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPeerAbort(t *testing.T) {
+	addr := startScriptedProvider(t, func(conn net.Conn) {
+		mustWritePDU(t, conn, &pdu.AAbort{
+			Source: pdu.AbortSourceServiceProvider,
+			Reason: pdu.AbortReasonUnexpectedPDUParameter,
+		})
+	})
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.VerificationClasses})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(addr)
+	err = su.CEcho()
+	var abortErr *AbortError
+	require.True(t, errors.As(err, &abortErr), "unexpected error: %v", err)
+	require.True(t, abortErr.Remote)
+	require.True(t, abortErr.IsProviderAbort())
+	require.Equal(t, pdu.AbortReasonUnexpectedPDUParameter, abortErr.Reason)
+}
+
+func TestPeerDisconnect(t *testing.T) {
+	addr := startScriptedProvider(t, func(conn net.Conn) {})
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.VerificationClasses})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(addr)
+	err = su.CEcho()
+	var transportErr *TransportError
+	require.True(t, errors.As(err, &transportErr), "unexpected error: %v", err)
+	var abortErr *AbortError
+	require.False(t, errors.As(err, &abortErr))
+}
+
+func TestPeerHalfClose(t *testing.T) {
+	for _, midPDU := range []bool{false, true} {
+		errCh := make(chan error, 1)
+		sp, err := NewServiceProvider(ServiceProviderParams{
+			CEcho: func(conn ConnectionState) dimse.Status { return dimse.Success },
+			AssociationError: func(conn ConnectionState, err error) {
+				errCh <- err
+			},
+		}, "localhost:0")
+		require.NoError(t, err)
+		go sp.Run()
+
+		conn, err := net.Dial("tcp", sp.ListenAddr().String())
+		require.NoError(t, err)
+		p := newScriptPeer(t, conn)
+		p.sendAssociateRQ("SCRIPTED-USER", pctx(uid.VerificationSOPClass, uid.ImplicitVRLittleEndian))
+		p.expectAssociateAC(pctx(uid.VerificationSOPClass, uid.ImplicitVRLittleEndian))
+		if midPDU {
+			// The header of a P-DATA-TF, but no body.
+			_, err = conn.Write([]byte{byte(pdu.TypePDataTf), 0, 0, 0, 0, 100})
+			require.NoError(t, err)
+		}
+		// Stop sending, but keep reading. The provider must close its
+		// end, and forget the association.
+		require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+		p.expectClosed()
+
+		var transportErr *TransportError
+		err = <-errCh
+		require.True(t, errors.As(err, &transportErr), "unexpected error: %v", err)
+		if midPDU {
+			require.Equal(t, io.ErrUnexpectedEOF, transportErr.Err)
+		} else {
+			require.NoError(t, transportErr.Err)
+		}
+		require.Eventually(t, func() bool { return sp.Health().NumAssociations == 0 },
+			scriptTimeout, 10*time.Millisecond)
+	}
+}
+
+func TestAssociationRequestTimeout(t *testing.T) {
+	errCh := make(chan error, 1)
+	clock := NewVirtualClock(time.Time{})
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		Clock:                     clock,
+		AssociationRequestTimeout: time.Second,
+		AssociationError: func(conn ConnectionState, err error) {
+			errCh <- err
+		},
+	}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+
+	// Connect, but never send A-ASSOCIATE-RQ.
+	conn, err := net.Dial("tcp", sp.ListenAddr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	// Wait for the ARTIM timer and the read deadline to be armed. Only the
+	// latter expires.
+	clock.BlockUntil(2)
+	clock.Advance(time.Second)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	require.Equal(t, io.EOF, err)
+
+	err = <-errCh
+	var transportErr *TransportError
+	require.True(t, errors.As(err, &transportErr), "unexpected error: %v", err)
+	require.True(t, errors.Is(err, os.ErrDeadlineExceeded))
+	require.Equal(t, int64(1), sp.Health().DroppedConnections[DropAssociationRequestTimeout])
+}
+
+func TestAssociationRequestTooLarge(t *testing.T) {
+	errCh := make(chan error, 1)
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		MaxAssociationRequestBytes: 100,
+		AssociationError: func(conn ConnectionState, err error) {
+			errCh <- err
+		},
+	}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+
+	conn, err := net.Dial("tcp", sp.ListenAddr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	// An A-ASSOCIATE-RQ header announcing 1000 bytes, then the bytes.
+	req := []byte{byte(pdu.TypeAAssociateRq), 0, 0, 0, 0x03, 0xe8}
+	_, err = conn.Write(append(req, make([]byte, 1000)...))
+	require.NoError(t, err)
+
+	err = <-errCh
+	require.True(t, errors.Is(err, ErrAssociationRequestTooLarge), "unexpected error: %v", err)
+	require.Equal(t, int64(1), sp.Health().DroppedConnections[DropAssociationRequestTooLarge])
+}
+
+// An A-ASSOCIATE-RQ with more items than allowed is aborted, and counted.
+func TestAssociationRequestTooComplex(t *testing.T) {
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		CEcho:                      onCEchoRequest,
+		MaxAssociationRequestItems: 20,
+	}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+	defer sp.Shutdown() // nolint: errcheck
+
+	conn, err := net.Dial("tcp", sp.ListenAddr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	rq := &pdu.AAssociate{
+		Type:            pdu.TypeAAssociateRq,
+		ProtocolVersion: pdu.CurrentProtocolVersion,
+		CalledAETitle:   "SCP",
+		CallingAETitle:  "SCU",
+		Items:           []pdu.SubItem{&pdu.ApplicationContextItem{Name: pdu.DICOMApplicationContextItemName}},
+	}
+	for i := 0; i < 10; i++ {
+		rq.Items = append(rq.Items, &pdu.PresentationContextItem{
+			Type:      pdu.ItemTypePresentationContextRequest,
+			ContextID: byte(2*i + 1),
+			Items: []pdu.SubItem{
+				&pdu.AbstractSyntaxSubItem{Name: uid.VerificationSOPClass},
+				&pdu.TransferSyntaxSubItem{Name: uid.ImplicitVRLittleEndian},
+			},
+		})
+	}
+	data, err := pdu.EncodePDU(rq)
+	require.NoError(t, err)
+	_, err = conn.Write(data)
+	require.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	v, err := pdu.ReadPDU(conn, DefaultMaxPDUSize)
+	require.NoError(t, err)
+	require.IsType(t, &pdu.AAbort{}, v)
+	require.Eventually(t, func() bool {
+		return sp.Health().DroppedConnections[DropAssociationRequestTooComplex] == 1
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestMinTransferRate(t *testing.T) {
+	errCh := make(chan error, 1)
+	clock := NewVirtualClock(time.Time{})
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		Clock:                     clock,
+		AssociationRequestTimeout: -1,
+		MinTransferRate:           100,
+		TransferRateWindow:        100 * time.Millisecond,
+		AssociationError: func(conn ConnectionState, err error) {
+			errCh <- err
+		},
+	}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+
+	conn, err := net.Dial("tcp", sp.ListenAddr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	// Wait for the ARTIM timer and the rate check to be armed, then send
+	// the start of an A-ASSOCIATE-RQ, and nothing more.
+	clock.BlockUntil(2)
+	_, err = conn.Write([]byte{byte(pdu.TypeAAssociateRq), 0, 0, 0, 0x03, 0xe8})
+	require.NoError(t, err)
+	// The rate is checked over whole windows after the first byte is
+	// read; advance until the connection is dropped, well before ARTIM.
+	for i := 0; i < 50; i++ {
+		clock.Advance(100 * time.Millisecond)
+		select {
+		case err = <-errCh:
+			require.True(t, errors.Is(err, ErrTransferTooSlow), "unexpected error: %v", err)
+			require.Equal(t, int64(1), sp.Health().DroppedConnections[DropSlowTransfer])
+			return
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+	t.Fatal("connection not dropped")
+}
+
+func TestARTIMTimerExpiry(t *testing.T) {
+	for _, timeout := range []time.Duration{0, time.Minute} {
+		testARTIMTimerExpiry(t, timeout)
+	}
+	// The timer can't be disabled.
+	_, err := NewServiceProvider(ServiceProviderParams{ARTIMTimeout: -1}, "localhost:0")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "ARTIMTimeout")
+	_, err = NewServiceUser(ServiceUserParams{SOPClasses: sopclass.VerificationClasses, ARTIMTimeout: -1})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "ARTIMTimeout")
+}
+
+func testARTIMTimerExpiry(t *testing.T, timeout time.Duration) {
+	clock := NewVirtualClock(time.Time{})
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		Clock:                     clock,
+		AssociationRequestTimeout: -1,
+		ARTIMTimeout:              timeout,
+	}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+	defer sp.Shutdown() // nolint: errcheck
+
+	conn, err := net.Dial("tcp", sp.ListenAddr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	clock.BlockUntil(1)
+	clock.Advance(artimTimeoutOrDefault(timeout) - time.Millisecond)
+	require.Equal(t, 1, clock.PendingTimers())
+	clock.Advance(time.Millisecond)
+	require.Equal(t, 0, clock.PendingTimers())
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	require.Equal(t, io.EOF, err)
+}
+
+// Simulate a WAN link in both directions.
+func TestLinkFaultInjectorLatency(t *testing.T) {
+	const latency = 50 * time.Millisecond
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		CEcho:         onCEchoRequest,
+		FaultInjector: NewLinkFaultInjector(LinkConditions{Latency: latency}),
+	}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:    sopclass.VerificationClasses,
+		FaultInjector: NewLinkFaultInjector(LinkConditions{Latency: latency, Jitter: 10 * time.Millisecond, Seed: 1}),
+	})
+	require.NoError(t, err)
+	su.Connect(sp.ListenAddr().String())
+	require.NoError(t, su.CEcho())
+
+	start := time.Now()
+	require.NoError(t, su.CEcho())
+	require.GreaterOrEqual(t, time.Since(start), 2*latency)
+	// A-RELEASE-RP is delivered before the provider's side closes.
+	require.NoError(t, su.Release())
+}
+
+func TestLinkFaultInjectorBandwidth(t *testing.T) {
+	const bytesPerSecond = 320 * 1024
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:    sopclass.StorageClasses,
+		FaultInjector: NewLinkFaultInjector(LinkConditions{BytesPerSecond: bytesPerSecond}),
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(provider.ListenAddr().String())
+
+	payload := make([]byte, 32*1024)
+	start := time.Now()
+	require.NoError(t, su.CStoreRaw(sopclass.StorageClasses[0], "1.2.3.4", uid.ImplicitVRLittleEndian, payload))
+	require.GreaterOrEqual(t, time.Since(start), time.Duration(len(payload))*time.Second/bytesPerSecond)
+}
+
+// A user proposing PreferHTJ2KLosslessTransferSyntaxes negotiates HTJ2K, and
+// sends HTJ2K data under it, while native data still goes out in a native
+// syntax.
+func TestCStoreHTJ2KNegotiation(t *testing.T) {
+	const sopClassUID = "1.2.840.10008.5.1.4.1.1.7" // Secondary capture
+	type stored struct {
+		transferSyntaxUID string
+		data              []byte
+	}
+	received := make(chan stored, 2)
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		CStore: func(conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID, calledAE, callingAE string, data []byte) dimse.Status {
+			received <- stored{transferSyntaxUID, data}
+			return dimse.Success
+		},
+	}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:               []string{sopClassUID},
+		TransferSyntaxes:         PreferHTJ2KLosslessTransferSyntaxes,
+		ContextPerTransferSyntax: true,
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+
+	payload := []byte("encapsulated HTJ2K payload")
+	require.NoError(t, su.CStoreRaw(sopClassUID, "1.2.3.1", HTJ2KLosslessTransferSyntax, payload))
+	require.Equal(t, stored{HTJ2KLosslessTransferSyntax, payload}, <-received)
+	require.NoError(t, su.CStoreRaw(sopClassUID, "1.2.3.2", uid.ExplicitVRLittleEndian, payload))
+	require.Equal(t, stored{uid.ExplicitVRLittleEndian, payload}, <-received)
+}
+
+// Relay an object through an intermediate provider with CStoreRaw, and check
+// that the final destination receives exactly the bytes originally sent.
+func TestCStoreRawRelayPreservesBytes(t *testing.T) {
+	const sopClassUID = "1.2.840.10008.5.1.4.1.1.7" // Secondary capture
+	const sopInstanceUID = "1.2.826.0.1.3680043.9.7133.1.1"
+	transferSyntaxUID := uid.ExplicitVRLittleEndian
+
+	// Large enough to span multiple PDUs.
+	payload := make([]byte, DefaultMaxPDUSize+12345)
+	for i := range payload {
+		payload[i] = byte(i * 7)
+	}
+
+	received := make(chan []byte, 1)
+	destination, err := NewServiceProvider(ServiceProviderParams{
+		CStore: func(conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID, calledAE, callingAE string, data []byte) dimse.Status {
+			received <- data
+			return dimse.Success
+		},
+	}, "localhost:0")
+	require.NoError(t, err)
+	go destination.Run()
+
+	relay, err := NewServiceProvider(ServiceProviderParams{
+		PreserveTransferSyntax: true,
+		CStore: func(conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID, calledAE, callingAE string, data []byte) dimse.Status {
+			su, err := NewServiceUser(ServiceUserParams{
+				SOPClasses:       []string{sopClassUID},
+				TransferSyntaxes: []string{transferSyntaxUID},
+			})
+			if err != nil {
+				t.Error(err)
+				return dimse.Status{Status: dimse.CStoreCannotUnderstand}
+			}
+			defer su.Release()
+			su.Connect(destination.ListenAddr().String())
+			if err := su.CStoreRaw(sopClassUID, sopInstanceUID, transferSyntaxUID, data); err != nil {
+				t.Error(err)
+				return dimse.Status{Status: dimse.CStoreCannotUnderstand}
+			}
+			return dimse.Success
+		},
+	}, "localhost:0")
+	require.NoError(t, err)
+	go relay.Run()
+
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:       []string{sopClassUID},
+		TransferSyntaxes: []string{transferSyntaxUID},
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(relay.ListenAddr().String())
+	require.NoError(t, su.CStoreRaw(sopClassUID, sopInstanceUID, transferSyntaxUID, payload))
+	require.Equal(t, sha256.Sum256(payload), sha256.Sum256(<-received))
+
+	// CStoreRaw sends the bytes as they are, so it fails, rather than
+	// transcoding, if the peer didn't accept their transfer syntax.
+	err = su.CStoreRaw(sopClassUID, sopInstanceUID, uid.ImplicitVRLittleEndian, payload)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "peer did not accept transfer syntax")
+	require.Len(t, received, 0)
+}
+
+// Encode a Part-10 file holding "body".
+func encodePart10(sopClassUID, sopInstanceUID, transferSyntaxUID string, body []byte) []byte {
+	b := bytes.Buffer{}
+	if err := WritePart10(&b, transferSyntaxUID, sopClassUID, sopInstanceUID, "", body); err != nil {
+		log.Panic(err)
+	}
+	return b.Bytes()
+}
+
+func TestCStorePart10(t *testing.T) {
+	const sopClassUID = "1.2.840.10008.5.1.4.1.1.7" // Secondary capture
+	const sopInstanceUID = "1.2.826.0.1.3680043.9.7133.1.2"
+	body := make([]byte, 2*DefaultMaxPDUSize+17)
+	for i := range body {
+		body[i] = byte(i * 13)
+	}
+
+	type stored struct {
+		transferSyntaxUID, sopInstanceUID string
+		data                              []byte
+	}
+	received := make(chan stored, 1)
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		CStore: func(conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID, calledAE, callingAE string, data []byte) dimse.Status {
+			received <- stored{transferSyntaxUID, sopInstanceUID, data}
+			return dimse.Success
+		},
+	}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:       []string{sopClassUID},
+		TransferSyntaxes: []string{uid.ExplicitVRLittleEndian},
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	require.NoError(t, su.CStorePart10(bytes.NewReader(encodePart10(sopClassUID, sopInstanceUID, uid.ExplicitVRLittleEndian, body))))
+	got := <-received
+	require.Equal(t, uid.ExplicitVRLittleEndian, got.transferSyntaxUID)
+	require.Equal(t, sopInstanceUID, got.sopInstanceUID)
+	require.Equal(t, sha256.Sum256(body), sha256.Sum256(got.data))
+
+	// The data is never transcoded.
+	err = su.CStorePart10(bytes.NewReader(encodePart10(sopClassUID, sopInstanceUID, uid.ImplicitVRLittleEndian, body)))
+	require.Error(t, err)
+	require.Error(t, su.CStorePart10(bytes.NewReader([]byte("not a DICOM file"))))
+}
+
+func TestCStoreFile(t *testing.T) {
+	const sopClassUID = "1.2.840.10008.5.1.4.1.1.7" // Secondary capture
+	const sopInstanceUID = "1.2.826.0.1.3680043.9.7133.1.3"
+	body := make([]byte, 3*DefaultMaxPDUSize+5)
+	for i := range body {
+		body[i] = byte(i * 7)
+	}
+	path := filepath.Join(t.TempDir(), "large.dcm")
+	require.NoError(t, os.WriteFile(path, encodePart10(sopClassUID, sopInstanceUID, uid.ExplicitVRLittleEndian, body), 0644))
+
+	received := make(chan []byte, 1)
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		CStore: func(conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID, calledAE, callingAE string, data []byte) dimse.Status {
+			received <- data
+			return dimse.Success
+		},
+	}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:       []string{sopClassUID},
+		TransferSyntaxes: []string{uid.ExplicitVRLittleEndian},
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	require.NoError(t, su.CStoreFile(path))
+	require.Equal(t, sha256.Sum256(body), sha256.Sum256(<-received))
+
+	require.Error(t, su.CStoreFile(filepath.Join(t.TempDir(), "missing.dcm")))
+}
+
+func TestCStoreForwarder(t *testing.T) {
+	const sopClassUID = "1.2.840.10008.5.1.4.1.1.7" // Secondary capture
+	const sopInstanceUID = "1.2.826.0.1.3680043.9.7133.1.4"
+	body := make([]byte, 3*DefaultMaxPDUSize+5)
+	for i := range body {
+		body[i] = byte(i * 11)
+	}
+
+	received := make(chan []byte, 1)
+	dest, err := NewServiceProvider(ServiceProviderParams{
+		CStore: func(conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID, calledAE, callingAE string, data []byte) dimse.Status {
+			received <- data
+			return dimse.Success
+		},
+	}, "localhost:0")
+	require.NoError(t, err)
+	go dest.Run()
+
+	upstream, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:       []string{sopClassUID},
+		TransferSyntaxes: []string{uid.ExplicitVRLittleEndian},
+	})
+	require.NoError(t, err)
+	defer upstream.Release()
+	upstream.Connect(dest.ListenAddr().String())
+
+	proxy, err := NewServiceProvider(ServiceProviderParams{
+		CStoreStream: NewCStoreForwarder(upstream),
+	}, "localhost:0")
+	require.NoError(t, err)
+	go proxy.Run()
+
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:       []string{sopClassUID},
+		TransferSyntaxes: []string{uid.ExplicitVRLittleEndian},
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(proxy.ListenAddr().String())
+	require.NoError(t, su.CStoreRaw(sopClassUID, sopInstanceUID, uid.ExplicitVRLittleEndian, body))
+	require.Equal(t, sha256.Sum256(body), sha256.Sum256(<-received))
+
+	// The statemachine never sees the whole dataset, so it can't peek at it.
+	_, err = NewServiceProvider(ServiceProviderParams{
+		CStoreStream: NewCStoreForwarder(upstream),
+		CStoreAdmit: func(conn ConnectionState, callingAETitle, sopClassUID, sopInstanceUID string) dimse.Status {
+			return dimse.Success
+		},
+	}, "localhost:0")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "CStoreStream")
+	_, err = NewServiceProvider(ServiceProviderParams{
+		CStoreStream:     NewCStoreForwarder(upstream),
+		HandlerExecution: HandlerExecutionModels{CStore: HandlerInline},
+	}, "localhost:0")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "inline")
+}
+
+// A C-STORE answered with a warning succeeds; one answered with a failure
+// returns a CStoreStatusError.
+func TestCStoreWarningStatus(t *testing.T) {
+	const sopClassUID = "1.2.840.10008.5.1.4.1.1.7" // Secondary capture
+	statuses := map[string]dimse.StatusCode{
+		"1.2.3.1": dimse.CStoreCoercionOfDataElements,
+		"1.2.3.2": dimse.CStoreElementsDiscarded,
+		"1.2.3.3": dimse.CStoreDataSetDoesNotMatchSOPClassWarning,
+		"1.2.3.4": dimse.CStoreOutOfResources,
+	}
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		CStore: func(conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID, calledAE, callingAE string, data []byte) dimse.Status {
+			return dimse.Status{Status: statuses[sopInstanceUID]}
+		},
+	}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:       []string{sopClassUID},
+		TransferSyntaxes: []string{uid.ExplicitVRLittleEndian},
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	for _, sopInstanceUID := range []string{"1.2.3.1", "1.2.3.2", "1.2.3.3"} {
+		require.NoError(t, su.CStoreRaw(sopClassUID, sopInstanceUID, uid.ExplicitVRLittleEndian, []byte("data")))
+	}
+	err = su.CStoreRaw(sopClassUID, "1.2.3.4", uid.ExplicitVRLittleEndian, []byte("data"))
+	var statusErr *CStoreStatusError
+	require.ErrorAs(t, err, &statusErr)
+	require.Equal(t, dimse.CStoreOutOfResources, statusErr.Response.Status.Status)
+}
+
+// The network reader stops while the streamed datasets hold more than
+// maxBufferedStreamBytes, and resumes once a handler reads, or waits for data.
+func TestCStoreStreamFlow(t *testing.T) {
+	s := newCStoreStreamer(ServiceProviderParams{CStoreStream: NewCStoreForwarder(nil)})
+	stream := &cstoreStream{flow: s.flow}
+	s.pending[1] = stream
+	s.write(1, make([]byte, maxBufferedStreamBytes+1))
+	resumed := make(chan struct{})
+	go func() {
+		s.flow.wait(nil)
+		close(resumed)
+	}()
+	select {
+	case <-resumed:
+		t.Fatal("reader didn't wait for the handler")
+	case <-time.After(50 * time.Millisecond):
+	}
+	n, err := stream.Read(make([]byte, 2))
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	<-resumed
+
+	// A handler waiting for data lets the reader go on, whatever is
+	// buffered for the others.
+	other := &cstoreStream{flow: s.flow}
+	s.pending[3] = other
+	s.write(1, make([]byte, maxBufferedStreamBytes))
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := other.Read(make([]byte, 1))
+		readErr <- err
+	}()
+	s.flow.wait(nil)
+
+	// Meanwhile, a dataset that falls maxStreamBacklogBytes behind is
+	// dropped.
+	s.write(1, make([]byte, maxStreamBacklogBytes))
+	s.flow.wait(nil)
+	s.finish(1, nil)
+	_, err = io.ReadAll(stream)
+	require.Equal(t, errStreamOverflow, err)
+	s.flow.mu.Lock()
+	require.Zero(t, s.flow.buffered)
+	s.flow.mu.Unlock()
+
+	s.abort()
+	require.Equal(t, errStreamAborted, <-readErr)
+}
+
+func TestCStoreDigest(t *testing.T) {
+	const sopClassUID = "1.2.840.10008.5.1.4.1.1.7" // Secondary capture
+	payload := []byte("digest test payload.")
+	digests := make(chan []byte, 1)
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		DataDigest: sha256.New,
+		CStoreWithDigest: func(conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID, calledAE, callingAE string, data, digest []byte) dimse.Status {
+			digests <- digest
+			return dimse.Success
+		},
+	}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: []string{sopClassUID}})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	require.NoError(t, su.CStoreRaw(sopClassUID, "1.2.3.4", uid.ImplicitVRLittleEndian, payload))
+	expected := sha256.Sum256(payload)
+	require.Equal(t, expected[:], <-digests)
+
+	// A streamed dataset is digested as the handler reads it.
+	streamed, err := NewServiceProvider(ServiceProviderParams{
+		DataDigest: sha256.New,
+		CStoreStream: func(conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID string, priority int, data io.Reader) dimse.Status {
+			d := data.(DigestReader)
+			if d.Digest() != nil {
+				return dimse.Status{Status: dimse.CStoreCannotUnderstand, ErrorComment: "digest before EOF"}
+			}
+			if _, err := io.Copy(io.Discard, data); err != nil {
+				return dimse.Status{Status: dimse.CStoreOutOfResources, ErrorComment: err.Error()}
+			}
+			digests <- d.Digest()
+			return dimse.Success
+		},
+	}, "localhost:0")
+	require.NoError(t, err)
+	go streamed.Run()
+	defer streamed.Shutdown() // nolint: errcheck
+	su2, err := NewServiceUser(ServiceUserParams{SOPClasses: []string{sopClassUID}})
+	require.NoError(t, err)
+	defer su2.Release()
+	su2.Connect(streamed.ListenAddr().String())
+	require.NoError(t, su2.CStoreRaw(sopClassUID, "1.2.3.5", uid.ImplicitVRLittleEndian, payload))
+	require.Equal(t, expected[:], <-digests)
+
+	// Without DataDigest, CStoreWithDigest would never be called.
+	_, err = NewServiceProvider(ServiceProviderParams{
+		CStoreWithDigest: func(conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID, calledAE, callingAE string, data, digest []byte) dimse.Status {
+			return dimse.Success
+		},
+	}, "localhost:0")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "requires DataDigest")
+}
+
+func TestCStorePeekReject(t *testing.T) {
+	const sopClassUID = "1.2.840.10008.5.1.4.1.1.1" // CR
+	// Explicit VR little endian: Modality (0008,0060) CS "CR", then pixel data.
+	var payload []byte
+	payload = append(payload, 0x08, 0x00, 0x60, 0x00, 'C', 'S', 2, 0, 'C', 'R')
+	payload = append(payload, 0xe0, 0x7f, 0x10, 0x00, 'O', 'B', 0, 0, 4, 0, 0, 0, 1, 2, 3, 4)
+
+	modalities := make(chan string, 1)
+	stored := false
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		CStorePeek: func(conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID string, elems []*dicom.Element) dimse.Status {
+			for _, elem := range elems {
+				if elem.Tag == tag.Modality {
+					modalities <- elem.Value.GetValue().([]string)[0]
+				}
+			}
+			return dimse.Status{Status: dimse.StatusNotAuthorized}
+		},
+		CStore: func(conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID, calledAE, callingAE string, data []byte) dimse.Status {
+			stored = true
+			return dimse.Success
+		},
+	}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: []string{sopClassUID}})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	require.Error(t, su.CStoreRaw(sopClassUID, "1.2.3.4", uid.ExplicitVRLittleEndian, payload))
+	require.Equal(t, "CR", <-modalities)
+	require.False(t, stored)
+}
+
+func TestCStoreAdmitRefuse(t *testing.T) {
+	const sopClassUID = "1.2.840.10008.5.1.4.1.1.7" // Secondary capture
+	callingAEs := make(chan string, 1)
+	stored := false
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		CStoreAdmit: func(conn ConnectionState, callingAETitle, sopClassUID, sopInstanceUID string) dimse.Status {
+			callingAEs <- callingAETitle
+			return dimse.Status{Status: dimse.CStoreOutOfResources}
+		},
+		CStore: func(conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID, calledAE, callingAE string, data []byte) dimse.Status {
+			stored = true
+			return dimse.Success
+		},
+	}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+
+	su, err := NewServiceUser(ServiceUserParams{
+		CallingAETitle: "admittest",
+		SOPClasses:     []string{sopClassUID}})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	require.Error(t, su.CStoreRaw(sopClassUID, "1.2.3.4", uid.ImplicitVRLittleEndian, []byte("admit test payload..")))
+	require.Equal(t, "admittest", <-callingAEs)
+	require.False(t, stored)
+}
+
+func TestResponseShaping(t *testing.T) {
+	const sopClassUID = "1.2.840.10008.5.1.4.1.1.7" // Secondary capture
+	var stored []string
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		CEcho: onCEchoRequest,
+		CStore: func(conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID, calledAE, callingAE string, data []byte) dimse.Status {
+			stored = append(stored, sopInstanceUID)
+			return dimse.Success
+		},
+		ResponseShaping: &ResponseShaping{Rules: []ResponseRule{
+			{
+				CommandField:    dimse.CommandFieldCStoreRq,
+				SOPInstanceUIDs: []string{"1.2.3.4"},
+				Delay:           10 * time.Millisecond,
+				Status:          &dimse.Status{Status: dimse.CStoreOutOfResources},
+			},
+			{CommandField: dimse.CommandFieldCEchoRq, AbortProbability: 1},
+		}},
+	}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses: append([]string{sopClassUID}, sopclass.VerificationClasses...)})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	payload := []byte("shaping test payload")
+	require.Error(t, su.CStoreRaw(sopClassUID, "1.2.3.4", uid.ImplicitVRLittleEndian, payload))
+	require.NoError(t, su.CStoreRaw(sopClassUID, "1.2.3.5", uid.ImplicitVRLittleEndian, payload))
+	require.Equal(t, []string{"1.2.3.5"}, stored)
+	require.Error(t, su.CEcho())
+}
+
+func TestEventBus(t *testing.T) {
+	const sopClassUID = "1.2.840.10008.5.1.4.1.1.7" // Secondary capture
+	// Implicit VR little endian: StudyInstanceUID (0020,000D) "1.2.3".
+	payload := []byte{0x20, 0x00, 0x0d, 0x00, 6, 0, 0, 0, '1', '.', '2', '.', '3', 0}
+	bus := NewEventBus(50 * time.Millisecond)
+	defer bus.Close()
+	events := bus.Subscribe(16)
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		Events: bus,
+		CStore: func(conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID, calledAE, callingAE string, data []byte) dimse.Status {
+			return dimse.Success
+		},
+	}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: []string{sopClassUID}})
+	require.NoError(t, err)
+	su.Connect(sp.ListenAddr().String())
+	require.NoError(t, su.CStoreRaw(sopClassUID, "1.2.3.4", uid.ImplicitVRLittleEndian, payload))
+	su.Release()
+
+	got := map[EventType]Event{}
+	for len(got) < 3 {
+		select {
+		case e := <-events:
+			got[e.Type] = e
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out; received %v", got)
+		}
+	}
+	require.Equal(t, "1.2.3.4", got[EventInstanceReceived].SOPInstanceUID)
+	require.Equal(t, "1.2.3", got[EventInstanceReceived].StudyInstanceUID)
+	require.Equal(t, "1.2.3", got[EventStudyComplete].StudyInstanceUID)
+	require.Equal(t, 1, got[EventStudyComplete].NumInstances)
+	require.NoError(t, got[EventAssociationClosed].Err)
+	// The C-STORE used one context; the others were negotiated for nothing.
+	var used []ContextUsage
+	for _, u := range got[EventAssociationClosed].Contexts {
+		if u.Used() {
+			used = append(used, u)
+		}
+	}
+	require.Len(t, used, 1)
+	require.Equal(t, sopClassUID, used[0].AbstractSyntaxUID)
+	require.Equal(t, uid.ImplicitVRLittleEndian, used[0].TransferSyntaxUID)
+	require.Equal(t, int64(1), used[0].MessagesReceived)
+	require.Equal(t, int64(1), used[0].MessagesSent)
+}
+
+// The events of a streamed C-STORE carry the study, even if the handler
+// doesn't read the dataset.
+func TestEventBusCStoreStream(t *testing.T) {
+	const sopClassUID = "1.2.840.10008.5.1.4.1.1.7" // Secondary capture
+	// Implicit VR little endian: StudyInstanceUID (0020,000D) "1.2.3".
+	payload := []byte{0x20, 0x00, 0x0d, 0x00, 6, 0, 0, 0, '1', '.', '2', '.', '3', 0}
+	bus := NewEventBus(50 * time.Millisecond)
+	defer bus.Close()
+	events := bus.Subscribe(16)
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		Events: bus,
+		CStoreStream: func(conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID string, priority int, data io.Reader) dimse.Status {
+			return dimse.Success
+		},
+	}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: []string{sopClassUID}})
+	require.NoError(t, err)
+	su.Connect(sp.ListenAddr().String())
+	require.NoError(t, su.CStoreRaw(sopClassUID, "1.2.3.4", uid.ImplicitVRLittleEndian, payload))
+	su.Release()
+
+	got := map[EventType]Event{}
+	for len(got) < 3 {
+		select {
+		case e := <-events:
+			got[e.Type] = e
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out; received %v", got)
+		}
+	}
+	require.Equal(t, "1.2.3.4", got[EventInstanceReceived].SOPInstanceUID)
+	require.Equal(t, "1.2.3", got[EventInstanceReceived].StudyInstanceUID)
+	require.Equal(t, "1.2.3", got[EventStudyComplete].StudyInstanceUID)
+	require.Equal(t, 1, got[EventStudyComplete].NumInstances)
+}
+
+// The copies for a replica share one association, and are dropped once the
+// replica falls too far behind.
+func TestCMoveReplicator(t *testing.T) {
+	stored := make(chan int, maxReplicaBacklog+2)
+	unblock := make(chan struct{})
+	replica, err := NewServiceProvider(ServiceProviderParams{
+		CStore: func(conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID, calledAE, callingAE string, data []byte) dimse.Status {
+			stored <- conn.Peer.Port
+			<-unblock
+			return dimse.Success
+		},
+	}, "localhost:0")
+	require.NoError(t, err)
+	go replica.Run()
+
+	r := newCMoveReplicator(ServiceProviderParams{
+		AETitle:   "testae",
+		RemoteAEs: map[string]string{"dr": replica.ListenAddr().String()},
+		CMoveReplicas: func(conn ConnectionState, moveDestination string, ds *dicom.Dataset) []string {
+			return nil
+		},
+	})
+	ds := mustReadDICOMFile("testdata/reportsi.dcm")
+	r.send([]string{"dr", "unknown"}, ds)
+	// The first copy is being stored; the queue takes maxReplicaBacklog
+	// more.
+	port := <-stored
+	for i := 0; i < maxReplicaBacklog+2; i++ {
+		r.send([]string{"dr"}, ds)
+	}
+	close(unblock)
+	counts := r.finish()
+	require.Equal(t, CMoveReplicaCounts{Completed: maxReplicaBacklog + 1, Dropped: 2}, counts["dr"])
+	require.Equal(t, 1, counts["unknown"].Failed)
+	require.Error(t, counts["unknown"].Err)
+	for len(stored) > 0 {
+		require.Equal(t, port, <-stored)
+	}
+}
+
+func TestSubOperations(t *testing.T) {
+	const limit = 3
+	var pending [][2]uint16
+	subOps := newSubOperations(nil, limit, func(remaining int, completed, failed uint16) {
+		pending = append(pending, [2]uint16{completed, failed})
+	})
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	for i := 0; i < 10; i++ {
+		i := i
+		subOps.start(9-i, func() error {
+			mu.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			mu.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+			if i%4 == 0 {
+				return fmt.Errorf("sub-operation %d failed", i)
+			}
+			return nil
+		})
+	}
+	completed, failed := subOps.wait()
+	require.Equal(t, uint16(7), completed)
+	require.Equal(t, uint16(3), failed)
+	require.LessOrEqual(t, maxRunning, limit)
+	require.Len(t, pending, 10)
+	for i, counts := range pending {
+		require.Equal(t, i+1, int(counts[0]+counts[1]))
+	}
+}
+
+func TestTransferScheduler(t *testing.T) {
+	sched := NewTransferScheduler(TransferSchedulerParams{
+		Rules: []TransferPriorityRule{
+			func(t Transfer) (TransferPriority, bool) {
+				return TransferPriorityLow, t.CallingAETitle == "MIGRATION"
+			},
+		},
+	})
+	defer sched.Close()
+
+	// Hold the worker, so that the others queue up.
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go sched.Do(Transfer{}, func() error {
+		close(started)
+		<-release
+		return nil
+	})
+	<-started
+
+	var mu sync.Mutex
+	var order []string
+	errs := make(chan error, 5)
+	queued := 0
+	submit := func(name string, tr Transfer) {
+		go func() {
+			errs <- sched.Do(tr, func() error {
+				mu.Lock()
+				order = append(order, name)
+				mu.Unlock()
+				return nil
+			})
+		}()
+		// Wait until it's queued, so that the submission order is known.
+		queued++
+		for sched.Queued() < queued {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	submit("a", Transfer{CallingAETitle: "MIGRATION", DIMSEPriority: 1})
+	submit("b", Transfer{DIMSEPriority: 2})
+	submit("c", Transfer{})
+	submit("d", Transfer{DIMSEPriority: 1})
+	submit("e", Transfer{CallingAETitle: "MIGRATION", StudyInstanceUID: "1.2.3"})
+	sched.SetStudyPriority("1.2.3", TransferPriorityHigh+1)
+	close(release)
+	for i := 0; i < queued; i++ {
+		require.NoError(t, <-errs)
+	}
+	require.Equal(t, []string{"e", "d", "c", "a", "b"}, order)
+}
+
+func TestVerificationProvider(t *testing.T) {
+	sp, err := NewVerificationProvider("localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+	require.Len(t, sp.Capabilities().SOPClasses, len(sopclass.VerificationClasses))
+
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.VerificationClasses})
+	require.NoError(t, err)
+	su.Connect(sp.ListenAddr().String())
+	require.NoError(t, su.CEcho())
+	su.Release()
+
+	// Anything else is rejected during negotiation.
+	su, err = NewServiceUser(ServiceUserParams{SOPClasses: sopclass.StorageClasses})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	require.Error(t, su.CStore(mustReadDICOMFile("testdata/reportsi.dcm")))
+}
+
+// testAuthenticator accepts user "alice" with password "secret", the JWT
+// "token", and the SAML assertion "<Assertion/>".
+type testAuthenticator struct{}
+
+func (testAuthenticator) VerifyUsernamePassword(conn ConnectionState, username, password string) (*Principal, error) {
+	if username != "alice" || password != "secret" {
+		return nil, fmt.Errorf("bad password for '%s'", username)
+	}
+	return &Principal{Name: username, Attributes: map[string]string{"role": "radiologist"}}, nil
+}
+
+func (testAuthenticator) VerifyKerberosTicket(conn ConnectionState, ticket []byte) (*Principal, error) {
+	return nil, fmt.Errorf("kerberos not supported")
+}
+
+func (testAuthenticator) VerifyJWT(conn ConnectionState, token string) (*Principal, error) {
+	if token != "token" {
+		return nil, fmt.Errorf("bad token")
+	}
+	return &Principal{Name: "jwt-user", ServerResponse: []byte("ok")}, nil
+}
+
+func (testAuthenticator) VerifySAMLAssertion(conn ConnectionState, assertion string) (*Principal, error) {
+	if assertion != "<Assertion/>" {
+		return nil, fmt.Errorf("bad assertion")
+	}
+	return &Principal{Name: "saml-user"}, nil
+}
+
+func TestAuthenticator(t *testing.T) {
+	principals := make(chan *Principal, 1)
+	params := ServiceProviderParams{
+		CEcho: func(conn ConnectionState) dimse.Status {
+			principals <- conn.Principal
+			return dimse.Success
+		},
+		Authenticator: testAuthenticator{},
+	}
+	sp, err := NewServiceProvider(params, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+
+	echo := func(identity *UserIdentity) error {
+		su, err := NewServiceUser(ServiceUserParams{
+			SOPClasses:   sopclass.VerificationClasses,
+			UserIdentity: identity,
+		})
+		require.NoError(t, err)
+		defer su.Release()
+		su.Connect(sp.ListenAddr().String())
+		return su.CEcho()
+	}
+	require.NoError(t, echo(&UserIdentity{
+		Type:           pdu.UserIdentityUsernamePasscode,
+		PrimaryField:   []byte("alice"),
+		SecondaryField: []byte("secret"),
+	}))
+	p := <-principals
+	require.Equal(t, "alice", p.Name)
+	require.Equal(t, pdu.UserIdentityUsernamePasscode, p.IdentityType)
+	require.Equal(t, "radiologist", p.Attributes["role"])
+
+	require.NoError(t, echo(&UserIdentity{
+		Type:                      pdu.UserIdentityJWT,
+		PrimaryField:              []byte("token"),
+		PositiveResponseRequested: true,
+	}))
+	require.Equal(t, "jwt-user", (<-principals).Name)
+
+	require.NoError(t, echo(&UserIdentity{
+		Type:         pdu.UserIdentitySAML,
+		PrimaryField: []byte("<Assertion/>"),
+	}))
+	p = <-principals
+	require.Equal(t, "saml-user", p.Name)
+	require.Equal(t, pdu.UserIdentitySAML, p.IdentityType)
+	require.Error(t, echo(&UserIdentity{Type: pdu.UserIdentitySAML, PrimaryField: []byte("<Forged/>")}))
+
+	require.Error(t, echo(&UserIdentity{
+		Type:           pdu.UserIdentityUsernamePasscode,
+		PrimaryField:   []byte("alice"),
+		SecondaryField: []byte("wrong"),
+	}))
+	require.Error(t, echo(&UserIdentity{Type: pdu.UserIdentityKerberos, PrimaryField: []byte{1}}))
+	require.Error(t, echo(nil))
+
+	params.AllowAnonymous = true
+	require.NoError(t, sp.SetParams(params))
+	require.NoError(t, echo(nil))
+	require.Nil(t, <-principals)
+}
+
+func TestTokenIdentityCallback(t *testing.T) {
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		CEcho:         func(conn ConnectionState) dimse.Status { return dimse.Success },
+		Authenticator: testAuthenticator{},
+	}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+
+	clock := NewVirtualClock(time.Unix(0, 0))
+	fetches := 0
+	token := "token"
+	callback := NewTokenIdentityCallback(func() (string, time.Time, error) {
+		fetches++
+		return token, clock.Now().Add(10 * time.Minute), nil
+	}, TokenIdentityParams{Clock: clock})
+	echo := func() error {
+		su, err := NewServiceUser(ServiceUserParams{
+			SOPClasses:           sopclass.VerificationClasses,
+			UserIdentityCallback: callback,
+		})
+		require.NoError(t, err)
+		defer su.Release()
+		su.Connect(sp.ListenAddr().String())
+		return su.CEcho()
+	}
+	require.NoError(t, echo())
+	require.NoError(t, echo())
+	require.Equal(t, 1, fetches)
+
+	// The token is refreshed shortly before it expires.
+	token = "expired"
+	clock.Advance(9 * time.Minute)
+	require.Error(t, echo())
+	require.Equal(t, 2, fetches)
+
+	failing := NewTokenIdentityCallback(func() (string, time.Time, error) {
+		return "", time.Time{}, fmt.Errorf("identity provider unreachable")
+	}, TokenIdentityParams{})
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:           sopclass.VerificationClasses,
+		UserIdentityCallback: failing,
+	})
+	require.NoError(t, err)
+	su.Connect(sp.ListenAddr().String())
+	err = su.CEcho()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "identity provider unreachable")
+}
+
+// fakeGSSAPI issues and accepts tokens of the form "ticket:<service>:<client>".
+type fakeGSSAPI struct{ client string }
+
+func (g fakeGSSAPI) InitSecContext(servicePrincipal string) ([]byte, error) {
+	return []byte("ticket:" + servicePrincipal + ":" + g.client), nil
+}
+
+func (g fakeGSSAPI) AcceptSecContext(token []byte) (string, []byte, error) {
+	parts := strings.Split(string(token), ":")
+	if len(parts) != 3 || parts[0] != "ticket" || parts[1] != "dicom/pacs@HOSPITAL.ORG" {
+		return "", nil, fmt.Errorf("bad ticket %q", token)
+	}
+	return parts[2], []byte("mutual"), nil
+}
+
+func TestKerberosIdentity(t *testing.T) {
+	principals := make(chan *Principal, 1)
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		CEcho: func(conn ConnectionState) dimse.Status {
+			principals <- conn.Principal
+			return dimse.Success
+		},
+		Authenticator: KerberosAuthenticator{Acceptor: fakeGSSAPI{}},
+	}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+
+	connect := func(params ServiceUserParams) *ServiceUser {
+		params.SOPClasses = sopclass.VerificationClasses
+		su, err := NewServiceUser(params)
+		require.NoError(t, err)
+		su.Connect(sp.ListenAddr().String())
+		return su
+	}
+	su := connect(ServiceUserParams{
+		UserIdentityCallback: NewKerberosIdentityCallback(fakeGSSAPI{client: "alice@HOSPITAL.ORG"}, "dicom/pacs@HOSPITAL.ORG"),
+	})
+	require.NoError(t, su.CEcho())
+	p := <-principals
+	require.Equal(t, "alice@HOSPITAL.ORG", p.Name)
+	require.Equal(t, "HOSPITAL.ORG", p.Attributes["realm"])
+	require.Equal(t, pdu.UserIdentityKerberos, p.IdentityType)
+	response, err := su.UserIdentityResponse()
+	require.NoError(t, err)
+	require.Equal(t, "mutual", string(response))
+	su.Release()
+
+	// A ticket for another service, and other identity types, are
+	// rejected.
+	su = connect(ServiceUserParams{
+		UserIdentityCallback: NewKerberosIdentityCallback(fakeGSSAPI{client: "alice@HOSPITAL.ORG"}, "dicom/other@HOSPITAL.ORG"),
+	})
+	require.Error(t, su.CEcho())
+	su.Release()
+	su = connect(ServiceUserParams{
+		UserIdentity: &UserIdentity{Type: pdu.UserIdentityJWT, PrimaryField: []byte("token")},
+	})
+	require.Error(t, su.CEcho())
+	su.Release()
+}
+
+func TestDrain(t *testing.T) {
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		CEcho: func(conn ConnectionState) dimse.Status { return dimse.Success },
+	}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+
+	newUser := func() *ServiceUser {
+		su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.VerificationClasses})
+		require.NoError(t, err)
+		return su
+	}
+	su := newUser()
+	su.Connect(sp.ListenAddr().String())
+	require.NoError(t, su.CEcho())
+
+	drained := sp.Drain()
+	su2 := newUser()
+	su2.Connect(sp.ListenAddr().String())
+	require.Error(t, su2.CEcho())
+	su2.Release()
+
+	// The existing association keeps working.
+	require.NoError(t, su.CEcho())
+	select {
+	case <-drained:
+		t.Fatal("Drained with an open association")
+	case <-time.After(100 * time.Millisecond):
+	}
+	su.Release()
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for drain")
+	}
+
+	sp.CancelDrain()
+	su3 := newUser()
+	defer su3.Release()
+	su3.Connect(sp.ListenAddr().String())
+	require.NoError(t, su3.CEcho())
+}
+
+func TestAssociationsAndAbort(t *testing.T) {
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		CEcho: func(conn ConnectionState) dimse.Status { return dimse.Success },
+	}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+
+	su, err := NewServiceUser(ServiceUserParams{
+		CallingAETitle: "runaway",
+		SOPClasses:     sopclass.VerificationClasses})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	require.NoError(t, su.CEcho())
+
+	assocs := sp.Associations()
+	require.Len(t, assocs, 1)
+	require.Equal(t, "runaway", assocs[0].CallingAETitle)
+	require.GreaterOrEqual(t, assocs[0].Goroutines, 3)
+	require.Error(t, sp.Abort("nonexistent"))
+	require.NoError(t, sp.Abort(assocs[0].ID))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(sp.Associations()) > 0 {
+		require.True(t, time.Now().Before(deadline), "association not removed")
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Error(t, su.CEcho())
+}
+
+func TestConnectionStatePeer(t *testing.T) {
+	peerCh := make(chan Peer, 1)
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		CEcho: func(conn ConnectionState) dimse.Status {
+			peerCh <- conn.Peer
+			return dimse.Success
+		},
+	}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+
+	su, err := NewServiceUser(ServiceUserParams{
+		CalledAETitle:  "ARCHIVE",
+		CallingAETitle: "CT1",
+		SOPClasses:     sopclass.VerificationClasses})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	require.NoError(t, su.CEcho())
+
+	peer := <-peerCh
+	require.Equal(t, "127.0.0.1", peer.IP)
+	require.NotZero(t, peer.Port)
+	require.Equal(t, "CT1", peer.CallingAETitle)
+	require.Equal(t, "ARCHIVE", peer.CalledAETitle)
+	require.Equal(t, GoDICOMImplementationClassUID, peer.ImplementationClassUID)
+	require.Equal(t, GoDICOMImplementationVersionName, peer.ImplementationVersionName)
+	require.Equal(t, DefaultMaxPDUSize, peer.MaxPDUSize)
+	require.Equal(t, fmt.Sprintf("CT1@127.0.0.1:%d", peer.Port), peer.String())
+	require.Equal(t, "CT1", peer.Labels()["calling_ae"])
+
+	assocs := sp.Associations()
+	require.Len(t, assocs, 1)
+	require.Equal(t, peer, assocs[0].Peer)
+}
+
+func TestSetParamsAllowedCallingAETitles(t *testing.T) {
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		CEcho: func(conn ConnectionState) dimse.Status { return dimse.Success },
+	}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+
+	echo := func(callingAETitle string) error {
+		su, err := NewServiceUser(ServiceUserParams{
+			CallingAETitle: callingAETitle,
+			SOPClasses:     sopclass.VerificationClasses,
+		})
+		require.NoError(t, err)
+		defer su.Release()
+		su.Connect(sp.ListenAddr().String())
+		return su.CEcho()
+	}
+	require.NoError(t, echo("CT1"))
+	require.NoError(t, sp.SetParams(ServiceProviderParams{
+		CEcho:                  func(conn ConnectionState) dimse.Status { return dimse.Success },
+		AllowedCallingAETitles: []string{"MR1"},
+	}))
+	err = echo("CT1")
+	var rejected *AssociationRejectedError
+	require.True(t, errors.As(err, &rejected), "%v", err)
+	require.False(t, rejected.Transient())
+	require.Contains(t, err.Error(), "calling-AE-title-not-recognized")
+	require.NoError(t, echo("MR1"))
+	require.Error(t, sp.SetParams(ServiceProviderParams{TLSConfig: &tls.Config{}}))
+}
+
+// AE titles longer than 16 characters are rejected when the params are
+// checked, instead of being cut when sent.
+func TestAETitleTooLong(t *testing.T) {
+	const tooLong = "ABCDEFGHIJKLMNOPQ"
+	_, err := NewServiceUser(ServiceUserParams{CalledAETitle: tooLong, SOPClasses: sopclass.VerificationClasses})
+	require.Error(t, err)
+	_, err = NewServiceUser(ServiceUserParams{CallingAETitle: tooLong[:16], SOPClasses: sopclass.VerificationClasses})
+	require.NoError(t, err)
+	for _, params := range []ServiceProviderParams{
+		{AETitle: tooLong},
+		{AllowedCallingAETitles: []string{"CT1", tooLong}},
+		{CalledAETitles: []string{tooLong}},
+		{RemoteAEs: map[string]string{tooLong: "localhost:11112"}},
+	} {
+		_, err := NewServiceProvider(params, "localhost:0")
+		require.Error(t, err, "%+v", params)
+		require.Contains(t, err.Error(), "longer than 16 characters")
+	}
+}
+
+// Send "n" C-STOREs concurrently on one association to a provider created
+// with "params", and return the highest number of CStore handlers that ran at
+// once.
+func maxConcurrentCStores(t *testing.T, params ServiceProviderParams, n int) int {
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	params.CStore = func(conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID, calledAE, callingAE string, data []byte) dimse.Status {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return dimse.Success
+	}
+	sp, err := NewServiceProvider(params, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.StorageClasses})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			errs <- su.CStoreRaw(sopclass.StorageClasses[0], fmt.Sprintf("1.2.3.%d", i), uid.ImplicitVRLittleEndian, []byte("data"))
+		}(i)
+	}
+	for i := 0; i < n; i++ {
+		require.NoError(t, <-errs)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	return maxRunning
+}
+
+func TestHandlerExecution(t *testing.T) {
+	require.Equal(t, 1, maxConcurrentCStores(t, ServiceProviderParams{
+		HandlerExecution: HandlerExecutionModels{CStore: HandlerSequential},
+	}, 6))
+	require.Equal(t, 1, maxConcurrentCStores(t, ServiceProviderParams{
+		HandlerExecution: HandlerExecutionModels{CStore: HandlerInline},
+	}, 6))
+	require.LessOrEqual(t, maxConcurrentCStores(t, ServiceProviderParams{
+		HandlerExecution: HandlerExecutionModels{CStore: HandlerPool},
+		HandlerPoolSize:  2,
+	}, 6), 2)
+
+	_, err := NewServiceProvider(ServiceProviderParams{
+		HandlerExecution: HandlerExecutionModels{CGet: HandlerInline},
+	}, "localhost:0")
+	require.Error(t, err)
+}
+
+func TestOrderedCStore(t *testing.T) {
+	require.Equal(t, 1, maxConcurrentCStores(t, ServiceProviderParams{OrderedCStore: true}, 6))
+	require.Equal(t, 1, maxConcurrentCStores(t, ServiceProviderParams{
+		HandlerExecution: HandlerExecutionModels{CStore: HandlerPool},
+		HandlerPoolSize:  4,
+		OrderedCStore:    true,
+	}, 6))
+
+	// Requests sent back to back are handled, and answered, in the order
+	// they arrived, even though the later ones take less time.
+	const n = 6
+	ct := sopclass.StorageClasses[0]
+	handled := make(chan string, n)
+	p := newScriptedUser(t, ServiceProviderParams{
+		HandlerExecution: HandlerExecutionModels{CStore: HandlerPool},
+		HandlerPoolSize:  4,
+		OrderedCStore:    true,
+		CStore: func(conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID, calledAE, callingAE string, data []byte) dimse.Status {
+			var i int
+			fmt.Sscanf(sopInstanceUID, "1.2.3.%d", &i) // nolint: errcheck
+			time.Sleep(time.Duration(n-i) * 5 * time.Millisecond)
+			handled <- sopInstanceUID
+			return dimse.Success
+		},
+	})
+	p.sendAssociateRQ("SCRIPTED-USER", pctx(ct, uid.ImplicitVRLittleEndian))
+	p.expectAssociateAC(pctx(ct, uid.ImplicitVRLittleEndian))
+	var want []string
+	for i := 1; i <= n; i++ {
+		sopInstanceUID := fmt.Sprintf("1.2.3.%d", i)
+		want = append(want, sopInstanceUID)
+		p.sendDIMSE(ct, &dimse.CStoreRq{
+			AffectedSOPClassUID:    ct,
+			MessageID:              dimse.MessageID(i),
+			CommandDataSetType:     int(dimse.CommandDataSetTypeNonNull),
+			AffectedSOPInstanceUID: sopInstanceUID,
+		}, []byte{0x08, 0x00, 0x18, 0x00, 0x06, 0x00, 0x00, 0x00, '1', '.', '2', '.', '3', 0})
+	}
+	var got []string
+	for i := 1; i <= n; i++ {
+		_, msg, _ := p.expectDIMSE(dimse.CommandFieldCStoreRsp)
+		require.Equal(t, dimse.MessageID(i), msg.(*dimse.CStoreRsp).MessageIDBeingRespondedTo)
+		got = append(got, <-handled)
+	}
+	require.Equal(t, want, got)
+	p.sendReleaseRQ()
+	p.expectReleaseRP()
+}
+
+func TestMaxOpsPerformed(t *testing.T) {
+	require.LessOrEqual(t, maxConcurrentCStores(t, ServiceProviderParams{MaxOpsPerformed: 2}, 6), 2)
+	_, err := NewServiceProvider(ServiceProviderParams{MaxOpsPerformed: -1}, "localhost:0")
+	require.Error(t, err)
+
+	// A peer that ignores the window can't queue handlers without bound.
+	x := &handlerExecutor{maxOps: 1}
+	release := make(chan struct{})
+	require.True(t, x.run(nil, dimse.CommandFieldCEchoRq, func() { <-release }))
+	for i := 0; i < maxWaitingOpsFactor; i++ {
+		require.True(t, x.run(nil, dimse.CommandFieldCEchoRq, func() {}))
+	}
+	require.False(t, x.run(nil, dimse.CommandFieldCEchoRq, func() {}))
+	close(release)
+}
+
+func TestCStoreRouter(t *testing.T) {
+	const srClassUID = "1.2.840.10008.5.1.4.1.1.88.22" // Enhanced SR
+	const ctClassUID = "1.2.840.10008.5.1.4.1.1.2"     // CT image
+	const mrClassUID = "1.2.840.10008.5.1.4.1.1.4"     // MR image
+	handled := make(chan string, 2)
+	handler := func(name string) CStoreCallback {
+		return func(conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID, calledAE, callingAE string, data []byte) dimse.Status {
+			handled <- name
+			return dimse.Success
+		}
+	}
+	router := NewCStoreRouter()
+	router.HandleCategory(sopclass.StructuredReport, handler("sr"))
+	router.Handle(handler("ct"), ctClassUID)
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		CStoreHandlers: router,
+		Promiscuous:    true,
+	}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: []string{srClassUID, ctClassUID, mrClassUID}})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	require.NoError(t, su.CStoreRaw(srClassUID, "1.2.3.1", uid.ImplicitVRLittleEndian, []byte("data")))
+	require.Equal(t, "sr", <-handled)
+	require.NoError(t, su.CStoreRaw(ctClassUID, "1.2.3.2", uid.ImplicitVRLittleEndian, []byte("data")))
+	require.Equal(t, "ct", <-handled)
+	// Rejected during negotiation.
+	require.Error(t, su.CStoreRaw(mrClassUID, "1.2.3.3", uid.ImplicitVRLittleEndian, []byte("data")))
+}
+
+func TestULConn(t *testing.T) {
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		CEcho: func(conn ConnectionState) dimse.Status { return dimse.Success },
+	}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+
+	var trace []ULTraceEntry
+	c, err := DialUL(sp.ListenAddr().String(), ULConnParams{
+		Trace: func(e ULTraceEntry) { trace = append(trace, e) },
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(scriptTimeout))
+	require.Equal(t, ULStateAwaitingTransportOpen, c.State())
+
+	// P-DATA-TF isn't allowed before the association is accepted.
+	var illegal *IllegalPDUError
+	err = c.Send(&pdu.PDataTf{})
+	require.True(t, errors.As(err, &illegal), "unexpected error: %v", err)
+	require.True(t, illegal.Sent)
+	require.Equal(t, ULStateAwaitingTransportOpen, c.State())
+
+	require.NoError(t, c.Send(&pdu.AAssociate{
+		Type:            pdu.TypeAAssociateRq,
+		ProtocolVersion: pdu.CurrentProtocolVersion,
+		CalledAETitle:   "PROVIDER",
+		CallingAETitle:  "ULCONN",
+		Items: []pdu.SubItem{
+			&pdu.ApplicationContextItem{Name: pdu.DICOMApplicationContextItemName},
+			&pdu.PresentationContextItem{
+				Type:      pdu.ItemTypePresentationContextRequest,
+				ContextID: 1,
+				Items: []pdu.SubItem{
+					&pdu.AbstractSyntaxSubItem{Name: uid.VerificationSOPClass},
+					&pdu.TransferSyntaxSubItem{Name: uid.ImplicitVRLittleEndian},
+				},
+			},
+			&pdu.UserInformationItem{Items: []pdu.SubItem{
+				&pdu.UserInformationMaximumLengthItem{MaximumLengthReceived: uint32(DefaultMaxPDUSize)}}},
+		},
+	}))
+	require.Equal(t, ULStateAwaitingAssociateResponse, c.State())
+	v, err := c.Receive()
+	require.NoError(t, err)
+	require.Equal(t, pdu.TypeAAssociateAc, v.(*pdu.AAssociate).Type)
+	require.Equal(t, ULStateAssociated, c.State())
+
+	err = c.Send(&pdu.AReleaseRp{})
+	require.True(t, errors.As(err, &illegal), "unexpected error: %v", err)
+
+	require.NoError(t, c.Send(&pdu.AReleaseRq{}))
+	require.Equal(t, ULStateAwaitingReleaseRP, c.State())
+	v, err = c.Receive()
+	require.NoError(t, err)
+	require.IsType(t, &pdu.AReleaseRp{}, v)
+	require.Equal(t, ULStateIdle, c.State())
+
+	var actions []string
+	for _, e := range trace {
+		actions = append(actions, e.Action)
+	}
+	require.Equal(t, []string{"AE-2", "AE-3", "AR-1", "AR-3"}, actions)
+}
+
+// Create a self-signed certificate for localhost.
+func newTestCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestTLS(t *testing.T) {
+	cert, pool := newTestCertificate(t)
+	assocErrs := make(chan error, 1)
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		CEcho:            func(conn ConnectionState) dimse.Status { return dimse.Success },
+		TLSConfig:        &tls.Config{Certificates: []tls.Certificate{cert}},
+		AssociationError: func(conn ConnectionState, err error) { assocErrs <- err },
+	}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+
+	echo := func(config *tls.Config) error {
+		su, err := NewServiceUser(ServiceUserParams{
+			SOPClasses: sopclass.VerificationClasses,
+			TLSConfig:  config,
+		})
+		require.NoError(t, err)
+		defer su.Release()
+		su.Connect(sp.ListenAddr().String())
+		return su.CEcho()
+	}
+	require.NoError(t, echo(&tls.Config{RootCAs: pool}))
+
+	// The user doesn't trust the provider's certificate.
+	err = echo(&tls.Config{RootCAs: x509.NewCertPool()})
+	var handshakeErr *TLSHandshakeError
+	require.True(t, errors.As(err, &handshakeErr), "%v", err)
+	var certErr x509.UnknownAuthorityError
+	require.True(t, errors.As(err, &certErr), "%v", err)
+	select {
+	case err := <-assocErrs:
+		require.True(t, errors.As(err, &handshakeErr), "%v", err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("AssociationError not called")
+	}
+}
+
+// Shutdown cancels the contexts of the handlers still running, and Run
+// returns.
+func TestShutdown(t *testing.T) {
+	started := make(chan context.Context, 1)
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		CEcho: func(conn ConnectionState) dimse.Status {
+			started <- conn.Context()
+			<-conn.Context().Done()
+			return dimse.Success
+		},
+	}, "localhost:0")
+	require.NoError(t, err)
+	runDone := make(chan struct{})
+	go func() {
+		sp.Run()
+		close(runDone)
+	}()
+
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.VerificationClasses})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	echoErr := make(chan error, 1)
+	go func() { echoErr <- su.CEcho() }()
+	ctx := <-started
+	require.NoError(t, ctx.Err())
+
+	require.NoError(t, sp.Shutdown())
+	require.Equal(t, context.Canceled, ctx.Err())
+	require.Error(t, <-echoErr)
+	select {
+	case <-runDone:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run didn't return")
+	}
+}
+
+// A user whose peer never answers A-ASSOCIATE-RQ gives up when the ARTIM timer
+// expires.
+func TestARTIMTimerExpiryUser(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(io.Discard, conn) // nolint: errcheck
+	}()
+
+	clock := NewVirtualClock(time.Time{})
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:   sopclass.VerificationClasses,
+		Clock:        clock,
+		ARTIMTimeout: 3 * time.Second,
+	})
+	require.NoError(t, err)
+	defer su.Release() // nolint: errcheck
+	require.NoError(t, su.ConnectContext(context.Background(), l.Addr().String()))
+	clock.BlockUntil(1)
+	clock.Advance(3 * time.Second)
+	// The user sends A-ABORT, and restarts the timer for the peer to close
+	// the connection, which it doesn't.
+	clock.BlockUntil(1)
+	clock.Advance(3 * time.Second)
+	require.Error(t, su.CEcho())
+}
+
+// A private user information sub-item of A-ASSOCIATE-RQ reaches the provider,
+// and the provider's answer reaches the user, both unchanged.
+func TestUserInformationItems(t *testing.T) {
+	requests := make(chan AssociateRequest, 1)
+	local, remote := net.Pipe()
+	go RunProviderForConn(remote, ServiceProviderParams{
+		CEcho: onCEchoRequest,
+		UserInformationReply: func(rq AssociateRequest) []pdu.SubItem {
+			requests <- rq
+			for _, item := range rq.UserInformation {
+				if v, ok := item.(*pdu.SubItemUnsupported); ok && v.Type == 0xe0 {
+					return []pdu.SubItem{&pdu.SubItemUnsupported{Type: 0xe1, Data: append([]byte("re: "), v.Data...)}}
+				}
+			}
+			return nil
+		},
+	})
+	private := &pdu.SubItemUnsupported{Type: 0xe0, Data: []byte("hello")}
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:           sopclass.VerificationClasses,
+		UserInformationItems: []pdu.SubItem{private},
+	})
+	require.NoError(t, err)
+	su.SetConn(local)
+	require.NoError(t, su.CEcho())
+
+	rq := <-requests
+	require.Contains(t, rq.UserInformation, pdu.SubItem(private))
+	ac, err := su.AssociateAC()
+	require.NoError(t, err)
+	var reply *pdu.SubItemUnsupported
+	for _, item := range ac.Items {
+		if ui, ok := item.(*pdu.UserInformationItem); ok {
+			for _, subItem := range ui.Items {
+				if v, ok := subItem.(*pdu.SubItemUnsupported); ok {
+					reply = v
+				}
+			}
+		}
+	}
+	require.Equal(t, &pdu.SubItemUnsupported{Type: 0xe1, Data: []byte("re: hello")}, reply)
+	require.NoError(t, su.Release())
+
+	_, err = NewServiceUser(ServiceUserParams{
+		SOPClasses:           sopclass.VerificationClasses,
+		UserInformationItems: []pdu.SubItem{&pdu.SubItemUnsupported{Type: 0xe0, Data: make([]byte, 0x10000)}},
+	})
+	require.Error(t, err)
+}
+
+// ShutdownContext stops accepting connections, and returns once the
+// associations in progress are released, or aborts them when its context ends.
+func TestShutdownContext(t *testing.T) {
+	for _, release := range []bool{true, false} {
+		sp, err := NewServiceProvider(ServiceProviderParams{
+			CEcho: func(conn ConnectionState) dimse.Status { return dimse.Success },
+		}, "localhost:0")
+		require.NoError(t, err)
+		runDone := make(chan struct{})
+		go func() {
+			sp.Run()
+			close(runDone)
+		}()
+		su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.VerificationClasses})
+		require.NoError(t, err)
+		su.Connect(sp.ListenAddr().String())
+		require.NoError(t, su.CEcho())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		errCh := make(chan error, 1)
+		go func() { errCh <- sp.ShutdownContext(ctx) }()
+		<-runDone
+		_, err = net.Dial("tcp", sp.ListenAddr().String())
+		require.Error(t, err)
+		if release {
+			// The association in progress keeps working.
+			require.NoError(t, su.CEcho())
+			require.NoError(t, su.Release())
+			require.NoError(t, <-errCh)
+		} else {
+			require.ErrorIs(t, <-errCh, context.DeadlineExceeded)
+			require.Error(t, su.CEcho())
+			su.Release()
+		}
+		cancel()
+	}
+}
+
+// ShutdownContext returns when its context ends, even if a handler ignores
+// ConnectionState.Context.
+func TestShutdownContextStuckHandler(t *testing.T) {
+	started, unblock := make(chan struct{}), make(chan struct{})
+	defer close(unblock)
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		CEcho: func(conn ConnectionState) dimse.Status {
+			close(started)
+			<-unblock
+			return dimse.Success
+		},
+	}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.VerificationClasses})
+	require.NoError(t, err)
+	defer su.Release() // nolint: errcheck
+	su.Connect(sp.ListenAddr().String())
+	echoErr := make(chan error, 1)
+	go func() { echoErr <- su.CEcho() }()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	errCh := make(chan error, 1)
+	go func() { errCh <- sp.ShutdownContext(ctx) }()
+	select {
+	case err := <-errCh:
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+	case <-time.After(5 * time.Second):
+		t.Fatal("ShutdownContext didn't return after its deadline")
+	}
+	require.Error(t, <-echoErr)
+}
@@ -0,0 +1,259 @@
+package netdicom
+
+// This file implements EventBus, which notifies subscribers of the instances
+// and associations handled by a ServiceProvider.
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	dicomtag "github.com/antibios/dicom/pkg/tag"
+	"github.com/antibios/go-dicom/dicomlog"
+)
+
+// EventType identifies the kind of an Event.
+type EventType int
+
+const (
+	// EventInstanceReceived is sent when CStore accepts an instance.
+	EventInstanceReceived EventType = iota
+
+	// EventStudyComplete is sent when no instance of a study has arrived for
+	// the bus's quiescence period.
+	EventStudyComplete
+
+	// EventAssociationClosed is sent when an association ends, whether it
+	// was released or aborted.
+	EventAssociationClosed
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventInstanceReceived:
+		return "InstanceReceived"
+	case EventStudyComplete:
+		return "StudyComplete"
+	case EventAssociationClosed:
+		return "AssociationClosed"
+	}
+	return "EventType(?)"
+}
+
+// Event describes something that happened in a ServiceProvider.
+type Event struct {
+	Type EventType
+
+	// The connection that caused the event. Unset for EventStudyComplete.
+	Conn ConnectionState
+
+	// Set for EventInstanceReceived.
+	TransferSyntaxUID string
+	SOPClassUID       string
+	SOPInstanceUID    string
+
+	// Set for EventInstanceReceived, if the dataset carries them before its
+	// first sequence.
+	SeriesInstanceUID string
+	Modality          string
+	PatientID         string
+
+	// Set for EventInstanceReceived: NumberOfSeriesRelatedInstances, or 0 if
+	// the dataset doesn't carry it before its first sequence.
+	NumberOfSeriesRelatedInstances int
+
+	// Set for EventInstanceReceived and EventStudyComplete.
+	StudyInstanceUID string
+
+	// Set for EventStudyComplete: number of instances received since the
+	// study last became quiescent.
+	NumInstances int
+
+	// Set for EventAssociationClosed: nil if the association was released,
+	// otherwise why it ended (see AssociationErrorCallback).
+	Err error
+
+	// Set for EventAssociationClosed: the presentation contexts accepted,
+	// and how much each was used. Empty if the association wasn't accepted.
+	Contexts []ContextUsage
+}
+
+// EventBus distributes provider events to subscribers. Set it in
+// ServiceProviderParams.Events. It is thread safe.
+type EventBus struct {
+	quiescence time.Duration
+
+	mu      sync.Mutex
+	subs    []chan Event
+	studies map[string]*studyState // keyed by StudyInstanceUID
+	closed  bool
+}
+
+// Tracks a study for the completion heuristic.
+type studyState struct {
+	timer        *time.Timer
+	numInstances int
+}
+
+// NewEventBus creates an EventBus. If studyQuiescence is positive, an
+// EventStudyComplete is sent once no instance of a study has arrived for that
+// long. Otherwise, no EventStudyComplete is sent.
+func NewEventBus(studyQuiescence time.Duration) *EventBus {
+	return &EventBus{
+		quiescence: studyQuiescence,
+		studies:    map[string]*studyState{},
+	}
+}
+
+// Subscribe returns a channel that receives every event published after the
+// call. Events are dropped, rather than delay the provider, when the channel
+// has no room; bufSize should be large enough to absorb bursts.
+func (b *EventBus) Subscribe(bufSize int) <-chan Event {
+	ch := make(chan Event, bufSize)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(ch)
+		return ch
+	}
+	b.subs = append(b.subs, ch)
+	return ch
+}
+
+// Unsubscribe closes a channel returned by Subscribe.
+func (b *EventBus) Unsubscribe(ch <-chan Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, sub := range b.subs {
+		if sub == ch {
+			close(sub)
+			b.subs = append(b.subs[:i], b.subs[i+1:]...)
+			return
+		}
+	}
+}
+
+// Close stops the study timers and closes every subscribed channel. Pending
+// EventStudyComplete events are not sent.
+func (b *EventBus) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	b.closed = true
+	for _, st := range b.studies {
+		st.timer.Stop()
+	}
+	b.studies = nil
+	for _, sub := range b.subs {
+		close(sub)
+	}
+	b.subs = nil
+}
+
+// Send "e" to the subscribers. Requires b.mu.
+func (b *EventBus) publishLocked(e Event) {
+	if b.closed {
+		return
+	}
+	for _, sub := range b.subs {
+		select {
+		case sub <- e:
+		default:
+			dicomlog.Vprintf(0, "dicom.EventBus: subscriber is full; dropping %v event", e.Type)
+		}
+	}
+}
+
+func (b *EventBus) publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.publishLocked(e)
+	if e.Type == EventInstanceReceived && e.StudyInstanceUID != "" && b.quiescence > 0 && !b.closed {
+		b.touchStudyLocked(e.StudyInstanceUID)
+	}
+}
+
+// Restart the idle timer for the study. Requires b.mu.
+func (b *EventBus) touchStudyLocked(studyUID string) {
+	st, ok := b.studies[studyUID]
+	if !ok {
+		st = &studyState{}
+		b.studies[studyUID] = st
+		st.timer = time.AfterFunc(b.quiescence, func() { b.onStudyQuiescent(studyUID, st) })
+	} else {
+		st.timer.Reset(b.quiescence)
+	}
+	st.numInstances++
+}
+
+func (b *EventBus) onStudyQuiescent(studyUID string, st *studyState) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.studies[studyUID] != st {
+		return // The bus was closed.
+	}
+	delete(b.studies, studyUID)
+	b.publishLocked(Event{
+		Type:             EventStudyComplete,
+		StudyInstanceUID: studyUID,
+		NumInstances:     st.numInstances,
+	})
+}
+
+// Max bytes of a streamed dataset kept for publishInstance. The elements it
+// reads come early in the dataset.
+const maxEventHeadBytes = 64 << 10
+
+// headRecorder passes a streamed dataset through, keeping its first bytes, up
+// to maxEventHeadBytes, for publishInstance.
+type headRecorder struct {
+	r    io.Reader
+	head []byte
+}
+
+func (h *headRecorder) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	if room := maxEventHeadBytes - len(h.head); room > 0 {
+		if room > n {
+			room = n
+		}
+		h.head = append(h.head, p[:room]...)
+	}
+	return n, err
+}
+
+// Publish EventInstanceReceived for a C-STORE dataset. For a streamed one,
+// "data" is its head, as kept by headRecorder.
+func (b *EventBus) publishInstance(conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) {
+	e := Event{
+		Type:              EventInstanceReceived,
+		Conn:              conn,
+		TransferSyntaxUID: transferSyntaxUID,
+		SOPClassUID:       sopClassUID,
+		SOPInstanceUID:    sopInstanceUID,
+	}
+	fields := map[dicomtag.Tag]*string{
+		dicomtag.Modality:          &e.Modality,
+		dicomtag.PatientID:         &e.PatientID,
+		dicomtag.StudyInstanceUID:  &e.StudyInstanceUID,
+		dicomtag.SeriesInstanceUID: &e.SeriesInstanceUID,
+	}
+	// Stop right after NumberOfSeriesRelatedInstances (0020,1209).
+	elems, _ := shallowParseElements(transferSyntaxUID, data, dicomtag.Tag{Group: 0x0020, Element: 0x120A})
+	for _, elem := range elems {
+		v, ok := elem.Value.GetValue().([]string)
+		if !ok || len(v) == 0 {
+			continue
+		}
+		if field, ok := fields[elem.Tag]; ok {
+			*field = v[0]
+		} else if elem.Tag == dicomtag.NumberOfSeriesRelatedInstances {
+			e.NumberOfSeriesRelatedInstances, _ = strconv.Atoi(strings.TrimSpace(v[0]))
+		}
+	}
+	b.publish(e)
+}
@@ -3,6 +3,7 @@ package netdicom
 import (
 	"fmt"
 	"math"
+	"sync"
 )
 
 type faultInjectorAction int
@@ -19,35 +20,65 @@ type faultInjectorStateTransition struct {
 }
 
 // FaultInjector is a unittest helper. It's used by the statemachine to inject
-// faults.
+// faults, and it observes every state transition. Set it in
+// ServiceUserParams.FaultInjector or ServiceProviderParams.FaultInjector.
 type FaultInjector interface {
 	fmt.Stringer
 	// Called when an "event" happens when at "oldState" and transitions to
 	// "newState"
 	onStateTransition(oldState stateType, event *stateEvent, action *stateAction, newState stateType)
 	onSend(data []byte) faultInjectorAction
+	// Called after "data" is sent. Returns encoded PDUs to send right
+	// after it, e.g., to inject traffic the peer doesn't expect.
+	afterSend(data []byte) [][]byte
 }
 
 // SetUserFaultInjector sets the fault injector to be used by all user (client)
-// side statemachines.
+// side statemachines whose ServiceUserParams.FaultInjector is nil.
+//
+// Deprecated: Set ServiceUserParams.FaultInjector instead. The global
+// injector is shared by every test in the process, so parallel tests
+// interfere.
 func SetUserFaultInjector(f FaultInjector) {
+	faultsMu.Lock()
 	userFaults = f
+	faultsMu.Unlock()
 }
 
 // SetProviderFaultInjector sets the fault injector to be used by all provider
-// (server) side statemachines.
+// (server) side statemachines whose ServiceProviderParams.FaultInjector is
+// nil.
+//
+// Deprecated: Set ServiceProviderParams.FaultInjector instead.
 func SetProviderFaultInjector(f FaultInjector) {
+	faultsMu.Lock()
 	providerFaults = f
+	faultsMu.Unlock()
 }
 
 func getUserFaultInjector() FaultInjector {
+	faultsMu.Lock()
+	defer faultsMu.Unlock()
 	return userFaults
 }
 func getProviderFaultInjector() FaultInjector {
+	faultsMu.Lock()
+	defer faultsMu.Unlock()
 	return providerFaults
 }
 
-var userFaults, providerFaults FaultInjector
+// Returns f, or the global injector if f is nil.
+func faultInjectorOrDefault(f, global FaultInjector) FaultInjector {
+	if f != nil {
+		return f
+	}
+	return global
+}
+
+var (
+	faultsMu                   sync.Mutex
+	userFaults, providerFaults FaultInjector // guarded by faultsMu
+)
 
 // fuzzFaultInjector is used by fuzz tests to inject faults somewhat
 // deterministically.
@@ -121,6 +152,10 @@ func (f *fuzzFaultInjector) onSend(data []byte) faultInjectorAction {
 	return faultInjectorContinue
 }
 
+func (f *fuzzFaultInjector) afterSend(data []byte) [][]byte {
+	return nil
+}
+
 func (f *fuzzFaultInjector) String() string {
 	s := "statehistory:{"
 	for i, e := range f.stateHistory {
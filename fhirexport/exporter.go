@@ -0,0 +1,175 @@
+package fhirexport
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/antibios/go-dicom/dicomlog"
+	"github.com/antibios/go-netdicom"
+)
+
+// Exporter consumes netdicom events and posts an ImagingStudy for each
+// completed study.
+type Exporter struct {
+	// Endpoint is the FHIR base URL. Resources are POSTed to
+	// Endpoint + "/ImagingStudy".
+	Endpoint string
+
+	// Client sends the requests. If nil, http.DefaultClient is used.
+	Client *http.Client
+
+	// Header, if non-nil, is added to each request, e.g., for
+	// "Authorization".
+	Header http.Header
+
+	// MaxAttempts bounds the number of tries for each study. If zero,
+	// DefaultMaxAttempts is used.
+	MaxAttempts int
+
+	// Backoff is the delay before the first retry. It doubles on each
+	// retry. If zero, DefaultBackoff is used.
+	Backoff time.Duration
+
+	// Transform, if non-nil, is called on each resource before it is sent,
+	// e.g., to set the subject reference to a Patient resource.
+	Transform func(s *Study, is *ImagingStudy)
+
+	// OnError, if non-nil, is called when a study could not be exported
+	// after MaxAttempts.
+	OnError func(s *Study, err error)
+
+	mu      sync.Mutex
+	studies map[string]*Study
+	wg      sync.WaitGroup
+}
+
+const (
+	// DefaultMaxAttempts is the default value of Exporter.MaxAttempts.
+	DefaultMaxAttempts = 5
+
+	// DefaultBackoff is the default value of Exporter.Backoff.
+	DefaultBackoff = time.Second
+)
+
+// Run consumes "events" until the channel is closed, and then waits for the
+// pending exports to finish. It is typically given the result of
+// netdicom.EventBus.Subscribe.
+func (e *Exporter) Run(events <-chan netdicom.Event) {
+	for ev := range events {
+		e.handleEvent(ev)
+	}
+	e.wg.Wait()
+}
+
+func (e *Exporter) handleEvent(ev netdicom.Event) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.studies == nil {
+		e.studies = map[string]*Study{}
+	}
+	switch ev.Type {
+	case netdicom.EventInstanceReceived:
+		if ev.StudyInstanceUID == "" {
+			return
+		}
+		s, ok := e.studies[ev.StudyInstanceUID]
+		if !ok {
+			s = &Study{StudyInstanceUID: ev.StudyInstanceUID, Series: map[string]*Series{}}
+			e.studies[ev.StudyInstanceUID] = s
+		}
+		if s.PatientID == "" {
+			s.PatientID = ev.PatientID
+		}
+		series, ok := s.Series[ev.SeriesInstanceUID]
+		if !ok {
+			series = &Series{SeriesInstanceUID: ev.SeriesInstanceUID, Modality: ev.Modality, Instances: map[string]string{}}
+			s.Series[ev.SeriesInstanceUID] = series
+		}
+		series.Instances[ev.SOPInstanceUID] = ev.SOPClassUID
+	case netdicom.EventStudyComplete:
+		s, ok := e.studies[ev.StudyInstanceUID]
+		if !ok {
+			return
+		}
+		delete(e.studies, ev.StudyInstanceUID)
+		e.wg.Add(1)
+		go func() {
+			defer e.wg.Done()
+			if err := e.Export(s); err != nil {
+				dicomlog.Vprintf(0, "fhirexport: study %s: %v", s.StudyInstanceUID, err)
+				if e.OnError != nil {
+					e.OnError(s, err)
+				}
+			}
+		}()
+	}
+}
+
+// Export posts the ImagingStudy for "s", retrying on transport errors, 429,
+// and 5xx responses.
+func (e *Exporter) Export(s *Study) error {
+	is := NewImagingStudy(s)
+	if e.Transform != nil {
+		e.Transform(s, is)
+	}
+	body, err := json.Marshal(is)
+	if err != nil {
+		return err
+	}
+	maxAttempts := e.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultMaxAttempts
+	}
+	backoff := e.Backoff
+	if backoff <= 0 {
+		backoff = DefaultBackoff
+	}
+	for attempt := 1; ; attempt++ {
+		retry, err := e.post(body)
+		if err == nil {
+			dicomlog.Vprintf(1, "fhirexport: exported study %s", s.StudyInstanceUID)
+			return nil
+		}
+		if !retry || attempt >= maxAttempts {
+			return fmt.Errorf("fhirexport: giving up after %d attempt(s): %w", attempt, err)
+		}
+		dicomlog.Vprintf(0, "fhirexport: study %s: attempt %d: %v; retrying in %v", s.StudyInstanceUID, attempt, err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// Send one request. Returns whether a failure is worth retrying.
+func (e *Exporter) post(body []byte) (bool, error) {
+	req, err := http.NewRequest("POST", strings.TrimRight(e.Endpoint, "/")+"/ImagingStudy", bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	for k, v := range e.Header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/fhir+json")
+	client := e.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return false, nil
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	err = fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode/100 == 5, err
+}
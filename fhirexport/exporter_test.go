@@ -0,0 +1,83 @@
+package fhirexport
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/antibios/go-netdicom"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExporter(t *testing.T) {
+	// The handler reports each request to the test goroutine, which checks
+	// it.
+	type request struct {
+		path, contentType string
+		study             ImagingStudy
+		err               error
+	}
+	var attempts int
+	requests := make(chan request, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := request{path: r.URL.Path, contentType: r.Header.Get("Content-Type")}
+		attempts++
+		if attempts == 1 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			requests <- req
+			return
+		}
+		req.err = json.NewDecoder(r.Body).Decode(&req.study)
+		w.WriteHeader(http.StatusCreated)
+		requests <- req
+	}))
+	defer server.Close()
+
+	events := make(chan netdicom.Event, 8)
+	for _, uid := range []string{"1.2.3.4.2", "1.2.3.4.1"} {
+		events <- netdicom.Event{
+			Type:              netdicom.EventInstanceReceived,
+			SOPClassUID:       "1.2.840.10008.5.1.4.1.1.2",
+			SOPInstanceUID:    uid,
+			StudyInstanceUID:  "1.2.3",
+			SeriesInstanceUID: "1.2.3.4",
+			Modality:          "CT",
+			PatientID:         "PAT001",
+		}
+	}
+	events <- netdicom.Event{Type: netdicom.EventStudyComplete, StudyInstanceUID: "1.2.3"}
+	close(events)
+	exp := &Exporter{Endpoint: server.URL + "/", Backoff: time.Millisecond}
+	exp.Run(events)
+
+	var is ImagingStudy
+	for i := 0; i < 2; i++ {
+		req := <-requests
+		require.Equal(t, "/ImagingStudy", req.path)
+		require.Equal(t, "application/fhir+json", req.contentType)
+		require.NoError(t, req.err)
+		is = req.study
+	}
+	require.Equal(t, 2, attempts)
+	require.Equal(t, "ImagingStudy", is.ResourceType)
+	require.Equal(t, "urn:oid:1.2.3", is.Identifier[0].Value)
+	require.Equal(t, "PAT001", is.Subject.Identifier.Value)
+	require.Equal(t, 1, is.NumberOfSeries)
+	require.Equal(t, 2, is.NumberOfInstances)
+	require.Equal(t, "CT", is.Series[0].Modality.Code)
+	require.Equal(t, "1.2.3.4.1", is.Series[0].Instance[0].UID)
+	require.Equal(t, "urn:oid:1.2.840.10008.5.1.4.1.1.2", is.Series[0].Instance[0].SOPClass.Code)
+}
+
+func TestExporterGivesUp(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad resource", http.StatusBadRequest)
+	}))
+	defer server.Close()
+	exp := &Exporter{Endpoint: server.URL, Backoff: time.Millisecond}
+	err := exp.Export(&Study{StudyInstanceUID: "1.2.3"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "1 attempt")
+}
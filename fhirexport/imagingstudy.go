@@ -0,0 +1,116 @@
+// Package fhirexport posts a FHIR R4 ImagingStudy resource for each study a
+// netdicom.ServiceProvider receives, so that EHR integrations can reference
+// the images without scraping the archive.
+//
+//	bus := netdicom.NewEventBus(time.Minute)
+//	exp := &fhirexport.Exporter{Endpoint: "https://fhir.example.com/r4"}
+//	go exp.Run(bus.Subscribe(1024))
+//	params := netdicom.ServiceProviderParams{Events: bus, ...}
+package fhirexport
+
+import (
+	"sort"
+)
+
+// Study accumulates the instances of one study, as reported by
+// netdicom.EventInstanceReceived events.
+type Study struct {
+	StudyInstanceUID string
+	PatientID        string
+	Series           map[string]*Series // keyed by SeriesInstanceUID
+}
+
+// Series is one series within a Study.
+type Series struct {
+	SeriesInstanceUID string
+	Modality          string
+	Instances         map[string]string // SOPInstanceUID -> SOPClassUID
+}
+
+// ImagingStudy is the subset of the FHIR R4 ImagingStudy resource that can be
+// filled from the C-STORE stream. https://hl7.org/fhir/R4/imagingstudy.html
+type ImagingStudy struct {
+	ResourceType      string               `json:"resourceType"`
+	Identifier        []Identifier         `json:"identifier"`
+	Status            string               `json:"status"`
+	Subject           Reference            `json:"subject"`
+	NumberOfSeries    int                  `json:"numberOfSeries"`
+	NumberOfInstances int                  `json:"numberOfInstances"`
+	Series            []ImagingStudySeries `json:"series,omitempty"`
+}
+
+// ImagingStudySeries is ImagingStudy.series.
+type ImagingStudySeries struct {
+	UID               string                 `json:"uid"`
+	Modality          Coding                 `json:"modality"`
+	NumberOfInstances int                    `json:"numberOfInstances"`
+	Instance          []ImagingStudyInstance `json:"instance,omitempty"`
+}
+
+// ImagingStudyInstance is ImagingStudy.series.instance.
+type ImagingStudyInstance struct {
+	UID      string `json:"uid"`
+	SOPClass Coding `json:"sopClass"`
+}
+
+// Identifier is the FHIR Identifier datatype.
+type Identifier struct {
+	System string `json:"system,omitempty"`
+	Value  string `json:"value"`
+}
+
+// Reference is the FHIR Reference datatype.
+type Reference struct {
+	Reference  string      `json:"reference,omitempty"`
+	Identifier *Identifier `json:"identifier,omitempty"`
+	Display    string      `json:"display,omitempty"`
+}
+
+// Coding is the FHIR Coding datatype.
+type Coding struct {
+	System string `json:"system,omitempty"`
+	Code   string `json:"code"`
+}
+
+// Code systems. https://hl7.org/fhir/R4/terminologies-systems.html
+const (
+	dicomUIDSystem = "urn:dicom:uid"
+	dicomDCMSystem = "http://dicom.nema.org/resources/ontology/DCM"
+	uriSystem      = "urn:ietf:rfc:3986"
+)
+
+// NewImagingStudy maps a Study to an ImagingStudy. Series and instances are
+// sorted by UID so that the output is deterministic. The subject refers to
+// the patient by identifier, since the DICOM patient ID is all that is known.
+func NewImagingStudy(s *Study) *ImagingStudy {
+	is := &ImagingStudy{
+		ResourceType: "ImagingStudy",
+		Identifier: []Identifier{{
+			System: dicomUIDSystem,
+			Value:  "urn:oid:" + s.StudyInstanceUID,
+		}},
+		Status: "available",
+		Subject: Reference{
+			Identifier: &Identifier{Value: s.PatientID},
+		},
+	}
+	for _, series := range s.Series {
+		iss := ImagingStudySeries{
+			UID:               series.SeriesInstanceUID,
+			Modality:          Coding{System: dicomDCMSystem, Code: series.Modality},
+			NumberOfInstances: len(series.Instances),
+		}
+		for uid, sopClassUID := range series.Instances {
+			iss.Instance = append(iss.Instance, ImagingStudyInstance{
+				UID:      uid,
+				SOPClass: Coding{System: uriSystem, Code: "urn:oid:" + sopClassUID},
+			})
+		}
+		sort.Slice(iss.Instance, func(i, j int) bool { return iss.Instance[i].UID < iss.Instance[j].UID })
+		is.Series = append(is.Series, iss)
+		is.NumberOfInstances += iss.NumberOfInstances
+	}
+	sort.Slice(is.Series, func(i, j int) bool { return is.Series[i].UID < is.Series[j].UID })
+	is.NumberOfSeries = len(is.Series)
+	return is
+}
@@ -12,7 +12,6 @@ import (
 )
 
 func startServer(faults netdicom.FaultInjector) net.Listener {
-	netdicom.SetProviderFaultInjector(faults)
 	listener, err := net.Listen("tcp", ":0")
 	if err != nil {
 		log.Panic(err)
@@ -20,6 +19,7 @@ func startServer(faults netdicom.FaultInjector) net.Listener {
 	go func() {
 		// TODO(saito) test w/ small PDU.
 		params := netdicom.ServiceProviderParams{
+			FaultInjector: faults,
 			CStore: func(
 				connState netdicom.ConnectionState,
 				transferSyntaxUID string,
@@ -53,8 +53,10 @@ func runClient(serverAddr string, faults netdicom.FaultInjector) {
 	if err != nil {
 		log.Fatal(err)
 	}
-	netdicom.SetUserFaultInjector(faults)
-	su, err := netdicom.NewServiceUser(netdicom.ServiceUserParams{SOPClasses: sopclass.StorageClasses})
+	su, err := netdicom.NewServiceUser(netdicom.ServiceUserParams{
+		SOPClasses:    sopclass.StorageClasses,
+		FaultInjector: faults,
+	})
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -24,7 +24,7 @@ func Fuzz(data []byte) int {
 			panic(err)
 		}
 
-		dimse.ReadMessage(d)
+		dimse.ReadMessage(d) // nolint: errcheck
 	}
 	return 0
 }
@@ -0,0 +1,262 @@
+package netdicom
+
+// This file implements the execution models of the ServiceProvider handlers.
+// See HandlerExecution.
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/antibios/go-netdicom/dimse"
+)
+
+// HandlerExecution selects how a ServiceProvider runs the handler of one type
+// of DIMSE request. Whatever the model, the data of each request is received
+// in full before its handler starts.
+type HandlerExecution int
+
+const (
+	// HandlerPerRequest runs each request in a new goroutine. Requests on
+	// one association may run concurrently, and finish in any order. This
+	// is the default.
+	HandlerPerRequest HandlerExecution = iota
+
+	// HandlerSequential runs the requests that arrive on one association
+	// one at a time, in arrival order, on a goroutine of the association.
+	// Every type set to HandlerSequential shares the same queue, so, e.g.,
+	// a C-ECHO waits for the C-STOREs that arrived before it. Messages keep
+	// being received while the queue drains.
+	HandlerSequential
+
+	// HandlerPool runs requests on a pool shared by all the associations of
+	// the provider. At most ServiceProviderParams.HandlerPoolSize handlers
+	// of the types set to HandlerPool run at once; the others wait for a
+	// free slot. Requests may finish in any order.
+	HandlerPool
+
+	// HandlerInline runs the handler on the goroutine that dispatches the
+	// messages of the association. No other message of the association is
+	// dispatched until the handler returns, so it should be quick. It can't
+	// be used for C-GET and C-MOVE, whose handlers wait for messages from
+	// the peer.
+	HandlerInline
+)
+
+func (e HandlerExecution) String() string {
+	switch e {
+	case HandlerPerRequest:
+		return "PerRequest"
+	case HandlerSequential:
+		return "Sequential"
+	case HandlerPool:
+		return "Pool"
+	case HandlerInline:
+		return "Inline"
+	}
+	return fmt.Sprintf("HandlerExecution(%d)", int(e))
+}
+
+// HandlerExecutionModels sets the HandlerExecution of each type of request.
+// The zero value runs every request in its own goroutine.
+type HandlerExecutionModels struct {
+	CEcho  HandlerExecution
+	CStore HandlerExecution
+	CFind  HandlerExecution
+	CGet   HandlerExecution
+	CMove  HandlerExecution
+}
+
+// DefaultHandlerPoolSize is the default value of
+// ServiceProviderParams.HandlerPoolSize.
+const DefaultHandlerPoolSize = 16
+
+// Check that the models are known, and allowed for their request types.
+func validateHandlerExecution(m HandlerExecutionModels) error {
+	for _, e := range []struct {
+		name  string
+		model HandlerExecution
+	}{{"CEcho", m.CEcho}, {"CStore", m.CStore}, {"CFind", m.CFind}, {"CGet", m.CGet}, {"CMove", m.CMove}} {
+		if e.model < HandlerPerRequest || e.model > HandlerInline {
+			return fmt.Errorf("dicom.serviceProvider: unknown execution model %v for %s", e.model, e.name)
+		}
+	}
+	if m.CGet == HandlerInline || m.CMove == HandlerInline {
+		return fmt.Errorf("dicom.serviceProvider: C-GET and C-MOVE handlers can't run inline")
+	}
+	return nil
+}
+
+// Slots of the pool used by HandlerPool. A slot is held while a handler runs.
+type handlerPool chan struct{}
+
+func newHandlerPool(size int) handlerPool {
+	if size <= 0 {
+		size = DefaultHandlerPoolSize
+	}
+	return make(handlerPool, size)
+}
+
+// handlerExecutor runs the handlers of one association according to their
+// execution models.
+type handlerExecutor struct {
+	models HandlerExecutionModels
+	pool   handlerPool
+
+	// If true, C-STORE handlers run one at a time, in arrival order, on
+	// cstoreQueue, whatever models.CStore says.
+	orderedCStore bool
+
+	sequential  handlerQueue // For HandlerSequential.
+	cstoreQueue handlerQueue // For orderedCStore.
+
+	// If positive, at most maxOps handlers are started and not finished.
+	// The others wait in "waiting", in arrival order, up to
+	// maxWaitingOpsFactor*maxOps of them.
+	maxOps   int
+	mu       sync.Mutex
+	inFlight int         // Guarded by mu.
+	waiting  []waitingOp // Guarded by mu.
+}
+
+// How many times handlerExecutor.maxOps handlers may wait for a slot. Each
+// holds the data of its request, so a peer that ignores the operation window
+// must not queue them without bound.
+const maxWaitingOpsFactor = 4
+
+// A handler held back by handlerExecutor.maxOps.
+type waitingOp struct {
+	commandField int
+	fn           func()
+}
+
+// A FIFO of handlers, run one at a time by a goroutine that exists while the
+// queue is nonempty.
+type handlerQueue struct {
+	mu      sync.Mutex
+	queue   []func() // Guarded by mu.
+	running bool     // A goroutine is draining queue. Guarded by mu.
+}
+
+func (x *handlerExecutor) model(commandField int) HandlerExecution {
+	switch commandField {
+	case dimse.CommandFieldCEchoRq:
+		return x.models.CEcho
+	case dimse.CommandFieldCStoreRq:
+		return x.models.CStore
+	case dimse.CommandFieldCFindRq:
+		return x.models.CFind
+	case dimse.CommandFieldCGetRq:
+		return x.models.CGet
+	case dimse.CommandFieldCMoveRq:
+		return x.models.CMove
+	}
+	return HandlerPerRequest
+}
+
+// Run "fn", the handler of a request of the given type. Called by the
+// dispatcher goroutine. A nil executor runs every handler in its own
+// goroutine. Returns false, without running fn, if too many handlers are
+// already waiting for maxOps.
+func (x *handlerExecutor) run(stats *associationStats, commandField int, fn func()) bool {
+	if x == nil || x.maxOps <= 0 {
+		x.dispatch(stats, commandField, fn)
+		return true
+	}
+	x.mu.Lock()
+	if x.inFlight >= x.maxOps {
+		if len(x.waiting) >= maxWaitingOpsFactor*x.maxOps {
+			x.mu.Unlock()
+			return false
+		}
+		x.waiting = append(x.waiting, waitingOp{commandField, fn})
+		x.mu.Unlock()
+		return true
+	}
+	x.inFlight++
+	x.mu.Unlock()
+	x.dispatch(stats, commandField, x.counted(stats, fn))
+	return true
+}
+
+// Wrap "fn" so that, once it finishes, the next waiting handler is
+// dispatched in its place.
+func (x *handlerExecutor) counted(stats *associationStats, fn func()) func() {
+	return func() {
+		fn()
+		x.mu.Lock()
+		if len(x.waiting) == 0 {
+			x.inFlight--
+			x.mu.Unlock()
+			return
+		}
+		next := x.waiting[0]
+		x.waiting = x.waiting[1:]
+		x.mu.Unlock()
+		x.dispatch(stats, next.commandField, x.counted(stats, next.fn))
+	}
+}
+
+// Run "fn" according to the execution model of its request type.
+func (x *handlerExecutor) dispatch(stats *associationStats, commandField int, fn func()) {
+	model := HandlerPerRequest
+	if x != nil {
+		model = x.model(commandField)
+	}
+	if model == HandlerPool {
+		fn = x.inPool(fn)
+	}
+	if x != nil && x.orderedCStore && commandField == dimse.CommandFieldCStoreRq &&
+		model != HandlerInline && model != HandlerSequential {
+		x.cstoreQueue.push(stats, fn)
+		return
+	}
+	switch model {
+	case HandlerInline:
+		fn()
+	case HandlerSequential:
+		x.sequential.push(stats, fn)
+	default:
+		stats.goFunc(fn)
+	}
+}
+
+// Wrap "fn" so that it holds a slot of the pool while it runs. The slot is
+// acquired in the goroutine that runs fn, so that a full pool doesn't stop
+// the dispatcher: a running C-GET handler may be waiting for a response it
+// must deliver.
+func (x *handlerExecutor) inPool(fn func()) func() {
+	return func() {
+		x.pool <- struct{}{}
+		defer func() { <-x.pool }()
+		fn()
+	}
+}
+
+// Append "fn" to the queue, and start a goroutine to drain it if needed.
+func (q *handlerQueue) push(stats *associationStats, fn func()) {
+	q.mu.Lock()
+	q.queue = append(q.queue, fn)
+	if q.running {
+		q.mu.Unlock()
+		return
+	}
+	q.running = true
+	q.mu.Unlock()
+	stats.goFunc(q.drain)
+}
+
+// Run the queued handlers until the queue is empty.
+func (q *handlerQueue) drain() {
+	for {
+		q.mu.Lock()
+		if len(q.queue) == 0 {
+			q.running = false
+			q.mu.Unlock()
+			return
+		}
+		fn := q.queue[0]
+		q.queue = q.queue[1:]
+		q.mu.Unlock()
+		fn()
+	}
+}
@@ -0,0 +1,120 @@
+//go:build go1.23
+
+package netdicom
+
+// This file implements iterators over the results of C-FIND and C-GET, as an
+// alternative to the channel and callback APIs, for use with range-over-func.
+
+import (
+	"iter"
+
+	"github.com/antibios/dicom"
+	"github.com/antibios/go-netdicom/dimse"
+)
+
+// FindIter runs a C-FIND command, as CFind, and yields the elements of each
+// match. A failure is yielded as a nil slice and an error, after which the
+// iteration ends.
+//
+// Breaking out of the loop is safe: the responses that are still to come are
+// read and discarded, and the loop statement returns once the peer has sent
+// its final response, so that the association can be used for the next
+// command. No C-CANCEL is sent.
+//
+// REQUIRES: Connect() or SetConn has been called.
+func (su *ServiceUser) FindIter(qrLevel QRLevel, filter []*dicom.Element) iter.Seq2[[]*dicom.Element, error] {
+	return func(yield func([]*dicom.Element, error) bool) {
+		ch := su.CFind(qrLevel, filter)
+		// Drain the channel, so that the goroutine of CFind ends.
+		defer func() {
+			for range ch {
+			}
+		}()
+		for result := range ch {
+			if result.Err != nil {
+				yield(nil, result.Err)
+				return
+			}
+			// The final response usually carries no dataset.
+			if len(result.Elements) == 0 {
+				continue
+			}
+			if !yield(result.Elements, nil) {
+				return
+			}
+		}
+	}
+}
+
+// CGetResult is a dataset received by GetIter.
+type CGetResult struct {
+	TransferSyntaxUID string
+	SOPClassUID       string
+	SOPInstanceUID    string
+
+	// Data is the dataset, encoded in TransferSyntaxUID, as passed to the
+	// callback of CGet.
+	Data []byte
+}
+
+// Status returned for the C-STOREs that arrive after the caller stopped a
+// GetIter loop.
+var cgetAbandonedStatus = dimse.Status{Status: dimse.CStoreOutOfResources, ErrorComment: "C-GET abandoned by the caller"}
+
+// GetIter runs a C-GET command, as CGet, and yields each dataset received. The
+// C-STORE of a dataset is answered with success once the loop body for it has
+// run, so the body should store the data stably. A failure of the C-GET is
+// yielded last, with an empty CGetResult.
+//
+// Breaking out of the loop, or a panic in its body, refuses the dataset being
+// handled and those still to come, with status dimse.CStoreOutOfResources. The
+// loop statement returns once the peer has sent its final C-GET response, so
+// that the association can be used for the next command.
+//
+// REQUIRES: Connect() or SetConn has been called.
+func (su *ServiceUser) GetIter(qrLevel QRLevel, filter []*dicom.Element) iter.Seq2[CGetResult, error] {
+	type item struct {
+		result CGetResult
+		ack    chan bool // receives whether the dataset was accepted
+	}
+	return func(yield func(CGetResult, error) bool) {
+		items := make(chan item)
+		errCh := make(chan error, 1)
+		go func() {
+			refused := false
+			errCh <- su.CGet(qrLevel, filter, func(transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) dimse.Status {
+				if !refused {
+					ack := make(chan bool, 1)
+					items <- item{CGetResult{transferSyntaxUID, sopClassUID, sopInstanceUID, data}, ack}
+					refused = !<-ack
+				}
+				if refused {
+					return cgetAbandonedStatus
+				}
+				return dimse.Success
+			})
+			close(items)
+		}()
+		var pending chan bool // ack of the dataset being yielded
+		defer func() {
+			if pending != nil {
+				pending <- false
+			}
+			for it := range items {
+				it.ack <- false
+			}
+		}()
+		for it := range items {
+			pending = it.ack
+			ok := yield(it.result, nil)
+			pending = nil
+			it.ack <- ok
+			if !ok {
+				return
+			}
+		}
+		if err := <-errCh; err != nil {
+			yield(CGetResult{}, err)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+//go:build go1.23
+
+package netdicom
+
+import (
+	"testing"
+
+	"github.com/antibios/dicom"
+	"github.com/antibios/dicom/pkg/tag"
+	"github.com/antibios/go-netdicom/sopclass"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindIter(t *testing.T) {
+	su := mustNewServiceUser(t, sopclass.QRFindClasses)
+	defer su.Release()
+	filter := []*dicom.Element{dicom.MustNewElement(tag.PatientName, "foohah")}
+	var names []string
+	for elems, err := range su.FindIter(QRLevelPatient, filter) {
+		require.NoError(t, err)
+		names = append(names, elems[0].Value.GetValue().(string))
+	}
+	require.Equal(t, []string{"johndoe", "johndoe2"}, names)
+
+	// Break after the first match; the association is usable afterwards.
+	for elems, err := range su.FindIter(QRLevelPatient, filter) {
+		require.NoError(t, err)
+		require.Equal(t, "johndoe", elems[0].Value.GetValue().(string))
+		break
+	}
+	n := 0
+	for _, err := range su.FindIter(QRLevelPatient, filter) {
+		require.NoError(t, err)
+		n++
+	}
+	require.Equal(t, 2, n)
+}
+
+func TestGetIter(t *testing.T) {
+	su := mustNewServiceUser(t, sopclass.QRGetClasses)
+	defer su.Release()
+	filter := []*dicom.Element{dicom.MustNewElement(tag.PatientName, "foohah")}
+	var results []CGetResult
+	for r, err := range su.GetIter(QRLevelPatient, filter) {
+		require.NoError(t, err)
+		results = append(results, r)
+	}
+	require.Len(t, results, 1)
+	require.NotEmpty(t, results[0].Data)
+
+	// The dataset is refused when the loop breaks; the association is
+	// usable afterwards.
+	for range su.GetIter(QRLevelPatient, filter) {
+		break
+	}
+	n := 0
+	for _, err := range su.GetIter(QRLevelPatient, filter) {
+		require.NoError(t, err)
+		n++
+	}
+	require.Equal(t, 1, n)
+}
@@ -0,0 +1,105 @@
+package netdicom
+
+// This file implements the Kerberos variant of User Identity negotiation
+// (P3.7 D.3.3.7, user identity type 3) on top of a pluggable GSSAPI
+// implementation, e.g., one backed by gokrb5 or by the platform's SSPI.
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/antibios/go-netdicom/pdu"
+)
+
+// GSSAPIInitiator creates Kerberos security contexts on the user side.
+type GSSAPIInitiator interface {
+	// InitSecContext returns the token that opens a security context with
+	// "servicePrincipal", e.g., "dicom/pacs.hospital.org@HOSPITAL.ORG".
+	// It is sent as the primary field of the User Identity item.
+	InitSecContext(servicePrincipal string) ([]byte, error)
+}
+
+// GSSAPIAcceptor accepts Kerberos security contexts on the provider side,
+// typically with the keytab of the provider's service principal.
+type GSSAPIAcceptor interface {
+	// AcceptSecContext verifies the token sent by a user. It returns the
+	// user's principal, e.g., "alice@HOSPITAL.ORG", and the token for
+	// mutual authentication, which may be empty.
+	AcceptSecContext(token []byte) (clientPrincipal string, responseToken []byte, err error)
+}
+
+// NewKerberosIdentityCallback returns a UserIdentityCallback that presents a
+// Kerberos service ticket for "servicePrincipal", obtained from "initiator"
+// for each association. It requests a positive response, so that the
+// provider's mutual authentication token can be checked with
+// ServiceUser.UserIdentityResponse.
+func NewKerberosIdentityCallback(initiator GSSAPIInitiator, servicePrincipal string) UserIdentityCallback {
+	return func() (*UserIdentity, error) {
+		token, err := initiator.InitSecContext(servicePrincipal)
+		if err != nil {
+			return nil, fmt.Errorf("kerberos: %w", err)
+		}
+		return &UserIdentity{
+			Type:                      pdu.UserIdentityKerberos,
+			PrimaryField:              token,
+			PositiveResponseRequested: true,
+		}, nil
+	}
+}
+
+// KerberosAuthenticator is an Authenticator that verifies Kerberos service
+// tickets with a GSSAPIAcceptor. The principal's Name is the client
+// principal, and its "realm" attribute the realm. Other identity types are
+// passed to Next, or rejected if Next is nil.
+type KerberosAuthenticator struct {
+	Acceptor GSSAPIAcceptor
+	Next     Authenticator
+}
+
+// VerifyKerberosTicket implements Authenticator.
+func (a KerberosAuthenticator) VerifyKerberosTicket(conn ConnectionState, ticket []byte) (*Principal, error) {
+	client, response, err := a.Acceptor.AcceptSecContext(ticket)
+	if err != nil {
+		return nil, fmt.Errorf("kerberos: %w", err)
+	}
+	p := &Principal{Name: client, ServerResponse: response}
+	if i := strings.LastIndex(client, "@"); i >= 0 {
+		p.Attributes = map[string]string{"realm": client[i+1:]}
+	}
+	return p, nil
+}
+
+// VerifyUsernamePassword implements Authenticator.
+func (a KerberosAuthenticator) VerifyUsernamePassword(conn ConnectionState, username, password string) (*Principal, error) {
+	if a.Next == nil {
+		return nil, fmt.Errorf("only kerberos identities are accepted")
+	}
+	return a.Next.VerifyUsernamePassword(conn, username, password)
+}
+
+// VerifyJWT implements Authenticator.
+func (a KerberosAuthenticator) VerifyJWT(conn ConnectionState, token string) (*Principal, error) {
+	if a.Next == nil {
+		return nil, fmt.Errorf("only kerberos identities are accepted")
+	}
+	return a.Next.VerifyJWT(conn, token)
+}
+
+// VerifySAMLAssertion implements Authenticator.
+func (a KerberosAuthenticator) VerifySAMLAssertion(conn ConnectionState, assertion string) (*Principal, error) {
+	if a.Next == nil {
+		return nil, fmt.Errorf("only kerberos identities are accepted")
+	}
+	return a.Next.VerifySAMLAssertion(conn, assertion)
+}
+
+// UserIdentityResponse returns the server response of the User Identity item
+// the provider sent in A-ASSOCIATE-AC, e.g., its Kerberos mutual
+// authentication token, or nil if it sent none. It waits until the
+// association is established.
+func (su *ServiceUser) UserIdentityResponse() ([]byte, error) {
+	if err := su.waitUntilReady(); err != nil {
+		return nil, err
+	}
+	return su.cm.identityResponse, nil
+}
@@ -0,0 +1,172 @@
+package netdicom
+
+// This file implements a FaultInjector that simulates the latency, jitter and
+// bandwidth of a network link, so that timeout settings and throughput can be
+// tested under WAN-like conditions without leaving the process.
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// LinkConditions describes a simulated network link in one direction: from
+// the side whose params hold the injector to its peer.
+type LinkConditions struct {
+	// Latency is the one-way delay added to every PDU.
+	Latency time.Duration
+	// Jitter, if positive, adds a random delay in [0, Jitter) to every
+	// PDU. PDUs are never reordered.
+	Jitter time.Duration
+	// BytesPerSecond, if positive, limits the throughput. Sending a PDU
+	// blocks for as long as it takes to transmit at this rate.
+	BytesPerSecond int64
+	// Seed initializes the jitter generator, for reproducible runs.
+	Seed int64
+}
+
+// NewLinkFaultInjector creates a FaultInjector that delivers the PDUs sent
+// under the given conditions. Set it in ServiceUserParams.FaultInjector to
+// shape the user-to-provider direction, and in
+// ServiceProviderParams.FaultInjector for the other one. Delays use the real
+// clock.
+func NewLinkFaultInjector(c LinkConditions) FaultInjector {
+	return &linkFaultInjector{
+		conditions: c,
+		rand:       rand.New(rand.NewSource(c.Seed)),
+	}
+}
+
+type linkFaultInjector struct {
+	conditions LinkConditions
+
+	mu   sync.Mutex
+	rand *rand.Rand // guarded by mu; shared by the links
+}
+
+// linkSimulator is implemented by a FaultInjector that delays the PDUs sent.
+// The statemachine then writes PDUs to the link returned by newLink, rather
+// than to the connection.
+type linkSimulator interface {
+	// Called once per connection. Closing the link closes "conn" once the
+	// data written before has been delivered.
+	newLink(conn net.Conn) io.WriteCloser
+}
+
+func (f *linkFaultInjector) onStateTransition(oldState stateType, event *stateEvent, action *stateAction, newState stateType) {
+}
+
+func (f *linkFaultInjector) onSend(data []byte) faultInjectorAction {
+	return faultInjectorContinue
+}
+
+func (f *linkFaultInjector) afterSend(data []byte) [][]byte {
+	return nil
+}
+
+func (f *linkFaultInjector) String() string {
+	return fmt.Sprintf("linkFaultInjector%+v", f.conditions)
+}
+
+func (f *linkFaultInjector) jitter() time.Duration {
+	if f.conditions.Jitter <= 0 {
+		return 0
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return time.Duration(f.rand.Int63n(int64(f.conditions.Jitter)))
+}
+
+func (f *linkFaultInjector) newLink(conn net.Conn) io.WriteCloser {
+	l := &simulatedLink{
+		f:     f,
+		conn:  conn,
+		queue: make(chan linkPacket, 1024),
+	}
+	go l.deliver()
+	return l
+}
+
+// A PDU in flight.
+type linkPacket struct {
+	data      []byte
+	deliverAt time.Time
+}
+
+type simulatedLink struct {
+	f     *linkFaultInjector
+	conn  net.Conn
+	queue chan linkPacket // closed by Close
+
+	// Used only by the statemachine goroutine, which does all the writes.
+	txEnd       time.Time // when the last PDU finished transmitting
+	lastDeliver time.Time
+	closed      bool
+
+	mu  sync.Mutex
+	err error // the first delivery error; guarded by mu
+}
+
+// Write queues "data" for delivery after the link's delay. It blocks while the
+// data is being "transmitted" at the link's bandwidth.
+func (l *simulatedLink) Write(data []byte) (int, error) {
+	l.mu.Lock()
+	err := l.err
+	l.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	if l.closed {
+		return 0, net.ErrClosed
+	}
+	now := time.Now()
+	start := now
+	if l.txEnd.After(start) {
+		start = l.txEnd
+	}
+	l.txEnd = start
+	if bps := l.f.conditions.BytesPerSecond; bps > 0 {
+		l.txEnd = start.Add(time.Duration(int64(len(data)) * int64(time.Second) / bps))
+	}
+	deliverAt := l.txEnd.Add(l.f.conditions.Latency + l.f.jitter())
+	if deliverAt.Before(l.lastDeliver) {
+		deliverAt = l.lastDeliver
+	}
+	l.lastDeliver = deliverAt
+	l.queue <- linkPacket{data: append([]byte(nil), data...), deliverAt: deliverAt}
+	time.Sleep(l.txEnd.Sub(now))
+	return len(data), nil
+}
+
+// Close closes the connection once the PDUs already written are delivered.
+// The delivery goroutine then exits.
+func (l *simulatedLink) Close() error {
+	if !l.closed {
+		l.closed = true
+		close(l.queue)
+	}
+	return nil
+}
+
+// Delivers the queued PDUs until the link is closed. Once a write fails, the
+// connection is closed, and the rest is dropped without waiting.
+func (l *simulatedLink) deliver() {
+	defer l.conn.Close()
+	failed := false
+	for p := range l.queue {
+		if failed {
+			continue
+		}
+		time.Sleep(time.Until(p.deliverAt))
+		if _, err := l.conn.Write(p.data); err != nil {
+			l.mu.Lock()
+			l.err = err
+			l.mu.Unlock()
+			l.conn.Close()
+			failed = true
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package netdicom
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// A net.Conn whose Close is reported on a channel.
+type closeNotifyConn struct {
+	net.Conn
+	closed chan struct{}
+}
+
+func (c *closeNotifyConn) Close() error {
+	select {
+	case <-c.closed:
+	default:
+		close(c.closed)
+	}
+	return c.Conn.Close()
+}
+
+// Closing a link delivers the PDUs in flight, then closes the connection and
+// ends the delivery goroutine, also after the peer went away.
+func TestSimulatedLinkClose(t *testing.T) {
+	const latency = 20 * time.Millisecond
+	local, remote := net.Pipe()
+	conn := &closeNotifyConn{Conn: local, closed: make(chan struct{})}
+	l := NewLinkFaultInjector(LinkConditions{Latency: latency}).(linkSimulator).newLink(conn)
+	received := make(chan []byte, 1)
+	go func() {
+		data, _ := io.ReadAll(remote)
+		received <- data
+	}()
+	start := time.Now()
+	_, err := l.Write([]byte("first"))
+	require.NoError(t, err)
+	_, err = l.Write([]byte("second"))
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+	_, err = l.Write([]byte("third"))
+	require.ErrorIs(t, err, net.ErrClosed)
+	require.Equal(t, "firstsecond", string(<-received))
+	require.GreaterOrEqual(t, time.Since(start), latency)
+	<-conn.closed
+
+	// The peer is gone: the PDUs queued are dropped.
+	local, remote = net.Pipe()
+	remote.Close()
+	conn = &closeNotifyConn{Conn: local, closed: make(chan struct{})}
+	l = NewLinkFaultInjector(LinkConditions{Latency: latency}).(linkSimulator).newLink(conn)
+	_, err = l.Write([]byte("lost"))
+	require.NoError(t, err)
+	<-conn.closed
+	require.Eventually(t, func() bool {
+		_, err := l.Write([]byte("lost"))
+		return err != nil
+	}, time.Second, latency)
+	require.NoError(t, l.Close())
+}
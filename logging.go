@@ -0,0 +1,22 @@
+package netdicom
+
+// This file implements ServiceUserParams.Logger and
+// ServiceProviderParams.Logger.
+
+import (
+	"github.com/antibios/go-dicom/dicomlog"
+)
+
+// Logger receives the diagnostic messages of one ServiceUser or
+// ServiceProvider. Level has the same meaning as in dicomlog.Vprintf. A Logger
+// receives every message, regardless of dicomlog.SetLevel, so it must filter
+// by level itself. It may be called from multiple goroutines at once.
+type Logger func(level int, format string, args ...interface{})
+
+// Returns l, or dicomlog.Vprintf if l is nil.
+func loggerOrDefault(l Logger) Logger {
+	if l != nil {
+		return l
+	}
+	return dicomlog.Vprintf
+}
@@ -0,0 +1,37 @@
+package netdicom
+
+// This file implements the memory-mapped send path for large files.
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+)
+
+// Returned by mapFile on platforms without mmap.
+var errMmapUnsupported = errors.New("dicom: mmap is not supported on this platform")
+
+// mappedData is a read-only mapping of a file, passed as the data of a
+// C-STORE. The state machine slices PDVs directly from "body" and releases the
+// mapping once sent. Ownership passes to the state machine with the event, so
+// a mapping whose event is dropped, e.g., because the association ended, is
+// unmapped when garbage collected.
+type mappedData struct {
+	mapping []byte // as returned by mapFile
+	body    []byte // the part of mapping to send
+	once    sync.Once
+}
+
+func newMappedData(mapping, body []byte) *mappedData {
+	m := &mappedData{mapping: mapping, body: body}
+	runtime.SetFinalizer(m, (*mappedData).release)
+	return m
+}
+
+// Unmap the file. The body must not be used afterwards.
+func (m *mappedData) release() {
+	m.once.Do(func() {
+		runtime.SetFinalizer(m, nil)
+		unmapFile(m.mapping)
+	})
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package netdicom
+
+import "os"
+
+func mapFile(f *os.File) ([]byte, error) {
+	return nil, errMmapUnsupported
+}
+
+func unmapFile(b []byte) {}
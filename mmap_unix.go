@@ -0,0 +1,25 @@
+//go:build unix
+
+package netdicom
+
+import (
+	"os"
+	"syscall"
+)
+
+// Map the whole of "f" read-only.
+func mapFile(f *os.File) ([]byte, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := fi.Size()
+	if size <= 0 || int64(int(size)) != size {
+		return nil, errMmapUnsupported
+	}
+	return syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func unmapFile(b []byte) {
+	syscall.Munmap(b)
+}
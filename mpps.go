@@ -0,0 +1,197 @@
+package netdicom
+
+// This file implements the Modality Performed Procedure Step service (P3.4
+// F): a modality reports the procedure it performs with an N-CREATE, once it
+// starts, and N-SETs, up to the one that completes or discontinues it. The
+// user sends them with MPPSCreate and MPPSSet; the provider hands them to
+// ServiceProviderParams.MPPS.
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	dicom "github.com/antibios/dicom"
+	dicomtag "github.com/antibios/dicom/pkg/tag"
+	"github.com/antibios/go-netdicom/dimse"
+	"github.com/antibios/go-netdicom/sopclass"
+)
+
+// The values of PerformedProcedureStepStatus (0040,0252).
+const (
+	MPPSInProgress   = "IN PROGRESS"
+	MPPSCompleted    = "COMPLETED"
+	MPPSDiscontinued = "DISCONTINUED"
+)
+
+// MPPSEvent is an MPPS N-CREATE or N-SET received by a ServiceProvider.
+type MPPSEvent struct {
+	// Create is true for N-CREATE, false for N-SET.
+	Create bool
+	// SOPInstanceUID is the performed procedure step. For an N-CREATE that
+	// doesn't name one, it is a UID generated by the provider, which is
+	// returned to the peer if the callback succeeds.
+	SOPInstanceUID string
+	// Status is the PerformedProcedureStepStatus of the dataset. It is
+	// MPPSInProgress for N-CREATE, and empty for an N-SET that doesn't
+	// change it.
+	Status string
+	// Elements is the dataset of the request: the attributes of the step
+	// for N-CREATE, the ones changed for N-SET.
+	Elements []*dicom.Element
+}
+
+// MPPSCallback handles an MPPS N-CREATE or N-SET. The status it returns is
+// sent to the peer, e.g., dimse.StatusFailure(...) for an N-SET of a step that
+// is already completed.
+type MPPSCallback func(conn ConnectionState, event MPPSEvent) dimse.Status
+
+var mppsUIDSeq uint32
+
+// Generate the UID of a performed procedure step created without one.
+func newMPPSInstanceUID() string {
+	return fmt.Sprintf("%s.4.%d.%d", GoDICOMImplementationClassUIDPrefix,
+		time.Now().UnixNano()/1000, atomic.AddUint32(&mppsUIDSeq, 1))
+}
+
+// Returns "elems" with PerformedProcedureStepStatus set to "status".
+func withMPPSStatus(elems []*dicom.Element, status string) ([]*dicom.Element, error) {
+	statusElem, err := dicom.NewElement(dicomtag.PerformedProcedureStepStatus, []string{status})
+	if err != nil {
+		return nil, err
+	}
+	r := []*dicom.Element{statusElem}
+	for _, elem := range elems {
+		if elem.Tag != dicomtag.PerformedProcedureStepStatus {
+			r = append(r, elem)
+		}
+	}
+	return r, nil
+}
+
+// Returns the NServiceCallback of a provider: MPPS N-CREATE and N-SET go to
+// params.MPPS, if set, and the other requests to params.NService.
+func providerNService(params ServiceProviderParams) NServiceCallback {
+	if params.MPPS == nil {
+		return params.NService
+	}
+	return func(conn ConnectionState, rq NServiceRequest) NServiceResponse {
+		if rq.SOPClassUID != sopclass.MPPSClasses[0] {
+			return callNService(params.NService, conn, rq)
+		}
+		switch rq.Command.(type) {
+		case *dimse.NCreateRq:
+			return handleMPPS(params.MPPS, conn, rq, true)
+		case *dimse.NSetRq:
+			return handleMPPS(params.MPPS, conn, rq, false)
+		}
+		return callNService(params.NService, conn, rq)
+	}
+}
+
+// Pass "rq" to "cb", or answer it with "unrecognized operation" if it's nil.
+func callNService(cb NServiceCallback, conn ConnectionState, rq NServiceRequest) NServiceResponse {
+	if cb == nil {
+		return NServiceResponse{Status: dimse.Status{
+			Status:       dimse.StatusUnrecognizedOperation,
+			ErrorComment: "No callback found for N-service",
+		}}
+	}
+	return cb(conn, rq)
+}
+
+func handleMPPS(cb MPPSCallback, conn ConnectionState, rq NServiceRequest, create bool) NServiceResponse {
+	event := MPPSEvent{
+		Create:         create,
+		SOPInstanceUID: rq.SOPInstanceUID,
+		Status:         elementString(rq.Elements, dicomtag.PerformedProcedureStepStatus),
+		Elements:       rq.Elements,
+	}
+	// P3.4 F.7.2.1: a step is created in progress, and may then only be
+	// completed or discontinued.
+	switch {
+	case create && event.Status != MPPSInProgress:
+		return NServiceResponse{Status: dimse.NewStatus(dimse.StatusInvalidAttributeValue,
+			fmt.Sprintf("PerformedProcedureStepStatus must be %q, found %q", MPPSInProgress, event.Status))}
+	case !create && event.Status != "" && event.Status != MPPSInProgress &&
+		event.Status != MPPSCompleted && event.Status != MPPSDiscontinued:
+		return NServiceResponse{Status: dimse.NewStatus(dimse.StatusInvalidAttributeValue,
+			fmt.Sprintf("Unknown PerformedProcedureStepStatus %q", event.Status))}
+	case !create && event.SOPInstanceUID == "":
+		return NServiceResponse{Status: dimse.NewStatus(dimse.StatusInvalidObjectInstance, "N-SET names no step")}
+	}
+	if create && event.SOPInstanceUID == "" {
+		event.SOPInstanceUID = newMPPSInstanceUID()
+	}
+	return NServiceResponse{Status: cb(conn, event), SOPInstanceUID: event.SOPInstanceUID}
+}
+
+// Returns an error unless "resp" reports success, or a warning.
+func mppsError(op string, resp dimse.Message) error {
+	status := resp.GetStatus()
+	if status == nil {
+		return fmt.Errorf("dicom.serviceUser: %s response has no status", op)
+	}
+	if c := status.Status.Category(); c != dimse.StatusCategorySuccess && c != dimse.StatusCategoryWarning {
+		return fmt.Errorf("Non-OK status in %s response: %+v", op, *status)
+	}
+	return nil
+}
+
+// MPPSCreate reports the start of a procedure step with an N-CREATE of the
+// MPPS class, which must be in ServiceUserParams.SOPClasses, e.g., through
+// sopclass.MPPSClasses. "elems" are the attributes of the step, P3.3 C.4.13;
+// their PerformedProcedureStepStatus is set to MPPSInProgress. If
+// "sopInstanceUID" is empty, the provider picks the UID of the step. Returns
+// the UID. It blocks until the operation finishes.
+//
+// REQUIRES: Connect() or SetConn has been called.
+func (su *ServiceUser) MPPSCreate(sopInstanceUID string, elems []*dicom.Element) (string, error) {
+	elems, err := withMPPSStatus(elems, MPPSInProgress)
+	if err != nil {
+		return "", err
+	}
+	resp, _, err := su.NRequest(&dimse.NCreateRq{
+		AffectedSOPClassUID:    sopclass.MPPSClasses[0],
+		AffectedSOPInstanceUID: sopInstanceUID,
+	}, elems)
+	if err != nil {
+		return "", err
+	}
+	if err := mppsError("N-CREATE", resp); err != nil {
+		return "", err
+	}
+	if uid := resp.(*dimse.NCreateRsp).AffectedSOPInstanceUID; uid != "" {
+		sopInstanceUID = uid
+	}
+	if sopInstanceUID == "" {
+		return "", fmt.Errorf("dicom.serviceUser: N-CREATE response names no procedure step")
+	}
+	return sopInstanceUID, nil
+}
+
+// MPPSSet updates the procedure step "sopInstanceUID" with an N-SET of the
+// attributes "elems". If "status" is nonempty, e.g., MPPSCompleted or
+// MPPSDiscontinued, the PerformedProcedureStepStatus is set to it. It blocks
+// until the operation finishes.
+//
+// REQUIRES: Connect() or SetConn has been called.
+func (su *ServiceUser) MPPSSet(sopInstanceUID, status string, elems []*dicom.Element) error {
+	if sopInstanceUID == "" {
+		return fmt.Errorf("dicom.serviceUser: MPPSSet: empty SOP instance UID")
+	}
+	if status != "" {
+		var err error
+		if elems, err = withMPPSStatus(elems, status); err != nil {
+			return err
+		}
+	}
+	resp, _, err := su.NRequest(&dimse.NSetRq{
+		RequestedSOPClassUID:    sopclass.MPPSClasses[0],
+		RequestedSOPInstanceUID: sopInstanceUID,
+	}, elems)
+	if err != nil {
+		return err
+	}
+	return mppsError("N-SET", resp)
+}
@@ -0,0 +1,54 @@
+package netdicom
+
+import (
+	"net"
+	"testing"
+
+	dicom "github.com/antibios/dicom"
+	"github.com/antibios/dicom/pkg/tag"
+	"github.com/antibios/go-netdicom/dimse"
+	"github.com/antibios/go-netdicom/sopclass"
+	"github.com/stretchr/testify/require"
+)
+
+// A step is created in progress, with a UID picked by the provider, then
+// completed. Statuses that break the life cycle are refused before reaching
+// the callback.
+func TestMPPS(t *testing.T) {
+	events := make(chan MPPSEvent, 4)
+	userConn, providerConn := net.Pipe()
+	RunProviderForConn(providerConn, ServiceProviderParams{
+		MPPS: func(conn ConnectionState, event MPPSEvent) dimse.Status {
+			events <- event
+			return dimse.Success
+		},
+	})
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.MPPSClasses})
+	require.NoError(t, err)
+	defer su.Release()
+	su.SetConn(userConn)
+
+	uid, err := su.MPPSCreate("", []*dicom.Element{
+		dicom.MustNewElement(tag.PerformedProcedureStepStatus, []string{MPPSCompleted}),
+		dicom.MustNewElement(tag.PerformedProcedureStepID, []string{"PPS1"}),
+	})
+	require.NoError(t, err)
+	require.NotEmpty(t, uid)
+	event := <-events
+	require.True(t, event.Create)
+	require.Equal(t, uid, event.SOPInstanceUID)
+	require.Equal(t, MPPSInProgress, event.Status)
+	require.Len(t, event.Elements, 2)
+
+	require.NoError(t, su.MPPSSet(uid, MPPSCompleted, nil))
+	event = <-events
+	require.False(t, event.Create)
+	require.Equal(t, uid, event.SOPInstanceUID)
+	require.Equal(t, MPPSCompleted, event.Status)
+
+	require.Error(t, su.MPPSSet(uid, "PAUSED", nil))
+	resp, _, err := su.NRequest(&dimse.NCreateRq{AffectedSOPClassUID: sopclass.MPPSClasses[0]}, nil)
+	require.NoError(t, err)
+	require.Equal(t, dimse.StatusInvalidAttributeValue, resp.GetStatus().Status)
+	require.Empty(t, events)
+}
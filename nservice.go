@@ -0,0 +1,278 @@
+package netdicom
+
+// This file implements the DIMSE N-services (P3.7 10): N-EVENT-REPORT, N-GET,
+// N-SET, N-ACTION, N-CREATE and N-DELETE, on which services such as Modality
+// Performed Procedure Step and Storage Commitment are built. The provider
+// hands each N request to ServiceProviderParams.NService; the user sends them
+// with NRequest, and hands N-EVENT-REPORT requests from the provider to
+// ServiceUserParams.NEventReport.
+
+import (
+	"fmt"
+
+	dicom "github.com/antibios/dicom"
+	"github.com/antibios/go-dicom/dicomlog"
+	"github.com/antibios/go-netdicom/dimse"
+)
+
+// NServiceRequest is an N-service request received by a ServiceProvider, or an
+// N-EVENT-REPORT request received by a ServiceUser.
+type NServiceRequest struct {
+	// Command is the request: one of *dimse.NEventReportRq, *dimse.NGetRq,
+	// *dimse.NSetRq, *dimse.NActionRq, *dimse.NCreateRq and
+	// *dimse.NDeleteRq. It carries the fields specific to the operation,
+	// e.g., the action type of N-ACTION.
+	Command dimse.Message
+	// The affected or requested SOP class and instance. SOPInstanceUID is
+	// empty for an N-CREATE that leaves it to the provider.
+	SOPClassUID    string
+	SOPInstanceUID string
+	// TransferSyntaxUID is the transfer syntax of the presentation context.
+	TransferSyntaxUID string
+	// Elements is the dataset of the request, or nil if it has none.
+	Elements []*dicom.Element
+}
+
+// NServiceResponse is the answer of an NServiceCallback.
+type NServiceResponse struct {
+	Status dimse.Status
+	// SOPInstanceUID, if nonempty, is the instance reported in the response
+	// instead of the one in the request. An N-CREATE handler sets it to the
+	// instance it created, if the request didn't name one.
+	SOPInstanceUID string
+	// Elements is the dataset of the response, e.g., the attributes asked
+	// for by N-GET, or nil.
+	Elements []*dicom.Element
+}
+
+// NServiceCallback handles an N-service request. It is called once per
+// request, and its response is sent to the peer.
+type NServiceCallback func(conn ConnectionState, rq NServiceRequest) NServiceResponse
+
+// Returns the affected or requested SOP class and instance of "msg", and
+// whether it is an N-service request.
+func nRequestUIDs(msg dimse.Message) (sopClassUID, sopInstanceUID string, ok bool) {
+	switch m := msg.(type) {
+	case *dimse.NEventReportRq:
+		return m.AffectedSOPClassUID, m.AffectedSOPInstanceUID, true
+	case *dimse.NGetRq:
+		return m.RequestedSOPClassUID, m.RequestedSOPInstanceUID, true
+	case *dimse.NSetRq:
+		return m.RequestedSOPClassUID, m.RequestedSOPInstanceUID, true
+	case *dimse.NActionRq:
+		return m.RequestedSOPClassUID, m.RequestedSOPInstanceUID, true
+	case *dimse.NCreateRq:
+		return m.AffectedSOPClassUID, m.AffectedSOPInstanceUID, true
+	case *dimse.NDeleteRq:
+		return m.RequestedSOPClassUID, m.RequestedSOPInstanceUID, true
+	}
+	return "", "", false
+}
+
+// Fill in the message ID and data set type of the N-service request "msg".
+func setNRequestHeader(msg dimse.Message, id dimse.MessageID, dataSetType uint16) error {
+	switch m := msg.(type) {
+	case *dimse.NEventReportRq:
+		m.MessageID, m.CommandDataSetType = id, dataSetType
+	case *dimse.NGetRq:
+		m.MessageID, m.CommandDataSetType = id, dataSetType
+	case *dimse.NSetRq:
+		m.MessageID, m.CommandDataSetType = id, dataSetType
+	case *dimse.NActionRq:
+		m.MessageID, m.CommandDataSetType = id, dataSetType
+	case *dimse.NCreateRq:
+		m.MessageID, m.CommandDataSetType = id, dataSetType
+	case *dimse.NDeleteRq:
+		m.MessageID, m.CommandDataSetType = id, dataSetType
+	default:
+		return fmt.Errorf("dicom: %v is not an N-service request", msg)
+	}
+	return nil
+}
+
+// Build the response to the N-service request "msg". "sopInstanceUID", if
+// nonempty, replaces the instance of the request.
+func nResponse(msg dimse.Message, status dimse.Status, sopInstanceUID string, dataSetType uint16) dimse.Message {
+	sopClassUID, rqInstanceUID, ok := nRequestUIDs(msg)
+	if !ok {
+		return nil
+	}
+	if sopInstanceUID == "" {
+		sopInstanceUID = rqInstanceUID
+	}
+	id := msg.GetMessageID()
+	switch m := msg.(type) {
+	case *dimse.NEventReportRq:
+		return &dimse.NEventReportRsp{
+			AffectedSOPClassUID:       sopClassUID,
+			MessageIDBeingRespondedTo: id,
+			CommandDataSetType:        dataSetType,
+			AffectedSOPInstanceUID:    sopInstanceUID,
+			EventTypeID:               m.EventTypeID,
+			Status:                    status,
+		}
+	case *dimse.NGetRq:
+		return &dimse.NGetRsp{
+			AffectedSOPClassUID:       sopClassUID,
+			MessageIDBeingRespondedTo: id,
+			CommandDataSetType:        dataSetType,
+			AffectedSOPInstanceUID:    sopInstanceUID,
+			Status:                    status,
+		}
+	case *dimse.NSetRq:
+		return &dimse.NSetRsp{
+			AffectedSOPClassUID:       sopClassUID,
+			MessageIDBeingRespondedTo: id,
+			CommandDataSetType:        dataSetType,
+			AffectedSOPInstanceUID:    sopInstanceUID,
+			Status:                    status,
+		}
+	case *dimse.NActionRq:
+		return &dimse.NActionRsp{
+			AffectedSOPClassUID:       sopClassUID,
+			MessageIDBeingRespondedTo: id,
+			CommandDataSetType:        dataSetType,
+			AffectedSOPInstanceUID:    sopInstanceUID,
+			ActionTypeID:              m.ActionTypeID,
+			Status:                    status,
+		}
+	case *dimse.NCreateRq:
+		return &dimse.NCreateRsp{
+			AffectedSOPClassUID:       sopClassUID,
+			MessageIDBeingRespondedTo: id,
+			CommandDataSetType:        dataSetType,
+			AffectedSOPInstanceUID:    sopInstanceUID,
+			Status:                    status,
+		}
+	default:
+		return &dimse.NDeleteRsp{
+			AffectedSOPClassUID:       sopClassUID,
+			MessageIDBeingRespondedTo: id,
+			CommandDataSetType:        dataSetType,
+			AffectedSOPInstanceUID:    sopInstanceUID,
+			Status:                    status,
+		}
+	}
+}
+
+// Pass the N-service request "msg" to "cb", and send its response. Without a
+// callback, the request is answered with "unrecognized operation".
+func handleNService(cb NServiceCallback, connState ConnectionState, msg dimse.Message, data []byte, cs *serviceCommandState) {
+	if cb == nil {
+		cs.sendMessage(nResponse(msg, dimse.Status{
+			Status:       dimse.StatusUnrecognizedOperation,
+			ErrorComment: "No callback found for N-service",
+		}, "", dimse.CommandDataSetTypeNull), nil)
+		return
+	}
+	sopClassUID, sopInstanceUID, _ := nRequestUIDs(msg)
+	rq := NServiceRequest{
+		Command:           msg,
+		SOPClassUID:       sopClassUID,
+		SOPInstanceUID:    sopInstanceUID,
+		TransferSyntaxUID: cs.context.transferSyntaxUID,
+	}
+	if msg.HasData() {
+		elems, err := readElementsInBytes(data, cs.context.transferSyntaxUID)
+		if err != nil {
+			cs.sendMessage(nResponse(msg, dimse.StatusFailure(err.Error()), "", dimse.CommandDataSetTypeNull), nil)
+			return
+		}
+		rq.Elements = elems
+	}
+	dicomlog.Vprintf(1, "dicom.serviceDispatcher(%s): N-service request: %v", cs.disp.label, msg)
+	resp := cb(connState, rq)
+	if len(resp.Elements) == 0 {
+		cs.sendMessage(nResponse(msg, resp.Status, resp.SOPInstanceUID, dimse.CommandDataSetTypeNull), nil)
+		return
+	}
+	payload, err := writeElementsToBytes(resp.Elements, cs.context.transferSyntaxUID)
+	if err != nil {
+		cs.sendMessage(nResponse(msg, dimse.StatusFailure(err.Error()), resp.SOPInstanceUID, dimse.CommandDataSetTypeNull), nil)
+		return
+	}
+	cs.sendMessage(nResponse(msg, resp.Status, resp.SOPInstanceUID, dimse.CommandDataSetTypeNonNull), payload)
+}
+
+// The command fields of the N-service requests.
+var nRequestCommandFields = []int{
+	dimse.CommandFieldNEventReportRq,
+	dimse.CommandFieldNGetRq,
+	dimse.CommandFieldNSetRq,
+	dimse.CommandFieldNActionRq,
+	dimse.CommandFieldNCreateRq,
+	dimse.CommandFieldNDeleteRq,
+}
+
+// NRequest sends "rq", one of the N-service requests listed in
+// NServiceRequest.Command, with the dataset "elems", which may be nil, and
+// waits for the response. Its MessageID and CommandDataSetType are filled in.
+// The request is sent on the presentation context of its SOP class, which
+// must be in ServiceUserParams.SOPClasses. A status other than success, e.g.,
+// a warning, is returned in the response rather than as an error. It blocks
+// until the operation finishes.
+//
+// REQUIRES: Connect() or SetConn has been called.
+func (su *ServiceUser) NRequest(rq dimse.Message, elems []*dicom.Element) (dimse.Message, []*dicom.Element, error) {
+	sopClassUID, _, ok := nRequestUIDs(rq)
+	if !ok {
+		return nil, nil, fmt.Errorf("dicom.serviceUser: %v is not an N-service request", rq)
+	}
+	if err := su.waitUntilReady(); err != nil {
+		return nil, nil, err
+	}
+	if err := su.cm.checkRole(sopClassUID, false); err != nil {
+		return nil, nil, err
+	}
+	context, err := su.cm.lookupByAbstractSyntaxUID(sopClassUID)
+	if err != nil {
+		return nil, nil, err
+	}
+	var payload []byte
+	dataSetType := dimse.CommandDataSetTypeNull
+	if len(elems) > 0 {
+		if payload, err = writeElementsToBytes(elems, context.transferSyntaxUID); err != nil {
+			return nil, nil, err
+		}
+		dataSetType = dimse.CommandDataSetTypeNonNull
+	}
+	cs, err := su.disp.newCommand(su.cm, context)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer su.disp.deleteCommand(cs)
+	setNRequestHeader(rq, cs.messageID, dataSetType) // nolint: errcheck
+	cs.sendMessage(rq, payload)
+	event, ok := <-cs.upcallCh
+	if !ok {
+		return nil, nil, su.disp.closeError("Failed to receive N-service response")
+	}
+	resp := event.command
+	if resp.CommandField() != rq.CommandField()|0x8000 {
+		return nil, nil, cs.abortUnexpectedCommand(fmt.Sprintf("N-service response 0x%x", rq.CommandField()|0x8000), resp)
+	}
+	if !resp.HasData() {
+		return resp, nil, nil
+	}
+	respElems, err := readElementsInBytes(event.data, context.transferSyntaxUID)
+	if err != nil {
+		return resp, nil, err
+	}
+	return resp, respElems, nil
+}
+
+// Hand the N-EVENT-REPORT requests of the provider to
+// ServiceUserParams.NEventReport, if set.
+func (su *ServiceUser) registerNEventReport() {
+	cb := su.params.NEventReport
+	if cb == nil {
+		return
+	}
+	su.disp.registerCallback(dimse.CommandFieldNEventReportRq,
+		func(msg dimse.Message, data []byte, cs *serviceCommandState) {
+			su.mu.Lock()
+			conn := su.conn
+			su.mu.Unlock()
+			handleNService(cb, getConnState(conn, cs.cm), msg, data, cs)
+		})
+}
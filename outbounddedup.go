@@ -0,0 +1,178 @@
+package netdicom
+
+// This file implements OutboundQueueParams.DedupTTL: the record of the
+// instances an OutboundQueue has delivered, kept in its spool directory, so
+// that a copy queued again, or one whose spool file outlived a crash right
+// after its delivery, isn't sent twice; and the check, before an instance
+// whose C-STORE got no response is sent again, that the destination doesn't
+// hold it already.
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/antibios/dicom"
+	dicomtag "github.com/antibios/dicom/pkg/tag"
+	dicomuid "github.com/antibios/dicom/pkg/uid"
+)
+
+// Name of the file, in the spool directory, that records the instances
+// delivered.
+const outboundDeliveredFile = "delivered"
+
+// deliveredLog is the set of instances delivered to each destination within
+// the TTL. Each line of the file is "<unix nanoseconds> <address>
+// <SOP instance UID>". Expired entries are dropped, and the file rewritten
+// without them, when the log is opened and then once per TTL. Thread safe.
+type deliveredLog struct {
+	path string
+	ttl  time.Duration
+
+	mu          sync.Mutex
+	seen        map[deliveredKey]time.Time
+	f           *os.File  // for appending
+	compactedAt time.Time // when the file was last rewritten
+}
+
+type deliveredKey struct {
+	address, sopInstanceUID string
+}
+
+// Read the log at "path", and rewrite it without the entries older than
+// "ttl".
+func openDeliveredLog(path string, ttl time.Duration) (*deliveredLog, error) {
+	l := &deliveredLog{path: path, ttl: ttl, seen: map[deliveredKey]time.Time{}}
+	f, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var nanos int64
+			var key deliveredKey
+			// Lines cut short by a crash don't parse, and are dropped.
+			if _, err := fmt.Sscanf(scanner.Text(), "%d %s %s", &nanos, &key.address, &key.sopInstanceUID); err != nil {
+				continue
+			}
+			if t := time.Unix(0, nanos); t.After(l.seen[key]) {
+				l.seen[key] = t
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := l.compactLocked(time.Now()); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Drop the entries older than the TTL, and replace the file with one that
+// holds only the rest. REQUIRES: l.mu is held, or "l" is not shared yet.
+func (l *deliveredLog) compactLocked(now time.Time) error {
+	for key, t := range l.seen {
+		if now.Sub(t) >= l.ttl {
+			delete(l.seen, key)
+		}
+	}
+	if _, err := writeFileSynced(l.path, func(w io.Writer) error {
+		b := strings.Builder{}
+		for key, t := range l.seen {
+			fmt.Fprintf(&b, "%d %s %s\n", t.UnixNano(), key.address, key.sopInstanceUID)
+		}
+		_, err := io.WriteString(w, b.String())
+		return err
+	}); err != nil {
+		return err
+	}
+	if l.f != nil {
+		l.f.Close()
+	}
+	var err error
+	if l.f, err = os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		return err
+	}
+	l.compactedAt = now
+	return nil
+}
+
+// Reports whether the instance was delivered to "address" within the TTL.
+func (l *deliveredLog) delivered(address, sopInstanceUID string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	t, ok := l.seen[deliveredKey{address, sopInstanceUID}]
+	return ok && time.Since(t) < l.ttl
+}
+
+// Record the delivery of the instance to "address". The record is synced
+// before it returns.
+func (l *deliveredLog) add(address, sopInstanceUID string) error {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.seen[deliveredKey{address, sopInstanceUID}] = now
+	if now.Sub(l.compactedAt) >= l.ttl {
+		// The new entry is written along with the others.
+		return l.compactLocked(now)
+	}
+	if _, err := fmt.Fprintf(l.f, "%d %s %s\n", now.UnixNano(), address, sopInstanceUID); err != nil {
+		return err
+	}
+	return l.f.Sync()
+}
+
+func (l *deliveredLog) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.f.Close()
+}
+
+// Reports whether the destination of "su" holds the instance in the spool
+// file at "path", whose meta information is "h", with a study root C-FIND at
+// the IMAGE level.
+func verifyDelivered(su *ServiceUser, path string, h part10Header) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	r := bufio.NewReaderSize(f, 64<<10)
+	if _, err := readPart10Header(r); err != nil {
+		return false, err
+	}
+	// The study and series are needed by archives that only support
+	// hierarchical queries. If they can't be found, e.g., because an
+	// undefined-length sequence precedes them, they are left universal.
+	elems := peekElements(r, h.transferSyntaxUID, dicomtag.StudyID)
+	uids, err := cFindStrings(su, dicomtag.SOPInstanceUID, []*dicom.Element{
+		dicom.MustNewElement(dicomtag.QueryRetrieveLevel, []string{"IMAGE"}),
+		dicom.MustNewElement(dicomtag.StudyInstanceUID, []string{elementString(elems, dicomtag.StudyInstanceUID)}),
+		dicom.MustNewElement(dicomtag.SeriesInstanceUID, []string{elementString(elems, dicomtag.SeriesInstanceUID)}),
+		dicom.MustNewElement(dicomtag.SOPInstanceUID, []string{h.sopInstanceUID}),
+	})
+	if err != nil {
+		return false, err
+	}
+	for _, uid := range uids {
+		if uid == h.sopInstanceUID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Reports whether the destination of "su" accepted the presentation context
+// verifyDelivered needs.
+func canVerifyDelivered(su *ServiceUser) error {
+	_, err := su.cm.lookupByAbstractSyntaxUID(dicomuid.StudyRootQRFind)
+	return err
+}
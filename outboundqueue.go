@@ -0,0 +1,648 @@
+package netdicom
+
+// This file implements OutboundQueue: a spool of C-STORE operations kept on
+// disk, so that instances bound for a destination that is unreachable, e.g., a
+// PACS across a flaky teleradiology link, survive until it comes back, and
+// across restarts.
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	dicomuid "github.com/antibios/dicom/pkg/uid"
+	"github.com/antibios/go-dicom/dicomlog"
+	"github.com/antibios/go-netdicom/dimse"
+	"github.com/antibios/go-netdicom/sopclass"
+)
+
+// DefaultOutboundRetryInterval is the default value of
+// OutboundQueueParams.RetryInterval.
+const DefaultOutboundRetryInterval = 30 * time.Second
+
+const (
+	// Suffix of a queued Part-10 file, and of one being written.
+	outboundFileSuffix = ".dcm"
+	outboundTempSuffix = ".tmp"
+
+	// Subdirectory that holds the instances given up on, and the suffix of
+	// the file that holds the last error of each.
+	outboundFailedDir   = "failed"
+	outboundErrorSuffix = ".err"
+
+	// Suffix of the file that marks a queued instance whose C-STORE got no
+	// response. See OutboundQueueParams.DedupTTL.
+	outboundInDoubtSuffix = ".indoubt"
+)
+
+// OutboundQueueParams configures an OutboundQueue.
+type OutboundQueueParams struct {
+	// Dir is the spool directory. It is created if needed. Instances
+	// queued by an earlier OutboundQueue on the same directory are sent
+	// too. Only one OutboundQueue may use a directory at a time.
+	Dir string
+
+	// Address is the "host:port" of the destination.
+	Address string
+
+	// ServiceUser configures the associations to the destination. If
+	// SOPClasses is empty, sopclass.StorageClasses is proposed.
+	ServiceUser ServiceUserParams
+
+	// RetryInterval is how long to wait after a failure before trying
+	// again. If zero, DefaultOutboundRetryInterval is used.
+	RetryInterval time.Duration
+
+	// MaxAttempts, if positive, is the number of times the destination may
+	// refuse an instance for lack of resources, i.e., answer its C-STORE
+	// with status 0xA7xx, before it is moved to the failed list. If zero,
+	// it is retried until it goes through. An instance the destination
+	// can never take is moved to the failed list at once: one it refuses
+	// with another failure status, one whose SOP class and transfer syntax
+	// it accepted no presentation context for, and one whose spool file
+	// can't be read. Other errors, such as failures to connect or
+	// associations that break off mid-transfer, don't count: the instance
+	// is retried until it goes through.
+	MaxAttempts int
+
+	// DedupTTL, if positive, makes the queue remember, for that long and
+	// across restarts, the SOP instance UIDs it has delivered to Address.
+	// An instance queued again within DedupTTL of its delivery is dropped
+	// instead of sent, as is one whose spool file outlived a crash right
+	// after its delivery. Only the UID is remembered, so a corrected
+	// instance that keeps the UID of one delivered within DedupTTL is
+	// dropped too.
+	//
+	// With DedupTTL, an instance whose C-STORE response never came, e.g.,
+	// because the association timed out after its data was sent, is marked
+	// in doubt. Before it is sent again, the queue asks the destination
+	// whether it holds the instance, with a study root C-FIND, and drops
+	// it if so. If the destination doesn't support C-FIND, the instance is
+	// moved to the failed list instead, for the caller to check and, if
+	// need be, send again with RetryFailed. The study root C-FIND SOP
+	// class is added to ServiceUser.SOPClasses for this. Without DedupTTL,
+	// such an instance is sent again, and the destination may then hold it
+	// twice.
+	DedupTTL time.Duration
+}
+
+// OutboundQueueStats describes the state of an OutboundQueue.
+type OutboundQueueStats struct {
+	// Instances waiting to be sent, and their size on disk.
+	Pending      int
+	PendingBytes int64
+
+	// Instances given up on. See OutboundQueue.Failed.
+	Failed int
+
+	// Instances sent since the queue was created.
+	Sent int64
+
+	// Instances dropped since the queue was created, because they had
+	// already been delivered. See OutboundQueueParams.DedupTTL.
+	Suppressed int64
+
+	// C-STOREs whose response never came. See
+	// OutboundQueueParams.DedupTTL.
+	InDoubt int64
+
+	// The last error, and when it happened. Cleared by a successful send.
+	LastError     error
+	LastErrorTime time.Time
+}
+
+// FailedTransfer is an instance an OutboundQueue gave up on.
+type FailedTransfer struct {
+	// Path of the Part-10 file.
+	Path string
+	// The error of the last attempt.
+	Err string
+}
+
+// OutboundQueue sends instances to one destination with C-STORE. Enqueue
+// returns once the instance is safely on disk; a goroutine sends the queued
+// instances in order, over one association, whenever the destination is
+// reachable. An instance the destination refuses doesn't hold up those behind
+// it: it is retried after RetryInterval, or moved to the failed list; see
+// MaxAttempts. Thread safe.
+type OutboundQueue struct {
+	params OutboundQueueParams
+	ctx    context.Context
+	cancel context.CancelFunc
+	wake   chan struct{} // capacity 1
+	done   chan struct{}
+
+	// Set iff params.DedupTTL > 0.
+	delivered *deliveredLog
+
+	mu          sync.Mutex
+	pending     []outboundFile // oldest first
+	attempts    map[string]int // keyed by outboundFile.name
+	nextSeq     uint64
+	failed      int
+	sent        int64
+	suppressed  int64
+	inDoubt     int64
+	lastErr     error
+	lastErrTime time.Time
+}
+
+// outboundFile is a queued Part-10 file in the spool directory.
+type outboundFile struct {
+	name string
+	size int64
+}
+
+// NewOutboundQueue creates a queue on params.Dir, and starts sending the
+// instances already in it.
+func NewOutboundQueue(params OutboundQueueParams) (*OutboundQueue, error) {
+	if params.Dir == "" || params.Address == "" {
+		return nil, errors.New("dicom.OutboundQueue: Dir and Address must be set")
+	}
+	if params.RetryInterval <= 0 {
+		params.RetryInterval = DefaultOutboundRetryInterval
+	}
+	if len(params.ServiceUser.SOPClasses) == 0 {
+		params.ServiceUser.SOPClasses = sopclass.StorageClasses
+	}
+	if params.DedupTTL > 0 && !containsString(params.ServiceUser.SOPClasses, dicomuid.StudyRootQRFind) {
+		params.ServiceUser.SOPClasses = append(append([]string(nil), params.ServiceUser.SOPClasses...), dicomuid.StudyRootQRFind)
+	}
+	if err := os.MkdirAll(filepath.Join(params.Dir, outboundFailedDir), 0755); err != nil {
+		return nil, err
+	}
+	q := &OutboundQueue{
+		params:   params,
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		attempts: map[string]int{},
+	}
+	if params.DedupTTL > 0 {
+		var err error
+		if q.delivered, err = openDeliveredLog(filepath.Join(params.Dir, outboundDeliveredFile), params.DedupTTL); err != nil {
+			return nil, err
+		}
+	}
+	if err := q.load(); err != nil {
+		if q.delivered != nil {
+			q.delivered.close()
+		}
+		return nil, err
+	}
+	q.ctx, q.cancel = context.WithCancel(context.Background())
+	go q.run()
+	return q, nil
+}
+
+// Read the spool directory. Files left half written by a crash are removed,
+// as are in-doubt marks left without their instance.
+func (q *OutboundQueue) load() error {
+	entries, err := os.ReadDir(q.params.Dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if !e.Type().IsRegular() {
+			continue
+		}
+		if strings.HasSuffix(name, outboundTempSuffix) {
+			os.Remove(filepath.Join(q.params.Dir, name))
+			continue
+		}
+		if strings.HasSuffix(name, outboundInDoubtSuffix) {
+			if _, err := os.Stat(filepath.Join(q.params.Dir, strings.TrimSuffix(name, outboundInDoubtSuffix))); os.IsNotExist(err) {
+				os.Remove(filepath.Join(q.params.Dir, name))
+			}
+			continue
+		}
+		if !strings.HasSuffix(name, outboundFileSuffix) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return err
+		}
+		q.pending = append(q.pending, outboundFile{name: name, size: info.Size()})
+		var seq uint64
+		if _, err := fmt.Sscanf(name, "%d", &seq); err == nil && seq >= q.nextSeq {
+			q.nextSeq = seq + 1
+		}
+	}
+	// The names are zero-padded sequence numbers, so this is queue order.
+	sort.Slice(q.pending, func(i, j int) bool { return q.pending[i].name < q.pending[j].name })
+	failed, err := q.Failed()
+	if err != nil {
+		return err
+	}
+	q.failed = len(failed)
+	return nil
+}
+
+// EnqueueRaw queues an instance whose dataset, "data", is encoded in
+// transferSyntaxUID, as passed to CStoreCallback.
+func (q *OutboundQueue) EnqueueRaw(sopClassUID, sopInstanceUID, transferSyntaxUID string, data []byte) error {
+	return q.enqueue(func(w io.Writer) error {
+		return WritePart10(w, transferSyntaxUID, sopClassUID, sopInstanceUID, "", data)
+	})
+}
+
+// EnqueueFile queues a copy of the DICOM Part-10 file at "path".
+func (q *OutboundQueue) EnqueueFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := readPart10Header(f); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return q.enqueue(func(w io.Writer) error {
+		_, err := io.Copy(w, f)
+		return err
+	})
+}
+
+// Write a new file in the spool directory, and queue it once it is synced.
+func (q *OutboundQueue) enqueue(write func(w io.Writer) error) error {
+	q.mu.Lock()
+	name := fmt.Sprintf("%020d%s", q.nextSeq, outboundFileSuffix)
+	q.nextSeq++
+	q.mu.Unlock()
+	size, err := writeFileSynced(filepath.Join(q.params.Dir, name), write)
+	if err != nil {
+		return fmt.Errorf("dicom.OutboundQueue: %v", err)
+	}
+	q.mu.Lock()
+	q.pending = append(q.pending, outboundFile{name: name, size: size})
+	sort.Slice(q.pending, func(i, j int) bool { return q.pending[i].name < q.pending[j].name })
+	q.mu.Unlock()
+	q.signal()
+	return nil
+}
+
+// Write "path" atomically: through a temporary file that is synced, then
+// renamed. Returns the size of the file.
+func writeFileSynced(path string, write func(w io.Writer) error) (int64, error) {
+	temp := path + outboundTempSuffix
+	f, err := os.Create(temp)
+	if err != nil {
+		return 0, err
+	}
+	err = write(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	var size int64
+	if err == nil {
+		size, err = f.Seek(0, io.SeekCurrent)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp, path)
+	}
+	if err != nil {
+		os.Remove(temp)
+		return 0, err
+	}
+	if d, err := os.Open(filepath.Dir(path)); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return size, nil
+}
+
+// Wake up the sender.
+func (q *OutboundQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Stats returns the state of the queue.
+func (q *OutboundQueue) Stats() OutboundQueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	s := OutboundQueueStats{
+		Pending:       len(q.pending),
+		Failed:        q.failed,
+		Sent:          q.sent,
+		Suppressed:    q.suppressed,
+		InDoubt:       q.inDoubt,
+		LastError:     q.lastErr,
+		LastErrorTime: q.lastErrTime,
+	}
+	for _, f := range q.pending {
+		s.PendingBytes += f.size
+	}
+	return s
+}
+
+// Failed lists the instances given up on, oldest first.
+func (q *OutboundQueue) Failed() ([]FailedTransfer, error) {
+	dir := filepath.Join(q.params.Dir, outboundFailedDir)
+	names, err := filepath.Glob(filepath.Join(dir, "*"+outboundFileSuffix))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	var failed []FailedTransfer
+	for _, path := range names {
+		msg, _ := os.ReadFile(path + outboundErrorSuffix)
+		failed = append(failed, FailedTransfer{Path: path, Err: string(msg)})
+	}
+	return failed, nil
+}
+
+// RetryFailed moves the instances given up on back to the end of the queue.
+func (q *OutboundQueue) RetryFailed() error {
+	failed, err := q.Failed()
+	if err != nil {
+		return err
+	}
+	for _, f := range failed {
+		q.mu.Lock()
+		name := fmt.Sprintf("%020d%s", q.nextSeq, outboundFileSuffix)
+		q.nextSeq++
+		q.mu.Unlock()
+		info, err := os.Stat(f.Path)
+		if err != nil {
+			return err
+		}
+		if err := os.Rename(f.Path, filepath.Join(q.params.Dir, name)); err != nil {
+			return err
+		}
+		os.Remove(f.Path + outboundErrorSuffix)
+		q.mu.Lock()
+		q.pending = append(q.pending, outboundFile{name: name, size: info.Size()})
+		q.failed--
+		q.mu.Unlock()
+	}
+	q.signal()
+	return nil
+}
+
+// Close stops sending. The instances still queued stay on disk, and are sent
+// by the next OutboundQueue created on the directory.
+func (q *OutboundQueue) Close() {
+	q.cancel()
+	<-q.done
+	if q.delivered != nil {
+		q.delivered.close()
+	}
+}
+
+func (q *OutboundQueue) run() {
+	defer close(q.done)
+	for {
+		q.mu.Lock()
+		n := len(q.pending)
+		q.mu.Unlock()
+		if n == 0 {
+			select {
+			case <-q.wake:
+				continue
+			case <-q.ctx.Done():
+				return
+			}
+		}
+		if q.sendPending() {
+			continue
+		}
+		timer := time.NewTimer(q.params.RetryInterval)
+		select {
+		case <-timer.C:
+		case <-q.ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// Send the queued instances over one association, until the queue is empty
+// or the association fails. An instance the destination refuses for lack of
+// resources is left for the next call, and those behind it are sent. Returns
+// false if the association failed, or an instance was left.
+func (q *OutboundQueue) sendPending() bool {
+	su, err := NewServiceUser(q.params.ServiceUser)
+	if err != nil {
+		q.setError(err)
+		return false
+	}
+	defer su.Release()
+	if err := su.ConnectContext(q.ctx, q.params.Address); err != nil {
+		q.setError(err)
+		return false
+	}
+	if err := su.waitUntilReady(); err != nil {
+		q.setError(err)
+		return false
+	}
+	// Instances left for the next call, keyed by outboundFile.name.
+	skipped := map[string]bool{}
+	for q.ctx.Err() == nil {
+		f, ok := q.nextPending(skipped)
+		if !ok {
+			return len(skipped) == 0
+		}
+		path := filepath.Join(q.params.Dir, f.name)
+		h, err := readSpoolHeader(path)
+		if err != nil {
+			q.setError(err)
+			q.giveUp(f, err)
+			continue
+		}
+		if q.delivered != nil && q.delivered.delivered(q.params.Address, h.sopInstanceUID) {
+			dicomlog.Vprintf(1, "dicom.OutboundQueue(%s): %s: %s already delivered; dropping it", q.params.Address, f.name, h.sopInstanceUID)
+			q.removeSent(f, true)
+			continue
+		}
+		if q.delivered != nil && q.isInDoubt(f) {
+			if err := canVerifyDelivered(su); err != nil {
+				q.setError(err)
+				q.giveUp(f, fmt.Errorf("no C-STORE response was received, and whether the destination holds it can't be checked: %v", err))
+				continue
+			}
+			held, err := verifyDelivered(su, path, h)
+			if err != nil {
+				dicomlog.Vprintf(0, "dicom.OutboundQueue(%s): %s: %v", q.params.Address, f.name, err)
+				q.setError(err)
+				return false
+			}
+			if held {
+				dicomlog.Vprintf(0, "dicom.OutboundQueue(%s): %s: the destination holds %s; dropping it", q.params.Address, f.name, h.sopInstanceUID)
+				if err := q.delivered.add(q.params.Address, h.sopInstanceUID); err != nil {
+					dicomlog.Vprintf(0, "dicom.OutboundQueue(%s): %v", q.params.Address, err)
+				}
+				q.removeSent(f, true)
+				continue
+			}
+		}
+		// No other association would accept it either.
+		if _, err := lookupCStoreContext(su.cm, h.sopClassUID, h.transferSyntaxUID, true); err != nil {
+			q.setError(err)
+			q.giveUp(f, err)
+			continue
+		}
+		if err := su.CStoreFile(path); err != nil {
+			dicomlog.Vprintf(0, "dicom.OutboundQueue(%s): %s: %v", q.params.Address, f.name, err)
+			q.setError(err)
+			if !q.onSendFailure(f, err) {
+				return false
+			}
+			skipped[f.name] = true
+			continue
+		}
+		if q.delivered != nil {
+			// Recorded before the file is removed, so that a crash in
+			// between doesn't cause a second delivery.
+			if err := q.delivered.add(q.params.Address, h.sopInstanceUID); err != nil {
+				dicomlog.Vprintf(0, "dicom.OutboundQueue(%s): %v", q.params.Address, err)
+			}
+		}
+		q.removeSent(f, false)
+	}
+	return false
+}
+
+// Reports whether the last C-STORE of "f" got no response.
+func (q *OutboundQueue) isInDoubt(f outboundFile) bool {
+	_, err := os.Stat(q.inDoubtPath(f))
+	return err == nil
+}
+
+func (q *OutboundQueue) inDoubtPath(f outboundFile) string {
+	return filepath.Join(q.params.Dir, f.name+outboundInDoubtSuffix)
+}
+
+// Returns the oldest queued instance not in "skipped".
+func (q *OutboundQueue) nextPending(skipped map[string]bool) (outboundFile, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, f := range q.pending {
+		if !skipped[f.name] {
+			return f, true
+		}
+	}
+	return outboundFile{}, false
+}
+
+// Returns the file meta information of the spool file at "path".
+func readSpoolHeader(path string) (part10Header, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return part10Header{}, err
+	}
+	defer f.Close()
+	h, err := readPart10Header(bufio.NewReader(f))
+	if err != nil {
+		return part10Header{}, fmt.Errorf("%s: %v", filepath.Base(path), err)
+	}
+	return h, nil
+}
+
+// Remove "f" from the queue once it has been delivered, now or, if
+// "suppressed", before.
+func (q *OutboundQueue) removeSent(f outboundFile, suppressed bool) {
+	// The mark goes first: an instance left behind by a crash is then
+	// dropped for being in the delivered log.
+	os.Remove(q.inDoubtPath(f))
+	if err := os.Remove(filepath.Join(q.params.Dir, f.name)); err != nil {
+		dicomlog.Vprintf(0, "dicom.OutboundQueue(%s): %v", q.params.Address, err)
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.removePendingLocked(f)
+	if suppressed {
+		q.suppressed++
+		return
+	}
+	q.sent++
+	q.lastErr = nil
+}
+
+// REQUIRES: q.mu is held.
+func (q *OutboundQueue) removePendingLocked(f outboundFile) {
+	for i, p := range q.pending {
+		if p.name == f.name {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			break
+		}
+	}
+	delete(q.attempts, f.name)
+}
+
+func (q *OutboundQueue) setError(err error) {
+	q.mu.Lock()
+	q.lastErr = err
+	q.lastErrTime = time.Now()
+	q.mu.Unlock()
+}
+
+// Handle the failure of the C-STORE of "f". An instance the destination
+// refused for lack of resources is retried until MaxAttempts is reached; one
+// it refused with another failure status, it never will accept, so it is
+// moved to the failed list at once. Returns true if the association is still
+// usable, i.e., the destination answered.
+func (q *OutboundQueue) onSendFailure(f outboundFile, sendErr error) bool {
+	var statusErr *CStoreStatusError
+	if !errors.As(sendErr, &statusErr) {
+		if errors.Is(sendErr, ErrCStoreNoResponse) {
+			if q.delivered != nil {
+				dicomlog.Vprintf(0, "dicom.OutboundQueue(%s): %s: no C-STORE response; checking whether the destination holds it before sending it again", q.params.Address, f.name)
+				if err := os.WriteFile(q.inDoubtPath(f), nil, 0644); err != nil {
+					dicomlog.Vprintf(0, "dicom.OutboundQueue(%s): %v", q.params.Address, err)
+				}
+			} else {
+				dicomlog.Vprintf(0, "dicom.OutboundQueue(%s): %s: no C-STORE response; the destination may have stored it, but it will be sent again", q.params.Address, f.name)
+			}
+			q.mu.Lock()
+			q.inDoubt++
+			q.mu.Unlock()
+		}
+		return false
+	}
+	if statusErr.Response.Status.Status&0xff00 != dimse.CStoreOutOfResources&0xff00 {
+		q.giveUp(f, sendErr)
+		return true
+	}
+	q.mu.Lock()
+	q.attempts[f.name]++
+	n := q.attempts[f.name]
+	q.mu.Unlock()
+	if q.params.MaxAttempts > 0 && n >= q.params.MaxAttempts {
+		dicomlog.Vprintf(0, "dicom.OutboundQueue(%s): %s refused %d times", q.params.Address, f.name, n)
+		q.giveUp(f, sendErr)
+	}
+	return true
+}
+
+// Move "f" to the failed list, recording "cause".
+func (q *OutboundQueue) giveUp(f outboundFile, cause error) {
+	path := filepath.Join(q.params.Dir, outboundFailedDir, f.name)
+	if err := os.Rename(filepath.Join(q.params.Dir, f.name), path); err != nil {
+		dicomlog.Vprintf(0, "dicom.OutboundQueue(%s): %v", q.params.Address, err)
+		return
+	}
+	os.WriteFile(path+outboundErrorSuffix, []byte(cause.Error()), 0644)
+	os.Remove(q.inDoubtPath(f))
+	dicomlog.Vprintf(0, "dicom.OutboundQueue(%s): giving up on %s: %v", q.params.Address, f.name, cause)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.removePendingLocked(f)
+	q.failed++
+}
@@ -0,0 +1,347 @@
+package netdicom
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/antibios/dicom"
+	"github.com/antibios/dicom/pkg/tag"
+	"github.com/antibios/go-netdicom/dimse"
+	"github.com/stretchr/testify/require"
+)
+
+// Instances queued while the destination is down survive a restart of the
+// queue, and are sent in order once it comes up.
+func TestOutboundQueue(t *testing.T) {
+	const sopClassUID = "1.2.840.10008.5.1.4.1.1.7" // Secondary capture
+	dir, err := os.MkdirTemp("", "outboundqueue")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Reserve a port, and leave it closed for now.
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	l.Close()
+
+	params := OutboundQueueParams{Dir: dir, Address: addr, RetryInterval: 10 * time.Millisecond, MaxAttempts: 1}
+	q, err := NewOutboundQueue(params)
+	require.NoError(t, err)
+	payload := []byte("outbound queue payload")
+	for _, uid := range []string{"1.2.3.1", "1.2.3.2", "1.2.3.3"} {
+		require.NoError(t, q.EnqueueRaw(sopClassUID, uid, "1.2.840.10008.1.2", payload))
+	}
+	require.Eventually(t, func() bool { return q.Stats().LastError != nil }, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, 3, q.Stats().Pending)
+	q.Close()
+
+	var mu sync.Mutex
+	var stored []string
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		CStore: func(conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID, calledAE, callingAE string, data []byte) dimse.Status {
+			if sopInstanceUID == "1.2.3.2" {
+				return dimse.Status{Status: dimse.CStoreOutOfResources}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			stored = append(stored, sopInstanceUID)
+			return dimse.Success
+		},
+	}, addr)
+	require.NoError(t, err)
+	go sp.Run()
+
+	q, err = NewOutboundQueue(params)
+	require.NoError(t, err)
+	defer q.Close()
+	require.Eventually(t, func() bool { return q.Stats().Pending == 0 }, 5*time.Second, 10*time.Millisecond)
+	mu.Lock()
+	require.Equal(t, []string{"1.2.3.1", "1.2.3.3"}, stored)
+	mu.Unlock()
+	stats := q.Stats()
+	require.EqualValues(t, 2, stats.Sent)
+	require.Equal(t, 1, stats.Failed)
+	failed, err := q.Failed()
+	require.NoError(t, err)
+	require.Len(t, failed, 1)
+	require.NotEmpty(t, failed[0].Err)
+
+	require.NoError(t, q.RetryFailed())
+	require.Equal(t, 0, q.Stats().Failed)
+	require.Eventually(t, func() bool { return q.Stats().Failed == 1 }, 5*time.Second, 10*time.Millisecond)
+}
+
+// With DedupTTL, an instance queued again after its delivery is dropped, also
+// by a queue created later on the same directory.
+func TestOutboundQueueDedup(t *testing.T) {
+	const sopClassUID = "1.2.840.10008.5.1.4.1.1.7" // Secondary capture
+	dir, err := os.MkdirTemp("", "outboundqueue")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var mu sync.Mutex
+	var stored []string
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		CStore: func(conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID, calledAE, callingAE string, data []byte) dimse.Status {
+			mu.Lock()
+			defer mu.Unlock()
+			stored = append(stored, sopInstanceUID)
+			return dimse.Success
+		},
+	}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+
+	params := OutboundQueueParams{Dir: dir, Address: sp.ListenAddr().String(), RetryInterval: 10 * time.Millisecond, DedupTTL: time.Hour}
+	payload := []byte("outbound queue payload")
+	q, err := NewOutboundQueue(params)
+	require.NoError(t, err)
+	require.NoError(t, q.EnqueueRaw(sopClassUID, "1.2.3.1", "1.2.840.10008.1.2", payload))
+	require.Eventually(t, func() bool { return q.Stats().Sent == 1 }, 5*time.Second, 10*time.Millisecond)
+	for _, uid := range []string{"1.2.3.1", "1.2.3.2"} {
+		require.NoError(t, q.EnqueueRaw(sopClassUID, uid, "1.2.840.10008.1.2", payload))
+	}
+	require.Eventually(t, func() bool { return q.Stats().Pending == 0 }, 5*time.Second, 10*time.Millisecond)
+	require.EqualValues(t, 1, q.Stats().Suppressed)
+	q.Close()
+
+	q, err = NewOutboundQueue(params)
+	require.NoError(t, err)
+	defer q.Close()
+	require.NoError(t, q.EnqueueRaw(sopClassUID, "1.2.3.2", "1.2.840.10008.1.2", payload))
+	require.Eventually(t, func() bool { return q.Stats().Pending == 0 }, 5*time.Second, 10*time.Millisecond)
+	stats := q.Stats()
+	require.EqualValues(t, 0, stats.Sent)
+	require.EqualValues(t, 1, stats.Suppressed)
+	mu.Lock()
+	require.Equal(t, []string{"1.2.3.1", "1.2.3.2"}, stored)
+	mu.Unlock()
+}
+
+// An association that breaks off mid-transfer doesn't count against
+// MaxAttempts: the instance is sent again over the next one.
+func TestOutboundQueueConnectionDrop(t *testing.T) {
+	const sopClassUID = "1.2.840.10008.5.1.4.1.1.7" // Secondary capture
+	dir, err := os.MkdirTemp("", "outboundqueue")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	drop := make(chan struct{})    // closed by the first CStore call
+	dropped := make(chan struct{}) // closed once the connection is cut
+	var mu sync.Mutex
+	var stored []string
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		CStore: func(conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID, calledAE, callingAE string, data []byte) dimse.Status {
+			mu.Lock()
+			stored = append(stored, sopInstanceUID)
+			first := len(stored) == 1
+			mu.Unlock()
+			if first {
+				close(drop)
+				<-dropped
+			}
+			return dimse.Success
+		},
+	}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+
+	proxy := newDroppingProxy(t, sp.ListenAddr().String(), drop, dropped)
+	params := OutboundQueueParams{Dir: dir, Address: proxy, RetryInterval: 10 * time.Millisecond, MaxAttempts: 1}
+	q, err := NewOutboundQueue(params)
+	require.NoError(t, err)
+	defer q.Close()
+	require.NoError(t, q.EnqueueRaw(sopClassUID, "1.2.3.1", "1.2.840.10008.1.2", []byte("outbound queue payload")))
+	require.Eventually(t, func() bool { return q.Stats().Pending == 0 }, 5*time.Second, 10*time.Millisecond)
+	stats := q.Stats()
+	require.EqualValues(t, 1, stats.Sent)
+	require.Equal(t, 0, stats.Failed)
+	require.EqualValues(t, 1, stats.InDoubt)
+	mu.Lock()
+	require.Equal(t, []string{"1.2.3.1", "1.2.3.1"}, stored)
+	mu.Unlock()
+}
+
+// Starts a proxy to "addr" that cuts its first connection once "drop" is
+// closed, then closes "dropped". Returns its address.
+func newDroppingProxy(t *testing.T, addr string, drop, dropped chan struct{}) string {
+	proxy, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { proxy.Close() })
+	go func() {
+		for i := 0; ; i++ {
+			c, err := proxy.Accept()
+			if err != nil {
+				return
+			}
+			s, err := net.Dial("tcp", addr)
+			if err != nil {
+				c.Close()
+				continue
+			}
+			go io.Copy(s, c)
+			go io.Copy(c, s)
+			if i == 0 {
+				go func() {
+					<-drop
+					c.Close()
+					s.Close()
+					close(dropped)
+				}()
+			}
+		}
+	}()
+	return proxy.Addr().String()
+}
+
+// With DedupTTL, an instance whose C-STORE got no response isn't sent again
+// if a C-FIND finds it on the destination.
+func TestOutboundQueueInDoubt(t *testing.T) {
+	const sopClassUID = "1.2.840.10008.5.1.4.1.1.7" // Secondary capture
+	dir, err := os.MkdirTemp("", "outboundqueue")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	drop := make(chan struct{})    // closed by the first CStore call
+	dropped := make(chan struct{}) // closed once the connection is cut
+	var mu sync.Mutex
+	var stored []string
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		CStore: func(conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID, calledAE, callingAE string, data []byte) dimse.Status {
+			mu.Lock()
+			stored = append(stored, sopInstanceUID)
+			first := len(stored) == 1
+			mu.Unlock()
+			if first {
+				close(drop)
+				<-dropped
+			}
+			return dimse.Success
+		},
+		CFind: func(conn ConnectionState, transferSyntaxUID, sopClassUID string, filters []*dicom.Element, ch chan CFindResult) {
+			defer close(ch)
+			uid := elementString(filters, tag.SOPInstanceUID)
+			mu.Lock()
+			defer mu.Unlock()
+			for _, s := range stored {
+				if s == uid {
+					ch <- CFindResult{Elements: []*dicom.Element{dicom.MustNewElement(tag.SOPInstanceUID, []string{uid})}}
+					return
+				}
+			}
+		},
+	}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+
+	proxy := newDroppingProxy(t, sp.ListenAddr().String(), drop, dropped)
+	params := OutboundQueueParams{Dir: dir, Address: proxy, RetryInterval: 10 * time.Millisecond, DedupTTL: time.Hour}
+	q, err := NewOutboundQueue(params)
+	require.NoError(t, err)
+	defer q.Close()
+	require.NoError(t, q.EnqueueRaw(sopClassUID, "1.2.3.1", "1.2.840.10008.1.2", []byte("outbound queue payload")))
+	require.Eventually(t, func() bool { return q.Stats().Pending == 0 }, 5*time.Second, 10*time.Millisecond)
+	stats := q.Stats()
+	require.EqualValues(t, 0, stats.Sent)
+	require.EqualValues(t, 1, stats.Suppressed)
+	require.EqualValues(t, 1, stats.InDoubt)
+	mu.Lock()
+	require.Equal(t, []string{"1.2.3.1"}, stored)
+	mu.Unlock()
+}
+
+// Instances the destination can never take are moved to the failed list at
+// once, even without MaxAttempts, and don't hold up those behind them.
+func TestOutboundQueuePermanentFailures(t *testing.T) {
+	const sopClassUID = "1.2.840.10008.5.1.4.1.1.7" // Secondary capture
+	const ctImageStorage = "1.2.840.10008.5.1.4.1.1.2"
+	dir, err := os.MkdirTemp("", "outboundqueue")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	// A spool file that can't be read, at the head of the queue.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, fmt.Sprintf("%020d%s", 0, outboundFileSuffix)), []byte("garbage"), 0644))
+
+	var mu sync.Mutex
+	var stored []string
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		CStore: func(conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID, calledAE, callingAE string, data []byte) dimse.Status {
+			if sopInstanceUID == "1.2.3.1" {
+				return dimse.StatusCannotUnderstand("")
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			stored = append(stored, sopInstanceUID)
+			return dimse.Success
+		},
+	}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+
+	params := OutboundQueueParams{
+		Dir:           dir,
+		Address:       sp.ListenAddr().String(),
+		ServiceUser:   ServiceUserParams{SOPClasses: []string{sopClassUID}},
+		RetryInterval: time.Hour,
+	}
+	q, err := NewOutboundQueue(params)
+	require.NoError(t, err)
+	defer q.Close()
+	payload := []byte("outbound queue payload")
+	require.NoError(t, q.EnqueueRaw(sopClassUID, "1.2.3.1", "1.2.840.10008.1.2", payload))
+	// No presentation context is proposed for it.
+	require.NoError(t, q.EnqueueRaw(ctImageStorage, "1.2.3.2", "1.2.840.10008.1.2", payload))
+	require.NoError(t, q.EnqueueRaw(sopClassUID, "1.2.3.3", "1.2.840.10008.1.2", payload))
+	require.Eventually(t, func() bool { return q.Stats().Pending == 0 }, 5*time.Second, 10*time.Millisecond)
+	stats := q.Stats()
+	require.EqualValues(t, 1, stats.Sent)
+	require.Equal(t, 3, stats.Failed)
+	mu.Lock()
+	require.Equal(t, []string{"1.2.3.3"}, stored)
+	mu.Unlock()
+	failed, err := q.Failed()
+	require.NoError(t, err)
+	require.Len(t, failed, 3)
+	require.Contains(t, failed[0].Err, "dicom.part10")
+	require.Contains(t, failed[1].Err, "failed")
+	require.Contains(t, failed[2].Err, "Unknown syntax")
+}
+
+// The delivered log drops expired entries, from memory and from the file, as
+// it grows.
+func TestDeliveredLogCompaction(t *testing.T) {
+	dir, err := os.MkdirTemp("", "outboundqueue")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, outboundDeliveredFile)
+
+	const ttl = 100 * time.Millisecond
+	l, err := openDeliveredLog(path, ttl)
+	require.NoError(t, err)
+	defer l.close()
+	require.NoError(t, l.add("host:104", "1.2.3.1"))
+	require.True(t, l.delivered("host:104", "1.2.3.1"))
+	time.Sleep(ttl)
+	require.NoError(t, l.add("host:104", "1.2.3.2"))
+	require.False(t, l.delivered("host:104", "1.2.3.1"))
+	require.True(t, l.delivered("host:104", "1.2.3.2"))
+	l.mu.Lock()
+	require.Len(t, l.seen, 1)
+	l.mu.Unlock()
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.NotContains(t, string(data), "1.2.3.1")
+	require.Contains(t, string(data), "1.2.3.2")
+
+	// Entries appended after the compaction are kept across a reopen.
+	require.NoError(t, l.add("host:104", "1.2.3.3"))
+	l2, err := openDeliveredLog(path, ttl)
+	require.NoError(t, err)
+	defer l2.close()
+	require.True(t, l2.delivered("host:104", "1.2.3.3"))
+}
@@ -0,0 +1,148 @@
+package netdicom
+
+// This file reads and writes the file meta information of a DICOM Part-10
+// stream. The meta information (group 0002) is never sent over the network,
+// so it's stripped before C-STORE and synthesized again on receipt. P3.10 7.1.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/antibios/dicom"
+	dicomtag "github.com/antibios/dicom/pkg/tag"
+)
+
+// The fields of the file meta information that C-STORE needs.
+type part10Header struct {
+	sopClassUID       string
+	sopInstanceUID    string
+	transferSyntaxUID string
+}
+
+// Read the preamble and the file meta information from "r", leaving "r" at
+// the start of the dataset. The meta information is always explicit VR little
+// endian, and starts with its group length.
+func readPart10Header(r io.Reader) (part10Header, error) {
+	var h part10Header
+	var preamble [132]byte
+	if _, err := io.ReadFull(r, preamble[:]); err != nil {
+		return h, fmt.Errorf("dicom.part10: reading the preamble: %v", err)
+	}
+	if string(preamble[128:]) != "DICM" {
+		return h, fmt.Errorf("dicom.part10: 'DICM' magic not found")
+	}
+	// (0002,0000) UL, 4 bytes.
+	var groupLength [12]byte
+	if _, err := io.ReadFull(r, groupLength[:]); err != nil {
+		return h, fmt.Errorf("dicom.part10: reading the meta group length: %v", err)
+	}
+	if !bytes.Equal(groupLength[:8], []byte{2, 0, 0, 0, 'U', 'L', 4, 0}) {
+		return h, fmt.Errorf("dicom.part10: the meta information doesn't start with its group length")
+	}
+	meta := make([]byte, binary.LittleEndian.Uint32(groupLength[8:]))
+	if _, err := io.ReadFull(r, meta); err != nil {
+		return h, fmt.Errorf("dicom.part10: reading the meta information: %v", err)
+	}
+	for len(meta) > 0 {
+		if len(meta) < 8 {
+			return h, fmt.Errorf("dicom.part10: truncated meta element")
+		}
+		group := binary.LittleEndian.Uint16(meta[0:])
+		element := binary.LittleEndian.Uint16(meta[2:])
+		vr := string(meta[4:6])
+		var length uint32
+		if longExplicitVRs[vr] {
+			if len(meta) < 12 {
+				return h, fmt.Errorf("dicom.part10: truncated meta element")
+			}
+			length = binary.LittleEndian.Uint32(meta[8:])
+			meta = meta[12:]
+		} else {
+			length = uint32(binary.LittleEndian.Uint16(meta[6:]))
+			meta = meta[8:]
+		}
+		if group != 2 || uint32(len(meta)) < length {
+			return h, fmt.Errorf("dicom.part10: bad meta element (%04x,%04x)", group, element)
+		}
+		value := strings.TrimRight(string(meta[:length]), "\x00 ")
+		meta = meta[length:]
+		switch element {
+		case 0x0002:
+			h.sopClassUID = value
+		case 0x0003:
+			h.sopInstanceUID = value
+		case 0x0010:
+			h.transferSyntaxUID = value
+		}
+	}
+	if h.sopClassUID == "" || h.sopInstanceUID == "" || h.transferSyntaxUID == "" {
+		return h, fmt.Errorf("dicom.part10: the meta information lacks the SOP class, SOP instance or transfer syntax UID: %+v", h)
+	}
+	return h, nil
+}
+
+// WritePart10 writes a DICOM Part-10 file, made of the preamble, a File Meta
+// Information group synthesized from the arguments, and "data". The arguments
+// are typically those passed to CStoreCallback: data is the dataset encoded in
+// transferSyntaxUID, and sourceAETitle the calling AE title. sourceAETitle
+// may be empty, in which case SourceApplicationEntityTitle is omitted.
+func WritePart10(w io.Writer, transferSyntaxUID, sopClassUID, sopInstanceUID, sourceAETitle string, data []byte) error {
+	meta := bytes.Buffer{}
+	writeMetaElement(&meta, 0x0001, "OB", "\x00\x01")
+	writeMetaElement(&meta, 0x0002, "UI", sopClassUID)
+	writeMetaElement(&meta, 0x0003, "UI", sopInstanceUID)
+	writeMetaElement(&meta, 0x0010, "UI", transferSyntaxUID)
+	writeMetaElement(&meta, 0x0012, "UI", GoDICOMImplementationClassUID)
+	writeMetaElement(&meta, 0x0013, "SH", GoDICOMImplementationVersionName)
+	if sourceAETitle != "" {
+		writeMetaElement(&meta, 0x0016, "AE", sourceAETitle)
+	}
+	header := bytes.Buffer{}
+	header.Write(make([]byte, 128))
+	header.WriteString("DICM")
+	header.Write([]byte{2, 0, 0, 0, 'U', 'L', 4, 0})
+	binary.Write(&header, binary.LittleEndian, uint32(meta.Len()))
+	header.Write(meta.Bytes())
+	if _, err := w.Write(header.Bytes()); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// Append an explicit VR little endian element of group 0002 to "b". The value
+// is padded to an even length, with NUL for UIDs and space otherwise.
+func writeMetaElement(b *bytes.Buffer, element uint16, vr string, value string) {
+	if len(value)%2 != 0 {
+		if vr == "UI" || vr == "OB" {
+			value += "\x00"
+		} else {
+			value += " "
+		}
+	}
+	binary.Write(b, binary.LittleEndian, [2]uint16{2, element})
+	b.WriteString(vr)
+	if longExplicitVRs[vr] {
+		binary.Write(b, binary.LittleEndian, [2]uint16{0, 0})
+		binary.Write(b, binary.LittleEndian, uint32(len(value)))
+	} else {
+		binary.Write(b, binary.LittleEndian, uint16(len(value)))
+	}
+	b.WriteString(value)
+}
+
+// StripFileMetaElements returns the elements not in the File Meta Information
+// group. A dataset read from a Part-10 file must be stripped this way before
+// being encoded for C-STORE.
+func StripFileMetaElements(elems []*dicom.Element) []*dicom.Element {
+	var out []*dicom.Element
+	for _, elem := range elems {
+		if elem.Tag.Group != dicomtag.MetadataGroup {
+			out = append(out, elem)
+		}
+	}
+	return out
+}
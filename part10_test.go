@@ -0,0 +1,41 @@
+package netdicom
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/antibios/dicom"
+	"github.com/antibios/dicom/pkg/tag"
+	"github.com/antibios/dicom/pkg/uid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWritePart10RoundTrip(t *testing.T) {
+	body := []byte{1, 2, 3, 4, 5, 6}
+	b := bytes.Buffer{}
+	require.NoError(t, WritePart10(&b, uid.ExplicitVRLittleEndian, "1.2.840.10008.5.1.4.1.1.7", "1.2.3", "CALLER", body))
+	require.Contains(t, b.String(), "CALLER")
+
+	r := bytes.NewReader(b.Bytes())
+	h, err := readPart10Header(r)
+	require.NoError(t, err)
+	require.Equal(t, part10Header{
+		sopClassUID:       "1.2.840.10008.5.1.4.1.1.7",
+		sopInstanceUID:    "1.2.3",
+		transferSyntaxUID: uid.ExplicitVRLittleEndian,
+	}, h)
+	rest := make([]byte, r.Len())
+	r.Read(rest)
+	require.Equal(t, body, rest)
+}
+
+func TestStripFileMetaElements(t *testing.T) {
+	elems := []*dicom.Element{
+		dicom.MustNewElement(tag.TransferSyntaxUID, uid.ImplicitVRLittleEndian),
+		dicom.MustNewElement(tag.MediaStorageSOPInstanceUID, "1.2.3"),
+		dicom.MustNewElement(tag.PatientName, "foohah"),
+	}
+	stripped := StripFileMetaElements(elems)
+	require.Len(t, stripped, 1)
+	require.Equal(t, tag.PatientName, stripped[0].Tag)
+}
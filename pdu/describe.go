@@ -0,0 +1,101 @@
+package pdu
+
+// Descriptions of the result, source and reason fields of A-ASSOCIATE-RJ and
+// A-ABORT, in the terms of P3.8 Tables 9-21 and 9-26. The generated String
+// methods name constants, and SourceType and RejectReasonType values mean
+// different things depending on the PDU and the source, so these are the ones
+// to use in messages.
+
+import "fmt"
+
+// RejectResultDescription describes the Result field of A-ASSOCIATE-RJ.
+func RejectResultDescription(result RejectResultType) string {
+	switch result {
+	case ResultRejectedPermanent:
+		return "rejected-permanent"
+	case ResultRejectedTransient:
+		return "rejected-transient"
+	}
+	return fmt.Sprintf("reserved result %d", result)
+}
+
+// RejectSourceDescription describes the Source field of A-ASSOCIATE-RJ.
+func RejectSourceDescription(source SourceType) string {
+	switch source {
+	case SourceULServiceUser:
+		return "DICOM UL service-user"
+	case SourceULServiceProviderACSE:
+		return "DICOM UL service-provider (ACSE related function)"
+	case SourceULServiceProviderPresentation:
+		return "DICOM UL service-provider (presentation related function)"
+	}
+	return fmt.Sprintf("reserved source %d", source)
+}
+
+// RejectReasonDescription describes the Reason field of A-ASSOCIATE-RJ, whose
+// meaning depends on the Source field.
+func RejectReasonDescription(source SourceType, reason RejectReasonType) string {
+	switch source {
+	case SourceULServiceUser:
+		switch reason {
+		case RejectReasonNone:
+			return "no-reason-given"
+		case RejectReasonApplicationContextNameNotSupported:
+			return "application-context-name-not-supported"
+		case RejectReasonCallingAETitleNotRecognized:
+			return "calling-AE-title-not-recognized"
+		case RejectReasonCalledAETitleNotRecognized:
+			return "called-AE-title-not-recognized"
+		}
+	case SourceULServiceProviderACSE:
+		switch reason {
+		case RejectReasonNone:
+			return "no-reason-given"
+		case RejectReasonProtocolVersionNotSupported:
+			return "protocol-version-not-supported"
+		}
+	case SourceULServiceProviderPresentation:
+		switch reason {
+		case RejectReasonTemporaryCongestion:
+			return "temporary-congestion"
+		case RejectReasonLocalLimitExceeded:
+			return "local-limit-exceeded"
+		}
+	}
+	return fmt.Sprintf("reserved reason %d", reason)
+}
+
+// AbortSourceDescription describes the Source field of A-ABORT.
+func AbortSourceDescription(source SourceType) string {
+	switch source {
+	case AbortSourceServiceUser:
+		return "DICOM UL service-user (initiated abort)"
+	case AbortSourceServiceProvider:
+		return "DICOM UL service-provider (initiated abort)"
+	}
+	return fmt.Sprintf("reserved source %d", source)
+}
+
+// AbortReasonDescription describes the Reason field of A-ABORT. It is
+// significant only when the source is AbortSourceServiceProvider; otherwise
+// "not significant" is returned.
+func AbortReasonDescription(source SourceType, reason AbortReasonType) string {
+	if source != AbortSourceServiceProvider {
+		return "not significant"
+	}
+	switch reason {
+	case AbortReasonNotSpecified:
+		return "reason-not-specified"
+	case AbortReasonUnrecognizedPDU:
+		return "unrecognized-PDU"
+	case AbortReasonUnexpectedPDU:
+		return "unexpected-PDU"
+	case AbortReasonUnrecognizedPDUParameter:
+		return "unrecognized-PDU parameter"
+	case AbortReasonUnexpectedPDUParameter:
+		return "unexpected-PDU parameter"
+	case AbortReasonInvalidPDUParameterValue:
+		return "invalid-PDU-parameter value"
+	}
+	return fmt.Sprintf("reserved reason %d", reason)
+}
@@ -0,0 +1,79 @@
+package pdu
+
+// Multi-line formatting of A-ASSOCIATE-RQ and -AC, for logs and traces. The
+// output lists every field and item in the order they appear in the PDU, one
+// per line, so that two PDUs can be compared with a line diff.
+
+import (
+	"fmt"
+	"strings"
+)
+
+// FormatOptions controls AAssociate.Format.
+type FormatOptions struct {
+	// Redact prints the lengths of the fields of user identity items
+	// instead of their values, which may be credentials.
+	Redact bool
+	// MaxItems, if positive, limits the items listed in each list: the
+	// items of the PDU, of a presentation context, and of the user
+	// information. The rest are only counted.
+	MaxItems int
+}
+
+// RedactedFormat is the format of A-ASSOCIATE PDUs in log messages.
+var RedactedFormat = FormatOptions{Redact: true, MaxItems: 32}
+
+// Format returns a multi-line description of the PDU. String is
+// Format(FormatOptions{Redact: true}).
+func (pdu *AAssociate) Format(opts FormatOptions) string {
+	name := "AC"
+	if pdu.Type == TypeAAssociateRq {
+		name = "RQ"
+	}
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "A_ASSOCIATE_%s\n", name)
+	fmt.Fprintf(b, "  protocol version: %d\n", pdu.ProtocolVersion)
+	fmt.Fprintf(b, "  called AE title: %q\n", pdu.CalledAETitle)
+	fmt.Fprintf(b, "  calling AE title: %q\n", pdu.CallingAETitle)
+	fmt.Fprintf(b, "  items:")
+	formatSubItems(b, pdu.Items, "    ", opts)
+	return b.String()
+}
+
+// Appends "items", one per line, each preceded by "indent".
+func formatSubItems(b *strings.Builder, items []SubItem, indent string, opts FormatOptions) {
+	for i, item := range items {
+		if opts.MaxItems > 0 && i == opts.MaxItems {
+			fmt.Fprintf(b, "\n%s... %d more items", indent, len(items)-i)
+			return
+		}
+		b.WriteString("\n" + indent)
+		switch v := item.(type) {
+		case *PresentationContextItem:
+			if v.Type == ItemTypePresentationContextResponse {
+				fmt.Fprintf(b, "PresentationContextac{id: %d, result: %v}", v.ContextID, v.Result)
+			} else {
+				fmt.Fprintf(b, "PresentationContextrq{id: %d}", v.ContextID)
+			}
+			formatSubItems(b, v.Items, indent+"  ", opts)
+		case *UserInformationItem:
+			b.WriteString("UserInformationItem")
+			formatSubItems(b, v.Items, indent+"  ", opts)
+		case *UserIdentityRequestSubItem:
+			if opts.Redact {
+				b.WriteString(v.String())
+			} else {
+				fmt.Fprintf(b, "UserIdentityRequest{type: %d, positiveresponse: %v, primary: %q, secondary: %q}",
+					v.Type, v.PositiveResponseRequested, v.PrimaryField, v.SecondaryField)
+			}
+		case *UserIdentityResponseSubItem:
+			if opts.Redact {
+				b.WriteString(v.String())
+			} else {
+				fmt.Fprintf(b, "UserIdentityResponse{response: %q}", v.ServerResponse)
+			}
+		default:
+			b.WriteString(item.String())
+		}
+	}
+}
@@ -0,0 +1,372 @@
+package pdu
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// A PDU in testdata/associate. The file holds the PDU in hex, preceded by
+// comment lines. Two comments are directives:
+//
+//	# roundtrip: exact|lossy
+//	# strict: ok|error <substring of the Validate error>
+//
+// "exact" means that decoding and re-encoding must reproduce the input byte
+// for byte. "lossy" is for inputs with content that the standard tells
+// receivers to ignore; re-encoding then only needs to decode to the same PDU.
+type goldenPDU struct {
+	data        []byte
+	roundTrip   string
+	strictError string // empty if Validate must succeed
+}
+
+func readGoldenPDU(t *testing.T, path string) goldenPDU {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	g := goldenPDU{}
+	var hexData strings.Builder
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "#") {
+			hexData.WriteString(strings.Join(strings.Fields(line), ""))
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "#"))
+		if v := strings.TrimPrefix(line, "roundtrip:"); v != line {
+			g.roundTrip = strings.TrimSpace(v)
+		} else if v := strings.TrimPrefix(line, "strict:"); v != line {
+			v = strings.TrimSpace(v)
+			if v != "ok" {
+				g.strictError = strings.TrimSpace(strings.TrimPrefix(v, "error"))
+				require.NotEmpty(t, g.strictError, "%s: bad strict directive", path)
+			}
+		}
+	}
+	require.NoError(t, scanner.Err())
+	require.Contains(t, []string{"exact", "lossy"}, g.roundTrip, "%s: bad roundtrip directive", path)
+	g.data, err = hex.DecodeString(hexData.String())
+	require.NoError(t, err)
+	return g
+}
+
+// Decode, re-encode and validate each PDU in the corpus.
+func TestGoldenAssociatePDUs(t *testing.T) {
+	paths, err := filepath.Glob("testdata/associate/*.hex")
+	require.NoError(t, err)
+	require.NotEmpty(t, paths)
+	for _, path := range paths {
+		t.Run(strings.TrimSuffix(filepath.Base(path), ".hex"), func(t *testing.T) {
+			g := readGoldenPDU(t, path)
+			v, err := ReadPDU(bytes.NewReader(g.data), len(g.data)+16*1024)
+			require.NoError(t, err)
+			require.NotNil(t, v, "trailing bytes after the PDU")
+
+			encoded, err := EncodePDU(v)
+			require.NoError(t, err)
+			if g.roundTrip == "exact" {
+				require.Equal(t, hex.EncodeToString(g.data), hex.EncodeToString(encoded))
+			} else {
+				v2, err := ReadPDU(bytes.NewReader(encoded), len(encoded)+16*1024)
+				require.NoError(t, err)
+				require.Equal(t, v, v2)
+			}
+
+			err = Validate(v)
+			if g.strictError == "" {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), g.strictError)
+			}
+		})
+	}
+}
+
+// Count the bytes listed in a hex dump.
+func hexDumpBytes(t *testing.T, dump string) int {
+	n := 0
+	for _, line := range strings.Split(strings.TrimSuffix(dump, "\n"), "\n") {
+		require.True(t, len(line) >= 8+3*hexDumpWidth-1, "short line %q", line)
+		n += len(strings.Fields(line[8 : 8+3*hexDumpWidth-1]))
+	}
+	return n
+}
+
+// The dump of each PDU in the corpus annotates every byte, and a truncated
+// PDU is dumped to the end.
+func TestHexDump(t *testing.T) {
+	paths, err := filepath.Glob("testdata/associate/*.hex")
+	require.NoError(t, err)
+	for _, path := range paths {
+		g := readGoldenPDU(t, path)
+		dump := HexDump(g.data)
+		require.NotContains(t, dump, "truncated", path)
+		require.NotContains(t, dump, "unparsed", path)
+		require.Contains(t, dump, "PDU type: ", path)
+		require.Equal(t, len(g.data), hexDumpBytes(t, dump), path)
+
+		truncated := g.data[:len(g.data)-3]
+		dump = HexDump(truncated)
+		require.Contains(t, dump, "truncated", path)
+		require.Equal(t, len(truncated), hexDumpBytes(t, dump), path)
+	}
+
+	data, err := EncodePDU(&PDataTf{Items: []PresentationDataValueItem{
+		{ContextID: 3, Command: true, Last: true, Value: []byte{1, 2, 3}},
+	}})
+	require.NoError(t, err)
+	dump := HexDump(data)
+	require.Contains(t, dump, "context ID: 3")
+	require.Contains(t, dump, "message control header: command, last fragment")
+	require.Contains(t, dump, "command fragment (3 bytes)")
+}
+
+// A max PDU size of 2GB or more used to overflow the length check, which then
+// rejected every PDU.
+func TestReadPDULargeMaxPDUSize(t *testing.T) {
+	data, err := EncodePDU(&AReleaseRq{})
+	require.NoError(t, err)
+	v, err := ReadPDU(bytes.NewReader(data), 1<<31)
+	require.NoError(t, err)
+	require.IsType(t, &AReleaseRq{}, v)
+}
+
+// The same reason code means different things depending on the source.
+func TestRejectReasonDescription(t *testing.T) {
+	require.Equal(t, "application-context-name-not-supported", RejectReasonDescription(SourceULServiceUser, 2))
+	require.Equal(t, "protocol-version-not-supported", RejectReasonDescription(SourceULServiceProviderACSE, 2))
+	require.Equal(t, "local-limit-exceeded", RejectReasonDescription(SourceULServiceProviderPresentation, 2))
+	require.Equal(t, "reserved reason 5", RejectReasonDescription(SourceULServiceUser, 5))
+	require.Equal(t, "not significant", AbortReasonDescription(AbortSourceServiceUser, AbortReasonUnexpectedPDU))
+	require.Equal(t, "unexpected-PDU", AbortReasonDescription(AbortSourceServiceProvider, AbortReasonUnexpectedPDU))
+
+	dump := HexDump([]byte{3, 0, 0, 0, 0, 4, 0, 2, 3, 2})
+	require.Contains(t, dump, "reason: local-limit-exceeded")
+}
+
+// AE titles are decoded without their padding, and re-encoded with it.
+func TestAssociateAETitlePadding(t *testing.T) {
+	g := readGoldenPDU(t, "testdata/associate/synthetic-quirk-nul-padded-ae-titles.hex")
+	v, err := ReadPDU(bytes.NewReader(g.data), len(g.data)+16*1024)
+	require.NoError(t, err)
+	a := v.(*AAssociate)
+	require.Equal(t, "ARCHIVE", a.CalledAETitle)
+	require.Equal(t, "MODALITY", a.CallingAETitle)
+	require.Equal(t, "ARCHIVE\x00\x00\x00\x00\x00\x00\x00\x00\x00", a.RawCalledAETitle)
+
+	// A title changed after decoding replaces the raw field.
+	a.CalledAETitle = "PACS"
+	encoded, err := EncodePDU(a)
+	require.NoError(t, err)
+	v, err = ReadPDU(bytes.NewReader(encoded), len(encoded)+16*1024)
+	require.NoError(t, err)
+	require.Equal(t, "PACS            ", v.(*AAssociate).RawCalledAETitle)
+	require.Equal(t, a.RawCallingAETitle, v.(*AAssociate).RawCallingAETitle)
+}
+
+// AE titles of up to 16 characters are padded to 16; longer ones are an
+// error rather than being cut.
+func TestAssociateAETitleLength(t *testing.T) {
+	for _, n := range []int{1, 15, 16, 17} {
+		aeTitle := strings.Repeat("A", n)
+		v := &AAssociate{
+			Type:            TypeAAssociateRq,
+			ProtocolVersion: CurrentProtocolVersion,
+			CalledAETitle:   aeTitle,
+			CallingAETitle:  "CT1",
+			Items:           []SubItem{&ApplicationContextItem{Name: DICOMApplicationContextItemName}},
+		}
+		encoded, err := EncodePDU(v)
+		if n > 16 {
+			require.Error(t, err, n)
+			require.Contains(t, err.Error(), "longer than 16 characters")
+			require.Error(t, ValidateAETitle(aeTitle))
+			continue
+		}
+		require.NoError(t, err, n)
+		require.NoError(t, ValidateAETitle(aeTitle))
+		decoded, err := ReadPDU(bytes.NewReader(encoded), len(encoded))
+		require.NoError(t, err)
+		require.Equal(t, aeTitle, decoded.(*AAssociate).CalledAETitle)
+		require.Equal(t, aeTitle+strings.Repeat(" ", 16-n), decoded.(*AAssociate).RawCalledAETitle)
+	}
+}
+
+// User identity fields too long for the 2-byte item lengths are an error rather
+// than a wrapped length.
+func TestUserIdentityLength(t *testing.T) {
+	for _, c := range []struct {
+		primary, secondary int
+		wantErr            bool
+	}{
+		{1, 0, false},
+		// The user information item holds the 4-byte sub-item header,
+		// the 6 bytes of type, flag and lengths, and the fields.
+		{0xffff - 10, 0, false},
+		{0xffff - 10, 1, true},
+		{0x10000, 0, true},
+	} {
+		v := &AAssociate{
+			Type:            TypeAAssociateRq,
+			ProtocolVersion: CurrentProtocolVersion,
+			CalledAETitle:   "SCP",
+			CallingAETitle:  "SCU",
+			Items: []SubItem{
+				&ApplicationContextItem{Name: DICOMApplicationContextItemName},
+				&UserInformationItem{Items: []SubItem{&UserIdentityRequestSubItem{
+					Type:           UserIdentityUsernamePasscode,
+					PrimaryField:   make([]byte, c.primary),
+					SecondaryField: make([]byte, c.secondary),
+				}}},
+			},
+		}
+		_, err := EncodePDU(v)
+		if c.wantErr {
+			require.Error(t, err, "%d+%d bytes", c.primary, c.secondary)
+			require.Contains(t, err.Error(), "fit in the item")
+			continue
+		}
+		require.NoError(t, err, "%d+%d bytes", c.primary, c.secondary)
+	}
+}
+
+const testMaxPDUSize = 16 * 1024
+
+// Prefixes "body" with a PDU header.
+func rawPDU(typ Type, body []byte) []byte {
+	header := []byte{byte(typ), 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(header[2:], uint32(len(body)))
+	return append(header, body...)
+}
+
+// The fixed fields of an A-ASSOCIATE-RQ, followed by "items".
+func rawAAssociateRq(items ...byte) []byte {
+	body := []byte{0, 1, 0, 0}
+	body = append(body, []byte("CALLED          CALLING         ")...)
+	body = append(body, make([]byte, 32)...)
+	return rawPDU(TypeAAssociateRq, append(body, items...))
+}
+
+// Malformed PDUs are errors, never partially decoded PDUs. A stream that ends
+// inside a PDU is told apart from a PDU whose fields are inconsistent.
+func TestReadPDUMalformed(t *testing.T) {
+	rq, err := EncodePDU(&AAssociate{
+		Type:            TypeAAssociateRq,
+		ProtocolVersion: CurrentProtocolVersion,
+		CalledAETitle:   "CALLED",
+		CallingAETitle:  "CALLING",
+		Items:           []SubItem{&ApplicationContextItem{Name: DICOMApplicationContextItemName}},
+	})
+	require.NoError(t, err)
+
+	_, err = ReadPDU(bytes.NewReader(nil), testMaxPDUSize)
+	require.Equal(t, io.EOF, err)
+	for _, n := range []int{3, len(rq) - 1} {
+		_, err = ReadPDU(bytes.NewReader(rq[:n]), testMaxPDUSize)
+		require.Error(t, err, n)
+		require.True(t, errors.Is(err, io.ErrUnexpectedEOF), "%d: %v", n, err)
+	}
+
+	for _, test := range []struct {
+		name  string
+		data  []byte
+		error string
+	}{
+		{"unknown type", rawPDU(9, []byte{0, 0, 0, 0}), "unknown PDU type 0x9"},
+		{"short release", rawPDU(TypeAReleaseRq, []byte{0, 0}), "A_RELEASE_RQ: reserved bytes"},
+		{"long abort", rawPDU(TypeAAbort, []byte{0, 0, 2, 1, 0, 0}), "2 of the 6 bytes"},
+		{"short reject", rawPDU(TypeAAssociateRj, []byte{0, 1, 1}), "A_ASSOCIATE_RJ: reason: past the end"},
+		{"short associate", rawPDU(TypeAAssociateRq, []byte{0, 1, 0, 0, 'A'}), "called AE title: past the end"},
+		{"item overruns the PDU", rawAAssociateRq(0x10, 0, 0, 0x20, '1', '.', '2'), "length 32 exceeds the 3 bytes"},
+		{"item overruns its parent", rawAAssociateRq(0x50, 0, 0, 4, 0x51, 0, 0, 4, 0, 0, 0x40, 0), "length 4 exceeds the 0 bytes"},
+		{"item with bytes left over", rawAAssociateRq(0x53, 0, 0, 5, 0, 1, 0, 1, 9), "1 of its 5 bytes left over"},
+		{"short maximum length", rawAAssociateRq(0x50, 0, 0, 6, 0x51, 0, 0, 2, 0x40, 0), "must be 4 bytes, but found 2B"},
+		{"short role selection", rawAAssociateRq(0x54, 0, 0, 3, 0, 9, '1'), "RoleSelection: SOP class UID: past the end"},
+		{"PDV without header", rawPDU(TypePDataTf, []byte{0, 0, 0, 0}), "item 0: PresentationDataValue: length 0 is shorter"},
+		{"PDV with half a header", rawPDU(TypePDataTf, []byte{0, 0, 0, 1, 1}), "item 0: PresentationDataValue: length 1 is shorter"},
+		{"PDV after an empty one", rawPDU(TypePDataTf, []byte{0, 0, 0, 2, 1, 2, 0, 0, 0, 1, 1}), "item 1: PresentationDataValue: length 1 is shorter"},
+		{"PDV overruns the PDU", rawPDU(TypePDataTf, []byte{0, 0, 0, 8, 1, 3, 0}), "length 8 exceeds the 3 bytes"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			v, err := ReadPDU(bytes.NewReader(test.data), testMaxPDUSize)
+			require.Error(t, err)
+			require.Nil(t, v)
+			require.Contains(t, err.Error(), test.error)
+			// Not to be mistaken for a connection that broke
+			// off in the middle of a PDU.
+			require.NotContains(t, err.Error(), "EOF")
+		})
+	}
+}
+
+// A PDV of just the header, which some peers send to end a message, has an
+// empty value.
+func TestReadPDUEmptyPDV(t *testing.T) {
+	v, err := ReadPDU(bytes.NewReader(rawPDU(TypePDataTf, []byte{0, 0, 0, 2, 1, 3, 0, 0, 0, 2, 3, 2})), testMaxPDUSize)
+	require.NoError(t, err)
+	items := v.(*PDataTf).Items
+	require.Len(t, items, 2)
+	for i, want := range []PresentationDataValueItem{
+		{ContextID: 1, Command: true, Last: true},
+		{ContextID: 3, Command: false, Last: true},
+	} {
+		require.Empty(t, items[i].Value)
+		items[i].Value = nil
+		require.Equal(t, want, items[i])
+	}
+}
+
+// Format lists one field or item per line. Redaction hides credentials and
+// cuts long lists.
+func TestAAssociateFormat(t *testing.T) {
+	v := &AAssociate{
+		Type:            TypeAAssociateRq,
+		ProtocolVersion: CurrentProtocolVersion,
+		CalledAETitle:   "ARCHIVE",
+		CallingAETitle:  "CT1",
+		Items: []SubItem{
+			&ApplicationContextItem{Name: DICOMApplicationContextItemName},
+			&PresentationContextItem{Type: ItemTypePresentationContextRequest, ContextID: 1, Items: []SubItem{
+				&AbstractSyntaxSubItem{Name: "1.2.840.10008.1.1"},
+				&TransferSyntaxSubItem{Name: "1.2.840.10008.1.2"},
+			}},
+			&UserInformationItem{Items: []SubItem{
+				&UserInformationMaximumLengthItem{MaximumLengthReceived: 16384},
+				&UserIdentityRequestSubItem{Type: UserIdentityUsernamePasscode, PrimaryField: []byte("alice"), SecondaryField: []byte("secret")},
+			}},
+		},
+	}
+	require.Equal(t, `A_ASSOCIATE_RQ
+  protocol version: 1
+  called AE title: "ARCHIVE"
+  calling AE title: "CT1"
+  items:
+    ApplicationContext{name: "1.2.840.10008.3.1.1.1"}
+    PresentationContextrq{id: 1}
+      AbstractSyntax{name: "1.2.840.10008.1.1"}
+      TransferSyntax{name: "1.2.840.10008.1.2"}
+    UserInformationItem
+      UserInformationMaximumlengthItem{16384}
+      UserIdentityRequest{type: 2, positiveresponse: false, primary: "alice", secondary: "secret"}`,
+		v.Format(FormatOptions{}))
+	require.NotContains(t, v.String(), "secret")
+	require.Contains(t, v.String(), "secondary: 6 bytes")
+
+	for i := 0; i < 40; i++ {
+		v.Items = append(v.Items, &PresentationContextItem{Type: ItemTypePresentationContextRequest, ContextID: byte(2*i + 3)})
+	}
+	require.Contains(t, v.Format(RedactedFormat), "\n    ... 11 more items")
+	require.NotContains(t, v.String(), "more items")
+}
@@ -0,0 +1,330 @@
+package pdu
+
+// Annotated hex dumps of encoded PDUs, for debugging interoperability
+// problems.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// Number of bytes per line of a hex dump.
+const hexDumpWidth = 8
+
+// HexDump returns an annotated hex dump of an encoded PDU, as produced by
+// EncodePDU or read from the network. Each line shows an offset, up to 8
+// bytes, and the meaning of the field they encode, e.g.,
+//
+//	000000  01                       PDU type: TypeAAssociateRq
+//	000001  00                       reserved
+//	000002  00 00 00 cd              PDU length: 205
+//
+// The PDU needn't be valid: the dump stops annotating at the first field that
+// overruns the data, and dumps the remaining bytes as is.
+func HexDump(data []byte) string {
+	d := &hexDumper{data: data}
+	d.dumpPDU()
+	return d.buf.String()
+}
+
+type hexDumper struct {
+	buf  strings.Builder
+	data []byte
+	off  int
+}
+
+// Write "b", which starts at d.off, annotated with "note" on its first line.
+func (d *hexDumper) emit(b []byte, note string) {
+	for i := 0; i == 0 || i < len(b); i += hexDumpWidth {
+		end := i + hexDumpWidth
+		if end > len(b) {
+			end = len(b)
+		}
+		hex := make([]string, 0, hexDumpWidth)
+		for _, c := range b[i:end] {
+			hex = append(hex, fmt.Sprintf("%02x", c))
+		}
+		fmt.Fprintf(&d.buf, "%06x  %-*s  %s\n", d.off+i, 3*hexDumpWidth-1, strings.Join(hex, " "), note)
+		note = ""
+	}
+	d.off += len(b)
+}
+
+// Dump the next n bytes, annotated with describe(bytes). Returns the bytes,
+// or nil if fewer than n bytes remain before "end", in which case the rest is
+// dumped as truncated.
+func (d *hexDumper) field(n, end int, describe func(b []byte) string) []byte {
+	if n < 0 || d.off+n > end {
+		d.rest(end, fmt.Sprintf("truncated: expected %d more bytes", n))
+		return nil
+	}
+	b := d.data[d.off : d.off+n]
+	d.emit(b, describe(b))
+	return b
+}
+
+// Dump the bytes up to "end", if any, annotated with "note".
+func (d *hexDumper) rest(end int, note string) {
+	if end > len(d.data) {
+		end = len(d.data)
+	}
+	if d.off < end {
+		d.emit(d.data[d.off:end], note)
+	}
+}
+
+func hexNote(s string) func([]byte) string {
+	return func([]byte) string { return s }
+}
+
+func (d *hexDumper) dumpPDU() {
+	end := len(d.data)
+	typ := d.field(1, end, func(b []byte) string { return fmt.Sprintf("PDU type: %v", Type(b[0])) })
+	if typ == nil || d.field(1, end, hexNote("reserved")) == nil {
+		return
+	}
+	b := d.field(4, end, func(b []byte) string {
+		return fmt.Sprintf("PDU length: %d", binary.BigEndian.Uint32(b))
+	})
+	if b == nil {
+		return
+	}
+	if length := uint64(binary.BigEndian.Uint32(b)); uint64(d.off)+length < uint64(end) {
+		end = d.off + int(length)
+	}
+	switch Type(typ[0]) {
+	case TypeAAssociateRq, TypeAAssociateAc:
+		d.dumpAAssociate(end)
+	case TypeAAssociateRj:
+		var source SourceType // The meaning of the reason depends on it.
+		d.dumpFields(end, []string{"reserved", "result", "source", "reason"}, func(i int, v byte) string {
+			switch i {
+			case 1:
+				return RejectResultDescription(RejectResultType(v))
+			case 2:
+				source = SourceType(v)
+				return RejectSourceDescription(source)
+			case 3:
+				return RejectReasonDescription(source, RejectReasonType(v))
+			}
+			return ""
+		})
+	case TypeAAbort:
+		var source SourceType
+		d.dumpFields(end, []string{"reserved", "reserved", "source", "reason"}, func(i int, v byte) string {
+			switch i {
+			case 2:
+				source = SourceType(v)
+				return AbortSourceDescription(source)
+			case 3:
+				return AbortReasonDescription(source, AbortReasonType(v))
+			}
+			return ""
+		})
+	case TypeAReleaseRq, TypeAReleaseRp:
+		d.field(4, end, hexNote("reserved"))
+	case TypePDataTf:
+		d.dumpPDataTf(end)
+	}
+	d.rest(end, "unparsed")
+	d.rest(len(d.data), "trailing bytes after the PDU")
+}
+
+// Dump one-byte fields, named by "names" and described by describe(i, value).
+func (d *hexDumper) dumpFields(end int, names []string, describe func(i int, v byte) string) {
+	for i, name := range names {
+		b := d.field(1, end, func(b []byte) string {
+			if s := describe(i, b[0]); s != "" {
+				return fmt.Sprintf("%s: %s", name, s)
+			}
+			return name
+		})
+		if b == nil {
+			return
+		}
+	}
+}
+
+func (d *hexDumper) dumpAAssociate(end int) {
+	if d.field(2, end, func(b []byte) string {
+		return fmt.Sprintf("protocol version: %d", binary.BigEndian.Uint16(b))
+	}) == nil ||
+		d.field(2, end, hexNote("reserved")) == nil ||
+		d.field(16, end, func(b []byte) string { return fmt.Sprintf("called AE title: %q", string(b)) }) == nil ||
+		d.field(16, end, func(b []byte) string { return fmt.Sprintf("calling AE title: %q", string(b)) }) == nil ||
+		d.field(32, end, hexNote("reserved")) == nil {
+		return
+	}
+	d.dumpItems(end, "")
+}
+
+// Dump the items up to "end". "indent" prefixes the notes of nested items.
+func (d *hexDumper) dumpItems(end int, indent string) {
+	for d.off < end {
+		typ := d.field(1, end, func(b []byte) string {
+			return fmt.Sprintf("%sitem type: 0x%02x (%s)", indent, b[0], itemTypeName(b[0]))
+		})
+		if typ == nil || d.field(1, end, hexNote(indent+"  reserved")) == nil {
+			return
+		}
+		b := d.field(2, end, func(b []byte) string {
+			return fmt.Sprintf("%s  item length: %d", indent, binary.BigEndian.Uint16(b))
+		})
+		if b == nil {
+			return
+		}
+		itemEnd := d.off + int(binary.BigEndian.Uint16(b))
+		if itemEnd > end {
+			d.rest(end, indent+"  truncated item")
+			return
+		}
+		d.dumpItem(typ[0], itemEnd, indent+"  ")
+		d.rest(itemEnd, indent+"  unparsed")
+	}
+}
+
+func (d *hexDumper) dumpItem(typ byte, end int, indent string) {
+	str := func(name string) func([]byte) string {
+		return func(b []byte) string { return fmt.Sprintf("%s%s: %q", indent, name, string(b)) }
+	}
+	switch typ {
+	case ItemTypeApplicationContext:
+		d.field(end-d.off, end, str("application context name"))
+	case ItemTypeAbstractSyntax:
+		d.field(end-d.off, end, str("abstract syntax"))
+	case ItemTypeTransferSyntax:
+		d.field(end-d.off, end, str("transfer syntax"))
+	case ItemTypeImplementationClassUID:
+		d.field(end-d.off, end, str("implementation class UID"))
+	case ItemTypeImplementationVersionName:
+		d.field(end-d.off, end, str("implementation version name"))
+	case ItemTypePresentationContextRequest, ItemTypePresentationContextResponse:
+		if d.field(1, end, func(b []byte) string { return fmt.Sprintf("%scontext ID: %d", indent, b[0]) }) == nil ||
+			d.field(1, end, hexNote(indent+"reserved")) == nil {
+			return
+		}
+		if typ == ItemTypePresentationContextResponse {
+			if d.field(1, end, func(b []byte) string {
+				return fmt.Sprintf("%sresult: %v", indent, PresentationContextResult(b[0]))
+			}) == nil {
+				return
+			}
+		} else if d.field(1, end, hexNote(indent+"reserved")) == nil {
+			return
+		}
+		if d.field(1, end, hexNote(indent+"reserved")) == nil {
+			return
+		}
+		d.dumpItems(end, indent)
+	case ItemTypeUserInformation:
+		d.dumpItems(end, indent)
+	case ItemTypeUserInformationMaximumLength:
+		d.field(4, end, func(b []byte) string {
+			return fmt.Sprintf("%smaximum length received: %d", indent, binary.BigEndian.Uint32(b))
+		})
+	case ItemTypeAsynchronousOperationsWindow:
+		if d.field(2, end, func(b []byte) string {
+			return fmt.Sprintf("%smax operations invoked: %d", indent, binary.BigEndian.Uint16(b))
+		}) != nil {
+			d.field(2, end, func(b []byte) string {
+				return fmt.Sprintf("%smax operations performed: %d", indent, binary.BigEndian.Uint16(b))
+			})
+		}
+	case ItemTypeRoleSelection:
+		b := d.field(2, end, func(b []byte) string {
+			return fmt.Sprintf("%sSOP class UID length: %d", indent, binary.BigEndian.Uint16(b))
+		})
+		if b == nil || d.field(int(binary.BigEndian.Uint16(b)), end, str("SOP class UID")) == nil {
+			return
+		}
+		if d.field(1, end, func(b []byte) string { return fmt.Sprintf("%sSCU role: %d", indent, b[0]) }) != nil {
+			d.field(1, end, func(b []byte) string { return fmt.Sprintf("%sSCP role: %d", indent, b[0]) })
+		}
+	case ItemTypeUserIdentityRequest:
+		if d.field(1, end, func(b []byte) string { return fmt.Sprintf("%suser identity type: %d", indent, b[0]) }) == nil ||
+			d.field(1, end, func(b []byte) string { return fmt.Sprintf("%spositive response requested: %d", indent, b[0]) }) == nil {
+			return
+		}
+		for _, name := range []string{"primary field", "secondary field"} {
+			b := d.field(2, end, func(b []byte) string {
+				return fmt.Sprintf("%s%s length: %d", indent, name, binary.BigEndian.Uint16(b))
+			})
+			if b == nil || d.field(int(binary.BigEndian.Uint16(b)), end, hexNote(indent+name)) == nil {
+				return
+			}
+		}
+	case ItemTypeUserIdentityResponse:
+		b := d.field(2, end, func(b []byte) string {
+			return fmt.Sprintf("%sserver response length: %d", indent, binary.BigEndian.Uint16(b))
+		})
+		if b != nil {
+			d.field(int(binary.BigEndian.Uint16(b)), end, hexNote(indent+"server response"))
+		}
+	}
+}
+
+func itemTypeName(typ byte) string {
+	switch typ {
+	case ItemTypeApplicationContext:
+		return "application context"
+	case ItemTypePresentationContextRequest:
+		return "presentation context (request)"
+	case ItemTypePresentationContextResponse:
+		return "presentation context (response)"
+	case ItemTypeAbstractSyntax:
+		return "abstract syntax"
+	case ItemTypeTransferSyntax:
+		return "transfer syntax"
+	case ItemTypeUserInformation:
+		return "user information"
+	case ItemTypeUserInformationMaximumLength:
+		return "maximum length"
+	case ItemTypeImplementationClassUID:
+		return "implementation class UID"
+	case ItemTypeAsynchronousOperationsWindow:
+		return "asynchronous operations window"
+	case ItemTypeRoleSelection:
+		return "SCP/SCU role selection"
+	case ItemTypeImplementationVersionName:
+		return "implementation version name"
+	case ItemTypeUserIdentityRequest:
+		return "user identity (request)"
+	case ItemTypeUserIdentityResponse:
+		return "user identity (response)"
+	}
+	return "unknown"
+}
+
+func (d *hexDumper) dumpPDataTf(end int) {
+	for d.off < end {
+		b := d.field(4, end, func(b []byte) string {
+			return fmt.Sprintf("PDV item length: %d", binary.BigEndian.Uint32(b))
+		})
+		if b == nil {
+			return
+		}
+		length := uint64(binary.BigEndian.Uint32(b))
+		if length < 2 || uint64(d.off)+length > uint64(end) {
+			d.rest(end, "  truncated PDV item")
+			return
+		}
+		itemEnd := d.off + int(length)
+		d.field(1, itemEnd, func(b []byte) string { return fmt.Sprintf("  context ID: %d", b[0]) })
+		header := d.field(1, itemEnd, func(b []byte) string {
+			kind, last := "data", "more fragments follow"
+			if b[0]&1 != 0 {
+				kind = "command"
+			}
+			if b[0]&2 != 0 {
+				last = "last fragment"
+			}
+			return fmt.Sprintf("  message control header: %s, %s", kind, last)
+		})
+		kind := "data"
+		if header[0]&1 != 0 {
+			kind = "command"
+		}
+		d.rest(itemEnd, fmt.Sprintf("  %s fragment (%d bytes)", kind, itemEnd-d.off))
+	}
+}
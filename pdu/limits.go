@@ -0,0 +1,86 @@
+package pdu
+
+// This file implements AssociateLimits: bounds on the items of an
+// A-ASSOCIATE-RQ or -AC, checked on the encoded PDU before it is decoded, so
+// that a hostile peer can't make the decoder allocate an object per tiny item,
+// or recurse through deeply nested ones.
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// DefaultMaxAssociateItems is the default value of AssociateLimits.MaxItems.
+// It leaves room for 128 presentation contexts proposing dozens of transfer
+// syntaxes each.
+const DefaultMaxAssociateItems = 8192
+
+// DefaultMaxAssociateItemDepth is the default value of
+// AssociateLimits.MaxDepth: the items of the PDU, and their sub-items, as in
+// P3.8 9.3.2 and 9.3.3.
+const DefaultMaxAssociateItemDepth = 2
+
+// ErrAssociateTooComplex is returned, wrapped, by Reader.Read and ReadPDU for
+// an A-ASSOCIATE-RQ or -AC beyond its AssociateLimits.
+var ErrAssociateTooComplex = errors.New("A-ASSOCIATE: too many items, or items nested too deep")
+
+// AssociateLimits bounds the items of the A-ASSOCIATE-RQ and -AC PDUs read by
+// a Reader. The zero value applies the defaults.
+type AssociateLimits struct {
+	// MaxItems is the max number of items, sub-items included. If zero,
+	// DefaultMaxAssociateItems is used. If negative, there is no limit.
+	MaxItems int
+
+	// MaxDepth is the max nesting of the items: 1 allows only the items
+	// of the PDU, 2 their sub-items too. If zero,
+	// DefaultMaxAssociateItemDepth is used. If negative, there is no
+	// limit.
+	MaxDepth int
+}
+
+// Length of the fields of A-ASSOCIATE-RQ and -AC that precede the items.
+const associateHeaderLength = 2 + 2 + aeTitleLength*2 + 32
+
+// Check the items of "body", the body of an A-ASSOCIATE-RQ or -AC, against
+// "limits". Malformed items are left for the decoder to report.
+func checkAssociateItems(body []byte, limits AssociateLimits) error {
+	maxItems, maxDepth := limits.MaxItems, limits.MaxDepth
+	if maxItems == 0 {
+		maxItems = DefaultMaxAssociateItems
+	}
+	if maxDepth == 0 {
+		maxDepth = DefaultMaxAssociateItemDepth
+	}
+	var ends []int // End offsets of the items that enclose "pos".
+	items := 0
+	for pos := associateHeaderLength; ; {
+		for len(ends) > 0 && pos >= ends[len(ends)-1] {
+			ends = ends[:len(ends)-1]
+		}
+		if pos+4 > len(body) {
+			return nil
+		}
+		items++
+		if maxItems > 0 && items > maxItems {
+			return fmt.Errorf("%w: more than %d items", ErrAssociateTooComplex, maxItems)
+		}
+		if depth := len(ends) + 1; maxDepth > 0 && depth > maxDepth {
+			return fmt.Errorf("%w: item 0x%x at offset %d nested %d deep, more than %d", ErrAssociateTooComplex, body[pos], pos, depth, maxDepth)
+		}
+		start := pos + 4
+		end := start + int(binary.BigEndian.Uint16(body[pos+2:]))
+		switch body[pos] {
+		case ItemTypePresentationContextRequest, ItemTypePresentationContextResponse:
+			// Context ID, result, and reserved bytes, then the
+			// sub-items.
+			ends = append(ends, end)
+			pos = start + 4
+		case ItemTypeUserInformation:
+			ends = append(ends, end)
+			pos = start
+		default:
+			pos = end
+		}
+	}
+}
@@ -11,12 +11,13 @@ package pdu
 //
 // http://dicom.nema.org/medical/dicom/current/output/pdf/part08.pdf
 import (
-	"bufio"
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"math"
+	"strings"
 
 	"github.com/antibios/dicom/pkg/dicomio"
 )
@@ -66,22 +67,43 @@ const (
 	ItemTypeAsynchronousOperationsWindow = 0x53
 	ItemTypeRoleSelection                = 0x54
 	ItemTypeImplementationVersionName    = 0x55
+	ItemTypeUserIdentityRequest          = 0x58
+	ItemTypeUserIdentityResponse         = 0x59
 )
 
-func decodeSubItem(d dicomio.Reader) SubItem {
+// Decodes an item and checks that its body is consumed exactly, so that a
+// wrong length can't shift the items that follow.
+func decodeSubItem(d dicomio.Reader) (SubItem, error) {
 	itemType, err := d.ReadByte()
 	if err != nil {
-		log.Print("(decodeSubItem) Unable to read item type: ", err)
-		return nil
+		return nil, fieldError("item type", err)
+	}
+	if err := d.Skip(1); err != nil {
+		return nil, fieldError(fmt.Sprintf("item 0x%x: reserved byte", itemType), err)
 	}
-
-	d.Skip(1)
 	length, err := d.ReadUInt16()
 	if err != nil {
-		log.Print("(decodeSubItem) Able to decode item length: ", err)
-		return nil
+		return nil, fieldError(fmt.Sprintf("item 0x%x: length", itemType), err)
+	}
+	if int64(length) > d.BytesLeftUntilLimit() {
+		return nil, fmt.Errorf("item 0x%x: length %d exceeds the %d bytes left in the enclosing item",
+			itemType, length, d.BytesLeftUntilLimit())
+	}
+	if err := d.PushLimit(int64(length)); err != nil {
+		return nil, fmt.Errorf("item 0x%x: %v", itemType, err)
+	}
+	defer d.PopLimit()
+	item, err := decodeSubItemBody(d, itemType, length)
+	if err != nil {
+		return nil, fmt.Errorf("item 0x%x: %v", itemType, err)
+	}
+	if n := d.BytesLeftUntilLimit(); n > 0 {
+		return nil, fmt.Errorf("item 0x%x: %d of its %d bytes left over", itemType, n, length)
 	}
+	return item, nil
+}
 
+func decodeSubItemBody(d dicomio.Reader, itemType byte, length uint16) (SubItem, error) {
 	switch itemType {
 	case ItemTypeApplicationContext:
 		return decodeApplicationContextItem(d, length)
@@ -90,27 +112,46 @@ func decodeSubItem(d dicomio.Reader) SubItem {
 	case ItemTypeTransferSyntax:
 		return decodeTransferSyntaxSubItem(d, length)
 	case ItemTypePresentationContextRequest:
-		return decodePresentationContextItem(d, itemType, length)
+		return decodePresentationContextItem(d, itemType)
 	case ItemTypePresentationContextResponse:
-		return decodePresentationContextItem(d, itemType, length)
+		return decodePresentationContextItem(d, itemType)
 	case ItemTypeUserInformation:
-		return decodeUserInformationItem(d, length)
+		return decodeUserInformationItem(d)
 	case ItemTypeUserInformationMaximumLength:
 		return decodeUserInformationMaximumLengthItem(d, length)
 	case ItemTypeImplementationClassUID:
-		return decodeImplementationClassUIDSubItem(&d, length)
+		return decodeImplementationClassUIDSubItem(d, length)
 	case ItemTypeAsynchronousOperationsWindow:
-		return decodeAsynchronousOperationsWindowSubItem(d, length)
+		return decodeAsynchronousOperationsWindowSubItem(d)
 	case ItemTypeRoleSelection:
-		return decodeRoleSelectionSubItem(d, length)
+		return decodeRoleSelectionSubItem(d)
 	case ItemTypeImplementationVersionName:
 		return decodeImplementationVersionNameSubItem(d, length)
+	case ItemTypeUserIdentityRequest:
+		return decodeUserIdentityRequestSubItem(d)
+	case ItemTypeUserIdentityResponse:
+		return decodeUserIdentityResponseSubItem(d)
 	default:
-		log.Printf("(decodeSubItem) Unknown item type: 0x%x", itemType)
-		return nil
+		// E.g., SOP class extended negotiation. Keep
+		// the bytes so that the item can be re-encoded.
+		data, err := d.ReadString(uint32(length))
+		if err != nil {
+			return nil, fieldError("data", err)
+		}
+		return &SubItemUnsupported{Type: itemType, Data: []byte(data)}, nil
 	}
 }
 
+// Describes a failure to read "field". The body of a PDU is read in full
+// before it is decoded, so running out of bytes means that the field extends
+// past the end of its item or PDU, not that the connection was lost.
+func fieldError(field string, err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%s: past the end of the item", field)
+	}
+	return fmt.Errorf("%s: %v", field, err)
+}
+
 func encodeSubItemHeader(e *dicomio.Writer, itemType byte, length uint16) {
 	e.WriteByte(itemType)
 	e.WriteZeros(1)
@@ -137,19 +178,16 @@ func (v *UserInformationItem) Write(e *dicomio.Writer) {
 	e.WriteBytes(itemBytes)
 }
 
-func decodeUserInformationItem(d dicomio.Reader, length uint16) *UserInformationItem {
+func decodeUserInformationItem(d dicomio.Reader) (*UserInformationItem, error) {
 	v := &UserInformationItem{}
-	d.PushLimit(int64(length))
-	defer d.PopLimit()
 	for d.BytesLeftUntilLimit() > 0 {
-		item := decodeSubItem(d)
-		/* 	MK: Error check here.
-		if d.Error() != nil {
-			break
-		} */
+		item, err := decodeSubItem(d)
+		if err != nil {
+			return nil, fmt.Errorf("UserInformationItem: %v", err)
+		}
 		v.Items = append(v.Items, item)
 	}
-	return v
+	return v, nil
 }
 
 func (v *UserInformationItem) String() string {
@@ -167,12 +205,15 @@ func (v *UserInformationMaximumLengthItem) Write(e *dicomio.Writer) {
 	e.WriteUInt32(v.MaximumLengthReceived)
 }
 
-func decodeUserInformationMaximumLengthItem(d dicomio.Reader, length uint16) *UserInformationMaximumLengthItem {
+func decodeUserInformationMaximumLengthItem(d dicomio.Reader, length uint16) (*UserInformationMaximumLengthItem, error) {
+	if length != 4 {
+		return nil, fmt.Errorf("UserInformationMaximumLengthItem must be 4 bytes, but found %dB", length)
+	}
 	rtn, err := d.ReadUInt32()
-	if length != 4 || err != nil {
-		log.Printf("UserInformationMaximumLengthItem must be 4 bytes, but found %dB", length)
+	if err != nil {
+		return nil, fieldError("UserInformationMaximumLengthItem", err)
 	}
-	return &UserInformationMaximumLengthItem{MaximumLengthReceived: rtn}
+	return &UserInformationMaximumLengthItem{MaximumLengthReceived: rtn}, nil
 }
 
 func (v *UserInformationMaximumLengthItem) String() string {
@@ -183,8 +224,12 @@ func (v *UserInformationMaximumLengthItem) String() string {
 // PS3.7 Annex D.3.3.2.1
 type ImplementationClassUIDSubItem subItemWithName
 
-func decodeImplementationClassUIDSubItem(d *dicomio.Reader, length uint16) *ImplementationClassUIDSubItem {
-	return &ImplementationClassUIDSubItem{Name: decodeSubItemWithName(*d, length)}
+func decodeImplementationClassUIDSubItem(d dicomio.Reader, length uint16) (*ImplementationClassUIDSubItem, error) {
+	name, err := decodeSubItemWithName(d, length)
+	if err != nil {
+		return nil, fmt.Errorf("ImplementationClassUID: %v", err)
+	}
+	return &ImplementationClassUIDSubItem{Name: name}, nil
 }
 
 func (v *ImplementationClassUIDSubItem) Write(e *dicomio.Writer) {
@@ -201,17 +246,19 @@ type AsynchronousOperationsWindowSubItem struct {
 	MaxOpsPerformed uint16
 }
 
-func decodeAsynchronousOperationsWindowSubItem(d dicomio.Reader, length uint16) *AsynchronousOperationsWindowSubItem {
-	rtn, err := d.ReadUInt16()
+func decodeAsynchronousOperationsWindowSubItem(d dicomio.Reader) (*AsynchronousOperationsWindowSubItem, error) {
+	invoked, err := d.ReadUInt16()
 	if err != nil {
-		log.Print("(decodeAsynchronousOperationsWindowSubItem) Failed to convert ", err)
-		return nil
+		return nil, fieldError("AsynchronousOpsWindow: invoked", err)
 	}
-
-	return &AsynchronousOperationsWindowSubItem{
-		MaxOpsInvoked:   rtn,
-		MaxOpsPerformed: rtn,
+	performed, err := d.ReadUInt16()
+	if err != nil {
+		return nil, fieldError("AsynchronousOpsWindow: performed", err)
 	}
+	return &AsynchronousOperationsWindowSubItem{
+		MaxOpsInvoked:   invoked,
+		MaxOpsPerformed: performed,
+	}, nil
 }
 
 func (v *AsynchronousOperationsWindowSubItem) Write(e *dicomio.Writer) {
@@ -232,32 +279,28 @@ type RoleSelectionSubItem struct {
 	SCPRole     byte
 }
 
-func decodeRoleSelectionSubItem(d dicomio.Reader, length uint16) *RoleSelectionSubItem {
+func decodeRoleSelectionSubItem(d dicomio.Reader) (*RoleSelectionSubItem, error) {
 	uidLen, err := d.ReadUInt16()
 	if err != nil {
-		log.Println("(decodeRoleSelectionSubItem) Failed to decode ", err)
+		return nil, fieldError("RoleSelection: UID length", err)
 	}
-
 	sop, err := d.ReadString(uint32(uidLen))
 	if err != nil {
-		log.Println("(decodeRoleSelectionSubItem) Failed to decode SOPInsUID ", err)
+		return nil, fieldError("RoleSelection: SOP class UID", err)
 	}
-
 	scu, err := d.ReadByte()
 	if err != nil {
-		log.Println("(decodeRoleSelectionSubItem) Failed to decode SCURole ", err)
+		return nil, fieldError("RoleSelection: SCU role", err)
 	}
-
 	scp, err := d.ReadByte()
 	if err != nil {
-		log.Println("(decodeRoleSelectionSubItem) Failed to decode SCURole ", err)
+		return nil, fieldError("RoleSelection: SCP role", err)
 	}
-
 	return &RoleSelectionSubItem{
 		SOPClassUID: sop,
 		SCURole:     scu,
 		SCPRole:     scp,
-	}
+	}, nil
 }
 
 func (v *RoleSelectionSubItem) Write(e *dicomio.Writer) {
@@ -275,8 +318,12 @@ func (v *RoleSelectionSubItem) String() string {
 // PS3.7 Annex D.3.3.2.3
 type ImplementationVersionNameSubItem subItemWithName
 
-func decodeImplementationVersionNameSubItem(d dicomio.Reader, length uint16) *ImplementationVersionNameSubItem {
-	return &ImplementationVersionNameSubItem{Name: decodeSubItemWithName(d, length)}
+func decodeImplementationVersionNameSubItem(d dicomio.Reader, length uint16) (*ImplementationVersionNameSubItem, error) {
+	name, err := decodeSubItemWithName(d, length)
+	if err != nil {
+		return nil, fmt.Errorf("ImplementationVersionName: %v", err)
+	}
+	return &ImplementationVersionNameSubItem{Name: name}, nil
 }
 
 func (v *ImplementationVersionNameSubItem) Write(e *dicomio.Writer) {
@@ -287,6 +334,107 @@ func (v *ImplementationVersionNameSubItem) String() string {
 	return fmt.Sprintf("ImplementationVersionName{name: \"%s\"}", v.Name)
 }
 
+// UserIdentityType is the User-Identity-Type field of a User Identity
+// negotiation sub-item (P3.7 D.3.3.7.1).
+type UserIdentityType byte
+
+const (
+	UserIdentityUsername         UserIdentityType = 1
+	UserIdentityUsernamePasscode UserIdentityType = 2
+	UserIdentityKerberos         UserIdentityType = 3
+	UserIdentitySAML             UserIdentityType = 4
+	UserIdentityJWT              UserIdentityType = 5
+)
+
+// PS3.7 Annex D.3.3.7.1
+type UserIdentityRequestSubItem struct {
+	Type UserIdentityType
+	// PositiveResponseRequested asks the acceptor to return a
+	// UserIdentityResponseSubItem.
+	PositiveResponseRequested bool
+	// PrimaryField is the username, Kerberos ticket, SAML assertion or JWT.
+	PrimaryField []byte
+	// SecondaryField is the passcode, for UserIdentityUsernamePasscode.
+	SecondaryField []byte
+}
+
+func decodeUserIdentityRequestSubItem(d dicomio.Reader) (*UserIdentityRequestSubItem, error) {
+	typ, err := d.ReadByte()
+	if err != nil {
+		return nil, fieldError("UserIdentityRequest: type", err)
+	}
+	positive, err := d.ReadByte()
+	if err != nil {
+		return nil, fieldError("UserIdentityRequest: positive response flag", err)
+	}
+	v := &UserIdentityRequestSubItem{Type: UserIdentityType(typ), PositiveResponseRequested: positive == 1}
+	if v.PrimaryField, err = decodeUserIdentityField(d); err != nil {
+		return nil, fieldError("UserIdentityRequest: primary field", err)
+	}
+	if v.SecondaryField, err = decodeUserIdentityField(d); err != nil {
+		return nil, fieldError("UserIdentityRequest: secondary field", err)
+	}
+	return v, nil
+}
+
+// Decodes a 2-byte length followed by that many bytes.
+func decodeUserIdentityField(d dicomio.Reader) ([]byte, error) {
+	n, err := d.ReadUInt16()
+	if err != nil {
+		return nil, err
+	}
+	s, err := d.ReadString(uint32(n))
+	if err != nil {
+		return nil, err
+	}
+	return []byte(s), nil
+}
+
+func (v *UserIdentityRequestSubItem) Write(e *dicomio.Writer) {
+	encodeSubItemHeader(e, ItemTypeUserIdentityRequest, uint16(2+2+len(v.PrimaryField)+2+len(v.SecondaryField)))
+	e.WriteByte(byte(v.Type))
+	if v.PositiveResponseRequested {
+		e.WriteByte(1)
+	} else {
+		e.WriteByte(0)
+	}
+	e.WriteUInt16(uint16(len(v.PrimaryField)))
+	e.WriteBytes(v.PrimaryField)
+	e.WriteUInt16(uint16(len(v.SecondaryField)))
+	e.WriteBytes(v.SecondaryField)
+}
+
+// String doesn't print the fields, which may hold credentials.
+func (v *UserIdentityRequestSubItem) String() string {
+	return fmt.Sprintf("UserIdentityRequest{type: %d, positiveresponse: %v, primary: %d bytes, secondary: %d bytes}",
+		v.Type, v.PositiveResponseRequested, len(v.PrimaryField), len(v.SecondaryField))
+}
+
+// PS3.7 Annex D.3.3.7.2
+type UserIdentityResponseSubItem struct {
+	// ServerResponse is the Kerberos server ticket or SAML response, or
+	// empty.
+	ServerResponse []byte
+}
+
+func decodeUserIdentityResponseSubItem(d dicomio.Reader) (*UserIdentityResponseSubItem, error) {
+	response, err := decodeUserIdentityField(d)
+	if err != nil {
+		return nil, fieldError("UserIdentityResponse: server response", err)
+	}
+	return &UserIdentityResponseSubItem{ServerResponse: response}, nil
+}
+
+func (v *UserIdentityResponseSubItem) Write(e *dicomio.Writer) {
+	encodeSubItemHeader(e, ItemTypeUserIdentityResponse, uint16(2+len(v.ServerResponse)))
+	e.WriteUInt16(uint16(len(v.ServerResponse)))
+	e.WriteBytes(v.ServerResponse)
+}
+
+func (v *UserIdentityResponseSubItem) String() string {
+	return fmt.Sprintf("UserIdentityResponse{response: %d bytes}", len(v.ServerResponse))
+}
+
 // Container for subitems that this package doesnt' support
 type SubItemUnsupported struct {
 	Type byte
@@ -315,12 +463,12 @@ func encodeSubItemWithName(e *dicomio.Writer, itemType byte, name string) {
 	e.WriteBytes([]byte(name))
 }
 
-func decodeSubItemWithName(d dicomio.Reader, length uint16) string {
+func decodeSubItemWithName(d dicomio.Reader, length uint16) (string, error) {
 	name, err := d.ReadString(uint32(length))
 	if err != nil {
-		log.Println("(decodeRoleSelectionSubItem) Failed to decode SCURole ", err)
+		return "", fieldError("name", err)
 	}
-	return name
+	return name, nil
 }
 
 type ApplicationContextItem subItemWithName
@@ -328,8 +476,12 @@ type ApplicationContextItem subItemWithName
 // The app context for DICOM. The first item in the A-ASSOCIATE-RQ
 const DICOMApplicationContextItemName = "1.2.840.10008.3.1.1.1"
 
-func decodeApplicationContextItem(d dicomio.Reader, length uint16) *ApplicationContextItem {
-	return &ApplicationContextItem{Name: decodeSubItemWithName(d, length)}
+func decodeApplicationContextItem(d dicomio.Reader, length uint16) (*ApplicationContextItem, error) {
+	name, err := decodeSubItemWithName(d, length)
+	if err != nil {
+		return nil, fmt.Errorf("ApplicationContext: %v", err)
+	}
+	return &ApplicationContextItem{Name: name}, nil
 }
 
 func (v *ApplicationContextItem) Write(e *dicomio.Writer) {
@@ -342,8 +494,12 @@ func (v *ApplicationContextItem) String() string {
 
 type AbstractSyntaxSubItem subItemWithName
 
-func decodeAbstractSyntaxSubItem(d dicomio.Reader, length uint16) *AbstractSyntaxSubItem {
-	return &AbstractSyntaxSubItem{Name: decodeSubItemWithName(d, length)}
+func decodeAbstractSyntaxSubItem(d dicomio.Reader, length uint16) (*AbstractSyntaxSubItem, error) {
+	name, err := decodeSubItemWithName(d, length)
+	if err != nil {
+		return nil, fmt.Errorf("AbstractSyntax: %v", err)
+	}
+	return &AbstractSyntaxSubItem{Name: name}, nil
 }
 
 func (v *AbstractSyntaxSubItem) Write(e *dicomio.Writer) {
@@ -356,8 +512,12 @@ func (v *AbstractSyntaxSubItem) String() string {
 
 type TransferSyntaxSubItem subItemWithName
 
-func decodeTransferSyntaxSubItem(d dicomio.Reader, length uint16) *TransferSyntaxSubItem {
-	return &TransferSyntaxSubItem{Name: decodeSubItemWithName(d, length)}
+func decodeTransferSyntaxSubItem(d dicomio.Reader, length uint16) (*TransferSyntaxSubItem, error) {
+	name, err := decodeSubItemWithName(d, length)
+	if err != nil {
+		return nil, fmt.Errorf("TransferSyntax: %v", err)
+	}
+	return &TransferSyntaxSubItem{Name: name}, nil
 }
 
 func (v *TransferSyntaxSubItem) Write(e *dicomio.Writer) {
@@ -393,30 +553,31 @@ type PresentationContextItem struct {
 	Items []SubItem // List of {Abstract,Transfer}SyntaxSubItem
 }
 
-func decodePresentationContextItem(d dicomio.Reader, itemType byte, length uint16) *PresentationContextItem {
+func decodePresentationContextItem(d dicomio.Reader, itemType byte) (*PresentationContextItem, error) {
 	v := &PresentationContextItem{Type: itemType}
-	d.PushLimit(int64(length))
-	defer d.PopLimit()
-	v.ContextID, _ = d.ReadByte()
-	d.Skip(1)
+	var err error
+	if v.ContextID, err = d.ReadByte(); err != nil {
+		return nil, fieldError("PresentationContext: ID", err)
+	}
+	if err := d.Skip(1); err != nil {
+		return nil, fieldError("PresentationContext: reserved byte", err)
+	}
 	pcr, err := d.ReadByte()
 	if err != nil {
-		log.Println("(decodePresentationContextItem) Failed to decode PresentationContextResult ", err)
+		return nil, fieldError("PresentationContext: result", err)
 	}
 	v.Result = PresentationContextResult(pcr)
-	d.Skip(1)
+	if err := d.Skip(1); err != nil {
+		return nil, fieldError("PresentationContext: reserved byte", err)
+	}
 	for d.BytesLeftUntilLimit() > 0 {
-		item := decodeSubItem(d)
-		/* 		mk: todo error check
-		if d.Error() != nil {
-					break
-				} */
+		item, err := decodeSubItem(d)
+		if err != nil {
+			return nil, fmt.Errorf("PresentationContext %d: %v", v.ContextID, err)
+		}
 		v.Items = append(v.Items, item)
 	}
-	if v.ContextID%2 != 1 {
-		log.Printf("PresentationContextItem ID must be odd, but found %x", v.ContextID)
-	}
-	return v
+	return v, nil
 }
 
 func (v *PresentationContextItem) Write(e *dicomio.Writer) {
@@ -437,7 +598,9 @@ func (v *PresentationContextItem) Write(e *dicomio.Writer) {
 	itemBytes := itemEncoder.Bytes()
 	encodeSubItemHeader(e, v.Type, uint16(4+len(itemBytes)))
 	e.WriteByte(v.ContextID)
-	e.WriteZeros(3)
+	e.WriteZeros(1)
+	e.WriteByte(byte(v.Result))
+	e.WriteZeros(1)
 	e.WriteBytes(itemBytes)
 }
 
@@ -463,28 +626,35 @@ type PresentationDataValueItem struct {
 	Value []byte
 }
 
-func ReadPresentationDataValueItem(d dicomio.Reader) PresentationDataValueItem {
+// ReadPresentationDataValueItem decodes one item of a P-DATA-TF. It fails if
+// the item is shorter than its length says.
+func ReadPresentationDataValueItem(d dicomio.Reader) (PresentationDataValueItem, error) {
 	item := PresentationDataValueItem{}
 	length, err := d.ReadUInt32()
 	if err != nil {
-		log.Printf("Error reading presentation data - length")
+		return item, fieldError("PresentationDataValue: length", err)
 	}
-
-	item.ContextID, err = d.ReadByte()
-	if err != nil {
-		log.Printf("Error reading presentation data - ContextID")
+	if length < 2 {
+		return item, fmt.Errorf("PresentationDataValue: length %d is shorter than the 2-byte header", length)
+	}
+	if int64(length) > d.BytesLeftUntilLimit() {
+		return item, fmt.Errorf("PresentationDataValue: length %d exceeds the %d bytes left in the PDU",
+			length, d.BytesLeftUntilLimit())
+	}
+	if item.ContextID, err = d.ReadByte(); err != nil {
+		return item, fieldError("PresentationDataValue: context ID", err)
 	}
 	header, err := d.ReadByte()
 	if err != nil {
-		log.Printf("Error reading presentation data - header")
+		return item, fieldError("PresentationDataValue: message control header", err)
 	}
 	item.Command = (header&1 != 0)
 	item.Last = (header&2 != 0)
 	item.Value, err = d.ReadBytes(int(length - 2)) // remove contextID and header
 	if err != nil {
-		log.Printf("Error reading presentation data - readbytes contextID and header")
+		return item, fieldError("PresentationDataValue: value", err)
 	}
-	return item
+	return item, nil
 }
 
 func (v *PresentationDataValueItem) Write(e *dicomio.Writer) {
@@ -511,6 +681,14 @@ func EncodePDU(pdu PDU) ([]byte, error) {
 	switch n := pdu.(type) {
 	case *AAssociate:
 		pduType = n.Type
+		// Titles that don't fit used to be cut silently.
+		if _, _, err := n.encodeAETitles(); err != nil {
+			return nil, fmt.Errorf("EncodePDU: %v", err)
+		}
+		// So did user information too long for its length fields.
+		if err := n.checkUserInformationLengths(); err != nil {
+			return nil, fmt.Errorf("EncodePDU: %v", err)
+		}
 	case *AAssociateRj:
 		pduType = TypeAAssociateRj
 	case *PDataTf:
@@ -532,6 +710,9 @@ func EncodePDU(pdu PDU) ([]byte, error) {
 		return nil, err
 	} */
 	payload := e.Bytes()
+	if uint64(len(payload)) > math.MaxUint32 {
+		return nil, fmt.Errorf("EncodePDU: payload of %d bytes exceeds the PDU length field", len(payload))
+	}
 	// Reserve the header bytes. It will be filled in Finish.
 	var header [6]byte // First 6 bytes of buf.
 	header[0] = byte(pduType)
@@ -540,68 +721,36 @@ func EncodePDU(pdu PDU) ([]byte, error) {
 	return append(header[:], payload...), nil
 }
 
-// EncodePDU reads a "pdu" from a stream. maxPDUSize defines the maximum
-// possible PDU size, in bytes, accepted by the caller.
+// ReadPDU reads a "pdu" from a stream. maxPDUSize defines the maximum
+// possible PDU size, in bytes, accepted by the caller. It returns io.EOF if
+// the stream ends before the PDU, and an error that wraps io.ErrUnexpectedEOF
+// if it ends inside it. A PDU that can't be decoded, e.g., because an item
+// overruns its enclosing item, is an error; no partial PDU is returned.
+//
+// ReadPDU reads no more than the PDU from "in". To read a series of PDUs from
+// a connection, a Reader makes fewer reads and allocations.
 func ReadPDU(in io.Reader, maxPDUSize int) (PDU, error) {
-	var pduType Type
-	var skip byte
-	var length uint32
-	err := binary.Read(in, binary.BigEndian, &pduType)
-	if err != nil {
-		return nil, err
-	}
-	err = binary.Read(in, binary.BigEndian, &skip)
-	if err != nil {
-		return nil, err
-	}
-	err = binary.Read(in, binary.BigEndian, &length)
-	if err != nil {
-		return nil, err
-	}
-	if length >= uint32(maxPDUSize)*2 {
-		// Avoid using too much memory. *2 is just an arbitrary slack.
-		return nil, fmt.Errorf("Invalid length %d; it's much larger than max PDU size of %d", length, maxPDUSize)
-	}
-	x := io.LimitedReader{R: in, N: int64(length)}
-
-	d := dicomio.NewReader(
-		bufio.NewReader(&x),
-		binary.BigEndian, // PDU is always big endian
-		int64(length))    // irrelevant for PDU parsing
-	var pdu PDU
-	switch pduType {
-	case TypeAAssociateRq:
-		fallthrough
-	case TypeAAssociateAc:
-		pdu = decodeAAssociate(d, pduType)
-	case TypeAAssociateRj:
-		pdu = decodeAAssociateRj(d)
-	case TypeAAbort:
-		pdu = decodeAAbort(d)
-	case TypePDataTf:
-		pdu = decodePDataTf(d)
-	case TypeAReleaseRq:
-		pdu = decodeAReleaseRq(d)
-	case TypeAReleaseRp:
-		pdu = decodeAReleaseRp(d)
-	}
-	if pdu == nil {
-		err := fmt.Errorf("ReadPDU: unknown message type %d", pduType)
-		return nil, err
-	}
-	if d.BytesLeftUntilLimit() > 0 {
-		return nil, err
+	r := Reader{src: in, maxPDUSize: maxPDUSize}
+	defer r.Release()
+	return r.Read()
+}
+
+// Skips the reserved field that makes up the body of A-RELEASE-RQ and -RP.
+func skipReleaseReserved(d dicomio.Reader, name string) error {
+	if err := d.Skip(4); err != nil {
+		return fieldError(name+": reserved bytes", err)
 	}
-	return pdu, nil
+	return nil
 }
 
 type AReleaseRq struct {
 }
 
-func decodeAReleaseRq(d dicomio.Reader) *AReleaseRq {
-	pdu := &AReleaseRq{}
-	d.Skip(4)
-	return pdu
+func decodeAReleaseRq(d dicomio.Reader) (*AReleaseRq, error) {
+	if err := skipReleaseReserved(d, "A_RELEASE_RQ"); err != nil {
+		return nil, err
+	}
+	return &AReleaseRq{}, nil
 }
 
 func (pdu *AReleaseRq) WritePayload(e *dicomio.Writer) {
@@ -615,10 +764,11 @@ func (pdu *AReleaseRq) String() string {
 type AReleaseRp struct {
 }
 
-func decodeAReleaseRp(d dicomio.Reader) *AReleaseRp {
-	pdu := &AReleaseRp{}
-	d.Skip(4)
-	return pdu
+func decodeAReleaseRp(d dicomio.Reader) (*AReleaseRp, error) {
+	if err := skipReleaseReserved(d, "A_RELEASE_RP"); err != nil {
+		return nil, err
+	}
+	return &AReleaseRp{}, nil
 }
 
 func (pdu *AReleaseRp) WritePayload(e *dicomio.Writer) {
@@ -652,52 +802,139 @@ type AAssociate struct {
 	CalledAETitle  string // For .._AC, the value is copied from A_ASSOCIATE_RQ
 	CallingAETitle string // For .._AC, the value is copied from A_ASSOCIATE_RQ
 	Items          []SubItem
+
+	// RawCalledAETitle and RawCallingAETitle are the 16-byte fields as
+	// decoded, padding included; CalledAETitle and CallingAETitle hold them
+	// normalized by NormalizeAETitle. On encoding, a raw field is written
+	// as is if it still normalizes to its title, so that an AC can echo the
+	// RQ byte for byte.
+	RawCalledAETitle  string
+	RawCallingAETitle string
+}
+
+// NormalizeAETitle strips the padding of an AE title: leading and trailing
+// spaces, which are not significant (P3.5 Table 6.2-1), and the NULs that some
+// implementations pad with instead.
+func NormalizeAETitle(aeTitle string) string {
+	return strings.Trim(aeTitle, " \x00")
 }
 
-func decodeAAssociate(d dicomio.Reader, pduType Type) *AAssociate {
+// Returns what to write for "aeTitle", before padding: "raw", the field it
+// was decoded from, if it still matches.
+func wireAETitle(aeTitle, raw string) string {
+	if raw != "" && NormalizeAETitle(raw) == NormalizeAETitle(aeTitle) {
+		return raw
+	}
+	return aeTitle
+}
+
+// Returns the 16-byte field for "aeTitle". "raw" is the field it was decoded
+// from, if any. Fails if the title is too long.
+func encodeAETitle(aeTitle, raw string) (string, error) {
+	return fillString(wireAETitle(aeTitle, raw), aeTitleLength)
+}
+
+// The size of the AE title fields of A-ASSOCIATE. P3.8 9.3.2.
+const aeTitleLength = 16
+
+// Decodes A-ASSOCIATE-RQ or -AC. Content that the standard forbids but that
+// can be decoded, e.g., an empty AE title, is left to Validate.
+func decodeAAssociate(d dicomio.Reader, pduType Type) (*AAssociate, error) {
 	pdu := &AAssociate{}
 	pdu.Type = pduType
-	pdu.ProtocolVersion, _ = d.ReadUInt16()
-	d.Skip(2) // Reserved
-	pdu.CalledAETitle, _ = d.ReadString(16)
-	pdu.CallingAETitle, _ = d.ReadString(16)
-	d.Skip(8 * 4)
-
+	var err error
+	if pdu.ProtocolVersion, err = d.ReadUInt16(); err != nil {
+		return nil, fieldError("A_ASSOCIATE: protocol version", err)
+	}
+	if err := d.Skip(2); err != nil { // Reserved
+		return nil, fieldError("A_ASSOCIATE: reserved bytes", err)
+	}
+	if pdu.RawCalledAETitle, err = d.ReadString(aeTitleLength); err != nil {
+		return nil, fieldError("A_ASSOCIATE: called AE title", err)
+	}
+	if pdu.RawCallingAETitle, err = d.ReadString(aeTitleLength); err != nil {
+		return nil, fieldError("A_ASSOCIATE: calling AE title", err)
+	}
+	pdu.CalledAETitle = NormalizeAETitle(pdu.RawCalledAETitle)
+	pdu.CallingAETitle = NormalizeAETitle(pdu.RawCallingAETitle)
+	if err := d.Skip(8 * 4); err != nil {
+		return nil, fieldError("A_ASSOCIATE: reserved bytes", err)
+	}
 	for d.BytesLeftUntilLimit() > 0 {
-		item := decodeSubItem(d)
-		if item == nil {
-			break
+		item, err := decodeSubItem(d)
+		if err != nil {
+			return nil, fmt.Errorf("A_ASSOCIATE: %v", err)
 		}
 		pdu.Items = append(pdu.Items, item)
 	}
+	return pdu, nil
+}
+
+// Returns the AE title fields, padded. Fails if a title is empty or too long.
+func (pdu *AAssociate) encodeAETitles() (called, calling string, err error) {
 	if pdu.CalledAETitle == "" || pdu.CallingAETitle == "" {
-		log.Printf("A_ASSOCIATE.{Called,Calling}AETitle must not be empty, in %v", pdu.String())
+		return "", "", fmt.Errorf("A_ASSOCIATE.{Called,Calling}AETitle must not be empty")
 	}
-	return pdu
+	if called, err = encodeAETitle(pdu.CalledAETitle, pdu.RawCalledAETitle); err != nil {
+		return "", "", fmt.Errorf("A_ASSOCIATE.CalledAETitle: %v", err)
+	}
+	if calling, err = encodeAETitle(pdu.CallingAETitle, pdu.RawCallingAETitle); err != nil {
+		return "", "", fmt.Errorf("A_ASSOCIATE.CallingAETitle: %v", err)
+	}
+	return called, calling, nil
+}
+
+// Checks that the user information item, and its user identity sub-items, fit
+// in their 2-byte length fields.
+func (pdu *AAssociate) checkUserInformationLengths() error {
+	for _, item := range pdu.Items {
+		ui, ok := item.(*UserInformationItem)
+		if !ok {
+			continue
+		}
+		length := 0
+		for _, s := range ui.Items {
+			switch n := s.(type) {
+			case *UserIdentityRequestSubItem:
+				if 2+2+len(n.PrimaryField)+2+len(n.SecondaryField) > math.MaxUint16 {
+					return fmt.Errorf("UserIdentityRequest: primary and secondary fields of %d and %d bytes don't fit in the item",
+						len(n.PrimaryField), len(n.SecondaryField))
+				}
+			case *UserIdentityResponseSubItem:
+				if 2+len(n.ServerResponse) > math.MaxUint16 {
+					return fmt.Errorf("UserIdentityResponse: server response of %d bytes doesn't fit in the item", len(n.ServerResponse))
+				}
+			}
+			e := dicomio.NewWriter(&bytes.Buffer{}, binary.BigEndian, true)
+			s.Write(&e)
+			length += len(e.Bytes())
+		}
+		if length > math.MaxUint16 {
+			return fmt.Errorf("UserInformationItem: sub-items of %d bytes don't fit in the item", length)
+		}
+	}
+	return nil
 }
 
 func (pdu *AAssociate) WritePayload(e *dicomio.Writer) {
-	if pdu.Type == 0 || pdu.CalledAETitle == "" || pdu.CallingAETitle == "" {
+	called, calling, err := pdu.encodeAETitles()
+	if pdu.Type == 0 || err != nil {
 		panic(*pdu)
 	}
 	e.WriteUInt16(pdu.ProtocolVersion)
 	e.WriteZeros(2) // Reserved
-	e.WriteString(fillString(pdu.CalledAETitle, 16))
-	e.WriteString(fillString(pdu.CallingAETitle, 16))
+	e.WriteString(called)
+	e.WriteString(calling)
 	e.WriteZeros(8 * 4)
 	for _, item := range pdu.Items {
 		item.Write(e)
 	}
 }
 
+// String lists every field and item, one per line, without credentials. See
+// Format.
 func (pdu *AAssociate) String() string {
-	name := "AC"
-	if pdu.Type == TypeAAssociateRq {
-		name = "RQ"
-	}
-	return fmt.Sprintf("A_ASSOCIATE_%s{version:%v called:'%v' calling:'%v' items:%s}",
-		name, pdu.ProtocolVersion,
-		pdu.CalledAETitle, pdu.CallingAETitle, subItemListString(pdu.Items))
+	return pdu.Format(FormatOptions{Redact: true})
 }
 
 // P3.8 9.3.4
@@ -715,7 +952,8 @@ const (
 	ResultRejectedTransient RejectResultType = 2
 )
 
-// Possible values for AAssociateRj.Reason
+// Possible values for AAssociateRj.Reason. Their meaning depends on
+// AAssociateRj.Source; see RejectReasonDescription.
 type RejectReasonType byte
 
 const (
@@ -723,6 +961,13 @@ const (
 	RejectReasonApplicationContextNameNotSupported RejectReasonType = 2
 	RejectReasonCallingAETitleNotRecognized        RejectReasonType = 3
 	RejectReasonCalledAETitleNotRecognized         RejectReasonType = 7
+
+	// Reasons for SourceULServiceProviderACSE, besides RejectReasonNone.
+	RejectReasonProtocolVersionNotSupported RejectReasonType = 2
+
+	// Reasons for SourceULServiceProviderPresentation.
+	RejectReasonTemporaryCongestion RejectReasonType = 1
+	RejectReasonLocalLimitExceeded  RejectReasonType = 2
 )
 
 // Possible values for AAssociateRj.Source
@@ -734,27 +979,29 @@ const (
 	SourceULServiceProviderPresentation SourceType = 3
 )
 
-func decodeAAssociateRj(d dicomio.Reader) *AAssociateRj {
+func decodeAAssociateRj(d dicomio.Reader) (*AAssociateRj, error) {
 	pdu := &AAssociateRj{}
-	d.Skip(1) // reserved
+	if err := d.Skip(1); err != nil { // reserved
+		return nil, fieldError("A_ASSOCIATE_RJ: reserved byte", err)
+	}
 	result, err := d.ReadByte()
 	if err != nil {
-		log.Println("(decodeAAssociateRj) PDU result error", err)
+		return nil, fieldError("A_ASSOCIATE_RJ: result", err)
 	}
 	pdu.Result = RejectResultType(result)
 
 	source, err := d.ReadByte()
 	if err != nil {
-		log.Println("(decodeAAssociateRj) PDU source error", err)
+		return nil, fieldError("A_ASSOCIATE_RJ: source", err)
 	}
 	pdu.Source = SourceType(source)
 
 	reason, err := d.ReadByte()
 	if err != nil {
-		log.Println("(decodeAAssociateRj) PDU reason error", err)
+		return nil, fieldError("A_ASSOCIATE_RJ: reason", err)
 	}
 	pdu.Reason = RejectReasonType(reason)
-	return pdu
+	return pdu, nil
 }
 
 func (pdu *AAssociateRj) WritePayload(e *dicomio.Writer) {
@@ -765,17 +1012,28 @@ func (pdu *AAssociateRj) WritePayload(e *dicomio.Writer) {
 }
 
 func (pdu *AAssociateRj) String() string {
-	return fmt.Sprintf("A_ASSOCIATE_RJ{result: %v, source: %v, reason: %v}", pdu.Result, pdu.Source, pdu.Reason)
+	return fmt.Sprintf("A_ASSOCIATE_RJ{result: %s, source: %s, reason: %s}",
+		RejectResultDescription(pdu.Result), RejectSourceDescription(pdu.Source),
+		RejectReasonDescription(pdu.Source, pdu.Reason))
 }
 
 type AbortReasonType byte
 
+// Possible values for AAbort.Reason, P3.8 Table 9-26. They are meaningful only
+// when Source is AbortSourceServiceProvider.
 const (
 	AbortReasonNotSpecified             AbortReasonType = 0
+	AbortReasonUnrecognizedPDU          AbortReasonType = 1
 	AbortReasonUnexpectedPDU            AbortReasonType = 2
-	AbortReasonUnrecognizedPDUParameter AbortReasonType = 3
-	AbortReasonUnexpectedPDUParameter   AbortReasonType = 4
-	AbortReasonInvalidPDUParameterValue AbortReasonType = 5
+	AbortReasonUnrecognizedPDUParameter AbortReasonType = 4
+	AbortReasonUnexpectedPDUParameter   AbortReasonType = 5
+	AbortReasonInvalidPDUParameterValue AbortReasonType = 6
+)
+
+// Possible values for AAbort.Source, P3.8 Table 9-26.
+const (
+	AbortSourceServiceUser     SourceType = 0
+	AbortSourceServiceProvider SourceType = 2
 )
 
 type AAbort struct {
@@ -783,22 +1041,22 @@ type AAbort struct {
 	Reason AbortReasonType
 }
 
-func decodeAAbort(d dicomio.Reader) *AAbort {
+func decodeAAbort(d dicomio.Reader) (*AAbort, error) {
 	pdu := &AAbort{}
-	d.Skip(2)
+	if err := d.Skip(2); err != nil {
+		return nil, fieldError("A_ABORT: reserved bytes", err)
+	}
 	b, err := d.ReadByte()
 	if err != nil {
-		log.Print("(decodeAAbort) Error reading buffer SourceType", err)
-		return nil
+		return nil, fieldError("A_ABORT: source", err)
 	}
 	pdu.Source = SourceType(b)
 	b, err = d.ReadByte()
 	if err != nil {
-		log.Print("(decodeAAbort) Error reading buffer AbortReasonType", err)
-		return nil
+		return nil, fieldError("A_ABORT: reason", err)
 	}
 	pdu.Reason = AbortReasonType(b)
-	return pdu
+	return pdu, nil
 }
 
 func (pdu *AAbort) WritePayload(e *dicomio.Writer) {
@@ -808,24 +1066,24 @@ func (pdu *AAbort) WritePayload(e *dicomio.Writer) {
 }
 
 func (pdu *AAbort) String() string {
-	return fmt.Sprintf("A_ABORT{source:%v reason:%v}", pdu.Source, pdu.Reason)
+	return fmt.Sprintf("A_ABORT{source:%s reason:%s}",
+		AbortSourceDescription(pdu.Source), AbortReasonDescription(pdu.Source, pdu.Reason))
 }
 
 type PDataTf struct {
 	Items []PresentationDataValueItem
 }
 
-func decodePDataTf(d dicomio.Reader) *PDataTf {
+func decodePDataTf(d dicomio.Reader) (*PDataTf, error) {
 	pdu := &PDataTf{}
 	for d.BytesLeftUntilLimit() > 0 {
-		item := ReadPresentationDataValueItem(d)
-		/* mk: probably should check it's correctly filled.
-		if item == nil {
-			break
-		} */
+		item, err := ReadPresentationDataValueItem(d)
+		if err != nil {
+			return nil, fmt.Errorf("P_DATA_TF: item %d: %v", len(pdu.Items), err)
+		}
 		pdu.Items = append(pdu.Items, item)
 	}
-	return pdu
+	return pdu, nil
 }
 
 func (pdu *PDataTf) WritePayload(e *dicomio.Writer) {
@@ -847,13 +1105,11 @@ func (pdu *PDataTf) String() string {
 	return buf.String()
 }
 
-// fillString pads the string with " " up to the given length.
-func fillString(v string, length int) string {
+// fillString pads the string with " " up to the given length. Fails if the
+// string is longer.
+func fillString(v string, length int) (string, error) {
 	if len(v) > length {
-		return v[:16]
-	}
-	for len(v) < length {
-		v += " "
+		return "", fmt.Errorf("'%s' is longer than %d characters", v, length)
 	}
-	return v
+	return v + strings.Repeat(" ", length-len(v)), nil
 }
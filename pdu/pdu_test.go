@@ -0,0 +1,79 @@
+package pdu
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Encodes "v", decodes the result, and checks that it encodes to the same
+// bytes again.
+func roundTripPDU(t *testing.T, v PDU) PDU {
+	encoded, err := EncodePDU(v)
+	require.NoError(t, err)
+	decoded, err := ReadPDU(bytes.NewReader(encoded), len(encoded))
+	require.NoError(t, err)
+	reencoded, err := EncodePDU(decoded)
+	require.NoError(t, err)
+	require.Equal(t, encoded, reencoded)
+	return decoded
+}
+
+// The two counts of the asynchronous operations window are decoded from
+// their own fields.
+func TestAsynchronousOperationsWindowSubItem(t *testing.T) {
+	v := roundTripPDU(t, &AAssociate{
+		Type:            TypeAAssociateRq,
+		ProtocolVersion: CurrentProtocolVersion,
+		CalledAETitle:   "SCP",
+		CallingAETitle:  "SCU",
+		Items: []SubItem{
+			&ApplicationContextItem{Name: DICOMApplicationContextItemName},
+			&UserInformationItem{Items: []SubItem{
+				&AsynchronousOperationsWindowSubItem{MaxOpsInvoked: 3, MaxOpsPerformed: 5},
+			}},
+		},
+	})
+	items := v.(*AAssociate).Items[1].(*UserInformationItem).Items
+	require.Equal(t, &AsynchronousOperationsWindowSubItem{MaxOpsInvoked: 3, MaxOpsPerformed: 5}, items[0])
+}
+
+// The result of a presentation context in an A-ASSOCIATE-AC is written to
+// the byte after the context ID.
+func TestPresentationContextItemResult(t *testing.T) {
+	item := &PresentationContextItem{
+		Type:      ItemTypePresentationContextResponse,
+		ContextID: 1,
+		Result:    PresentationContextProviderRejectionAbstractSyntaxNotSupported,
+		Items:     []SubItem{&TransferSyntaxSubItem{Name: "1.2.840.10008.1.2"}},
+	}
+	v := roundTripPDU(t, &AAssociate{
+		Type:            TypeAAssociateAc,
+		ProtocolVersion: CurrentProtocolVersion,
+		CalledAETitle:   "SCP",
+		CallingAETitle:  "SCU",
+		Items: []SubItem{
+			&ApplicationContextItem{Name: DICOMApplicationContextItemName},
+			item,
+		},
+	})
+	require.Equal(t, item, v.(*AAssociate).Items[1])
+}
+
+// Sub-items of unknown types, e.g., SOP class extended negotiation, are kept
+// as they were received.
+func TestSubItemUnsupported(t *testing.T) {
+	item := &SubItemUnsupported{Type: 0x56, Data: []byte{0, 4, '1', '.', '2', '3', 1, 0}}
+	v := roundTripPDU(t, &AAssociate{
+		Type:            TypeAAssociateRq,
+		ProtocolVersion: CurrentProtocolVersion,
+		CalledAETitle:   "SCP",
+		CallingAETitle:  "SCU",
+		Items: []SubItem{
+			&ApplicationContextItem{Name: DICOMApplicationContextItemName},
+			&UserInformationItem{Items: []SubItem{item}},
+		},
+	})
+	require.Equal(t, item, v.(*AAssociate).Items[1].(*UserInformationItem).Items[0])
+}
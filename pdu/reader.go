@@ -0,0 +1,188 @@
+package pdu
+
+// This file implements Reader, which reads the PDUs of a connection one after
+// another, reusing its buffers, so that reading a PDU costs two reads of a
+// buffered stream and no allocations besides the decoded PDU. The buffers are
+// pooled, so that idle connections can give theirs up.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/antibios/dicom/pkg/dicomio"
+)
+
+// DefaultReaderBufferSize is the size of the buffer NewReader puts in front
+// of its stream.
+const DefaultReaderBufferSize = 64 << 10
+
+// Bodies up to this size are read into the reused body buffer. Larger ones
+// get a buffer of their own, so that a connection doesn't hold on to the
+// largest body it ever received.
+const maxReusedBodySize = DefaultReaderBufferSize
+
+// Reader reads PDUs from a stream. It is not safe for concurrent use.
+type Reader struct {
+	src io.Reader
+	// If set, src is read through bufs.in.
+	buffered   bool
+	maxPDUSize int
+	limits     AssociateLimits
+	header     [6]byte
+	// Taken from readerBufferPool by Read, and given back by Release. Nil
+	// while released.
+	bufs *readerBuffers
+	// Reset to each body in turn.
+	bodyReader bytes.Reader
+}
+
+// The buffers a Reader needs only while it reads.
+type readerBuffers struct {
+	// Buffers the stream of a buffered Reader. Created on first use.
+	in      *bufio.Reader
+	decoder *bufio.Reader
+	// The body of the last PDU read, if it was at most maxReusedBodySize.
+	// Reused by the next one, since the decoders copy what they keep.
+	body []byte
+}
+
+// Buffers released by the Readers of the process. A connection that is mostly
+// idle, and released while it is, holds none most of the time.
+var readerBufferPool = sync.Pool{
+	New: func() interface{} { return &readerBuffers{} },
+}
+
+// NewReader creates a Reader of the PDUs of "in", e.g., a connection, which
+// it buffers: it may read past the PDU returned by Read. maxPDUSize is as for
+// ReadPDU.
+func NewReader(in io.Reader, maxPDUSize int) *Reader {
+	return &Reader{src: in, buffered: true, maxPDUSize: maxPDUSize}
+}
+
+// SetAssociateLimits sets the bounds on the items of the A-ASSOCIATE-RQ and -AC
+// PDUs read from now on. Read fails with ErrAssociateTooComplex on a PDU beyond
+// them.
+func (r *Reader) SetAssociateLimits(limits AssociateLimits) {
+	r.limits = limits
+}
+
+// Buffered returns the number of bytes that have been read from the stream
+// but not yet returned by Read. If it is zero, the next Read starts by
+// reading the stream.
+func (r *Reader) Buffered() int {
+	if r.bufs == nil || !r.buffered {
+		return 0
+	}
+	return r.bufs.in.Buffered()
+}
+
+// Release gives the buffers of the Reader back to a pool shared by the
+// Readers of the process, e.g., while its connection is idle. The next Read
+// takes buffers from the pool again. Release does nothing while Buffered is
+// nonzero.
+func (r *Reader) Release() {
+	if r.bufs == nil || r.Buffered() > 0 {
+		return
+	}
+	if r.bufs.in != nil {
+		r.bufs.in.Reset(nil)
+	}
+	if r.bufs.decoder != nil {
+		r.bufs.decoder.Reset(nil)
+	}
+	r.bodyReader.Reset(nil)
+	readerBufferPool.Put(r.bufs)
+	r.bufs = nil
+}
+
+// Read reads the next PDU. Its errors are those of ReadPDU. After an error,
+// the stream is no longer in sync, and the Reader must be dropped.
+func (r *Reader) Read() (PDU, error) {
+	if r.bufs == nil {
+		r.bufs = readerBufferPool.Get().(*readerBuffers)
+		if r.buffered {
+			if r.bufs.in == nil {
+				r.bufs.in = bufio.NewReaderSize(r.src, DefaultReaderBufferSize)
+			} else {
+				r.bufs.in.Reset(r.src)
+			}
+		}
+	}
+	in := r.src
+	if r.buffered {
+		in = r.bufs.in
+	}
+	if _, err := io.ReadFull(in, r.header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("ReadPDU: truncated PDU header: %w", err)
+		}
+		return nil, err
+	}
+	pduType := Type(r.header[0])
+	length := binary.BigEndian.Uint32(r.header[2:6])
+	if uint64(length) >= uint64(r.maxPDUSize)*2 {
+		// Avoid using too much memory. *2 is just an arbitrary slack.
+		return nil, fmt.Errorf("Invalid length %d; it's much larger than max PDU size of %d", length, r.maxPDUSize)
+	}
+	// Read the whole body first, so that a decoding error below is about
+	// the PDU, not about the connection.
+	var body []byte
+	if length > maxReusedBodySize {
+		body = make([]byte, length)
+	} else {
+		if uint32(cap(r.bufs.body)) < length {
+			r.bufs.body = make([]byte, length)
+		}
+		body = r.bufs.body[:length]
+	}
+	if _, err := io.ReadFull(in, body); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("ReadPDU: %v PDU truncated; want %d bytes: %w", pduType, length, io.ErrUnexpectedEOF)
+		}
+		return nil, err
+	}
+	r.bodyReader.Reset(body)
+	if r.bufs.decoder == nil {
+		r.bufs.decoder = bufio.NewReader(&r.bodyReader)
+	} else {
+		r.bufs.decoder.Reset(&r.bodyReader)
+	}
+	d := dicomio.NewReader(
+		r.bufs.decoder,
+		binary.BigEndian, // PDU is always big endian
+		int64(length))    // irrelevant for PDU parsing
+	var pdu PDU
+	var err error
+	switch pduType {
+	case TypeAAssociateRq:
+		fallthrough
+	case TypeAAssociateAc:
+		if err := checkAssociateItems(body, r.limits); err != nil {
+			return nil, fmt.Errorf("ReadPDU: %w", err)
+		}
+		pdu, err = decodeAAssociate(d, pduType)
+	case TypeAAssociateRj:
+		pdu, err = decodeAAssociateRj(d)
+	case TypeAAbort:
+		pdu, err = decodeAAbort(d)
+	case TypePDataTf:
+		pdu, err = decodePDataTf(d)
+	case TypeAReleaseRq:
+		pdu, err = decodeAReleaseRq(d)
+	case TypeAReleaseRp:
+		pdu, err = decodeAReleaseRp(d)
+	default:
+		return nil, fmt.Errorf("ReadPDU: unknown PDU type 0x%x", byte(pduType))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ReadPDU: %v", err)
+	}
+	if n := d.BytesLeftUntilLimit(); n > 0 {
+		return nil, fmt.Errorf("ReadPDU: %d of the %d bytes of %v left over", n, length, pduType)
+	}
+	return pdu, nil
+}
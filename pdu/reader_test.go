@@ -0,0 +1,185 @@
+package pdu
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Returns P-DATA-TF PDUs with values of the given sizes, each filled with a
+// distinct byte.
+func testPDataTfs(sizes ...int) []PDU {
+	var pdus []PDU
+	for i, size := range sizes {
+		pdus = append(pdus, &PDataTf{Items: []PresentationDataValueItem{{
+			ContextID: 1,
+			Last:      true,
+			Value:     bytes.Repeat([]byte{byte(i + 1)}, size),
+		}}})
+	}
+	return pdus
+}
+
+// Encodes "pdus" back to back.
+func encodePDUs(t testing.TB, pdus []PDU) []byte {
+	var stream []byte
+	for _, v := range pdus {
+		data, err := EncodePDU(v)
+		require.NoError(t, err)
+		stream = append(stream, data...)
+	}
+	return stream
+}
+
+// A Reader reuses its buffers, but the PDUs it returned keep their values.
+func TestReaderSequence(t *testing.T) {
+	want := append(testPDataTfs(100, 10, 70000, 2),
+		&AReleaseRq{}, &AAbort{Source: AbortSourceServiceProvider, Reason: AbortReasonUnexpectedPDU})
+	stream := encodePDUs(t, want)
+	for _, in := range []io.Reader{bytes.NewReader(stream), iotest.OneByteReader(bytes.NewReader(stream))} {
+		r := NewReader(in, testMaxPDUSize*8)
+		var got []PDU
+		for {
+			v, err := r.Read()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			got = append(got, v)
+		}
+		require.Equal(t, want, got)
+		// The 70000-byte body wasn't kept.
+		require.LessOrEqual(t, cap(r.bufs.body), maxReusedBodySize)
+	}
+}
+
+// A Reader gives up its buffers only while nothing is buffered, and takes them
+// back to read on.
+func TestReaderRelease(t *testing.T) {
+	want := testPDataTfs(100, 200, 300)
+	stream := encodePDUs(t, want)
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write(stream[:len(stream)-2]) // nolint: errcheck
+		pw.Write(stream[len(stream)-2:]) // nolint: errcheck
+		pw.Close()
+	}()
+	r := NewReader(pr, testMaxPDUSize)
+	v, err := r.Read()
+	require.NoError(t, err)
+	require.Equal(t, want[0], v)
+	require.Greater(t, r.Buffered(), 0)
+	r.Release()
+	require.NotNil(t, r.bufs)
+	for _, w := range want[1:] {
+		v, err = r.Read()
+		require.NoError(t, err)
+		require.Equal(t, w, v)
+	}
+	require.Equal(t, 0, r.Buffered())
+	r.Release()
+	require.Nil(t, r.bufs)
+	_, err = r.Read()
+	require.Equal(t, io.EOF, err)
+}
+
+// A truncated stream fails the same way with Reader as with ReadPDU.
+func TestReaderTruncated(t *testing.T) {
+	stream := encodePDUs(t, testPDataTfs(100, 100))
+	r := NewReader(bytes.NewReader(stream[:len(stream)-1]), testMaxPDUSize)
+	_, err := r.Read()
+	require.NoError(t, err)
+	_, err = r.Read()
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+// Compares ReadPDU, which allocates a body and decoding buffers per PDU, with
+// Reader. On a 1-CPU Xeon with go1.27, for 1000 P-DATA-TF PDUs of 200-263
+// bytes (the medians of 5 runs):
+//
+//	ReadPDU before Reader was added  1184 us/op  4884 KB/op  10003 allocs/op
+//	ReadPDU                           468 us/op   500 KB/op   6003 allocs/op
+//	Reader                            350 us/op   470 KB/op   5071 allocs/op
+//
+// ReadPDU got faster too, since it now decodes through the same code. The runs
+// used a minimal stand-in for dicomio, so decoding may cost more with the real
+// one.
+func BenchmarkReadPDU(b *testing.B) {
+	sizes := make([]int, 1000)
+	for i := range sizes {
+		sizes[i] = 200 + i%64
+	}
+	stream := encodePDUs(b, testPDataTfs(sizes...))
+	b.Run("ReadPDU", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(stream)))
+		for i := 0; i < b.N; i++ {
+			in := bufio.NewReader(bytes.NewReader(stream))
+			for range sizes {
+				if _, err := ReadPDU(in, testMaxPDUSize); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("Reader", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(stream)))
+		for i := 0; i < b.N; i++ {
+			r := NewReader(bytes.NewReader(stream), testMaxPDUSize)
+			for range sizes {
+				if _, err := r.Read(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
+
+// An A-ASSOCIATE-RQ beyond the AssociateLimits of the Reader fails before it
+// is decoded.
+func TestReaderAssociateLimits(t *testing.T) {
+	rq := func(items ...SubItem) []byte {
+		data, err := EncodePDU(&AAssociate{
+			Type:            TypeAAssociateRq,
+			ProtocolVersion: CurrentProtocolVersion,
+			CalledAETitle:   "SCP",
+			CallingAETitle:  "SCU",
+			Items:           items,
+		})
+		require.NoError(t, err)
+		return data
+	}
+	read := func(data []byte, limits AssociateLimits) error {
+		r := NewReader(bytes.NewReader(data), testMaxPDUSize)
+		r.SetAssociateLimits(limits)
+		_, err := r.Read()
+		return err
+	}
+	context := &PresentationContextItem{
+		Type:      ItemTypePresentationContextRequest,
+		ContextID: 1,
+		Items:     []SubItem{&AbstractSyntaxSubItem{Name: "1.2.3"}, &TransferSyntaxSubItem{Name: "1.2.840.10008.1.2"}},
+	}
+	// 1 application context, 3 items per context, 1 user information
+	// item with 1 sub-item.
+	standard := rq(&ApplicationContextItem{Name: DICOMApplicationContextItemName}, context, context,
+		&UserInformationItem{Items: []SubItem{&UserInformationMaximumLengthItem{MaximumLengthReceived: 16384}}})
+	require.NoError(t, read(standard, AssociateLimits{}))
+	require.NoError(t, read(standard, AssociateLimits{MaxItems: 9}))
+	err := read(standard, AssociateLimits{MaxItems: 8})
+	require.ErrorIs(t, err, ErrAssociateTooComplex)
+	require.NoError(t, read(standard, AssociateLimits{MaxItems: -1}))
+
+	nested := rq(&UserInformationItem{Items: []SubItem{
+		&UserInformationItem{Items: []SubItem{&UserInformationMaximumLengthItem{MaximumLengthReceived: 16384}}}}})
+	require.ErrorIs(t, read(nested, AssociateLimits{}), ErrAssociateTooComplex)
+	require.NoError(t, read(nested, AssociateLimits{MaxDepth: 3}))
+	require.NoError(t, read(nested, AssociateLimits{MaxDepth: -1}))
+	_, err = ReadPDU(bytes.NewReader(nested), testMaxPDUSize)
+	require.ErrorIs(t, err, ErrAssociateTooComplex)
+}
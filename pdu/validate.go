@@ -0,0 +1,241 @@
+package pdu
+
+// Strict checks of association PDUs against P3.8 9.3 and P3.7 Annex D. The
+// decoder is lenient, since peers in the field deviate from the standard in
+// small ways; Validate reports those deviations, e.g., to decide whether a
+// peer is inside the envelope we interoperate with.
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Validate checks that "v" conforms to the standard. It returns nil for PDU
+// types other than A-ASSOCIATE-RQ, -AC and -RJ.
+func Validate(v PDU) error {
+	switch n := v.(type) {
+	case *AAssociate:
+		return validateAAssociate(n)
+	case *AAssociateRj:
+		return validateAAssociateRj(n)
+	}
+	return nil
+}
+
+func validateAAssociate(v *AAssociate) error {
+	if v.Type != TypeAAssociateRq && v.Type != TypeAAssociateAc {
+		return fmt.Errorf("A-ASSOCIATE: bad type %v", v.Type)
+	}
+	if v.ProtocolVersion&1 == 0 {
+		return fmt.Errorf("A-ASSOCIATE: protocol version 0x%x lacks bit 0", v.ProtocolVersion)
+	}
+	if err := ValidateAETitle(wireAETitle(v.CalledAETitle, v.RawCalledAETitle)); err != nil {
+		return fmt.Errorf("A-ASSOCIATE: called AE title: %v", err)
+	}
+	if err := ValidateAETitle(wireAETitle(v.CallingAETitle, v.RawCallingAETitle)); err != nil {
+		return fmt.Errorf("A-ASSOCIATE: calling AE title: %v", err)
+	}
+	if len(v.Items) == 0 {
+		return fmt.Errorf("A-ASSOCIATE: no items")
+	}
+	if _, ok := v.Items[0].(*ApplicationContextItem); !ok {
+		return fmt.Errorf("A-ASSOCIATE: first item is %v, not the application context", v.Items[0])
+	}
+	contextType := byte(ItemTypePresentationContextRequest)
+	if v.Type == TypeAAssociateAc {
+		contextType = ItemTypePresentationContextResponse
+	}
+	contextIDs := map[byte]bool{}
+	var userInfo *UserInformationItem
+	for i, item := range v.Items {
+		switch n := item.(type) {
+		case *ApplicationContextItem:
+			if i != 0 {
+				return fmt.Errorf("A-ASSOCIATE: multiple application context items")
+			}
+			if n.Name != DICOMApplicationContextItemName {
+				return fmt.Errorf("A-ASSOCIATE: application context '%s' is not DICOM", n.Name)
+			}
+		case *PresentationContextItem:
+			if userInfo != nil {
+				return fmt.Errorf("A-ASSOCIATE: presentation context %d after the user information item", n.ContextID)
+			}
+			if n.Type != contextType {
+				return fmt.Errorf("A-ASSOCIATE: presentation context %d has item type 0x%x", n.ContextID, n.Type)
+			}
+			if contextIDs[n.ContextID] {
+				return fmt.Errorf("A-ASSOCIATE: duplicate presentation context ID %d", n.ContextID)
+			}
+			contextIDs[n.ContextID] = true
+			if err := validatePresentationContext(n); err != nil {
+				return fmt.Errorf("A-ASSOCIATE: %v", err)
+			}
+		case *UserInformationItem:
+			if userInfo != nil {
+				return fmt.Errorf("A-ASSOCIATE: multiple user information items")
+			}
+			userInfo = n
+		default:
+			return fmt.Errorf("A-ASSOCIATE: unexpected item %v", item)
+		}
+	}
+	if len(contextIDs) == 0 {
+		return fmt.Errorf("A-ASSOCIATE: no presentation context")
+	}
+	if userInfo == nil {
+		return fmt.Errorf("A-ASSOCIATE: no user information item")
+	}
+	if err := validateUserInformation(userInfo); err != nil {
+		return fmt.Errorf("A-ASSOCIATE: %v", err)
+	}
+	return nil
+}
+
+func validatePresentationContext(v *PresentationContextItem) error {
+	if v.ContextID%2 != 1 {
+		return fmt.Errorf("presentation context ID %d is even", v.ContextID)
+	}
+	var abstractSyntaxes, transferSyntaxes int
+	for _, item := range v.Items {
+		switch n := item.(type) {
+		case *AbstractSyntaxSubItem:
+			if err := validateUID(n.Name); err != nil {
+				return fmt.Errorf("presentation context %d: abstract syntax: %v", v.ContextID, err)
+			}
+			abstractSyntaxes++
+		case *TransferSyntaxSubItem:
+			if err := validateUID(n.Name); err != nil {
+				return fmt.Errorf("presentation context %d: transfer syntax: %v", v.ContextID, err)
+			}
+			transferSyntaxes++
+		default:
+			return fmt.Errorf("presentation context %d: unexpected subitem %v", v.ContextID, item)
+		}
+	}
+	if v.Type == ItemTypePresentationContextRequest {
+		if v.Result != 0 {
+			return fmt.Errorf("presentation context %d: nonzero result %d in a request", v.ContextID, v.Result)
+		}
+		if abstractSyntaxes != 1 || transferSyntaxes == 0 {
+			return fmt.Errorf("presentation context %d: found %d abstract and %d transfer syntaxes, want 1 and 1+",
+				v.ContextID, abstractSyntaxes, transferSyntaxes)
+		}
+		return nil
+	}
+	if v.Result > PresentationContextProviderRejectionTransferSyntaxNotSupported {
+		return fmt.Errorf("presentation context %d: bad result %d", v.ContextID, v.Result)
+	}
+	if abstractSyntaxes != 0 || transferSyntaxes != 1 {
+		return fmt.Errorf("presentation context %d: found %d abstract and %d transfer syntaxes, want 0 and 1",
+			v.ContextID, abstractSyntaxes, transferSyntaxes)
+	}
+	return nil
+}
+
+func validateUserInformation(v *UserInformationItem) error {
+	var maxLength, classUID int
+	for _, item := range v.Items {
+		switch n := item.(type) {
+		case *UserInformationMaximumLengthItem:
+			maxLength++
+		case *ImplementationClassUIDSubItem:
+			if err := validateUID(n.Name); err != nil {
+				return fmt.Errorf("implementation class UID: %v", err)
+			}
+			classUID++
+		case *ImplementationVersionNameSubItem:
+			if len(n.Name) == 0 || len(n.Name) > 16 {
+				return fmt.Errorf("implementation version name '%s' must be 1-16 characters", n.Name)
+			}
+		case *RoleSelectionSubItem:
+			if err := validateUID(n.SOPClassUID); err != nil {
+				return fmt.Errorf("role selection: %v", err)
+			}
+			if n.SCURole > 1 || n.SCPRole > 1 {
+				return fmt.Errorf("role selection: bad roles %d/%d", n.SCURole, n.SCPRole)
+			}
+		case *UserIdentityRequestSubItem:
+			if n.Type < UserIdentityUsername || n.Type > UserIdentityJWT {
+				return fmt.Errorf("user identity: bad type %d", n.Type)
+			}
+			if len(n.PrimaryField) == 0 {
+				return fmt.Errorf("user identity: empty primary field")
+			}
+		case *AsynchronousOperationsWindowSubItem, *UserIdentityResponseSubItem, *SubItemUnsupported:
+			// Extended negotiation, etc. are opaque to us, and may be
+			// ignored.
+		default:
+			return fmt.Errorf("unexpected user information subitem %v", item)
+		}
+	}
+	if maxLength != 1 {
+		return fmt.Errorf("found %d maximum length subitems, want 1", maxLength)
+	}
+	if classUID != 1 {
+		return fmt.Errorf("found %d implementation class UIDs, want 1", classUID)
+	}
+	return nil
+}
+
+// ValidateAETitle checks an AE title as it appears in the PDU, i.e., possibly
+// padded with spaces: it must have 1 to 16 characters, not counting the
+// padding, with no control characters or backslashes. P3.5 Table 6.2-1 (AE).
+func ValidateAETitle(aeTitle string) error {
+	if len(aeTitle) > aeTitleLength {
+		return fmt.Errorf("'%s' is longer than 16 characters", aeTitle)
+	}
+	if strings.TrimSpace(aeTitle) == "" {
+		return fmt.Errorf("empty")
+	}
+	for _, c := range aeTitle {
+		if c < 0x20 || c >= 0x7f || c == '\\' {
+			return fmt.Errorf("%q contains illegal character %q", aeTitle, c)
+		}
+	}
+	return nil
+}
+
+// Check a UID. P3.5 9.1.
+func validateUID(uid string) error {
+	if len(uid) == 0 || len(uid) > 64 {
+		return fmt.Errorf("UID %q must be 1-64 characters", uid)
+	}
+	for _, component := range strings.Split(uid, ".") {
+		if component == "" {
+			return fmt.Errorf("UID %q has an empty component", uid)
+		}
+		if len(component) > 1 && component[0] == '0' {
+			return fmt.Errorf("UID %q has a component with a leading zero", uid)
+		}
+		for _, c := range component {
+			if c < '0' || c > '9' {
+				return fmt.Errorf("UID %q contains illegal character %q", uid, c)
+			}
+		}
+	}
+	return nil
+}
+
+func validateAAssociateRj(v *AAssociateRj) error {
+	if v.Result != ResultRejectedPermanent && v.Result != ResultRejectedTransient {
+		return fmt.Errorf("A-ASSOCIATE-RJ: bad result %d", v.Result)
+	}
+	var valid bool
+	switch v.Source {
+	case SourceULServiceUser:
+		valid = v.Reason == RejectReasonNone ||
+			v.Reason == RejectReasonApplicationContextNameNotSupported ||
+			v.Reason == RejectReasonCallingAETitleNotRecognized ||
+			v.Reason == RejectReasonCalledAETitleNotRecognized
+	case SourceULServiceProviderACSE:
+		valid = v.Reason == RejectReasonNone || v.Reason == RejectReasonProtocolVersionNotSupported
+	case SourceULServiceProviderPresentation:
+		valid = v.Reason == RejectReasonTemporaryCongestion || v.Reason == RejectReasonLocalLimitExceeded
+	default:
+		return fmt.Errorf("A-ASSOCIATE-RJ: bad source %d", v.Source)
+	}
+	if !valid {
+		return fmt.Errorf("A-ASSOCIATE-RJ: bad reason %d for source %d", v.Reason, v.Source)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package netdicom
+
+// This file implements Peer, the identity of the remote end of an association.
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// Peer identifies the remote end of an association, and what it negotiated.
+// It is passed to callbacks in ConnectionState.Peer, reported in
+// AssociationInfo and Event.Conn, and used in log messages, so that records
+// from different subsystems can be correlated. Fields that aren't known yet,
+// e.g., the AE titles before A-ASSOCIATE-RQ arrives, are empty.
+type Peer struct {
+	// Address of the peer. Port is 0 if the transport has no ports.
+	IP   string
+	Port int
+
+	// AE titles of the association, without padding. On the provider side,
+	// CallingAETitle is the peer's title, and CalledAETitle is the one it
+	// asked for.
+	CallingAETitle string
+	CalledAETitle  string
+
+	// RawCallingAETitle and RawCalledAETitle are the AE title fields of the
+	// A-ASSOCIATE-RQ as received, padding included, e.g., to diagnose a
+	// peer that pads with NULs. Only set on the provider side.
+	RawCallingAETitle string
+	RawCalledAETitle  string
+
+	// TLSCommonName is the subject common name of the certificate the peer
+	// presented. Empty without TLS, or if the peer sent no certificate.
+	TLSCommonName string
+
+	// Implementation identification sent by the peer.
+	ImplementationClassUID    string
+	ImplementationVersionName string
+
+	// MaxPDUSize is the maximum PDU length the peer accepts.
+	MaxPDUSize int
+
+	// The Asynchronous Operations Window proposed by the peer. 0 means
+	// unlimited. Both are 1 if the peer didn't propose a window.
+	MaxOpsInvoked   int
+	MaxOpsPerformed int
+}
+
+// String returns a short description of the peer, e.g.,
+// "CT1@192.168.0.7:41002".
+func (p Peer) String() string {
+	addr := p.IP
+	if p.Port != 0 {
+		addr = net.JoinHostPort(p.IP, strconv.Itoa(p.Port))
+	}
+	if p.CallingAETitle == "" {
+		return addr
+	}
+	return fmt.Sprintf("%s@%s", p.CallingAETitle, addr)
+}
+
+// Labels returns the fields that identify the peer, keyed by snake_case names,
+// e.g., for metrics labels or structured logs. Empty fields are omitted.
+func (p Peer) Labels() map[string]string {
+	labels := map[string]string{}
+	for _, l := range []struct{ key, value string }{
+		{"ip", p.IP},
+		{"calling_ae", p.CallingAETitle},
+		{"called_ae", p.CalledAETitle},
+		{"tls_cn", p.TLSCommonName},
+		{"implementation_class_uid", p.ImplementationClassUID},
+		{"implementation_version_name", p.ImplementationVersionName},
+	} {
+		if l.value != "" {
+			labels[l.key] = l.value
+		}
+	}
+	if p.Port != 0 {
+		labels["port"] = strconv.Itoa(p.Port)
+	}
+	return labels
+}
+
+// Build the Peer of "conn". cm may be nil, in which case only the transport
+// fields are set.
+func newPeer(conn net.Conn, cm *contextManager) Peer {
+	var p Peer
+	if conn != nil {
+		if addr := conn.RemoteAddr(); addr != nil {
+			if host, port, err := net.SplitHostPort(addr.String()); err == nil {
+				p.IP = host
+				p.Port, _ = strconv.Atoi(port)
+			} else {
+				p.IP = addr.String()
+			}
+		}
+		if tlsConn, ok := conn.(*tls.Conn); ok {
+			if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+				p.TLSCommonName = certs[0].Subject.CommonName
+			}
+		}
+	}
+	if cm != nil {
+		p.CallingAETitle = cm.callingAETitle
+		p.CalledAETitle = cm.calledAETitle
+		p.RawCallingAETitle = cm.rawCallingAETitle
+		p.RawCalledAETitle = cm.rawCalledAETitle
+		p.ImplementationClassUID = cm.peerImplementationClassUID
+		p.ImplementationVersionName = cm.peerImplementationVersionName
+		p.MaxPDUSize = cm.peerMaxPDUSize
+		p.MaxOpsInvoked = cm.peerMaxOpsInvoked
+		p.MaxOpsPerformed = cm.peerMaxOpsPerformed
+	}
+	return p
+}
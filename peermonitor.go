@@ -0,0 +1,288 @@
+package netdicom
+
+// This file implements PeerMonitor: checking that remote AEs answer C-ECHO, on
+// a schedule, and reporting when one goes down or comes back.
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/antibios/go-dicom/dicomlog"
+	"github.com/antibios/go-netdicom/sopclass"
+)
+
+const (
+	// DefaultPeerMonitorInterval is the default value of
+	// PeerMonitorParams.Interval.
+	DefaultPeerMonitorInterval = time.Minute
+
+	// DefaultPeerEchoTimeout is the default value of
+	// PeerMonitorParams.Timeout.
+	DefaultPeerEchoTimeout = 10 * time.Second
+
+	// DefaultPeerFailureThreshold and DefaultPeerRecoveryThreshold are the
+	// default values of PeerMonitorParams.FailureThreshold and
+	// RecoveryThreshold.
+	DefaultPeerFailureThreshold  = 3
+	DefaultPeerRecoveryThreshold = 2
+)
+
+// PeerState is the availability of a peer, as seen by a PeerMonitor.
+type PeerState int
+
+const (
+	// PeerUnknown is the state of a peer that hasn't been checked yet.
+	PeerUnknown PeerState = iota
+	PeerUp
+	PeerDown
+)
+
+func (s PeerState) String() string {
+	switch s {
+	case PeerUnknown:
+		return "unknown"
+	case PeerUp:
+		return "up"
+	case PeerDown:
+		return "down"
+	}
+	return fmt.Sprintf("PeerState(%d)", int(s))
+}
+
+// PeerStatus describes a peer watched by a PeerMonitor.
+type PeerStatus struct {
+	AETitle string
+	Address string // host:port
+	State   PeerState
+
+	// Since is when the peer entered State.
+	Since time.Time
+
+	// The outcome of the last C-ECHO. LastError is nil if it succeeded,
+	// in which case LastLatency is the time from the connection to the
+	// response.
+	LastCheck   time.Time
+	LastError   error
+	LastLatency time.Duration
+
+	// The number of C-ECHOs in a row that failed, or succeeded, up to the
+	// last one.
+	ConsecutiveFailures  int
+	ConsecutiveSuccesses int
+
+	// Transitions counts the changes of State, excluding the first one out
+	// of PeerUnknown.
+	Transitions int
+}
+
+// PeerStateChangeCallback is called when a peer changes state. "old" is its
+// previous state.
+type PeerStateChangeCallback func(status PeerStatus, old PeerState)
+
+// PeerMonitorParams configures a PeerMonitor.
+type PeerMonitorParams struct {
+	// Peers maps the AE title of each peer to watch to its "host:port",
+	// like ServiceProviderParams.RemoteAEs.
+	Peers map[string]string
+
+	// Interval is the time between rounds of C-ECHOs. If zero,
+	// DefaultPeerMonitorInterval is used.
+	Interval time.Duration
+
+	// Timeout bounds each C-ECHO, from the connection to the response. If
+	// zero, DefaultPeerEchoTimeout is used.
+	Timeout time.Duration
+
+	// FailureThreshold is the number of C-ECHOs in a row that must fail
+	// for a peer that is up to be reported down, and RecoveryThreshold the
+	// number that must succeed for a peer that is down to be reported up,
+	// so that a flapping link doesn't flood OnChange. The first C-ECHO
+	// decides the state of a peer whose state is unknown. If zero,
+	// DefaultPeerFailureThreshold and DefaultPeerRecoveryThreshold are
+	// used.
+	FailureThreshold  int
+	RecoveryThreshold int
+
+	// ServiceUser configures the associations used for C-ECHO, e.g., the
+	// calling AE title. CalledAETitle and SOPClasses are set for each
+	// peer.
+	ServiceUser ServiceUserParams
+
+	// OnChange, if non-nil, is called when a peer changes state. Calls are
+	// made one at a time.
+	OnChange PeerStateChangeCallback
+
+	// Clock, if non-nil, schedules the rounds. If nil, the real clock is
+	// used.
+	Clock Clock
+}
+
+// PeerMonitor sends C-ECHO to a set of peers periodically, and tracks whether
+// each is up. The peers of a round are checked in parallel. Thread safe.
+type PeerMonitor struct {
+	params PeerMonitorParams
+	clock  Clock
+	stop   chan struct{}
+	done   chan struct{}
+
+	roundMu sync.Mutex // serializes rounds, and so OnChange calls
+
+	mu    sync.Mutex
+	peers map[string]*PeerStatus // keyed by AE title
+}
+
+// NewPeerMonitor creates a monitor and starts its first round.
+func NewPeerMonitor(params PeerMonitorParams) *PeerMonitor {
+	if params.Interval <= 0 {
+		params.Interval = DefaultPeerMonitorInterval
+	}
+	if params.Timeout <= 0 {
+		params.Timeout = DefaultPeerEchoTimeout
+	}
+	if params.FailureThreshold <= 0 {
+		params.FailureThreshold = DefaultPeerFailureThreshold
+	}
+	if params.RecoveryThreshold <= 0 {
+		params.RecoveryThreshold = DefaultPeerRecoveryThreshold
+	}
+	m := &PeerMonitor{
+		params: params,
+		clock:  clockOrDefault(params.Clock),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+		peers:  map[string]*PeerStatus{},
+	}
+	for aeTitle, addr := range params.Peers {
+		m.peers[aeTitle] = &PeerStatus{AETitle: aeTitle, Address: addr, Since: m.clock.Now()}
+	}
+	go m.run()
+	return m
+}
+
+func (m *PeerMonitor) run() {
+	defer close(m.done)
+	for {
+		m.CheckNow()
+		tick := make(chan struct{})
+		timer := m.clock.AfterFunc(m.params.Interval, func() { close(tick) })
+		select {
+		case <-tick:
+		case <-m.stop:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// Close stops the monitor, waiting for the round in progress to end.
+func (m *PeerMonitor) Close() {
+	close(m.stop)
+	<-m.done
+}
+
+// Status returns the status of the peers, sorted by AE title.
+func (m *PeerMonitor) Status() []PeerStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	statuses := make([]PeerStatus, 0, len(m.peers))
+	for _, s := range m.peers {
+		statuses = append(statuses, *s)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].AETitle < statuses[j].AETitle })
+	return statuses
+}
+
+// CheckNow runs a round of C-ECHOs right away, and returns once it is done.
+// The periodic rounds continue as scheduled.
+func (m *PeerMonitor) CheckNow() {
+	m.roundMu.Lock()
+	defer m.roundMu.Unlock()
+	type result struct {
+		aeTitle string
+		latency time.Duration
+		err     error
+	}
+	results := make(chan result, len(m.params.Peers))
+	for aeTitle, addr := range m.params.Peers {
+		go func(aeTitle, addr string) {
+			latency, err := m.echo(aeTitle, addr)
+			results <- result{aeTitle, latency, err}
+		}(aeTitle, addr)
+	}
+	for range m.params.Peers {
+		r := <-results
+		m.record(r.aeTitle, r.latency, r.err)
+	}
+}
+
+// Send one C-ECHO to "aeTitle" at "addr". Returns the time it took.
+func (m *PeerMonitor) echo(aeTitle, addr string) (time.Duration, error) {
+	params := m.params.ServiceUser
+	params.CalledAETitle = aeTitle
+	params.SOPClasses = sopclass.VerificationClasses
+	su, err := NewServiceUser(params)
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), m.params.Timeout)
+	defer cancel()
+	start := time.Now()
+	result := make(chan error, 1)
+	go func() {
+		if err := su.ConnectContext(ctx, addr); err != nil {
+			result <- err
+			return
+		}
+		result <- su.CEcho()
+	}()
+	select {
+	case err = <-result:
+		su.Release()
+	case <-ctx.Done():
+		err = fmt.Errorf("dicom.PeerMonitor: no C-ECHO response from %s within %v", aeTitle, m.params.Timeout)
+		// Release aborts the association if the peer doesn't answer,
+		// which ends the C-ECHO.
+		go su.Release()
+	}
+	return time.Since(start), err
+}
+
+// Update the status of "aeTitle" with the outcome of a C-ECHO.
+func (m *PeerMonitor) record(aeTitle string, latency time.Duration, err error) {
+	m.mu.Lock()
+	s := m.peers[aeTitle]
+	old := s.State
+	s.LastCheck = m.clock.Now()
+	s.LastError = err
+	if err == nil {
+		s.LastLatency = latency
+		s.ConsecutiveSuccesses++
+		s.ConsecutiveFailures = 0
+		if old == PeerUnknown || (old == PeerDown && s.ConsecutiveSuccesses >= m.params.RecoveryThreshold) {
+			s.State = PeerUp
+		}
+	} else {
+		s.ConsecutiveFailures++
+		s.ConsecutiveSuccesses = 0
+		if old == PeerUnknown || (old == PeerUp && s.ConsecutiveFailures >= m.params.FailureThreshold) {
+			s.State = PeerDown
+		}
+	}
+	if s.State == old {
+		m.mu.Unlock()
+		return
+	}
+	s.Since = s.LastCheck
+	if old != PeerUnknown {
+		s.Transitions++
+	}
+	status := *s
+	m.mu.Unlock()
+	dicomlog.Vprintf(0, "dicom.PeerMonitor: %s (%s) is %v (was %v): %v", aeTitle, status.Address, status.State, old, err)
+	if m.params.OnChange != nil {
+		m.params.OnChange(status, old)
+	}
+}
@@ -0,0 +1,71 @@
+package netdicom
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/antibios/go-netdicom/dimse"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeerMonitor(t *testing.T) {
+	var failing int32
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		CEcho: func(conn ConnectionState) dimse.Status {
+			if atomic.LoadInt32(&failing) != 0 {
+				return dimse.Status{Status: dimse.StatusNotAuthorized}
+			}
+			return dimse.Success
+		},
+	}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	closedAddr := l.Addr().String()
+	l.Close()
+
+	changes := make(chan PeerStatus, 10)
+	m := NewPeerMonitor(PeerMonitorParams{
+		Peers: map[string]string{
+			"PACS":   sp.ListenAddr().String(),
+			"OFFICE": closedAddr,
+		},
+		Interval:          time.Hour,
+		Timeout:           5 * time.Second,
+		FailureThreshold:  2,
+		RecoveryThreshold: 1,
+		OnChange:          func(s PeerStatus, old PeerState) { changes <- s },
+	})
+	defer m.Close()
+	states := map[string]PeerState{}
+	for i := 0; i < 2; i++ {
+		s := <-changes
+		states[s.AETitle] = s.State
+	}
+	require.Equal(t, map[string]PeerState{"PACS": PeerUp, "OFFICE": PeerDown}, states)
+
+	// One failure isn't enough to report PACS down.
+	atomic.StoreInt32(&failing, 1)
+	m.CheckNow()
+	status := m.Status()
+	require.Equal(t, "OFFICE", status[0].AETitle)
+	require.Equal(t, PeerUp, status[1].State)
+	require.Equal(t, 1, status[1].ConsecutiveFailures)
+	require.Error(t, status[1].LastError)
+	m.CheckNow()
+	s := <-changes
+	require.Equal(t, "PACS", s.AETitle)
+	require.Equal(t, PeerDown, s.State)
+	require.Equal(t, 1, s.Transitions)
+
+	atomic.StoreInt32(&failing, 0)
+	m.CheckNow()
+	s = <-changes
+	require.Equal(t, PeerUp, s.State)
+	require.Equal(t, 2, s.Transitions)
+	require.Empty(t, changes)
+}
@@ -0,0 +1,254 @@
+// Package providerconfig loads the declarative part of a
+// netdicom.ServiceProvider's configuration from a JSON file, and re-applies it
+// to a running provider on SIGHUP or when the file changes. The "mock" section
+// turns the provider into a misbehaving PACS for testing SCUs:
+//
+//	"mock": {"rules": [
+//	  {"command": "C-STORE", "sopInstanceUIDs": ["1.2.3"], "status": "A700"},
+//	  {"command": "C-FIND", "delay": "5s"},
+//	  {"abortProbability": 0.01}
+//	]}
+//
+//	r := &providerconfig.Reloader{Provider: sp, Path: "/etc/dicom.json", Base: params}
+//	if err := r.Reload(); err != nil { ... }
+//	defer r.WatchSignals()()
+//
+// A config that fails to parse or validate is rejected as a whole; the provider
+// keeps running with the previous one.
+package providerconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/antibios/go-netdicom"
+	"github.com/antibios/go-netdicom/dimse"
+	"github.com/antibios/go-netdicom/pdu"
+)
+
+// Config is the JSON form of the reloadable settings. Fields that are omitted
+// leave the corresponding ServiceProviderParams field of the base unchanged.
+type Config struct {
+	// AE title of the provider.
+	AETitle string `json:"aeTitle,omitempty"`
+	// Peers allowed to associate. See
+	// ServiceProviderParams.AllowedCallingAETitles.
+	AllowedCallingAETitles []string `json:"allowedCallingAETitles,omitempty"`
+	// AE titles the provider answers to; "*" accepts any. See
+	// ServiceProviderParams.CalledAETitles.
+	CalledAETitles []string `json:"calledAETitles,omitempty"`
+	// Maps AE title to host:port. See ServiceProviderParams.RemoteAEs.
+	RemoteAEs map[string]string `json:"remoteAEs,omitempty"`
+	TLS       *TLSConfig        `json:"tls,omitempty"`
+	// Verbosity passed to dicomlog.SetLevel.
+	LogLevel *int `json:"logLevel,omitempty"`
+	// Makes the provider misbehave on purpose, for testing SCUs. An empty
+	// object turns it off. See ServiceProviderParams.ResponseShaping.
+	Mock *MockConfig `json:"mock,omitempty"`
+}
+
+// TLSConfig names the PEM files holding the provider's certificate.
+type TLSConfig struct {
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+	// Optional. If set, peers must present a certificate signed by one of
+	// these CAs.
+	CAFile string `json:"caFile,omitempty"`
+}
+
+// MockConfig is the JSON form of netdicom.ResponseShaping.
+type MockConfig struct {
+	Rules []MockRule `json:"rules,omitempty"`
+}
+
+// MockRule is the JSON form of netdicom.ResponseRule.
+type MockRule struct {
+	// One of "C-ECHO", "C-STORE", "C-FIND", "C-GET" or "C-MOVE". If empty,
+	// any request matches.
+	Command         string   `json:"command,omitempty"`
+	SOPClassUIDs    []string `json:"sopClassUIDs,omitempty"`
+	SOPInstanceUIDs []string `json:"sopInstanceUIDs,omitempty"`
+	// Duration, e.g., "2s".
+	Delay string `json:"delay,omitempty"`
+	// Hex status code, e.g., "A700".
+	Status           string  `json:"status,omitempty"`
+	ErrorComment     string  `json:"errorComment,omitempty"`
+	AbortProbability float64 `json:"abortProbability,omitempty"`
+}
+
+var mockCommands = map[string]int{
+	"C-ECHO":  dimse.CommandFieldCEchoRq,
+	"C-STORE": dimse.CommandFieldCStoreRq,
+	"C-FIND":  dimse.CommandFieldCFindRq,
+	"C-GET":   dimse.CommandFieldCGetRq,
+	"C-MOVE":  dimse.CommandFieldCMoveRq,
+}
+
+func (m *MockConfig) shaping() (*netdicom.ResponseShaping, error) {
+	s := &netdicom.ResponseShaping{}
+	for i, r := range m.Rules {
+		rule := netdicom.ResponseRule{
+			SOPClassUIDs:     r.SOPClassUIDs,
+			SOPInstanceUIDs:  r.SOPInstanceUIDs,
+			AbortProbability: r.AbortProbability,
+		}
+		if r.Command != "" {
+			cmd, ok := mockCommands[r.Command]
+			if !ok {
+				return nil, fmt.Errorf("mock: rule %d: unknown command '%s'", i, r.Command)
+			}
+			rule.CommandField = cmd
+		}
+		if r.Delay != "" {
+			d, err := time.ParseDuration(r.Delay)
+			if err != nil {
+				return nil, fmt.Errorf("mock: rule %d: invalid delay '%s'", i, r.Delay)
+			}
+			rule.Delay = d
+		}
+		if r.Status != "" {
+			code, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(r.Status), "0x"), 16, 16)
+			if err != nil {
+				return nil, fmt.Errorf("mock: rule %d: invalid status '%s'", i, r.Status)
+			}
+			rule.Status = &dimse.Status{Status: dimse.StatusCode(code), ErrorComment: r.ErrorComment}
+		}
+		s.Rules = append(s.Rules, rule)
+	}
+	if err := s.Validate(); err != nil {
+		return nil, fmt.Errorf("mock: %v", err)
+	}
+	return s, nil
+}
+
+// Parse decodes and validates a config.
+func Parse(data []byte) (*Config, error) {
+	c := &Config{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, err
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Load reads and validates the config file at "path".
+func Load(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return c, nil
+}
+
+func validateAETitle(aeTitle string) error {
+	if err := pdu.ValidateAETitle(aeTitle); err != nil {
+		return fmt.Errorf("invalid AE title: %v", err)
+	}
+	return nil
+}
+
+func (c *Config) validate() error {
+	if c.AETitle != "" {
+		if err := validateAETitle(c.AETitle); err != nil {
+			return err
+		}
+	}
+	for _, aeTitle := range c.AllowedCallingAETitles {
+		if err := validateAETitle(aeTitle); err != nil {
+			return fmt.Errorf("allowedCallingAETitles: %v", err)
+		}
+	}
+	for _, aeTitle := range c.CalledAETitles {
+		if err := validateAETitle(aeTitle); err != nil {
+			return fmt.Errorf("calledAETitles: %v", err)
+		}
+	}
+	for aeTitle, hostPort := range c.RemoteAEs {
+		if err := validateAETitle(aeTitle); err != nil {
+			return fmt.Errorf("remoteAEs: %v", err)
+		}
+		if _, _, err := net.SplitHostPort(hostPort); err != nil {
+			return fmt.Errorf("remoteAEs: %s: %v", aeTitle, err)
+		}
+	}
+	if c.TLS != nil && (c.TLS.CertFile == "" || c.TLS.KeyFile == "") {
+		return fmt.Errorf("tls: certFile and keyFile must be set")
+	}
+	if c.LogLevel != nil && *c.LogLevel < -1 {
+		return fmt.Errorf("invalid logLevel %d", *c.LogLevel)
+	}
+	if c.Mock != nil {
+		if _, err := c.Mock.shaping(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Apply returns "base" overridden by the settings in c. It reads the TLS
+// files, so it fails if they are missing or malformed.
+func (c *Config) Apply(base netdicom.ServiceProviderParams) (netdicom.ServiceProviderParams, error) {
+	params := base
+	if c.AETitle != "" {
+		params.AETitle = c.AETitle
+	}
+	if c.AllowedCallingAETitles != nil {
+		params.AllowedCallingAETitles = c.AllowedCallingAETitles
+	}
+	if c.CalledAETitles != nil {
+		params.CalledAETitles = c.CalledAETitles
+	}
+	if c.RemoteAEs != nil {
+		params.RemoteAEs = c.RemoteAEs
+	}
+	if c.Mock != nil {
+		shaping, err := c.Mock.shaping()
+		if err != nil {
+			return params, err
+		}
+		params.ResponseShaping = shaping
+	}
+	if c.TLS != nil {
+		tlsConfig, err := c.TLS.load()
+		if err != nil {
+			return params, err
+		}
+		params.TLSConfig = tlsConfig
+	}
+	return params, nil
+}
+
+func (t *TLSConfig) load() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("tls: %v", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+	if t.CAFile != "" {
+		ca, err := ioutil.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls: %v", err)
+		}
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("tls: %s: no certificates found", t.CAFile)
+		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,96 @@
+package providerconfig
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/antibios/go-netdicom"
+	"github.com/antibios/go-netdicom/dimse"
+	"github.com/antibios/go-netdicom/sopclass"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	c, err := Parse([]byte(`{
+  "aeTitle": "ARCHIVE",
+  "allowedCallingAETitles": ["CT1", "MR1"],
+  "remoteAEs": {"VIEWER": "localhost:11112"},
+  "logLevel": 1,
+  "mock": {"rules": [
+    {"command": "C-STORE", "sopInstanceUIDs": ["1.2.3"], "status": "A700", "delay": "2s"},
+    {"abortProbability": 0.5}
+  ]}
+}`))
+	require.NoError(t, err)
+	params, err := c.Apply(netdicom.ServiceProviderParams{AETitle: "OLD", IdleTimeout: 5})
+	require.NoError(t, err)
+	require.Equal(t, "ARCHIVE", params.AETitle)
+	require.Equal(t, []string{"CT1", "MR1"}, params.AllowedCallingAETitles)
+	require.Equal(t, "localhost:11112", params.RemoteAEs["VIEWER"])
+	require.EqualValues(t, 5, params.IdleTimeout)
+	require.Equal(t, []netdicom.ResponseRule{
+		{
+			CommandField:    dimse.CommandFieldCStoreRq,
+			SOPInstanceUIDs: []string{"1.2.3"},
+			Delay:           2 * time.Second,
+			Status:          &dimse.Status{Status: dimse.CStoreOutOfResources},
+		},
+		{AbortProbability: 0.5},
+	}, params.ResponseShaping.Rules)
+
+	for _, bad := range []string{
+		`{"aeTitle": "WAY_TOO_LONG_AE_TITLE"}`,
+		`{"remoteAEs": {"VIEWER": "localhost"}}`,
+		`{"tls": {"certFile": "cert.pem"}}`,
+		`{"aeTitle": `,
+		`{"mock": {"rules": [{"command": "C-FOO"}]}}`,
+		`{"mock": {"rules": [{"status": "XYZ"}]}}`,
+		`{"mock": {"rules": [{"abortProbability": 2}]}}`,
+	} {
+		_, err := Parse([]byte(bad))
+		require.Error(t, err, bad)
+	}
+}
+
+func TestReloadKeepsConfigOnError(t *testing.T) {
+	base := netdicom.ServiceProviderParams{
+		CEcho: func(conn netdicom.ConnectionState) dimse.Status { return dimse.Success },
+	}
+	sp, err := netdicom.NewServiceProvider(base, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+	defer sp.Shutdown() // nolint: errcheck
+	dir, err := ioutil.TempDir("", "providerconfig")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	r := &Reloader{Provider: sp, Path: path, Base: base}
+	// Reports whether the provider accepts an association from "callingAETitle".
+	accepts := func(callingAETitle string) bool {
+		su, err := netdicom.NewServiceUser(netdicom.ServiceUserParams{
+			CallingAETitle: callingAETitle,
+			SOPClasses:     sopclass.VerificationClasses,
+		})
+		require.NoError(t, err)
+		defer su.Release() // nolint: errcheck
+		su.Connect(sp.ListenAddr().String())
+		return su.CEcho() == nil
+	}
+
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"allowedCallingAETitles": ["CT1"]}`), 0600))
+	require.NoError(t, r.Reload())
+	require.True(t, accepts("CT1"))
+	require.False(t, accepts("MR1"))
+
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"allowedCallingAETitles": ["MR1"], "remoteAEs": {"X": "nope"}}`), 0600))
+	require.Error(t, r.Reload())
+	// Unreadable certificates are rejected before reaching the provider.
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"allowedCallingAETitles": ["MR1"], "tls": {"certFile": "missing.pem", "keyFile": "missing.pem"}}`), 0600))
+	require.Error(t, r.Reload())
+	// The first config is still in effect.
+	require.True(t, accepts("CT1"))
+	require.False(t, accepts("MR1"))
+}
@@ -0,0 +1,115 @@
+package providerconfig
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/antibios/go-dicom/dicomlog"
+	"github.com/antibios/go-netdicom"
+)
+
+// Reloader re-applies the config file to a running provider.
+type Reloader struct {
+	Provider *netdicom.ServiceProvider
+	// Path of the JSON config file.
+	Path string
+	// Parameters that aren't part of the config, e.g., the callbacks. The
+	// file's settings are layered on top of these on every reload.
+	Base netdicom.ServiceProviderParams
+
+	mu sync.Mutex // serializes Reload
+}
+
+// Reload reads the config file and, if it is valid, applies it to the
+// provider. Associations in progress keep the settings they started with.
+// On error nothing is changed. Its signature matches admin.Handler.Reload.
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, err := Load(r.Path)
+	if err != nil {
+		return err
+	}
+	params, err := c.Apply(r.Base)
+	if err != nil {
+		return err
+	}
+	if err := r.Provider.SetParams(params); err != nil {
+		return err
+	}
+	if c.LogLevel != nil {
+		dicomlog.SetLevel(*c.LogLevel)
+	}
+	dicomlog.Vprintf(0, "providerconfig: reloaded %s", r.Path)
+	return nil
+}
+
+// Call Reload, logging failures.
+func (r *Reloader) reloadAndLog() {
+	if err := r.Reload(); err != nil {
+		dicomlog.Vprintf(0, "providerconfig: reload failed, keeping the previous config: %v", err)
+	}
+}
+
+// WatchSignals calls Reload whenever one of "sigs" (default SIGHUP) is
+// received. It returns a function that stops watching.
+func (r *Reloader) WatchSignals(sigs ...os.Signal) (stop func()) {
+	if len(sigs) == 0 {
+		sigs = []os.Signal{syscall.SIGHUP}
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sigs...)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ch:
+				r.reloadAndLog()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(ch)
+		close(done)
+	}
+}
+
+// WatchFile calls Reload whenever the modification time or size of the config
+// file changes, checking every "interval". It returns a function that stops
+// watching.
+func (r *Reloader) WatchFile(interval time.Duration) (stop func()) {
+	stat := func() (time.Time, int64) {
+		fi, err := os.Stat(r.Path)
+		if err != nil {
+			return time.Time{}, -1
+		}
+		return fi.ModTime(), fi.Size()
+	}
+	lastMtime, lastSize := stat()
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				mtime, size := stat()
+				if size < 0 || (mtime.Equal(lastMtime) && size == lastSize) {
+					continue
+				}
+				lastMtime, lastSize = mtime, size
+				r.reloadAndLog()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(done)
+	}
+}
@@ -0,0 +1,248 @@
+package netdicom
+
+// This file implements the limits that keep a peer from holding a provider
+// connection open by sending data very slowly: a byte budget for the
+// A-ASSOCIATE-RQ, and a minimum transfer rate while a PDU is being received.
+// It also carries the bounds on the items of the A-ASSOCIATE-RQ, which keep a
+// small request from decoding into a large number of objects.
+// AssociationRequestTimeout and IdleTimeout, implemented by
+// updateReadDeadline, complete them.
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/antibios/go-netdicom/pdu"
+)
+
+// DefaultMaxAssociationRequestBytes is the default value of
+// ServiceProviderParams.MaxAssociationRequestBytes.
+const DefaultMaxAssociationRequestBytes = 256 << 10
+
+// DefaultTransferRateWindow is the default value of
+// ServiceProviderParams.TransferRateWindow.
+const DefaultTransferRateWindow = 10 * time.Second
+
+// ErrAssociationRequestTooLarge is reported, wrapped in a TransportError, when
+// the A-ASSOCIATE-RQ exceeds ServiceProviderParams.MaxAssociationRequestBytes.
+var ErrAssociationRequestTooLarge = errors.New("dicom: A-ASSOCIATE-RQ too large")
+
+// ErrTransferTooSlow is reported, wrapped in a TransportError, when a PDU is
+// received slower than ServiceProviderParams.MinTransferRate.
+var ErrTransferTooSlow = errors.New("dicom: transfer rate too low")
+
+// DropCause is the reason a provider closed a connection because of a
+// timeout or limit.
+type DropCause int
+
+const (
+	// DropAssociationRequestTimeout: no A-ASSOCIATE-RQ arrived within
+	// AssociationRequestTimeout, or the ARTIM timer expired first.
+	DropAssociationRequestTimeout DropCause = iota
+	// DropAssociationRequestTooLarge: the A-ASSOCIATE-RQ exceeded
+	// MaxAssociationRequestBytes.
+	DropAssociationRequestTooLarge
+	// DropSlowTransfer: a PDU was received slower than MinTransferRate.
+	DropSlowTransfer
+	// DropIdleTimeout: no PDU arrived within IdleTimeout.
+	DropIdleTimeout
+	// DropAssociationRequestTooComplex: the A-ASSOCIATE-RQ had more items
+	// than MaxAssociationRequestItems, or items nested deeper than
+	// MaxAssociationRequestItemDepth. The association was aborted.
+	DropAssociationRequestTooComplex
+
+	// NumDropCauses is the number of DropCause values.
+	NumDropCauses
+)
+
+func (c DropCause) String() string {
+	switch c {
+	case DropAssociationRequestTimeout:
+		return "association_request_timeout"
+	case DropAssociationRequestTooLarge:
+		return "association_request_too_large"
+	case DropSlowTransfer:
+		return "slow_transfer"
+	case DropIdleTimeout:
+		return "idle_timeout"
+	case DropAssociationRequestTooComplex:
+		return "association_request_too_complex"
+	}
+	return fmt.Sprintf("DropCause(%d)", int(c))
+}
+
+// Counts of dropped connections, indexed by DropCause. Updated atomically.
+type dropCounters [NumDropCauses]int64
+
+func (d *dropCounters) snapshot() map[DropCause]int64 {
+	m := map[DropCause]int64{}
+	for c := DropCause(0); c < NumDropCauses; c++ {
+		m[c] = atomic.LoadInt64(&d[c])
+	}
+	return m
+}
+
+// Classify the error of a provider connection that ended in state "state".
+// Returns false if the connection wasn't dropped by a limit.
+func dropCauseForError(state stateType, err error) (DropCause, bool) {
+	if errors.Is(err, ErrAssociationRequestTooLarge) {
+		return DropAssociationRequestTooLarge, true
+	}
+	if errors.Is(err, ErrTransferTooSlow) {
+		return DropSlowTransfer, true
+	}
+	var ne net.Error
+	if !errors.As(err, &ne) || !ne.Timeout() {
+		return 0, false
+	}
+	if state == sta02 {
+		return DropAssociationRequestTimeout, true
+	}
+	return DropIdleTimeout, true
+}
+
+// readGuard wraps the connection read by networkReaderThread on the provider
+// side. It limits the bytes read until the first PDU, the A-ASSOCIATE-RQ,
+// completes, and closes the connection if a PDU is received slower than
+// minRate.
+type readGuard struct {
+	conn    net.Conn
+	clock   Clock
+	minRate int64 // Bytes per second. No minimum if zero.
+	window  time.Duration
+	// Bounds on the items of the A-ASSOCIATE-RQ, applied by the
+	// pdu.Reader of the connection.
+	itemLimits pdu.AssociateLimits
+
+	mu sync.Mutex
+	// Bytes the first PDU may still use. Negative once it is received.
+	budget int64
+	// Set while a PDU is partially received.
+	inPDU       bool
+	windowStart time.Time
+	windowBytes int64
+	// Set once the guard has failed the connection.
+	err     error
+	timer   Timer
+	stopped bool
+}
+
+func newReadGuard(conn net.Conn, params ServiceProviderParams, clock Clock) *readGuard {
+	g := &readGuard{
+		conn:    conn,
+		clock:   clock,
+		minRate: int64(params.MinTransferRate),
+		window:  params.TransferRateWindow,
+		budget:  int64(params.MaxAssociationRequestBytes),
+		itemLimits: pdu.AssociateLimits{
+			MaxItems: params.MaxAssociationRequestItems,
+			MaxDepth: params.MaxAssociationRequestItemDepth,
+		},
+	}
+	if g.budget == 0 {
+		g.budget = DefaultMaxAssociationRequestBytes
+	}
+	if g.window == 0 {
+		g.window = DefaultTransferRateWindow
+	}
+	if g.minRate > 0 {
+		g.timer = clock.AfterFunc(g.window, g.checkRate)
+	}
+	return g
+}
+
+func (g *readGuard) Read(p []byte) (int, error) {
+	g.mu.Lock()
+	if g.err != nil {
+		err := g.err
+		g.mu.Unlock()
+		return 0, err
+	}
+	if g.budget == 0 {
+		g.err = ErrAssociationRequestTooLarge
+		g.mu.Unlock()
+		return 0, ErrAssociationRequestTooLarge
+	}
+	if g.budget > 0 && int64(len(p)) > g.budget {
+		p = p[:g.budget]
+	}
+	g.mu.Unlock()
+
+	n, err := g.conn.Read(p)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.budget > 0 {
+		g.budget -= int64(n)
+	}
+	if n > 0 && !g.inPDU {
+		g.inPDU = true
+		g.windowStart = g.clock.Now()
+		g.windowBytes = 0
+	}
+	g.windowBytes += int64(n)
+	if g.err != nil {
+		// checkRate closed the connection under us.
+		err = g.err
+	}
+	return n, err
+}
+
+// Called by networkReaderThread once a PDU is fully received.
+func (g *readGuard) pduDone() {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	g.budget = -1
+	g.inPDU = false
+	g.mu.Unlock()
+}
+
+// Returns the error the guard failed the connection with, or nil.
+func (g *readGuard) failure() error {
+	if g == nil {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.err
+}
+
+// Called by networkReaderThread when it exits.
+func (g *readGuard) stop() {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.stopped = true
+	if g.timer != nil {
+		g.timer.Stop()
+	}
+}
+
+// Runs every window. Closes the connection if the PDU being received has
+// progressed slower than minRate since the window started.
+func (g *readGuard) checkRate() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.stopped || g.err != nil {
+		return
+	}
+	now := g.clock.Now()
+	if elapsed := now.Sub(g.windowStart); g.inPDU && elapsed >= g.window {
+		if g.windowBytes*int64(time.Second) < g.minRate*int64(elapsed) {
+			g.err = ErrTransferTooSlow
+			g.conn.Close()
+			return
+		}
+		g.windowStart = now
+		g.windowBytes = 0
+	}
+	g.timer = g.clock.AfterFunc(g.window, g.checkRate)
+}
@@ -0,0 +1,207 @@
+package netdicom
+
+// This file implements ReadSharedPoller: instead of a goroutine blocked
+// reading each connection, a poller shared by all the connections of the
+// process watches the idle ones, and a goroutine reads a connection only while
+// PDUs arrive on it.
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/antibios/go-dicom/dicomlog"
+)
+
+// ReadMode selects how a ServiceProvider waits for the PDUs of its
+// connections.
+type ReadMode int
+
+const (
+	// ReadPerConnection reads each connection from a goroutine of its own,
+	// blocked in Read while the connection is idle. This is the default.
+	ReadPerConnection ReadMode = iota
+
+	// ReadSharedPoller leaves idle connections to a poller shared by the
+	// process, epoll on Linux, and reads a connection only once it has
+	// data, so that thousands of mostly idle associations hold no reader
+	// goroutines. Connections the poller can't watch, e.g., TLS
+	// connections, and all connections on other platforms, are read as
+	// with ReadPerConnection.
+	ReadSharedPoller
+)
+
+// errPollUnsupported is returned by the readPoller of platforms without one,
+// and for connections that have no file descriptor.
+var errPollUnsupported = errors.New("dicom: connection can't be polled")
+
+// readPoller watches connections for readability.
+type readPoller interface {
+	// Call pc.wake once pc's connection is readable, or has failed. Fails
+	// if the connection is closed.
+	arm(pc *polledConn) error
+	// Stop watching pc's connection.
+	forget(pc *polledConn)
+}
+
+var (
+	sharedPollerOnce sync.Once
+	sharedPollerV    readPoller
+	sharedPollerErr  error
+)
+
+// Returns the poller of the process, created on first use.
+func sharedPoller() (readPoller, error) {
+	sharedPollerOnce.Do(func() {
+		sharedPollerV, sharedPollerErr = newReadPoller()
+		if sharedPollerErr != nil {
+			dicomlog.Vprintf(0, "dicom: no shared poller: %v; reading each connection from its own goroutine", sharedPollerErr)
+		}
+	})
+	return sharedPollerV, sharedPollerErr
+}
+
+// polledConn is a connection read by a networkReader whenever the poller
+// reports it readable.
+type polledConn struct {
+	poller readPoller
+	reader *networkReader
+	stats  *associationStats
+	// The connection, for the poller. The poller uses the descriptor only
+	// within rc.Control, which fails once the connection is closed, so that
+	// it never touches a descriptor reused by another connection.
+	rc syscall.RawConn
+	// The number of the descriptor, which identifies the connection in
+	// the poller's events while it is open.
+	fd int
+	// Set by the poller once the descriptor is registered.
+	registered bool
+	// 1 while the poller watches the connection, i.e., while no goroutine
+	// reads it. Updated atomically.
+	armed int32
+
+	mu sync.Mutex
+	// Wakes the reader at the read deadline of the connection, so that an
+	// idle connection times out. Guarded by mu.
+	deadlineTimer *time.Timer
+	done          bool
+}
+
+// Start reading "conn" whenever "poller" reports it readable. Returns nil if
+// the poller can't watch the connection, which must then be read by
+// networkReaderThread.
+func startPolledNetworkReader(poller readPoller, stats *associationStats, ch chan stateEvent, conn net.Conn, guard *readGuard, flow *cstoreStreamFlow, tee *connTee, maxPDUSize int, smName string, logf Logger) *polledConn {
+	rc, fd, err := connFD(conn)
+	if err != nil {
+		return nil
+	}
+	pc := &polledConn{
+		poller: poller,
+		reader: newNetworkReader(ch, conn, guard, flow, tee, maxPDUSize, smName, logf),
+		stats:  stats,
+		rc:     rc,
+		fd:     fd,
+	}
+	stats.goroutineStarted()
+	atomic.StoreInt32(&pc.armed, 1)
+	if err := poller.arm(pc); err != nil {
+		logf(1, "dicom.StateMachine %s: Can't poll connection: %v", smName, err)
+		atomic.StoreInt32(&pc.armed, 0)
+		go pc.readUntilDone()
+	}
+	return pc
+}
+
+// Returns the file descriptor of "conn", if it has one the poller can watch.
+// Connections that buffer what they read, such as *tls.Conn, have none.
+func connFD(conn net.Conn) (syscall.RawConn, int, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil, 0, errPollUnsupported
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return nil, 0, err
+	}
+	fd := -1
+	if err := rc.Control(func(f uintptr) { fd = int(f) }); err != nil {
+		return nil, 0, err
+	}
+	return rc, fd, nil
+}
+
+// Hand the connection to a reader goroutine, unless one already has it.
+// Called by the poller, at the read deadline, and when the statemachine
+// finishes. Safe on a nil polledConn.
+func (pc *polledConn) wake() {
+	if pc == nil {
+		return
+	}
+	if atomic.CompareAndSwapInt32(&pc.armed, 1, 0) {
+		go pc.step()
+	}
+}
+
+// Read the PDUs available, then give the connection back to the poller.
+func (pc *polledConn) step() {
+	for {
+		if !pc.reader.readOne() {
+			pc.finish()
+			return
+		}
+		if pc.reader.r.Buffered() == 0 {
+			break
+		}
+	}
+	// Hold no read buffers while idle.
+	pc.reader.r.Release()
+	atomic.StoreInt32(&pc.armed, 1)
+	if err := pc.poller.arm(pc); err != nil {
+		// E.g., the connection was closed under us. Read until the
+		// failure shows, unless a wakeup got there first.
+		if atomic.CompareAndSwapInt32(&pc.armed, 1, 0) {
+			pc.readUntilDone()
+		}
+	}
+}
+
+// Read the connection from this goroutine until it ends.
+func (pc *polledConn) readUntilDone() {
+	for pc.reader.readOne() {
+	}
+	pc.finish()
+}
+
+func (pc *polledConn) finish() {
+	pc.poller.forget(pc)
+	pc.mu.Lock()
+	pc.done = true
+	if pc.deadlineTimer != nil {
+		pc.deadlineTimer.Stop()
+	}
+	pc.mu.Unlock()
+	pc.reader.guard.stop()
+	pc.reader.logf(2, "dicom.StateMachine %s: Exiting network reader", pc.reader.smName)
+	pc.stats.goroutineDone()
+}
+
+// Note the read deadline just set on the connection. A zero deadline means
+// none. Safe on a nil polledConn.
+func (pc *polledConn) setDeadline(deadline time.Time) {
+	if pc == nil {
+		return
+	}
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.deadlineTimer != nil {
+		pc.deadlineTimer.Stop()
+		pc.deadlineTimer = nil
+	}
+	if pc.done || deadline.IsZero() {
+		return
+	}
+	pc.deadlineTimer = time.AfterFunc(time.Until(deadline), pc.wake)
+}
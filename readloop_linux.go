@@ -0,0 +1,99 @@
+//go:build linux
+
+package netdicom
+
+import (
+	"sync"
+	"syscall"
+
+	"github.com/antibios/go-dicom/dicomlog"
+)
+
+// epollPoller is the readPoller of Linux. Each connection is registered with
+// EPOLLONESHOT, so it is reported once per arm.
+type epollPoller struct {
+	epfd int
+
+	mu sync.Mutex
+	// The connections registered, by file descriptor. Guarded by mu.
+	conns map[int32]*polledConn
+}
+
+func newReadPoller() (readPoller, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	p := &epollPoller{epfd: epfd, conns: map[int32]*polledConn{}}
+	go p.run()
+	return p, nil
+}
+
+func (p *epollPoller) arm(pc *polledConn) error {
+	ev := syscall.EpollEvent{
+		Events: syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT,
+		Fd:     int32(pc.fd),
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	op := syscall.EPOLL_CTL_MOD
+	if !pc.registered {
+		op = syscall.EPOLL_CTL_ADD
+	}
+	var err error
+	if cerr := pc.rc.Control(func(fd uintptr) {
+		err = syscall.EpollCtl(p.epfd, op, int(fd), &ev)
+	}); cerr != nil {
+		// The connection is closed, and its descriptor left the epoll
+		// set with it.
+		p.drop(pc)
+		return cerr
+	}
+	if err != nil {
+		return err
+	}
+	pc.registered = true
+	p.conns[int32(pc.fd)] = pc
+	return nil
+}
+
+func (p *epollPoller) forget(pc *polledConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// Fails if the connection is closed already, which is fine.
+	pc.rc.Control(func(fd uintptr) { // nolint: errcheck
+		syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_DEL, int(fd), nil) // nolint: errcheck
+	})
+	p.drop(pc)
+}
+
+// Remove pc from p.conns, unless another connection has taken its
+// descriptor number since. Requires p.mu.
+func (p *epollPoller) drop(pc *polledConn) {
+	if p.conns[int32(pc.fd)] == pc {
+		delete(p.conns, int32(pc.fd))
+	}
+}
+
+// Wait for connections to become readable, and wake their readers.
+func (p *epollPoller) run() {
+	events := make([]syscall.EpollEvent, 128)
+	for {
+		n, err := syscall.EpollWait(p.epfd, events, -1)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			// Shouldn't happen. The connections left are woken at
+			// their read deadline, or when their association ends.
+			dicomlog.Vprintf(0, "dicom: shared poller failed: %v", err)
+			return
+		}
+		for _, ev := range events[:n] {
+			p.mu.Lock()
+			pc := p.conns[ev.Fd]
+			p.mu.Unlock()
+			pc.wake()
+		}
+	}
+}
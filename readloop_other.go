@@ -0,0 +1,7 @@
+//go:build !linux
+
+package netdicom
+
+func newReadPoller() (readPoller, error) {
+	return nil, errPollUnsupported
+}
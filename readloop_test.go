@@ -0,0 +1,87 @@
+package netdicom
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/antibios/go-netdicom/sopclass"
+	"github.com/stretchr/testify/require"
+)
+
+func newPolledProvider(t *testing.T, idleTimeout time.Duration) *ServiceProvider {
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		CEcho:       onCEchoRequest,
+		IdleTimeout: idleTimeout,
+		ReadMode:    ReadSharedPoller,
+	}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+	t.Cleanup(func() { sp.Shutdown() }) // nolint: errcheck
+	return sp
+}
+
+// Associations read through the shared poller run side by side.
+func TestReadSharedPoller(t *testing.T) {
+	sp := newPolledProvider(t, 0)
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		go func() {
+			su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.VerificationClasses})
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer su.Release()
+			su.Connect(sp.ListenAddr().String())
+			for j := 0; j < 10; j++ {
+				if err := su.CEcho(); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}()
+	}
+	for i := 0; i < 8; i++ {
+		require.NoError(t, <-errs)
+	}
+	require.Eventually(t, func() bool {
+		return sp.Health().NumAssociations == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// An idle connection has no reader blocked on it, but still times out.
+func TestReadSharedPollerIdleTimeout(t *testing.T) {
+	sp := newPolledProvider(t, 100*time.Millisecond)
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.VerificationClasses})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	require.NoError(t, su.CEcho())
+	require.Eventually(t, func() bool {
+		return sp.Health().DroppedConnections[DropIdleTimeout] == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Error(t, su.CEcho())
+}
+
+// The shared poller refuses a closed connection rather than register its
+// descriptor, which another connection may reuse.
+func TestSharedPollerClosedConn(t *testing.T) {
+	poller, err := sharedPoller()
+	if err != nil {
+		t.Skip(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	conn, err := l.Accept()
+	require.NoError(t, err)
+	rc, fd, err := connFD(conn)
+	require.NoError(t, err)
+	conn.Close()
+	require.Error(t, poller.arm(&polledConn{rc: rc, fd: fd}))
+}
@@ -0,0 +1,143 @@
+package netdicom
+
+// This file implements ServiceProviderParams.ResponseShaping: a mock-PACS mode
+// in which the provider delays its responses, fails chosen requests, or aborts
+// associations at random, so that SCU authors can test their error handling
+// against a real provider.
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/antibios/go-dicom/dicomlog"
+	"github.com/antibios/go-netdicom/dimse"
+)
+
+// ResponseShaping makes a provider misbehave on purpose. Only for testing.
+type ResponseShaping struct {
+	// Rules are tried in order against each request; the first that
+	// matches applies. Requests that match no rule are handled normally.
+	Rules []ResponseRule
+}
+
+// ResponseRule selects requests and says how to answer them. The selectors
+// that are set must all match. A rule without selectors matches every
+// request.
+type ResponseRule struct {
+	// CommandField selects the type of request, e.g.,
+	// dimse.CommandFieldCStoreRq. If zero, any type matches.
+	CommandField int
+
+	// SOPClassUIDs, if non-empty, lists the abstract syntaxes of the
+	// presentation contexts the request may arrive on.
+	SOPClassUIDs []string
+
+	// SOPInstanceUIDs, if non-empty, lists the affected SOP instances of
+	// the C-STORE requests that match. Other requests don't.
+	SOPInstanceUIDs []string
+
+	// Delay is how long to wait before handling the request, and so before
+	// responding.
+	Delay time.Duration
+
+	// Status, if non-nil, is returned in the response instead of calling
+	// the handler. For C-FIND, C-GET and C-MOVE it is the final response;
+	// no pending responses are sent.
+	Status *dimse.Status
+
+	// AbortProbability is the probability, in [0, 1], that the association
+	// is aborted after Delay instead of the request being answered.
+	AbortProbability float64
+}
+
+// Reports whether the rule applies to "msg", which arrived on a context for
+// "sopClassUID".
+func (r *ResponseRule) matches(msg dimse.Message, sopClassUID string) bool {
+	if r.CommandField != 0 && r.CommandField != msg.CommandField() {
+		return false
+	}
+	if len(r.SOPClassUIDs) > 0 && !containsString(r.SOPClassUIDs, sopClassUID) {
+		return false
+	}
+	if len(r.SOPInstanceUIDs) > 0 {
+		c, ok := msg.(*dimse.CStoreRq)
+		if !ok || !containsString(r.SOPInstanceUIDs, c.AffectedSOPInstanceUID) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the rules. NewServiceProvider and SetParams call it; it's
+// exported for config loaders to report errors before that.
+func (s *ResponseShaping) Validate() error {
+	if s == nil {
+		return nil
+	}
+	for i, r := range s.Rules {
+		if r.Delay < 0 {
+			return fmt.Errorf("dicom.serviceProvider: response rule %d: negative delay", i)
+		}
+		if r.AbortProbability < 0 || r.AbortProbability > 1 {
+			return fmt.Errorf("dicom.serviceProvider: response rule %d: abort probability %v out of range [0, 1]", i, r.AbortProbability)
+		}
+	}
+	return nil
+}
+
+// Returns "cb" wrapped so that the rules apply to the requests it handles.
+func (s *ResponseShaping) wrap(cb serviceCallback, clock Clock) serviceCallback {
+	if s == nil || len(s.Rules) == 0 {
+		return cb
+	}
+	return func(msg dimse.Message, data []byte, cs *serviceCommandState) {
+		var rule *ResponseRule
+		for i := range s.Rules {
+			if s.Rules[i].matches(msg, cs.context.abstractSyntaxUID) {
+				rule = &s.Rules[i]
+				break
+			}
+		}
+		if rule == nil {
+			cb(msg, data, cs)
+			return
+		}
+		if rule.Delay > 0 {
+			done := make(chan struct{})
+			timer := clock.AfterFunc(rule.Delay, func() { close(done) })
+			select {
+			case <-done:
+			case <-cs.disp.done:
+				// The association is gone; there is no one to
+				// answer.
+				timer.Stop()
+				cs.disp.discardStream(cs)
+				return
+			}
+		}
+		if rule.AbortProbability > 0 && rand.Float64() < rule.AbortProbability {
+			dicomlog.Vprintf(0, "dicom.serviceDispatcher(%s): Aborting on %v, as the response rules say", cs.disp.label, msg)
+			cs.disp.discardStream(cs)
+			cs.disp.sendDowncall(stateEvent{event: evt15})
+			return
+		}
+		if rule.Status != nil {
+			if resp := failureResponse(msg, *rule.Status); resp != nil {
+				cs.disp.discardStream(cs)
+				cs.sendMessage(resp, nil)
+				return
+			}
+		}
+		cb(msg, data, cs)
+	}
+}
@@ -0,0 +1,206 @@
+package netdicom
+
+// This file implements SCP/SCU role selection negotiation (P3.7 D.3.3.4).
+
+import (
+	"fmt"
+
+	dicomuid "github.com/antibios/dicom/pkg/uid"
+	"github.com/antibios/go-netdicom/dimse"
+	"github.com/antibios/go-netdicom/pdu"
+)
+
+// RoleSelection requests roles for a SOP class in A-ASSOCIATE-RQ. SCU and SCP
+// are the roles the requestor wants to play. Without a role selection, the
+// requestor is an SCU and the acceptor an SCP.
+type RoleSelection struct {
+	SOPClassUID string
+	SCU         bool
+	SCP         bool
+}
+
+// RoleNotGrantedError is returned by a ServiceUser operation that needs a role
+// the provider didn't grant in reply to ServiceUserParams.RoleSelections.
+type RoleNotGrantedError struct {
+	SOPClassUID string
+	// Role is "SCU" or "SCP".
+	Role string
+}
+
+func (e *RoleNotGrantedError) Error() string {
+	return fmt.Sprintf("dicom: %s role for %s was not negotiated",
+		e.Role, dicomuid.UIDString(e.SOPClassUID))
+}
+
+// RoleViolationPolicy selects what to do with a request that the peer isn't
+// allowed to send under the negotiated roles: a request for a SOP class for
+// which the peer gave up the SCU role, or, on a ServiceUser, for which the
+// provider didn't grant the user the SCP role.
+type RoleViolationPolicy int
+
+const (
+	// RoleViolationReject answers the request with status 0x0122
+	// ("Refused: SOP class not supported") without running the handler.
+	// This is the default.
+	RoleViolationReject RoleViolationPolicy = iota
+
+	// RoleViolationAbort aborts the association with A-ABORT.
+	RoleViolationAbort
+
+	// RoleViolationLenient logs the violation and serves the request
+	// anyway.
+	RoleViolationLenient
+)
+
+func validateRoleSelections(roles []RoleSelection) error {
+	seen := map[string]bool{}
+	for _, r := range roles {
+		if r.SOPClassUID == "" {
+			return fmt.Errorf("ServiceUserParams.RoleSelections: empty SOP class UID")
+		}
+		if seen[r.SOPClassUID] {
+			return fmt.Errorf("ServiceUserParams.RoleSelections: duplicate SOP class %s", r.SOPClassUID)
+		}
+		seen[r.SOPClassUID] = true
+	}
+	return nil
+}
+
+func roleByte(b bool) byte {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Build the role selection subitems of A-ASSOCIATE-RQ.
+func (m *contextManager) roleSelectionItems() []pdu.SubItem {
+	var items []pdu.SubItem
+	for _, r := range m.proposedRoles {
+		items = append(items, &pdu.RoleSelectionSubItem{
+			SOPClassUID: r.SOPClassUID,
+			SCURole:     roleByte(r.SCU),
+			SCPRole:     roleByte(r.SCP),
+		})
+	}
+	return items
+}
+
+// Record the roles granted in A-ASSOCIATE-AC. "replies" are its role
+// selection subitems. A role is granted only if it was proposed and accepted.
+// A class the acceptor didn't reply for gets the default roles.
+func (m *contextManager) onRoleSelectionReplies(replies []*pdu.RoleSelectionSubItem) {
+	proposed := map[string]RoleSelection{}
+	m.grantedRoles = map[string]RoleSelection{}
+	for _, r := range m.proposedRoles {
+		proposed[r.SOPClassUID] = r
+		m.grantedRoles[r.SOPClassUID] = RoleSelection{SOPClassUID: r.SOPClassUID, SCU: true}
+	}
+	for _, reply := range replies {
+		r, ok := proposed[reply.SOPClassUID]
+		if !ok {
+			continue
+		}
+		m.grantedRoles[r.SOPClassUID] = RoleSelection{
+			SOPClassUID: r.SOPClassUID,
+			SCU:         r.SCU && reply.SCURole == 1,
+			SCP:         r.SCP && reply.SCPRole == 1,
+		}
+	}
+}
+
+// Check that the local side may act as SCP (if "scp") or SCU for the class.
+// Roles are enforced only for the classes listed in
+// ServiceUserParams.RoleSelections.
+func (m *contextManager) checkRole(sopClassUID string, scp bool) error {
+	granted, ok := m.grantedRoles[sopClassUID]
+	if !ok {
+		return nil
+	}
+	if scp && !granted.SCP {
+		return &RoleNotGrantedError{SOPClassUID: sopClassUID, Role: "SCP"}
+	}
+	if !scp && !granted.SCU {
+		return &RoleNotGrantedError{SOPClassUID: sopClassUID, Role: "SCU"}
+	}
+	return nil
+}
+
+// Check that C-GET can receive its C-STORE sub-operations: if SCP roles were
+// requested, at least one must have been granted.
+func (m *contextManager) checkCGetRoles() error {
+	var firstRequested string
+	for _, r := range m.proposedRoles {
+		if !r.SCP {
+			continue
+		}
+		if m.grantedRoles[r.SOPClassUID].SCP {
+			return nil
+		}
+		if firstRequested == "" {
+			firstRequested = r.SOPClassUID
+		}
+	}
+	if firstRequested != "" {
+		return &RoleNotGrantedError{SOPClassUID: firstRequested, Role: "SCP"}
+	}
+	return nil
+}
+
+// Check that the peer may send requests for the SOP class. On the provider
+// side, the peer must not have given up the SCU role; on the user side, the
+// user must have been granted the SCP role. Classes without role selection
+// have the default roles.
+func (m *contextManager) checkPeerMayInvoke(sopClassUID string) error {
+	if r, ok := m.peerRoles[sopClassUID]; ok && !r.SCU {
+		return &RoleNotGrantedError{SOPClassUID: sopClassUID, Role: "SCU"}
+	}
+	return m.checkRole(sopClassUID, true)
+}
+
+// Apply disp.rolePolicy to a message starting a new command. Returns true if
+// the message was dealt with, i.e., rejected or the association aborted.
+func (disp *serviceDispatcher) rejectRoleViolation(msg dimse.Message, context contextManagerEntry, cs *serviceCommandState) bool {
+	resp := failureResponse(msg, dimse.Status{Status: dimse.CStoreRefusedSOPClassNotSupported})
+	if resp == nil {
+		// Not a request.
+		return false
+	}
+	err := cs.cm.checkPeerMayInvoke(context.abstractSyntaxUID)
+	if err == nil {
+		return false
+	}
+	switch disp.rolePolicy {
+	case RoleViolationLenient:
+		disp.logf(0, "dicom.serviceDispatcher(%s): Serving %v despite role violation: %v", disp.label, msg, err)
+		return false
+	case RoleViolationAbort:
+		disp.logf(0, "dicom.serviceDispatcher(%s): %v in %v; aborting", disp.label, err, msg)
+		disp.sendDowncall(stateEvent{event: evt15})
+		return true
+	}
+	disp.logf(0, "dicom.serviceDispatcher(%s): %v in %v; rejecting", disp.label, err, msg)
+	cs.sendMessage(resp, nil)
+	return true
+}
+
+// Build the replies to the role selection subitems of A-ASSOCIATE-RQ. The
+// provider accepts the roles as proposed: it serves every class as SCP, and
+// sends C-STOREs to the requestor for C-GET.
+func (m *contextManager) acceptRoleSelections(requests []*pdu.RoleSelectionSubItem) []pdu.SubItem {
+	var replies []pdu.SubItem
+	m.peerRoles = map[string]RoleSelection{}
+	for _, r := range requests {
+		m.peerRoles[r.SOPClassUID] = RoleSelection{
+			SOPClassUID: r.SOPClassUID,
+			SCU:         r.SCURole == 1,
+			SCP:         r.SCPRole == 1,
+		}
+		replies = append(replies, &pdu.RoleSelectionSubItem{
+			SOPClassUID: r.SOPClassUID,
+			SCURole:     r.SCURole,
+			SCPRole:     r.SCPRole,
+		})
+	}
+	return replies
+}
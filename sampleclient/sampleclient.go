@@ -2,12 +2,15 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log"
 	"os"
 
 	"github.com/antibios/dicom"
 	dicomtag "github.com/antibios/dicom/pkg/tag"
+	"github.com/antibios/go-dicom/dicomlog"
 	"github.com/antibios/go-netdicom"
 	"github.com/antibios/go-netdicom/dimse"
 	"github.com/antibios/go-netdicom/sopclass"
@@ -22,6 +25,12 @@ var (
 	getFlag           = flag.Bool("get", false, "Issue a C-GET.")
 	seriesFlag        = flag.String("series", "", "Study series UID to retrieve in C-{FIND,GET}.")
 	studyFlag         = flag.String("study", "", "Study instance UID to retrieve in C-{FIND,GET}.")
+	debugFlag         = flag.Bool("debug", false, "Log an annotated hex dump of every PDU and DIMSE command set exchanged.")
+	assocBenchFlag    = flag.Int("assoc-bench", 0, "If positive, set up and release this many associations, with no DIMSE message, and print the latency percentiles.")
+	assocIntervalFlag = flag.Duration("assoc-interval", 0, "Pause between the associations of -assoc-bench.")
+	verifyStudyFlag   = flag.String("verify-study", "", "If set, compare the instances of this study on -server and on -verify-target.")
+	verifyTargetFlag  = flag.String("verify-target", "", "host:port of the AE checked by -verify-study.")
+	verifyTargetAE    = flag.String("verify-target-ae-title", "", "AE title of the AE checked by -verify-study.")
 )
 
 func newServiceUser(sopClasses []string) *netdicom.ServiceUser {
@@ -120,15 +129,64 @@ func cFind() {
 	}
 }
 
+func assocBench() {
+	report, err := netdicom.BenchmarkAssociations(context.Background(), netdicom.AssociationBenchParams{
+		Address:  *serverFlag,
+		Count:    *assocBenchFlag,
+		Interval: *assocIntervalFlag,
+		ServiceUser: netdicom.ServiceUserParams{
+			CalledAETitle:  *remoteAETitleFlag,
+			CallingAETitle: *aeTitleFlag,
+		},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, err := range report.Errors {
+		log.Printf("Association failed: %v", err)
+	}
+	fmt.Print(report)
+}
+
+func verifyStudy() {
+	c, err := netdicom.VerifyStudy(context.Background(), netdicom.StudyVerifyParams{
+		SourceAETitle: *remoteAETitleFlag,
+		SourceAddress: *serverFlag,
+		TargetAETitle: *verifyTargetAE,
+		TargetAddress: *verifyTargetFlag,
+		ServiceUser:   netdicom.ServiceUserParams{CallingAETitle: *aeTitleFlag},
+	}, *verifyStudyFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(c)
+	for _, uid := range c.Missing {
+		fmt.Printf("missing %s\n", uid)
+	}
+	for _, uid := range c.Extra {
+		fmt.Printf("extra %s\n", uid)
+	}
+	if !c.Match() {
+		os.Exit(1)
+	}
+}
+
 func main() {
 	flag.Parse()
-	if *storeFlag != "" {
+	if *debugFlag {
+		dicomlog.SetLevel(netdicom.HexDumpLogLevel)
+	}
+	if *assocBenchFlag > 0 {
+		assocBench()
+	} else if *verifyStudyFlag != "" {
+		verifyStudy()
+	} else if *storeFlag != "" {
 		cStore(*storeFlag)
 	} else if *findFlag {
 		cFind()
 	} else if *getFlag {
 		cGet()
 	} else {
-		log.Panic("Either -store, -get, or -find must be set")
+		log.Panic("Either -store, -get, -find, -assoc-bench, or -verify-study must be set")
 	}
 }
@@ -0,0 +1,92 @@
+package main
+
+// Crash-consistent storage of files received by C-STORE. An object is written
+// to a temporary file next to its final path, synced, and renamed into place,
+// so that a crash never leaves a truncated file under a name that C-FIND and
+// C-GET would serve. The temporary files left by a crash are removed on the
+// next start.
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Suffix of the temporary file an object is written to.
+const tempSuffix = ".part"
+
+// Reports whether "path" is a temporary file, as opposed to a stored object.
+func isTempFile(path string) bool {
+	return strings.HasSuffix(path, tempSuffix)
+}
+
+// Remove the temporary files under "dir", left by writes that a crash
+// interrupted. A write whose rename went through is complete, since the data
+// is synced before the rename. Must be called before the server starts
+// writing to "dir".
+func removeTempFiles(dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.Mode().IsRegular() && isTempFile(path) {
+			log.Printf("%s: removing partial file", path)
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Create "path" with the data produced by "write". Either "path" ends up
+// holding all of it, or it is left as it was. Safe to call concurrently for
+// distinct paths.
+func storeAtomically(path string, write func(w io.Writer) error) error {
+	temp := path + tempSuffix
+	err := writeSynced(temp, write)
+	if err == nil {
+		err = os.Rename(temp, path)
+	}
+	if err == nil {
+		err = syncDir(filepath.Dir(path))
+	}
+	if err != nil {
+		os.Remove(temp)
+	}
+	return err
+}
+
+// Create "path", fill it with "write", and sync it to disk.
+func writeSynced(path string, write func(w io.Writer) error) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = write(out)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Sync the directory entries of "dir", making a rename in it durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
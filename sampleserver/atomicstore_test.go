@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// The temporary files of interrupted writes are removed on start, and stored
+// objects are kept.
+func TestRemoveTempFiles(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "sub"), 0755))
+	stored := filepath.Join(dir, "image0001.dcm")
+	partial := filepath.Join(dir, "sub", "image0002.dcm"+tempSuffix)
+	require.NoError(t, os.WriteFile(stored, []byte("stored"), 0644))
+	require.NoError(t, os.WriteFile(partial, []byte("part"), 0644))
+
+	require.NoError(t, removeTempFiles(dir))
+	require.FileExists(t, stored)
+	require.NoFileExists(t, partial)
+	require.NoError(t, removeTempFiles(filepath.Join(dir, "missing")))
+}
+
+// A failed write leaves neither the object nor its temporary file.
+func TestStoreAtomically(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "image0001.dcm")
+	require.NoError(t, storeAtomically(path, func(w io.Writer) error {
+		_, err := w.Write([]byte("object"))
+		return err
+	}))
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "object", string(data))
+
+	path = filepath.Join(dir, "image0002.dcm")
+	err = storeAtomically(path, func(w io.Writer) error {
+		w.Write([]byte("obj")) // nolint: errcheck
+		return errors.New("peer went away")
+	})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "peer went away")
+	require.NoFileExists(t, path)
+	require.NoFileExists(t, path+tempSuffix)
+}
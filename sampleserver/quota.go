@@ -0,0 +1,173 @@
+package main
+
+// Quota and disk-watermark management for files received by C-STORE.
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/antibios/go-netdicom/dimse"
+)
+
+// storedFile is a file created by C-STORE.
+type storedFile struct {
+	path string
+	size int64
+}
+
+// evictionPolicy is called when storing a new object of "size" bytes would
+// exceed a limit. "files" lists the stored files, oldest first. It returns the
+// candidates for deletion in the order they should go; they are deleted one at
+// a time until the object fits. If the object still doesn't fit, it is
+// refused.
+type evictionPolicy func(files []storedFile, size int64) []storedFile
+
+// evictionPolicies lists the values accepted by the -evict flag.
+var evictionPolicies = map[string]evictionPolicy{
+	"none":   evictNone,
+	"oldest": evictOldest,
+}
+
+// Never delete anything.
+func evictNone(files []storedFile, size int64) []storedFile {
+	return nil
+}
+
+// Delete the oldest files first.
+func evictOldest(files []storedFile, size int64) []storedFile {
+	return files
+}
+
+// storageQuota tracks the files stored under a directory, and refuses new
+// objects once a limit is reached. Thread compatible; the server guards it
+// with server.mu.
+type storageQuota struct {
+	dir string
+
+	// Limits. Zero means unlimited.
+	maxBytes     int64 // total size of stored files
+	maxInstances int   // number of stored files
+	minFreeBytes int64 // free space that must remain on the filesystem
+
+	evict evictionPolicy
+
+	files []storedFile // oldest first
+	bytes int64        // sum of files[].size
+}
+
+// Create a quota for "dir", accounting for the files already in it.
+func newStorageQuota(dir string, maxBytes int64, maxInstances int, minFreeBytes int64, evict evictionPolicy) (*storageQuota, error) {
+	q := &storageQuota{
+		dir:          dir,
+		maxBytes:     maxBytes,
+		maxInstances: maxInstances,
+		minFreeBytes: minFreeBytes,
+		evict:        evict,
+	}
+	if minFreeBytes > 0 {
+		// Fail now, rather than at each C-STORE, if the free space
+		// can't be known on this platform.
+		if _, err := diskFreeBytes(dir); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	var modTimes []int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.Mode().IsRegular() && !isTempFile(path) {
+			q.files = append(q.files, storedFile{path: path, size: info.Size()})
+			modTimes = append(modTimes, info.ModTime().UnixNano())
+			q.bytes += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(byModTime{q.files, modTimes})
+	log.Printf("%s: %d files, %d bytes in storage", dir, len(q.files), q.bytes)
+	return q, nil
+}
+
+type byModTime struct {
+	files    []storedFile
+	modTimes []int64
+}
+
+func (s byModTime) Len() int           { return len(s.files) }
+func (s byModTime) Less(i, j int) bool { return s.modTimes[i] < s.modTimes[j] }
+func (s byModTime) Swap(i, j int) {
+	s.files[i], s.files[j] = s.files[j], s.files[i]
+	s.modTimes[i], s.modTimes[j] = s.modTimes[j], s.modTimes[i]
+}
+
+// Returns a non-nil error if storing "size" more bytes would exceed a limit.
+func (q *storageQuota) check(size int64) error {
+	if q.maxInstances > 0 && len(q.files)+1 > q.maxInstances {
+		return fmt.Errorf("instance quota of %d exceeded", q.maxInstances)
+	}
+	if q.maxBytes > 0 && q.bytes+size > q.maxBytes {
+		return fmt.Errorf("byte quota of %d exceeded", q.maxBytes)
+	}
+	if q.minFreeBytes > 0 {
+		free, err := diskFreeBytes(q.dir)
+		if err != nil {
+			return err
+		}
+		if free-size < q.minFreeBytes {
+			return fmt.Errorf("free space %d below watermark %d", free-size, q.minFreeBytes)
+		}
+	}
+	return nil
+}
+
+// Make room for an object of "size" bytes, evicting files if the policy
+// allows. Returns dimse.Success, or a refusal status if the object doesn't
+// fit. "size" is zero when the size is not known yet.
+func (q *storageQuota) reserve(size int64, onEvict func(path string)) dimse.Status {
+	err := q.check(size)
+	if err == nil {
+		return dimse.Success
+	}
+	// Copy the list, since q.remove modifies q.files.
+	candidates := q.evict(append([]storedFile(nil), q.files...), size)
+	for _, f := range candidates {
+		if rmErr := os.Remove(f.path); rmErr != nil && !os.IsNotExist(rmErr) {
+			log.Printf("%s: evict: %v", f.path, rmErr)
+			break
+		}
+		log.Printf("%s: evicted to make room", f.path)
+		q.remove(f.path)
+		onEvict(f.path)
+		if err = q.check(size); err == nil {
+			return dimse.Success
+		}
+	}
+	log.Printf("C-STORE: refusing %d-byte object: %v", size, err)
+	return dimse.Status{Status: dimse.CStoreOutOfResources, ErrorComment: err.Error()}
+}
+
+// Record a newly stored file. It replaces an existing file of the same path.
+func (q *storageQuota) add(path string, size int64) {
+	q.remove(path)
+	q.files = append(q.files, storedFile{path: path, size: size})
+	q.bytes += size
+}
+
+func (q *storageQuota) remove(path string) {
+	for i, f := range q.files {
+		if f.path == path {
+			q.files = append(q.files[:i], q.files[i+1:]...)
+			q.bytes -= f.size
+			return
+		}
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !(aix || darwin || dragonfly || freebsd || linux)
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// The free space on a filesystem isn't known on this platform.
+func diskFreeBytes(dir string) (int64, error) {
+	return 0, fmt.Errorf("free disk space is not supported on %s", runtime.GOOS)
+}
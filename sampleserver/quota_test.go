@@ -0,0 +1,108 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/antibios/go-netdicom/dimse"
+	"github.com/stretchr/testify/require"
+)
+
+// Creates "name" under "dir" with "size" bytes, modified "age" ago.
+func writeStoredFile(t *testing.T, dir, name string, size int, age time.Duration) string {
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, make([]byte, size), 0644))
+	modTime := time.Now().Add(-age)
+	require.NoError(t, os.Chtimes(path, modTime, modTime))
+	return path
+}
+
+// An object that doesn't fit is refused with A700 when nothing may be
+// evicted; one that fits exactly is accepted.
+func TestQuotaRefusal(t *testing.T) {
+	dir := t.TempDir()
+	writeStoredFile(t, dir, "a.dcm", 60, time.Hour)
+	writeStoredFile(t, dir, "b.dcm", 30, time.Minute)
+
+	q, err := newStorageQuota(dir, 100, 0, 0, evictNone)
+	require.NoError(t, err)
+	require.Len(t, q.files, 2)
+	require.Equal(t, int64(90), q.bytes)
+	onEvict := func(path string) { t.Errorf("evicted %s", path) }
+
+	require.Equal(t, dimse.Success, q.reserve(10, onEvict))
+	status := q.reserve(11, onEvict)
+	require.Equal(t, dimse.CStoreOutOfResources, status.Status)
+	require.Contains(t, status.ErrorComment, "byte quota of 100 exceeded")
+
+	q, err = newStorageQuota(dir, 0, 2, 0, evictNone)
+	require.NoError(t, err)
+	status = q.reserve(0, onEvict)
+	require.Equal(t, dimse.CStoreOutOfResources, status.Status)
+	require.Contains(t, status.ErrorComment, "instance quota of 2 exceeded")
+	require.FileExists(t, filepath.Join(dir, "a.dcm"))
+	require.FileExists(t, filepath.Join(dir, "b.dcm"))
+}
+
+// Files are evicted oldest first, by modification time, and only until the
+// object fits.
+func TestQuotaEvictionOrder(t *testing.T) {
+	dir := t.TempDir()
+	newest := writeStoredFile(t, dir, "a.dcm", 40, time.Minute)
+	oldest := writeStoredFile(t, dir, "b.dcm", 40, 3*time.Hour)
+	middle := writeStoredFile(t, dir, "c.dcm", 40, 2*time.Hour)
+
+	q, err := newStorageQuota(dir, 150, 0, 0, evictOldest)
+	require.NoError(t, err)
+	var evicted []string
+	onEvict := func(path string) { evicted = append(evicted, path) }
+
+	require.Equal(t, dimse.Success, q.reserve(80, onEvict))
+	require.Equal(t, []string{oldest, middle}, evicted)
+	require.NoFileExists(t, oldest)
+	require.NoFileExists(t, middle)
+	require.FileExists(t, newest)
+	require.Equal(t, []storedFile{{path: newest, size: 40}}, q.files)
+	require.Equal(t, int64(40), q.bytes)
+
+	// An object larger than the quota is refused, after evicting
+	// everything.
+	evicted = nil
+	status := q.reserve(151, onEvict)
+	require.Equal(t, dimse.CStoreOutOfResources, status.Status)
+	require.Equal(t, []string{newest}, evicted)
+	require.Empty(t, q.files)
+	require.Equal(t, int64(0), q.bytes)
+}
+
+// Removing a file returns its bytes and its instance to the quota, and
+// re-adding a path replaces it rather than counting it twice.
+func TestQuotaAccountingAfterDelete(t *testing.T) {
+	dir := t.TempDir()
+	q, err := newStorageQuota(dir, 100, 2, 0, evictNone)
+	require.NoError(t, err)
+	onEvict := func(path string) { t.Errorf("evicted %s", path) }
+
+	a := filepath.Join(dir, "a.dcm")
+	b := filepath.Join(dir, "b.dcm")
+	q.add(a, 50)
+	q.add(b, 50)
+	require.Equal(t, dimse.CStoreOutOfResources, q.reserve(1, onEvict).Status)
+
+	q.remove(a)
+	require.Equal(t, int64(50), q.bytes)
+	require.Equal(t, []storedFile{{path: b, size: 50}}, q.files)
+	require.Equal(t, dimse.Success, q.reserve(50, onEvict))
+	require.Equal(t, dimse.CStoreOutOfResources, q.reserve(51, onEvict).Status)
+
+	q.add(b, 20)
+	require.Equal(t, int64(20), q.bytes)
+	require.Len(t, q.files, 1)
+
+	// Removing an unknown path changes nothing.
+	q.remove(a)
+	require.Equal(t, int64(20), q.bytes)
+	require.Len(t, q.files, 1)
+}
@@ -0,0 +1,18 @@
+//go:build aix || darwin || dragonfly || freebsd || linux
+
+package main
+
+// syscall.Statfs, with Bavail and Bsize, exists on these systems only; other
+// Unix systems have Statvfs, or name the fields differently.
+
+import "syscall"
+
+// Returns the number of bytes available to unprivileged users on the
+// filesystem that holds "dir".
+func diskFreeBytes(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
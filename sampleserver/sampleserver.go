@@ -9,9 +9,9 @@ package main
 import (
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/binary"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
@@ -22,7 +22,6 @@ import (
 	"sync"
 
 	"github.com/antibios/dicom"
-	"github.com/antibios/dicom/pkg/tag"
 	dicomuid "github.com/antibios/dicom/pkg/uid"
 	"github.com/antibios/go-dicom/dicomlog"
 	"github.com/antibios/go-netdicom"
@@ -46,6 +45,17 @@ If empty, use <dir>/incoming, where <dir> is the value of the -dir flag.`)
 	tlsKeyFlag  = flag.String("tls-key", "", "Sets the private key file. If empty, TLS is disabled.")
 	tlsCertFlag = flag.String("tls-cert", "", "File containing TLS cert to be presented to the peer.")
 	tlsCAFlag   = flag.String("tls-ca", "", "Optional file containing certs to match against what peers present.")
+
+	maxBytesFlag     = flag.Int64("max-bytes", 0, "Maximum total size of files stored by C-STORE. If zero, unlimited.")
+	maxInstancesFlag = flag.Int("max-instances", 0, "Maximum number of files stored by C-STORE. If zero, unlimited.")
+	minFreeBytesFlag = flag.Int64("min-free-bytes", 0, "C-STORE is refused when the free space on the output filesystem would fall below this value. If zero, unlimited.")
+	evictFlag        = flag.String("evict", "none", `
+What to do when a quota is exceeded. "none" refuses new objects with status
+A700 (out of resources); "oldest" deletes the oldest stored files to make room.`)
+
+	promiscuousFlag   = flag.Bool("promiscuous", false, "Accept any abstract syntax proposed by the peer, including private SOP classes, even with -reject_unknown_sop_classes.")
+	rejectUnknownFlag = flag.Bool("reject_unknown_sop_classes", false, "Accept only the SOP classes listed in the sopclass package.")
+	debugFlag         = flag.Bool("debug", false, "Log an annotated hex dump of every PDU and DIMSE command set exchanged.")
 )
 
 type server struct {
@@ -57,6 +67,22 @@ type server struct {
 
 	// For generating new unique path in C-STORE. Guarded by mu.
 	pathSeq int32
+
+	// Limits the space used by C-STORE. Guarded by mu.
+	quota *storageQuota
+}
+
+// Called before the data of a C-STORE request arrives. Refuses the object if
+// the storage is already full.
+func (ss *server) onCStoreAdmit() dimse.Status {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.quota.reserve(0, ss.forgetFile)
+}
+
+// Drop an evicted file from ss.datasets. Requires ss.mu.
+func (ss *server) forgetFile(path string) {
+	delete(ss.datasets, path)
 }
 
 func (ss *server) onCStore(
@@ -68,63 +94,29 @@ func (ss *server) onCStore(
 	data []byte) dimse.Status {
 	fmt.Printf("Called %s\t Calling %s\n", calledAETitle, callingAETitle)
 	ss.mu.Lock()
-	defer ss.mu.Unlock()
+	if status := ss.quota.reserve(int64(len(data)), ss.forgetFile); status.Status != dimse.StatusSuccess {
+		ss.mu.Unlock()
+		return status
+	}
 	ss.pathSeq++
 	path := path.Join(*outputFlag, fmt.Sprintf("image%04d.dcm", ss.pathSeq))
-	out, err := os.Create(path)
-	if err != nil {
-		dirPath := filepath.Dir(path)
-		err := os.MkdirAll(dirPath, 0755)
-		if err != nil {
-			return dimse.Status{Status: dimse.StatusNotAuthorized, ErrorComment: err.Error()}
-		}
-		out, err = os.Create(path)
-		if err != nil {
-			log.Printf("%s: create: %v", path, err)
-			return dimse.Status{Status: dimse.StatusNotAuthorized, ErrorComment: err.Error()}
-		}
-	}
-	defer func() {
-		if out != nil {
-			out.Close()
-		}
-	}()
-	/* 	e := dicomio.NewWriter(out, binary.LittleEndian, false)
-	   	//e := dicomio.NewEncoderWithTransferSyntax(out, transferSyntaxUID)
-	   	for _, elem := range []*dicom.Element{
-	   		dicom.MustNewElement(tag.TransferSyntaxUID, transferSyntaxUID),
-	   		dicom.MustNewElement(tag.MediaStorageSOPClassUID, sopClassUID),
-	   		dicom.MustNewElement(tag.MediaStorageSOPInstanceUID, sopInstanceUID),
-	   	} {
-	   		//e.WriteElement(elem)
-	   		//out.Write(elem.)
-	   		e.WriteBytes([]byte(elem.RawValueRepresentation))
+	// Count the object against the quota while it is written, outside
+	// the lock.
+	ss.quota.add(path, int64(len(data)))
+	ss.mu.Unlock()
 
-	   	} */
-	//err = e.WriteBytes(data)
-	e := dicom.NewWriter(out, dicom.DefaultMissingTransferSyntax())
-	e.SetTransferSyntax(binary.LittleEndian, true)
-	header := dicom.Dataset{
-		Elements: []*dicom.Element{
-			dicom.MustNewElement(tag.TransferSyntaxUID, transferSyntaxUID),
-			dicom.MustNewElement(tag.MediaStorageSOPClassUID, sopClassUID),
-			dicom.MustNewElement(tag.MediaStorageSOPInstanceUID, sopInstanceUID),
-		}}
-	//e.WriteElement()
-	err = e.WriteDataset(&header)
+	err := storeAtomically(path, func(out io.Writer) error {
+		return netdicom.WritePart10(out, transferSyntaxUID, sopClassUID, sopInstanceUID, callingAETitle, data)
+	})
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
 	if err != nil {
-		log.Printf("%s: write: %v", path, err)
+		ss.quota.remove(path)
+		log.Printf("%s: store: %v", path, err)
 		return dimse.Status{Status: dimse.StatusNotAuthorized, ErrorComment: err.Error()}
 	}
-
-	//TODO write bytes to output file:
-	err = e.WriteBytes(data)
-
-	err = out.Close()
-	out = nil
-	if err != nil {
-		log.Printf("%s: close %s", path, err)
-		return dimse.Status{Status: dimse.StatusNotAuthorized, ErrorComment: err.Error()}
+	if info, err := os.Stat(path); err == nil {
+		ss.quota.add(path, info.Size())
 	}
 	log.Printf("C-STORE: Created %v", path)
 	// Register the new file in ss.datasets.
@@ -337,9 +329,24 @@ func main() {
 	if err != nil {
 		log.Panicf("Failed to list DICOM files in %s: %v", *dirFlag, err)
 	}
+	evict, ok := evictionPolicies[*evictFlag]
+	if !ok {
+		log.Panicf("Unknown -evict policy '%s'", *evictFlag)
+	}
+	if err := os.MkdirAll(*outputFlag, 0755); err != nil {
+		log.Panicf("Failed to create %s: %v", *outputFlag, err)
+	}
+	if err := removeTempFiles(*outputFlag); err != nil {
+		log.Panicf("Failed to recover %s: %v", *outputFlag, err)
+	}
+	quota, err := newStorageQuota(*outputFlag, *maxBytesFlag, *maxInstancesFlag, *minFreeBytesFlag, evict)
+	if err != nil {
+		log.Panicf("Failed to list files in %s: %v", *outputFlag, err)
+	}
 	ss := server{
 		mu:       &sync.Mutex{},
 		datasets: datasets,
+		quota:    quota,
 	}
 	log.Printf("Listening on %s", port)
 
@@ -364,8 +371,10 @@ func main() {
 	}
 
 	params := netdicom.ServiceProviderParams{
-		AETitle:   *aeFlag,
-		RemoteAEs: remoteAEs,
+		AETitle:                 *aeFlag,
+		RemoteAEs:               remoteAEs,
+		Promiscuous:             *promiscuousFlag,
+		RejectUnknownSOPClasses: *rejectUnknownFlag,
 		CEcho: func(connState netdicom.ConnectionState) dimse.Status {
 			log.Printf("Received C-ECHO")
 			return dimse.Success
@@ -382,6 +391,9 @@ func main() {
 			filter []*dicom.Element, ch chan netdicom.CMoveResult) {
 			ss.onCMoveOrCGet(transferSyntaxUID, sopClassUID, filter, ch)
 		},
+		CStoreAdmit: func(connState netdicom.ConnectionState, callingAETitle, sopClassUID, sopInstanceUID string) dimse.Status {
+			return ss.onCStoreAdmit()
+		},
 		CStore: func(connState netdicom.ConnectionState, transferSyntaxUID string,
 			sopClassUID string,
 			sopInstanceUID string,
@@ -393,6 +405,9 @@ func main() {
 		TLSConfig: tlsConfig,
 	}
 	dicomlog.SetLevel(2)
+	if *debugFlag {
+		dicomlog.SetLevel(netdicom.HexDumpLogLevel)
+	}
 	sp, err := netdicom.NewServiceProvider(params, port)
 	if err != nil {
 		panic(err)
@@ -0,0 +1,237 @@
+package netdicom
+
+// This file implements TransferScheduler: ordering outbound C-STOREs by
+// priority, e.g., so that stat studies overtake a batch migration.
+
+import (
+	"container/heap"
+	"errors"
+	"sync"
+)
+
+// TransferPriority ranks the transfers queued in a TransferScheduler. Higher
+// priorities are sent first. Rules may return values other than the
+// constants below for a finer ranking.
+type TransferPriority int
+
+const (
+	TransferPriorityLow TransferPriority = iota
+	TransferPriorityMedium
+	TransferPriorityHigh
+)
+
+// TransferPriorityFromDIMSE maps the Priority field of a DIMSE request (P3.7
+// C.4.2.1.4: 0 medium, 1 high, 2 low) to a TransferPriority. Unknown values
+// map to TransferPriorityMedium.
+func TransferPriorityFromDIMSE(priority int) TransferPriority {
+	switch priority {
+	case 1:
+		return TransferPriorityHigh
+	case 2:
+		return TransferPriorityLow
+	}
+	return TransferPriorityMedium
+}
+
+// Transfer describes an instance submitted to a TransferScheduler. Fields that
+// aren't known are empty.
+type Transfer struct {
+	SOPClassUID      string
+	SOPInstanceUID   string
+	StudyInstanceUID string
+	// CallingAETitle is the peer of the association the instance arrived on.
+	CallingAETitle string
+	// DIMSEPriority is the Priority field of the C-STORE request the instance
+	// arrived with, or 0 (medium).
+	DIMSEPriority int
+}
+
+// TransferPriorityRule returns the priority of "t", and true, if the rule
+// applies to it, e.g., to send a modality's studies first, or to send a
+// migration source's last.
+type TransferPriorityRule func(t Transfer) (TransferPriority, bool)
+
+// TransferSchedulerParams configures a TransferScheduler.
+type TransferSchedulerParams struct {
+	// Rules are tried in order; the first that applies sets the priority of
+	// a transfer. If none applies, the priority is derived from
+	// Transfer.DIMSEPriority. SetStudyPriority overrides the rules.
+	Rules []TransferPriorityRule
+
+	// Concurrency is the number of transfers sent at once. If zero, they
+	// are sent one at a time.
+	Concurrency int
+}
+
+// Returned by TransferScheduler.Do once the scheduler is closed.
+var errSchedulerClosed = errors.New("dicom.TransferScheduler: closed")
+
+// TransferScheduler sends instances in order of priority, and in submission
+// order within a priority. Priorities take effect between instances: a
+// transfer that has started is never interrupted, but the next one to start
+// is the most urgent queued. It can be shared by the forwarders of any number
+// of associations, with NewScheduledCStoreForwarder, and by bulk senders.
+type TransferScheduler struct {
+	params TransferSchedulerParams
+	wg     sync.WaitGroup
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  transferQueue
+	seq    uint64
+	closed bool
+	// Priorities set by SetStudyPriority, keyed by study instance UID.
+	studies map[string]TransferPriority
+}
+
+type queuedTransfer struct {
+	transfer Transfer
+	priority TransferPriority
+	seq      uint64 // submission order
+	index    int    // in transferQueue
+	send     func() error
+	done     chan error
+}
+
+// NewTransferScheduler creates a scheduler and starts its workers. Call Close
+// to stop them.
+func NewTransferScheduler(params TransferSchedulerParams) *TransferScheduler {
+	s := &TransferScheduler{params: params, studies: map[string]TransferPriority{}}
+	s.cond = sync.NewCond(&s.mu)
+	n := params.Concurrency
+	if n <= 0 {
+		n = 1
+	}
+	s.wg.Add(n)
+	for i := 0; i < n; i++ {
+		go s.run()
+	}
+	return s
+}
+
+// Do queues "send", which sends the instance described by "t", and waits until
+// it has run. It returns the error from "send", or an error if the scheduler
+// is closed before "send" starts.
+func (s *TransferScheduler) Do(t Transfer, send func() error) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return errSchedulerClosed
+	}
+	q := &queuedTransfer{
+		transfer: t,
+		priority: s.priorityLocked(t),
+		seq:      s.seq,
+		send:     send,
+		done:     make(chan error, 1),
+	}
+	s.seq++
+	heap.Push(&s.queue, q)
+	s.cond.Signal()
+	s.mu.Unlock()
+	return <-q.done
+}
+
+// SetStudyPriority sets the priority of the instances of a study, overriding
+// the rules, e.g., when a study is flagged stat. It applies to the instances
+// already queued too.
+func (s *TransferScheduler) SetStudyPriority(studyInstanceUID string, priority TransferPriority) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.studies[studyInstanceUID] = priority
+	for _, q := range s.queue {
+		if q.transfer.StudyInstanceUID == studyInstanceUID {
+			q.priority = priority
+			heap.Fix(&s.queue, q.index)
+		}
+	}
+}
+
+// ClearStudyPriority undoes SetStudyPriority for new submissions.
+func (s *TransferScheduler) ClearStudyPriority(studyInstanceUID string) {
+	s.mu.Lock()
+	delete(s.studies, studyInstanceUID)
+	s.mu.Unlock()
+}
+
+// Queued returns the number of transfers waiting to start.
+func (s *TransferScheduler) Queued() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.queue)
+}
+
+// Close fails the transfers still queued, and waits for those running to
+// finish.
+func (s *TransferScheduler) Close() {
+	s.mu.Lock()
+	s.closed = true
+	for len(s.queue) > 0 {
+		heap.Pop(&s.queue).(*queuedTransfer).done <- errSchedulerClosed
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *TransferScheduler) priorityLocked(t Transfer) TransferPriority {
+	if t.StudyInstanceUID != "" {
+		if p, ok := s.studies[t.StudyInstanceUID]; ok {
+			return p
+		}
+	}
+	for _, rule := range s.params.Rules {
+		if p, ok := rule(t); ok {
+			return p
+		}
+	}
+	return TransferPriorityFromDIMSE(t.DIMSEPriority)
+}
+
+func (s *TransferScheduler) run() {
+	defer s.wg.Done()
+	for {
+		s.mu.Lock()
+		for len(s.queue) == 0 && !s.closed {
+			s.cond.Wait()
+		}
+		if s.closed {
+			s.mu.Unlock()
+			return
+		}
+		q := heap.Pop(&s.queue).(*queuedTransfer)
+		s.mu.Unlock()
+		q.done <- q.send()
+	}
+}
+
+// transferQueue is a heap of queued transfers, most urgent first.
+type transferQueue []*queuedTransfer
+
+func (h transferQueue) Len() int { return len(h) }
+
+func (h transferQueue) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h transferQueue) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *transferQueue) Push(x interface{}) {
+	q := x.(*queuedTransfer)
+	q.index = len(*h)
+	*h = append(*h, q)
+}
+
+func (h *transferQueue) Pop() interface{} {
+	old := *h
+	q := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return q
+}
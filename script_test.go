@@ -0,0 +1,1225 @@
+package netdicom
+
+// This file implements a small DSL for scripting one side of an association
+// in tests, so that negotiation edge cases can be written as a readable
+// sequence of expected and sent PDUs:
+//
+//	p := newScriptedProvider(t, su)
+//	rq := p.expectAssociateRQ(pctx(verification, implicitLE, explicitLE))
+//	p.acceptAssociate(rq, pctx(verification, implicitLE))
+//	_, msg, _ := p.expectDIMSE(dimse.CommandFieldCEchoRq)
+//	p.sendDIMSE(verification, &dimse.CEchoRsp{...}, nil)
+//
+// The peer talks over net.Pipe, so no sockets are involved.
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/antibios/dicom"
+	dicomuid "github.com/antibios/dicom/pkg/uid"
+	"github.com/antibios/go-netdicom/dimse"
+	"github.com/antibios/go-netdicom/pdu"
+	"github.com/antibios/go-netdicom/sopclass"
+	"github.com/stretchr/testify/require"
+)
+
+// How long a step waits for the other side before failing the test.
+const scriptTimeout = 5 * time.Second
+
+// A presentation context, as proposed (one or more transfer syntaxes) or as
+// accepted (exactly one).
+type scriptContext struct {
+	abstractSyntax   string
+	transferSyntaxes []string
+}
+
+func pctx(abstractSyntax string, transferSyntaxes ...string) scriptContext {
+	return scriptContext{abstractSyntax, transferSyntaxes}
+}
+
+// scriptPeer plays one side of an association. Each expect* step reads the
+// next PDU and fails the test unless it matches; each send* step writes one.
+// Every PDU exchanged is recorded, and the transcript is printed when a step
+// fails. Steps must be called from the test goroutine.
+type scriptPeer struct {
+	t    *testing.T
+	conn net.Conn
+
+	// Contexts in the A-ASSOCIATE-RQ, keyed by context ID.
+	proposed map[byte]scriptContext
+	// Accepted contexts, keyed by context ID.
+	accepted map[byte]scriptContext
+	// Extra user information subitems for sendAssociateRQ and
+	// acceptAssociate.
+	userInfo []pdu.SubItem
+	// The max PDU size advertised by sendAssociateRQ and acceptAssociate,
+	// or 0 for DefaultMaxPDUSize. A larger P-DATA-TF fails the test.
+	maxPDUSize int
+	// The max PDU size advertised by the other side. sendDIMSE fragments
+	// data to fit.
+	peerMaxPDUSize int
+
+	assembler  dimse.CommandAssembler
+	transcript []string
+}
+
+// Connect a scripted provider to "su". The caller must run the ServiceUser's
+// blocking calls in another goroutine.
+func newScriptedProvider(t *testing.T, su *ServiceUser) *scriptPeer {
+	local, remote := net.Pipe()
+	su.SetConn(local)
+	return newScriptPeer(t, remote)
+}
+
+// Serve a connection with "params", and connect a scripted user to it.
+func newScriptedUser(t *testing.T, params ServiceProviderParams) *scriptPeer {
+	local, remote := net.Pipe()
+	go RunProviderForConn(local, params)
+	return newScriptPeer(t, remote)
+}
+
+func newScriptPeer(t *testing.T, conn net.Conn) *scriptPeer {
+	t.Cleanup(func() { conn.Close() })
+	return &scriptPeer{
+		t:        t,
+		conn:     conn,
+		proposed: map[byte]scriptContext{},
+		accepted: map[byte]scriptContext{},
+	}
+}
+
+func (p *scriptPeer) fatalf(format string, args ...interface{}) {
+	p.t.Helper()
+	p.t.Fatalf("%s\ntranscript:\n%s", fmt.Sprintf(format, args...), strings.Join(p.transcript, "\n"))
+}
+
+func (p *scriptPeer) send(v pdu.PDU) {
+	p.t.Helper()
+	p.transcript = append(p.transcript, "  sent: "+v.String())
+	data, err := pdu.EncodePDU(v)
+	if err != nil {
+		p.fatalf("encode %v: %v", v, err)
+	}
+	p.conn.SetWriteDeadline(time.Now().Add(scriptTimeout))
+	if _, err := p.conn.Write(data); err != nil {
+		p.fatalf("write %v: %v", v, err)
+	}
+}
+
+func (p *scriptPeer) receive() pdu.PDU {
+	p.t.Helper()
+	p.conn.SetReadDeadline(time.Now().Add(scriptTimeout))
+	v, err := pdu.ReadPDU(p.conn, DefaultMaxPDUSize)
+	if err != nil {
+		p.fatalf("read PDU: %v", err)
+	}
+	p.transcript = append(p.transcript, "  received: "+v.String())
+	if tf, ok := v.(*pdu.PDataTf); ok {
+		size := 0
+		for _, item := range tf.Items {
+			size += pdvHeaderSize + len(item.Value)
+		}
+		if size > maxPDUSizeOrDefault(p.maxPDUSize) {
+			p.fatalf("P-DATA-TF of %d bytes exceeds the max PDU size of %d", size, maxPDUSizeOrDefault(p.maxPDUSize))
+		}
+	}
+	return v
+}
+
+// Record the max PDU size in the user information of an A-ASSOCIATE-RQ or
+// -AC.
+func (p *scriptPeer) notePeerMaxPDUSize(a *pdu.AAssociate) {
+	for _, item := range a.Items {
+		if ui, ok := item.(*pdu.UserInformationItem); ok {
+			for _, subItem := range ui.Items {
+				if ml, ok := subItem.(*pdu.UserInformationMaximumLengthItem); ok {
+					p.peerMaxPDUSize = int(ml.MaximumLengthReceived)
+				}
+			}
+		}
+	}
+}
+
+// Extract the presentation contexts of an A-ASSOCIATE-RQ, in order.
+func proposedContexts(rq *pdu.AAssociate) (ids []byte, contexts []scriptContext) {
+	for _, item := range rq.Items {
+		pc, ok := item.(*pdu.PresentationContextItem)
+		if !ok {
+			continue
+		}
+		c := scriptContext{}
+		for _, subItem := range pc.Items {
+			switch s := subItem.(type) {
+			case *pdu.AbstractSyntaxSubItem:
+				c.abstractSyntax = s.Name
+			case *pdu.TransferSyntaxSubItem:
+				c.transferSyntaxes = append(c.transferSyntaxes, s.Name)
+			}
+		}
+		ids = append(ids, pc.ContextID)
+		contexts = append(contexts, c)
+	}
+	return ids, contexts
+}
+
+// expectAssociateRQ reads an A-ASSOCIATE-RQ. If "want" is nonempty, the
+// request must propose exactly those contexts, in order.
+func (p *scriptPeer) expectAssociateRQ(want ...scriptContext) *pdu.AAssociate {
+	p.t.Helper()
+	v := p.receive()
+	rq, ok := v.(*pdu.AAssociate)
+	if !ok || rq.Type != pdu.TypeAAssociateRq {
+		p.fatalf("expected A-ASSOCIATE-RQ, got %v", v)
+	}
+	ids, contexts := proposedContexts(rq)
+	if len(want) > 0 && !reflect.DeepEqual(contexts, want) {
+		p.fatalf("proposed contexts: got %v, want %v", contexts, want)
+	}
+	for i, id := range ids {
+		p.proposed[id] = contexts[i]
+	}
+	p.notePeerMaxPDUSize(rq)
+	return rq
+}
+
+// acceptAssociate answers "rq" with A-ASSOCIATE-AC. A proposed context is
+// accepted if "accept" lists its abstract syntax with one of its transfer
+// syntaxes; otherwise it is rejected.
+func (p *scriptPeer) acceptAssociate(rq *pdu.AAssociate, accept ...scriptContext) {
+	p.t.Helper()
+	items := []pdu.SubItem{&pdu.ApplicationContextItem{Name: pdu.DICOMApplicationContextItemName}}
+	ids, contexts := proposedContexts(rq)
+	for i, c := range contexts {
+		result := pdu.PresentationContextProviderRejectionAbstractSyntaxNotSupported
+		transferSyntax := c.transferSyntaxes[0]
+		for _, a := range accept {
+			if a.abstractSyntax != c.abstractSyntax {
+				continue
+			}
+			result = pdu.PresentationContextProviderRejectionTransferSyntaxNotSupported
+			for _, ts := range c.transferSyntaxes {
+				if ts == a.transferSyntaxes[0] {
+					result = pdu.PresentationContextAccepted
+					transferSyntax = ts
+				}
+			}
+		}
+		if result == pdu.PresentationContextAccepted {
+			p.accepted[ids[i]] = pctx(c.abstractSyntax, transferSyntax)
+		}
+		items = append(items, &pdu.PresentationContextItem{
+			Type:      pdu.ItemTypePresentationContextResponse,
+			ContextID: ids[i],
+			Result:    result,
+			Items:     []pdu.SubItem{&pdu.TransferSyntaxSubItem{Name: transferSyntax}},
+		})
+	}
+	items = append(items, &pdu.UserInformationItem{
+		Items: append([]pdu.SubItem{&pdu.UserInformationMaximumLengthItem{MaximumLengthReceived: uint32(maxPDUSizeOrDefault(p.maxPDUSize))}},
+			p.userInfo...)})
+	p.send(&pdu.AAssociate{
+		Type:            pdu.TypeAAssociateAc,
+		ProtocolVersion: pdu.CurrentProtocolVersion,
+		CalledAETitle:   rq.CalledAETitle,
+		CallingAETitle:  rq.CallingAETitle,
+		Items:           items,
+	})
+}
+
+// rejectAssociate answers with A-ASSOCIATE-RJ.
+func (p *scriptPeer) rejectAssociate(result pdu.RejectResultType, source pdu.SourceType, reason pdu.RejectReasonType) {
+	p.t.Helper()
+	p.send(&pdu.AAssociateRj{Result: result, Source: source, Reason: reason})
+}
+
+// sendAssociateRQ proposes "contexts", with IDs 1, 3, 5, ...
+func (p *scriptPeer) sendAssociateRQ(callingAETitle string, contexts ...scriptContext) {
+	p.t.Helper()
+	items := []pdu.SubItem{&pdu.ApplicationContextItem{Name: pdu.DICOMApplicationContextItemName}}
+	for i, c := range contexts {
+		id := byte(2*i + 1)
+		subItems := []pdu.SubItem{&pdu.AbstractSyntaxSubItem{Name: c.abstractSyntax}}
+		for _, ts := range c.transferSyntaxes {
+			subItems = append(subItems, &pdu.TransferSyntaxSubItem{Name: ts})
+		}
+		items = append(items, &pdu.PresentationContextItem{
+			Type:      pdu.ItemTypePresentationContextRequest,
+			ContextID: id,
+			Items:     subItems,
+		})
+		p.proposed[id] = c
+	}
+	items = append(items, &pdu.UserInformationItem{
+		Items: append([]pdu.SubItem{&pdu.UserInformationMaximumLengthItem{MaximumLengthReceived: uint32(maxPDUSizeOrDefault(p.maxPDUSize))}},
+			p.userInfo...)})
+	p.send(&pdu.AAssociate{
+		Type:            pdu.TypeAAssociateRq,
+		ProtocolVersion: pdu.CurrentProtocolVersion,
+		CalledAETitle:   "SCRIPTED-SCP",
+		CallingAETitle:  callingAETitle,
+		Items:           items,
+	})
+}
+
+// expectAssociateAC reads an A-ASSOCIATE-AC, which must accept exactly the
+// contexts in "want", in order of context ID.
+func (p *scriptPeer) expectAssociateAC(want ...scriptContext) *pdu.AAssociate {
+	p.t.Helper()
+	v := p.receive()
+	ac, ok := v.(*pdu.AAssociate)
+	if !ok || ac.Type != pdu.TypeAAssociateAc {
+		p.fatalf("expected A-ASSOCIATE-AC, got %v", v)
+	}
+	var got []scriptContext
+	for _, item := range ac.Items {
+		pc, ok := item.(*pdu.PresentationContextItem)
+		if !ok || pc.Result != pdu.PresentationContextAccepted {
+			continue
+		}
+		proposed, ok := p.proposed[pc.ContextID]
+		if !ok || len(pc.Items) != 1 {
+			p.fatalf("bad presentation context in A-ASSOCIATE-AC: %v", pc)
+		}
+		c := pctx(proposed.abstractSyntax, pc.Items[0].(*pdu.TransferSyntaxSubItem).Name)
+		p.accepted[pc.ContextID] = c
+		got = append(got, c)
+	}
+	if !reflect.DeepEqual(got, want) {
+		p.fatalf("accepted contexts: got %v, want %v", got, want)
+	}
+	p.notePeerMaxPDUSize(ac)
+	return ac
+}
+
+// expectAssociateRJ reads an A-ASSOCIATE-RJ with the given reason.
+func (p *scriptPeer) expectAssociateRJ(reason pdu.RejectReasonType) *pdu.AAssociateRj {
+	p.t.Helper()
+	v := p.receive()
+	rj, ok := v.(*pdu.AAssociateRj)
+	if !ok {
+		p.fatalf("expected A-ASSOCIATE-RJ, got %v", v)
+	}
+	if rj.Reason != reason {
+		p.fatalf("A-ASSOCIATE-RJ reason: got %v, want %v", rj.Reason, reason)
+	}
+	return rj
+}
+
+// sendDIMSE sends a DIMSE message, and its data if msg.HasData(), on the
+// context accepted for "abstractSyntax". The data is split into PDVs that fill
+// the peer's max PDU size.
+func (p *scriptPeer) sendDIMSE(abstractSyntax string, msg dimse.Message, data []byte) {
+	p.t.Helper()
+	var fragments [][]byte
+	maxChunkSize := maxPDUSizeOrDefault(p.peerMaxPDUSize) - pdvHeaderSize
+	for msg.HasData() {
+		chunk := data
+		if len(chunk) > maxChunkSize {
+			chunk = chunk[:maxChunkSize]
+		}
+		data = data[len(chunk):]
+		fragments = append(fragments, chunk)
+		if len(data) == 0 {
+			break
+		}
+	}
+	p.sendDIMSEFragments(abstractSyntax, msg, fragments)
+}
+
+// sendDIMSEFragments is like sendDIMSE, but sends the data as the given PDVs,
+// one per P-DATA-TF, e.g., to end with a zero-length fragment.
+func (p *scriptPeer) sendDIMSEFragments(abstractSyntax string, msg dimse.Message, fragments [][]byte) {
+	p.t.Helper()
+	p.sendCommand(abstractSyntax, msg)
+	for i, chunk := range fragments {
+		p.sendFragment(abstractSyntax, chunk, i == len(fragments)-1)
+	}
+}
+
+// sendCommand sends the command set of "msg", without its data, on the context
+// accepted for "abstractSyntax".
+func (p *scriptPeer) sendCommand(abstractSyntax string, msg dimse.Message) {
+	p.t.Helper()
+	b := bytes.Buffer{}
+	e := dicom.NewWriter(&b, dicom.SkipVRVerification())
+	e.SetTransferSyntax(binary.LittleEndian, true)
+	dimse.EncodeMessage(e, msg)
+	p.send(&pdu.PDataTf{Items: []pdu.PresentationDataValueItem{
+		{ContextID: p.contextID(abstractSyntax), Command: true, Last: true, Value: b.Bytes()},
+	}})
+}
+
+// sendFragment sends one PDV of data on the context accepted for
+// "abstractSyntax".
+func (p *scriptPeer) sendFragment(abstractSyntax string, chunk []byte, last bool) {
+	p.t.Helper()
+	p.send(&pdu.PDataTf{Items: []pdu.PresentationDataValueItem{
+		{ContextID: p.contextID(abstractSyntax), Command: false, Last: last, Value: chunk},
+	}})
+}
+
+// contextID returns the ID of the context accepted for "abstractSyntax".
+func (p *scriptPeer) contextID(abstractSyntax string) byte {
+	p.t.Helper()
+	var contextID byte
+	for id, c := range p.accepted {
+		if c.abstractSyntax == abstractSyntax {
+			contextID = id
+		}
+	}
+	if contextID == 0 {
+		p.fatalf("no accepted context for %v", abstractSyntax)
+	}
+	return contextID
+}
+
+// expectDIMSE reads P-DATA-TF PDUs until a DIMSE message is complete. The
+// message must have the given command field.
+func (p *scriptPeer) expectDIMSE(commandField int) (abstractSyntax string, msg dimse.Message, data []byte) {
+	p.t.Helper()
+	for {
+		v := p.receive()
+		tf, ok := v.(*pdu.PDataTf)
+		if !ok {
+			p.fatalf("expected P-DATA-TF, got %v", v)
+		}
+		contextID, msg, data, err := p.assembler.AddDataPDU(tf)
+		if err != nil {
+			p.fatalf("assemble DIMSE message: %v", err)
+		}
+		if msg == nil {
+			continue
+		}
+		if msg.CommandField() != commandField {
+			p.fatalf("expected DIMSE command field 0x%x, got %v", commandField, msg)
+		}
+		return p.accepted[contextID].abstractSyntax, msg, data
+	}
+}
+
+func (p *scriptPeer) sendReleaseRQ() {
+	p.t.Helper()
+	p.send(&pdu.AReleaseRq{})
+}
+
+func (p *scriptPeer) sendReleaseRP() {
+	p.t.Helper()
+	p.send(&pdu.AReleaseRp{})
+}
+
+func (p *scriptPeer) expectReleaseRQ() {
+	p.t.Helper()
+	if v := p.receive(); reflect.TypeOf(v) != reflect.TypeOf(&pdu.AReleaseRq{}) {
+		p.fatalf("expected A-RELEASE-RQ, got %v", v)
+	}
+}
+
+func (p *scriptPeer) expectReleaseRP() {
+	p.t.Helper()
+	if v := p.receive(); reflect.TypeOf(v) != reflect.TypeOf(&pdu.AReleaseRp{}) {
+		p.fatalf("expected A-RELEASE-RP, got %v", v)
+	}
+}
+
+// expectAbort reads an A-ABORT.
+func (p *scriptPeer) expectAbort() *pdu.AAbort {
+	p.t.Helper()
+	v := p.receive()
+	abort, ok := v.(*pdu.AAbort)
+	if !ok {
+		p.fatalf("expected A-ABORT, got %v", v)
+	}
+	return abort
+}
+
+// expectClosed waits for the other side to close the connection.
+func (p *scriptPeer) expectClosed() {
+	p.t.Helper()
+	p.conn.SetReadDeadline(time.Now().Add(scriptTimeout))
+	v, err := pdu.ReadPDU(p.conn, DefaultMaxPDUSize)
+	if err == nil {
+		p.transcript = append(p.transcript, "  received: "+v.String())
+		p.fatalf("expected the connection to be closed, got %v", v)
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		p.fatalf("timed out waiting for the connection to be closed")
+	}
+}
+
+func TestScriptUserCEcho(t *testing.T) {
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.VerificationClasses})
+	require.NoError(t, err)
+	p := newScriptedProvider(t, su)
+	errCh := make(chan error, 1)
+	go func() { errCh <- su.CEcho() }()
+
+	rq := p.expectAssociateRQ(pctx(dicomuid.VerificationSOPClass, StandardTransferSyntaxes...))
+	p.acceptAssociate(rq, pctx(dicomuid.VerificationSOPClass, dicomuid.ExplicitVRLittleEndian))
+	_, msg, _ := p.expectDIMSE(dimse.CommandFieldCEchoRq)
+	p.sendDIMSE(dicomuid.VerificationSOPClass, &dimse.CEchoRsp{
+		MessageIDBeingRespondedTo: msg.GetMessageID(),
+		CommandDataSetType:        dimse.CommandDataSetTypeNull,
+		Status:                    dimse.Success,
+	}, nil)
+	require.NoError(t, <-errCh)
+
+	go func() { errCh <- su.Release() }()
+	p.expectReleaseRQ()
+	p.sendReleaseRP()
+	p.expectClosed()
+	require.NoError(t, <-errCh)
+}
+
+// A ServiceUser with a 4096-byte max PDU size advertises it, and sends data in
+// PDUs no larger than the peer's.
+func TestScriptUserMaxPDUSize(t *testing.T) {
+	ct := sopclass.StorageClasses[0]
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:       []string{ct},
+		TransferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian},
+		MaxPDUSize:       4096,
+	})
+	require.NoError(t, err)
+	p := newScriptedProvider(t, su)
+	p.maxPDUSize = 4096
+	data := make([]byte, 2*(4096-pdvHeaderSize))
+	for i := range data {
+		data[i] = byte(i)
+	}
+	errCh := make(chan error, 1)
+	go func() { errCh <- su.CStoreRaw(ct, "1.2.3", dicomuid.ImplicitVRLittleEndian, data) }()
+
+	rq := p.expectAssociateRQ(pctx(ct, dicomuid.ImplicitVRLittleEndian))
+	require.Equal(t, 4096, p.peerMaxPDUSize)
+	p.acceptAssociate(rq, pctx(ct, dicomuid.ImplicitVRLittleEndian))
+	_, msg, got := p.expectDIMSE(dimse.CommandFieldCStoreRq)
+	require.Equal(t, data, got)
+	p.sendDIMSE(ct, &dimse.CStoreRsp{
+		AffectedSOPClassUID:       ct,
+		MessageIDBeingRespondedTo: msg.GetMessageID(),
+		CommandDataSetType:        dimse.CommandDataSetTypeNull,
+		AffectedSOPInstanceUID:    "1.2.3",
+		Status:                    dimse.Success,
+	}, nil)
+	require.NoError(t, <-errCh)
+
+	go func() { errCh <- su.Release() }()
+	p.expectReleaseRQ()
+	p.sendReleaseRP()
+	p.expectClosed()
+	require.NoError(t, <-errCh)
+}
+
+// CStoreFromReader sends exactly "size" bytes, and aborts rather than send the
+// last fragment of a stream that ends early.
+func TestScriptUserCStoreFromReader(t *testing.T) {
+	ct := sopclass.StorageClasses[0]
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:       []string{ct},
+		TransferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian},
+		MaxPDUSize:       4096,
+	})
+	require.NoError(t, err)
+	require.Error(t, su.CStoreFromReader(ct, "1.2.3", dicomuid.ImplicitVRLittleEndian, bytes.NewReader(nil), 3))
+	p := newScriptedProvider(t, su)
+	p.maxPDUSize = 4096
+	data := make([]byte, 4096-pdvHeaderSize)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- su.CStoreFromReader(ct, "1.2.3", dicomuid.ImplicitVRLittleEndian,
+			bytes.NewReader(append(data, 1, 2, 3, 4)), int64(len(data)))
+	}()
+	rq := p.expectAssociateRQ(pctx(ct, dicomuid.ImplicitVRLittleEndian))
+	p.acceptAssociate(rq, pctx(ct, dicomuid.ImplicitVRLittleEndian))
+	_, msg, got := p.expectDIMSE(dimse.CommandFieldCStoreRq)
+	require.Equal(t, data, got)
+	p.sendDIMSE(ct, &dimse.CStoreRsp{
+		AffectedSOPClassUID:       ct,
+		MessageIDBeingRespondedTo: msg.GetMessageID(),
+		CommandDataSetType:        dimse.CommandDataSetTypeNull,
+		AffectedSOPInstanceUID:    "1.2.3",
+		Status:                    dimse.Success,
+	}, nil)
+	require.NoError(t, <-errCh)
+
+	// The stream ends 2 bytes short, after the first fragment.
+	go func() {
+		errCh <- su.CStoreFromReader(ct, "1.2.4", dicomuid.ImplicitVRLittleEndian,
+			bytes.NewReader(data), int64(len(data)+2))
+	}()
+	for {
+		v := p.receive()
+		if _, ok := v.(*pdu.AAbort); ok {
+			break
+		}
+		tf, ok := v.(*pdu.PDataTf)
+		require.True(t, ok, "%v", v)
+		for _, item := range tf.Items {
+			require.False(t, !item.Command && item.Last, "%v", item)
+		}
+	}
+	require.Error(t, <-errCh)
+}
+
+// Returns "data", then blocks until "unblock" is closed.
+type blockingReader struct {
+	data    []byte
+	unblock chan struct{}
+}
+
+func (r *blockingReader) Read(p []byte) (int, error) {
+	if len(r.data) > 0 {
+		n := copy(p, r.data)
+		r.data = r.data[n:]
+		return n, nil
+	}
+	<-r.unblock
+	return 0, io.EOF
+}
+
+// A reader that blocks doesn't hold up the statemachine: an A-ABORT from the
+// peer ends the C-STORE while the reader is still blocked.
+func TestScriptUserCStoreFromBlockedReader(t *testing.T) {
+	ct := sopclass.StorageClasses[0]
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:       []string{ct},
+		TransferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian},
+	})
+	require.NoError(t, err)
+	p := newScriptedProvider(t, su)
+	r := &blockingReader{data: []byte{1, 2, 3, 4}, unblock: make(chan struct{})}
+	defer close(r.unblock)
+	errCh := make(chan error, 1)
+	go func() { errCh <- su.CStoreRawFromReader(ct, "1.2.3", dicomuid.ImplicitVRLittleEndian, r) }()
+	rq := p.expectAssociateRQ(pctx(ct, dicomuid.ImplicitVRLittleEndian))
+	p.acceptAssociate(rq, pctx(ct, dicomuid.ImplicitVRLittleEndian))
+	tf, ok := p.receive().(*pdu.PDataTf)
+	require.True(t, ok)
+	require.True(t, tf.Items[0].Command)
+	p.send(&pdu.AAbort{Source: pdu.AbortSourceServiceProvider})
+	select {
+	case err := <-errCh:
+		require.Error(t, err)
+	case <-time.After(scriptTimeout):
+		t.Fatal("C-STORE not ended by the abort")
+	}
+}
+
+// NRequest sends an N-ACTION and returns its response; the N-EVENT-REPORT
+// that follows goes to NEventReport, whose status is sent back.
+func TestScriptUserNRequest(t *testing.T) {
+	ct := sopclass.NServiceClasses[0]
+	reports := make(chan NServiceRequest, 1)
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:       []string{ct},
+		TransferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian},
+		NEventReport: func(conn ConnectionState, rq NServiceRequest) NServiceResponse {
+			reports <- rq
+			return NServiceResponse{Status: dimse.Success}
+		},
+	})
+	require.NoError(t, err)
+	p := newScriptedProvider(t, su)
+	type result struct {
+		resp dimse.Message
+		err  error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		resp, _, err := su.NRequest(&dimse.NActionRq{
+			RequestedSOPClassUID:    ct,
+			RequestedSOPInstanceUID: "1.2.840.10008.1.20.1.1",
+			ActionTypeID:            1,
+		}, nil)
+		resultCh <- result{resp, err}
+	}()
+	rq := p.expectAssociateRQ(pctx(ct, dicomuid.ImplicitVRLittleEndian))
+	p.acceptAssociate(rq, pctx(ct, dicomuid.ImplicitVRLittleEndian))
+	_, msg, _ := p.expectDIMSE(dimse.CommandFieldNActionRq)
+	action := msg.(*dimse.NActionRq)
+	require.Equal(t, dimse.CommandDataSetTypeNull, action.CommandDataSetType)
+	p.sendDIMSE(ct, &dimse.NActionRsp{
+		AffectedSOPClassUID:       ct,
+		MessageIDBeingRespondedTo: action.MessageID,
+		CommandDataSetType:        dimse.CommandDataSetTypeNull,
+		AffectedSOPInstanceUID:    action.RequestedSOPInstanceUID,
+		ActionTypeID:              1,
+		Status:                    dimse.Success,
+	}, nil)
+	r := <-resultCh
+	require.NoError(t, r.err)
+	require.Equal(t, dimse.Success, *r.resp.GetStatus())
+
+	p.sendDIMSE(ct, &dimse.NEventReportRq{
+		AffectedSOPClassUID:    ct,
+		MessageID:              100,
+		CommandDataSetType:     dimse.CommandDataSetTypeNull,
+		AffectedSOPInstanceUID: "1.2.840.10008.1.20.1.1",
+		EventTypeID:            1,
+	}, nil)
+	_, msg, _ = p.expectDIMSE(dimse.CommandFieldNEventReportRsp)
+	require.Equal(t, dimse.Success, *msg.GetStatus())
+	require.Equal(t, uint16(1), msg.(*dimse.NEventReportRsp).EventTypeID)
+	report := <-reports
+	require.Equal(t, ct, report.SOPClassUID)
+	require.Equal(t, "1.2.840.10008.1.20.1.1", report.SOPInstanceUID)
+}
+
+// Association exposes the state of the association, and aborts it, e.g., to
+// unblock an operation the peer doesn't answer.
+func TestScriptUserAssociationAbort(t *testing.T) {
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.VerificationClasses})
+	require.NoError(t, err)
+	require.Nil(t, su.Association())
+	p := newScriptedProvider(t, su)
+	assoc := su.Association()
+	require.NotNil(t, assoc)
+	require.Equal(t, UserAssociationRequested, assoc.Info().State)
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- su.CEcho() }()
+	rq := p.expectAssociateRQ(pctx(dicomuid.VerificationSOPClass, StandardTransferSyntaxes...))
+	p.acceptAssociate(rq, pctx(dicomuid.VerificationSOPClass, dicomuid.ImplicitVRLittleEndian))
+	p.expectDIMSE(dimse.CommandFieldCEchoRq)
+	info := assoc.Info()
+	require.Equal(t, UserAssociationActive, info.State)
+	require.Equal(t, 1, info.ActiveCommands)
+	require.Equal(t, "unknown-called", info.Peer.CalledAETitle)
+
+	// The C-ECHO-RSP never comes.
+	stalled := errors.New("stalled")
+	require.NoError(t, assoc.Abort(stalled))
+	p.expectAbort()
+	err = <-errCh
+	var abortErr *AbortError
+	require.True(t, errors.As(err, &abortErr), "%v", err)
+	require.False(t, abortErr.Remote)
+	require.True(t, errors.Is(err, stalled), "%v", err)
+	require.Eventually(t, func() bool { return assoc.Info().State == UserAssociationClosed },
+		scriptTimeout, 10*time.Millisecond)
+	require.Error(t, assoc.Abort(nil))
+}
+
+func TestScriptUserUnexpectedResponse(t *testing.T) {
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.VerificationClasses})
+	require.NoError(t, err)
+	p := newScriptedProvider(t, su)
+	errCh := make(chan error, 1)
+	go func() { errCh <- su.CEcho() }()
+
+	rq := p.expectAssociateRQ()
+	p.acceptAssociate(rq, pctx(dicomuid.VerificationSOPClass, dicomuid.ImplicitVRLittleEndian))
+	_, msg, _ := p.expectDIMSE(dimse.CommandFieldCEchoRq)
+	p.sendDIMSE(dicomuid.VerificationSOPClass, &dimse.CStoreRsp{
+		AffectedSOPClassUID:       dicomuid.VerificationSOPClass,
+		MessageIDBeingRespondedTo: msg.GetMessageID(),
+		CommandDataSetType:        dimse.CommandDataSetTypeNull,
+		AffectedSOPInstanceUID:    "1.2.3",
+		Status:                    dimse.Success,
+	}, nil)
+	err = <-errCh
+	var unexpected *UnexpectedCommandError
+	require.True(t, errors.As(err, &unexpected), "%v", err)
+	require.Equal(t, "C-ECHO-RSP", unexpected.Want)
+	p.expectAbort()
+}
+
+func TestScriptUserReleaseTimeout(t *testing.T) {
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:     sopclass.VerificationClasses,
+		ReleaseTimeout: 100 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	p := newScriptedProvider(t, su)
+	errCh := make(chan error, 1)
+	go func() { errCh <- su.CEcho() }()
+
+	rq := p.expectAssociateRQ()
+	p.acceptAssociate(rq, pctx(dicomuid.VerificationSOPClass, dicomuid.ImplicitVRLittleEndian))
+	_, msg, _ := p.expectDIMSE(dimse.CommandFieldCEchoRq)
+	p.sendDIMSE(dicomuid.VerificationSOPClass, &dimse.CEchoRsp{
+		MessageIDBeingRespondedTo: msg.GetMessageID(),
+		CommandDataSetType:        dimse.CommandDataSetTypeNull,
+		Status:                    dimse.Success,
+	}, nil)
+	require.NoError(t, <-errCh)
+
+	go func() { errCh <- su.Release() }()
+	p.expectReleaseRQ()
+	// Never answer; the user gives up and aborts.
+	p.expectAbort()
+	err = <-errCh
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "did not answer A-RELEASE-RQ")
+}
+
+func TestScriptUserAllContextsRejected(t *testing.T) {
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.VerificationClasses})
+	require.NoError(t, err)
+	p := newScriptedProvider(t, su)
+	errCh := make(chan error, 1)
+	go func() { errCh <- su.CEcho() }()
+
+	rq := p.expectAssociateRQ()
+	p.acceptAssociate(rq)
+	require.Error(t, <-errCh)
+
+	go func() { errCh <- su.Release() }()
+	p.expectReleaseRQ()
+	p.sendReleaseRP()
+	p.expectClosed()
+	require.NoError(t, <-errCh)
+}
+
+func TestScriptProviderContextNegotiation(t *testing.T) {
+	const privateSOPClassUID = "1.2.826.0.1.3680043.9.7133.99"
+	p := newScriptedUser(t, ServiceProviderParams{
+		CEcho: func(conn ConnectionState) dimse.Status { return dimse.Success },
+	})
+	p.sendAssociateRQ("SCRIPTED-USER",
+		pctx(privateSOPClassUID, dicomuid.ImplicitVRLittleEndian),
+		pctx(dicomuid.VerificationSOPClass, dicomuid.ExplicitVRLittleEndian, dicomuid.ImplicitVRLittleEndian))
+	// The private SOP class is rejected; the first proposed transfer syntax
+	// is picked for the other.
+	p.expectAssociateAC(pctx(dicomuid.VerificationSOPClass, dicomuid.ExplicitVRLittleEndian))
+
+	p.sendDIMSE(dicomuid.VerificationSOPClass, &dimse.CEchoRq{
+		MessageID:          1,
+		CommandDataSetType: dimse.CommandDataSetTypeNull,
+	}, nil)
+	_, msg, _ := p.expectDIMSE(dimse.CommandFieldCEchoRsp)
+	require.Equal(t, dimse.Success, *msg.GetStatus())
+
+	p.sendReleaseRQ()
+	p.expectReleaseRP()
+}
+
+func TestScriptProviderRejectsCallingAETitle(t *testing.T) {
+	p := newScriptedUser(t, ServiceProviderParams{AllowedCallingAETitles: []string{"CT1"}})
+	p.sendAssociateRQ("MR1", pctx(dicomuid.VerificationSOPClass, dicomuid.ImplicitVRLittleEndian))
+	p.expectAssociateRJ(pdu.RejectReasonCallingAETitleNotRecognized)
+}
+
+func TestScriptProviderRejectsCalledAETitle(t *testing.T) {
+	p := newScriptedUser(t, ServiceProviderParams{CalledAETitles: []string{"ARCHIVE"}})
+	p.sendAssociateRQ("CT1", pctx(dicomuid.VerificationSOPClass, dicomuid.ImplicitVRLittleEndian))
+	p.expectAssociateRJ(pdu.RejectReasonCalledAETitleNotRecognized)
+}
+
+// OnAssociateRequest sees the request, and its rejection is sent as is; an
+// error of its own is a permanent rejection with no reason.
+func TestScriptProviderOnAssociateRequest(t *testing.T) {
+	requests := make(chan AssociateRequest, 1)
+	params := ServiceProviderParams{
+		CEcho: onCEchoRequest,
+		OnAssociateRequest: func(rq AssociateRequest) error {
+			requests <- rq
+			switch rq.CallingAETitle {
+			case "BUSY":
+				return &AssociationRejectedError{
+					Result: pdu.ResultRejectedTransient,
+					Source: pdu.SourceULServiceProviderPresentation,
+					Reason: pdu.RejectReasonTemporaryCongestion,
+				}
+			case "STRANGER":
+				return fmt.Errorf("unknown peer")
+			}
+			return nil
+		},
+	}
+	p := newScriptedUser(t, params)
+	p.sendAssociateRQ("CT1", pctx(dicomuid.VerificationSOPClass, dicomuid.ImplicitVRLittleEndian))
+	p.expectAssociateAC(pctx(dicomuid.VerificationSOPClass, dicomuid.ImplicitVRLittleEndian))
+	rq := <-requests
+	require.Equal(t, "CT1", rq.CallingAETitle)
+	require.Equal(t, "SCRIPTED-SCP", rq.CalledAETitle)
+	require.Equal(t, []ProposedContext{{
+		ContextID:          1,
+		AbstractSyntaxUID:  dicomuid.VerificationSOPClass,
+		TransferSyntaxUIDs: []string{dicomuid.ImplicitVRLittleEndian},
+	}}, rq.PresentationContexts)
+	p.sendReleaseRQ()
+	p.expectReleaseRP()
+
+	p = newScriptedUser(t, params)
+	p.sendAssociateRQ("BUSY", pctx(dicomuid.VerificationSOPClass, dicomuid.ImplicitVRLittleEndian))
+	rj := p.expectAssociateRJ(pdu.RejectReasonTemporaryCongestion)
+	require.Equal(t, pdu.ResultRejectedTransient, rj.Result)
+	require.Equal(t, pdu.SourceULServiceProviderPresentation, rj.Source)
+	<-requests
+
+	p = newScriptedUser(t, params)
+	p.sendAssociateRQ("STRANGER", pctx(dicomuid.VerificationSOPClass, dicomuid.ImplicitVRLittleEndian))
+	rj = p.expectAssociateRJ(pdu.RejectReasonNone)
+	require.Equal(t, pdu.ResultRejectedPermanent, rj.Result)
+	require.Equal(t, pdu.SourceULServiceUser, rj.Source)
+	<-requests
+}
+
+// AE titles are compared without padding, even NULs, and the AC echoes the
+// fields of the RQ as received.
+func TestScriptProviderAETitlePadding(t *testing.T) {
+	for _, called := range [][]string{{" SCRIPTED-SCP"}, {"ARCHIVE", "*"}} {
+		peers := make(chan Peer, 1)
+		p := newScriptedUser(t, ServiceProviderParams{
+			AllowedCallingAETitles: []string{"CT1"},
+			CalledAETitles:         called,
+			CEcho: func(conn ConnectionState) dimse.Status {
+				peers <- conn.Peer
+				return dimse.Success
+			},
+		})
+		p.sendAssociateRQ(" CT1\x00\x00", pctx(dicomuid.VerificationSOPClass, dicomuid.ImplicitVRLittleEndian))
+		ac := p.expectAssociateAC(pctx(dicomuid.VerificationSOPClass, dicomuid.ImplicitVRLittleEndian))
+		require.Equal(t, "CT1", ac.CallingAETitle)
+		require.Equal(t, " CT1\x00\x00          ", ac.RawCallingAETitle)
+
+		p.sendDIMSE(dicomuid.VerificationSOPClass, &dimse.CEchoRq{
+			MessageID:          1,
+			CommandDataSetType: dimse.CommandDataSetTypeNull,
+		}, nil)
+		p.expectDIMSE(dimse.CommandFieldCEchoRsp)
+		peer := <-peers
+		require.Equal(t, "CT1", peer.CallingAETitle)
+		require.Equal(t, "SCRIPTED-SCP", peer.CalledAETitle)
+		require.Equal(t, " CT1\x00\x00          ", peer.RawCallingAETitle)
+		require.Equal(t, "SCRIPTED-SCP    ", peer.RawCalledAETitle)
+
+		p.sendReleaseRQ()
+		p.expectReleaseRP()
+	}
+}
+
+func TestScriptProviderRoleViolation(t *testing.T) {
+	for _, policy := range []RoleViolationPolicy{RoleViolationReject, RoleViolationAbort, RoleViolationLenient} {
+		p := newScriptedUser(t, ServiceProviderParams{
+			CEcho:         func(conn ConnectionState) dimse.Status { return dimse.Success },
+			RoleViolation: policy,
+		})
+		// The user gives up the SCU role for verification, then sends
+		// a C-ECHO anyway.
+		p.userInfo = []pdu.SubItem{&pdu.RoleSelectionSubItem{
+			SOPClassUID: dicomuid.VerificationSOPClass, SCURole: 0, SCPRole: 1}}
+		p.sendAssociateRQ("SCRIPTED-USER", pctx(dicomuid.VerificationSOPClass, dicomuid.ImplicitVRLittleEndian))
+		p.expectAssociateAC(pctx(dicomuid.VerificationSOPClass, dicomuid.ImplicitVRLittleEndian))
+		p.sendDIMSE(dicomuid.VerificationSOPClass, &dimse.CEchoRq{
+			MessageID:          1,
+			CommandDataSetType: dimse.CommandDataSetTypeNull,
+		}, nil)
+		switch policy {
+		case RoleViolationReject:
+			_, msg, _ := p.expectDIMSE(dimse.CommandFieldCEchoRsp)
+			require.Equal(t, dimse.CStoreRefusedSOPClassNotSupported, msg.GetStatus().Status)
+		case RoleViolationAbort:
+			p.expectAbort()
+			continue
+		case RoleViolationLenient:
+			_, msg, _ := p.expectDIMSE(dimse.CommandFieldCEchoRsp)
+			require.Equal(t, dimse.Success, *msg.GetStatus())
+		}
+		p.sendReleaseRQ()
+		p.expectReleaseRP()
+	}
+}
+
+// A provider with a 4096-byte max PDU size advertises it, and assembles data
+// sent in PDVs that fill the PDUs exactly, followed by a zero-length last one.
+func TestScriptProviderMaxPDUSize(t *testing.T) {
+	ct := sopclass.StorageClasses[0]
+	dataCh := make(chan []byte, 1)
+	p := newScriptedUser(t, ServiceProviderParams{
+		CStore: func(conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID, calledAE, callingAE string, data []byte) dimse.Status {
+			dataCh <- append([]byte(nil), data...)
+			return dimse.Success
+		},
+		MaxPDUSize: 4096,
+	})
+	p.maxPDUSize = 4096
+	p.sendAssociateRQ("SCRIPTED-USER", pctx(ct, dicomuid.ImplicitVRLittleEndian))
+	p.expectAssociateAC(pctx(ct, dicomuid.ImplicitVRLittleEndian))
+	require.Equal(t, 4096, p.peerMaxPDUSize)
+
+	full := bytes.Repeat([]byte{0xab}, 4096-pdvHeaderSize)
+	p.sendDIMSEFragments(ct, &dimse.CStoreRq{
+		AffectedSOPClassUID:    ct,
+		MessageID:              1,
+		CommandDataSetType:     int(dimse.CommandDataSetTypeNonNull),
+		AffectedSOPInstanceUID: "1.2.3",
+	}, [][]byte{full, full, nil})
+	_, msg, _ := p.expectDIMSE(dimse.CommandFieldCStoreRsp)
+	require.Equal(t, dimse.Success, *msg.GetStatus())
+	require.Equal(t, append(append([]byte(nil), full...), full...), <-dataCh)
+	p.sendReleaseRQ()
+	p.expectReleaseRP()
+}
+
+// A provider without a C-STORE handler refuses C-STORE requests, or rejects
+// the storage contexts, according to UnhandledCStore.
+func TestScriptProviderUnhandledCStore(t *testing.T) {
+	ct := sopclass.StorageClasses[0]
+	for _, policy := range []UnhandledCStorePolicy{UnhandledCStoreRefuse, UnhandledCStoreRejectContext} {
+		p := newScriptedUser(t, ServiceProviderParams{
+			CEcho:           func(conn ConnectionState) dimse.Status { return dimse.Success },
+			UnhandledCStore: policy,
+		})
+		p.sendAssociateRQ("SCRIPTED-USER",
+			pctx(dicomuid.VerificationSOPClass, dicomuid.ImplicitVRLittleEndian),
+			pctx(ct, dicomuid.ImplicitVRLittleEndian))
+		if policy == UnhandledCStoreRejectContext {
+			p.expectAssociateAC(pctx(dicomuid.VerificationSOPClass, dicomuid.ImplicitVRLittleEndian))
+		} else {
+			p.expectAssociateAC(
+				pctx(dicomuid.VerificationSOPClass, dicomuid.ImplicitVRLittleEndian),
+				pctx(ct, dicomuid.ImplicitVRLittleEndian))
+			p.sendDIMSE(ct, &dimse.CStoreRq{
+				AffectedSOPClassUID:    ct,
+				MessageID:              1,
+				CommandDataSetType:     int(dimse.CommandDataSetTypeNonNull),
+				AffectedSOPInstanceUID: "1.2.3",
+			}, []byte{0x08, 0x00, 0x18, 0x00, 0x06, 0x00, 0x00, 0x00, '1', '.', '2', '.', '3', 0})
+			_, msg, _ := p.expectDIMSE(dimse.CommandFieldCStoreRsp)
+			require.Equal(t, dimse.CStoreRefusedSOPClassNotSupported, msg.GetStatus().Status)
+		}
+		p.sendReleaseRQ()
+		p.expectReleaseRP()
+	}
+}
+
+// The datasets of interleaved C-STOREs are buffered for their CStoreStream
+// handlers: a handler that doesn't read yet holds back neither the other
+// C-STORE nor the rest of the association.
+func TestScriptProviderInterleavedCStoreStream(t *testing.T) {
+	ct1, ct2 := sopclass.StorageClasses[0], sopclass.StorageClasses[1]
+	type result struct {
+		sopInstanceUID string
+		data           []byte
+		err            error
+	}
+	results := make(chan result, 2)
+	secondDone := make(chan struct{})
+	p := newScriptedUser(t, ServiceProviderParams{
+		CEcho: func(conn ConnectionState) dimse.Status { return dimse.Success },
+		CStoreStream: func(conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID string, priority int, data io.Reader) dimse.Status {
+			if sopInstanceUID == "1.2.1" {
+				<-secondDone
+			}
+			b, err := io.ReadAll(data)
+			results <- result{sopInstanceUID, b, err}
+			if sopInstanceUID == "1.2.2" {
+				close(secondDone)
+			}
+			return dimse.Success
+		},
+	})
+	p.sendAssociateRQ("SCRIPTED-USER",
+		pctx(dicomuid.VerificationSOPClass, dicomuid.ImplicitVRLittleEndian),
+		pctx(ct1, dicomuid.ImplicitVRLittleEndian),
+		pctx(ct2, dicomuid.ImplicitVRLittleEndian))
+	p.expectAssociateAC(
+		pctx(dicomuid.VerificationSOPClass, dicomuid.ImplicitVRLittleEndian),
+		pctx(ct1, dicomuid.ImplicitVRLittleEndian),
+		pctx(ct2, dicomuid.ImplicitVRLittleEndian))
+	for i, c := range []struct{ sopClassUID, sopInstanceUID string }{{ct1, "1.2.1"}, {ct2, "1.2.2"}} {
+		p.sendCommand(c.sopClassUID, &dimse.CStoreRq{
+			AffectedSOPClassUID:    c.sopClassUID,
+			MessageID:              dimse.MessageID(i + 1),
+			CommandDataSetType:     int(dimse.CommandDataSetTypeNonNull),
+			AffectedSOPInstanceUID: c.sopInstanceUID,
+		})
+		p.sendFragment(c.sopClassUID, []byte{1, 2}, false)
+	}
+	p.sendDIMSE(dicomuid.VerificationSOPClass, &dimse.CEchoRq{
+		MessageID:          3,
+		CommandDataSetType: dimse.CommandDataSetTypeNull,
+	}, nil)
+	p.expectDIMSE(dimse.CommandFieldCEchoRsp)
+
+	p.sendFragment(ct2, []byte{3, 4}, true)
+	_, msg, _ := p.expectDIMSE(dimse.CommandFieldCStoreRsp)
+	require.Equal(t, dimse.MessageID(2), msg.GetMessageID())
+	p.sendFragment(ct1, []byte{5}, true)
+	_, msg, _ = p.expectDIMSE(dimse.CommandFieldCStoreRsp)
+	require.Equal(t, dimse.MessageID(1), msg.GetMessageID())
+	require.Equal(t, result{"1.2.2", []byte{1, 2, 3, 4}, nil}, <-results)
+	require.Equal(t, result{"1.2.1", []byte{1, 2, 5}, nil}, <-results)
+	p.sendReleaseRQ()
+	p.expectReleaseRP()
+}
+
+// N-service requests go to NService, which may name the instance it creates;
+// without NService, they are answered with "unrecognized operation".
+func TestScriptProviderNService(t *testing.T) {
+	ct := sopclass.NServiceClasses[1]
+	requests := make(chan NServiceRequest, 1)
+	p := newScriptedUser(t, ServiceProviderParams{
+		NService: func(conn ConnectionState, rq NServiceRequest) NServiceResponse {
+			requests <- rq
+			return NServiceResponse{Status: dimse.Success, SOPInstanceUID: "1.2.3.4"}
+		},
+	})
+	p.sendAssociateRQ("SCRIPTED-USER", pctx(ct, dicomuid.ImplicitVRLittleEndian))
+	p.expectAssociateAC(pctx(ct, dicomuid.ImplicitVRLittleEndian))
+	p.sendDIMSE(ct, &dimse.NCreateRq{
+		AffectedSOPClassUID: ct,
+		MessageID:           1,
+		CommandDataSetType:  dimse.CommandDataSetTypeNonNull,
+	}, []byte{0x08, 0x00, 0x18, 0x00, 0x06, 0x00, 0x00, 0x00, '1', '.', '2', '.', '3', 0})
+	_, msg, data := p.expectDIMSE(dimse.CommandFieldNCreateRsp)
+	require.Equal(t, dimse.Success, *msg.GetStatus())
+	require.Equal(t, "1.2.3.4", msg.(*dimse.NCreateRsp).AffectedSOPInstanceUID)
+	require.Empty(t, data)
+	rq := <-requests
+	require.IsType(t, &dimse.NCreateRq{}, rq.Command)
+	require.Equal(t, ct, rq.SOPClassUID)
+	require.Len(t, rq.Elements, 1)
+	p.sendReleaseRQ()
+	p.expectReleaseRP()
+
+	p = newScriptedUser(t, ServiceProviderParams{})
+	p.sendAssociateRQ("SCRIPTED-USER", pctx(ct, dicomuid.ImplicitVRLittleEndian))
+	p.expectAssociateAC(pctx(ct, dicomuid.ImplicitVRLittleEndian))
+	p.sendDIMSE(ct, &dimse.NSetRq{
+		RequestedSOPClassUID:    ct,
+		MessageID:               1,
+		CommandDataSetType:      dimse.CommandDataSetTypeNull,
+		RequestedSOPInstanceUID: "1.2.3.4",
+	}, nil)
+	_, msg, _ = p.expectDIMSE(dimse.CommandFieldNSetRsp)
+	require.Equal(t, dimse.StatusUnrecognizedOperation, msg.GetStatus().Status)
+	require.Equal(t, "1.2.3.4", msg.(*dimse.NSetRsp).AffectedSOPInstanceUID)
+	p.sendReleaseRQ()
+	p.expectReleaseRP()
+}
+
+// The context of the association is cancelled when the peer aborts, while
+// the handler still runs.
+func TestScriptProviderContextCancelledOnAbort(t *testing.T) {
+	started := make(chan context.Context, 1)
+	p := newScriptedUser(t, ServiceProviderParams{
+		CEcho: func(conn ConnectionState) dimse.Status {
+			started <- conn.Context()
+			<-conn.Context().Done()
+			return dimse.Success
+		},
+	})
+	p.sendAssociateRQ("SCRIPTED-USER", pctx(dicomuid.VerificationSOPClass, dicomuid.ImplicitVRLittleEndian))
+	p.expectAssociateAC(pctx(dicomuid.VerificationSOPClass, dicomuid.ImplicitVRLittleEndian))
+	p.sendDIMSE(dicomuid.VerificationSOPClass, &dimse.CEchoRq{
+		MessageID:          1,
+		CommandDataSetType: dimse.CommandDataSetTypeNull,
+	}, nil)
+	ctx := <-started
+	require.NoError(t, ctx.Err())
+	p.send(&pdu.AAbort{Source: pdu.AbortSourceServiceUser})
+	select {
+	case <-ctx.Done():
+	case <-time.After(scriptTimeout):
+		t.Fatal("context not cancelled")
+	}
+}
+
+// A second A-ASSOCIATE-RQ on an established association is a protocol error:
+// the provider aborts (AA-8).
+func TestScriptProviderSecondAssociateRQ(t *testing.T) {
+	errCh := make(chan error, 1)
+	p := newScriptedUser(t, ServiceProviderParams{
+		CEcho:            func(conn ConnectionState) dimse.Status { return dimse.Success },
+		AssociationError: func(conn ConnectionState, err error) { errCh <- err },
+	})
+	p.sendAssociateRQ("SCRIPTED-USER", pctx(dicomuid.VerificationSOPClass, dicomuid.ImplicitVRLittleEndian))
+	p.expectAssociateAC(pctx(dicomuid.VerificationSOPClass, dicomuid.ImplicitVRLittleEndian))
+	p.sendAssociateRQ("SCRIPTED-USER", pctx(dicomuid.VerificationSOPClass, dicomuid.ImplicitVRLittleEndian))
+	abort := p.expectAbort()
+	require.Equal(t, pdu.AbortSourceServiceProvider, abort.Source)
+	require.Equal(t, pdu.AbortReasonUnexpectedPDU, abort.Reason)
+	require.True(t, errors.Is(<-errCh, ErrSecondAssociationRequest))
+}
+
+// After a release, the connection can't carry another association: the
+// provider answers a new A-ASSOCIATE-RQ with A-ABORT (AA-7).
+func TestScriptProviderAssociateRQAfterRelease(t *testing.T) {
+	p := newScriptedUser(t, ServiceProviderParams{
+		CEcho: func(conn ConnectionState) dimse.Status { return dimse.Success },
+	})
+	p.sendAssociateRQ("SCRIPTED-USER", pctx(dicomuid.VerificationSOPClass, dicomuid.ImplicitVRLittleEndian))
+	p.expectAssociateAC(pctx(dicomuid.VerificationSOPClass, dicomuid.ImplicitVRLittleEndian))
+	p.sendReleaseRQ()
+	p.expectReleaseRP()
+	p.sendAssociateRQ("SCRIPTED-USER", pctx(dicomuid.VerificationSOPClass, dicomuid.ImplicitVRLittleEndian))
+	p.expectAbort()
+}
+
+// A provider that sends A-ASSOCIATE-RQ to the user once the association is
+// established gets aborted.
+func TestScriptUserAssociateRQFromProvider(t *testing.T) {
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.VerificationClasses})
+	require.NoError(t, err)
+	p := newScriptedProvider(t, su)
+	errCh := make(chan error, 1)
+	go func() { errCh <- su.CEcho() }()
+
+	rq := p.expectAssociateRQ()
+	p.acceptAssociate(rq, pctx(dicomuid.VerificationSOPClass, dicomuid.ImplicitVRLittleEndian))
+	p.expectDIMSE(dimse.CommandFieldCEchoRq)
+	p.sendAssociateRQ("SCRIPTED-SCP", pctx(dicomuid.VerificationSOPClass, dicomuid.ImplicitVRLittleEndian))
+	p.expectAbort()
+	err = <-errCh
+	require.True(t, errors.Is(err, ErrSecondAssociationRequest), "%v", err)
+}
+
+// AssociateAC returns the A-ASSOCIATE-AC as received, private sub-items
+// included.
+func TestScriptUserAssociateAC(t *testing.T) {
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.VerificationClasses})
+	require.NoError(t, err)
+	p := newScriptedProvider(t, su)
+	private := &pdu.SubItemUnsupported{Type: 0xe0, Data: []byte("vendor data")}
+	p.userInfo = []pdu.SubItem{private}
+	type acResult struct {
+		ac  *pdu.AAssociate
+		err error
+	}
+	acCh := make(chan acResult, 1)
+	go func() {
+		ac, err := su.AssociateAC()
+		acCh <- acResult{ac, err}
+	}()
+
+	rq := p.expectAssociateRQ(pctx(dicomuid.VerificationSOPClass, StandardTransferSyntaxes...))
+	p.acceptAssociate(rq, pctx(dicomuid.VerificationSOPClass, dicomuid.ExplicitVRLittleEndian))
+	r := <-acCh
+	require.NoError(t, r.err)
+	ac := r.ac
+	require.Equal(t, pdu.TypeAAssociateAc, ac.Type)
+	var found []pdu.SubItem
+	for _, item := range ac.Items {
+		if ui, ok := item.(*pdu.UserInformationItem); ok {
+			for _, subItem := range ui.Items {
+				if _, ok := subItem.(*pdu.SubItemUnsupported); ok {
+					found = append(found, subItem)
+				}
+			}
+		}
+	}
+	require.Equal(t, []pdu.SubItem{private}, found)
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- su.Release() }()
+	p.expectReleaseRQ()
+	p.sendReleaseRP()
+	p.expectClosed()
+	require.NoError(t, <-errCh)
+}
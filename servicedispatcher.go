@@ -10,7 +10,8 @@ import (
 
 // serviceDispatcher multiplexes statemachine upcall events to DIMSE commands.
 type serviceDispatcher struct {
-	label      string          // for logging.
+	label      string // for logging.
+	logf       Logger
 	downcallCh chan stateEvent // for sending PDUs to the statemachine.
 
 	mu sync.Mutex
@@ -26,6 +27,26 @@ type serviceDispatcher struct {
 	// The last message ID used in newCommand(). Used to avoid creating duplicate
 	// IDs.
 	lastMessageID dimse.MessageID
+
+	// The reason the association failed, as reported by the statemachine.
+	err error // guarded by mu
+
+	// Resource accounting for the association. May be nil.
+	stats *associationStats
+
+	// If true, a message that no command or callback claims aborts the
+	// association. See handleUnexpectedMessage.
+	abortOnUnexpected bool
+
+	// Runs the callbacks. If nil, each callback runs in a new goroutine.
+	exec *handlerExecutor
+
+	// What to do with a request the peer's negotiated role doesn't allow.
+	rolePolicy RoleViolationPolicy
+
+	// Closed by close(), once the association has ended. See sendDowncall.
+	done   chan struct{}
+	closed bool // guarded by mu
 }
 
 type serviceCallback func(msg dimse.Message, data []byte, cs *serviceCommandState)
@@ -39,28 +60,78 @@ type serviceCommandState struct {
 
 	// upcallCh streams command+data for this messageID.
 	upcallCh chan upcallEvent
+
+	// If non-nil, the request was rejected while its data was being
+	// received, and the response must carry this status.
+	rejectStatus *dimse.Status
+
+	// If non-nil, the request is a C-STORE whose dataset is streamed
+	// through this reader instead of being passed as data.
+	stream *cstoreStream
+
+	// The digest of the data, computed while it was received, if
+	// ServiceProviderParams.CStoreWithDigest is set.
+	digest []byte
 }
 
 // Send a command+data combo to the remote peer. data may be nil.
 func (cs *serviceCommandState) sendMessage(cmd dimse.Message, data []byte) {
 	if s := cmd.GetStatus(); s != nil && s.Status != dimse.StatusSuccess && s.Status != dimse.StatusPending {
-		dicomlog.Vprintf(0, "dicom.serviceDispatcher(%s): Sending DIMSE error: %v %v", cs.disp.label, cmd, cs.disp)
+		cs.disp.logf(0, "dicom.serviceDispatcher(%s): Sending DIMSE error: %v %v", cs.disp.label, cmd, cs.disp)
 	} else {
-		dicomlog.Vprintf(1, "dicom.serviceDispatcher(%s): Sending DIMSE message: %v %v", cs.disp.label, cmd, cs.disp)
+		cs.disp.logf(1, "dicom.serviceDispatcher(%s): Sending DIMSE message: %v %v", cs.disp.label, cmd, cs.disp)
 	}
 	payload := &stateEventDIMSEPayload{
-		abstractSyntaxName: cs.context.abstractSyntaxUID,
-		command:            cmd,
-		data:               data,
+		contextID: cs.context.contextID,
+		command:   cmd,
+		data:      data,
 	}
-	cs.disp.downcallCh <- stateEvent{
+	cs.disp.sendDowncall(stateEvent{
 		event:        evt09,
 		pdu:          nil,
 		conn:         nil,
 		dimsePayload: payload,
+	})
+}
+
+// Send several command+data combos to the remote peer, in order, packed into
+// as few P_DATA_TF PDUs as they fit in. data[i] may be nil.
+func (cs *serviceCommandState) sendMessages(cmds []dimse.Message, data [][]byte) {
+	payload := &stateEventDIMSEPayload{}
+	for i, cmd := range cmds {
+		cs.disp.logf(1, "dicom.serviceDispatcher(%s): Sending DIMSE message: %v %v", cs.disp.label, cmd, cs.disp)
+		payload.batch = append(payload.batch, &stateEventDIMSEPayload{
+			contextID: cs.context.contextID,
+			command:   cmd,
+			data:      data[i],
+		})
+	}
+	cs.disp.sendDowncall(stateEvent{
+		event:        evt09,
+		dimsePayload: payload,
+	})
+}
+
+// Send an event to the statemachine. The event is dropped once the association
+// has ended, e.g., because the peer closed the connection: the statemachine no
+// longer reads downcallCh, and a handler blocked on it would never return.
+func (disp *serviceDispatcher) sendDowncall(event stateEvent) {
+	select {
+	case disp.downcallCh <- event:
+	case <-disp.done:
+		disp.logf(1, "dicom.serviceDispatcher(%s): Association ended; dropping event %v", disp.label, event.event)
 	}
 }
 
+// Abort the association because the peer answered this command with "got"
+// instead of a "want" message. Returns the error to report to the caller.
+func (cs *serviceCommandState) abortUnexpectedCommand(want string, got dimse.Message) error {
+	err := &UnexpectedCommandError{Want: want, Got: got}
+	cs.disp.logf(0, "dicom.serviceDispatcher(%s): %v; aborting", cs.disp.label, err)
+	cs.disp.sendDowncall(stateEvent{event: evt15})
+	return err
+}
+
 func (disp *serviceDispatcher) findOrCreateCommand(
 	msgID dimse.MessageID,
 	cm *contextManager,
@@ -78,7 +149,7 @@ func (disp *serviceDispatcher) findOrCreateCommand(
 		upcallCh:  make(chan upcallEvent, 128),
 	}
 	disp.activeCommands[msgID] = cs
-	dicomlog.Vprintf(1, "dicom.serviceDispatcher(%s): Start command %+v", disp.label, cs)
+	disp.logf(1, "dicom.serviceDispatcher(%s): Start command %+v", disp.label, cs)
 	return cs, false
 }
 
@@ -103,7 +174,7 @@ func (disp *serviceDispatcher) newCommand(
 		}
 		disp.activeCommands[msgID] = cs
 		disp.lastMessageID = msgID
-		dicomlog.Vprintf(1, "dicom.serviceDispatcher: Start new command %+v", cs)
+		disp.logf(1, "dicom.serviceDispatcher: Start new command %+v", cs)
 		return cs, nil
 	}
 	return nil, fmt.Errorf("Failed to allocate a message ID (too many outstading?)")
@@ -111,7 +182,7 @@ func (disp *serviceDispatcher) newCommand(
 
 func (disp *serviceDispatcher) deleteCommand(cs *serviceCommandState) {
 	disp.mu.Lock()
-	dicomlog.Vprintf(1, "dicom.serviceDispatcher(%s): Finish provider command %v", disp.label, cs.messageID)
+	disp.logf(1, "dicom.serviceDispatcher(%s): Finish provider command %v", disp.label, cs.messageID)
 	if _, ok := disp.activeCommands[cs.messageID]; !ok {
 		panic(fmt.Sprintf("cs %+v", cs))
 	}
@@ -135,34 +206,164 @@ func (disp *serviceDispatcher) handleEvent(event upcallEvent) {
 	if event.eventType == upcallEventHandshakeCompleted {
 		return
 	}
+	if event.eventType == upcallEventError {
+		disp.logf(0, "dicom.serviceDispatcher(%s): Association failed: %v", disp.label, event.err)
+		disp.mu.Lock()
+		if disp.err == nil {
+			disp.err = event.err
+		}
+		disp.mu.Unlock()
+		return
+	}
 	doassert(event.eventType == upcallEventData)
 	doassert(event.command != nil)
 	context, err := event.cm.lookupByContextID(event.contextID)
 	if err != nil {
-		dicomlog.Vprintf(0, "dicom.serviceDispatcher(%s): Invalid context ID %d: %v", disp.label, event.contextID, err)
-		disp.downcallCh <- stateEvent{event: evt19, pdu: nil, err: err}
+		disp.logf(0, "dicom.serviceDispatcher(%s): Invalid context ID %d: %v", disp.label, event.contextID, err)
+		disp.sendDowncall(stateEvent{event: evt19, pdu: nil, err: err})
 		return
 	}
 	messageID := event.command.GetMessageID()
 	dc, found := disp.findOrCreateCommand(messageID, event.cm, context)
 	if found {
-		dicomlog.Vprintf(1, "dicom.serviceDispatcher(%s): Forwarding command to existing command: %+v %+v", disp.label, event.command, dc)
+		disp.logf(1, "dicom.serviceDispatcher(%s): Forwarding command to existing command: %+v %+v", disp.label, event.command, dc)
 		dc.upcallCh <- event
-		dicomlog.Vprintf(1, "dicom.serviceDispatcher(%s): Done forwarding command to existing command: %+v %+v", disp.label, event.command, dc)
+		disp.logf(1, "dicom.serviceDispatcher(%s): Done forwarding command to existing command: %+v %+v", disp.label, event.command, dc)
+		return
+	}
+	dc.rejectStatus = event.status
+	dc.stream = event.stream
+	dc.digest = event.digest
+	if disp.rejectRoleViolation(event.command, context, dc) {
+		disp.discardStream(dc)
+		disp.deleteCommand(dc)
 		return
 	}
 	disp.mu.Lock()
 	cb := disp.callbacks[event.command.CommandField()]
 	disp.mu.Unlock()
-	go func() {
+	if cb == nil {
+		disp.handleUnexpectedMessage(event.command, dc)
+		disp.discardStream(dc)
+		disp.deleteCommand(dc)
+		return
+	}
+	disp.stats.addHandlerBytes(len(event.data))
+	if !disp.exec.run(disp.stats, event.command.CommandField(), func() {
+		defer disp.stats.addHandlerBytes(-len(event.data))
 		cb(event.command, event.data, dc)
 		disp.deleteCommand(dc)
-	}()
+	}) {
+		// The peer ignores the operation window it was given.
+		disp.logf(0, "dicom.serviceDispatcher(%s): Too many requests outstanding; aborting", disp.label)
+		disp.stats.addHandlerBytes(-len(event.data))
+		disp.discardStream(dc)
+		disp.deleteCommand(dc)
+		disp.sendDowncall(stateEvent{event: evt15})
+	}
+}
+
+// Drop the rest of the streamed dataset of a request that won't be handled,
+// so that it doesn't hold back the network reader.
+func (disp *serviceDispatcher) discardStream(cs *serviceCommandState) {
+	if cs.stream != nil {
+		cs.stream.Close()
+	}
+}
+
+// Handle a message that no command or callback claims: a response whose
+// message ID matches no outstanding request, or a request of a type we don't
+// serve. The message is logged and counted. Then the association is aborted
+// if abortOnUnexpected; otherwise a response is dropped, and a request is
+// answered with "unrecognized operation".
+func (disp *serviceDispatcher) handleUnexpectedMessage(msg dimse.Message, cs *serviceCommandState) {
+	disp.stats.addUnexpectedMessage()
+	if disp.abortOnUnexpected {
+		disp.logf(0, "dicom.serviceDispatcher(%s): Unexpected message %v; aborting", disp.label, msg)
+		disp.sendDowncall(stateEvent{event: evt15})
+		return
+	}
+	resp := unrecognizedOperationResponse(msg)
+	if resp == nil {
+		disp.logf(0, "dicom.serviceDispatcher(%s): Dropping unexpected message %v", disp.label, msg)
+		return
+	}
+	disp.logf(0, "dicom.serviceDispatcher(%s): Rejecting unexpected request %v", disp.label, msg)
+	cs.sendMessage(resp, nil)
 }
 
-// Must be called exactly once to shut down the dispatcher.
+// Build the response to a request that we don't serve. Returns nil if "msg"
+// is not a request.
+func unrecognizedOperationResponse(msg dimse.Message) dimse.Message {
+	return failureResponse(msg, dimse.Status{Status: dimse.StatusUnrecognizedOperation})
+}
+
+// Build a response to the request "msg" that carries "status" and no data.
+// Returns nil if "msg" is not a request.
+func failureResponse(msg dimse.Message, status dimse.Status) dimse.Message {
+	switch m := msg.(type) {
+	case *dimse.CStoreRq:
+		return &dimse.CStoreRsp{
+			AffectedSOPClassUID:       m.AffectedSOPClassUID,
+			MessageIDBeingRespondedTo: m.MessageID,
+			CommandDataSetType:        dimse.CommandDataSetTypeNull,
+			AffectedSOPInstanceUID:    m.AffectedSOPInstanceUID,
+			Status:                    status,
+		}
+	case *dimse.CFindRq:
+		return &dimse.CFindRsp{
+			AffectedSOPClassUID:       m.AffectedSOPClassUID,
+			MessageIDBeingRespondedTo: m.MessageID,
+			CommandDataSetType:        dimse.CommandDataSetTypeNull,
+			Status:                    status,
+		}
+	case *dimse.CGetRq:
+		return &dimse.CGetRsp{
+			AffectedSOPClassUID:       m.AffectedSOPClassUID,
+			MessageIDBeingRespondedTo: m.MessageID,
+			CommandDataSetType:        dimse.CommandDataSetTypeNull,
+			Status:                    status,
+		}
+	case *dimse.CMoveRq:
+		return &dimse.CMoveRsp{
+			AffectedSOPClassUID:       m.AffectedSOPClassUID,
+			MessageIDBeingRespondedTo: m.MessageID,
+			CommandDataSetType:        dimse.CommandDataSetTypeNull,
+			Status:                    status,
+		}
+	case *dimse.CEchoRq:
+		return &dimse.CEchoRsp{
+			MessageIDBeingRespondedTo: m.MessageID,
+			CommandDataSetType:        dimse.CommandDataSetTypeNull,
+			Status:                    status,
+		}
+	}
+	return nResponse(msg, status, "", dimse.CommandDataSetTypeNull)
+}
+
+// Create an error to be returned by a command whose upcallCh was closed. The
+// error wraps the reason the association failed, if known, so that callers can
+// inspect it with errors.As.
+func (disp *serviceDispatcher) closeError(format string, args ...interface{}) error {
+	msg := fmt.Sprintf(format, args...)
+	disp.mu.Lock()
+	defer disp.mu.Unlock()
+	if disp.err != nil {
+		return fmt.Errorf("%s: %w", msg, disp.err)
+	}
+	return fmt.Errorf("%s", msg)
+}
+
+// Shuts down the dispatcher once the association has ended. Later calls are
+// no-ops.
 func (disp *serviceDispatcher) close() {
 	disp.mu.Lock()
+	if disp.closed {
+		disp.mu.Unlock()
+		return
+	}
+	disp.closed = true
+	close(disp.done)
 	for _, cs := range disp.activeCommands {
 		close(cs.upcallCh)
 	}
@@ -173,9 +374,11 @@ func (disp *serviceDispatcher) close() {
 func newServiceDispatcher(label string) *serviceDispatcher {
 	return &serviceDispatcher{
 		label:          label,
+		logf:           dicomlog.Vprintf,
 		downcallCh:     make(chan stateEvent, 128),
 		activeCommands: make(map[dimse.MessageID]*serviceCommandState),
 		callbacks:      make(map[int]serviceCallback),
 		lastMessageID:  123,
+		done:           make(chan struct{}),
 	}
 }
@@ -4,14 +4,25 @@ package netdicom
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/binary"
 	"fmt"
+	"hash"
+	"io"
 	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 
 	dicom "github.com/antibios/dicom"
+	dicomtag "github.com/antibios/dicom/pkg/tag"
+	dicomuid "github.com/antibios/dicom/pkg/uid"
 	"github.com/antibios/go-dicom/dicomlog"
 	"github.com/antibios/go-netdicom/dimse"
+	"github.com/antibios/go-netdicom/pdu"
 	"github.com/antibios/go-netdicom/sopclass"
 )
 
@@ -23,13 +34,113 @@ type CMoveResult struct {
 	DataSet   *dicom.Dataset // Contents of the file.
 }
 
+// Maximum length of the Error Comment of a status, an LO.
+const maxErrorCommentLength = 64
+
+// Returns "msg" cut short, at a character boundary, to fit in an Error
+// Comment.
+func errorComment(msg string) string {
+	if len(msg) <= maxErrorCommentLength {
+		return msg
+	}
+	n := maxErrorCommentLength
+	for n > 0 && !utf8.RuneStart(msg[n]) {
+		n--
+	}
+	return msg[:n]
+}
+
 func handleCStore(
-	cb CStoreCallback,
+	params ServiceProviderParams,
 	connState ConnectionState,
 	c *dimse.CStoreRq, data []byte,
 	cs *serviceCommandState) {
-	status := dimse.Status{Status: dimse.StatusUnrecognizedOperation}
-	if cb != nil {
+	var status dimse.Status
+	rejectStatus := cs.rejectStatus
+	var coercions []Coercion
+	var stream io.Reader
+	if cs.stream != nil {
+		stream = cs.stream
+	}
+	if rejectStatus == nil && params.CStoreCoerce != nil {
+		var err error
+		if stream != nil {
+			stream, coercions, err = coerceCStoreStream(params, connState, cs.context.transferSyntaxUID,
+				c.AffectedSOPClassUID, c.AffectedSOPInstanceUID, stream)
+		} else {
+			var coerced []byte
+			if coerced, coercions, err = coerceCStoreData(params, connState, cs.context.transferSyntaxUID,
+				c.AffectedSOPClassUID, c.AffectedSOPInstanceUID, data); err == nil {
+				data = coerced
+			}
+		}
+		if err != nil {
+			cs.disp.logf(0, "dicom.serviceProvider: C-STORE %s: %v", c.AffectedSOPInstanceUID, err)
+			rejectStatus = &dimse.Status{Status: dimse.CStoreCannotUnderstand, ErrorComment: errorComment(err.Error())}
+		}
+	}
+	if rejectStatus != nil {
+		status = *rejectStatus
+		if cs.stream != nil {
+			// Respond once the whole dataset has arrived.
+			io.Copy(io.Discard, cs.stream)
+		}
+	} else if cs.stream != nil {
+		var head *headRecorder
+		if params.Events != nil {
+			head = &headRecorder{r: stream}
+			stream = head
+		}
+		if params.DataDigest != nil {
+			stream = &digestReader{r: stream, h: params.DataDigest()}
+		}
+		status = params.CStoreStream(
+			connState,
+			cs.context.transferSyntaxUID,
+			c.AffectedSOPClassUID,
+			c.AffectedSOPInstanceUID,
+			c.Priority,
+			stream)
+		// Respond once the whole dataset has arrived. The rest goes
+		// through "head", in case the handler didn't read that far.
+		io.Copy(io.Discard, stream)
+		io.Copy(io.Discard, cs.stream)
+		if head != nil {
+			data = head.head
+		}
+	} else if params.CStoreWithDigest != nil {
+		digest := cs.digest
+		if len(coercions) > 0 || digest == nil {
+			// The data differs from what was digested as it arrived.
+			h := params.DataDigest()
+			h.Write(data)
+			digest = h.Sum(nil)
+		}
+		status = params.CStoreWithDigest(
+			connState,
+			cs.context.transferSyntaxUID,
+			c.AffectedSOPClassUID,
+			c.AffectedSOPInstanceUID,
+			c.CalledApplicationEntityTitle,
+			c.MoveOriginatorApplicationEntityTitle,
+			data,
+			digest)
+	} else if params.CStoreHandlers != nil {
+		status = params.CStoreHandlers.CStore(
+			connState,
+			cs.context.transferSyntaxUID,
+			c.AffectedSOPClassUID,
+			c.AffectedSOPInstanceUID,
+			c.CalledApplicationEntityTitle,
+			c.MoveOriginatorApplicationEntityTitle,
+			data)
+	} else if cb := params.CStoreDataset; cb != nil {
+		status = cb(connState, NewRawDataset(
+			c.AffectedSOPClassUID,
+			c.AffectedSOPInstanceUID,
+			cs.context.transferSyntaxUID,
+			data))
+	} else if cb := params.CStore; cb != nil {
 		status = cb(
 			connState,
 			cs.context.transferSyntaxUID,
@@ -38,6 +149,18 @@ func handleCStore(
 			c.CalledApplicationEntityTitle,
 			c.MoveOriginatorApplicationEntityTitle,
 			data)
+	} else {
+		status = dimse.Status{Status: dimse.CStoreRefusedSOPClassNotSupported, ErrorComment: "No callback found for C-STORE"}
+	}
+	if rejectStatus == nil && status.Status == dimse.StatusSuccess {
+		if params.Events != nil {
+			params.Events.publishInstance(connState, cs.context.transferSyntaxUID,
+				c.AffectedSOPClassUID, c.AffectedSOPInstanceUID, data)
+		}
+		if len(coercions) > 0 && params.CStoreCoerced != nil {
+			params.CStoreCoerced(connState, c.AffectedSOPClassUID, c.AffectedSOPInstanceUID, coercions)
+		}
+		status = coercedCStoreStatus(status, coercions)
 	}
 	resp := &dimse.CStoreRsp{
 		AffectedSOPClassUID:       c.AffectedSOPClassUID,
@@ -73,13 +196,32 @@ func handleCFind(
 		}, nil)
 		return
 	}
-	dicomlog.Vprintf(1, "dicom.serviceProvider: C-FIND-RQ payload: %s", elementsString(elems))
+	cs.disp.logf(1, "dicom.serviceProvider: C-FIND-RQ payload: %s", elementsString(elems))
 
 	status := dimse.Status{Status: dimse.StatusSuccess}
 	responseCh := make(chan CFindResult, 128)
-	go func() {
+	cs.disp.stats.goFunc(func() {
 		params.CFind(connState, cs.context.transferSyntaxUID, c.AffectedSOPClassUID, elems, responseCh)
-	}()
+	})
+	var batch []dimse.Message
+	var batchData [][]byte
+	flushed := false
+	flush := func() {
+		if flushed && params.CFindBatchDelay > 0 {
+			// Pace the peer, unless the association is gone.
+			select {
+			case <-time.After(params.CFindBatchDelay):
+			case <-cs.disp.done:
+			}
+		}
+		if len(batch) == 1 {
+			cs.sendMessage(batch[0], batchData[0])
+		} else {
+			cs.sendMessages(batch, batchData)
+		}
+		batch, batchData, flushed = nil, nil, true
+	}
+	numMatches := 0
 	for resp := range responseCh {
 		if resp.Err != nil {
 			status = dimse.Status{
@@ -88,22 +230,37 @@ func handleCFind(
 			}
 			break
 		}
-		dicomlog.Vprintf(1, "dicom.serviceProvider: C-FIND-RSP: %s", elementsString(resp.Elements))
+		if params.CFindMaxResults > 0 && numMatches >= params.CFindMaxResults {
+			cs.disp.logf(0, "dicom.serviceProvider: C-FIND: more than %d matches; dropping the rest", params.CFindMaxResults)
+			status = params.CFindMaxResultsStatus
+			break
+		}
+		numMatches++
+		cs.disp.logf(1, "dicom.serviceProvider: C-FIND-RSP: %s", elementsString(resp.Elements))
 		payload, err := writeElementsToBytes(resp.Elements, cs.context.transferSyntaxUID)
 		if err != nil {
-			dicomlog.Vprintf(0, "dicom.serviceProvider: C-FIND: encode error %v", err)
+			cs.disp.logf(0, "dicom.serviceProvider: C-FIND: encode error %v", err)
 			status = dimse.Status{
 				Status:       dimse.CFindUnableToProcess,
 				ErrorComment: err.Error(),
 			}
 			break
 		}
-		cs.sendMessage(&dimse.CFindRsp{
+		batch = append(batch, &dimse.CFindRsp{
 			AffectedSOPClassUID:       c.AffectedSOPClassUID,
 			MessageIDBeingRespondedTo: c.MessageID,
 			CommandDataSetType:        dimse.CommandDataSetTypeNonNull,
 			Status:                    dimse.Status{Status: dimse.StatusPending},
-		}, payload)
+		})
+		batchData = append(batchData, payload)
+		// Don't hold back the responses we have while the callback
+		// produces more.
+		if len(batch) >= params.CFindBatchSize || len(responseCh) == 0 {
+			flush()
+		}
+	}
+	if len(batch) > 0 {
+		flush()
 	}
 	cs.sendMessage(&dimse.CFindRsp{
 		AffectedSOPClassUID:       c.AffectedSOPClassUID,
@@ -137,9 +294,14 @@ func handleCMove(
 		}, nil)
 		return
 	}
-	remoteHostPort, ok := params.RemoteAEs[c.MoveDestination]
-	if !ok {
-		sendError(fmt.Errorf("C-MOVE destination '%v' not registered in the server", c.MoveDestination))
+	remoteHostPort, err := resolveAE(params, c.MoveDestination)
+	if err != nil {
+		cs.sendMessage(&dimse.CMoveRsp{
+			AffectedSOPClassUID:       c.AffectedSOPClassUID,
+			MessageIDBeingRespondedTo: c.MessageID,
+			CommandDataSetType:        dimse.CommandDataSetTypeNull,
+			Status:                    dimse.StatusMoveDestinationUnknown(fmt.Sprintf("C-MOVE destination: %v", err)),
+		}, nil)
 		return
 	}
 	elems, err := readElementsInBytes(data, cs.context.transferSyntaxUID)
@@ -147,14 +309,26 @@ func handleCMove(
 		sendError(err)
 		return
 	}
-	dicomlog.Vprintf(1, "dicom.serviceProvider: C-MOVE-RQ payload: %s", elementsString(elems))
+	cs.disp.logf(1, "dicom.serviceProvider: C-MOVE-RQ payload: %s", elementsString(elems))
 	responseCh := make(chan CMoveResult, 128)
-	go func() {
+	cs.disp.stats.goFunc(func() {
 		params.CMove(connState, cs.context.transferSyntaxUID, c.AffectedSOPClassUID, elems, responseCh)
-	}()
-	// responseCh :=
+	})
+	subAssocs := newCMoveSubAssociations(params, c.MoveDestination, remoteHostPort)
+	defer subAssocs.close()
+	replicator := newCMoveReplicator(params)
 	status := dimse.Status{Status: dimse.StatusSuccess}
-	var numSuccesses, numFailures uint16
+	subOps := newSubOperations(cs.disp.stats, cmoveConcurrency(params, c.MoveDestination), func(remaining int, completed, failed uint16) {
+		cs.sendMessage(&dimse.CMoveRsp{
+			AffectedSOPClassUID:            c.AffectedSOPClassUID,
+			MessageIDBeingRespondedTo:      c.MessageID,
+			CommandDataSetType:             dimse.CommandDataSetTypeNull,
+			NumberOfRemainingSuboperations: uint16(remaining),
+			NumberOfCompletedSuboperations: completed,
+			NumberOfFailedSuboperations:    failed,
+			Status:                         dimse.Status{Status: dimse.StatusPending},
+		}, nil)
+	})
 	for resp := range responseCh {
 		if resp.Err != nil {
 			status = dimse.Status{
@@ -163,24 +337,26 @@ func handleCMove(
 			}
 			break
 		}
-		dicomlog.Vprintf(0, "dicom.serviceProvider: C-MOVE: Sending %v to %v(%s)", resp.Path, c.MoveDestination, remoteHostPort)
-		err := runCStoreOnNewAssociation(params.AETitle, c.MoveDestination, remoteHostPort, resp.DataSet)
-		if err != nil {
-			dicomlog.Vprintf(0, "dicom.serviceProvider: C-MOVE: C-store of %v to %v(%v) failed: %v", resp.Path, c.MoveDestination, remoteHostPort, err)
-			numFailures++
-		} else {
-			numSuccesses++
+		if replicator != nil {
+			var replicas []string
+			for _, aeTitle := range params.CMoveReplicas(connState, c.MoveDestination, resp.DataSet) {
+				if aeTitle != c.MoveDestination {
+					replicas = append(replicas, aeTitle)
+				}
+			}
+			replicator.send(replicas, resp.DataSet)
 		}
-		cs.sendMessage(&dimse.CMoveRsp{
-			AffectedSOPClassUID:            c.AffectedSOPClassUID,
-			MessageIDBeingRespondedTo:      c.MessageID,
-			CommandDataSetType:             dimse.CommandDataSetTypeNull,
-			NumberOfRemainingSuboperations: uint16(resp.Remaining),
-			NumberOfCompletedSuboperations: numSuccesses,
-			NumberOfFailedSuboperations:    numFailures,
-			Status:                         dimse.Status{Status: dimse.StatusPending},
-		}, nil)
+		resp := resp
+		subOps.start(resp.Remaining, func() error {
+			cs.disp.logf(0, "dicom.serviceProvider: C-MOVE: Sending %v to %v(%s)", resp.Path, c.MoveDestination, remoteHostPort)
+			err := subAssocs.cstore(resp.DataSet)
+			if err != nil {
+				cs.disp.logf(0, "dicom.serviceProvider: C-MOVE: C-store of %v to %v(%v) failed: %v", resp.Path, c.MoveDestination, remoteHostPort, err)
+			}
+			return err
+		})
 	}
+	numSuccesses, numFailures := subOps.wait()
 	cs.sendMessage(&dimse.CMoveRsp{
 		AffectedSOPClassUID:            c.AffectedSOPClassUID,
 		MessageIDBeingRespondedTo:      c.MessageID,
@@ -191,6 +367,12 @@ func handleCMove(
 	// Drain the responses in case of errors
 	for range responseCh {
 	}
+	if replicator != nil {
+		counts := replicator.finish()
+		if params.CMoveReplicasDone != nil {
+			params.CMoveReplicasDone(connState, c.MoveDestination, counts)
+		}
+	}
 }
 
 func handleCGet(
@@ -219,13 +401,23 @@ func handleCGet(
 		sendError(err)
 		return
 	}
-	dicomlog.Vprintf(1, "dicom.serviceProvider: C-GET-RQ payload: %s", elementsString(elems))
+	cs.disp.logf(1, "dicom.serviceProvider: C-GET-RQ payload: %s", elementsString(elems))
 	responseCh := make(chan CMoveResult, 128)
-	go func() {
+	cs.disp.stats.goFunc(func() {
 		params.CGet(connState, cs.context.transferSyntaxUID, c.AffectedSOPClassUID, elems, responseCh)
-	}()
+	})
 	status := dimse.Status{Status: dimse.StatusSuccess}
-	var numSuccesses, numFailures uint16
+	subOps := newSubOperations(cs.disp.stats, cgetConcurrency(params, cs), func(remaining int, completed, failed uint16) {
+		cs.sendMessage(&dimse.CGetRsp{
+			AffectedSOPClassUID:            c.AffectedSOPClassUID,
+			MessageIDBeingRespondedTo:      c.MessageID,
+			CommandDataSetType:             dimse.CommandDataSetTypeNull,
+			NumberOfRemainingSuboperations: uint16(remaining),
+			NumberOfCompletedSuboperations: completed,
+			NumberOfFailedSuboperations:    failed,
+			Status:                         dimse.Status{Status: dimse.StatusPending},
+		}, nil)
+	})
 	for resp := range responseCh {
 		if resp.Err != nil {
 			status = dimse.Status{
@@ -242,25 +434,19 @@ func handleCGet(
 			}
 			break
 		}
-		err = runCStoreOnAssociation(subCs.upcallCh, subCs.disp.downcallCh, subCs.cm, subCs.messageID, resp.DataSet)
-		if err != nil {
-			dicomlog.Vprintf(0, "dicom.serviceProvider: C-GET: C-store of %v failed: %v", resp.Path, err)
-			numFailures++
-		} else {
-			dicomlog.Vprintf(0, "dicom.serviceProvider: C-GET: Sent %v", resp.Path)
-			numSuccesses++
-		}
-		cs.sendMessage(&dimse.CGetRsp{
-			AffectedSOPClassUID:            c.AffectedSOPClassUID,
-			MessageIDBeingRespondedTo:      c.MessageID,
-			CommandDataSetType:             dimse.CommandDataSetTypeNull,
-			NumberOfRemainingSuboperations: uint16(resp.Remaining),
-			NumberOfCompletedSuboperations: numSuccesses,
-			NumberOfFailedSuboperations:    numFailures,
-			Status:                         dimse.Status{Status: dimse.StatusPending},
-		}, nil)
-		cs.disp.deleteCommand(subCs)
+		resp := resp
+		subOps.start(resp.Remaining, func() error {
+			defer cs.disp.deleteCommand(subCs)
+			err := runCStoreOnAssociation(subCs, resp.DataSet, params.PreserveTransferSyntax)
+			if err != nil {
+				cs.disp.logf(0, "dicom.serviceProvider: C-GET: C-store of %v failed: %v", resp.Path, err)
+			} else {
+				cs.disp.logf(0, "dicom.serviceProvider: C-GET: Sent %v", resp.Path)
+			}
+			return err
+		})
 	}
+	numSuccesses, numFailures := subOps.wait()
 	cs.sendMessage(&dimse.CGetRsp{
 		AffectedSOPClassUID:            c.AffectedSOPClassUID,
 		MessageIDBeingRespondedTo:      c.MessageID,
@@ -282,7 +468,7 @@ func handleCEcho(
 	if params.CEcho != nil {
 		status = params.CEcho(connState)
 	}
-	dicomlog.Vprintf(0, "dicom.serviceProvider: Received E-ECHO: context: %+v, status: %+v", cs.context, status)
+	cs.disp.logf(0, "dicom.serviceProvider: Received E-ECHO: context: %+v, status: %+v", cs.context, status)
 	resp := &dimse.CEchoRsp{
 		MessageIDBeingRespondedTo: c.MessageID,
 		CommandDataSetType:        dimse.CommandDataSetTypeNull,
@@ -293,13 +479,61 @@ func handleCEcho(
 
 // ServiceProviderParams defines parameters for ServiceProvider.
 type ServiceProviderParams struct {
-	// The application-entity title of the server. Must be nonempty
+	// The application-entity title of the server. Must be nonempty, and at
+	// most 16 characters; see pdu.ValidateAETitle.
 	AETitle string
 
 	// Names of remote AEs and their host:ports. Used only by C-MOVE. This
-	// map should be nonempty iff the server supports CMove.
+	// map should be nonempty iff the server supports CMove, unless
+	// ResolveAE is set.
 	RemoteAEs map[string]string
 
+	// ResolveAE, if non-nil, is used instead of RemoteAEs to find the
+	// address of C-MOVE destinations and of the AEs named by
+	// CMoveReplicas. A destination it fails to resolve is answered with
+	// dimse.CMoveMoveDestinationUnknown.
+	ResolveAE AEResolver
+
+	// SOPClasses, if nonempty, restricts the abstract syntaxes accepted
+	// during association negotiation to these. Contexts proposing others
+	// are rejected as "abstract syntax not supported". The classes listed
+	// are accepted even if unknown to the sopclass package, e.g., private
+	// ones, regardless of RejectUnknownSOPClasses.
+	SOPClasses []string
+
+	// If nonempty, only these peers may associate. Others are rejected with
+	// "calling AE title not recognized".
+	AllowedCallingAETitles []string
+
+	// If nonempty, the AE titles the provider answers to. Peers that ask
+	// for another are rejected with "called AE title not recognized". An
+	// entry "*" accepts any title, as test servers often want. If empty,
+	// the called AE title isn't checked. Titles are compared without their
+	// padding; see pdu.NormalizeAETitle.
+	CalledAETitles []string
+
+	// OnAssociateRequest, if non-nil, is called on each association request
+	// that passes AllowedCallingAETitles and CalledAETitles, before the
+	// presentation contexts are negotiated, and may reject it. See
+	// AssociateRequestCallback.
+	OnAssociateRequest AssociateRequestCallback
+
+	// UserInformationReply, if non-nil, is called on each association
+	// request that is accepted, and returns sub-items to add to the user
+	// information item of A-ASSOCIATE-AC, e.g., the answer to a
+	// vendor-private negotiation item of the request. Items that can't be
+	// encoded are logged and dropped.
+	UserInformationReply UserInformationReplyCallback
+
+	// Authenticator, if non-nil, checks the User Identity item (P3.7
+	// D.3.3.7) of each association request. Peers whose credentials it
+	// rejects, or that send none unless AllowAnonymous is set, are rejected
+	// with "no reason given". The principal it returns is passed to the
+	// handlers in ConnectionState.Principal. If nil, identities are
+	// ignored.
+	Authenticator  Authenticator
+	AllowAnonymous bool
+
 	// Called on C_ECHO request. If nil, a C-ECHO call will produce an error response.
 	//
 	// TODO(saito) Support a default C-ECHO callback?
@@ -309,27 +543,485 @@ type ServiceProviderParams struct {
 	// If CFindCallback=nil, a C-FIND call will produce an error response.
 	CFind CFindCallback
 
+	// CFindBatchSize, if greater than 1, is the number of C-FIND pending
+	// responses that may share a P_DATA_TF PDU, as far as the peer's max
+	// PDU size allows. Responses are sent as soon as the CFind callback
+	// stops producing them faster than they are sent, even if the batch
+	// isn't full.
+	CFindBatchSize int
+
+	// CFindBatchDelay, if positive, is the pause between batches of C-FIND
+	// pending responses (single responses, unless CFindBatchSize is set),
+	// to avoid overwhelming slow SCUs.
+	CFindBatchDelay time.Duration
+
+	// CFindMaxResults, if positive, is the maximum number of matches
+	// returned for a C-FIND request. The matches beyond it are dropped,
+	// and the final response carries CFindMaxResultsStatus, e.g.,
+	// dimse.Status{Status: dimse.CFindOutOfResources, ErrorComment: "too
+	// many matches; refine the query"}. Its zero value reports success.
+	CFindMaxResults       int
+	CFindMaxResultsStatus dimse.Status
+
+	// NService is called on N-EVENT-REPORT, N-GET, N-SET, N-ACTION,
+	// N-CREATE and N-DELETE requests, e.g., for Modality Performed
+	// Procedure Step or Storage Commitment. If nil, they are answered with
+	// "unrecognized operation".
+	NService NServiceCallback
+
+	// MPPS, if non-nil, is called on the N-CREATE and N-SET requests of
+	// Modality Performed Procedure Step, instead of NService. The requests
+	// are checked first: an N-CREATE must create a step in progress, and
+	// an N-SET may only set it to one of MPPSInProgress, MPPSCompleted and
+	// MPPSDiscontinued.
+	MPPS MPPSCallback
+
 	// CMove is called on C_MOVE request.
 	CMove CMoveCallback
 
+	// CMoveReplicas, if non-nil, picks AEs that receive a copy of each
+	// dataset sent by C-MOVE, alongside the move destination. Copies are
+	// sent concurrently, on associations of their own that are reused
+	// across the datasets of the C-MOVE, and their failures don't affect
+	// the C-MOVE status. The copies for a replica that falls 1024 datasets
+	// behind are dropped; see CMoveReplicaCounts.Dropped.
+	CMoveReplicas CMoveReplicasCallback
+
+	// CMoveReplicasDone, if non-nil, receives the outcome of the copies made
+	// for each C-MOVE.
+	CMoveReplicasDone CMoveReplicasDoneCallback
+
+	// SubOperationConcurrency is the number of C-STORE sub-operations of a
+	// C-GET or C-MOVE that may run at once. For C-GET, it is bounded by the
+	// Asynchronous Operations Window negotiated with the peer, i.e., by
+	// MaxOpsInvoked and the peer's proposal; without a window, the
+	// sub-operations run one at a time. Each pending response reports the
+	// counters as of the sub-operation that just completed, and counts the
+	// ones still running as remaining. If zero, the sub-operations run one
+	// at a time.
+	SubOperationConcurrency int
+
+	// CMoveDestinationConcurrency, if non-nil, overrides
+	// SubOperationConcurrency for the C-MOVE destinations it lists, keyed by
+	// AE title, e.g., to send faster to an archive that accepts many
+	// associations.
+	CMoveDestinationConcurrency map[string]int
+
+	// CMoveUser, if non-nil, is the template of the associations the
+	// provider opens to send the C-STORE sub-operations of C-MOVE and the
+	// copies of CMoveReplicas. E.g., its PeerProfile paces them, for legacy
+	// destinations, and its TLSConfig, a client configuration, runs them
+	// over TLS. The provider's own TLSConfig is a server configuration, and
+	// doesn't apply to them. The AE titles, SOPClasses, TransferSyntaxes and
+	// PreserveTransferSyntax are set by the provider; Clock, MaxPDUSize and
+	// Logger default to the provider's.
+	CMoveUser *ServiceUserParams
+
+	// CMovePeerProfiles, if non-nil, overrides CMoveUser.PeerProfile for
+	// the destinations and replicas it lists, keyed by AE title.
+	CMovePeerProfiles map[string]*PeerProfile
+
 	// CGet is called on C_GET request. The only difference between cmove
 	// and cget is that cget uses the same connection to send images back to
 	// the requester. Generally you shuold set the same function to CMove
 	// and CGet.
 	CGet CMoveCallback
 
-	// If CStoreCallback=nil, a C-STORE call will produce an error response.
+	// CStore is called on C-STORE request. If neither it nor any of the
+	// other C-STORE handlers below is set, storage SOP classes are handled
+	// as UnhandledCStore says. If several are set, only the first of
+	// CStoreStream, CStoreWithDigest, CStoreHandlers, CStoreDataset and
+	// CStore is called.
 	CStore CStoreCallback
 
+	// UnhandledCStore selects whether a provider without a C-STORE handler
+	// refuses each C-STORE request, or rejects the presentation contexts of
+	// storage SOP classes during negotiation.
+	UnhandledCStore UnhandledCStorePolicy
+
+	// CStoreDataset, if non-nil, is called instead of CStore, with the
+	// dataset as a DatasetSource.
+	CStoreDataset CStoreDatasetCallback
+
+	// CStoreHandlers, if non-nil, is used instead of CStore, to pick the
+	// handler by SOP class. Storage SOP classes that no handler applies to
+	// are rejected during association negotiation.
+	CStoreHandlers *CStoreRouter
+
+	// DataDigest, if non-nil, creates the hash used to compute a digest of
+	// each inbound C-STORE payload, e.g., sha256.New or crc32.NewIEEE. The
+	// payload is digested fragment by fragment as it arrives, and passed to
+	// CStoreWithDigest, or, as it is read, to CStoreStream; see
+	// DigestReader.
+	DataDigest func() hash.Hash
+
+	// CStoreWithDigest, if non-nil, is called instead of CStore on C-STORE
+	// request. It requires DataDigest.
+	CStoreWithDigest CStoreWithDigestCallback
+
+	// CStoreAdmit, if non-nil, is called when the command set of a C-STORE
+	// request arrives, before its dataset. It can refuse the object, e.g.,
+	// to enforce a quota, without receiving it first.
+	CStoreAdmit CStoreAdmitCallback
+
+	// CStorePeek, if non-nil, is called while an inbound C-STORE dataset is
+	// still being received, with the elements that precede CStorePeekTag.
+	// It can be used to make routing decisions, or to refuse the object
+	// before the transfer completes.
+	CStorePeek CStorePeekCallback
+
+	// CStoreStream, if non-nil, is called instead of the other C-STORE
+	// handlers, with the dataset streamed as it arrives instead of
+	// assembled in memory; see NewCStoreForwarder for a proxy. It can't be
+	// combined with CStoreAdmit or CStorePeek, nor run with HandlerInline,
+	// since its handler waits for data from the peer. If DataDigest is
+	// set, the reader passed to it is a DigestReader.
+	CStoreStream CStoreStreamCallback
+
+	// CStoreCoerce, if non-nil, is called before the C-STORE handler to
+	// correct attributes of the dataset, e.g., to map a PatientID or an
+	// accession number issued by a modality. For CStoreStream, only the
+	// attributes that precede PixelData, in the first 1MB of the dataset,
+	// are read ahead and can be coerced. See CStoreCoerceCallback.
+	CStoreCoerce CStoreCoerceCallback
+
+	// CStoreCoerced, if non-nil, receives the changes made by CStoreCoerce
+	// to each dataset the handler accepted.
+	CStoreCoerced CStoreCoercedCallback
+
+	// CStorePeekTag is the tag at which the parse for CStorePeek stops. If
+	// zero, it defaults to PixelData.
+	CStorePeekTag dicomtag.Tag
+
+	// AssociationError, if non-nil, is called when the association is
+	// aborted or the connection fails.
+	AssociationError AssociationErrorCallback
+
+	// Events, if non-nil, receives an Event for each instance stored, study
+	// completed, and association closed.
+	Events *EventBus
+
 	// TLSConfig, if non-nil, enables TLS on the connection. See
 	// https://gist.github.com/michaljemala/d6f4e01c4834bf47a9c4 for an
-	// example for creating a TLS config from x509 cert files.
+	// example for creating a TLS config from x509 cert files. A failed
+	// handshake is passed to AssociationError as a *TLSHandshakeError.
 	TLSConfig *tls.Config
+
+	// RejectAssociationWithoutContexts, if true, causes the provider to
+	// answer A-ASSOCIATE-RJ when none of the proposed presentation contexts
+	// is acceptable. If false, the association is accepted with every
+	// context marked as rejected, and the requestor decides what to do.
+	RejectAssociationWithoutContexts bool
+
+	// AssociationRequestTimeout bounds the time between accepting a TCP
+	// connection and receiving A-ASSOCIATE-RQ. If zero,
+	// DefaultAssociationRequestTimeout is used. If negative, no deadline is
+	// set.
+	AssociationRequestTimeout time.Duration
+
+	// IdleTimeout, if positive, bounds the time between PDUs once the
+	// association is established. The connection is closed when it
+	// expires.
+	IdleTimeout time.Duration
+
+	// MaxAssociationRequestBytes bounds the size of the A-ASSOCIATE-RQ PDU.
+	// The connection is closed once a request has used up the budget. If
+	// zero, DefaultMaxAssociationRequestBytes is used. If negative, only
+	// the max PDU size applies.
+	MaxAssociationRequestBytes int
+
+	// MaxAssociationRequestItems and MaxAssociationRequestItemDepth bound
+	// the number of items of the A-ASSOCIATE-RQ, sub-items included, and
+	// their nesting. A request beyond either is aborted before it is
+	// decoded, and counted in ProviderHealth.DroppedConnections. If zero,
+	// pdu.DefaultMaxAssociateItems and pdu.DefaultMaxAssociateItemDepth
+	// are used. If negative, no limit applies.
+	MaxAssociationRequestItems     int
+	MaxAssociationRequestItemDepth int
+
+	// MinTransferRate, if positive, is the minimum rate, in bytes per
+	// second, at which a PDU must arrive once its first byte has been
+	// received. The rate is measured over every TransferRateWindow
+	// (DefaultTransferRateWindow if zero), and the connection is closed if
+	// it falls short. Together with AssociationRequestTimeout and
+	// IdleTimeout, this drops peers that trickle data to hold connections
+	// open. See ProviderHealth.DroppedConnections.
+	MinTransferRate    int
+	TransferRateWindow time.Duration
+
+	// WriteTimeout, if positive, bounds the time to send one PDU.
+	WriteTimeout time.Duration
+
+	// Tee, if non-nil, copies the bytes of each connection to writers,
+	// e.g., for live capture. See TeeParams.
+	Tee *TeeParams
+
+	// WriteCoalescing, if non-nil, gathers the P-DATA-TF PDUs sent back to
+	// back, e.g., C-FIND responses, into fewer writes to the connection.
+	// See WriteCoalescingParams.
+	WriteCoalescing *WriteCoalescingParams
+
+	// ReadMode selects how the connections are read: by a goroutine per
+	// connection (ReadPerConnection, the default), or through a poller
+	// shared by the process (ReadSharedPoller).
+	ReadMode ReadMode
+
+	// ARTIMTimeout is the duration of the ARTIM timer (P3.8 9.1.5): how
+	// long the provider waits for A-ASSOCIATE-RQ once the connection is
+	// accepted, and for the peer to close the connection after
+	// A-ASSOCIATE-RJ, A-RELEASE-RP or A-ABORT, before closing it itself.
+	// If zero, DefaultARTIMTimeout is used. Unlike
+	// AssociationRequestTimeout, it can't be negative.
+	ARTIMTimeout time.Duration
+
+	// Clock, if non-nil, drives the ARTIM timer, AssociationRequestTimeout,
+	// IdleTimeout, MinTransferRate and the delays of ResponseShaping. Tests
+	// set it to a VirtualClock. If nil, the real clock is used.
+	Clock Clock
+
+	// If true, a DIMSE message that matches no outstanding request and no
+	// handler, e.g., a response with an unknown message ID, aborts the
+	// association. Otherwise it is logged and counted (see
+	// ProviderHealth.UnexpectedMessages), and dropped if it's a response,
+	// or answered with "unrecognized operation" if it's a request.
+	AbortOnUnexpectedMessage bool
+
+	// RoleViolation selects what to do with a request for a SOP class for
+	// which the peer gave up the SCU role in role selection negotiation.
+	// The provider accepts the roles proposed by the peer as is.
+	RoleViolation RoleViolationPolicy
+
+	// MaxCommandSetBytes and MaxCommandElements bound the DIMSE command
+	// sets accepted from the peer. A command set beyond either limit aborts
+	// the association. If zero, dimse.DefaultMaxCommandBytes and
+	// dimse.DefaultMaxCommandElements are used. If negative, no limit
+	// applies.
+	MaxCommandSetBytes int
+	MaxCommandElements int
+
+	// MaxPDUSize is the max PDU size advertised in A-ASSOCIATE-AC, i.e.,
+	// the largest P-DATA-TF PDU the peer may send. It must be at least
+	// MinMaxPDUSize. If zero, DefaultMaxPDUSize is used. Small values, such
+	// as the 4096 bytes of some vendors, are for exercising fragmentation
+	// in tests; PDUs larger than advertised are still accepted.
+	MaxPDUSize int
+
+	// ResponseShaping, if non-nil, makes the provider delay, fail or abort
+	// chosen requests, to test how SCUs handle misbehaving peers. See
+	// providerconfig for setting it from a config file.
+	ResponseShaping *ResponseShaping
+
+	// FaultInjector, if non-nil, injects faults into the associations
+	// served. Only for testing. If nil, the injector set by
+	// SetProviderFaultInjector is used.
+	FaultInjector FaultInjector
+
+	// Logger, if non-nil, receives the diagnostic messages of the
+	// associations served instead of dicomlog. Messages not tied to an
+	// association, e.g., listener errors, still go to dicomlog.
+	Logger Logger
+
+	// RejectUnknownSOPClasses, if true, causes the provider to accept only
+	// the SOP classes listed in the sopclass package, or in SOPClasses.
+	// Contexts proposing others are rejected as "abstract syntax not
+	// supported". By default, every abstract syntax is accepted, and
+	// C-STORE requests for private SOP classes are passed to CStore like
+	// any other.
+	RejectUnknownSOPClasses bool
+
+	// Promiscuous, if true, causes the provider to accept every abstract
+	// syntax proposed by the peer, like dcmtk's "storescp --promiscuous",
+	// even if RejectUnknownSOPClasses is set.
+	Promiscuous bool
+
+	// BigEndian selects whether explicit VR big endian is accepted, and
+	// listed by Capabilities. By default it is, for compatibility with old
+	// peers; new code should set RetireExplicitVRBigEndian. Either way, a
+	// little endian syntax is preferred when a context offers both.
+	BigEndian BigEndianPolicy
+
+	// UnknownTransferSyntaxes selects whether a transfer syntax missing from
+	// the dicomuid registry may be accepted in a presentation context. By
+	// default, such syntaxes are refused; see
+	// PassThroughUnknownTransferSyntaxes.
+	UnknownTransferSyntaxes UnknownTransferSyntaxPolicy
+
+	// PreserveTransferSyntax, if true, causes C-GET and C-MOVE
+	// sub-operations to fail rather than transcode a dataset the peer
+	// didn't accept in its original transfer syntax. Inbound C-STORE data
+	// is never transcoded regardless of this setting.
+	PreserveTransferSyntax bool
+
+	// HandlerExecution chooses how the handlers of each type of request
+	// run, e.g., C-STORE on a bounded pool and C-ECHO inline. By default,
+	// each request runs in its own goroutine, so requests on one
+	// association aren't handled in order. Use HandlerSequential where the
+	// order matters.
+	HandlerExecution HandlerExecutionModels
+
+	// OrderedCStore, if true, causes the CStore handler to be called for
+	// one C-STORE request at a time per association, in the order the
+	// requests arrived, so the responses are sent in that order too. It
+	// holds whatever HandlerExecution.CStore is; with HandlerPool, the
+	// handlers of different associations still run in parallel.
+	OrderedCStore bool
+
+	// MaxOpsPerformed, if positive, bounds the number of requests handled
+	// at once on one association. Requests beyond it are queued, in arrival
+	// order, until one finishes. When the peer proposes an Asynchronous
+	// Operations Window, it is also the number of operations the peer is
+	// told it may invoke. A peer that has more than five times as many
+	// requests outstanding is aborted. If zero, requests are not bounded,
+	// and the peer's proposal is accepted as is.
+	MaxOpsPerformed int
+
+	// MaxOpsInvoked is the number of operations the provider tells the
+	// peer it may perform at once, e.g., C-STORE sub-operations of a C-GET,
+	// when the peer proposes an Asynchronous Operations Window. If zero,
+	// the peer's proposal is accepted as is.
+	MaxOpsInvoked int
+
+	// HandlerPoolSize is the number of handlers that may run at once on
+	// the pool used by HandlerPool. If zero, DefaultHandlerPoolSize is used.
+	// It is read when the provider is created; SetParams doesn't change it.
+	HandlerPoolSize int
+}
+
+// Check the AE titles in "params", so that one that doesn't fit in a PDU is
+// reported now rather than when it is sent.
+func validateProviderAETitles(params ServiceProviderParams) error {
+	if params.AETitle != "" {
+		if err := pdu.ValidateAETitle(params.AETitle); err != nil {
+			return fmt.Errorf("dicom.serviceProvider: AETitle: %v", err)
+		}
+	}
+	for _, aeTitle := range params.AllowedCallingAETitles {
+		if err := pdu.ValidateAETitle(aeTitle); err != nil {
+			return fmt.Errorf("dicom.serviceProvider: AllowedCallingAETitles: %v", err)
+		}
+	}
+	for _, aeTitle := range params.CalledAETitles {
+		if err := pdu.ValidateAETitle(aeTitle); err != nil {
+			return fmt.Errorf("dicom.serviceProvider: CalledAETitles: %v", err)
+		}
+	}
+	for aeTitle := range params.RemoteAEs {
+		if err := pdu.ValidateAETitle(aeTitle); err != nil {
+			return fmt.Errorf("dicom.serviceProvider: RemoteAEs: %v", err)
+		}
+	}
+	return nil
+}
+
+// Check the params that can't be checked when they are used.
+func validateServiceProviderParams(params ServiceProviderParams) error {
+	if err := validateHandlerExecution(params.HandlerExecution); err != nil {
+		return err
+	}
+	for _, n := range []int{params.MaxOpsPerformed, params.MaxOpsInvoked} {
+		if n < 0 || n > 0xffff {
+			return fmt.Errorf("dicom.serviceProvider: operation window %d out of range [0, 65535]", n)
+		}
+	}
+	if err := validateProviderAETitles(params); err != nil {
+		return err
+	}
+	if params.CStoreWithDigest != nil && params.DataDigest == nil {
+		return fmt.Errorf("dicom.serviceProvider: CStoreWithDigest requires DataDigest")
+	}
+	if params.CStoreStream != nil && (params.CStoreAdmit != nil || params.CStorePeek != nil) {
+		return fmt.Errorf("dicom.serviceProvider: CStoreAdmit and CStorePeek can't be used with CStoreStream")
+	}
+	if params.CStoreStream != nil && params.HandlerExecution.CStore == HandlerInline {
+		return fmt.Errorf("dicom.serviceProvider: CStoreStream handlers can't run inline")
+	}
+	if err := validateMaxPDUSize(params.MaxPDUSize); err != nil {
+		return fmt.Errorf("dicom.serviceProvider: MaxPDUSize: %v", err)
+	}
+	if params.CFindBatchSize < 0 || params.CFindMaxResults < 0 {
+		return fmt.Errorf("dicom.serviceProvider: negative C-FIND batch size or max results")
+	}
+	if params.SubOperationConcurrency < 0 {
+		return fmt.Errorf("dicom.serviceProvider: negative sub-operation concurrency")
+	}
+	for aeTitle, n := range params.CMoveDestinationConcurrency {
+		if n < 0 {
+			return fmt.Errorf("dicom.serviceProvider: negative sub-operation concurrency for %v", aeTitle)
+		}
+	}
+	if params.ARTIMTimeout < 0 {
+		return fmt.Errorf("dicom.serviceProvider: negative ARTIMTimeout %v", params.ARTIMTimeout)
+	}
+	if params.CMoveUser != nil {
+		suParams := newCStoreServiceUserParams(params, "", "")
+		if err := validateServiceUserParams(&suParams); err != nil {
+			return fmt.Errorf("dicom.serviceProvider: CMoveUser: %v", err)
+		}
+	}
+	for aeTitle, profile := range params.CMovePeerProfiles {
+		if err := profile.validate(); err != nil {
+			return fmt.Errorf("dicom.serviceProvider: CMovePeerProfiles[%v]: %v", aeTitle, err)
+		}
+	}
+	if params.MinTransferRate < 0 || params.TransferRateWindow < 0 {
+		return fmt.Errorf("dicom.serviceProvider: negative transfer rate or window")
+	}
+	if err := params.WriteCoalescing.validate(); err != nil {
+		return fmt.Errorf("dicom.serviceProvider: %v", err)
+	}
+	return params.ResponseShaping.Validate()
+}
+
+// knownAbstractSyntaxes is the set of SOP classes listed in the sopclass
+// package.
+var knownAbstractSyntaxes = func() map[string]bool {
+	m := map[string]bool{}
+	for _, list := range [][]string{
+		sopclass.VerificationClasses,
+		sopclass.StorageClasses,
+		sopclass.QRFindClasses,
+		sopclass.QRMoveClasses,
+		sopclass.QRGetClasses,
+		sopclass.NServiceClasses,
+	} {
+		for _, uid := range list {
+			m[uid] = true
+		}
+	}
+	return m
+}()
+
+// Reports whether the provider accepts the abstract syntax when
+// RejectUnknownSOPClasses is set.
+func isKnownAbstractSyntax(uid string) bool {
+	return knownAbstractSyntaxes[uid]
 }
 
 // DefaultMaxPDUSize is the the PDU size advertized by go-netdicom.
 const DefaultMaxPDUSize = 4 << 20
 
+// MinMaxPDUSize is the smallest max PDU size that ServiceUserParams and
+// ServiceProviderParams accept: a PDV header and one byte of value.
+const MinMaxPDUSize = pdvHeaderSize + 1
+
+func maxPDUSizeOrDefault(size int) int {
+	if size == 0 {
+		return DefaultMaxPDUSize
+	}
+	return size
+}
+
+func validateMaxPDUSize(size int) error {
+	if size != 0 && (size < MinMaxPDUSize || size > DefaultMaxPDUSize) {
+		return fmt.Errorf("max PDU size %d out of range [%d, %d]", size, MinMaxPDUSize, DefaultMaxPDUSize)
+	}
+	return nil
+}
+
+// DefaultAssociationRequestTimeout is the default value of
+// ServiceProviderParams.AssociationRequestTimeout.
+const DefaultAssociationRequestTimeout = 30 * time.Second
+
 // CStoreCallback is called C-STORE request.  sopInstanceUID is the UID of the
 // data.  sopClassUID is the data type requested
 // (e.g.,"1.2.840.10008.5.1.4.1.1.1.2"), and transferSyntaxUID is the encoding
@@ -342,7 +1034,10 @@ const DefaultMaxPDUSize = 4 << 20
 // objects in transferSyntaxUID.  "data" does not contain metadata elements
 // (elements whose Tag.Group=2 -- e.g., TransferSyntaxUID and
 // MediaStorageSOPClassUID), since they are stripped by the requster (two key
-// metadata are passed as sop{Class,Instance)UID).
+// metadata are passed as sop{Class,Instance)UID). The bytes are passed exactly
+// as received, so they can be relayed unchanged with ServiceUser.CStoreRaw.
+// The whole dataset is held in memory; to spool large objects to disk or
+// object storage as they arrive, use CStoreStreamCallback instead.
 //
 // The function should store encode the sop{Class,InstanceUID} as the DICOM
 // header, followed by data. It should return either dimse.Success0 on success,
@@ -356,6 +1051,29 @@ type CStoreCallback func(
 	callingAE string,
 	data []byte) dimse.Status
 
+// CStoreWithDigestCallback is similar to CStoreCallback, but it also receives
+// the digest of "data", computed by ServiceProviderParams.DataDigest. Archives
+// can use it to verify integrity or deduplicate objects without reading them
+// back after they are stored.
+type CStoreWithDigestCallback func(
+	conn ConnectionState,
+	transferSyntaxUID string,
+	sopClassUID string,
+	sopInstanceUID string,
+	calledAE string,
+	callingAE string,
+	data []byte,
+	digest []byte) dimse.Status
+
+// Returns the hash the statemachine digests C-STORE data with as it arrives,
+// for CStoreWithDigest, or nil if it's not called.
+func cstoreDataHash(params ServiceProviderParams) func() hash.Hash {
+	if params.CStoreStream != nil || params.CStoreWithDigest == nil {
+		return nil
+	}
+	return params.DataDigest
+}
+
 // CFindCallback implements a C-FIND handler.  sopClassUID is the data type
 // requested (e.g.,"1.2.840.10008.5.1.4.1.1.1.2"), and transferSyntaxUID is the
 // data encoding requested (e.g., "1.2.840.10008.1.2.1").  These args are
@@ -394,18 +1112,81 @@ type ConnectionState struct {
 	// TLS connection state. It is nonempty only when the connection is set up
 	// over TLS.
 	TLS tls.ConnectionState
+
+	// The remote end of the association. In the AssociationError callback
+	// and in EventAssociationClosed, only the transport fields are set if
+	// the association wasn't accepted.
+	Peer Peer
+
+	// The Asynchronous Operations Window proposed by the peer in
+	// A-ASSOCIATE-RQ: the number of operations it may invoke and perform at
+	// once. 0 means unlimited. Both are 1 if the peer didn't propose a
+	// window. Also in Peer. Unset in the AssociationError callback and in
+	// EventAssociationClosed if the association wasn't accepted.
+	PeerMaxOpsInvoked   int
+	PeerMaxOpsPerformed int
+
+	// Principal is the identity established by
+	// ServiceProviderParams.Authenticator, or nil if no Authenticator is set
+	// or the peer associated anonymously.
+	Principal *Principal
+
+	// The context of the association. See Context.
+	ctx context.Context
+}
+
+// Context returns the context of the association: it is cancelled when the
+// association is released or aborted, when the connection fails, and on
+// ServiceProvider.Shutdown. Handlers may pass it to database queries and
+// storage writes, so that they stop when the peer is gone. It is
+// context.Background() in the AssociationError callback and in
+// EventAssociationClosed if the association wasn't accepted.
+func (c ConnectionState) Context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
 }
 
 // CEchoCallback implements C-ECHO callback. It typically just returns
 // dimse.Success.
 type CEchoCallback func(conn ConnectionState) dimse.Status
 
+// AssociationErrorCallback is called when an association ends abnormally. err
+// is an *AbortError if an A-ABORT PDU was exchanged, a *TLSHandshakeError if
+// the TLS handshake failed, or a *TransportError if the connection failed.
+type AssociationErrorCallback func(conn ConnectionState, err error)
+
 // ServiceProvider encapsulates the state for DICOM server (provider).
 type ServiceProvider struct {
-	params   ServiceProviderParams
+	params   ServiceProviderParams // guarded by mu
 	listener net.Listener
 	// Label is a unique string used in log messages to identify this provider.
 	label string
+
+	mu sync.Mutex
+	// Connections being served, keyed by label. Guarded by mu.
+	assocs map[string]*providerAssociation
+	// Non-nil while draining. Closed once assocs becomes empty, at which
+	// point drained is set. Guarded by mu.
+	drainedCh chan struct{}
+	drained   bool
+
+	// Count of unexpected messages over all associations. Updated
+	// atomically.
+	unexpectedMessages int64
+
+	// Connections dropped by a timeout or limit, by cause.
+	dropped dropCounters
+
+	// Shared by the associations, for HandlerPool.
+	pool handlerPool
+
+	// The parent of the contexts of the associations. Cancelled by
+	// Shutdown, which also sets shutdown, guarded by mu.
+	ctx      context.Context
+	cancel   context.CancelFunc
+	shutdown bool
 }
 
 func writeElementsToBytes(elems []*dicom.Element, transferSyntaxUID string) ([]byte, error) {
@@ -443,6 +1224,11 @@ func readElementsInBytes(data []byte, transferSyntaxUID string) ([]*dicom.Elemen
 		}
 		return elems, nil
 	*/
+	if len(data) == 0 {
+		// An empty dataset, e.g., a C-FIND identifier sent as a
+		// zero-length PDV.
+		return nil, nil
+	}
 	dataset, err := dicom.ReadDataSetInBytes(&data, nil)
 	if err != nil {
 		return nil, err
@@ -450,6 +1236,26 @@ func readElementsInBytes(data []byte, transferSyntaxUID string) ([]*dicom.Elemen
 	return dataset.Elements, nil
 }
 
+// Describe the use of the accepted presentation contexts, for the log message
+// that ends an association.
+func contextUsageSummary(contexts []ContextUsage) string {
+	if len(contexts) == 0 {
+		return ""
+	}
+	var unused []string
+	for _, u := range contexts {
+		if !u.Used() {
+			unused = append(unused, fmt.Sprintf("%d:%s/%s", u.ContextID,
+				dicomuid.UIDString(u.AbstractSyntaxUID), dicomuid.UIDString(u.TransferSyntaxUID)))
+		}
+	}
+	s := fmt.Sprintf("; used %d of %d accepted presentation contexts", len(contexts)-len(unused), len(contexts))
+	if len(unused) > 0 {
+		s += "; unused: " + strings.Join(unused, ", ")
+	}
+	return s
+}
+
 func elementsString(elems []*dicom.Element) string {
 	s := "["
 	for i, elem := range elems {
@@ -461,34 +1267,32 @@ func elementsString(elems []*dicom.Element) string {
 	return s + "]"
 }
 
-// Send "ds" to remoteHostPort using C-STORE. Called as part of C-MOVE.
-func runCStoreOnNewAssociation(myAETitle, remoteAETitle, remoteHostPort string, ds *dicom.Dataset) error {
-	su, err := NewServiceUser(ServiceUserParams{
-		CalledAETitle:  remoteAETitle,
-		CallingAETitle: myAETitle,
-		SOPClasses:     sopclass.StorageClasses})
-	if err != nil {
-		return err
-	}
-	defer su.Release()
-	su.Connect(remoteHostPort)
-	err = su.CStore(ds)
-	dicomlog.Vprintf(1, "dicom.serviceProvider: C-STORE subop done: %v", err)
-	return err
-}
-
 // NewServiceProvider creates a new DICOM server object.  "listenAddr" is the
 // TCP address to listen to. E.g., ":1234" will listen to port 1234 at all the
 // IP address that this machine can bind to.  Run() will actually start running
 // the service.
 func NewServiceProvider(params ServiceProviderParams, port string) (*ServiceProvider, error) {
+	if err := validateServiceProviderParams(params); err != nil {
+		return nil, err
+	}
 	sp := &ServiceProvider{
 		params: params,
 		label:  newUID("sp"),
+		assocs: map[string]*providerAssociation{},
+		pool:   newHandlerPool(params.HandlerPoolSize),
 	}
+	sp.ctx, sp.cancel = context.WithCancel(context.Background())
 	var err error
 	if params.TLSConfig != nil {
-		sp.listener, err = tls.Listen("tcp", port, params.TLSConfig)
+		// Look up the config on each handshake, so that SetParams can
+		// replace the certificates.
+		sp.listener, err = tls.Listen("tcp", port, &tls.Config{
+			GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				sp.mu.Lock()
+				defer sp.mu.Unlock()
+				return sp.params.TLSConfig, nil
+			},
+		})
 	} else {
 		sp.listener, err = net.Listen("tcp", port)
 	}
@@ -498,59 +1302,351 @@ func NewServiceProvider(params ServiceProviderParams, port string) (*ServiceProv
 	return sp, nil
 }
 
-func getConnState(conn net.Conn) (cs ConnectionState) {
+// VerificationProviderParams returns the parameters of a provider that only
+// answers C-ECHO, e.g., as a readiness endpoint for a monitoring stack. Only
+// the Verification SOP class is accepted; contexts proposing others are
+// rejected during association negotiation.
+func VerificationProviderParams() ServiceProviderParams {
+	return ServiceProviderParams{
+		SOPClasses: sopclass.VerificationClasses,
+		CEcho:      func(conn ConnectionState) dimse.Status { return dimse.Success },
+	}
+}
+
+// NewVerificationProvider creates a provider with VerificationProviderParams,
+// listening on "port". Call Run to serve it:
+//
+//	sp, err := netdicom.NewVerificationProvider(":11112")
+//	...
+//	go sp.Run()
+func NewVerificationProvider(port string) (*ServiceProvider, error) {
+	return NewServiceProvider(VerificationProviderParams(), port)
+}
+
+// Build the ConnectionState passed to callbacks. cm may be nil.
+func getConnState(conn net.Conn, cm *contextManager) (cs ConnectionState) {
 	tlsConn, ok := conn.(*tls.Conn)
 	if ok {
 		cs.TLS = tlsConn.ConnectionState()
 	}
+	if cm != nil {
+		cs.PeerMaxOpsInvoked = cm.peerMaxOpsInvoked
+		cs.PeerMaxOpsPerformed = cm.peerMaxOpsPerformed
+		cs.Principal = cm.principal
+		cs.ctx = cm.ctx
+	}
+	cs.Peer = newPeer(conn, cm)
 	return
 }
 
 // RunProviderForConn starts threads for running a DICOM server on "conn". This
 // function returns immediately; "conn" will be cleaned up in the background.
 func RunProviderForConn(conn net.Conn, params ServiceProviderParams) {
+	runProviderForConn(conn, params, nil)
+}
+
+// Serve "conn" until it is closed. "a" is non-nil if the connection was
+// accepted by ServiceProvider.Run.
+func runProviderForConn(conn net.Conn, params ServiceProviderParams, a *providerAssociation) {
 	upcallCh := make(chan upcallEvent, 128)
-	label := newUID("sc")
+	logf := loggerOrDefault(params.Logger)
+	var label string
+	var draining func() bool
+	var stats *associationStats
+	var pool handlerPool
+	parent := context.Background()
+	if a != nil {
+		label = a.label
+		draining = a.sp.isDraining
+		stats = &a.stats
+		pool = a.sp.pool
+		parent = a.sp.ctx
+	} else {
+		label = newUID("sc")
+		pool = newHandlerPool(params.HandlerPoolSize)
+	}
+	if err := validateServiceProviderParams(params); err != nil {
+		logf(0, "dicom.serviceProvider(%s): %v; closing connection", label, err)
+		conn.Close()
+		return
+	}
+	if err := tlsServerHandshake(conn, params); err != nil {
+		logf(0, "dicom.serviceProvider(%s): %v; closing connection", label, err)
+		if params.AssociationError != nil {
+			params.AssociationError(getConnState(conn, nil), err)
+		}
+		if params.Events != nil {
+			params.Events.publish(Event{
+				Type: EventAssociationClosed,
+				Conn: getConnState(conn, nil),
+				Err:  err,
+			})
+		}
+		conn.Close()
+		return
+	}
+	// Cancelled when the association ends, or as soon as it fails, so that
+	// handlers still running can stop.
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
 	disp := newServiceDispatcher(label)
-	disp.registerCallback(dimse.CommandFieldCStoreRq,
+	disp.logf = logf
+	disp.stats = stats
+	disp.abortOnUnexpected = params.AbortOnUnexpectedMessage
+	disp.rolePolicy = params.RoleViolation
+	disp.exec = &handlerExecutor{
+		models:        params.HandlerExecution,
+		pool:          pool,
+		orderedCStore: params.OrderedCStore,
+		maxOps:        params.MaxOpsPerformed,
+	}
+	if a != nil {
+		a.mu.Lock()
+		a.disp = disp
+		a.mu.Unlock()
+	}
+	clock := clockOrDefault(params.Clock)
+	disp.registerCallback(dimse.CommandFieldCStoreRq, params.ResponseShaping.wrap(
 		func(msg dimse.Message, data []byte, cs *serviceCommandState) {
-			handleCStore(params.CStore, getConnState(conn), msg.(*dimse.CStoreRq), data, cs)
-		})
-	disp.registerCallback(dimse.CommandFieldCFindRq,
+			handleCStore(params, getConnState(conn, cs.cm), msg.(*dimse.CStoreRq), data, cs)
+		}, clock))
+	disp.registerCallback(dimse.CommandFieldCFindRq, params.ResponseShaping.wrap(
 		func(msg dimse.Message, data []byte, cs *serviceCommandState) {
-			handleCFind(params, getConnState(conn), msg.(*dimse.CFindRq), data, cs)
-		})
-	disp.registerCallback(dimse.CommandFieldCMoveRq,
+			handleCFind(params, getConnState(conn, cs.cm), msg.(*dimse.CFindRq), data, cs)
+		}, clock))
+	disp.registerCallback(dimse.CommandFieldCMoveRq, params.ResponseShaping.wrap(
 		func(msg dimse.Message, data []byte, cs *serviceCommandState) {
-			handleCMove(params, getConnState(conn), msg.(*dimse.CMoveRq), data, cs)
-		})
-	disp.registerCallback(dimse.CommandFieldCGetRq,
+			handleCMove(params, getConnState(conn, cs.cm), msg.(*dimse.CMoveRq), data, cs)
+		}, clock))
+	disp.registerCallback(dimse.CommandFieldCGetRq, params.ResponseShaping.wrap(
 		func(msg dimse.Message, data []byte, cs *serviceCommandState) {
-			handleCGet(params, getConnState(conn), msg.(*dimse.CGetRq), data, cs)
-		})
-	disp.registerCallback(dimse.CommandFieldCEchoRq,
+			handleCGet(params, getConnState(conn, cs.cm), msg.(*dimse.CGetRq), data, cs)
+		}, clock))
+	disp.registerCallback(dimse.CommandFieldCEchoRq, params.ResponseShaping.wrap(
 		func(msg dimse.Message, data []byte, cs *serviceCommandState) {
-			handleCEcho(params, getConnState(conn), msg.(*dimse.CEchoRq), data, cs)
-		})
-	go runStateMachineForServiceProvider(conn, upcallCh, disp.downcallCh, label)
+			handleCEcho(params, getConnState(conn, cs.cm), msg.(*dimse.CEchoRq), data, cs)
+		}, clock))
+	nService := providerNService(params)
+	for _, commandField := range nRequestCommandFields {
+		disp.registerCallback(commandField, params.ResponseShaping.wrap(
+			func(msg dimse.Message, data []byte, cs *serviceCommandState) {
+				handleNService(nService, getConnState(conn, cs.cm), msg, data, cs)
+			}, clock))
+	}
+	stats.goFunc(func() {
+		runStateMachineForServiceProvider(ctx, conn, params, upcallCh, disp.downcallCh, label, draining, stats)
+	})
+	var assocErr error
+	// Set once the association is accepted.
+	var cm *contextManager
 	for event := range upcallCh {
+		if event.eventType == upcallEventHandshakeCompleted {
+			cm = event.cm
+		}
+		if event.eventType == upcallEventError {
+			cancel()
+			if assocErr == nil {
+				assocErr = event.err
+			}
+			if params.AssociationError != nil {
+				params.AssociationError(getConnState(conn, cm), event.err)
+			}
+		}
 		disp.handleEvent(event)
 	}
-	dicomlog.Vprintf(0, "dicom.serviceProvider(%s): Finished connection %p (remote: %+v)", label, conn, conn.RemoteAddr())
+	var contexts []ContextUsage
+	if cm != nil {
+		contexts = cm.contextUsage()
+	}
+	if params.Events != nil {
+		params.Events.publish(Event{
+			Type:     EventAssociationClosed,
+			Conn:     getConnState(conn, cm),
+			Err:      assocErr,
+			Contexts: contexts,
+		})
+	}
+	logf(0, "dicom.serviceProvider(%s): Finished connection %p (peer: %v)%s", label, conn, newPeer(conn, cm), contextUsageSummary(contexts))
+	cancel()
 	disp.close()
 }
 
 // Run listens to incoming connections, accepts them, and runs the DICOM
-// protocol. This function never returns.
+// protocol. It returns only after Shutdown or ShutdownContext.
 func (sp *ServiceProvider) Run() {
 	for {
 		conn, err := sp.listener.Accept()
 		if err != nil {
+			if sp.isShutdown() {
+				return
+			}
 			dicomlog.Vprintf(0, "dicom.serviceProvider(%s): Accept error: %v", sp.label, err)
 			continue
 		}
 		dicomlog.Vprintf(0, "dicom.serviceProvider(%s): Accepted connection %p (remote: %+v)", sp.label, conn, conn.RemoteAddr())
-		go func() { RunProviderForConn(conn, sp.params) }()
+		a := &providerAssociation{
+			sp:        sp,
+			label:     newUID("sc"),
+			conn:      conn,
+			startTime: time.Now(),
+		}
+		a.stats.totalUnexpectedMessages = &sp.unexpectedMessages
+		a.stats.totalDropped = &sp.dropped
+		sp.mu.Lock()
+		sp.assocs[a.label] = a
+		sp.mu.Unlock()
+		a.stats.goFunc(func() {
+			sp.mu.Lock()
+			params := sp.params
+			sp.mu.Unlock()
+			runProviderForConn(conn, params, a)
+			sp.mu.Lock()
+			delete(sp.assocs, a.label)
+			sp.checkDrainedLocked()
+			sp.mu.Unlock()
+		})
+	}
+}
+
+// Drain causes the provider to refuse new associations with a transient
+// A-ASSOCIATE-RJ, while the existing ones run to completion. The returned
+// channel is closed once no connection remains. Drain may be called again while
+// draining; it returns the same channel.
+func (sp *ServiceProvider) Drain() <-chan struct{} {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if sp.drainedCh == nil {
+		dicomlog.Vprintf(0, "dicom.serviceProvider(%s): Draining %d connection(s)", sp.label, len(sp.assocs))
+		sp.drainedCh = make(chan struct{})
+		sp.checkDrainedLocked()
+	}
+	return sp.drainedCh
+}
+
+// Shutdown closes the listener and aborts the associations being served. The
+// contexts of the associations (see ConnectionState.Context) are cancelled, so
+// that handlers still running can stop. Unlike Drain, it doesn't wait.
+func (sp *ServiceProvider) Shutdown() error {
+	sp.mu.Lock()
+	sp.shutdown = true
+	ids := make([]string, 0, len(sp.assocs))
+	for id := range sp.assocs {
+		ids = append(ids, id)
+	}
+	sp.mu.Unlock()
+	dicomlog.Vprintf(0, "dicom.serviceProvider(%s): Shutting down; aborting %d connection(s)", sp.label, len(ids))
+	sp.cancel()
+	err := sp.listener.Close()
+	for _, id := range ids {
+		// The association may have ended meanwhile.
+		sp.Abort(id) // nolint: errcheck
+	}
+	return err
+}
+
+// ShutdownContext stops the provider gracefully. It closes the listener, so
+// that Run returns and no new connection is accepted, and waits for the
+// associations being served to end. If "ctx" is done first, the remaining
+// associations are aborted as by Shutdown, their connections are closed, and
+// ctx.Err() is returned right away. Handlers still running are told to stop
+// through ConnectionState.Context, but aren't waited for.
+func (sp *ServiceProvider) ShutdownContext(ctx context.Context) error {
+	sp.mu.Lock()
+	sp.shutdown = true
+	sp.mu.Unlock()
+	dicomlog.Vprintf(0, "dicom.serviceProvider(%s): Shutting down gracefully", sp.label)
+	err := sp.listener.Close()
+	drained := sp.Drain()
+	select {
+	case <-drained:
+		sp.cancel()
+		return err
+	case <-ctx.Done():
+	}
+	sp.Shutdown() // nolint: errcheck
+	sp.closeConnections()
+	return ctx.Err()
+}
+
+func (sp *ServiceProvider) isShutdown() bool {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return sp.shutdown
+}
+
+// CancelDrain resumes accepting associations. A channel returned by Drain is
+// never closed if CancelDrain is called before the provider drains.
+func (sp *ServiceProvider) CancelDrain() {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if sp.drainedCh != nil {
+		dicomlog.Vprintf(0, "dicom.serviceProvider(%s): Drain cancelled", sp.label)
+		sp.drainedCh = nil
+		sp.drained = false
+	}
+}
+
+// SetParams replaces the parameters of the provider. Connections accepted
+// afterwards use the new parameters; existing associations keep the old ones.
+// TLS can't be turned on or off, but TLSConfig may be replaced, e.g., to rotate
+// certificates.
+func (sp *ServiceProvider) SetParams(params ServiceProviderParams) error {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if (params.TLSConfig == nil) != (sp.params.TLSConfig == nil) {
+		return fmt.Errorf("dicom.serviceProvider(%s): TLS can't be enabled or disabled on a running provider", sp.label)
+	}
+	if err := validateServiceProviderParams(params); err != nil {
+		return err
+	}
+	sp.params = params
+	dicomlog.Vprintf(0, "dicom.serviceProvider(%s): Parameters updated", sp.label)
+	return nil
+}
+
+// ProviderHealth is a snapshot of the state of a ServiceProvider.
+type ProviderHealth struct {
+	ListenAddr      net.Addr
+	NumAssociations int
+	// Draining is true between Drain and CancelDrain. Drained is true once
+	// every association has ended while draining.
+	Draining bool
+	Drained  bool
+	// Number of DIMSE messages received, over all associations so far,
+	// that matched no outstanding request and no handler.
+	UnexpectedMessages int64
+	// Number of connections closed so far because of a timeout or limit,
+	// by cause. Every cause is present.
+	DroppedConnections map[DropCause]int64
+}
+
+// Health returns a snapshot of the state of the provider.
+func (sp *ServiceProvider) Health() ProviderHealth {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return ProviderHealth{
+		ListenAddr:      sp.listener.Addr(),
+		NumAssociations: len(sp.assocs),
+		Draining:        sp.drainedCh != nil,
+		Drained:         sp.drained,
+
+		UnexpectedMessages: atomic.LoadInt64(&sp.unexpectedMessages),
+		DroppedConnections: sp.dropped.snapshot(),
+	}
+}
+
+func (sp *ServiceProvider) isDraining() bool {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return sp.drainedCh != nil
+}
+
+// Close drainedCh if the provider is draining and idle. Requires sp.mu.
+func (sp *ServiceProvider) checkDrainedLocked() {
+	if sp.drainedCh != nil && !sp.drained && len(sp.assocs) == 0 {
+		dicomlog.Vprintf(0, "dicom.serviceProvider(%s): Drained", sp.label)
+		close(sp.drainedCh)
+		sp.drained = true
 	}
 }
 
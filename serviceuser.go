@@ -6,16 +6,23 @@ package netdicom
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"net"
+	"os"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/antibios/dicom"
 	dicomtag "github.com/antibios/dicom/pkg/tag"
 	dicomuid "github.com/antibios/dicom/pkg/uid"
 	"github.com/antibios/go-dicom/dicomlog"
 	"github.com/antibios/go-netdicom/dimse"
+	"github.com/antibios/go-netdicom/pdu"
 )
 
 type serviceUserStatus int
@@ -42,6 +49,7 @@ const (
 // You must wait for CStore to finish before issuing CFind.
 type ServiceUser struct {
 	label    string // For  logging
+	params   ServiceUserParams
 	upcallCh chan upcallEvent
 
 	mu   *sync.Mutex
@@ -51,15 +59,27 @@ type ServiceUser struct {
 	// Following fields are guarded by mu.
 	status serviceUserStatus
 	cm     *contextManager // Set only after the handshake completes.
+	err    error           // Reason the association failed, if known.
+	// The connection handed to the statemachine, and when. See
+	// userassociation.go.
+	conn      net.Conn
+	startTime time.Time
+
+	// Closed once the statemachine has stopped.
+	done chan struct{}
+	// The pacer of the peer, if ServiceUserParams.PeerProfile is set and
+	// Connect was called. Guarded by mu.
+	pacer *peerPacer
 	// activeCommands map[uint16]*userCommandState // List of commands running
 }
 
 // ServiceUserParams defines parameters for a ServiceUser.
 type ServiceUserParams struct {
-	// Application-entity title of the peer. If empty, set to "unknown-called-ae"
+	// Application-entity title of the peer. If empty, set to
+	// "unknown-called". At most 16 characters; see pdu.ValidateAETitle.
 	CalledAETitle string
 	// Application-entity title of the client. If empty, set to
-	// "unknown-calling-ae"
+	// "unknown-calling". At most 16 characters.
 	CallingAETitle string
 
 	// List of SOPUIDs wanted by the client. The value is typically one of
@@ -69,34 +89,224 @@ type ServiceUserParams struct {
 	// List of Transfer syntaxes supported by the user.  If you know the
 	// transer syntax of the file you are going to copy, set that here.
 	// Otherwise, you'll need to re-encode the data w/ the given transfer
-	// syntax yourself.
+	// syntax yourself. PreferHTJ2KLosslessTransferSyntaxes etc. are presets
+	// for common cases.
+	//
+	// The UIDs in the dicomuid registry are replaced by their canonical
+	// form, see CanonicalTransferSyntaxUID; e.g., JPEG baseline is proposed
+	// as explicit VR little endian. HTJ2K, JPEG XL, and unknown UIDs passed
+	// through by PassThroughUnknownTransferSyntaxes, are proposed as given.
 	//
 	// TODO(saito) Support reencoding internally on C_STORE, etc. The DICOM
 	// spec is particularly moronic here, since we could just have specified
 	// the transfer syntax per data sent.
 	TransferSyntaxes []string
+
+	// If true, propose each of TransferSyntaxes in a separate presentation
+	// context, so that the provider may accept a SOP class under multiple
+	// transfer syntaxes. CStore then picks the context that matches the
+	// dataset's original transfer syntax, avoiding transcoding.  The
+	// number of SOPClasses times TransferSyntaxes must not exceed 128.
+	ContextPerTransferSyntax bool
+
+	// BigEndian selects whether explicit VR big endian is proposed. By
+	// default it is, for compatibility with old peers; new code should set
+	// RetireExplicitVRBigEndian.
+	BigEndian BigEndianPolicy
+
+	// UnknownTransferSyntaxes selects whether TransferSyntaxes may list
+	// UIDs missing from the dicomuid registry. See
+	// PassThroughUnknownTransferSyntaxes.
+	UnknownTransferSyntaxes UnknownTransferSyntaxPolicy
+
+	// If true, CStore fails rather than transcode a dataset when the peer
+	// didn't accept the dataset's original transfer syntax. Use CStoreRaw to
+	// guarantee that the bytes sent are exactly the ones given.
+	PreserveTransferSyntax bool
+
+	// RoleSelections requests SCU/SCP roles for SOP classes, e.g., the SCP
+	// role for the storage classes to be retrieved with CGet. Each class
+	// should also be in SOPClasses. Operations that need a role the
+	// provider didn't grant for a listed class fail up front with
+	// *RoleNotGrantedError; CGet fails so if SCP roles were requested and
+	// none was granted. Roles of unlisted classes aren't checked.
+	RoleSelections []RoleSelection
+
+	// NEventReport, if non-nil, is called on N-EVENT-REPORT requests from
+	// the provider, e.g., the Storage Commitment results that follow an
+	// N-ACTION sent with NRequest. If nil, they are answered with
+	// "unrecognized operation".
+	NEventReport NServiceCallback
+
+	// RoleViolation selects what to do with a C-STORE sub-operation, or
+	// other request from the provider, for a class listed in
+	// RoleSelections for which the user wasn't granted the SCP role.
+	RoleViolation RoleViolationPolicy
+
+	// UserIdentity, if non-nil, is sent in A-ASSOCIATE-RQ for the provider
+	// to authenticate the user (P3.7 D.3.3.7).
+	UserIdentity *UserIdentity
+
+	// UserInformationItems are added to the user information item of
+	// A-ASSOCIATE-RQ, after the standard ones, e.g., vendor-private
+	// negotiation items as *pdu.SubItemUnsupported. The provider's reply
+	// can be read with AssociateAC.
+	UserInformationItems []pdu.SubItem
+
+	// UserIdentityCallback, if non-nil, is called for the identity to send
+	// each time an association is requested, e.g., to present a fresh JWT
+	// or SAML assertion. See NewTokenIdentityCallback. It replaces
+	// UserIdentity. If it fails, the association fails.
+	UserIdentityCallback UserIdentityCallback
+
+	// Tee, if non-nil, copies the bytes of the connection to writers, e.g.,
+	// for live capture. See TeeParams.
+	Tee *TeeParams
+
+	// WriteCoalescing, if non-nil, gathers the P-DATA-TF PDUs sent back to
+	// back into fewer writes to the connection. See
+	// WriteCoalescingParams.
+	WriteCoalescing *WriteCoalescingParams
+
+	// Dial configures how Connect reaches the provider.
+	Dial DialParams
+
+	// PeerProfile, if non-nil, paces the associations Connect opens to the
+	// peer, e.g., for a legacy SCP that needs a pause after each release.
+	// Connect waits as long as the profile requires. It doesn't apply to
+	// SetConn.
+	PeerProfile *PeerProfile
+
+	// TLSConfig, if non-nil, makes Connect run the association over TLS,
+	// e.g., to a provider listening on DefaultTLSPort. If it doesn't set
+	// ServerName, the host given to Connect is used. A failed handshake is
+	// reported as a *TLSHandshakeError.
+	TLSConfig *tls.Config
+
+	// ARTIMTimeout is the duration of the ARTIM timer (P3.8 9.1.5): how
+	// long the user waits for A-ASSOCIATE-AC or -RJ after sending
+	// A-ASSOCIATE-RQ, and for the provider to close the connection after
+	// A-ABORT. On expiry, the association is aborted. If zero,
+	// DefaultARTIMTimeout is used. It can't be negative: the timer can't be
+	// disabled.
+	ARTIMTimeout time.Duration
+
+	// Clock, if non-nil, drives the ARTIM timer. Tests set it to a
+	// VirtualClock. If nil, the real clock is used.
+	Clock Clock
+
+	// ReleaseTimeout bounds the wait for A-RELEASE-RP in Release. The
+	// association is aborted when it expires. If zero,
+	// DefaultReleaseTimeout is used.
+	ReleaseTimeout time.Duration
+
+	// If true, a DIMSE message that matches no outstanding request and no
+	// handler aborts the association. Otherwise it is logged, and dropped
+	// if it's a response, or answered with "unrecognized operation" if it's
+	// a request, e.g., a C-STORE outside of CGet.
+	AbortOnUnexpectedMessage bool
+
+	// MaxCommandSetBytes and MaxCommandElements bound the DIMSE command
+	// sets accepted from the peer. A command set beyond either limit aborts
+	// the association. If zero, dimse.DefaultMaxCommandBytes and
+	// dimse.DefaultMaxCommandElements are used. If negative, no limit
+	// applies.
+	MaxCommandSetBytes int
+	MaxCommandElements int
+
+	// MaxPDUSize is the max PDU size advertised in A-ASSOCIATE-RQ, i.e.,
+	// the largest P-DATA-TF PDU the provider may send. See
+	// ServiceProviderParams.MaxPDUSize.
+	MaxPDUSize int
+
+	// FaultInjector, if non-nil, injects faults into the association. Only
+	// for testing. If nil, the injector set by SetUserFaultInjector is used.
+	FaultInjector FaultInjector
+
+	// Logger, if non-nil, receives the diagnostic messages of this
+	// ServiceUser instead of dicomlog.
+	Logger Logger
 }
 
+// DefaultReleaseTimeout is the default for ServiceUserParams.ReleaseTimeout.
+const DefaultReleaseTimeout = 10 * time.Second
+
+// The max number of presentation contexts in one A-ASSOCIATE-RQ. Context IDs
+// are odd integers in range [1,255]. P3.8 9.3.2.2.
+const maxPresentationContexts = 128
+
 func validateServiceUserParams(params *ServiceUserParams) error {
 	if params.CalledAETitle == "" {
-		params.CalledAETitle = "unknown-called-ae"
+		params.CalledAETitle = "unknown-called"
 	}
 	if params.CallingAETitle == "" {
-		params.CallingAETitle = "unknown-calling-ae"
+		params.CallingAETitle = "unknown-calling"
+	}
+	if err := pdu.ValidateAETitle(params.CalledAETitle); err != nil {
+		return fmt.Errorf("ServiceUserParams.CalledAETitle: %v", err)
+	}
+	if err := pdu.ValidateAETitle(params.CallingAETitle); err != nil {
+		return fmt.Errorf("ServiceUserParams.CallingAETitle: %v", err)
 	}
 	if len(params.SOPClasses) == 0 {
 		return fmt.Errorf("Empty ServiceUserParams.SOPClasses")
 	}
+	if err := validateMaxPDUSize(params.MaxPDUSize); err != nil {
+		return fmt.Errorf("ServiceUserParams.MaxPDUSize: %v", err)
+	}
+	if err := validateRoleSelections(params.RoleSelections); err != nil {
+		return err
+	}
+	if err := params.WriteCoalescing.validate(); err != nil {
+		return fmt.Errorf("ServiceUserParams.%v", err)
+	}
+	if err := params.PeerProfile.validate(); err != nil {
+		return fmt.Errorf("ServiceUserParams.%v", err)
+	}
+	if params.ARTIMTimeout < 0 {
+		return fmt.Errorf("ServiceUserParams.ARTIMTimeout: negative value %v", params.ARTIMTimeout)
+	}
+	if err := validateUserInformationItems(params.UserInformationItems); err != nil {
+		return fmt.Errorf("ServiceUserParams.UserInformationItems: %v", err)
+	}
+	if err := params.UserIdentity.validate(); err != nil {
+		return fmt.Errorf("ServiceUserParams.%v", err)
+	}
+	if params.UserIdentity != nil && params.UserIdentityCallback != nil {
+		return fmt.Errorf("ServiceUserParams: UserIdentity and UserIdentityCallback are exclusive")
+	}
 	if len(params.TransferSyntaxes) == 0 {
 		params.TransferSyntaxes = StandardTransferSyntaxes
 	} else {
-		for i, uid := range params.TransferSyntaxes {
-			canonicalUID, err := CanonicalTransferSyntaxUID(uid)
+		// The caller's slice, e.g., a preset, is left alone.
+		uids := make([]string, 0, len(params.TransferSyntaxes))
+		seen := map[string]bool{}
+		for _, uid := range params.TransferSyntaxes {
+			canonicalUID, err := canonicalTransferSyntaxUID(uid, params.UnknownTransferSyntaxes)
 			if err != nil {
 				return err
 			}
-			params.TransferSyntaxes[i] = canonicalUID
+			// Syntaxes missing from the registry are proposed as
+			// given, so that they can be negotiated at all.
+			if recentTransferSyntaxes[uid] {
+				canonicalUID = uid
+			}
+			if !seen[canonicalUID] {
+				seen[canonicalUID] = true
+				uids = append(uids, canonicalUID)
+			}
 		}
+		params.TransferSyntaxes = uids
+	}
+	if len(proposableTransferSyntaxes(params.TransferSyntaxes, params.BigEndian)) == 0 {
+		return fmt.Errorf("ServiceUserParams: no transfer syntax left after retiring explicit VR big endian")
+	}
+	numContexts := len(params.SOPClasses)
+	if params.ContextPerTransferSyntax {
+		numContexts *= len(params.TransferSyntaxes)
+	}
+	if numContexts > maxPresentationContexts {
+		return fmt.Errorf("ServiceUserParams: too many presentation contexts: %d (max %d)", numContexts, maxPresentationContexts)
 	}
 	return nil
 }
@@ -111,12 +321,18 @@ func NewServiceUser(params ServiceUserParams) (*ServiceUser, error) {
 	label := newUID("user")
 	su := &ServiceUser{
 		label:    label,
+		params:   params,
 		upcallCh: make(chan upcallEvent, 128),
 		disp:     newServiceDispatcher(label),
 		mu:       mu,
 		cond:     sync.NewCond(mu),
 		status:   serviceUserInitial,
+		done:     make(chan struct{}),
 	}
+	su.disp.logf = loggerOrDefault(params.Logger)
+	su.disp.abortOnUnexpected = params.AbortOnUnexpectedMessage
+	su.disp.rolePolicy = params.RoleViolation
+	su.registerNEventReport()
 	go runStateMachineForServiceUser(params, su.upcallCh, su.disp.downcallCh, label)
 	go func() {
 		for event := range su.upcallCh {
@@ -130,10 +346,26 @@ func NewServiceUser(params ServiceUserParams) (*ServiceUser, error) {
 				su.mu.Unlock()
 				continue
 			}
+			if event.eventType == upcallEventError {
+				su.mu.Lock()
+				if su.err == nil {
+					su.err = event.err
+				}
+				su.mu.Unlock()
+				su.disp.handleEvent(event)
+				continue
+			}
 			doassert(event.eventType == upcallEventData)
 			su.disp.handleEvent(event)
 		}
-		dicomlog.Vprintf(1, "dicom.serviceUser: dispatcher finished")
+		su.disp.logf(1, "dicom.serviceUser: dispatcher finished")
+		su.mu.Lock()
+		pacer := su.pacer
+		su.mu.Unlock()
+		if pacer != nil {
+			pacer.end(clockOrDefault(params.Clock), params.PeerProfile)
+		}
+		close(su.done)
 		su.disp.close()
 		su.mu.Lock()
 		su.cond.Broadcast()
@@ -151,7 +383,10 @@ func (su *ServiceUser) waitUntilReady() error {
 	}
 	if su.status != serviceUserAssociationActive {
 		// Will get an error when waiting for a response.
-		dicomlog.Vprintf(0, "dicom.serviceUser: Connection failed")
+		su.disp.logf(0, "dicom.serviceUser: Connection failed")
+		if su.err != nil {
+			return fmt.Errorf("dicom.serviceUser: Connection failed: %w", su.err)
+		}
 		return fmt.Errorf("dicom.serviceUser: Connection failed")
 	}
 	return nil
@@ -160,22 +395,51 @@ func (su *ServiceUser) waitUntilReady() error {
 // Connect connects to the server at the given "host:port". Either Connect or
 // SetConn must be before calling CStore, etc.
 func (su *ServiceUser) Connect(serverAddr string) {
+	su.ConnectContext(context.Background(), serverAddr)
+}
+
+// ConnectContext is like Connect, but gives up on the connection when "ctx" is
+// done. If the host name resolves to several addresses, they are tried as
+// described in DialParams. Returns the error if no connection could be made;
+// the operations that follow fail with it too.
+func (su *ServiceUser) ConnectContext(ctx context.Context, serverAddr string) error {
 	if su.status != serviceUserInitial {
 		panic(fmt.Sprintf("dicom.serviceUser: Connect called with wrong state: %v", su.status))
 	}
-	conn, err := net.Dial("tcp", serverAddr)
+	var err error
+	if su.params.PeerProfile != nil {
+		clock := clockOrDefault(su.params.Clock)
+		pacer := getPeerPacer(serverAddr, clock)
+		if err = pacer.start(ctx, clock, su.params.PeerProfile); err == nil {
+			su.mu.Lock()
+			su.pacer = pacer
+			su.mu.Unlock()
+		} else {
+			pacer.release()
+		}
+	}
+	var conn net.Conn
+	if err == nil {
+		conn, err = dialTCP(ctx, serverAddr, su.params.Dial)
+	}
+	if err == nil && su.params.TLSConfig != nil {
+		conn, err = tlsClientHandshake(ctx, conn, serverAddr, su.params.TLSConfig, su.params.Dial)
+	}
 	if err != nil {
-		dicomlog.Vprintf(0, "dicom.serviceUser: Connect(%s): %v", serverAddr, err)
+		su.disp.logf(0, "dicom.serviceUser: Connect(%s): %v", serverAddr, err)
 		su.disp.downcallCh <- stateEvent{event: evt17, pdu: nil, err: err}
-	} else {
-		su.disp.downcallCh <- stateEvent{event: evt02, pdu: nil, err: nil, conn: conn}
+		return err
 	}
+	su.setConn(conn)
+	su.disp.downcallCh <- stateEvent{event: evt02, pdu: nil, err: nil, conn: conn}
+	return nil
 }
 
 // SetConn instructs ServiceUser to use the given network connection to talk to
 // the server. Either Connect or SetConn must be before calling CStore, etc.
 func (su *ServiceUser) SetConn(conn net.Conn) {
 	doassert(su.status == serviceUserInitial)
+	su.setConn(conn)
 	su.disp.downcallCh <- stateEvent{event: evt02, pdu: nil, err: nil, conn: conn}
 }
 
@@ -186,6 +450,9 @@ func (su *ServiceUser) CEcho() error {
 	if err != nil {
 		return err
 	}
+	if err := su.cm.checkRole(dicomuid.VerificationSOPClass, false); err != nil {
+		return err
+	}
 	context, err := su.cm.lookupByAbstractSyntaxUID(dicomuid.VerificationSOPClass)
 	if err != nil {
 		return err
@@ -201,11 +468,11 @@ func (su *ServiceUser) CEcho() error {
 		}, nil)
 	event, ok := <-cs.upcallCh
 	if !ok {
-		return fmt.Errorf("Failed to receive C-ECHO response")
+		return su.disp.closeError("Failed to receive C-ECHO response")
 	}
 	resp, ok := event.command.(*dimse.CEchoRsp)
 	if !ok {
-		return fmt.Errorf("Invalid response for C-ECHO: %v", event.command)
+		return cs.abortUnexpectedCommand("C-ECHO-RSP", event.command)
 	}
 	if resp.Status.Status != dimse.StatusSuccess {
 		err = fmt.Errorf("Non-OK status in C-ECHO response: %+v", resp.Status)
@@ -230,20 +497,163 @@ func (su *ServiceUser) CStore(ds *dicom.Dataset) error {
 	} else {
 		sopClassUID = sopClassUIDElem.Value.GetValue().([]string)[0]
 	}
-	context, err := su.cm.lookupByAbstractSyntaxUID(sopClassUID)
+	context, err := lookupCStoreContext(su.cm, sopClassUID, datasetTransferSyntaxUID(ds), su.params.PreserveTransferSyntax)
 	if err != nil {
+		su.disp.logf(0, "dicom.serviceUser: C-STORE: sop class %v not found in context %v", sopClassUID, err)
 		return err
 	}
 	cs, err := su.disp.newCommand(su.cm, context)
 	if err != nil {
 		return err
 	}
+	defer su.disp.deleteCommand(cs)
+	return runCStoreOnAssociation(cs, ds, su.params.PreserveTransferSyntax)
+}
+
+// CStoreRaw issues a C-STORE request to send "data" verbatim. data is the body
+// of a dataset encoded in transferSyntaxUID, without the group 0002 metadata
+// elements; it's in the same form as the data passed to CStoreCallback, so an
+// object received by a provider can be relayed bit-for-bit. The call fails
+// if the peer did not accept transferSyntaxUID for sopClassUID, since the data
+// is never transcoded. It blocks until the operation finishes.
+//
+// REQUIRES: Connect() or SetConn has been called.
+func (su *ServiceUser) CStoreRaw(sopClassUID, sopInstanceUID, transferSyntaxUID string, data []byte) error {
+	err := su.waitUntilReady()
+	if err != nil {
+		return err
+	}
+	doassert(su.cm != nil)
+	context, err := lookupCStoreContext(su.cm, sopClassUID, transferSyntaxUID, true)
+	if err != nil {
+		su.disp.logf(0, "dicom.serviceUser: C-STORE: %v", err)
+		return err
+	}
+	cs, err := su.disp.newCommand(su.cm, context)
+	if err != nil {
+		return err
+	}
+	defer su.disp.deleteCommand(cs)
+	return runCStoreBytesOnAssociation(cs, context, sopClassUID, sopInstanceUID, data)
+}
+
+// CStoreRawFromReader is like CStoreRaw, but streams the data from "r" until
+// EOF, so the object need not be held in memory. If reading "r" fails after
+// the request has started, the association is aborted, since the peer can't
+// be told that the data is incomplete.
+//
+// REQUIRES: Connect() or SetConn has been called.
+func (su *ServiceUser) CStoreRawFromReader(sopClassUID, sopInstanceUID, transferSyntaxUID string, r io.Reader) error {
+	err := su.waitUntilReady()
+	if err != nil {
+		return err
+	}
+	doassert(su.cm != nil)
+	context, err := lookupCStoreContext(su.cm, sopClassUID, transferSyntaxUID, true)
+	if err != nil {
+		su.disp.logf(0, "dicom.serviceUser: C-STORE: %v", err)
+		return err
+	}
+	cs, err := su.disp.newCommand(su.cm, context)
 	if err != nil {
-		dicomlog.Vprintf(0, "dicom.serviceUser: C-STORE: sop class %v not found in context %v", sopClassUID, err)
 		return err
 	}
 	defer su.disp.deleteCommand(cs)
-	return runCStoreOnAssociation(cs.upcallCh, su.disp.downcallCh, su.cm, cs.messageID, ds)
+	return runCStoreReaderOnAssociation(cs, context, sopClassUID, sopInstanceUID, r)
+}
+
+// CStoreFromReader is like CStoreRawFromReader, but sends exactly "size"
+// bytes read from "r"; anything after them is left unread. If "r" ends early,
+// the association is aborted before the last fragment is sent, so that the
+// peer can't take a truncated object for a complete one. "size" must be even,
+// as the length of a dataset is.
+//
+// REQUIRES: Connect() or SetConn has been called.
+func (su *ServiceUser) CStoreFromReader(sopClassUID, sopInstanceUID, transferSyntaxUID string, r io.Reader, size int64) error {
+	if size < 0 || size%2 != 0 {
+		return fmt.Errorf("dicom.serviceUser: C-STORE: data size %d is negative or odd", size)
+	}
+	return su.CStoreRawFromReader(sopClassUID, sopInstanceUID, transferSyntaxUID, &sizedReader{r: r, size: size, left: size})
+}
+
+// CStoreDataset sends "ds" verbatim, in its own transfer syntax, as
+// CStoreRawFromReader. Use NewDicomDatasetSource for a dicom.Dataset that may
+// be transcoded instead, or CStore.
+//
+// REQUIRES: Connect() or SetConn has been called.
+func (su *ServiceUser) CStoreDataset(ds DatasetSource) error {
+	if raw, ok := ds.(*RawDataset); ok {
+		return su.CStoreRaw(raw.sopClassUID, raw.sopInstanceUID, raw.transferSyntaxUID, raw.data)
+	}
+	r, w := io.Pipe()
+	go func() {
+		_, err := ds.WriteTo(w)
+		w.CloseWithError(err)
+	}()
+	err := su.CStoreRawFromReader(ds.SOPClassUID(), ds.SOPInstanceUID(), ds.TransferSyntaxUID(), r)
+	// Unblock the writer if the request ended before reading everything.
+	r.Close()
+	return err
+}
+
+// CStorePart10 sends a DICOM Part-10 file read from "r" without parsing the
+// dataset. The SOP class, SOP instance and transfer syntax are taken from the
+// file meta information, and the rest of the file is sent verbatim as in
+// CStoreRawFromReader.
+//
+// REQUIRES: Connect() or SetConn has been called.
+func (su *ServiceUser) CStorePart10(r io.Reader) error {
+	h, err := readPart10Header(r)
+	if err != nil {
+		return err
+	}
+	return su.CStoreRawFromReader(h.sopClassUID, h.sopInstanceUID, h.transferSyntaxUID, r)
+}
+
+// CStoreFile sends the DICOM Part-10 file at "path", as CStorePart10. Where
+// the platform supports mmap, the file is mapped and the PDVs are sliced
+// directly from the mapping, so that multi-gigabyte objects aren't copied
+// through read buffers. Elsewhere, or if the file can't be mapped, it is
+// streamed as in CStorePart10.
+//
+// REQUIRES: Connect() or SetConn has been called.
+func (su *ServiceUser) CStoreFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	mapping, err := mapFile(f)
+	if err != nil {
+		su.disp.logf(1, "dicom.serviceUser: C-STORE: can't map %s (%v); reading it instead", path, err)
+		return su.CStorePart10(f)
+	}
+	mapped := newMappedData(mapping, nil)
+	r := bytes.NewReader(mapping)
+	h, err := readPart10Header(r)
+	if err != nil {
+		mapped.release()
+		return err
+	}
+	mapped.body = mapping[len(mapping)-r.Len():]
+	if err := su.waitUntilReady(); err != nil {
+		mapped.release()
+		return err
+	}
+	doassert(su.cm != nil)
+	context, err := lookupCStoreContext(su.cm, h.sopClassUID, h.transferSyntaxUID, true)
+	if err != nil {
+		su.disp.logf(0, "dicom.serviceUser: C-STORE: %v", err)
+		mapped.release()
+		return err
+	}
+	cs, err := su.disp.newCommand(su.cm, context)
+	if err != nil {
+		mapped.release()
+		return err
+	}
+	defer su.disp.deleteCommand(cs)
+	return runCStoreMappedOnAssociation(cs, context, h.sopClassUID, h.sopInstanceUID, mapped)
 }
 
 // QRLevel is used to specify the element hierarchy assumed during C-FIND,
@@ -306,6 +716,9 @@ func encodeQRPayload(opType qrOpType, qrLevel QRLevel, filter []*dicom.Element,
 		return contextManagerEntry{}, nil, fmt.Errorf("Invalid C-FIND QR lever: %d", qrLevel)
 	}
 
+	if err := cm.checkRole(sopClassUID, false); err != nil {
+		return contextManagerEntry{}, nil, err
+	}
 	// Translate qrLevel to the sopclass and QRLevel elem.
 	// Encode the C-FIND DIMSE command.
 	context, err := cm.lookupByAbstractSyntaxUID(sopClassUID)
@@ -320,17 +733,22 @@ func encodeQRPayload(opType qrOpType, qrLevel QRLevel, filter []*dicom.Element,
 	b := bytes.Buffer{}
 	dataEncoder := dicom.NewWriter(&b, dicom.SkipVRVerification())
 	dataEncoder.SetTransferSyntax(binary.LittleEndian, true)
+	elems := make([]*dicom.Element, 0, len(filter)+1)
 	foundQRLevel := false
 	for _, elem := range filter {
 		if elem.Tag == dicomtag.QueryRetrieveLevel {
 			foundQRLevel = true
 		}
-		dataEncoder.WriteElement(elem)
-		dicomlog.Vprintf(2, "dicom.serviceUser: Add QR payload: %v", elem)
+		elems = append(elems, elem)
 	}
 	if !foundQRLevel {
-		elem := dicom.MustNewElement(dicomtag.QueryRetrieveLevel, qrLevelString)
-		dicomlog.Vprintf(2, "dicom.serviceUser: Add QR payload: %v", elem)
+		elems = append(elems, dicom.MustNewElement(dicomtag.QueryRetrieveLevel, qrLevelString))
+	}
+	// The identifier is a dataset, whose elements must be in ascending tag
+	// order; strict providers reject or misparse it otherwise.
+	sort.SliceStable(elems, func(i, j int) bool { return tagLess(elems[i].Tag, elems[j].Tag) })
+	for _, elem := range elems {
+		cm.logf(2, "dicom.serviceUser: Add QR payload: %v", elem)
 		dataEncoder.WriteElement(elem)
 	}
 	/* 	if err := dataEncoder.Error(); err != nil {
@@ -380,28 +798,27 @@ func (su *ServiceUser) CFind(qrLevel QRLevel, filter []*dicom.Element) chan CFin
 		for {
 			event, ok := <-cs.upcallCh
 			if !ok {
-				su.status = serviceUserClosed
-				ch <- CFindResult{Err: fmt.Errorf("Connection closed while waiting for C-FIND response")}
+				su.setClosed()
+				ch <- CFindResult{Err: su.disp.closeError("Connection closed while waiting for C-FIND response")}
 				break
 			}
 			doassert(event.eventType == upcallEventData)
 			doassert(event.command != nil)
 			resp, ok := event.command.(*dimse.CFindRsp)
 			if !ok {
-				ch <- CFindResult{Err: fmt.Errorf("Found wrong response for C-FIND: %v", event.command)}
+				ch <- CFindResult{Err: cs.abortUnexpectedCommand("C-FIND-RSP", event.command)}
 				break
 			}
 			elems, err := readElementsInBytes(event.data, context.transferSyntaxUID)
 			if err != nil {
-				dicomlog.Vprintf(0, "dicom.serviceUser: Failed to decode C-FIND response: %v %v", resp.String(), err)
+				su.disp.logf(0, "dicom.serviceUser: Failed to decode C-FIND response: %v %v", resp.String(), err)
 				ch <- CFindResult{Err: err}
 			} else {
 				ch <- CFindResult{Elements: elems}
 			}
 			if resp.Status.Status != dimse.StatusPending {
 				if resp.Status.Status != 0 {
-					// TODO: report error if status!= 0
-					panic(resp)
+					ch <- CFindResult{Err: fmt.Errorf("Received C-FIND error: %+v", resp)}
 				}
 				break
 			}
@@ -429,6 +846,9 @@ func (su *ServiceUser) CGet(qrLevel QRLevel, filter []*dicom.Element,
 	if err != nil {
 		return err
 	}
+	if err := su.cm.checkCGetRoles(); err != nil {
+		return err
+	}
 	cs, err := su.disp.newCommand(su.cm, context)
 	if err != nil {
 		return err
@@ -463,19 +883,19 @@ func (su *ServiceUser) CGet(qrLevel QRLevel, filter []*dicom.Element,
 	for {
 		event, ok := <-cs.upcallCh
 		if !ok {
-			su.status = serviceUserClosed
-			return fmt.Errorf("Connection closed while waiting for C-GET response")
+			su.setClosed()
+			return su.disp.closeError("Connection closed while waiting for C-GET response")
 		}
 		doassert(event.eventType == upcallEventData)
 		doassert(event.command != nil)
 		resp, ok := event.command.(*dimse.CGetRsp)
 		if !ok {
-			return fmt.Errorf("Found wrong response for C-GET: %v", event.command)
+			return cs.abortUnexpectedCommand("C-GET-RSP", event.command)
 		}
 		if resp.Status.Status != dimse.StatusPending {
 			if resp.Status.Status != 0 {
 				e := fmt.Errorf("Received C-GET error: %+v", resp)
-				dicomlog.Vprintf(0, "dicom.serviceUser: C-GET: %v", e)
+				su.disp.logf(0, "dicom.serviceUser: C-GET: %v", e)
 				return e
 			}
 			break
@@ -484,13 +904,150 @@ func (su *ServiceUser) CGet(qrLevel QRLevel, filter []*dicom.Element,
 	return nil
 }
 
+// CMoveProgress is the state of a C-MOVE, as reported by one C-MOVE-RSP.
+// P3.4 C.4.2.1.6.
+type CMoveProgress struct {
+	// The number of C-STORE sub-operations to the move destination that
+	// remain, that completed, that failed, and that completed with a
+	// warning. Remaining is -1 if the response didn't say; it's usually
+	// absent in the final response.
+	Remaining int
+	Completed int
+	Failed    int
+	Warning   int
+
+	// Status of the response: dimse.StatusPending until the final one.
+	Status dimse.Status
+}
+
+// CMove runs a C-MOVE command, asking the peer to send the objects that match
+// "filter" to the AE "moveDestination" with C-STORE. The peer must know the
+// address of that AE. "progress", if non-nil, is called for each pending
+// response. This function blocks until the final response arrives, and
+// returns it.
+//
+// An error is returned if the final status is neither success nor
+// dimse.CMoveSubOperationsFailed, the warning that some sub-operations failed;
+// check Failed and Warning in the result.
+//
+// REQUIRES: Connect() or SetConn has been called.
+func (su *ServiceUser) CMove(moveDestination string, qrLevel QRLevel, filter []*dicom.Element,
+	progress func(CMoveProgress)) (CMoveProgress, error) {
+	if err := pdu.ValidateAETitle(moveDestination); err != nil {
+		return CMoveProgress{}, fmt.Errorf("dicom.serviceUser: C-MOVE destination: %v", err)
+	}
+	err := su.waitUntilReady()
+	if err != nil {
+		return CMoveProgress{}, err
+	}
+	context, payload, err := encodeQRPayload(qrOpCMove, qrLevel, filter, su.cm)
+	if err != nil {
+		return CMoveProgress{}, err
+	}
+	cs, err := su.disp.newCommand(su.cm, context)
+	if err != nil {
+		return CMoveProgress{}, err
+	}
+	defer su.disp.deleteCommand(cs)
+	cs.sendMessage(
+		&dimse.CMoveRq{
+			AffectedSOPClassUID: context.abstractSyntaxUID,
+			MessageID:           cs.messageID,
+			MoveDestination:     moveDestination,
+			CommandDataSetType:  dimse.CommandDataSetTypeNonNull,
+		},
+		payload)
+	for {
+		event, ok := <-cs.upcallCh
+		if !ok {
+			su.setClosed()
+			return CMoveProgress{}, su.disp.closeError("Connection closed while waiting for C-MOVE response")
+		}
+		doassert(event.eventType == upcallEventData)
+		doassert(event.command != nil)
+		resp, ok := event.command.(*dimse.CMoveRsp)
+		if !ok {
+			return CMoveProgress{}, cs.abortUnexpectedCommand("C-MOVE-RSP", event.command)
+		}
+		p := CMoveProgress{
+			Remaining: -1,
+			Completed: int(resp.NumberOfCompletedSuboperations),
+			Failed:    int(resp.NumberOfFailedSuboperations),
+			Warning:   int(resp.NumberOfWarningSuboperations),
+			Status:    resp.Status,
+		}
+		if resp.Status.Status == dimse.StatusPending || resp.RemainingSuboperationsPresent {
+			p.Remaining = int(resp.NumberOfRemainingSuboperations)
+		}
+		if resp.Status.Status == dimse.StatusPending {
+			if progress != nil {
+				progress(p)
+			}
+			continue
+		}
+		if resp.Status.Status != dimse.StatusSuccess && resp.Status.Status != dimse.CMoveSubOperationsFailed {
+			e := fmt.Errorf("Received C-MOVE error: %+v", resp)
+			su.disp.logf(0, "dicom.serviceUser: C-MOVE: %v", e)
+			return p, e
+		}
+		return p, nil
+	}
+}
+
+// Record that the association is gone. Info reads the status from other
+// goroutines, hence the lock.
+func (su *ServiceUser) setClosed() {
+	su.mu.Lock()
+	su.status = serviceUserClosed
+	su.mu.Unlock()
+}
+
 // Release shuts down the connection. It must be called exactly once.  After
 // Release(), no other operation can be performed on the ServiceUser object.
-func (su *ServiceUser) Release() {
+//
+// If the association is established, Release sends A-RELEASE-RQ and waits for
+// the peer to answer, for at most ServiceUserParams.ReleaseTimeout. If the
+// peer doesn't answer in time, the association is aborted and an error is
+// returned. An error is also returned if the peer aborts instead of
+// answering.
+func (su *ServiceUser) Release() error {
+	su.mu.Lock()
+	active := su.status == serviceUserAssociationActive
+	su.mu.Unlock()
 	su.disp.downcallCh <- stateEvent{event: evt11}
+	var err error
+	if active {
+		err = su.waitForRelease()
+	}
 	su.mu.Lock()
 	defer su.mu.Unlock()
 	su.status = serviceUserClosed
 	su.cond.Broadcast()
 	su.disp.close()
+	return err
+}
+
+// Wait for the statemachine to stop after A-RELEASE-RQ has been sent. Aborts
+// the association on timeout.
+func (su *ServiceUser) waitForRelease() error {
+	timeout := su.params.ReleaseTimeout
+	if timeout <= 0 {
+		timeout = DefaultReleaseTimeout
+	}
+	expired := make(chan struct{})
+	timer := clockOrDefault(su.params.Clock).AfterFunc(timeout, func() { close(expired) })
+	defer timer.Stop()
+	select {
+	case <-su.done:
+		su.mu.Lock()
+		defer su.mu.Unlock()
+		if su.err != nil {
+			return fmt.Errorf("dicom.serviceUser(%s): release failed: %w", su.label, su.err)
+		}
+		return nil
+	case <-expired:
+		su.disp.logf(0, "dicom.serviceUser(%s): No A-RELEASE-RP after %v; aborting", su.label, timeout)
+		su.disp.downcallCh <- stateEvent{event: evt15}
+		return fmt.Errorf("dicom.serviceUser(%s): peer did not answer A-RELEASE-RQ within %v; association aborted", su.label, timeout)
+	}
 }
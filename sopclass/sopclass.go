@@ -1,6 +1,8 @@
 package sopclass
 
 import (
+	"strings"
+
 	dicomuid "github.com/antibios/dicom/pkg/uid"
 )
 
@@ -162,3 +164,38 @@ var QRGetClasses = append([]string{
 	standardUID("1.2.840.10008.5.1.4.1.2.2.3"),
 	standardUID("1.2.840.10008.5.1.4.1.2.3.3")},
 	StorageClasses...)
+
+// NServiceClasses are the classes built on the DIMSE N-services: Storage
+// Commitment Push Model and Modality Performed Procedure Step.
+var NServiceClasses = []string{
+	standardUID("1.2.840.10008.1.20.1"),
+	MPPSClasses[0]}
+
+// MPPSClasses is for issuing Modality Performed Procedure Step N-CREATE and
+// N-SET requests.
+var MPPSClasses = []string{
+	standardUID("1.2.840.10008.3.1.2.3.3")}
+
+// Category reports whether a SOP class belongs to a family of classes. It is
+// used to route C-STORE requests by the kind of object they carry.
+type Category func(sopClassUID string) bool
+
+// HasPrefix returns a Category matching the SOP classes whose UIDs start with
+// "prefix".
+func HasPrefix(prefix string) Category {
+	return func(sopClassUID string) bool {
+		return strings.HasPrefix(sopClassUID, prefix)
+	}
+}
+
+var (
+	// StructuredReport matches the structured report storage classes,
+	// including key object selection and CAD SR. P3.4 B.5.
+	StructuredReport = HasPrefix("1.2.840.10008.5.1.4.1.1.88.")
+
+	// Waveform matches the waveform storage classes.
+	Waveform = HasPrefix("1.2.840.10008.5.1.4.1.1.9.")
+
+	// PresentationState matches the presentation state storage classes.
+	PresentationState = HasPrefix("1.2.840.10008.5.1.4.1.1.11.")
+)
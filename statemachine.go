@@ -5,7 +5,9 @@ package netdicom
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -13,8 +15,6 @@ import (
 	"time"
 
 	"github.com/antibios/dicom"
-	dicomuid "github.com/antibios/dicom/pkg/uid"
-	"github.com/antibios/go-dicom/dicomlog"
 	"github.com/antibios/go-netdicom/dimse"
 	"github.com/antibios/go-netdicom/pdu"
 )
@@ -163,10 +163,27 @@ var actionAe2 = &stateAction{"AE-2", "Connection established on the user side. S
 	func(sm *stateMachine, event stateEvent) stateType {
 		doassert(event.conn != nil)
 		sm.conn = event.conn
-		go networkReaderThread(sm.netCh, event.conn, DefaultMaxPDUSize, sm.label)
+		sm.contextManager.callingAETitle = sm.userParams.CallingAETitle
+		sm.contextManager.calledAETitle = sm.userParams.CalledAETitle
+		sm.contextManager.proposedRoles = sm.userParams.RoleSelections
+		sm.contextManager.maxPDUSize = maxPDUSizeOrDefault(sm.userParams.MaxPDUSize)
+		identity, err := userIdentityForRequest(sm.userParams)
+		if err != nil {
+			sm.logf(0, "dicom.stateMachine(%s): AE-2: %v", sm.label, err)
+			sm.upcallCh <- upcallEvent{eventType: upcallEventError, err: err}
+			closeConnection(sm)
+			return sta01
+		}
+		sm.contextManager.proposedIdentity = identity
+		sm.tee = newConnTee(sm.userParams.Tee, event.conn, sm.label)
+		go networkReaderThread(sm.netCh, event.conn, nil, nil, sm.tee, DefaultMaxPDUSize, sm.label, sm.logf)
 		items := sm.contextManager.generateAssociateRequest(
 			sm.userParams.SOPClasses,
-			sm.userParams.TransferSyntaxes)
+			sm.userParams.TransferSyntaxes,
+			sm.userParams.ContextPerTransferSyntax)
+		for _, item := range sm.userParams.UserInformationItems {
+			addUserInformationItem(items, item)
+		}
 		pdu := &pdu.AAssociate{
 			Type:            pdu.TypeAAssociateRq,
 			ProtocolVersion: pdu.CurrentProtocolVersion,
@@ -184,6 +201,7 @@ var actionAe3 = &stateAction{"AE-3", "Issue A-ASSOCIATE confirmation (accept) pr
 		stopTimer(sm)
 		v := event.pdu.(*pdu.AAssociate)
 		doassert(v.Type == pdu.TypeAAssociateAc)
+		sm.contextManager.associateAC = v
 		err := sm.contextManager.onAssociateResponse(v.Items)
 		if err == nil {
 			sm.upcallCh <- upcallEvent{
@@ -192,12 +210,24 @@ var actionAe3 = &stateAction{"AE-3", "Issue A-ASSOCIATE confirmation (accept) pr
 			}
 			return sta06
 		}
-		dicomlog.Vprintf(0, "dicom.stateMachine: AE-3: %v", err)
+		sm.logf(0, "dicom.stateMachine(%s): AE-3: %v", sm.label, err)
+		if _, ok := err.(*NoAcceptedContextsError); ok {
+			// The A-ASSOCIATE-AC itself is well formed; it's the local
+			// user that can't make use of it.
+			sm.upcallCh <- upcallEvent{eventType: upcallEventError, err: err}
+			return actionAa1.Callback(sm, event)
+		}
+		event.err = err
 		return actionAa8.Callback(sm, event)
 	}}
 
 var actionAe4 = &stateAction{"AE-4", "Issue A-ASSOCIATE confirmation (reject) primitive and close transport connection",
 	func(sm *stateMachine, event stateEvent) stateType {
+		v := event.pdu.(*pdu.AAssociateRj)
+		sm.upcallCh <- upcallEvent{
+			eventType: upcallEventError,
+			err:       &AssociationRejectedError{Result: v.Result, Source: v.Source, Reason: v.Reason},
+		}
 		closeConnection(sm)
 		return sta01
 	}}
@@ -206,9 +236,24 @@ var actionAe5 = &stateAction{"AE-5", "Issue Transport connection response primit
 	func(sm *stateMachine, event stateEvent) stateType {
 		doassert(event.conn != nil)
 		startTimer(sm)
-		go func(ch chan stateEvent, conn net.Conn) {
-			networkReaderThread(ch, conn, DefaultMaxPDUSize, sm.label)
-		}(sm.netCh, event.conn)
+		ch, conn := sm.netCh, event.conn
+		guard := newReadGuard(conn, sm.providerParams, sm.clock)
+		sm.tee = newConnTee(sm.providerParams.Tee, conn, sm.label)
+		tee := sm.tee
+		var flow *cstoreStreamFlow
+		if sm.cstoreStreamer != nil {
+			flow = sm.cstoreStreamer.flow
+		}
+		if sm.providerParams.ReadMode == ReadSharedPoller {
+			if poller, err := sharedPoller(); err == nil {
+				sm.polled = startPolledNetworkReader(poller, sm.stats, ch, conn, guard, flow, tee, DefaultMaxPDUSize, sm.label, sm.logf)
+			}
+		}
+		if sm.polled == nil {
+			sm.stats.goFunc(func() {
+				networkReaderThread(ch, conn, guard, flow, tee, DefaultMaxPDUSize, sm.label, sm.logf)
+			})
+		}
 		return sta02
 	}}
 
@@ -229,14 +274,65 @@ otherwise issue A-ASSOCIATE-RJ-PDU and start ARTIM timer`,
 		stopTimer(sm)
 		v := event.pdu.(*pdu.AAssociate)
 		if v.ProtocolVersion != 0x0001 {
-			dicomlog.Vprintf(0, "dicom.stateMachine(%s): Wrong remote protocol version 0x%x", sm.label, v.ProtocolVersion)
-			rj := pdu.AAssociateRj{Result: 1, Source: 2, Reason: 2}
+			sm.logf(0, "dicom.stateMachine(%s): Wrong remote protocol version 0x%x", sm.label, v.ProtocolVersion)
+			rj := pdu.AAssociateRj{
+				Result: pdu.ResultRejectedPermanent,
+				Source: pdu.SourceULServiceProviderACSE,
+				Reason: pdu.RejectReasonProtocolVersionNotSupported,
+			}
 			sendPDU(sm, &rj)
 			startTimer(sm)
 			return sta13
 		}
+		if sm.draining != nil && sm.draining() {
+			sm.logf(0, "dicom.stateMachine(%s): AE-6: provider is draining; rejecting association", sm.label)
+			sm.downcallCh <- stateEvent{
+				event: evt08,
+				pdu: &pdu.AAssociateRj{
+					Result: pdu.ResultRejectedTransient,
+					Source: pdu.SourceULServiceProviderPresentation,
+					Reason: pdu.RejectReasonTemporaryCongestion,
+				},
+			}
+			return sta03
+		}
+		if !isCallingAETitleAllowed(sm.providerParams.AllowedCallingAETitles, v.CallingAETitle) {
+			sm.logf(0, "dicom.stateMachine(%s): AE-6: calling AE title '%s' not allowed", sm.label, v.CallingAETitle)
+			sm.downcallCh <- stateEvent{
+				event: evt08,
+				pdu: &pdu.AAssociateRj{
+					Result: pdu.ResultRejectedPermanent,
+					Source: pdu.SourceULServiceUser,
+					Reason: pdu.RejectReasonCallingAETitleNotRecognized,
+				},
+			}
+			return sta03
+		}
+		if !isCalledAETitleAccepted(sm.providerParams.CalledAETitles, v.CalledAETitle) {
+			sm.logf(0, "dicom.stateMachine(%s): AE-6: called AE title '%s' (raw %q) not recognized", sm.label, v.CalledAETitle, v.RawCalledAETitle)
+			sm.downcallCh <- stateEvent{
+				event: evt08,
+				pdu: &pdu.AAssociateRj{
+					Result: pdu.ResultRejectedPermanent,
+					Source: pdu.SourceULServiceUser,
+					Reason: pdu.RejectReasonCalledAETitleNotRecognized,
+				},
+			}
+			return sta03
+		}
+		if cb := sm.providerParams.OnAssociateRequest; cb != nil {
+			if err := cb(newAssociateRequest(v, sm.conn)); err != nil {
+				sm.logf(0, "dicom.stateMachine(%s): AE-6: association from '%s' rejected by OnAssociateRequest: %v", sm.label, v.CallingAETitle, err)
+				sm.downcallCh <- stateEvent{event: evt08, pdu: associateRejection(err)}
+				return sta03
+			}
+		}
 		responses, err := sm.contextManager.onAssociateRequest(v.Items)
+		if err == nil && sm.contextManager.numAcceptedContexts() == 0 && sm.providerParams.RejectAssociationWithoutContexts {
+			err = fmt.Errorf("dicom.stateMachine(%s): no presentation context acceptable", sm.label)
+		}
 		if err != nil {
+			sm.logf(0, "dicom.stateMachine(%s): AE-6: rejecting association: %v", sm.label, err)
 			// TODO(saito) set proper error code.
 			sm.downcallCh <- stateEvent{
 				event: evt08,
@@ -250,22 +346,89 @@ otherwise issue A-ASSOCIATE-RJ-PDU and start ARTIM timer`,
 			doassert(len(responses) > 0)
 			doassert(v.CalledAETitle != "")
 			doassert(v.CallingAETitle != "")
+			sm.callingAETitle = pdu.NormalizeAETitle(v.CallingAETitle)
+			sm.stats.setCallingAETitle(sm.callingAETitle)
+			sm.contextManager.callingAETitle = sm.callingAETitle
+			sm.contextManager.calledAETitle = pdu.NormalizeAETitle(v.CalledAETitle)
+			sm.contextManager.rawCallingAETitle = v.RawCallingAETitle
+			sm.contextManager.rawCalledAETitle = v.RawCalledAETitle
+			identityResponse, err := authenticateUser(sm)
+			if err != nil {
+				sm.logf(0, "dicom.stateMachine(%s): AE-6: rejecting association from '%s': authentication failed: %v", sm.label, sm.callingAETitle, err)
+				sm.downcallCh <- stateEvent{
+					event: evt08,
+					pdu: &pdu.AAssociateRj{
+						Result: pdu.ResultRejectedPermanent,
+						Source: pdu.SourceULServiceUser,
+						Reason: pdu.RejectReasonNone,
+					},
+				}
+				return sta03
+			}
+			if identityResponse != nil {
+				addUserInformationItem(responses, identityResponse)
+			}
+			if cb := sm.providerParams.UserInformationReply; cb != nil {
+				items := cb(newAssociateRequest(v, sm.conn))
+				if err := validateUserInformationItems(items); err != nil {
+					sm.logf(0, "dicom.stateMachine(%s): AE-6: dropping the items of UserInformationReply: %v", sm.label, err)
+					items = nil
+				}
+				for _, item := range items {
+					addUserInformationItem(responses, item)
+				}
+			}
 			sm.downcallCh <- stateEvent{
 				event: evt07,
 				pdu: &pdu.AAssociate{
-					Type:            pdu.TypeAAssociateAc,
-					ProtocolVersion: pdu.CurrentProtocolVersion,
-					CalledAETitle:   v.CalledAETitle,
-					CallingAETitle:  v.CallingAETitle,
-					Items:           responses,
+					Type:              pdu.TypeAAssociateAc,
+					ProtocolVersion:   pdu.CurrentProtocolVersion,
+					CalledAETitle:     v.CalledAETitle,
+					CallingAETitle:    v.CallingAETitle,
+					RawCalledAETitle:  v.RawCalledAETitle,
+					RawCallingAETitle: v.RawCallingAETitle,
+					Items:             responses,
 				},
 			}
 		}
 		return sta03
 	}}
+
+// Reports whether the peer may associate. An empty list allows everyone.
+func isCallingAETitleAllowed(allowed []string, aeTitle string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	aeTitle = pdu.NormalizeAETitle(aeTitle)
+	for _, a := range allowed {
+		if pdu.NormalizeAETitle(a) == aeTitle {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether the provider answers to "aeTitle". An empty list, or one
+// that contains "*", accepts any title.
+func isCalledAETitleAccepted(accepted []string, aeTitle string) bool {
+	if len(accepted) == 0 {
+		return true
+	}
+	aeTitle = pdu.NormalizeAETitle(aeTitle)
+	for _, a := range accepted {
+		if a == "*" || pdu.NormalizeAETitle(a) == aeTitle {
+			return true
+		}
+	}
+	return false
+}
+
 var actionAe7 = &stateAction{"AE-7", "Send A-ASSOCIATE-AC PDU",
 	func(sm *stateMachine, event stateEvent) stateType {
 		sendPDU(sm, event.pdu.(*pdu.AAssociate))
+		peer := newPeer(sm.conn, sm.contextManager)
+		sm.logf(0, "dicom.stateMachine(%s): Association accepted from %v", sm.label, peer)
+		sm.stats.setPeer(peer)
 		sm.upcallCh <- upcallEvent{
 			eventType: upcallEventHandshakeCompleted,
 			cm:        sm.contextManager,
@@ -280,20 +443,40 @@ var actionAe8 = &stateAction{"AE-8", "Send A-ASSOCIATE-RJ PDU and start ARTIM ti
 		return sta13
 	}}
 
-// Produce a list of P_DATA_TF PDUs that collective store "data".
-func splitDataIntoPDUs(sm *stateMachine, abstractSyntaxName string, command bool, data []byte) []pdu.PDataTf {
-	doassert(len(data) > 0)
-	context, err := sm.contextManager.lookupByAbstractSyntaxUID(abstractSyntaxName)
+// Largest P_DATA_TF PDU sent, whatever the peer accepts. Peers may announce
+// no limit (0), or up to 4GB, and send buffers are allocated this large.
+const maxSendPDUSize = DefaultMaxPDUSize
+
+// Size of the header of a PDV item: the item length, the context ID and the
+// message control header. P3.8 9.3.5.1.
+const pdvHeaderSize = 6
+
+// Returns the largest PDV value that fits in the P_DATA_TF PDUs sent to the
+// peer. The max PDU size bounds the variable field of the PDU, so a PDV of
+// this size fills a PDU exactly.
+func maxPDVValueSize(sm *stateMachine) int {
+	size := sm.contextManager.peerMaxPDUSize
+	if size <= 0 || size > maxSendPDUSize {
+		// 0 means no limit. P3.8 D.1.
+		size = maxSendPDUSize
+	}
+	if size -= pdvHeaderSize; size < 1 {
+		size = 1
+	}
+	return size
+}
+
+// Split "data" into PDUs of one PDV each. Empty data, e.g., an empty dataset,
+// takes one zero-length PDV, so that the peer still sees its last fragment.
+func splitDataIntoPDUs(sm *stateMachine, contextID byte, command bool, data []byte) []pdu.PDataTf {
+	context, err := sm.contextManager.lookupByContextID(contextID)
 	if err != nil {
 		// TODO(saito) Don't crash here.
-		panic(fmt.Sprintf("dicom.stateMachine(%s): Illegal syntax name %s: %s", sm.label, dicomuid.UIDString(abstractSyntaxName), err))
+		panic(fmt.Sprintf("dicom.stateMachine(%s): Illegal context ID %d: %s", sm.label, contextID, err))
 	}
 	var pdus []pdu.PDataTf
-	// two byte header overhead.
-	//
-	// TODO(saito) move the magic number elsewhere.
-	var maxChunkSize = sm.contextManager.peerMaxPDUSize - 8
-	for len(data) > 0 {
+	var maxChunkSize = maxPDVValueSize(sm)
+	for len(data) > 0 || len(pdus) == 0 {
 		chunkSize := len(data)
 		if chunkSize > maxChunkSize {
 			chunkSize = maxChunkSize
@@ -314,10 +497,207 @@ func splitDataIntoPDUs(sm *stateMachine, abstractSyntaxName string, command bool
 	return pdus
 }
 
+// Send the command+data of each payload, in order. Unlike DT-1, PDVs of
+// consecutive messages share a P_DATA_TF PDU as long as the peer's max PDU
+// size allows, so that many small messages, e.g., C-FIND responses, take few
+// PDUs.
+func sendBatchedMessages(sm *stateMachine, payloads []*stateEventDIMSEPayload) {
+	var items []pdu.PresentationDataValueItem
+	for _, payload := range payloads {
+		doassert(payload.dataReader == nil && payload.mapped == nil && len(payload.batch) == 0)
+		b := bytes.Buffer{}
+		e := dicom.NewWriter(&b, dicom.SkipVRVerification())
+		e.SetTransferSyntax(binary.LittleEndian, true)
+		dimse.EncodeMessage(e, payload.command)
+		sm.contextManager.noteMessage(payload.contextID, true)
+		sm.logf(1, "dicom.stateMachine(%s): Send batched DIMSE msg: %v", sm.label, payload.command)
+		sm.logf(HexDumpLogLevel, "dicom.stateMachine(%s): Command set:\n%v", sm.label, commandHexDump(b.Bytes()))
+		for _, p := range splitDataIntoPDUs(sm, payload.contextID, true /*command*/, b.Bytes()) {
+			items = append(items, p.Items...)
+		}
+		if payload.command.HasData() {
+			for _, p := range splitDataIntoPDUs(sm, payload.contextID, false /*data*/, payload.data) {
+				items = append(items, p.Items...)
+			}
+		}
+	}
+	maxSize := maxPDVValueSize(sm) + pdvHeaderSize
+	v := pdu.PDataTf{}
+	size := 0
+	for _, item := range items {
+		if len(v.Items) > 0 && size+pdvHeaderSize+len(item.Value) > maxSize {
+			sendPDU(sm, &v)
+			v, size = pdu.PDataTf{}, 0
+		}
+		v.Items = append(v.Items, item)
+		size += pdvHeaderSize + len(item.Value)
+	}
+	if len(v.Items) > 0 {
+		sendPDU(sm, &v)
+	}
+}
+
+// A data payload being read from an io.Reader. The reader runs on its own
+// goroutine, so that a slow reader doesn't hold up the statemachine: each
+// chunk read is delivered on "ch" as an evt09 whose payload has a chunk, and
+// sent as one PDV. While a stream is active, no other downcall is taken, so
+// that no other message is sent before the data ends.
+type dataStream struct {
+	ch   chan stateEvent
+	stop chan struct{} // closed to make the reader goroutine exit
+}
+
+// A piece of the data read by readDataChunks.
+type dataChunk struct {
+	data []byte
+	last bool  // the data ends with this chunk
+	err  error // if non-nil, the read failed, and data is unused
+}
+
+// Start streaming the data read from "r" until EOF. The data is sent as
+// sendDataChunk receives it.
+func sendDataFromReader(sm *stateMachine, contextID byte, r io.Reader) {
+	doassert(sm.dataStream == nil)
+	s := &dataStream{ch: make(chan stateEvent), stop: make(chan struct{})}
+	sm.dataStream = s
+	go readDataChunks(r, contextID, maxPDVValueSize(sm), s)
+}
+
+// Read chunks of "r" until EOF or an error, and deliver them to the
+// statemachine. The reader is read one chunk ahead, so that the last chunk can
+// be flagged. Returns early if the stream is stopped; a Read in progress still
+// runs to completion.
+func readDataChunks(r io.Reader, contextID byte, maxChunkSize int, s *dataStream) {
+	chunk := make([]byte, maxChunkSize)
+	n, err := io.ReadFull(r, chunk)
+	for {
+		c := &dataChunk{data: chunk[:n], last: err != nil}
+		var next []byte
+		var nextN int
+		var nextErr error
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			c = &dataChunk{err: err}
+		} else if !c.last {
+			next = make([]byte, maxChunkSize)
+			nextN, nextErr = io.ReadFull(r, next)
+			c.last = nextErr == io.EOF
+		}
+		event := stateEvent{event: evt09, dimsePayload: &stateEventDIMSEPayload{contextID: contextID, chunk: c}}
+		select {
+		case s.ch <- event:
+		case <-s.stop:
+			return
+		}
+		if c.last || c.err != nil {
+			return
+		}
+		chunk, n, err = next, nextN, nextErr
+	}
+}
+
+// Send the chunk in "payload", read by readDataChunks. Returns false if the
+// read failed. Part of the data is then already out, so the only way to stop
+// is to abort.
+func sendDataChunk(sm *stateMachine, payload *stateEventDIMSEPayload) bool {
+	c := payload.chunk
+	if c.err != nil {
+		sm.logf(0, "dicom.stateMachine(%s): Failed to read DIMSE data: %v; aborting", sm.label, c.err)
+		stopDataStream(sm)
+		return false
+	}
+	sendPDU(sm, &pdu.PDataTf{Items: []pdu.PresentationDataValueItem{{
+		ContextID: payload.contextID,
+		Command:   false,
+		Last:      c.last,
+		Value:     c.data,
+	}}})
+	if c.last {
+		stopDataStream(sm)
+	}
+	return true
+}
+
+// End the active data stream, if any.
+func stopDataStream(sm *stateMachine) {
+	if sm.dataStream != nil {
+		close(sm.dataStream.stop)
+		sm.dataStream = nil
+	}
+}
+
+// Send "data" in P_DATA_TF PDUs of one data PDV each. The PDVs are slices of
+// "data": each PDU is written as its header followed by the slice, in one
+// vectored write where the transport supports it, so that the data isn't
+// copied. Under fault injection, which needs the encoded PDUs, the PDUs are
+// sent by sendPDU instead.
+func sendDataPDVs(sm *stateMachine, contextID byte, data []byte) {
+	maxChunkSize := maxPDVValueSize(sm)
+	for {
+		chunk := data
+		if len(chunk) > maxChunkSize {
+			chunk = chunk[:maxChunkSize]
+		}
+		data = data[len(chunk):]
+		last := len(data) == 0
+		v := &pdu.PDataTf{Items: []pdu.PresentationDataValueItem{{
+			ContextID: contextID,
+			Command:   false,
+			Last:      last,
+			Value:     chunk,
+		}}}
+		if sm.faults != nil {
+			sendPDU(sm, v)
+		} else if !writeDataPDV(sm, v, chunk) {
+			return
+		}
+		if last {
+			return
+		}
+	}
+}
+
+// Write "v", a P_DATA_TF PDU holding one data PDV whose value is "chunk".
+// Returns false if the write failed, in which case the connection is closed.
+func writeDataPDV(sm *stateMachine, v *pdu.PDataTf, chunk []byte) bool {
+	doassert(sm.conn != nil)
+	var header [12]byte
+	header[0] = byte(pdu.TypePDataTf)
+	binary.BigEndian.PutUint32(header[2:], uint32(6+len(chunk)))
+	binary.BigEndian.PutUint32(header[6:], uint32(2+len(chunk)))
+	header[10] = v.Items[0].ContextID
+	if v.Items[0].Last {
+		header[11] = 2
+	}
+	if !sm.isUser && sm.providerParams.WriteTimeout > 0 {
+		sm.conn.SetWriteDeadline(time.Now().Add(sm.providerParams.WriteTimeout))
+	}
+	buffers := net.Buffers{header[:], chunk}
+	n, err := buffers.WriteTo(pduWriter(sm))
+	if n != int64(len(header)+len(chunk)) || err != nil {
+		sm.logf(0, "dicom.StateMachine %s: Failed to write %d bytes. Actual %d bytes : %v; closing connection %v", sm.label, len(header)+len(chunk), n, err, sm.conn)
+		sm.conn.Close()
+		sm.errorCh <- stateEvent{event: evt17, err: err}
+		return false
+	}
+	sm.logf(2, "dicom.StateMachine %s: sendPDU: %v", sm.label, v.String())
+	sm.logf(HexDumpLogLevel, "dicom.StateMachine %s: sent PDU:\n%v", sm.label, pduHexDump{v: v})
+	return true
+}
+
 // Data transfer related actions
 var actionDt1 = &stateAction{"DT-1", "Send P-DATA-TF PDU",
 	func(sm *stateMachine, event stateEvent) stateType {
 		doassert(event.dimsePayload != nil)
+		if len(event.dimsePayload.batch) > 0 {
+			sendBatchedMessages(sm, event.dimsePayload.batch)
+			return sta06
+		}
+		if event.dimsePayload.chunk != nil {
+			if !sendDataChunk(sm, event.dimsePayload) {
+				return actionAa1.Callback(sm, event)
+			}
+			return sta06
+		}
 		command := event.dimsePayload.command
 		doassert(command != nil)
 		//e := dicomio.NewBytesEncoder(nil, dicomio.UnknownVR)
@@ -328,14 +708,24 @@ var actionDt1 = &stateAction{"DT-1", "Send P-DATA-TF PDU",
 		/* if e.Error() != nil {
 			panic(fmt.Sprintf("Failed to encode DIMSE cmd %v: %v", command, e.Error()))
 		} */
-		dicomlog.Vprintf(1, "dicom.stateMachine(%s): Send DIMSE msg: %v", sm.label, command)
-		pdus := splitDataIntoPDUs(sm, event.dimsePayload.abstractSyntaxName, true /*command*/, b.Bytes())
+		sm.contextManager.noteMessage(event.dimsePayload.contextID, true)
+		sm.logf(1, "dicom.stateMachine(%s): Send DIMSE msg: %v", sm.label, command)
+		sm.logf(HexDumpLogLevel, "dicom.stateMachine(%s): Command set:\n%v", sm.label, commandHexDump(b.Bytes()))
+		pdus := splitDataIntoPDUs(sm, event.dimsePayload.contextID, true /*command*/, b.Bytes())
 		for _, pdu := range pdus {
 			sendPDU(sm, &pdu)
 		}
-		if command.HasData() {
-			dicomlog.Vprintf(1, "dicom.stateMachine(%s): Send DIMSE data of %db, command: %v", sm.label, len(event.dimsePayload.data), command)
-			pdus := splitDataIntoPDUs(sm, event.dimsePayload.abstractSyntaxName, false /*data*/, event.dimsePayload.data)
+		if command.HasData() && event.dimsePayload.mapped != nil {
+			mapped := event.dimsePayload.mapped
+			sm.logf(1, "dicom.stateMachine(%s): Send mapped DIMSE data of %db, command: %v", sm.label, len(mapped.body), command)
+			sendDataPDVs(sm, event.dimsePayload.contextID, mapped.body)
+			mapped.release()
+		} else if command.HasData() && event.dimsePayload.dataReader != nil {
+			sm.logf(1, "dicom.stateMachine(%s): Stream DIMSE data, command: %v", sm.label, command)
+			sendDataFromReader(sm, event.dimsePayload.contextID, event.dimsePayload.dataReader)
+		} else if command.HasData() {
+			sm.logf(1, "dicom.stateMachine(%s): Send DIMSE data of %db, command: %v", sm.label, len(event.dimsePayload.data), command)
+			pdus := splitDataIntoPDUs(sm, event.dimsePayload.contextID, false /*data*/, event.dimsePayload.data)
 			for _, pdu := range pdus {
 				sendPDU(sm, &pdu)
 			}
@@ -347,20 +737,45 @@ var actionDt1 = &stateAction{"DT-1", "Send P-DATA-TF PDU",
 
 var actionDt2 = &stateAction{"DT-2", "Send P-DATA indication primitive",
 	func(sm *stateMachine, event stateEvent) stateType {
-		contextID, command, data, err := sm.commandAssembler.AddDataPDU(event.pdu.(*pdu.PDataTf))
+		var streaming map[byte]bool
+		if sm.cstoreStreamer != nil {
+			streaming = sm.cstoreStreamer.streaming()
+		}
+		messages, err := sm.commandAssembler.AddPDU(event.pdu.(*pdu.PDataTf))
 		if err == nil {
-			if command != nil { // All fragments received
-				dicomlog.Vprintf(1, "dicom.stateMachine(%s): DIMSE request: %v", sm.label, command)
+			for _, m := range messages {
+				sm.contextManager.noteMessage(m.ContextID, false)
+			}
+			if sm.cstoreStreamer != nil {
+				messages = sm.cstoreStreamer.onPDU(sm, event.pdu.(*pdu.PDataTf), streaming, messages)
+			}
+			for _, m := range messages { // All fragments received
+				sm.logf(1, "dicom.stateMachine(%s): DIMSE request: %v, %d data bytes", sm.label, m.Command, m.DataLength)
+				var status *dimse.Status
+				if sm.cstorePeeker != nil {
+					status = sm.cstorePeeker.onComplete(sm, m.ContextID, m.Command, m.Data)
+				}
 				sm.upcallCh <- upcallEvent{
 					eventType: upcallEventData,
 					cm:        sm.contextManager,
-					contextID: contextID,
-					command:   command,
-					data:      data}
+					contextID: m.ContextID,
+					command:   m.Command,
+					data:      m.Data,
+					digest:    m.Digest,
+					status:    status}
 			}
+			if sm.cstorePeeker != nil {
+				for _, m := range sm.commandAssembler.PendingCommands() {
+					if sm.cstorePeeker.onPartialData(sm, m.ContextID, m.Command, m.Data) {
+						sm.commandAssembler.DiscardData(m.ContextID)
+					}
+				}
+			}
+			sm.stats.setBufferedBytes(sm.commandAssembler.BufferedBytes())
 			return sta06
 		}
-		dicomlog.Vprintf(0, "dicom.stateMachine(%s): Failed to assemble data: %v", sm.label, err) // TODO(saito)
+		sm.logf(0, "dicom.stateMachine(%s): Failed to assemble data: %v", sm.label, err)
+		event.err = err
 		return actionAa8.Callback(sm, event)
 	}}
 
@@ -404,6 +819,21 @@ var actionAr6 = &stateAction{"AR-6", "Issue P-DATA indication",
 var actionAr7 = &stateAction{"AR-7", "Issue P-DATA-TF PDU",
 	func(sm *stateMachine, event stateEvent) stateType {
 		doassert(event.dimsePayload != nil)
+		if len(event.dimsePayload.batch) > 0 {
+			sendBatchedMessages(sm, event.dimsePayload.batch)
+			sm.downcallCh <- stateEvent{event: evt14}
+			return sta08
+		}
+		if event.dimsePayload.chunk != nil {
+			// A stream started before the release request.
+			if !sendDataChunk(sm, event.dimsePayload) {
+				return actionAa1.Callback(sm, event)
+			}
+			if event.dimsePayload.chunk.last {
+				sm.downcallCh <- stateEvent{event: evt14}
+			}
+			return sta08
+		}
 		command := event.dimsePayload.command
 		doassert(command != nil)
 		/*		e := dicomio.NewBytesEncoder(nil, dicomio.UnknownVR)
@@ -415,12 +845,13 @@ var actionAr7 = &stateAction{"AR-7", "Issue P-DATA-TF PDU",
 		e := dicom.NewWriter(&b, dicom.SkipVRVerification())
 		e.SetTransferSyntax(binary.LittleEndian, true)
 		dimse.EncodeMessage(e, command)
-		pdus := splitDataIntoPDUs(sm, event.dimsePayload.abstractSyntaxName, true /*command*/, b.Bytes())
+		sm.contextManager.noteMessage(event.dimsePayload.contextID, true)
+		pdus := splitDataIntoPDUs(sm, event.dimsePayload.contextID, true /*command*/, b.Bytes())
 		for _, pdu := range pdus {
 			sendPDU(sm, &pdu)
 		}
 		if command.HasData() {
-			pdus := splitDataIntoPDUs(sm, event.dimsePayload.abstractSyntaxName, false /*data*/, event.dimsePayload.data)
+			pdus := splitDataIntoPDUs(sm, event.dimsePayload.contextID, false /*data*/, event.dimsePayload.data)
 			for _, pdu := range pdus {
 				sendPDU(sm, &pdu)
 			}
@@ -457,7 +888,7 @@ var actionAa1 = &stateAction{"AA-1", "Send A-ABORT PDU (service-user source) and
 		if sm.currentState == sta02 {
 			diagnostic = pdu.AbortReasonUnexpectedPDU
 		}
-		sendPDU(sm, &pdu.AAbort{Source: 0, Reason: diagnostic})
+		sendPDU(sm, &pdu.AAbort{Source: pdu.AbortSourceServiceUser, Reason: diagnostic})
 		restartTimer(sm)
 		return sta13
 	}}
@@ -471,6 +902,11 @@ var actionAa2 = &stateAction{"AA-2", "Stop ARTIM timer if running. Close transpo
 
 var actionAa3 = &stateAction{"AA-3", "If (service-user initiated abort): issue A-ABORT indication and close transport connection, otherwise (service-dul initiated abort): issue A-P-ABORT indication and close transport connection",
 	func(sm *stateMachine, event stateEvent) stateType {
+		v := event.pdu.(*pdu.AAbort)
+		sm.upcallCh <- upcallEvent{
+			eventType: upcallEventError,
+			err:       &AbortError{Remote: true, Source: v.Source, Reason: v.Reason},
+		}
 		closeConnection(sm)
 		return sta01
 	}}
@@ -493,24 +929,162 @@ var actionAa6 = &stateAction{"AA-6", "Ignore PDU",
 
 var actionAa7 = &stateAction{"AA-7", "Send A-ABORT PDU",
 	func(sm *stateMachine, event stateEvent) stateType {
-		sendPDU(sm, &pdu.AAbort{Source: 0, Reason: 0})
+		if event.event == evt06 {
+			sm.logf(0, "dicom.stateMachine(%s): AA-7: %v", sm.label, ErrSecondAssociationRequest)
+		}
+		sendPDU(sm, &pdu.AAbort{Source: pdu.AbortSourceServiceUser, Reason: pdu.AbortReasonNotSpecified})
 		return sta13
 	}}
 
 var actionAa8 = &stateAction{"AA-8", "Send A-ABORT PDU (service-dul source), issue an A-P-ABORT indication and start ARTIM timer",
 	func(sm *stateMachine, event stateEvent) stateType {
-		sendPDU(sm, &pdu.AAbort{Source: 2, Reason: 0})
+		reason := abortReasonForEvent(event)
+		err := event.err
+		if event.event == evt06 && err == nil {
+			err = ErrSecondAssociationRequest
+		}
+		sm.upcallCh <- upcallEvent{
+			eventType: upcallEventError,
+			err:       &AbortError{Source: pdu.AbortSourceServiceProvider, Reason: reason, Err: err},
+		}
+		sendPDU(sm, &pdu.AAbort{Source: pdu.AbortSourceServiceProvider, Reason: reason})
 		startTimer(sm)
 		return sta13
 	}}
 
+// ErrSecondAssociationRequest is the cause, in an AbortError, of an abort due
+// to an A-ASSOCIATE-RQ received on a connection that already carries an
+// association, or did carry one. P3.8 9.1.1 allows a single association per
+// transport connection.
+var ErrSecondAssociationRequest = errors.New("dicom: A-ASSOCIATE-RQ on a connection that already has an association")
+
+// Pick the A-ABORT diagnostic for a protocol error detected while handling
+// "event".
+func abortReasonForEvent(event stateEvent) pdu.AbortReasonType {
+	switch event.event {
+	case evt03, evt04, evt06, evt10, evt12, evt13:
+		if event.err != nil {
+			// The PDU was expected, but its contents were unacceptable.
+			return pdu.AbortReasonInvalidPDUParameterValue
+		}
+		return pdu.AbortReasonUnexpectedPDU
+	}
+	return pdu.AbortReasonNotSpecified
+}
+
+// AbortError is reported when the association is torn down through an A-ABORT
+// PDU, either sent by the peer or by the local protocol machine. It represents
+// both the A-ABORT (service-user initiated) and the A-P-ABORT (service-provider
+// initiated) indications of P3.8 section 7.3. Transport failures are reported
+// as TransportError instead.
+type AbortError struct {
+	// Remote is true if the peer sent the A-ABORT PDU. It is false if the
+	// local protocol machine aborted the association after detecting an
+	// error.
+	Remote bool
+
+	// Source is pdu.AbortSourceServiceUser if the peer application gave
+	// up on the association, or pdu.AbortSourceServiceProvider if a
+	// protocol error was detected.
+	Source pdu.SourceType
+
+	// Reason is the diagnostic from P3.8 Table 9-26. Meaningful only when
+	// Source is pdu.AbortSourceServiceProvider.
+	Reason pdu.AbortReasonType
+
+	// Err describes the local error that caused the abort. Set only when
+	// Remote is false.
+	Err error
+}
+
+// IsProviderAbort returns true for an A-P-ABORT, i.e., an abort caused by a
+// protocol error rather than by a decision of the peer application.
+func (e *AbortError) IsProviderAbort() bool {
+	return e.Source == pdu.AbortSourceServiceProvider
+}
+
+func (e *AbortError) Error() string {
+	kind := "A-ABORT"
+	if e.IsProviderAbort() {
+		kind = fmt.Sprintf("A-P-ABORT (%s)", pdu.AbortReasonDescription(e.Source, e.Reason))
+	}
+	if e.Remote {
+		return fmt.Sprintf("dicom: association aborted by peer: %s", kind)
+	}
+	if e.Err != nil {
+		return fmt.Sprintf("dicom: association aborted: %s: %v", kind, e.Err)
+	}
+	return fmt.Sprintf("dicom: association aborted: %s", kind)
+}
+
+func (e *AbortError) Unwrap() error { return e.Err }
+
+// AssociationRejectedError is reported when the peer answers A-ASSOCIATE-RQ
+// with A-ASSOCIATE-RJ.
+type AssociationRejectedError struct {
+	Result pdu.RejectResultType
+	Source pdu.SourceType
+	// Reason is interpreted according to Source; see
+	// pdu.RejectReasonDescription.
+	Reason pdu.RejectReasonType
+}
+
+// Transient returns true if the peer indicated that the association may
+// succeed later, e.g., once it is less busy.
+func (e *AssociationRejectedError) Transient() bool {
+	return e.Result == pdu.ResultRejectedTransient
+}
+
+func (e *AssociationRejectedError) Error() string {
+	return fmt.Sprintf("dicom: association rejected (%s) by %s: %s",
+		pdu.RejectResultDescription(e.Result), pdu.RejectSourceDescription(e.Source),
+		pdu.RejectReasonDescription(e.Source, e.Reason))
+}
+
+// TransportError is reported when the transport connection fails, or is closed
+// by the peer without an A-RELEASE or A-ABORT exchange. P3.8 models this as an
+// A-P-ABORT indication, but no abort PDU is involved.
+type TransportError struct {
+	// Err is the underlying network error. It is nil if the peer closed,
+	// or half-closed, the connection between PDUs, and io.ErrUnexpectedEOF
+	// if it did so in the middle of a PDU.
+	Err error
+}
+
+func (e *TransportError) Error() string {
+	if e.Err == nil {
+		return "dicom: connection closed by peer"
+	}
+	return fmt.Sprintf("dicom: connection failed: %v", e.Err)
+}
+
+func (e *TransportError) Unwrap() error { return e.Err }
+
+// UnexpectedCommandError is returned by a ServiceUser operation when the peer
+// answers a request with a DIMSE message of the wrong type. The association is
+// aborted, since the peer's view of the exchange can't be trusted afterwards.
+type UnexpectedCommandError struct {
+	// Want names the message expected, e.g., "C-STORE-RSP".
+	Want string
+	// Got is the message received.
+	Got dimse.Message
+}
+
+func (e *UnexpectedCommandError) Error() string {
+	return fmt.Sprintf("dicom: expected %s, but received %v", e.Want, e.Got)
+}
+
 type upcallEventType int
 
 const (
 	upcallEventHandshakeCompleted = upcallEventType(100)
 	upcallEventData               = upcallEventType(101)
-	// Note: connection shutdown and any error will result in channel
-	// closure, so they don't have event types.
+	// upcallEventError reports why the association failed. It is sent
+	// only for errors the upper layer can act upon, and is always followed
+	// by channel closure.
+	upcallEventError = upcallEventType(102)
+	// Note: connection shutdown will result in channel closure, so it
+	// doesn't have an event type.
 )
 
 func (e *upcallEventType) String() string {
@@ -520,6 +1094,8 @@ func (e *upcallEventType) String() string {
 		description = "Handshake completed"
 	case upcallEventData:
 		description = "P_DATA_TF PDU received"
+	case upcallEventError:
+		description = "Association error"
 	default:
 		panic(fmt.Sprintf("dicom.StateMachine: Unknown event type %v", int(*e)))
 	}
@@ -546,11 +1122,28 @@ type upcallEvent struct {
 
 	command dimse.Message
 	data    []byte
+	// The digest of "data", if the provider computes one; see
+	// cstoreDataHash.
+	digest []byte
+
+	// If non-nil, the request was rejected by the statemachine while it was
+	// being received. The data has been discarded, and this status should
+	// be sent in the response. Set only in upcallEventData event.
+	status *dimse.Status
+
+	// If non-nil, the command is a C-STORE request whose dataset is
+	// streamed through this reader, and data is nil. See
+	// ServiceProviderParams.CStoreStream.
+	stream *cstoreStream
+
+	// Set only in upcallEventError event.
+	err error
 }
 
 type stateEventDIMSEPayload struct {
-	// The syntax UID of the data to be sent.
-	abstractSyntaxName string
+	// The presentation context to send the data on. It determines the
+	// abstract and transfer syntax of the data.
+	contextID byte
 
 	// Command to send. len(command) may exceed the max PDU size, in which case it
 	// will be split into multiple PresentationDataValueItems.
@@ -559,6 +1152,22 @@ type stateEventDIMSEPayload struct {
 	// Ditto, but for the data payload. The data PDU is sent iff.
 	// command.HasData()==true.
 	data []byte
+
+	// If non-nil, the data payload is streamed from dataReader until EOF,
+	// instead of being taken from data.
+	dataReader io.Reader
+
+	// Set, instead of the other fields, for the events of a dataStream.
+	chunk *dataChunk
+
+	// If non-nil, the data payload is the body of a mapped file. PDVs are
+	// sliced from the mapping, which is released once sent.
+	mapped *mappedData
+
+	// If non-empty, the other fields are unused, and these messages are sent
+	// instead, in order, packed into as few P_DATA_TF PDUs as they fit in.
+	// Only plain command+data payloads may be batched.
+	batch []*stateEventDIMSEPayload
 }
 
 type stateEventDebugInfo struct {
@@ -733,6 +1342,9 @@ type stateMachine struct {
 	// userParams is set only for a client-side statemachine
 	userParams ServiceUserParams
 
+	// providerParams is set only for a server-side statemachine
+	providerParams ServiceProviderParams
+
 	// Manages mappings between one-byte contextID to the
 	// <abstractsyntaxUID, transfersyntaxuid> pair.  Filled during A_ACCEPT
 	// handshake.
@@ -756,30 +1368,95 @@ type stateMachine struct {
 	// For Timer expiration event
 	timerCh chan stateEvent
 
+	// The data payload being read from an io.Reader, if any.
+	dataStream *dataStream
+
+	// Drives the ARTIM timer and the read deadlines.
+	clock Clock
+	// The running ARTIM timer, if any, and its duration.
+	artimTimer   Timer
+	artimTimeout time.Duration
+	// Expires the read deadline when clock is not the real clock. See
+	// updateReadDeadline.
+	deadlineTimer Timer
+
 	// The socket to the remote peer.
 	conn         net.Conn
 	currentState stateType
 
+	// Copies the bytes of conn, if TeeParams are set.
+	tee *connTee
+
 	// For assembling DIMSE command from multiple P_DATA_TF fragments.
 	commandAssembler dimse.CommandAssembler
 
+	// AE title of the peer that requested the association. Set only for a
+	// server-side statemachine, once the association is accepted.
+	callingAETitle string
+
+	// Resource accounting for the association. Set only for a server-side
+	// statemachine run by ServiceProvider.
+	stats *associationStats
+
+	// Reports whether new associations must be refused. Set only for a
+	// server-side statemachine run by ServiceProvider.
+	draining func() bool
+
+	// Inspects inbound C-STORE data as it arrives. Set only for a
+	// server-side statemachine with CStoreAdmit or CStorePeek configured.
+	cstorePeeker *cstorePeeker
+
+	// Streams inbound C-STORE datasets. Nil unless
+	// ServiceProviderParams.CStoreStream is set.
+	cstoreStreamer *cstoreStreamer
+
+	// Receives diagnostic messages. See ServiceUserParams.Logger.
+	logf Logger
+
 	// Only for testing.
 	faults FaultInjector
+	// Non-nil if faults simulates a network link. PDUs are written to it
+	// instead of conn.
+	link io.WriteCloser
+
+	// Buffers outbound P-DATA-TF PDUs. Nil unless WriteCoalescing is set.
+	coalescer *writeCoalescer
+
+	// Non-nil if the connection is read through the shared poller. See
+	// ReadSharedPoller.
+	polled *polledConn
 }
 
 func closeConnection(sm *stateMachine) {
+	flushWrites(sm)
 	close(sm.upcallCh)
-	dicomlog.Vprintf(1, "dicom.StateMachine %s: Closing connection %v", sm.label, sm.conn)
-	if sm.conn != nil {
+	sm.logf(1, "dicom.StateMachine %s: Closing connection %v", sm.label, sm.conn)
+	if sm.link != nil {
+		// Let the PDUs in flight arrive first.
+		sm.link.Close()
+	} else if sm.conn != nil {
 		sm.conn.Close()
 	}
 }
 
+// Returns where to write PDUs: the connection, or the simulated link in front
+// of it, copied to the tee if any.
+func pduWriter(sm *stateMachine) io.Writer {
+	if sm.link == nil {
+		ls, ok := sm.faults.(linkSimulator)
+		if !ok {
+			return sm.tee.writer(sm.conn)
+		}
+		sm.link = ls.newLink(sm.conn)
+	}
+	return sm.tee.writer(sm.link)
+}
+
 func sendPDU(sm *stateMachine, v pdu.PDU) {
 	doassert(sm.conn != nil)
 	data, err := pdu.EncodePDU(v)
 	if err != nil {
-		dicomlog.Vprintf(0, "dicom.StateMachine %s: Failed to encode: %v; closing connection %v", sm.label, err, sm.conn)
+		sm.logf(0, "dicom.StateMachine %s: Failed to encode: %v; closing connection %v", sm.label, err, sm.conn)
 		sm.conn.Close()
 		sm.errorCh <- stateEvent{event: evt17, err: err}
 		return
@@ -787,26 +1464,78 @@ func sendPDU(sm *stateMachine, v pdu.PDU) {
 	if sm.faults != nil {
 		action := sm.faults.onSend(data)
 		if action == faultInjectorDisconnect {
-			dicomlog.Vprintf(0, "dicom.StateMachine %s: FAULT: closing connection for test", sm.label)
+			sm.logf(0, "dicom.StateMachine %s: FAULT: closing connection for test", sm.label)
 			sm.conn.Close()
 		}
 	}
-	n, err := sm.conn.Write(data)
+	if sm.coalescer != nil {
+		if _, ok := v.(*pdu.PDataTf); ok {
+			if sm.coalescer.add(data, sm.clock.Now()) && !flushWrites(sm) {
+				return
+			}
+			sm.logf(2, "dicom.StateMachine %s: sendPDU (buffered): %v", sm.label, pduText{v: v})
+			sm.logf(HexDumpLogLevel, "dicom.StateMachine %s: sent PDU:\n%v", sm.label, pduHexDump{v: v, data: data})
+			return
+		}
+		if !flushWrites(sm) {
+			return
+		}
+	}
+	if !writePDUData(sm, data) {
+		return
+	}
+	if sm.faults != nil {
+		for _, extra := range sm.faults.afterSend(data) {
+			sm.logf(0, "dicom.StateMachine %s: FAULT: injecting %d bytes", sm.label, len(extra))
+			// Through the simulated link, if any, like the PDU.
+			if !writePDUData(sm, extra) {
+				return
+			}
+		}
+	}
+
+	sm.logf(2, "dicom.StateMachine %s: sendPDU: %v", sm.label, pduText{v: v})
+	sm.logf(HexDumpLogLevel, "dicom.StateMachine %s: sent PDU:\n%v", sm.label, pduHexDump{v: v, data: data})
+}
+
+// Write "data", one or more encoded PDUs, to the connection. Returns false if
+// the write failed, in which case the connection is closed and evt17 is
+// queued.
+func writePDUData(sm *stateMachine, data []byte) bool {
+	if !sm.isUser && sm.providerParams.WriteTimeout > 0 {
+		sm.conn.SetWriteDeadline(time.Now().Add(sm.providerParams.WriteTimeout))
+	}
+	n, err := pduWriter(sm).Write(data)
 	if n != len(data) || err != nil {
-		dicomlog.Vprintf(0, "dicom.StateMachine %s: Failed to write %d bytes. Actual %d bytes : %v; closing connection %v", sm.label, len(data), n, err, sm.conn)
+		sm.logf(0, "dicom.StateMachine %s: Failed to write %d bytes. Actual %d bytes : %v; closing connection %v", sm.label, len(data), n, err, sm.conn)
 		sm.conn.Close()
 		sm.errorCh <- stateEvent{event: evt17, err: err}
-		return
+		return false
 	}
+	return true
+}
 
-	dicomlog.Vprintf(2, "dicom.StateMachine %s: sendPDU: %v", sm.label, v.String())
+// DefaultARTIMTimeout is the default duration of the ARTIM timer. See
+// ServiceProviderParams.ARTIMTimeout and ServiceUserParams.ARTIMTimeout.
+const DefaultARTIMTimeout = 10 * time.Second
+
+// Returns "timeout", or DefaultARTIMTimeout if it is zero. Negative values are
+// rejected when the params are validated.
+func artimTimeoutOrDefault(timeout time.Duration) time.Duration {
+	if timeout == 0 {
+		return DefaultARTIMTimeout
+	}
+	return timeout
 }
 
 func startTimer(sm *stateMachine) {
+	if sm.artimTimer != nil {
+		sm.artimTimer.Stop()
+	}
 	ch := make(chan stateEvent, 1)
 	sm.timerCh = ch
 	currentState := sm.currentState
-	time.AfterFunc(time.Duration(10)*time.Second,
+	sm.artimTimer = sm.clock.AfterFunc(sm.artimTimeout,
 		func() {
 			ch <- stateEvent{event: evt18, debug: &stateEventDebugInfo{currentState}}
 			close(ch)
@@ -818,66 +1547,135 @@ func restartTimer(sm *stateMachine) {
 }
 
 func stopTimer(sm *stateMachine) {
+	if sm.artimTimer != nil {
+		sm.artimTimer.Stop()
+		sm.artimTimer = nil
+	}
 	sm.timerCh = make(chan stateEvent, 1)
 }
 
-func networkReaderThread(ch chan stateEvent, conn net.Conn, maxPDUSize int, smName string) {
-	dicomlog.Vprintf(2, "dicom.StateMachine %s: Starting network reader, maxPDU %d", smName, maxPDUSize)
+// networkReader reads the PDUs of a connection and sends them to the
+// statemachine as events.
+type networkReader struct {
+	ch     chan stateEvent
+	conn   net.Conn
+	guard  *readGuard
+	flow   *cstoreStreamFlow
+	r      *pdu.Reader
+	smName string
+	logf   Logger
+}
+
+// If "guard" is non-nil, the connection is read through it; see readGuard.
+// If "flow" is non-nil, reading waits for the handlers of streamed C-STOREs;
+// see cstoreStreamFlow.
+func newNetworkReader(ch chan stateEvent, conn net.Conn, guard *readGuard, flow *cstoreStreamFlow, tee *connTee, maxPDUSize int, smName string, logf Logger) *networkReader {
+	logf(2, "dicom.StateMachine %s: Starting network reader, maxPDU %d", smName, maxPDUSize)
 	doassert(maxPDUSize > 16*1024)
-	for {
-		v, err := pdu.ReadPDU(conn, maxPDUSize)
-		if err != nil {
-			if err == io.EOF || strings.Contains(err.Error(), "EOF") {
-				dicomlog.Vprintf(0, "dicom.StateMachine %s: Finished reading PDU: %v", smName, err)
-				ch <- stateEvent{event: evt17, pdu: nil, err: nil}
-			} else {
-				dicomlog.Vprintf(0, "dicom.StateMachine %s: Failed to read PDU: %v", smName, err)
-				ch <- stateEvent{event: evt19, pdu: nil, err: err}
-			}
-			close(ch)
-			break
-		}
-		doassert(v != nil)
-		dicomlog.Vprintf(2, "dicom.StateMachine %s: read PDU: %v", smName, v.String())
-		switch n := v.(type) {
-		case *pdu.AAssociate:
-			if n.Type == pdu.TypeAAssociateRq {
-				ch <- stateEvent{event: evt06, pdu: n, err: nil}
-			} else {
-				doassert(n.Type == pdu.TypeAAssociateAc)
-				ch <- stateEvent{event: evt03, pdu: n, err: nil}
+	var in io.Reader = conn
+	if guard != nil {
+		in = guard
+	}
+	r := pdu.NewReader(tee.reader(in), maxPDUSize)
+	if guard != nil {
+		r.SetAssociateLimits(guard.itemLimits)
+	}
+	return &networkReader{
+		ch:     ch,
+		conn:   conn,
+		guard:  guard,
+		flow:   flow,
+		r:      r,
+		smName: smName,
+		logf:   logf,
+	}
+}
+
+// Read PDUs from "conn" and send them to "ch". "guard" and "flow" are as for
+// newNetworkReader.
+func networkReaderThread(ch chan stateEvent, conn net.Conn, guard *readGuard, flow *cstoreStreamFlow, tee *connTee, maxPDUSize int, smName string, logf Logger) {
+	nr := newNetworkReader(ch, conn, guard, flow, tee, maxPDUSize, smName, logf)
+	defer guard.stop()
+	for nr.readOne() {
+	}
+	logf(2, "dicom.StateMachine %s: Exiting network reader", smName)
+}
+
+// Read one PDU and send its event to the statemachine. Returns false once the
+// connection has failed or ended, after closing nr.ch.
+func (nr *networkReader) readOne() bool {
+	ch, conn, guard, smName := nr.ch, nr.conn, nr.guard, nr.smName
+	nr.flow.wait(conn)
+	v, err := nr.r.Read()
+	if err != nil {
+		if gerr := guard.failure(); gerr != nil {
+			nr.logf(0, "dicom.StateMachine %s: Dropping connection: %v", smName, gerr)
+			conn.Close()
+			ch <- stateEvent{event: evt17, pdu: nil, err: gerr}
+		} else if err == io.EOF {
+			// The peer closed, or half-closed, the connection
+			// between PDUs.
+			nr.logf(0, "dicom.StateMachine %s: Finished reading PDU: %v", smName, err)
+			ch <- stateEvent{event: evt17, pdu: nil, err: nil}
+		} else if strings.Contains(err.Error(), "EOF") {
+			nr.logf(0, "dicom.StateMachine %s: Connection closed in the middle of a PDU: %v", smName, err)
+			ch <- stateEvent{event: evt17, pdu: nil, err: io.ErrUnexpectedEOF}
+		} else if ne, ok := err.(net.Error); ok {
+			nr.logf(0, "dicom.StateMachine %s: Connection failed: %v", smName, err)
+			if ne.Timeout() {
+				// Read deadline expired. Nobody else will
+				// close the connection.
+				conn.Close()
 			}
-			continue
-		case *pdu.AAssociateRj:
-			dicomlog.Vprintf(0, "dicom.StateMachine %s: Association rejected: %v", smName, v.String())
-			ch <- stateEvent{event: evt04, pdu: n, err: nil}
-			continue
-		case *pdu.PDataTf:
-			ch <- stateEvent{event: evt10, pdu: n, err: nil}
-			continue
-		case *pdu.AReleaseRq:
-			ch <- stateEvent{event: evt12, pdu: n, err: nil}
-			continue
-		case *pdu.AReleaseRp:
-			ch <- stateEvent{event: evt13, pdu: n, err: nil}
-			continue
-		case *pdu.AAbort:
-			dicomlog.Vprintf(0, "dicom.StateMachine %s: Association aborted: %v", smName, v.String())
-			ch <- stateEvent{event: evt16, pdu: n, err: nil}
-			continue
-		default:
-			err := fmt.Errorf("dicom.StateMachine %s: Unknown PDU type: %v", v.String(), smName)
-			ch <- stateEvent{event: evt19, pdu: v, err: err}
-			dicomlog.Vprintf(0, "dicom.StateMachine: %v", err)
-			continue
-		}
-	}
-	dicomlog.Vprintf(2, "dicom.StateMachine %s: Exiting network reader", smName)
+			ch <- stateEvent{event: evt17, pdu: nil, err: err}
+		} else {
+			nr.logf(0, "dicom.StateMachine %s: Failed to read PDU: %v", smName, err)
+			ch <- stateEvent{event: evt19, pdu: nil, err: err}
+		}
+		close(ch)
+		return false
+	}
+	doassert(v != nil)
+	guard.pduDone()
+	nr.logf(2, "dicom.StateMachine %s: read PDU: %v", smName, pduText{v: v})
+	nr.logf(HexDumpLogLevel, "dicom.StateMachine %s: read PDU:\n%v", smName, pduHexDump{v: v})
+	switch n := v.(type) {
+	case *pdu.AAssociate:
+		if n.Type == pdu.TypeAAssociateRq {
+			ch <- stateEvent{event: evt06, pdu: n, err: nil}
+		} else {
+			doassert(n.Type == pdu.TypeAAssociateAc)
+			ch <- stateEvent{event: evt03, pdu: n, err: nil}
+		}
+	case *pdu.AAssociateRj:
+		nr.logf(0, "dicom.StateMachine %s: Association rejected: %v", smName, v.String())
+		ch <- stateEvent{event: evt04, pdu: n, err: nil}
+	case *pdu.PDataTf:
+		ch <- stateEvent{event: evt10, pdu: n, err: nil}
+	case *pdu.AReleaseRq:
+		ch <- stateEvent{event: evt12, pdu: n, err: nil}
+	case *pdu.AReleaseRp:
+		ch <- stateEvent{event: evt13, pdu: n, err: nil}
+	case *pdu.AAbort:
+		nr.logf(0, "dicom.StateMachine %s: Association aborted: %v", smName, v.String())
+		ch <- stateEvent{event: evt16, pdu: n, err: nil}
+	default:
+		err := fmt.Errorf("dicom.StateMachine %s: Unknown PDU type: %v", v.String(), smName)
+		ch <- stateEvent{event: evt19, pdu: v, err: err}
+		nr.logf(0, "dicom.StateMachine: %v", err)
+	}
+	return true
 }
 
 func getNextEvent(sm *stateMachine) stateEvent {
 	var ok bool
 	var event stateEvent
+	downcallCh := sm.downcallCh
+	var streamCh chan stateEvent
+	if sm.dataStream != nil {
+		streamCh = sm.dataStream.ch
+		downcallCh = nil
+	}
 	for event.event == 0 {
 		select {
 		case event, ok = <-sm.netCh:
@@ -890,18 +1688,50 @@ func getNextEvent(sm *stateMachine) stateEvent {
 			if !ok {
 				sm.timerCh = nil
 			}
-		case event, ok = <-sm.downcallCh:
+		case event, ok = <-downcallCh:
 			if !ok {
 				sm.downcallCh = nil
+				downcallCh = nil
 			}
+		case event = <-streamCh:
 		}
 	}
 	switch event.event {
 	case evt02:
 		doassert(event.conn != nil)
 		sm.conn = event.conn
+	case evt18:
+		if sm.currentState == sta02 && !sm.isUser {
+			sm.stats.addDroppedConnection(DropAssociationRequestTimeout)
+		}
+	case evt19:
+		if errors.Is(event.err, pdu.ErrAssociateTooComplex) && !sm.isUser {
+			sm.stats.addDroppedConnection(DropAssociationRequestTooComplex)
+		}
 	case evt17:
+		if sm.currentState != sta13 {
+			if cause, ok := dropCauseForError(sm.currentState, event.err); ok && !sm.isUser {
+				sm.stats.addDroppedConnection(cause)
+			}
+			// The connection wasn't supposed to go away; issue
+			// A-P-ABORT.
+			var err error = &TransportError{Err: event.err}
+			if herr, ok := event.err.(*TLSHandshakeError); ok {
+				err = herr
+			}
+			sm.upcallCh <- upcallEvent{
+				eventType: upcallEventError,
+				err:       err,
+			}
+		}
 		close(sm.upcallCh)
+		// Close our end too. After a FIN or half-close from the peer,
+		// the connection would otherwise linger in CLOSE_WAIT.
+		if sm.link != nil {
+			sm.link.Close()
+		} else if sm.conn != nil {
+			sm.conn.Close()
+		}
 		sm.conn = nil
 	}
 	return event
@@ -918,28 +1748,88 @@ func findAction(currentState stateType, event *stateEvent, smName string) *state
 
 func runOneStep(sm *stateMachine) {
 	event := getNextEvent(sm)
-	dicomlog.Vprintf(2, "dicom.StateMachine %s: Current state: %v, Event %v", sm.label, sm.currentState.String(), event)
+	sm.logf(2, "dicom.StateMachine %s: Current state: %v, Event %v", sm.label, sm.currentState.String(), event)
 	action := findAction(sm.currentState, &event, sm.label)
 	if action == nil {
 		msg := fmt.Sprintf("dicom.StateMachine %s: No action found for state %v, event %v", sm.label, sm.currentState.String(), event.String())
 		if sm.faults != nil {
 			msg += " FIhistory: " + sm.faults.String()
 		}
-		dicomlog.Vprintf(0, "dicom.StateMachine: Unknown state transition:")
+		sm.logf(0, "dicom.StateMachine: Unknown state transition:")
 		for _, s := range strings.Split(msg, "\n") {
-			dicomlog.Vprintf(0, s)
+			sm.logf(0, s)
 		}
-		dicomlog.Vprintf(0, msg)
+		sm.logf(0, msg)
 
 		action = actionAa2 // This will force connection abortion
 	}
-	dicomlog.Vprintf(2, "dicom.StateMachine %s: Running action %v", sm.label, action)
+	sm.logf(2, "dicom.StateMachine %s: Running action %v", sm.label, action)
 	newState := action.Callback(sm, event)
 	if sm.faults != nil {
 		sm.faults.onStateTransition(sm.currentState, &event, action, newState)
 	}
 	sm.currentState = newState
-	dicomlog.Vprintf(2, "dicom.StateMachine Next state: %v", sm.currentState.String())
+	if newState != sta06 && newState != sta08 {
+		// The association is going away; drop the rest of the data.
+		stopDataStream(sm)
+	}
+	sm.logf(2, "dicom.StateMachine Next state: %v", sm.currentState.String())
+	queued := len(sm.downcallCh)
+	if sm.dataStream != nil {
+		// Downcalls wait for the stream to end, and the next chunk
+		// may be long in coming.
+		queued = 0
+	}
+	if sm.coalescer.due(queued, sm.clock.Now()) {
+		flushWrites(sm)
+	}
+	updateReadDeadline(sm)
+}
+
+// Set the read deadline of the connection for the current state. The deadline
+// is pushed back every time the statemachine makes a step, so in the
+// established state it bounds the idle time between PDUs. If the deadline
+// expires, networkReaderThread closes the connection and reports evt17.
+//
+// With a virtual clock, the deadline is tracked by a timer on that clock,
+// which expires the connection's real deadline when it fires.
+func updateReadDeadline(sm *stateMachine) {
+	if sm.conn == nil || sm.isUser {
+		return
+	}
+	var timeout time.Duration
+	switch sm.currentState {
+	case sta02:
+		timeout = sm.providerParams.AssociationRequestTimeout
+		if timeout == 0 {
+			timeout = DefaultAssociationRequestTimeout
+		}
+	case sta06:
+		timeout = sm.providerParams.IdleTimeout
+	}
+	var deadline time.Time
+	if _, ok := sm.clock.(realClock); ok {
+		if timeout > 0 {
+			deadline = time.Now().Add(timeout)
+		}
+	} else {
+		if sm.deadlineTimer != nil {
+			sm.deadlineTimer.Stop()
+			sm.deadlineTimer = nil
+		}
+		if timeout > 0 {
+			conn, polled := sm.conn, sm.polled
+			sm.deadlineTimer = sm.clock.AfterFunc(timeout, func() {
+				conn.SetReadDeadline(time.Now())
+				polled.wake()
+			})
+		}
+	}
+	if err := sm.conn.SetReadDeadline(deadline); err != nil {
+		sm.logf(1, "dicom.StateMachine %s: Failed to set read deadline: %v", sm.label, err)
+	}
+	// An idle polled connection has no reader to see the deadline expire.
+	sm.polled.setDeadline(deadline)
 }
 
 func runStateMachineForServiceUser(
@@ -955,42 +1845,89 @@ func runStateMachineForServiceUser(
 		isUser:         true,
 		contextManager: newContextManager(label),
 		userParams:     params,
-		netCh:          make(chan stateEvent, 128),
-		errorCh:        make(chan stateEvent, 128),
-		downcallCh:     downcallCh,
-		upcallCh:       upcallCh,
-		faults:         getUserFaultInjector(),
+		commandAssembler: dimse.CommandAssembler{
+			MaxCommandBytes:    params.MaxCommandSetBytes,
+			MaxCommandElements: params.MaxCommandElements,
+		},
+		netCh:        make(chan stateEvent, 128),
+		errorCh:      make(chan stateEvent, 128),
+		downcallCh:   downcallCh,
+		upcallCh:     upcallCh,
+		clock:        clockOrDefault(params.Clock),
+		artimTimeout: artimTimeoutOrDefault(params.ARTIMTimeout),
+		logf:         loggerOrDefault(params.Logger),
+		faults:       faultInjectorOrDefault(params.FaultInjector, getUserFaultInjector()),
 	}
+	sm.contextManager.logf = sm.logf
+	sm.contextManager.bigEndian = params.BigEndian
+	sm.contextManager.unknownTransferSyntaxes = params.UnknownTransferSyntaxes
+	sm.coalescer = newWriteCoalescer(params.WriteCoalescing, sm.faults)
 	event := stateEvent{event: evt01}
 	action := findAction(sta01, &event, sm.label)
 	sm.currentState = action.Callback(sm, event)
 	for sm.currentState != sta01 {
 		runOneStep(sm)
 	}
-	dicomlog.Vprintf(1, "dicom.StateMachine(%s): statemachine finished", sm.label)
+	sm.tee.close()
+	sm.logf(1, "dicom.StateMachine(%s): statemachine finished", sm.label)
 }
 
 func runStateMachineForServiceProvider(
+	ctx context.Context,
 	conn net.Conn,
+	params ServiceProviderParams,
 	upcallCh chan upcallEvent,
 	downcallCh chan stateEvent,
-	label string) {
+	label string,
+	draining func() bool,
+	stats *associationStats) {
+	cm := newContextManager(label)
+	cm.logf = loggerOrDefault(params.Logger)
+	cm.ctx = ctx
+	cm.acceptAbstractSyntax = abstractSyntaxFilter(params)
+	cm.maxOpsPerformed = params.MaxOpsPerformed
+	cm.maxOpsInvoked = params.MaxOpsInvoked
+	cm.maxPDUSize = maxPDUSizeOrDefault(params.MaxPDUSize)
+	cm.bigEndian = params.BigEndian
+	cm.unknownTransferSyntaxes = params.UnknownTransferSyntaxes
 	sm := &stateMachine{
 		label:          label,
 		isUser:         false,
-		contextManager: newContextManager(label),
+		contextManager: cm,
+		providerParams: params,
+		commandAssembler: dimse.CommandAssembler{
+			MaxCommandBytes:    params.MaxCommandSetBytes,
+			MaxCommandElements: params.MaxCommandElements,
+			DataHash:           cstoreDataHash(params),
+		},
+		cstorePeeker:   newCStorePeeker(params),
+		cstoreStreamer: newCStoreStreamer(params),
+		draining:       draining,
+		stats:          stats,
 		conn:           conn,
 		netCh:          make(chan stateEvent, 128),
 		errorCh:        make(chan stateEvent, 128),
 		downcallCh:     downcallCh,
 		upcallCh:       upcallCh,
-		faults:         getProviderFaultInjector(),
+		clock:          clockOrDefault(params.Clock),
+		artimTimeout:   artimTimeoutOrDefault(params.ARTIMTimeout),
+		logf:           cm.logf,
+		faults:         faultInjectorOrDefault(params.FaultInjector, getProviderFaultInjector()),
 	}
+	sm.coalescer = newWriteCoalescer(params.WriteCoalescing, sm.faults)
 	event := stateEvent{event: evt05, conn: conn}
 	action := findAction(sta01, &event, sm.label)
 	sm.currentState = action.Callback(sm, event)
+	updateReadDeadline(sm)
 	for sm.currentState != sta01 {
 		runOneStep(sm)
 	}
-	dicomlog.Vprintf(1, "dicom.StateMachine %s: statemachine finished", sm.label)
+	if sm.deadlineTimer != nil {
+		sm.deadlineTimer.Stop()
+	}
+	sm.cstoreStreamer.abort()
+	sm.tee.close()
+	// The connection is closed; let the reader see it, if it's idle.
+	sm.polled.wake()
+	sm.logf(1, "dicom.StateMachine %s: statemachine finished", sm.label)
 }
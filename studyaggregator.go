@@ -0,0 +1,189 @@
+package netdicom
+
+// This file implements StudyAggregator, which groups the instances received by
+// a ServiceProvider into studies and series.
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// StudyAggregator groups received instances by StudyInstanceUID and
+// SeriesInstanceUID. It consumes EventInstanceReceived events, and is meant
+// as the building block for rules such as "forward the study once it's
+// complete". It is thread safe.
+type StudyAggregator struct {
+	mu      sync.Mutex
+	studies map[string]*aggregatedStudy // keyed by StudyInstanceUID
+}
+
+type aggregatedStudy struct {
+	patientID     string
+	firstReceived time.Time
+	lastReceived  time.Time
+	series        map[string]*aggregatedSeries // keyed by SeriesInstanceUID
+}
+
+type aggregatedSeries struct {
+	modality  string
+	expected  int
+	instances map[string]string // SOPInstanceUID -> SOPClassUID
+}
+
+// StudySnapshot is a copy of the state of one study in a StudyAggregator.
+type StudySnapshot struct {
+	StudyInstanceUID string
+	PatientID        string
+
+	// When the first and the latest instance of the study arrived.
+	FirstReceived time.Time
+	LastReceived  time.Time
+
+	// Sorted by SeriesInstanceUID.
+	Series []SeriesSnapshot
+}
+
+// SeriesSnapshot is a copy of the state of one series in a StudyAggregator.
+type SeriesSnapshot struct {
+	SeriesInstanceUID string
+	Modality          string
+
+	// Number of distinct SOP instances received.
+	NumInstances int
+
+	// ExpectedInstances is the NumberOfSeriesRelatedInstances carried by
+	// the instances, or 0 if none carried it.
+	ExpectedInstances int
+}
+
+// Complete reports whether the number of instances announced by the series
+// has been received. It is false if the series doesn't announce its size.
+func (s SeriesSnapshot) Complete() bool {
+	return s.ExpectedInstances > 0 && s.NumInstances >= s.ExpectedInstances
+}
+
+// NumInstances is the number of instances received for the study.
+func (s StudySnapshot) NumInstances() int {
+	n := 0
+	for _, series := range s.Series {
+		n += series.NumInstances
+	}
+	return n
+}
+
+// Complete reports whether every series of the study is complete. Series
+// that were never received can't be accounted for.
+func (s StudySnapshot) Complete() bool {
+	if len(s.Series) == 0 {
+		return false
+	}
+	for _, series := range s.Series {
+		if !series.Complete() {
+			return false
+		}
+	}
+	return true
+}
+
+// NewStudyAggregator creates an empty StudyAggregator.
+func NewStudyAggregator() *StudyAggregator {
+	return &StudyAggregator{studies: map[string]*aggregatedStudy{}}
+}
+
+// Run consumes "events" until the channel is closed. It is typically given
+// the result of EventBus.Subscribe.
+func (a *StudyAggregator) Run(events <-chan Event) {
+	for e := range events {
+		a.Add(e)
+	}
+}
+
+// Add records the instance in an EventInstanceReceived event. Other events,
+// and instances that lack a StudyInstanceUID, are ignored. An instance
+// received twice is counted once.
+func (a *StudyAggregator) Add(e Event) {
+	if e.Type != EventInstanceReceived || e.StudyInstanceUID == "" {
+		return
+	}
+	now := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	st, ok := a.studies[e.StudyInstanceUID]
+	if !ok {
+		st = &aggregatedStudy{firstReceived: now, series: map[string]*aggregatedSeries{}}
+		a.studies[e.StudyInstanceUID] = st
+	}
+	st.lastReceived = now
+	if st.patientID == "" {
+		st.patientID = e.PatientID
+	}
+	series, ok := st.series[e.SeriesInstanceUID]
+	if !ok {
+		series = &aggregatedSeries{instances: map[string]string{}}
+		st.series[e.SeriesInstanceUID] = series
+	}
+	if series.modality == "" {
+		series.modality = e.Modality
+	}
+	if e.NumberOfSeriesRelatedInstances > 0 {
+		series.expected = e.NumberOfSeriesRelatedInstances
+	}
+	series.instances[e.SOPInstanceUID] = e.SOPClassUID
+}
+
+// Study returns the state of the given study, or false if no instance of it
+// has been received.
+func (a *StudyAggregator) Study(studyInstanceUID string) (StudySnapshot, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	st, ok := a.studies[studyInstanceUID]
+	if !ok {
+		return StudySnapshot{}, false
+	}
+	return st.snapshot(studyInstanceUID), true
+}
+
+// Studies returns the state of every study, sorted by StudyInstanceUID.
+func (a *StudyAggregator) Studies() []StudySnapshot {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	snapshots := make([]StudySnapshot, 0, len(a.studies))
+	for uid, st := range a.studies {
+		snapshots = append(snapshots, st.snapshot(uid))
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].StudyInstanceUID < snapshots[j].StudyInstanceUID
+	})
+	return snapshots
+}
+
+// Remove forgets the study, e.g., once it has been forwarded. Instances that
+// arrive later start a new entry.
+func (a *StudyAggregator) Remove(studyInstanceUID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.studies, studyInstanceUID)
+}
+
+// Requires a.mu.
+func (st *aggregatedStudy) snapshot(studyInstanceUID string) StudySnapshot {
+	s := StudySnapshot{
+		StudyInstanceUID: studyInstanceUID,
+		PatientID:        st.patientID,
+		FirstReceived:    st.firstReceived,
+		LastReceived:     st.lastReceived,
+	}
+	for uid, series := range st.series {
+		s.Series = append(s.Series, SeriesSnapshot{
+			SeriesInstanceUID: uid,
+			Modality:          series.modality,
+			NumInstances:      len(series.instances),
+			ExpectedInstances: series.expected,
+		})
+	}
+	sort.Slice(s.Series, func(i, j int) bool {
+		return s.Series[i].SeriesInstanceUID < s.Series[j].SeriesInstanceUID
+	})
+	return s
+}
@@ -0,0 +1,50 @@
+package netdicom
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStudyAggregator(t *testing.T) {
+	a := NewStudyAggregator()
+	instance := func(study, series, sop string, expected int) Event {
+		return Event{
+			Type:                           EventInstanceReceived,
+			StudyInstanceUID:               study,
+			SeriesInstanceUID:              series,
+			SOPInstanceUID:                 sop,
+			Modality:                       "CT",
+			PatientID:                      "P1",
+			NumberOfSeriesRelatedInstances: expected,
+		}
+	}
+	a.Add(instance("1.1", "1.1.1", "1.1.1.1", 2))
+	a.Add(instance("1.1", "1.1.1", "1.1.1.1", 2)) // Retransmission.
+	a.Add(instance("1.1", "1.1.2", "1.1.2.1", 0))
+	a.Add(instance("", "1.9", "1.9.1", 0))
+	a.Add(Event{Type: EventStudyComplete, StudyInstanceUID: "1.2"})
+
+	studies := a.Studies()
+	require.Len(t, studies, 1)
+	s := studies[0]
+	require.Equal(t, "1.1", s.StudyInstanceUID)
+	require.Equal(t, "P1", s.PatientID)
+	require.Equal(t, 2, s.NumInstances())
+	require.Equal(t, []SeriesSnapshot{
+		{SeriesInstanceUID: "1.1.1", Modality: "CT", NumInstances: 1, ExpectedInstances: 2},
+		{SeriesInstanceUID: "1.1.2", Modality: "CT", NumInstances: 1},
+	}, s.Series)
+	require.False(t, s.Complete())
+
+	a.Add(instance("1.1", "1.1.1", "1.1.1.2", 2))
+	s, ok := a.Study("1.1")
+	require.True(t, ok)
+	require.True(t, s.Series[0].Complete())
+	// The second series doesn't announce its size.
+	require.False(t, s.Complete())
+
+	a.Remove("1.1")
+	_, ok = a.Study("1.1")
+	require.False(t, ok)
+}
@@ -0,0 +1,187 @@
+package netdicom
+
+// This file implements VerifyStudy: comparing the instances of a study held by
+// two AEs, e.g., the old and the new archive of a migration, through C-FIND.
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	dicom "github.com/antibios/dicom"
+	dicomtag "github.com/antibios/dicom/pkg/tag"
+	"github.com/antibios/go-netdicom/sopclass"
+)
+
+// StudyVerifyParams configures VerifyStudy.
+type StudyVerifyParams struct {
+	// The AE whose copy of the study is the reference, e.g., the source of
+	// a migration, and its "host:port".
+	SourceAETitle string
+	SourceAddress string
+
+	// The AE whose copy is checked against it.
+	TargetAETitle string
+	TargetAddress string
+
+	// ServiceUser configures the associations, e.g., the calling AE
+	// title. CalledAETitle and SOPClasses are set for each AE.
+	ServiceUser ServiceUserParams
+}
+
+// StudyComparison is the outcome of VerifyStudy.
+type StudyComparison struct {
+	StudyInstanceUID string
+
+	// The number of instances of the study found on each AE.
+	SourceInstances int
+	TargetInstances int
+
+	// SOP instance UIDs found on the source but not on the target, and on
+	// the target but not on the source. Sorted.
+	Missing []string
+	Extra   []string
+}
+
+// Match reports whether both AEs hold the same instances.
+func (c *StudyComparison) Match() bool {
+	return len(c.Missing) == 0 && len(c.Extra) == 0
+}
+
+func (c *StudyComparison) String() string {
+	return fmt.Sprintf("study %s: %d instances on the source, %d on the target, %d missing, %d extra",
+		c.StudyInstanceUID, c.SourceInstances, c.TargetInstances, len(c.Missing), len(c.Extra))
+}
+
+// VerifyStudy lists the SOP instances of the study "studyInstanceUID" on the
+// source and the target AEs, with study root C-FINDs at the series, then the
+// image level, and reports the instances that one has and the other lacks.
+// The two AEs are queried concurrently. An error from either, e.g., a C-FIND
+// failure status, fails the verification; a study that an AE doesn't have is
+// not an error, but an empty list.
+func VerifyStudy(ctx context.Context, params StudyVerifyParams, studyInstanceUID string) (*StudyComparison, error) {
+	if studyInstanceUID == "" {
+		return nil, fmt.Errorf("dicom.VerifyStudy: empty StudyInstanceUID")
+	}
+	type result struct {
+		uids map[string]bool
+		err  error
+	}
+	sourceCh, targetCh := make(chan result, 1), make(chan result, 1)
+	for _, ae := range []struct {
+		aeTitle, addr string
+		ch            chan result
+	}{
+		{params.SourceAETitle, params.SourceAddress, sourceCh},
+		{params.TargetAETitle, params.TargetAddress, targetCh},
+	} {
+		go func(aeTitle, addr string, ch chan result) {
+			uids, err := listStudyInstances(ctx, params.ServiceUser, aeTitle, addr, studyInstanceUID)
+			if err != nil {
+				err = fmt.Errorf("dicom.VerifyStudy: %s (%s): %w", aeTitle, addr, err)
+			}
+			ch <- result{uids, err}
+		}(ae.aeTitle, ae.addr, ae.ch)
+	}
+	source, target := <-sourceCh, <-targetCh
+	if source.err != nil {
+		return nil, source.err
+	}
+	if target.err != nil {
+		return nil, target.err
+	}
+	c := &StudyComparison{
+		StudyInstanceUID: studyInstanceUID,
+		SourceInstances:  len(source.uids),
+		TargetInstances:  len(target.uids),
+	}
+	for uid := range source.uids {
+		if !target.uids[uid] {
+			c.Missing = append(c.Missing, uid)
+		}
+	}
+	for uid := range target.uids {
+		if !source.uids[uid] {
+			c.Extra = append(c.Extra, uid)
+		}
+	}
+	sort.Strings(c.Missing)
+	sort.Strings(c.Extra)
+	return c, nil
+}
+
+// Returns the SOP instance UIDs of the study on the AE "aeTitle" at "addr".
+func listStudyInstances(ctx context.Context, params ServiceUserParams, aeTitle, addr, studyInstanceUID string) (map[string]bool, error) {
+	params.CalledAETitle = aeTitle
+	params.SOPClasses = sopclass.QRFindClasses
+	su, err := NewServiceUser(params)
+	if err != nil {
+		return nil, err
+	}
+	defer su.Release()
+	if err := su.ConnectContext(ctx, addr); err != nil {
+		return nil, err
+	}
+	// Abort the association when the context ends, which ends the C-FIND
+	// in progress.
+	stop := su.abortOnDone(ctx)
+	defer stop()
+	series, err := cFindStrings(su, dicomtag.SeriesInstanceUID, []*dicom.Element{
+		dicom.MustNewElement(dicomtag.QueryRetrieveLevel, []string{"SERIES"}),
+		dicom.MustNewElement(dicomtag.StudyInstanceUID, []string{studyInstanceUID}),
+		dicom.MustNewElement(dicomtag.SeriesInstanceUID, []string{""}),
+	})
+	if err != nil {
+		return nil, err
+	}
+	uids := map[string]bool{}
+	for _, seriesInstanceUID := range series {
+		instances, err := cFindStrings(su, dicomtag.SOPInstanceUID, []*dicom.Element{
+			dicom.MustNewElement(dicomtag.QueryRetrieveLevel, []string{"IMAGE"}),
+			dicom.MustNewElement(dicomtag.StudyInstanceUID, []string{studyInstanceUID}),
+			dicom.MustNewElement(dicomtag.SeriesInstanceUID, []string{seriesInstanceUID}),
+			dicom.MustNewElement(dicomtag.SOPInstanceUID, []string{""}),
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, uid := range instances {
+			uids[uid] = true
+		}
+	}
+	return uids, nil
+}
+
+// Issue a study root C-FIND, and return the values of "t" in its matches.
+// Matches without a value are skipped.
+func cFindStrings(su *ServiceUser, t dicomtag.Tag, filter []*dicom.Element) ([]string, error) {
+	var values []string
+	var err error
+	for result := range su.CFind(QRLevelStudy, filter) {
+		if result.Err != nil {
+			// Keep reading, as CFind requires.
+			if err == nil {
+				err = result.Err
+			}
+			continue
+		}
+		if v := elementString(result.Elements, t); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values, err
+}
+
+// Returns the first string value of the element "t" in "elems", or "" if
+// there is none.
+func elementString(elems []*dicom.Element, t dicomtag.Tag) string {
+	for _, elem := range elems {
+		if elem.Tag != t {
+			continue
+		}
+		if v, ok := elem.Value.GetValue().([]string); ok && len(v) > 0 {
+			return v[0]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,79 @@
+package netdicom
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	dicom "github.com/antibios/dicom"
+	"github.com/antibios/dicom/pkg/tag"
+	"github.com/stretchr/testify/require"
+)
+
+// Starts a provider that holds study "1.2" with the given instances, keyed by
+// series. Like strict archives, it fails identifiers whose elements aren't in
+// ascending tag order.
+func newStudyArchive(t *testing.T, series map[string][]string) *ServiceProvider {
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		CFind: func(conn ConnectionState, transferSyntaxUID, sopClassUID string, filters []*dicom.Element, ch chan CFindResult) {
+			defer close(ch)
+			for i := 1; i < len(filters); i++ {
+				if !tagLess(filters[i-1].Tag, filters[i].Tag) {
+					ch <- CFindResult{Err: fmt.Errorf("%v after %v", filters[i].Tag, filters[i-1].Tag)}
+					return
+				}
+			}
+			if elementString(filters, tag.StudyInstanceUID) != "1.2" {
+				return
+			}
+			switch elementString(filters, tag.QueryRetrieveLevel) {
+			case "SERIES":
+				for uid := range series {
+					ch <- CFindResult{Elements: []*dicom.Element{dicom.MustNewElement(tag.SeriesInstanceUID, []string{uid})}}
+				}
+			case "IMAGE":
+				for _, uid := range series[elementString(filters, tag.SeriesInstanceUID)] {
+					ch <- CFindResult{Elements: []*dicom.Element{dicom.MustNewElement(tag.SOPInstanceUID, []string{uid})}}
+				}
+			}
+		},
+	}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+	t.Cleanup(func() { sp.Shutdown() }) // nolint: errcheck
+	return sp
+}
+
+func TestVerifyStudy(t *testing.T) {
+	source := newStudyArchive(t, map[string][]string{
+		"1.2.1": {"1.2.1.1", "1.2.1.2"},
+		"1.2.2": {"1.2.2.1"},
+	})
+	target := newStudyArchive(t, map[string][]string{
+		"1.2.1": {"1.2.1.1", "1.2.1.3"},
+	})
+	params := StudyVerifyParams{
+		SourceAETitle: "SOURCE",
+		SourceAddress: source.ListenAddr().String(),
+		TargetAETitle: "TARGET",
+		TargetAddress: target.ListenAddr().String(),
+	}
+	c, err := VerifyStudy(context.Background(), params, "1.2")
+	require.NoError(t, err)
+	require.False(t, c.Match())
+	require.Equal(t, 3, c.SourceInstances)
+	require.Equal(t, 2, c.TargetInstances)
+	require.Equal(t, []string{"1.2.1.2", "1.2.2.1"}, c.Missing)
+	require.Equal(t, []string{"1.2.1.3"}, c.Extra)
+
+	params.TargetAddress = params.SourceAddress
+	c, err = VerifyStudy(context.Background(), params, "1.2")
+	require.NoError(t, err)
+	require.True(t, c.Match())
+
+	// A study that neither AE has matches, with no instances.
+	c, err = VerifyStudy(context.Background(), params, "9.9")
+	require.NoError(t, err)
+	require.True(t, c.Match())
+	require.Equal(t, 0, c.SourceInstances)
+}
@@ -0,0 +1,105 @@
+package netdicom
+
+// This file implements ServiceProviderParams.SubOperationConcurrency: running
+// the C-STORE sub-operations of a C-GET or C-MOVE in parallel.
+
+import (
+	"sync"
+)
+
+// subOperations runs the C-STORE sub-operations of one C-GET or C-MOVE, up to
+// "limit" at once, and reports the progress with a pending response each time
+// one completes.
+type subOperations struct {
+	stats *associationStats
+	sem   chan struct{}
+	wg    sync.WaitGroup
+	// Sends a pending response. Called with mu held, so that the responses
+	// go out in order, and their counters never decrease.
+	sendPending func(remaining int, completed, failed uint16)
+
+	mu sync.Mutex
+	// Remaining, as reported by the callback with the dataset last started.
+	remaining int
+	// Number of sub-operations started but not completed.
+	inFlight  int
+	completed uint16
+	failed    uint16
+}
+
+func newSubOperations(stats *associationStats, limit int, sendPending func(remaining int, completed, failed uint16)) *subOperations {
+	if limit <= 0 {
+		limit = 1
+	}
+	return &subOperations{
+		stats:       stats,
+		sem:         make(chan struct{}, limit),
+		sendPending: sendPending,
+	}
+}
+
+// Start "run", which sends one dataset and returns an error if it failed.
+// Waits if "limit" sub-operations are already running. "remaining" is
+// CMoveResult.Remaining of the dataset.
+func (s *subOperations) start(remaining int, run func() error) {
+	s.sem <- struct{}{}
+	s.mu.Lock()
+	s.remaining = remaining
+	s.inFlight++
+	s.mu.Unlock()
+	s.wg.Add(1)
+	s.stats.goFunc(func() {
+		defer s.wg.Done()
+		err := run()
+		s.mu.Lock()
+		if err != nil {
+			s.failed++
+		} else {
+			s.completed++
+		}
+		s.inFlight--
+		// The datasets still being sent are remaining too.
+		remaining := s.remaining
+		if remaining >= 0 {
+			remaining += s.inFlight
+		}
+		s.sendPending(remaining, s.completed, s.failed)
+		s.mu.Unlock()
+		<-s.sem
+	})
+}
+
+// Wait for the sub-operations started, and return their counts.
+func (s *subOperations) wait() (completed, failed uint16) {
+	s.wg.Wait()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.completed, s.failed
+}
+
+// Returns the number of C-GET sub-operations that may run at once on the
+// association of "cs": params.SubOperationConcurrency, bounded by the
+// Asynchronous Operations Window negotiated with the peer.
+func cgetConcurrency(params ServiceProviderParams, cs *serviceCommandState) int {
+	n := params.SubOperationConcurrency
+	if n <= 0 {
+		n = 1
+	}
+	window := 1 // P3.7 D.3.3.3: one operation at a time, unless negotiated.
+	if cs.cm.peerProposedOpsWindow {
+		window = minOps(cs.cm.peerMaxOpsPerformed, cs.cm.maxOpsInvoked)
+	}
+	if window != 0 && window < n {
+		n = window
+	}
+	return n
+}
+
+// Returns the number of C-MOVE sub-operations that may run at once towards
+// "destination".
+func cmoveConcurrency(params ServiceProviderParams, destination string) int {
+	if n, ok := params.CMoveDestinationConcurrency[destination]; ok && n > 0 {
+		return n
+	}
+	return params.SubOperationConcurrency
+}
@@ -0,0 +1,192 @@
+package netdicom
+
+// This file implements TeeParams: copying the bytes of an association to
+// writers supplied by the application, e.g., for live capture, without
+// letting a slow writer stall the association.
+
+import (
+	"io"
+	"net"
+	"sync"
+
+	"github.com/antibios/go-dicom/dicomlog"
+)
+
+// DefaultTeeBufferBytes is the default value of TeeParams.BufferBytes.
+const DefaultTeeBufferBytes = 4 << 20
+
+// TeeOverflowPolicy selects what happens to the bytes of an association when
+// its tee writers fall behind by TeeParams.BufferBytes.
+type TeeOverflowPolicy int
+
+const (
+	// TeeDrop drops the bytes that don't fit in the buffer. This is the
+	// default. The number of bytes dropped is logged when the connection
+	// ends.
+	TeeDrop TeeOverflowPolicy = iota
+
+	// TeeBuffer keeps buffering, so that the copy is complete, at the cost
+	// of unbounded memory use.
+	TeeBuffer
+)
+
+// TeeParams configures the copying of the bytes exchanged on each connection
+// to writers. The bytes are those of the PDUs; over TLS, they are the
+// plaintext. The writers run on a goroutine of their own, so the association
+// never waits for them.
+type TeeParams struct {
+	// NewWriters is called when a connection is set up, and returns the
+	// writers that receive the bytes read from, and written to, "conn".
+	// Either may be nil. They are written to from a single goroutine, in
+	// the order the bytes went through the connection. Writers that
+	// implement io.Closer are closed once the connection ends and the
+	// buffered bytes are written.
+	NewWriters func(conn net.Conn) (inbound, outbound io.Writer)
+
+	// BufferBytes bounds the bytes waiting for the writers. If zero,
+	// DefaultTeeBufferBytes is used.
+	BufferBytes int
+
+	// Overflow selects what to do when the buffer is full.
+	Overflow TeeOverflowPolicy
+}
+
+// connTee copies the bytes of one connection to the writers of TeeParams.
+type connTee struct {
+	label             string
+	params            TeeParams
+	inbound, outbound io.Writer
+	done              chan struct{}
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	queue    []teeChunk
+	buffered int
+	dropped  int64
+	closed   bool
+}
+
+type teeChunk struct {
+	w    io.Writer
+	data []byte
+}
+
+// Returns nil if "params" is nil.
+func newConnTee(params *TeeParams, conn net.Conn, label string) *connTee {
+	if params == nil || params.NewWriters == nil {
+		return nil
+	}
+	t := &connTee{label: label, params: *params, done: make(chan struct{})}
+	if t.params.BufferBytes <= 0 {
+		t.params.BufferBytes = DefaultTeeBufferBytes
+	}
+	t.cond = sync.NewCond(&t.mu)
+	t.inbound, t.outbound = params.NewWriters(conn)
+	go t.run()
+	return t
+}
+
+// Queue a copy of "data" for "w".
+func (t *connTee) add(w io.Writer, data []byte) {
+	if w == nil || len(data) == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return
+	}
+	if t.params.Overflow == TeeDrop && t.buffered+len(data) > t.params.BufferBytes {
+		t.dropped += int64(len(data))
+		return
+	}
+	t.queue = append(t.queue, teeChunk{w: w, data: append([]byte(nil), data...)})
+	t.buffered += len(data)
+	t.cond.Signal()
+}
+
+func (t *connTee) run() {
+	defer close(t.done)
+	for {
+		t.mu.Lock()
+		for len(t.queue) == 0 && !t.closed {
+			t.cond.Wait()
+		}
+		queue := t.queue
+		t.queue = nil
+		closed := t.closed
+		t.mu.Unlock()
+		for _, c := range queue {
+			c.w.Write(c.data)
+			t.mu.Lock()
+			t.buffered -= len(c.data)
+			t.mu.Unlock()
+		}
+		if closed && len(queue) == 0 {
+			break
+		}
+	}
+	for _, w := range []io.Writer{t.inbound, t.outbound} {
+		if c, ok := w.(io.Closer); ok {
+			c.Close()
+		}
+		if t.inbound == t.outbound {
+			break
+		}
+	}
+	if t.dropped > 0 {
+		dicomlog.Vprintf(0, "dicom.StateMachine %s: tee dropped %d bytes", t.label, t.dropped)
+	}
+}
+
+// Stop accepting bytes, and wait until the ones queued are written. The
+// writers are closed.
+func (t *connTee) close() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.closed = true
+	t.cond.Signal()
+	t.mu.Unlock()
+	<-t.done
+}
+
+// Returns "r", copying what is read from it to the inbound writer.
+func (t *connTee) reader(r io.Reader) io.Reader {
+	if t == nil || t.inbound == nil {
+		return r
+	}
+	return io.TeeReader(r, teeSink{t, t.inbound})
+}
+
+// Returns "w", copying what is written to it to the outbound writer.
+func (t *connTee) writer(w io.Writer) io.Writer {
+	if t == nil || t.outbound == nil {
+		return w
+	}
+	return teeWriter{w: w, sink: teeSink{t, t.outbound}}
+}
+
+// teeSink queues the bytes written to it for one of the writers.
+type teeSink struct {
+	t *connTee
+	w io.Writer
+}
+
+func (s teeSink) Write(p []byte) (int, error) {
+	s.t.add(s.w, p)
+	return len(p), nil
+}
+
+// teeWriter copies the bytes that were written to "w".
+type teeWriter struct {
+	w    io.Writer
+	sink teeSink
+}
+
+func (t teeWriter) Write(p []byte) (int, error) {
+	n, err := t.w.Write(p)
+	t.sink.Write(p[:n])
+	return n, err
+}
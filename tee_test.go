@@ -0,0 +1,108 @@
+package netdicom
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/antibios/go-netdicom/dimse"
+	"github.com/antibios/go-netdicom/pdu"
+	"github.com/antibios/go-netdicom/sopclass"
+	"github.com/stretchr/testify/require"
+)
+
+// captureWriter records what is written to it, and is closed by the tee.
+type captureWriter struct {
+	bytes.Buffer
+	closed chan struct{}
+}
+
+func newCaptureWriter() *captureWriter { return &captureWriter{closed: make(chan struct{})} }
+
+func (w *captureWriter) Close() error {
+	close(w.closed)
+	return nil
+}
+
+// Returns the types of the PDUs in "data".
+func pduTypes(t *testing.T, data []byte) []string {
+	var types []string
+	r := bytes.NewReader(data)
+	for r.Len() > 0 {
+		v, err := pdu.ReadPDU(r, DefaultMaxPDUSize)
+		require.NoError(t, err)
+		switch n := v.(type) {
+		case *pdu.AAssociate:
+			if n.Type == pdu.TypeAAssociateRq {
+				types = append(types, "A_ASSOCIATE_RQ")
+			} else {
+				types = append(types, "A_ASSOCIATE_AC")
+			}
+		case *pdu.PDataTf:
+			types = append(types, "P_DATA_TF")
+		case *pdu.AReleaseRq:
+			types = append(types, "A_RELEASE_RQ")
+		case *pdu.AReleaseRp:
+			types = append(types, "A_RELEASE_RP")
+		}
+	}
+	return types
+}
+
+func TestTee(t *testing.T) {
+	inbound, outbound := newCaptureWriter(), newCaptureWriter()
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		CEcho: func(conn ConnectionState) dimse.Status { return dimse.Success },
+		Tee: &TeeParams{NewWriters: func(conn net.Conn) (io.Writer, io.Writer) {
+			return inbound, outbound
+		}},
+	}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.VerificationClasses})
+	require.NoError(t, err)
+	su.Connect(sp.ListenAddr().String())
+	require.NoError(t, su.CEcho())
+	su.Release()
+
+	<-inbound.closed
+	<-outbound.closed
+	require.Equal(t, []string{"A_ASSOCIATE_RQ", "P_DATA_TF", "A_RELEASE_RQ"}, pduTypes(t, inbound.Bytes()))
+	require.Equal(t, []string{"A_ASSOCIATE_AC", "P_DATA_TF", "A_RELEASE_RP"}, pduTypes(t, outbound.Bytes()))
+}
+
+// blockingWriter blocks writes until "unblock" is closed.
+type blockingWriter struct {
+	unblock chan struct{}
+	bytes.Buffer
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	<-w.unblock
+	return w.Buffer.Write(p)
+}
+
+func TestTeeOverflow(t *testing.T) {
+	for _, policy := range []TeeOverflowPolicy{TeeDrop, TeeBuffer} {
+		w := &blockingWriter{unblock: make(chan struct{})}
+		tee := newConnTee(&TeeParams{
+			NewWriters:  func(net.Conn) (io.Writer, io.Writer) { return w, nil },
+			BufferBytes: 10,
+			Overflow:    policy,
+		}, nil, "test")
+		r := tee.reader(bytes.NewReader(bytes.Repeat([]byte{1}, 100)))
+		// The reader never waits for the writer.
+		n, err := io.Copy(io.Discard, io.LimitReader(r, 100))
+		require.NoError(t, err)
+		require.Equal(t, int64(100), n)
+		close(w.unblock)
+		tee.close()
+		if policy == TeeDrop {
+			require.LessOrEqual(t, w.Len(), 10)
+		} else {
+			require.Equal(t, 100, w.Len())
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package netdicom
+
+// This file implements the TLS handshake of DICOM over TLS (P3.15 B.1) on both
+// sides of an association, and the error reported when it fails.
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+)
+
+// DefaultTLSPort is the port registered for DICOM over TLS.
+const DefaultTLSPort = 2762
+
+// TLSHandshakeError is reported when the TLS handshake fails, e.g., because
+// the peer's certificate isn't trusted, or the peer doesn't speak TLS. A
+// ServiceUser returns it, wrapped, from Connect and the operations that
+// follow; a ServiceProvider passes it to AssociationError. No association is
+// attempted.
+type TLSHandshakeError struct {
+	// Addr is the address of the peer.
+	Addr string
+	Err  error
+}
+
+func (e *TLSHandshakeError) Error() string {
+	return fmt.Sprintf("dicom: TLS handshake with %s failed: %v", e.Addr, e.Err)
+}
+
+func (e *TLSHandshakeError) Unwrap() error { return e.Err }
+
+// Run the client side of the handshake on "conn", dialed to "address". The
+// server name is taken from "address" unless config sets it. Closes conn on
+// failure.
+func tlsClientHandshake(ctx context.Context, conn net.Conn, address string, config *tls.Config, params DialParams) (net.Conn, error) {
+	if config.ServerName == "" {
+		if host, _, err := net.SplitHostPort(address); err == nil {
+			config = config.Clone()
+			config.ServerName = host
+		}
+	}
+	if params.Timeout <= 0 {
+		params.Timeout = DefaultDialTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, params.Timeout)
+	defer cancel()
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, &TLSHandshakeError{Addr: address, Err: err}
+	}
+	return tlsConn, nil
+}
+
+// Run the server side of the handshake if "conn" is a TLS connection, so that
+// a failure is reported as such rather than as a broken PDU. It must complete
+// within AssociationRequestTimeout.
+func tlsServerHandshake(conn net.Conn, params ServiceProviderParams) error {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	ctx := context.Background()
+	timeout := params.AssociationRequestTimeout
+	if timeout == 0 {
+		timeout = DefaultAssociationRequestTimeout
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return &TLSHandshakeError{Addr: conn.RemoteAddr().String(), Err: err}
+	}
+	return nil
+}
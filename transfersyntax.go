@@ -3,6 +3,7 @@ package netdicom
 import (
 	"encoding/binary"
 	"fmt"
+	"strings"
 
 	dicomuid "github.com/antibios/dicom/pkg/uid"
 )
@@ -34,14 +35,153 @@ var StandardTransferSyntaxes = []string{
 	dicomuid.DeflatedExplicitVRLittleEndian,
 }
 
+// Transfer syntaxes recent enough to be missing from the dicomuid registry.
+// All are encapsulated. P3.5 A.4.
+const (
+	HTJ2KLosslessTransferSyntax           = "1.2.840.10008.1.2.4.201"
+	HTJ2KLosslessRPCLTransferSyntax       = "1.2.840.10008.1.2.4.202"
+	HTJ2KTransferSyntax                   = "1.2.840.10008.1.2.4.203"
+	JPEGXLLosslessTransferSyntax          = "1.2.840.10008.1.2.4.110"
+	JPEGXLJPEGRecompressionTransferSyntax = "1.2.840.10008.1.2.4.111"
+	JPEGXLTransferSyntax                  = "1.2.840.10008.1.2.4.112"
+)
+
+var recentTransferSyntaxes = map[string]bool{
+	HTJ2KLosslessTransferSyntax:           true,
+	HTJ2KLosslessRPCLTransferSyntax:       true,
+	HTJ2KTransferSyntax:                   true,
+	JPEGXLLosslessTransferSyntax:          true,
+	JPEGXLJPEGRecompressionTransferSyntax: true,
+	JPEGXLTransferSyntax:                  true,
+}
+
+// Negotiation presets for ServiceUserParams.TransferSyntaxes, in order of
+// preference. Each ends with the native syntaxes, so that a peer that doesn't
+// support the compressed ones still accepts the context. The data sent must
+// already be encoded in the syntax picked; C-STORE doesn't compress.
+var (
+	// HTJ2K lossless, then explicit and implicit VR little endian.
+	PreferHTJ2KLosslessTransferSyntaxes = []string{
+		HTJ2KLosslessTransferSyntax,
+		HTJ2KLosslessRPCLTransferSyntax,
+		dicomuid.ExplicitVRLittleEndian,
+		dicomuid.ImplicitVRLittleEndian,
+	}
+	// JPEG XL lossless, then explicit and implicit VR little endian.
+	PreferJPEGXLLosslessTransferSyntaxes = []string{
+		JPEGXLLosslessTransferSyntax,
+		dicomuid.ExplicitVRLittleEndian,
+		dicomuid.ImplicitVRLittleEndian,
+	}
+)
+
+// Reports whether data in "uid" is not encapsulated, so that it can be
+// transcoded by re-encoding its elements.
+func isNativeTransferSyntax(uid string) bool {
+	return uid == dicomuid.ImplicitVRLittleEndian ||
+		uid == dicomuid.ExplicitVRLittleEndian ||
+		uid == dicomuid.ExplicitVRBigEndian
+}
+
+// UnknownTransferSyntaxPolicy defines how a transfer syntax UID missing from
+// the dicomuid registry is handled. See ServiceUserParams.UnknownTransferSyntaxes
+// and ServiceProviderParams.UnknownTransferSyntaxes.
+type UnknownTransferSyntaxPolicy int32
+
+const (
+	// RejectUnknownTransferSyntaxes makes NewServiceUser fail for unknown
+	// UIDs, and a ServiceProvider refuse them in presentation contexts.
+	// This is the default.
+	RejectUnknownTransferSyntaxes UnknownTransferSyntaxPolicy = iota
+
+	// PassThroughUnknownTransferSyntaxes treats a syntactically valid but
+	// unknown UID as an opaque transfer syntax: it is proposed and
+	// accepted as is, and data in it is relayed unchanged, e.g., by
+	// CStoreRaw, CStoreFile and CStoreStream handlers. Such data can't be
+	// decoded, since the encoding is unknown: CStoreCoerce leaves it alone,
+	// CStorePeek sees no elements, and CStore fails for a dataset in it,
+	// rather than re-encode it. This lets
+	// transfer syntaxes assigned after the dicomuid registry was built be
+	// negotiated without waiting for a dependency update.
+	PassThroughUnknownTransferSyntaxes
+)
+
+// Like CanonicalTransferSyntaxUID, but under
+// PassThroughUnknownTransferSyntaxes, an opaque UID is returned unchanged.
+func canonicalTransferSyntaxUID(uid string, policy UnknownTransferSyntaxPolicy) (string, error) {
+	canonical, err := CanonicalTransferSyntaxUID(uid)
+	if err != nil && policy == PassThroughUnknownTransferSyntaxes && isOpaqueTransferSyntax(uid) {
+		return uid, nil
+	}
+	return canonical, err
+}
+
+// Reports whether "uid" is well formed, but missing from the registry, so
+// that data in it can only be relayed as is.
+func isOpaqueTransferSyntax(uid string) bool {
+	if !isValidUID(uid) || recentTransferSyntaxes[uid] {
+		return false
+	}
+	_, err := dicomuid.Lookup(uid)
+	return err != nil
+}
+
+// BigEndianPolicy defines whether explicit VR big endian, retired in P3.5
+// 2018, is negotiated. See ServiceUserParams.BigEndian and
+// ServiceProviderParams.BigEndian.
+type BigEndianPolicy int32
+
+const (
+	// AllowExplicitVRBigEndian proposes and accepts explicit VR big
+	// endian like any other transfer syntax. This is the default, for
+	// compatibility with old peers.
+	AllowExplicitVRBigEndian BigEndianPolicy = iota
+
+	// RetireExplicitVRBigEndian drops explicit VR big endian from the
+	// transfer syntaxes a ServiceUser proposes, and makes a
+	// ServiceProvider reject presentation contexts that offer nothing
+	// else. New code should use this.
+	RetireExplicitVRBigEndian
+)
+
+// Returns the transfer syntaxes in "uids" that may be proposed under
+// "policy".
+func proposableTransferSyntaxes(uids []string, policy BigEndianPolicy) []string {
+	if policy != RetireExplicitVRBigEndian {
+		return uids
+	}
+	var r []string
+	for _, uid := range uids {
+		if uid != dicomuid.ExplicitVRBigEndian {
+			r = append(r, uid)
+		}
+	}
+	return r
+}
+
+// Reports whether "uid" is well formed. P3.5 9.1.
+func isValidUID(uid string) bool {
+	if len(uid) == 0 || len(uid) > 64 {
+		return false
+	}
+	for _, component := range strings.Split(uid, ".") {
+		if component == "" || (len(component) > 1 && component[0] == '0') {
+			return false
+		}
+		for _, c := range component {
+			if c < '0' || c > '9' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
 // CanonicalTransferSyntaxUID return the canonical transfer syntax UID (e.g.,
 // dicomuid.ExplicitVRLittleEndian or dicomuid.ImplicitVRLittleEndian), given an
 // UID that represents any transfer syntax.  Returns an error if the uid is not
 // defined in DICOM standard, or if the uid does not represent a transfer
 // syntax.
-//
-// TODO(saito) Check the standard to see if we need to accept unknown UIDS as
-// explicit little endian.
 func CanonicalTransferSyntaxUID(uid string) (string, error) {
 	// defaults are explicit VR, little endian
 	switch uid {
@@ -51,6 +191,9 @@ func CanonicalTransferSyntaxUID(uid string) (string, error) {
 		dicomuid.DeflatedExplicitVRLittleEndian:
 		return uid, nil
 	default:
+		if recentTransferSyntaxes[uid] {
+			return dicomuid.ExplicitVRLittleEndian, nil
+		}
 		e, err := dicomuid.Lookup(uid)
 		if err != nil {
 			return "", err
@@ -0,0 +1,138 @@
+package netdicom
+
+import (
+	"testing"
+
+	"github.com/antibios/dicom"
+	dicomtag "github.com/antibios/dicom/pkg/tag"
+	dicomuid "github.com/antibios/dicom/pkg/uid"
+	"github.com/antibios/go-netdicom/dimse"
+	"github.com/antibios/go-netdicom/pdu"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnknownTransferSyntaxPolicy(t *testing.T) {
+	// Assigned by the standard, but not necessarily in the registry.
+	const unknownUID = "1.2.840.10008.1.2.4.999"
+
+	_, err := canonicalTransferSyntaxUID(unknownUID, RejectUnknownTransferSyntaxes)
+	require.Error(t, err)
+	params := ServiceUserParams{
+		SOPClasses:       []string{testSOPClassUID},
+		TransferSyntaxes: []string{unknownUID, dicomuid.ImplicitVRLittleEndian},
+	}
+	require.Error(t, validateServiceUserParams(&params))
+
+	canonical, err := canonicalTransferSyntaxUID(unknownUID, PassThroughUnknownTransferSyntaxes)
+	require.NoError(t, err)
+	require.Equal(t, unknownUID, canonical)
+	params.UnknownTransferSyntaxes = PassThroughUnknownTransferSyntaxes
+	require.NoError(t, validateServiceUserParams(&params))
+	require.Equal(t, []string{unknownUID, dicomuid.ImplicitVRLittleEndian}, params.TransferSyntaxes)
+	// Data in it can't be decoded, so it is never re-encoded.
+	_, _, err = ParseTransferSyntaxUID(unknownUID)
+	require.Error(t, err)
+
+	// Malformed UIDs, and known UIDs that aren't transfer syntaxes, are
+	// still rejected.
+	_, err = canonicalTransferSyntaxUID("1.2.840.10008.1.2.abc", PassThroughUnknownTransferSyntaxes)
+	require.Error(t, err)
+	_, err = canonicalTransferSyntaxUID(dicomuid.VerificationSOPClass, PassThroughUnknownTransferSyntaxes)
+	require.Error(t, err)
+
+	// The provider accepts it only under PassThroughUnknownTransferSyntaxes,
+	// and otherwise picks a known syntax.
+	_, ok := pickTransferSyntax([]string{unknownUID}, AllowExplicitVRBigEndian, RejectUnknownTransferSyntaxes)
+	require.False(t, ok)
+	uid, ok := pickTransferSyntax([]string{unknownUID, dicomuid.ImplicitVRLittleEndian}, AllowExplicitVRBigEndian, RejectUnknownTransferSyntaxes)
+	require.True(t, ok)
+	require.Equal(t, dicomuid.ImplicitVRLittleEndian, uid)
+	uid, ok = pickTransferSyntax([]string{unknownUID, dicomuid.ImplicitVRLittleEndian}, AllowExplicitVRBigEndian, PassThroughUnknownTransferSyntaxes)
+	require.True(t, ok)
+	require.Equal(t, unknownUID, uid)
+}
+
+// Data in an unknown transfer syntax is relayed byte for byte.
+func TestUnknownTransferSyntaxRelay(t *testing.T) {
+	const unknownUID = "1.2.840.10008.1.2.4.999"
+	const sopClassUID = "1.2.840.10008.5.1.4.1.1.7" // Secondary capture
+	// Not a valid dataset in any known encoding.
+	payload := []byte{0x78, 0x9c, 0xff, 0x00, 0x01, 0x02, 0x03}
+	received := make(chan []byte, 1)
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		UnknownTransferSyntaxes: PassThroughUnknownTransferSyntaxes,
+		CStore: func(conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID, calledAE, callingAE string, data []byte) dimse.Status {
+			if transferSyntaxUID != unknownUID {
+				return dimse.Status{Status: dimse.CStoreCannotUnderstand, ErrorComment: transferSyntaxUID}
+			}
+			received <- data
+			return dimse.Success
+		},
+		// Would corrupt the data if it were applied.
+		CStoreCoerce: func(conn ConnectionState, sopClassUID, sopInstanceUID string, elems []*dicom.Element) (map[dicomtag.Tag][]string, error) {
+			return map[dicomtag.Tag][]string{dicomtag.PatientID: {"X"}}, nil
+		},
+	}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+	defer sp.Shutdown() // nolint: errcheck
+
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:              []string{sopClassUID},
+		TransferSyntaxes:        []string{unknownUID},
+		UnknownTransferSyntaxes: PassThroughUnknownTransferSyntaxes,
+	})
+	require.NoError(t, err)
+	defer su.Release() // nolint: errcheck
+	su.Connect(sp.ListenAddr().String())
+	require.NoError(t, su.CStoreRaw(sopClassUID, "1.2.3.4", unknownUID, payload))
+	require.Equal(t, payload, <-received)
+}
+
+func TestRecentTransferSyntaxesAreKnown(t *testing.T) {
+	for _, uid := range []string{HTJ2KLosslessTransferSyntax, HTJ2KTransferSyntax, JPEGXLLosslessTransferSyntax} {
+		canonical, err := CanonicalTransferSyntaxUID(uid)
+		require.NoError(t, err)
+		require.Equal(t, dicomuid.ExplicitVRLittleEndian, canonical)
+	}
+
+	// The user proposes the preset as given, not canonicalized.
+	params := ServiceUserParams{
+		CalledAETitle:    "foo",
+		SOPClasses:       []string{testSOPClassUID},
+		TransferSyntaxes: append([]string{}, PreferHTJ2KLosslessTransferSyntaxes...),
+	}
+	require.NoError(t, validateServiceUserParams(&params))
+	require.Equal(t, PreferHTJ2KLosslessTransferSyntaxes, params.TransferSyntaxes)
+
+	// Syntaxes in the registry are still canonicalized, without leaving
+	// duplicates.
+	const jpegBaselineUID = "1.2.840.10008.1.2.4.50"
+	params.TransferSyntaxes = []string{HTJ2KLosslessTransferSyntax, jpegBaselineUID, dicomuid.ExplicitVRLittleEndian}
+	require.NoError(t, validateServiceUserParams(&params))
+	require.Equal(t, []string{HTJ2KLosslessTransferSyntax, dicomuid.ExplicitVRLittleEndian}, params.TransferSyntaxes)
+}
+
+func TestCStoreContextForEncapsulatedData(t *testing.T) {
+	cm := newContextManager("test")
+	addContextMapping(cm, testSOPClassUID, HTJ2KLosslessTransferSyntax, 1, pdu.PresentationContextAccepted)
+	addContextMapping(cm, testSOPClassUID, dicomuid.ExplicitVRLittleEndian, 3, pdu.PresentationContextAccepted)
+
+	e, err := lookupCStoreContext(cm, testSOPClassUID, HTJ2KLosslessTransferSyntax, true)
+	require.NoError(t, err)
+	require.Equal(t, byte(1), e.contextID)
+
+	// Native data is transcoded to a native syntax, never an encapsulated one.
+	e, err = lookupCStoreContext(cm, testSOPClassUID, dicomuid.ImplicitVRLittleEndian, false)
+	require.NoError(t, err)
+	require.Equal(t, byte(3), e.contextID)
+
+	// Encapsulated data can't be transcoded.
+	_, err = lookupCStoreContext(cm, testSOPClassUID, JPEGXLLosslessTransferSyntax, false)
+	require.Error(t, err)
+
+	cm = newContextManager("test")
+	addContextMapping(cm, testSOPClassUID, HTJ2KLosslessTransferSyntax, 1, pdu.PresentationContextAccepted)
+	_, err = lookupCStoreContext(cm, testSOPClassUID, dicomuid.ExplicitVRLittleEndian, false)
+	require.Error(t, err)
+}
@@ -0,0 +1,409 @@
+package netdicom
+
+// This file exposes the DICOM upper layer (P3.8 section 9) as a PDU-level
+// API, for tools that work below DIMSE, e.g., association stress testers or
+// protocol conformance probes.
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/antibios/go-dicom/dicomlog"
+	"github.com/antibios/go-netdicom/pdu"
+)
+
+// ULState is a state of the upper layer state machine of P3.8 9.2.3. Its
+// value is the state number, e.g., 6 for Sta6.
+type ULState int
+
+const (
+	ULStateIdle                            = ULState(sta01)
+	ULStateAwaitingAssociateRQ             = ULState(sta02)
+	ULStateAwaitingLocalAssociateResponse  = ULState(sta03)
+	ULStateAwaitingTransportOpen           = ULState(sta04)
+	ULStateAwaitingAssociateResponse       = ULState(sta05)
+	ULStateAssociated                      = ULState(sta06)
+	ULStateAwaitingReleaseRP               = ULState(sta07)
+	ULStateAwaitingLocalReleaseResponse    = ULState(sta08)
+	ULStateReleaseCollisionRequestorLocal  = ULState(sta09)
+	ULStateReleaseCollisionAcceptorRemote  = ULState(sta10)
+	ULStateReleaseCollisionRequestorRemote = ULState(sta11)
+	ULStateReleaseCollisionAcceptorLocal   = ULState(sta12)
+	ULStateAwaitingClose                   = ULState(sta13)
+)
+
+// String returns the state number and its description from P3.8, e.g.,
+// "sta06(Association established and ready for data transfer)".
+func (s ULState) String() string {
+	st := stateType(s)
+	return st.String()
+}
+
+// IllegalPDUError is returned by ULConn when a PDU isn't allowed in the
+// current state of the association.
+type IllegalPDUError struct {
+	// State is the state in which the PDU was sent or received.
+	State ULState
+	PDU   pdu.PDU
+	// Sent is true if the local side tried to send the PDU. Such a PDU is
+	// not sent, and the state doesn't change. A PDU received from the peer
+	// is answered with A-ABORT.
+	Sent bool
+}
+
+func (e *IllegalPDUError) Error() string {
+	verb := "received"
+	if e.Sent {
+		verb = "sent"
+	}
+	return fmt.Sprintf("dicom.ULConn: %v %s in %v", e.PDU, verb, e.State)
+}
+
+// ULTraceEntry describes a PDU exchanged by a ULConn, and the transition it
+// caused.
+type ULTraceEntry struct {
+	Time time.Time
+	// Sent is true for a PDU sent by the local side, false for a PDU
+	// received from the peer.
+	Sent bool
+	// PDU is the decoded PDU. Its String method hides user identity
+	// credentials; for an A-ASSOCIATE, Format with pdu.RedactedFormat also
+	// bounds the length, as the logs do.
+	PDU pdu.PDU
+	// Data is the encoded PDU, e.g., for pdu.HexDump. For a received PDU,
+	// these are the bytes read from the connection.
+	Data []byte
+	// Action is the P3.8 action taken, e.g., "AE-7".
+	Action   string
+	From, To ULState
+}
+
+// ULConnParams configures a ULConn.
+type ULConnParams struct {
+	// MaxPDUSize is the largest PDU Receive accepts. Defaults to
+	// DefaultMaxPDUSize.
+	MaxPDUSize int
+
+	// Trace, if set, is called for every PDU sent or received, including the
+	// A-ABORTs that ULConn sends on its own.
+	Trace func(ULTraceEntry)
+
+	// Dial configures how DialUL reaches the peer.
+	Dial DialParams
+}
+
+// ULConn is an upper layer connection: it exchanges raw PDUs with a peer,
+// running the state machine of P3.8 9.2.3 so that only the PDUs legal in the
+// current state are sent. The caller plays the local service user: it builds
+// every PDU, including A-ASSOCIATE-RQ and A-ASSOCIATE-AC, and decides whether
+// to accept an association. ULConn doesn't run the ARTIM timer; use
+// SetDeadline to bound waits.
+//
+// Send and Receive may be called concurrently, e.g., Receive from a dedicated
+// goroutine.
+type ULConn struct {
+	conn       net.Conn
+	requestor  bool
+	maxPDUSize int
+	trace      func(ULTraceEntry)
+
+	mu    sync.Mutex // serializes writes to conn
+	state stateType  // guarded by mu
+}
+
+// DialUL connects to the given address, e.g., "localhost:104", as the
+// association requestor.
+func DialUL(addr string, params ULConnParams) (*ULConn, error) {
+	conn, err := dialTCP(context.Background(), addr, params.Dial)
+	if err != nil {
+		return nil, err
+	}
+	return NewULConn(conn, true, params), nil
+}
+
+// NewULConn wraps an open connection. If "requestor", the local side must
+// start by sending A-ASSOCIATE-RQ (the connection is in Sta4, and sending the
+// request performs AE-2). Otherwise the connection is in Sta2, awaiting the
+// peer's A-ASSOCIATE-RQ.
+func NewULConn(conn net.Conn, requestor bool, params ULConnParams) *ULConn {
+	if params.MaxPDUSize <= 0 {
+		params.MaxPDUSize = DefaultMaxPDUSize
+	}
+	c := &ULConn{
+		conn:       conn,
+		requestor:  requestor,
+		maxPDUSize: params.MaxPDUSize,
+		trace:      params.Trace,
+		state:      sta02,
+	}
+	if requestor {
+		c.state = sta04
+	}
+	return c
+}
+
+// State returns the current state of the association.
+func (c *ULConn) State() ULState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return ULState(c.state)
+}
+
+// Conn returns the underlying connection, e.g., to inspect the addresses.
+// Reading or writing it directly desynchronizes the state machine.
+func (c *ULConn) Conn() net.Conn { return c.conn }
+
+// SetDeadline sets the deadline for Send and Receive, as net.Conn.SetDeadline.
+func (c *ULConn) SetDeadline(t time.Time) error { return c.conn.SetDeadline(t) }
+
+// Close closes the connection. The state becomes Sta1.
+func (c *ULConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state = sta01
+	return c.conn.Close()
+}
+
+// The state reached by each action. ULConn doesn't issue primitives, so the
+// state is fixed, except for AR-8, which depends on the role.
+var ulNextStates = map[*stateAction]stateType{
+	actionAe2:  sta05,
+	actionAe3:  sta06,
+	actionAe4:  sta01,
+	actionAe6:  sta03,
+	actionAe7:  sta06,
+	actionAe8:  sta13,
+	actionDt1:  sta06,
+	actionDt2:  sta06,
+	actionAr1:  sta07,
+	actionAr2:  sta08,
+	actionAr3:  sta01,
+	actionAr4:  sta13,
+	actionAr5:  sta01,
+	actionAr6:  sta07,
+	actionAr7:  sta08,
+	actionAr9:  sta11,
+	actionAr10: sta12,
+	actionAa1:  sta13,
+	actionAa2:  sta01,
+	actionAa3:  sta01,
+	actionAa4:  sta01,
+	actionAa6:  sta13,
+	actionAa7:  sta13,
+	actionAa8:  sta13,
+}
+
+// The actions that send the PDU of the local event that triggers them.
+var ulSendActions = map[*stateAction]bool{
+	actionAe2: true,
+	actionAe7: true,
+	actionAe8: true,
+	actionDt1: true,
+	actionAr1: true,
+	actionAr4: true,
+	actionAr7: true,
+	actionAr9: true,
+	actionAa1: true,
+}
+
+func (c *ULConn) nextState(action *stateAction) stateType {
+	if action == actionAr8 {
+		if c.requestor {
+			return sta09
+		}
+		return sta10
+	}
+	next, ok := ulNextStates[action]
+	doassert(ok)
+	return next
+}
+
+// The local event for sending "v".
+func ulSendEvent(v pdu.PDU) (eventType, bool) {
+	switch n := v.(type) {
+	case *pdu.AAssociate:
+		if n.Type == pdu.TypeAAssociateRq {
+			return evt02, true
+		}
+		return evt07, true
+	case *pdu.AAssociateRj:
+		return evt08, true
+	case *pdu.PDataTf:
+		return evt09, true
+	case *pdu.AReleaseRq:
+		return evt11, true
+	case *pdu.AReleaseRp:
+		return evt14, true
+	case *pdu.AAbort:
+		return evt15, true
+	}
+	return 0, false
+}
+
+// The event for receiving "v".
+func ulReceiveEvent(v pdu.PDU) eventType {
+	switch n := v.(type) {
+	case *pdu.AAssociate:
+		if n.Type == pdu.TypeAAssociateRq {
+			return evt06
+		}
+		return evt03
+	case *pdu.AAssociateRj:
+		return evt04
+	case *pdu.PDataTf:
+		return evt10
+	case *pdu.AReleaseRq:
+		return evt12
+	case *pdu.AReleaseRp:
+		return evt13
+	case *pdu.AAbort:
+		return evt16
+	}
+	return evt19
+}
+
+// Send sends a PDU. It returns an *IllegalPDUError, without sending anything,
+// if the PDU isn't allowed in the current state, e.g., P-DATA-TF before the
+// association is accepted. After A-ASSOCIATE-RJ or A-ABORT, the connection
+// awaits the peer's close (Sta13); call Close when done.
+func (c *ULConn) Send(v pdu.PDU) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	event, ok := ulSendEvent(v)
+	var action *stateAction
+	if ok {
+		action = findAction(c.state, &stateEvent{event: event}, "ULConn")
+	}
+	if action == nil || !ulSendActions[action] {
+		return &IllegalPDUError{State: ULState(c.state), PDU: v, Sent: true}
+	}
+	data, err := c.write(v)
+	if err != nil {
+		c.state = sta01
+		c.conn.Close()
+		return err
+	}
+	c.transition(true, v, data, action)
+	return nil
+}
+
+// Receive waits for the next PDU from the peer.
+//
+// A PDU that isn't allowed in the current state, e.g., A-RELEASE-RP without
+// a prior A-RELEASE-RQ, is returned along with an *IllegalPDUError; as P3.8
+// requires, ULConn answers it with A-ABORT and the connection awaits the
+// peer's close. A PDU that can't be decoded is also answered with A-ABORT;
+// Receive then returns a nil PDU and the decoding error.
+//
+// Receive returns io.EOF when the peer closes the connection between PDUs.
+// The connection is then closed, and the state is Sta1. After A-ABORT,
+// A-ASSOCIATE-RJ and the A-RELEASE-RP that completes a release, the
+// connection is closed too, and Receive returns the PDU with a nil error.
+func (c *ULConn) Receive() (pdu.PDU, error) {
+	var raw bytes.Buffer
+	var in io.Reader = c.conn
+	if c.trace != nil {
+		in = io.TeeReader(c.conn, &raw)
+	}
+	v, err := pdu.ReadPDU(in, c.maxPDUSize)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		_, isNetErr := err.(net.Error)
+		if err == io.EOF || isNetErr || strings.Contains(err.Error(), "EOF") {
+			dicomlog.Vprintf(1, "dicom.ULConn: Connection closed: %v", err)
+			c.state = sta01
+			c.conn.Close()
+			return nil, err
+		}
+		c.protocolError(&stateEvent{event: evt19, err: err})
+		return nil, err
+	}
+	event := ulReceiveEvent(v)
+	action := findAction(c.state, &stateEvent{event: event, pdu: v}, "ULConn")
+	if action == nil || action == actionAa1 || action == actionAa7 || action == actionAa8 {
+		illegal := &IllegalPDUError{State: ULState(c.state), PDU: v}
+		c.trace1(false, v, raw.Bytes(), action, c.state)
+		c.protocolError(&stateEvent{event: event, pdu: v})
+		return v, illegal
+	}
+	c.transition(false, v, raw.Bytes(), action)
+	if c.state == sta01 {
+		c.conn.Close()
+	}
+	return v, nil
+}
+
+// Send A-ABORT in response to a protocol error, as AA-1, AA-7 or AA-8 would.
+func (c *ULConn) protocolError(event *stateEvent) {
+	action := findAction(c.state, event, "ULConn")
+	if action == nil || c.state == sta01 {
+		return
+	}
+	var abort *pdu.AAbort
+	switch action {
+	case actionAa1:
+		diagnostic := pdu.AbortReasonType(0)
+		if c.state == sta02 {
+			diagnostic = pdu.AbortReasonUnexpectedPDU
+		}
+		abort = &pdu.AAbort{Source: pdu.AbortSourceServiceUser, Reason: diagnostic}
+	case actionAa7:
+		abort = &pdu.AAbort{Source: pdu.AbortSourceServiceUser, Reason: pdu.AbortReasonNotSpecified}
+	case actionAa8:
+		abort = &pdu.AAbort{Source: pdu.AbortSourceServiceProvider, Reason: abortReasonForEvent(*event)}
+	default:
+		c.state = c.nextState(action)
+		return
+	}
+	dicomlog.Vprintf(0, "dicom.ULConn: Protocol error in %v: %v; aborting", c.state.String(), event)
+	data, err := c.write(abort)
+	if err != nil {
+		c.state = sta01
+		c.conn.Close()
+		return
+	}
+	c.transition(true, abort, data, action)
+}
+
+func (c *ULConn) write(v pdu.PDU) ([]byte, error) {
+	data, err := pdu.EncodePDU(v)
+	if err != nil {
+		return nil, err
+	}
+	_, err = c.conn.Write(data)
+	return data, err
+}
+
+// Move to the state reached by "action", and report the PDU to the trace.
+func (c *ULConn) transition(sent bool, v pdu.PDU, data []byte, action *stateAction) {
+	from := c.state
+	c.state = c.nextState(action)
+	c.trace1(sent, v, data, action, from)
+}
+
+func (c *ULConn) trace1(sent bool, v pdu.PDU, data []byte, action *stateAction, from stateType) {
+	dicomlog.Vprintf(2, "dicom.ULConn: sent:%v %v: %v -> %v", sent, pduText{v: v}, from.String(), c.state.String())
+	dicomlog.Vprintf(HexDumpLogLevel, "dicom.ULConn: PDU:\n%v", pduHexDump{v: v, data: data})
+	if c.trace == nil {
+		return
+	}
+	entry := ULTraceEntry{
+		Time: time.Now(),
+		Sent: sent,
+		PDU:  v,
+		Data: data,
+		From: ULState(from),
+		To:   ULState(c.state),
+	}
+	if action != nil {
+		entry.Action = action.Name
+	}
+	c.trace(entry)
+}
@@ -0,0 +1,34 @@
+package netdicom
+
+// This file implements the policy for storage SOP classes on a provider that
+// has no C-STORE handler.
+
+// UnhandledCStorePolicy selects what a ServiceProvider without a C-STORE
+// handler, i.e., with none of CStore, CStoreDataset, CStoreHandlers,
+// CStoreStream, or CStoreWithDigest and DataDigest, does about storage SOP
+// classes.
+type UnhandledCStorePolicy int
+
+const (
+	// UnhandledCStoreRefuse accepts the presentation contexts of storage
+	// SOP classes, and answers each C-STORE request with status 0x0122
+	// ("Refused: SOP class not supported"). This is the default.
+	UnhandledCStoreRefuse UnhandledCStorePolicy = iota
+
+	// UnhandledCStoreRejectContext rejects the presentation contexts of
+	// storage SOP classes during association negotiation, with "abstract
+	// syntax not supported", so the peer learns before sending any data.
+	UnhandledCStoreRejectContext
+)
+
+// Reports whether "params" sets a handler for C-STORE requests.
+func hasCStoreHandler(params ServiceProviderParams) bool {
+	return params.CStore != nil || params.CStoreDataset != nil || params.CStoreHandlers != nil || params.CStoreStream != nil ||
+		(params.CStoreWithDigest != nil && params.DataDigest != nil)
+}
+
+// Reports whether the presentation contexts of storage SOP classes are to be
+// rejected during negotiation.
+func rejectStorageContexts(params ServiceProviderParams) bool {
+	return params.UnhandledCStore == UnhandledCStoreRejectContext && !hasCStoreHandler(params)
+}
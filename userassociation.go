@@ -0,0 +1,142 @@
+package netdicom
+
+// This file exposes the association of a ServiceUser, so that an application
+// can watch it, e.g., to abort a wedged transfer, and tests can check its
+// state.
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/antibios/go-dicom/dicomlog"
+	"github.com/antibios/go-netdicom/pdu"
+)
+
+// UserAssociationState is the state of the association of a ServiceUser.
+type UserAssociationState int
+
+const (
+	// UserAssociationRequested: A-ASSOCIATE-RQ is being sent, or awaits
+	// an answer.
+	UserAssociationRequested UserAssociationState = iota
+	// UserAssociationActive: the association is established.
+	UserAssociationActive
+	// UserAssociationClosed: the association was released, aborted or
+	// rejected, or the connection failed.
+	UserAssociationClosed
+)
+
+func (s UserAssociationState) String() string {
+	switch s {
+	case UserAssociationRequested:
+		return "requested"
+	case UserAssociationActive:
+		return "active"
+	case UserAssociationClosed:
+		return "closed"
+	}
+	return fmt.Sprintf("UserAssociationState(%d)", int(s))
+}
+
+// UserAssociation is the association of a ServiceUser. See
+// ServiceUser.Association.
+type UserAssociation struct {
+	su *ServiceUser
+}
+
+// UserAssociationInfo is a snapshot of the association of a ServiceUser.
+type UserAssociationInfo struct {
+	// ID identifies the association in log messages.
+	ID    string
+	State UserAssociationState
+	// StartTime is when the connection was handed to the ServiceUser.
+	StartTime time.Time
+	// The remote end. Only the transport fields are set until the
+	// association is accepted.
+	Peer Peer
+	// Number of DIMSE commands in progress.
+	ActiveCommands int
+	// Err is why the association failed, if it did and the reason is
+	// known, e.g., an *AbortError.
+	Err error
+}
+
+// Association returns the association of the ServiceUser, or nil if Connect
+// or SetConn hasn't been called, or Connect failed to connect. It may be used
+// from any goroutine, e.g., by a watchdog while an operation runs.
+func (su *ServiceUser) Association() *UserAssociation {
+	su.mu.Lock()
+	defer su.mu.Unlock()
+	if su.conn == nil {
+		return nil
+	}
+	return &UserAssociation{su: su}
+}
+
+// AssociateAC returns the A-ASSOCIATE-AC received from the provider, with all
+// its items as decoded, e.g., private user information sub-items, which are
+// *pdu.SubItemUnsupported. It waits until the association is established. The
+// PDU is shared, and must not be modified.
+func (su *ServiceUser) AssociateAC() (*pdu.AAssociate, error) {
+	if err := su.waitUntilReady(); err != nil {
+		return nil, err
+	}
+	return su.cm.associateAC, nil
+}
+
+// Record the connection handed to the statemachine, for Association.
+func (su *ServiceUser) setConn(conn net.Conn) {
+	su.mu.Lock()
+	su.conn = conn
+	su.startTime = time.Now()
+	su.mu.Unlock()
+}
+
+// Info returns a snapshot of the association.
+func (a *UserAssociation) Info() UserAssociationInfo {
+	su := a.su
+	su.mu.Lock()
+	info := UserAssociationInfo{
+		ID:        su.label,
+		StartTime: su.startTime,
+		Err:       su.err,
+	}
+	switch su.status {
+	case serviceUserInitial:
+		info.State = UserAssociationRequested
+		info.Peer = newPeer(su.conn, nil)
+	case serviceUserAssociationActive:
+		info.State = UserAssociationActive
+		info.Peer = newPeer(su.conn, su.cm)
+	default:
+		info.State = UserAssociationClosed
+		info.Peer = newPeer(su.conn, su.cm)
+	}
+	su.mu.Unlock()
+	su.disp.mu.Lock()
+	info.ActiveCommands = len(su.disp.activeCommands)
+	su.disp.mu.Unlock()
+	return info
+}
+
+// Abort sends A-ABORT to the peer and closes the connection. The operations in
+// progress fail with an *AbortError that wraps "reason", which may be nil. It
+// returns an error if the association has already ended.
+func (a *UserAssociation) Abort(reason error) error {
+	su := a.su
+	err := &AbortError{Source: pdu.AbortSourceServiceUser, Err: reason}
+	su.mu.Lock()
+	if su.status == serviceUserClosed {
+		su.mu.Unlock()
+		return fmt.Errorf("dicom.serviceUser(%s): association already closed", su.label)
+	}
+	if su.err == nil {
+		su.err = err
+	}
+	su.mu.Unlock()
+	dicomlog.Vprintf(0, "dicom.serviceUser(%s): Aborting association: %v", su.label, err)
+	su.disp.handleEvent(upcallEvent{eventType: upcallEventError, err: err})
+	su.disp.sendDowncall(stateEvent{event: evt15})
+	return nil
+}
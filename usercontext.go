@@ -0,0 +1,89 @@
+package netdicom
+
+// This file implements the context.Context variants of the ServiceUser
+// operations: when the context is done before the operation finishes, the
+// association is aborted, which ends the operation.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	dicom "github.com/antibios/dicom"
+)
+
+// Abort the association when "ctx" is done, until "stop" is called. stop
+// returns true if the association was aborted.
+func (su *ServiceUser) abortOnDone(ctx context.Context) (stop func() bool) {
+	done := make(chan struct{})
+	aborted := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			if a := su.Association(); a != nil {
+				a.Abort(ctx.Err()) // nolint: errcheck
+			}
+			aborted <- true
+		case <-done:
+			aborted <- false
+		}
+	}()
+	return func() bool {
+		close(done)
+		return <-aborted
+	}
+}
+
+// Run "op", aborting the association if "ctx" is done first. The error
+// returned then wraps ctx.Err().
+func (su *ServiceUser) runContext(ctx context.Context, op func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	stop := su.abortOnDone(ctx)
+	err := op()
+	if !stop() || err == nil || errors.Is(err, ctx.Err()) {
+		// If err is nil, the operation finished just as the context
+		// ended: the association is gone, but the operation went
+		// through.
+		return err
+	}
+	return fmt.Errorf("%w: %v", ctx.Err(), err)
+}
+
+// CEchoContext is like CEcho, but aborts the association if "ctx" is done
+// before the response arrives. The error returned then wraps ctx.Err().
+func (su *ServiceUser) CEchoContext(ctx context.Context) error {
+	return su.runContext(ctx, su.CEcho)
+}
+
+// CStoreContext is like CStore, but aborts the association if "ctx" is done
+// before the response arrives. The error returned then wraps ctx.Err(). The
+// peer may or may not have stored the dataset.
+func (su *ServiceUser) CStoreContext(ctx context.Context, ds *dicom.Dataset) error {
+	return su.runContext(ctx, func() error { return su.CStore(ds) })
+}
+
+// CFindContext is like CFind, but aborts the association if "ctx" is done
+// before the last response arrives. The last result on the channel then has
+// an error that wraps ctx.Err(). The caller MUST still read the channel
+// until it is closed.
+func (su *ServiceUser) CFindContext(ctx context.Context, qrLevel QRLevel, filter []*dicom.Element) chan CFindResult {
+	if err := ctx.Err(); err != nil {
+		ch := make(chan CFindResult, 1)
+		ch <- CFindResult{Err: err}
+		close(ch)
+		return ch
+	}
+	stop := su.abortOnDone(ctx)
+	in := su.CFind(qrLevel, filter)
+	out := make(chan CFindResult, cap(in))
+	go func() {
+		defer close(out)
+		for result := range in {
+			out <- result
+		}
+		stop()
+	}()
+	return out
+}
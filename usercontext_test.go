@@ -0,0 +1,64 @@
+package netdicom
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	dicom "github.com/antibios/dicom"
+	"github.com/antibios/dicom/pkg/tag"
+	"github.com/antibios/go-netdicom/dimse"
+	"github.com/antibios/go-netdicom/sopclass"
+	"github.com/stretchr/testify/require"
+)
+
+// An operation whose context ends before the response aborts the association,
+// and fails with the error of the context.
+func TestServiceUserContext(t *testing.T) {
+	unblock := make(chan struct{})
+	defer close(unblock)
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		CEcho: func(conn ConnectionState) dimse.Status {
+			<-unblock
+			return dimse.Success
+		},
+		CFind: func(conn ConnectionState, transferSyntaxUID, sopClassUID string, filters []*dicom.Element, ch chan CFindResult) {
+			defer close(ch)
+			ch <- CFindResult{Elements: []*dicom.Element{dicom.MustNewElement(tag.PatientName, []string{"foo"})}}
+			<-unblock
+		},
+	}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+	defer sp.Shutdown() // nolint: errcheck
+
+	connect := func() *ServiceUser {
+		su, err := NewServiceUser(ServiceUserParams{
+			SOPClasses: append(append([]string{}, sopclass.VerificationClasses...), sopclass.QRFindClasses...)})
+		require.NoError(t, err)
+		require.NoError(t, su.ConnectContext(context.Background(), sp.ListenAddr().String()))
+		return su
+	}
+
+	su := connect()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, su.CEchoContext(ctx), context.DeadlineExceeded)
+	require.Eventually(t, func() bool { return su.Association().Info().State == UserAssociationClosed }, 5*time.Second, 10*time.Millisecond)
+	// The association is gone, and so is the context.
+	require.Error(t, su.CEcho())
+	require.ErrorIs(t, su.CEchoContext(ctx), context.DeadlineExceeded)
+	su.Release() // nolint: errcheck
+
+	su = connect()
+	defer su.Release() // nolint: errcheck
+	ctx, cancel = context.WithCancel(context.Background())
+	var results []CFindResult
+	for result := range su.CFindContext(ctx, QRLevelPatient, []*dicom.Element{dicom.MustNewElement(tag.PatientName, []string{"*"})}) {
+		results = append(results, result)
+		cancel()
+	}
+	require.Len(t, results, 2)
+	require.NoError(t, results[0].Err)
+	require.ErrorIs(t, results[1].Err, context.Canceled)
+}
@@ -0,0 +1,244 @@
+package netdicom
+
+// This file implements User Identity negotiation (P3.7 D.3.3.7): sending
+// credentials in A-ASSOCIATE-RQ, and checking them on the provider with an
+// Authenticator.
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/antibios/go-dicom/dicomlog"
+	"github.com/antibios/go-netdicom/pdu"
+)
+
+// UserIdentity is the identity a ServiceUser asserts in A-ASSOCIATE-RQ.
+type UserIdentity struct {
+	Type pdu.UserIdentityType
+	// PrimaryField is the username, Kerberos ticket, SAML assertion or JWT.
+	PrimaryField []byte
+	// SecondaryField is the passcode, for pdu.UserIdentityUsernamePasscode.
+	SecondaryField []byte
+	// PositiveResponseRequested asks the provider to acknowledge the
+	// identity in A-ASSOCIATE-AC.
+	PositiveResponseRequested bool
+}
+
+// Check that the fields fit in the User Identity item, whose lengths are 2
+// bytes.
+func (id *UserIdentity) validate() error {
+	if id == nil {
+		return nil
+	}
+	if 2+2+len(id.PrimaryField)+2+len(id.SecondaryField) > math.MaxUint16 {
+		return fmt.Errorf("UserIdentity: primary and secondary fields of %d and %d bytes don't fit in the item",
+			len(id.PrimaryField), len(id.SecondaryField))
+	}
+	return nil
+}
+
+// UserIdentityCallback returns the identity to send in the A-ASSOCIATE-RQ of a
+// new association. An error fails the association before anything is sent.
+//
+// It is called on the goroutine that runs the association, once the
+// connection is up and before A-ASSOCIATE-RQ is sent. Nothing else happens on
+// the association until it returns, so a slow callback delays the request.
+type UserIdentityCallback func() (*UserIdentity, error)
+
+// TokenFunc fetches a new token, e.g., a JWT from an identity provider, and
+// the time it expires. A zero expiry means the token doesn't expire. It is
+// called from the UserIdentityCallback, and so on the goroutine that runs the
+// association, when the cached token is missing or about to expire.
+type TokenFunc func() (token string, expiry time.Time, err error)
+
+// DefaultTokenRefreshMargin is the default value of
+// TokenIdentityParams.RefreshMargin.
+const DefaultTokenRefreshMargin = time.Minute
+
+// TokenIdentityParams configures NewTokenIdentityCallback.
+type TokenIdentityParams struct {
+	// Type is pdu.UserIdentityJWT or pdu.UserIdentitySAML. If zero,
+	// pdu.UserIdentityJWT is used.
+	Type pdu.UserIdentityType
+
+	// RefreshMargin is how long before its expiry a token is replaced, so
+	// that it doesn't expire while the request is in flight. If zero,
+	// DefaultTokenRefreshMargin is used.
+	RefreshMargin time.Duration
+
+	// PositiveResponseRequested is UserIdentity.PositiveResponseRequested.
+	PositiveResponseRequested bool
+
+	// Clock, if non-nil, is used to check expiries. Tests set it to a
+	// VirtualClock. If nil, the real clock is used.
+	Clock Clock
+}
+
+// NewTokenIdentityCallback returns a UserIdentityCallback that sends the token
+// from "fetch". The token is cached, and fetched again once it is about to
+// expire, so that the ServiceUsers of a pool can share the callback, each new
+// association presenting a valid token without a round trip to the identity
+// provider. It is thread safe.
+func NewTokenIdentityCallback(fetch TokenFunc, params TokenIdentityParams) UserIdentityCallback {
+	if params.Type == 0 {
+		params.Type = pdu.UserIdentityJWT
+	}
+	if params.RefreshMargin <= 0 {
+		params.RefreshMargin = DefaultTokenRefreshMargin
+	}
+	clock := clockOrDefault(params.Clock)
+	var mu sync.Mutex
+	var token string
+	var expiry time.Time
+	return func() (*UserIdentity, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if token == "" || (!expiry.IsZero() && !clock.Now().Before(expiry.Add(-params.RefreshMargin))) {
+			t, e, err := fetch()
+			if err != nil {
+				return nil, err
+			}
+			if t == "" {
+				return nil, fmt.Errorf("empty token")
+			}
+			token, expiry = t, e
+		}
+		return &UserIdentity{
+			Type:                      params.Type,
+			PrimaryField:              []byte(token),
+			PositiveResponseRequested: params.PositiveResponseRequested,
+		}, nil
+	}
+}
+
+// Returns the identity to send in A-ASSOCIATE-RQ, from
+// params.UserIdentityCallback or params.UserIdentity.
+func userIdentityForRequest(params ServiceUserParams) (*UserIdentity, error) {
+	if params.UserIdentityCallback == nil {
+		return params.UserIdentity, nil
+	}
+	identity, err := params.UserIdentityCallback()
+	if err != nil {
+		return nil, fmt.Errorf("dicom: user identity: %w", err)
+	}
+	return identity, nil
+}
+
+// Principal is the identity of a peer, as established by an Authenticator. It
+// is available to handlers as ConnectionState.Principal, e.g., to authorize
+// queries and retrievals.
+type Principal struct {
+	// Name identifies the peer, e.g., the username or the subject of the
+	// JWT.
+	Name string
+	// IdentityType is the kind of credentials that established the
+	// identity. It's filled in by the provider.
+	IdentityType pdu.UserIdentityType
+	// Attributes holds whatever else the Authenticator knows about the
+	// peer, e.g., roles or groups.
+	Attributes map[string]string
+	// ServerResponse is sent to the peer if it asked for a positive
+	// response, e.g., the Kerberos server ticket. Must be empty for
+	// username identities.
+	ServerResponse []byte
+}
+
+// Authenticator verifies the User Identity item that a peer sends in
+// A-ASSOCIATE-RQ. Each method returns the peer's principal if the credentials
+// are valid, and an error, which is logged but not sent to the peer,
+// otherwise. A failure rejects the association. "conn" describes the peer; its
+// Principal is not set yet.
+//
+// The methods are called before the association is accepted, on the
+// goroutine that serves it, so they may block, e.g., on a directory lookup.
+type Authenticator interface {
+	// VerifyUsernamePassword verifies a username and passcode. "password"
+	// is empty for pdu.UserIdentityUsername, which carries no passcode.
+	VerifyUsernamePassword(conn ConnectionState, username, password string) (*Principal, error)
+	// VerifyKerberosTicket verifies a Kerberos service ticket.
+	VerifyKerberosTicket(conn ConnectionState, ticket []byte) (*Principal, error)
+	// VerifyJWT verifies a JSON web token.
+	VerifyJWT(conn ConnectionState, token string) (*Principal, error)
+	// VerifySAMLAssertion verifies a SAML assertion, in its XML encoding.
+	VerifySAMLAssertion(conn ConnectionState, assertion string) (*Principal, error)
+}
+
+// Returned by authenticateUser when an Authenticator is set and the peer sent
+// no User Identity item.
+var errNoUserIdentity = errors.New("no user identity")
+
+// Build the user identity subitem of A-ASSOCIATE-RQ.
+func (m *contextManager) userIdentityItems() []pdu.SubItem {
+	if m.proposedIdentity == nil {
+		return nil
+	}
+	return []pdu.SubItem{&pdu.UserIdentityRequestSubItem{
+		Type:                      m.proposedIdentity.Type,
+		PositiveResponseRequested: m.proposedIdentity.PositiveResponseRequested,
+		PrimaryField:              m.proposedIdentity.PrimaryField,
+		SecondaryField:            m.proposedIdentity.SecondaryField,
+	}}
+}
+
+// Check the identity the peer proposed in A-ASSOCIATE-RQ against
+// params.Authenticator, and record the principal in sm.contextManager.
+// Returns the subitem to add to A-ASSOCIATE-AC's user information, or nil.
+// Called on the provider side after onAssociateRequest.
+func authenticateUser(sm *stateMachine) (pdu.SubItem, error) {
+	params := sm.providerParams
+	m := sm.contextManager
+	if params.Authenticator == nil {
+		// P3.7 D.3.3.7: the acceptor may ignore the item.
+		return nil, nil
+	}
+	item := m.peerIdentity
+	if item == nil {
+		if params.AllowAnonymous {
+			return nil, nil
+		}
+		return nil, errNoUserIdentity
+	}
+	conn := getConnState(sm.conn, m)
+	var principal *Principal
+	var err error
+	switch item.Type {
+	case pdu.UserIdentityUsername, pdu.UserIdentityUsernamePasscode:
+		principal, err = params.Authenticator.VerifyUsernamePassword(conn, string(item.PrimaryField), string(item.SecondaryField))
+	case pdu.UserIdentityKerberos:
+		principal, err = params.Authenticator.VerifyKerberosTicket(conn, item.PrimaryField)
+	case pdu.UserIdentityJWT:
+		principal, err = params.Authenticator.VerifyJWT(conn, string(item.PrimaryField))
+	case pdu.UserIdentitySAML:
+		principal, err = params.Authenticator.VerifySAMLAssertion(conn, string(item.PrimaryField))
+	default:
+		err = fmt.Errorf("unsupported user identity type %d", item.Type)
+	}
+	if err == nil && principal == nil {
+		err = fmt.Errorf("authenticator returned no principal")
+	}
+	if err != nil {
+		return nil, err
+	}
+	p := *principal
+	p.IdentityType = item.Type
+	m.principal = &p
+	dicomlog.Vprintf(1, "dicom.authenticateUser(%s): Peer authenticated as '%s'", sm.label, principal.Name)
+	if !item.PositiveResponseRequested {
+		return nil, nil
+	}
+	return &pdu.UserIdentityResponseSubItem{ServerResponse: principal.ServerResponse}, nil
+}
+
+// Append "item" to the user information item of A-ASSOCIATE-AC "responses",
+// as built by onAssociateRequest.
+func addUserInformationItem(responses []pdu.SubItem, item pdu.SubItem) {
+	for _, r := range responses {
+		if ui, ok := r.(*pdu.UserInformationItem); ok {
+			ui.Items = append(ui.Items, item)
+			return
+		}
+	}
+}
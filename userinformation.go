@@ -0,0 +1,33 @@
+package netdicom
+
+// This file implements custom user information sub-items: items, e.g.,
+// vendor-private negotiation items, that the application adds to the user
+// information item of A-ASSOCIATE-RQ or -AC. See
+// ServiceUserParams.UserInformationItems and
+// ServiceProviderParams.UserInformationReply.
+
+import (
+	"fmt"
+
+	"github.com/antibios/go-netdicom/pdu"
+)
+
+// UserInformationReplyCallback returns the sub-items to add to the user
+// information item of the A-ASSOCIATE-AC that accepts "rq". The peer's own
+// sub-items are in rq.UserInformation.
+type UserInformationReplyCallback func(rq AssociateRequest) []pdu.SubItem
+
+// Check that "items" can be encoded.
+func validateUserInformationItems(items []pdu.SubItem) error {
+	for i, item := range items {
+		switch v := item.(type) {
+		case nil:
+			return fmt.Errorf("user information sub-item %d is nil", i)
+		case *pdu.SubItemUnsupported:
+			if len(v.Data) > 0xffff {
+				return fmt.Errorf("user information sub-item %d (type 0x%x): %d bytes, more than fit in an item", i, v.Type, len(v.Data))
+			}
+		}
+	}
+	return nil
+}
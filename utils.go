@@ -3,6 +3,9 @@ package netdicom
 import (
 	"fmt"
 	"sync/atomic"
+
+	"github.com/antibios/go-netdicom/dimse"
+	"github.com/antibios/go-netdicom/pdu"
 )
 
 var idSeq int32 = 32 // for generating unique ID
@@ -20,3 +23,45 @@ func doassert(cond bool, values ...interface{}) {
 		panic(s)
 	}
 }
+
+// HexDumpLogLevel is the dicomlog level at which every PDU and DIMSE command
+// set exchanged is logged as an annotated hex dump (see pdu.HexDump and
+// dimse.HexDump), e.g., for a CLI's debug mode.
+const HexDumpLogLevel = 3
+
+// Formats as the hex dump of a PDU, for logging. The dump is built only if
+// the message is logged. Received PDUs are re-encoded, so the dump may differ
+// from the bytes on the wire in fields that decoding drops.
+type pduHexDump struct {
+	v    pdu.PDU
+	data []byte // encoded v; nil to encode on demand
+}
+
+func (d pduHexDump) String() string {
+	data := d.data
+	if data == nil {
+		var err error
+		if data, err = pdu.EncodePDU(d.v); err != nil {
+			return err.Error()
+		}
+	}
+	return pdu.HexDump(data)
+}
+
+// Formats a PDU for logging; an A-ASSOCIATE as pdu.RedactedFormat, so that
+// credentials stay out of the logs and a huge request doesn't flood them.
+type pduText struct {
+	v pdu.PDU
+}
+
+func (t pduText) String() string {
+	if a, ok := t.v.(*pdu.AAssociate); ok {
+		return a.Format(pdu.RedactedFormat)
+	}
+	return t.v.String()
+}
+
+// Formats as the hex dump of a command set, for logging.
+type commandHexDump []byte
+
+func (d commandHexDump) String() string { return dimse.HexDump(d) }
@@ -0,0 +1,215 @@
+package worklist
+
+// Parsing of HL7v2 ORM^O01 messages.
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// OrderControl is ORC-1 of an ORM message.
+type OrderControl string
+
+const (
+	OrderNew          OrderControl = "NW"
+	OrderChange       OrderControl = "XO"
+	OrderCancel       OrderControl = "CA"
+	OrderDiscontinue  OrderControl = "DC"
+	OrderStatusChange OrderControl = "SC"
+	OrderCanceledAsRq OrderControl = "OC"
+)
+
+// Order is an ORM^O01 message, reduced to the fields needed for a worklist
+// entry.
+type Order struct {
+	// ControlID is MSH-10. It is echoed in the acknowledgement.
+	ControlID string
+	Control   OrderControl
+	// OrderStatus is ORC-5, e.g., "CM" when the order is complete.
+	OrderStatus string
+	Item        Item
+}
+
+// Removes reports whether the order takes its item off the worklist.
+func (o *Order) Removes() bool {
+	switch o.Control {
+	case OrderCancel, OrderDiscontinue, OrderCanceledAsRq:
+		return true
+	case OrderStatusChange:
+		return o.OrderStatus == "CM" || o.OrderStatus == "CA" || o.OrderStatus == "DC"
+	}
+	return false
+}
+
+// An HL7 message split into segments and fields. Segments are keyed by their
+// name; only the first segment of each name is kept.
+type hl7Message struct {
+	segments map[string][]string
+	// Encoding characters from MSH-2.
+	compSep, repSep byte
+}
+
+func parseHL7(msg string) (*hl7Message, error) {
+	msg = strings.NewReplacer("\r\n", "\r", "\n", "\r").Replace(msg)
+	if !strings.HasPrefix(msg, "MSH") || len(msg) < 8 {
+		return nil, fmt.Errorf("hl7: message doesn't start with an MSH segment")
+	}
+	fieldSep := string(msg[3])
+	m := &hl7Message{
+		segments: map[string][]string{},
+		compSep:  msg[4],
+		repSep:   msg[5],
+	}
+	for _, seg := range strings.Split(msg, "\r") {
+		if seg == "" {
+			continue
+		}
+		fields := strings.Split(seg, fieldSep)
+		if fields[0] == "MSH" {
+			// MSH-1 is the field separator itself, so MSH-n is
+			// fields[n-1]. Insert it to make the numbering uniform.
+			fields = append([]string{"MSH", fieldSep}, fields[1:]...)
+		}
+		if _, ok := m.segments[fields[0]]; !ok {
+			m.segments[fields[0]] = fields
+		}
+	}
+	return m, nil
+}
+
+// Returns the first repetition of field "seg"-"n", e.g., ("PID", 3) for PID-3.
+func (m *hl7Message) field(seg string, n int) string {
+	fields := m.segments[seg]
+	if n >= len(fields) {
+		return ""
+	}
+	v := fields[n]
+	if i := strings.IndexByte(v, m.repSep); i >= 0 {
+		v = v[:i]
+	}
+	return v
+}
+
+// Returns component "c" (1-based) of field "seg"-"n".
+func (m *hl7Message) component(seg string, n, c int) string {
+	comps := strings.Split(m.field(seg, n), string(m.compSep))
+	if c > len(comps) {
+		return ""
+	}
+	return comps[c-1]
+}
+
+// Converts an HL7 XPN/XCN name, starting at component "first", to a DICOM PN.
+func (m *hl7Message) personName(seg string, n, first int) string {
+	var parts []string
+	for c := first; c < first+5; c++ {
+		parts = append(parts, m.component(seg, n, c))
+	}
+	return strings.TrimRight(strings.Join(parts, "^"), "^")
+}
+
+// Returns the first nonempty value.
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// ParseORM parses an ORM^O01 message. Segments may be separated by CR, LF, or
+// CRLF. The mapping follows the IHE Scheduled Workflow profile where it can:
+//
+//	PID-3.1  PatientID                 PID-5  PatientName
+//	PID-7    PatientBirthDate          PID-8  PatientSex
+//	PV1-8    ReferringPhysicianName    ORC-1  order control
+//	OBR-18   AccessionNumber (or OBR-3, ORC-3)
+//	OBR-19   RequestedProcedureID (or the accession number)
+//	OBR-4.2  RequestedProcedureDescription and ScheduledProcedureStepDescription
+//	OBR-20   ScheduledProcedureStepID (or the requested procedure ID)
+//	OBR-24   Modality
+//	OBR-27.4 scheduled date and time (or ORC-7.4, OBR-36)
+//	ORC-2.1  placer order number (or OBR-2)
+//	ORC-3.1  filler order number (or OBR-3)
+//	ZDS-1.1  StudyInstanceUID
+//
+// If ZDS-1 is absent, StudyInstanceUID is left empty; Worklist.Apply then
+// keeps that of the order's current item, or generates one.
+func ParseORM(msg string) (*Order, error) {
+	m, err := parseHL7(msg)
+	if err != nil {
+		return nil, err
+	}
+	if t := m.component("MSH", 9, 1); t != "ORM" {
+		return nil, fmt.Errorf("hl7: message type is '%s', expect ORM", m.field("MSH", 9))
+	}
+	for _, seg := range []string{"PID", "ORC", "OBR"} {
+		if _, ok := m.segments[seg]; !ok {
+			return nil, fmt.Errorf("hl7: ORM lacks the %s segment", seg)
+		}
+	}
+	o := &Order{
+		ControlID:   m.field("MSH", 10),
+		Control:     OrderControl(m.field("ORC", 1)),
+		OrderStatus: m.field("ORC", 5),
+	}
+	it := &o.Item
+	it.PatientID = m.component("PID", 3, 1)
+	it.PatientName = m.personName("PID", 5, 1)
+	if dob := m.field("PID", 7); len(dob) >= 8 {
+		it.PatientBirthDate = dob[:8]
+	}
+	it.PatientSex = m.field("PID", 8)
+	it.ReferringPhysicianName = m.personName("PV1", 8, 2)
+	it.AccessionNumber = firstNonEmpty(
+		m.component("OBR", 18, 1),
+		m.component("OBR", 3, 1),
+		m.component("ORC", 3, 1))
+	if it.AccessionNumber == "" {
+		return nil, fmt.Errorf("hl7: ORM has no accession number (OBR-18, OBR-3, ORC-3)")
+	}
+	it.RequestedProcedureID = firstNonEmpty(m.component("OBR", 19, 1), it.AccessionNumber)
+	it.RequestedProcedureDescription = firstNonEmpty(m.component("OBR", 4, 2), m.component("OBR", 4, 1))
+	it.ScheduledProcedureStepID = firstNonEmpty(m.component("OBR", 20, 1), it.RequestedProcedureID)
+	it.ScheduledProcedureStepDescription = it.RequestedProcedureDescription
+	it.Modality = m.component("OBR", 24, 1)
+	if ts := firstNonEmpty(
+		m.component("OBR", 27, 4),
+		m.component("ORC", 7, 4),
+		m.component("OBR", 36, 1)); len(ts) >= 8 {
+		it.ScheduledProcedureStepStartDate = ts[:8]
+		it.ScheduledProcedureStepStartTime = ts[8:]
+	}
+	it.PlacerOrderNumber = firstNonEmpty(m.component("ORC", 2, 1), m.component("OBR", 2, 1))
+	it.FillerOrderNumber = firstNonEmpty(m.component("ORC", 3, 1), m.component("OBR", 3, 1))
+	it.StudyInstanceUID = m.component("ZDS", 1, 1)
+	return o, nil
+}
+
+// Create a UUID-derived UID. P3.5 B.2.
+func newStudyUID() string {
+	n, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		panic(err)
+	}
+	return "2.25." + n.String()
+}
+
+// Create an acknowledgement for "m", which is nil if it couldn't be parsed.
+// code is "AA" (accepted) or "AE" (error).
+func ack(m *hl7Message, code, text string) string {
+	controlID := ""
+	msh := "MSH|^~\\&|||||||ACK"
+	if m != nil {
+		controlID = m.field("MSH", 10)
+		msh = strings.Join([]string{"MSH", "^~\\&",
+			m.field("MSH", 5), m.field("MSH", 6), // receiving app and facility
+			m.field("MSH", 3), m.field("MSH", 4), // sending app and facility
+			"", "", "ACK^" + m.component("MSH", 9, 2), "ACK" + controlID,
+			m.field("MSH", 11), m.field("MSH", 12)}, "|")
+	}
+	return msh + "\rMSA|" + code + "|" + controlID + "|" + text + "\r"
+}
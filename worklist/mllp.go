@@ -0,0 +1,127 @@
+package worklist
+
+// MLLP (Minimal Lower Layer Protocol) listener for HL7v2 orders.
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/antibios/go-dicom/dicomlog"
+)
+
+// MLLP framing bytes.
+const (
+	mllpStart = 0x0b
+	mllpEnd   = 0x1c
+	mllpCR    = 0x0d
+)
+
+// The largest MLLP frame accepted. Orders are a few KB at most.
+const maxMLLPFrameBytes = 1 << 20
+
+// MLLPServer receives ORM^O01 messages over MLLP, applies them to a Worklist,
+// and acknowledges each with ACK (AA on success, AE on error).
+type MLLPServer struct {
+	wl       *Worklist
+	listener net.Listener
+}
+
+// NewMLLPServer creates a server that listens on "listenAddr", e.g., ":2575".
+// Run() starts accepting connections.
+func NewMLLPServer(wl *Worklist, listenAddr string) (*MLLPServer, error) {
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &MLLPServer{wl: wl, listener: listener}, nil
+}
+
+// ListenAddr returns the TCP address that the server is listening on.
+func (s *MLLPServer) ListenAddr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Run accepts connections until Close is called.
+func (s *MLLPServer) Run() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			dicomlog.Vprintf(0, "worklist.MLLPServer: Accept error: %v", err)
+			return
+		}
+		go s.serve(conn)
+	}
+}
+
+// Close stops accepting connections. Connections already accepted run until
+// the peer closes them.
+func (s *MLLPServer) Close() error {
+	return s.listener.Close()
+}
+
+func (s *MLLPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		msg, err := readMLLPFrame(r)
+		if err != nil {
+			if err != io.EOF {
+				dicomlog.Vprintf(0, "worklist.MLLPServer(%v): %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		m, err := parseHL7(msg)
+		if err == nil {
+			err = s.wl.HandleORM(msg)
+		}
+		code, text := "AA", ""
+		if err != nil {
+			dicomlog.Vprintf(0, "worklist.MLLPServer(%v): rejecting message: %v", conn.RemoteAddr(), err)
+			code, text = "AE", err.Error()
+		}
+		if _, err := conn.Write(mllpFrame(ack(m, code, text))); err != nil {
+			dicomlog.Vprintf(0, "worklist.MLLPServer(%v): write: %v", conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+// Read one MLLP frame and return its payload. Returns io.EOF if the stream
+// ends between frames.
+func readMLLPFrame(r *bufio.Reader) (string, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	if b != mllpStart {
+		return "", fmt.Errorf("mllp: expect start byte 0x0b, found 0x%02x", b)
+	}
+	var payload []byte
+	for {
+		chunk, err := r.ReadSlice(mllpEnd)
+		// The payload ends with mllpEnd.
+		if len(payload)+len(chunk) > maxMLLPFrameBytes+1 {
+			return "", fmt.Errorf("mllp: frame longer than %d bytes", maxMLLPFrameBytes)
+		}
+		payload = append(payload, chunk...)
+		if err == nil {
+			break
+		}
+		if err != bufio.ErrBufferFull {
+			return "", fmt.Errorf("mllp: unterminated frame: %v", err)
+		}
+	}
+	if b, err = r.ReadByte(); err != nil || b != mllpCR {
+		return "", fmt.Errorf("mllp: frame doesn't end with 0x1c 0x0d")
+	}
+	return string(payload[:len(payload)-1]), nil
+}
+
+func mllpFrame(msg string) []byte {
+	b := make([]byte, 0, len(msg)+3)
+	b = append(b, mllpStart)
+	b = append(b, msg...)
+	return append(b, mllpEnd, mllpCR)
+}
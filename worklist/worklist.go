@@ -0,0 +1,355 @@
+// Package worklist implements a Modality Worklist (MWL) that is fed by HL7v2
+// ORM^O01 messages and served by a netdicom.ServiceProvider via C-FIND.
+//
+// Orders can be delivered through an MLLP listener (see MLLPServer) or
+// directly through Worklist.HandleORM. The worklist is kept in memory.
+//
+//	wl := worklist.New()
+//	mllp, _ := worklist.NewMLLPServer(wl, ":2575")
+//	go mllp.Run()
+//	params := netdicom.ServiceProviderParams{CFind: wl.CFind, ...}
+package worklist
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	dicom "github.com/antibios/dicom"
+	dicomtag "github.com/antibios/dicom/pkg/tag"
+	"github.com/antibios/go-dicom/dicomlog"
+	"github.com/antibios/go-netdicom"
+)
+
+// FindSOPClassUID is the Modality Worklist Information Model - FIND SOP class.
+const FindSOPClassUID = "1.2.840.10008.5.1.4.31"
+
+// Item is one worklist entry: a requested procedure with a single scheduled
+// procedure step. Values are in DICOM encoding, e.g., "20240131" for a date
+// and "Doe^John" for a person name.
+type Item struct {
+	PatientName      string
+	PatientID        string
+	PatientBirthDate string
+	PatientSex       string
+
+	AccessionNumber               string
+	RequestedProcedureID          string
+	RequestedProcedureDescription string
+	StudyInstanceUID              string
+	ReferringPhysicianName        string
+
+	// Attributes of the scheduled procedure step.
+	ScheduledStationAETitle           string
+	Modality                          string
+	ScheduledProcedureStepStartDate   string
+	ScheduledProcedureStepStartTime   string
+	ScheduledProcedureStepID          string
+	ScheduledProcedureStepDescription string
+
+	// The placer and filler order numbers of the order the item was
+	// scheduled for. Worklist.Apply matches updates of the order by them.
+	// They aren't returned by C-FIND.
+	PlacerOrderNumber string
+	FillerOrderNumber string
+}
+
+// Top-level attributes of a worklist response.
+func (it *Item) attrs() map[dicomtag.Tag]string {
+	return map[dicomtag.Tag]string{
+		dicomtag.PatientName:                   it.PatientName,
+		dicomtag.PatientID:                     it.PatientID,
+		dicomtag.PatientBirthDate:              it.PatientBirthDate,
+		dicomtag.PatientSex:                    it.PatientSex,
+		dicomtag.AccessionNumber:               it.AccessionNumber,
+		dicomtag.RequestedProcedureID:          it.RequestedProcedureID,
+		dicomtag.RequestedProcedureDescription: it.RequestedProcedureDescription,
+		dicomtag.StudyInstanceUID:              it.StudyInstanceUID,
+		dicomtag.ReferringPhysicianName:        it.ReferringPhysicianName,
+	}
+}
+
+// Attributes within ScheduledProcedureStepSequence.
+func (it *Item) stepAttrs() map[dicomtag.Tag]string {
+	return map[dicomtag.Tag]string{
+		dicomtag.ScheduledStationAETitle:           it.ScheduledStationAETitle,
+		dicomtag.Modality:                          it.Modality,
+		dicomtag.ScheduledProcedureStepStartDate:   it.ScheduledProcedureStepStartDate,
+		dicomtag.ScheduledProcedureStepStartTime:   it.ScheduledProcedureStepStartTime,
+		dicomtag.ScheduledProcedureStepID:          it.ScheduledProcedureStepID,
+		dicomtag.ScheduledProcedureStepDescription: it.ScheduledProcedureStepDescription,
+	}
+}
+
+// Attributes matched as ranges when the key contains a '-'. P3.4 C.2.2.2.5.
+var rangeMatchTags = map[dicomtag.Tag]bool{
+	dicomtag.PatientBirthDate:                true,
+	dicomtag.ScheduledProcedureStepStartDate: true,
+	dicomtag.ScheduledProcedureStepStartTime: true,
+}
+
+// Worklist is an in-memory set of Items, keyed by accession number. It is
+// thread safe.
+type Worklist struct {
+	// OnOrder, if non-nil, is called for each order before it is applied.
+	// It may modify the item, e.g., to set ScheduledStationAETitle from the
+	// modality.
+	OnOrder func(o *Order)
+
+	mu    sync.Mutex
+	items map[string]Item
+}
+
+// New creates an empty Worklist.
+func New() *Worklist {
+	return &Worklist{items: map[string]Item{}}
+}
+
+// Put adds or replaces an item.
+func (w *Worklist) Put(it Item) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.items[it.AccessionNumber] = it
+}
+
+// Remove deletes the item with the accession number. Returns false if there
+// was none.
+func (w *Worklist) Remove(accessionNumber string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, ok := w.items[accessionNumber]
+	delete(w.items, accessionNumber)
+	return ok
+}
+
+// Items returns the items, ordered by scheduled date and time.
+func (w *Worklist) Items() []Item {
+	w.mu.Lock()
+	items := make([]Item, 0, len(w.items))
+	for _, it := range w.items {
+		items = append(items, it)
+	}
+	w.mu.Unlock()
+	sort.Slice(items, func(i, j int) bool {
+		a, b := &items[i], &items[j]
+		if a.ScheduledProcedureStepStartDate+a.ScheduledProcedureStepStartTime !=
+			b.ScheduledProcedureStepStartDate+b.ScheduledProcedureStepStartTime {
+			return a.ScheduledProcedureStepStartDate+a.ScheduledProcedureStepStartTime <
+				b.ScheduledProcedureStepStartDate+b.ScheduledProcedureStepStartTime
+		}
+		return a.AccessionNumber < b.AccessionNumber
+	})
+	return items
+}
+
+// Apply updates the worklist with an order. An update of an order already on
+// the worklist, matched by its placer or filler order number, or accession
+// number, replaces its item. If the order has no StudyInstanceUID, that of
+// the item replaced is kept, so that the modality sees the same study;
+// failing that, one is generated.
+func (w *Worklist) Apply(o *Order) {
+	w.mu.Lock()
+	old, found := w.findOrderLocked(&o.Item)
+	w.mu.Unlock()
+	if o.Item.StudyInstanceUID == "" {
+		if found && old.StudyInstanceUID != "" {
+			o.Item.StudyInstanceUID = old.StudyInstanceUID
+		} else {
+			o.Item.StudyInstanceUID = newStudyUID()
+		}
+	}
+	if w.OnOrder != nil {
+		w.OnOrder(o)
+	}
+	if found && old.AccessionNumber != o.Item.AccessionNumber {
+		w.Remove(old.AccessionNumber)
+	}
+	if o.Removes() {
+		dicomlog.Vprintf(1, "worklist: %s: removing %s", o.Control, o.Item.AccessionNumber)
+		w.Remove(o.Item.AccessionNumber)
+		return
+	}
+	dicomlog.Vprintf(1, "worklist: %s: scheduling %s for %s", o.Control, o.Item.AccessionNumber, o.Item.PatientID)
+	w.Put(o.Item)
+}
+
+// Returns the item scheduled for the same order as "it".
+//
+// REQUIRES: w.mu is held.
+func (w *Worklist) findOrderLocked(it *Item) (Item, bool) {
+	if old, ok := w.items[it.AccessionNumber]; ok {
+		return old, true
+	}
+	for _, old := range w.items {
+		if (it.PlacerOrderNumber != "" && old.PlacerOrderNumber == it.PlacerOrderNumber) ||
+			(it.FillerOrderNumber != "" && old.FillerOrderNumber == it.FillerOrderNumber) {
+			return old, true
+		}
+	}
+	return Item{}, false
+}
+
+// HandleORM parses an ORM^O01 message and applies it to the worklist.
+func (w *Worklist) HandleORM(msg string) error {
+	o, err := ParseORM(msg)
+	if err != nil {
+		return err
+	}
+	w.Apply(o)
+	return nil
+}
+
+// CFind implements netdicom.CFindCallback for the Modality Worklist
+// Information Model. Requests for other SOP classes are answered with an
+// error.
+func (w *Worklist) CFind(
+	conn netdicom.ConnectionState,
+	transferSyntaxUID string,
+	sopClassUID string,
+	filters []*dicom.Element,
+	ch chan netdicom.CFindResult) {
+	defer close(ch)
+	if sopClassUID != FindSOPClassUID {
+		ch <- netdicom.CFindResult{Err: fmt.Errorf("worklist: unsupported SOP class %s", sopClassUID)}
+		return
+	}
+	matchers := compileFilters(filters)
+	for _, it := range w.Items() {
+		elems, ok, err := matchItem(&it, filters, matchers)
+		if err != nil {
+			ch <- netdicom.CFindResult{Err: err}
+			return
+		}
+		if ok {
+			ch <- netdicom.CFindResult{Elements: elems}
+		}
+	}
+}
+
+// Match "it" against the C-FIND keys, compiled into "matchers" by
+// compileFilters. If it matches, returns the response elements: one for each
+// key.
+func matchItem(it *Item, filters []*dicom.Element, matchers map[*dicom.Element]keyMatcher) ([]*dicom.Element, bool, error) {
+	var resp []*dicom.Element
+	for _, filter := range filters {
+		if filter.Tag == dicomtag.ScheduledProcedureStepSequence {
+			var stepFilters []*dicom.Element
+			if items, ok := filter.Value.GetValue().([]*dicom.SequenceItemValue); ok && len(items) > 0 {
+				stepFilters, _ = items[0].GetValue().([]*dicom.Element)
+			}
+			stepResp, ok, err := matchAttrs(it.stepAttrs(), stepFilters, matchers)
+			if err != nil || !ok {
+				return nil, false, err
+			}
+			elem, err := dicom.NewElement(filter.Tag, [][]*dicom.Element{stepResp})
+			if err != nil {
+				return nil, false, err
+			}
+			resp = append(resp, elem)
+			continue
+		}
+		elems, ok, err := matchAttrs(it.attrs(), []*dicom.Element{filter}, matchers)
+		if err != nil || !ok {
+			return nil, false, err
+		}
+		resp = append(resp, elems...)
+	}
+	return resp, true, nil
+}
+
+// Match "attrs" against "filters", none of which is a sequence we know.
+func matchAttrs(attrs map[dicomtag.Tag]string, filters []*dicom.Element, matchers map[*dicom.Element]keyMatcher) ([]*dicom.Element, bool, error) {
+	var resp []*dicom.Element
+	for _, filter := range filters {
+		value, known := attrs[filter.Tag]
+		if !known {
+			// Return an empty value for keys we don't maintain.
+			var empty interface{} = []string{}
+			if _, isSeq := filter.Value.GetValue().([]*dicom.SequenceItemValue); isSeq {
+				empty = [][]*dicom.Element{}
+			}
+			elem, err := dicom.NewElement(filter.Tag, empty)
+			if err != nil {
+				return nil, false, err
+			}
+			resp = append(resp, elem)
+			continue
+		}
+		if !matchers[filter].match(value) {
+			return nil, false, nil
+		}
+		elem, err := dicom.NewElement(filter.Tag, []string{value})
+		if err != nil {
+			return nil, false, err
+		}
+		resp = append(resp, elem)
+	}
+	return resp, true, nil
+}
+
+// Returns the matching key in "filter", or "" for universal matching.
+func filterKey(filter *dicom.Element) string {
+	if v, ok := filter.Value.GetValue().([]string); ok && len(v) > 0 {
+		return strings.TrimSpace(v[0])
+	}
+	return ""
+}
+
+// Compile the keys of "filters", and of the ScheduledProcedureStepSequence
+// among them, for matchItem.
+func compileFilters(filters []*dicom.Element) map[*dicom.Element]keyMatcher {
+	matchers := map[*dicom.Element]keyMatcher{}
+	for _, filter := range filters {
+		if filter.Tag == dicomtag.ScheduledProcedureStepSequence {
+			if items, ok := filter.Value.GetValue().([]*dicom.SequenceItemValue); ok && len(items) > 0 {
+				stepFilters, _ := items[0].GetValue().([]*dicom.Element)
+				for _, stepFilter := range stepFilters {
+					matchers[stepFilter] = newKeyMatcher(filterKey(stepFilter), rangeMatchTags[stepFilter.Tag])
+				}
+			}
+			continue
+		}
+		matchers[filter] = newKeyMatcher(filterKey(filter), rangeMatchTags[filter.Tag])
+	}
+	return matchers
+}
+
+// keyMatcher matches values against a C-FIND key: single value, wildcard, or
+// range matching. P3.4 C.2.2.2. The zero value matches everything.
+type keyMatcher struct {
+	key     string
+	isRange bool
+	// Set for a key with wildcards.
+	re *regexp.Regexp
+}
+
+// Compile "key". If isRange, a key that contains a '-' is a range.
+func newKeyMatcher(key string, isRange bool) keyMatcher {
+	m := keyMatcher{key: key, isRange: isRange && strings.Contains(key, "-")}
+	if !m.isRange && key != "*" && strings.ContainsAny(key, "*?") {
+		pattern := regexp.QuoteMeta(key)
+		pattern = strings.NewReplacer(`\*`, ".*", `\?`, ".").Replace(pattern)
+		m.re = regexp.MustCompile("^" + pattern + "$")
+	}
+	return m
+}
+
+func (m keyMatcher) match(value string) bool {
+	switch {
+	case m.key == "" || m.key == "*":
+		return true
+	case m.isRange:
+		r := strings.SplitN(m.key, "-", 2)
+		return (r[0] == "" || value >= r[0]) && (r[1] == "" || value <= r[1])
+	case m.re != nil:
+		return m.re.MatchString(value)
+	}
+	return m.key == value
+}
+
+// Match a value against a C-FIND key. See keyMatcher.
+func matchValue(key, value string, isRange bool) bool {
+	return newKeyMatcher(key, isRange).match(value)
+}
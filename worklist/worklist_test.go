@@ -0,0 +1,145 @@
+package worklist
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+
+	dicom "github.com/antibios/dicom"
+	dicomtag "github.com/antibios/dicom/pkg/tag"
+	"github.com/antibios/go-netdicom"
+	"github.com/stretchr/testify/require"
+)
+
+const testORM = "MSH|^~\\&|RIS|HOSP|MWL|HOSP|20240131083000||ORM^O01|MSG0001|P|2.3\r" +
+	"PID|||PAT001^^^HOSP||Doe^John^Q||19700102|M\r" +
+	"PV1||O||||||1234^Welby^Marcus\r" +
+	"ORC|NW|PLC001|FIL001||SC\r" +
+	"OBR|1|PLC001|FIL001|CTHEAD^CT Head w/o contrast||||||||||||||ACC001|RP001|SPS001||||CT|||^^^202401311030\r" +
+	"ZDS|1.2.3.4^RIS^Application^DICOM\r"
+
+func TestParseORM(t *testing.T) {
+	o, err := ParseORM(testORM)
+	require.NoError(t, err)
+	require.Equal(t, "MSG0001", o.ControlID)
+	require.Equal(t, OrderNew, o.Control)
+	require.False(t, o.Removes())
+	require.Equal(t, Item{
+		PatientName:                       "Doe^John^Q",
+		PatientID:                         "PAT001",
+		PatientBirthDate:                  "19700102",
+		PatientSex:                        "M",
+		AccessionNumber:                   "ACC001",
+		RequestedProcedureID:              "RP001",
+		RequestedProcedureDescription:     "CT Head w/o contrast",
+		StudyInstanceUID:                  "1.2.3.4",
+		ReferringPhysicianName:            "Welby^Marcus",
+		Modality:                          "CT",
+		ScheduledProcedureStepStartDate:   "20240131",
+		ScheduledProcedureStepStartTime:   "1030",
+		ScheduledProcedureStepID:          "SPS001",
+		ScheduledProcedureStepDescription: "CT Head w/o contrast",
+		PlacerOrderNumber:                 "PLC001",
+		FillerOrderNumber:                 "FIL001",
+	}, o.Item)
+
+	_, err = ParseORM(strings.Replace(testORM, "ORM^O01", "ADT^A01", 1))
+	require.Error(t, err)
+}
+
+// An update of an order without ZDS-1 keeps the study of the order, also when
+// it changes the accession number.
+func TestApplyKeepsStudyInstanceUID(t *testing.T) {
+	wl := New()
+	orm := strings.Replace(testORM, "ZDS|1.2.3.4^RIS^Application^DICOM\r", "", 1)
+	require.NoError(t, wl.HandleORM(orm))
+	items := wl.Items()
+	require.Len(t, items, 1)
+	studyUID := items[0].StudyInstanceUID
+	require.NotEmpty(t, studyUID)
+
+	update := strings.Replace(orm, "ORC|NW|", "ORC|XO|", 1)
+	update = strings.Replace(update, "|ACC001|", "|ACC002|", 1)
+	require.NoError(t, wl.HandleORM(update))
+	items = wl.Items()
+	require.Len(t, items, 1)
+	require.Equal(t, "ACC002", items[0].AccessionNumber)
+	require.Equal(t, studyUID, items[0].StudyInstanceUID)
+}
+
+func TestMatchValue(t *testing.T) {
+	require.True(t, matchValue("", "x", false))
+	require.True(t, matchValue("Doe*", "Doe^John", false))
+	require.True(t, matchValue("D?e^John", "Doe^John", false))
+	require.False(t, matchValue("Doe", "Doe^John", false))
+	require.True(t, matchValue("20240101-20240131", "20240131", true))
+	require.False(t, matchValue("20240101-20240130", "20240131", true))
+	require.True(t, matchValue("20240101-", "20240131", true))
+}
+
+func TestCFind(t *testing.T) {
+	wl := New()
+	require.NoError(t, wl.HandleORM(testORM))
+	step := dicom.MustNewElement(dicomtag.ScheduledProcedureStepSequence, [][]*dicom.Element{{
+		dicom.MustNewElement(dicomtag.Modality, []string{"CT"}),
+		dicom.MustNewElement(dicomtag.ScheduledProcedureStepStartDate, []string{"20240131"}),
+	}})
+	find := func(filters ...*dicom.Element) [][]*dicom.Element {
+		ch := make(chan netdicom.CFindResult, 16)
+		go wl.CFind(netdicom.ConnectionState{}, "", FindSOPClassUID, filters, ch)
+		var results [][]*dicom.Element
+		for r := range ch {
+			require.NoError(t, r.Err)
+			results = append(results, r.Elements)
+		}
+		return results
+	}
+	results := find(dicom.MustNewElement(dicomtag.PatientName, []string{"Doe*"}), step)
+	require.Len(t, results, 1)
+	require.Equal(t, []string{"Doe^John^Q"}, results[0][0].Value.GetValue())
+
+	require.Len(t, find(dicom.MustNewElement(dicomtag.PatientName, []string{"Roe*"}), step), 0)
+
+	cancel := strings.Replace(testORM, "ORC|NW|", "ORC|CA|", 1)
+	require.NoError(t, wl.HandleORM(cancel))
+	require.Len(t, find(step), 0)
+}
+
+func TestMLLP(t *testing.T) {
+	wl := New()
+	s, err := NewMLLPServer(wl, "localhost:0")
+	require.NoError(t, err)
+	defer s.Close()
+	go s.Run()
+
+	conn, err := net.Dial("tcp", s.ListenAddr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	_, err = conn.Write(mllpFrame(testORM))
+	require.NoError(t, err)
+	reply, err := readMLLPFrame(r)
+	require.NoError(t, err)
+	require.Contains(t, reply, "MSA|AA|MSG0001")
+	require.Len(t, wl.Items(), 1)
+
+	_, err = conn.Write(mllpFrame("MSH|^~\\&|RIS|HOSP|MWL|HOSP|||ORM^O01|MSG0002|P|2.3\r"))
+	require.NoError(t, err)
+	reply, err = readMLLPFrame(r)
+	require.NoError(t, err)
+	require.Contains(t, reply, "MSA|AE|MSG0002")
+}
+
+func TestMLLPFrameLimit(t *testing.T) {
+	frame := mllpFrame(strings.Repeat("x", maxMLLPFrameBytes+1))
+	_, err := readMLLPFrame(bufio.NewReader(strings.NewReader(string(frame))))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "frame longer than")
+
+	frame = mllpFrame(strings.Repeat("x", maxMLLPFrameBytes))
+	msg, err := readMLLPFrame(bufio.NewReader(strings.NewReader(string(frame))))
+	require.NoError(t, err)
+	require.Len(t, msg, maxMLLPFrameBytes)
+}
@@ -0,0 +1,107 @@
+package netdicom
+
+// This file implements WriteCoalescingParams: gathering the P-DATA-TF PDUs
+// that the statemachine sends back to back into fewer writes, so that, e.g., a
+// C-FIND with thousands of matches doesn't cost two writes per match.
+
+import (
+	"fmt"
+	"time"
+)
+
+// DefaultWriteCoalescingBytes is the default value of
+// WriteCoalescingParams.MaxBytes.
+const DefaultWriteCoalescingBytes = 64 << 10
+
+// DefaultWriteCoalescingDelay is the default value of
+// WriteCoalescingParams.MaxDelay.
+const DefaultWriteCoalescingDelay = 5 * time.Millisecond
+
+// WriteCoalescingParams configures the coalescing of outbound P-DATA-TF PDUs.
+// PDUs are held in a buffer while more are queued to be sent, and the buffer
+// is written as soon as the queue runs dry, so a lone response, or the last
+// one of an operation, is never delayed. Other PDUs, e.g., A-RELEASE-RQ, are
+// written at once, after the buffer. Coalescing is off while a FaultInjector
+// is set.
+type WriteCoalescingParams struct {
+	// MaxBytes is the size at which the buffer is written even though
+	// more PDUs are queued. If zero, DefaultWriteCoalescingBytes is used.
+	MaxBytes int
+
+	// MaxDelay bounds the time the first PDU in the buffer waits for more
+	// to join it. If zero, DefaultWriteCoalescingDelay is used.
+	MaxDelay time.Duration
+}
+
+func (p *WriteCoalescingParams) validate() error {
+	if p == nil {
+		return nil
+	}
+	if p.MaxBytes < 0 || p.MaxDelay < 0 {
+		return fmt.Errorf("WriteCoalescing: negative MaxBytes or MaxDelay")
+	}
+	return nil
+}
+
+// writeCoalescer is the buffer of the PDUs not yet written to the connection.
+// Used only by the statemachine goroutine.
+type writeCoalescer struct {
+	maxBytes int
+	maxDelay time.Duration
+	buf      []byte
+	// When the first PDU in buf was added.
+	since time.Time
+}
+
+// Returns nil, i.e., no coalescing, if params is nil or faults is set.
+func newWriteCoalescer(params *WriteCoalescingParams, faults FaultInjector) *writeCoalescer {
+	if params == nil || faults != nil {
+		return nil
+	}
+	c := &writeCoalescer{maxBytes: params.MaxBytes, maxDelay: params.MaxDelay}
+	if c.maxBytes == 0 {
+		c.maxBytes = DefaultWriteCoalescingBytes
+	}
+	if c.maxDelay == 0 {
+		c.maxDelay = DefaultWriteCoalescingDelay
+	}
+	return c
+}
+
+// Append an encoded PDU. Reports whether the buffer is full.
+func (c *writeCoalescer) add(data []byte, now time.Time) bool {
+	if len(c.buf) == 0 {
+		c.since = now
+	}
+	c.buf = append(c.buf, data...)
+	return len(c.buf) >= c.maxBytes
+}
+
+// Reports whether the buffer must be written, given the number of events
+// queued for the statemachine to send.
+func (c *writeCoalescer) due(queued int, now time.Time) bool {
+	if c == nil || len(c.buf) == 0 {
+		return false
+	}
+	return queued == 0 || now.Sub(c.since) >= c.maxDelay
+}
+
+// Remove and return the buffered bytes.
+func (c *writeCoalescer) take() []byte {
+	if c == nil || len(c.buf) == 0 {
+		return nil
+	}
+	data := c.buf
+	c.buf = nil
+	return data
+}
+
+// Write the PDUs buffered by the coalescer, if any. Returns false if the
+// write failed, in which case the connection is closed and evt17 is queued.
+func flushWrites(sm *stateMachine) bool {
+	data := sm.coalescer.take()
+	if len(data) == 0 || sm.conn == nil {
+		return true
+	}
+	return writePDUData(sm, data)
+}
@@ -0,0 +1,86 @@
+package netdicom
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	dicom "github.com/antibios/dicom"
+	"github.com/antibios/dicom/pkg/tag"
+	"github.com/antibios/go-netdicom/sopclass"
+	"github.com/stretchr/testify/require"
+)
+
+// countingConn counts the writes to a connection.
+type countingConn struct {
+	net.Conn
+	writes int64
+}
+
+func (c *countingConn) Write(data []byte) (int, error) {
+	atomic.AddInt64(&c.writes, 1)
+	return c.Conn.Write(data)
+}
+
+// Runs a C-FIND that matches "n" patients against a provider with the given
+// coalescing parameters. Returns the number of writes made by the provider.
+func runCFindWithCoalescing(tb testing.TB, n int, coalescing *WriteCoalescingParams) int64 {
+	userConn, providerConn := net.Pipe()
+	counter := &countingConn{Conn: providerConn}
+	RunProviderForConn(counter, ServiceProviderParams{
+		CFind: func(conn ConnectionState, transferSyntaxUID, sopClassUID string, filters []*dicom.Element, ch chan CFindResult) {
+			for i := 0; i < n; i++ {
+				ch <- CFindResult{Elements: []*dicom.Element{
+					dicom.MustNewElement(tag.PatientName, fmt.Sprintf("patient%d", i))}}
+			}
+			close(ch)
+		},
+		WriteCoalescing: coalescing,
+	})
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.QRFindClasses})
+	require.NoError(tb, err)
+	su.SetConn(userConn)
+	matches := 0
+	for result := range su.CFind(QRLevelPatient, []*dicom.Element{dicom.MustNewElement(tag.PatientName, "*")}) {
+		require.NoError(tb, result.Err)
+		matches++
+	}
+	require.Equal(tb, n, matches)
+	su.Release()
+	return atomic.LoadInt64(&counter.writes)
+}
+
+// Each C-FIND response is a command PDU and a data PDU. With coalescing they
+// share a write, and responses queued back to back may share one too.
+func TestWriteCoalescing(t *testing.T) {
+	const n = 200
+	require.GreaterOrEqual(t, runCFindWithCoalescing(t, n, nil), int64(2*n))
+	require.LessOrEqual(t, runCFindWithCoalescing(t, n, &WriteCoalescingParams{}), int64(n+4))
+}
+
+func TestWriteCoalescingParamsValidation(t *testing.T) {
+	_, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:      sopclass.VerificationClasses,
+		WriteCoalescing: &WriteCoalescingParams{MaxBytes: -1},
+	})
+	require.Error(t, err)
+}
+
+func BenchmarkCFindManyResults(b *testing.B) {
+	for _, bc := range []struct {
+		name       string
+		coalescing *WriteCoalescingParams
+	}{
+		{"Uncoalesced", nil},
+		{"Coalesced", &WriteCoalescingParams{}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			var writes int64
+			for i := 0; i < b.N; i++ {
+				writes += runCFindWithCoalescing(b, 5000, bc.coalescing)
+			}
+			b.ReportMetric(float64(writes)/float64(b.N), "writes/op")
+		})
+	}
+}